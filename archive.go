@@ -0,0 +1,827 @@
+package fsx
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/halimath/fsx/internal/linkutil"
+)
+
+var (
+	// ErrUnsafePath is returned when extracting an archive that contains an
+	// entry or a link target that is absolute or escapes the extraction
+	// root.
+	ErrUnsafePath = errors.New("unsafe path in archive")
+
+	// ErrLimitExceeded is returned when extracting an archive that exceeds
+	// one of the limits set in ExtractOptions.
+	ErrLimitExceeded = errors.New("archive limit exceeded")
+)
+
+// ArchiveOptions customize the behavior of ArchiveTar and ArchiveZip. A nil
+// *ArchiveOptions is equivalent to the zero value.
+type ArchiveOptions struct {
+	// Filter selects the entries to add to the archive.
+	Filter
+}
+
+// ExtractOptions customize the behavior of ExtractTar and ExtractZip. A nil
+// *ExtractOptions is equivalent to the zero value. When extracting untrusted
+// archives, set the limits to reasonable values.
+type ExtractOptions struct {
+	// Filter selects the entries to extract.
+	Filter
+
+	// Root defines the directory inside the destination to extract into. It
+	// is created if it does not exist. Defaults to ".".
+	Root string
+
+	// MaxEntries limits the number of entries read from the archive. Zero
+	// means no limit.
+	MaxEntries int
+
+	// MaxFileSize limits the size of a single extracted file in bytes. Zero
+	// means no limit.
+	MaxFileSize int64
+
+	// MaxTotalSize limits the sum of the sizes of all extracted files in
+	// bytes. Zero means no limit.
+	MaxTotalSize int64
+
+	// PreserveOwner enables applying the numeric owner and group stored in a
+	// tar archive using Chown.
+	PreserveOwner bool
+}
+
+// ArchiveTar writes the tree rooted at root in src as a tar stream to w.
+// Names in the archive are relative to root. Regular files, directories and
+// symlinks are written with their permission, modification time (rounded to
+// seconds) and - if provided by the filesystem's fs.FileInfo.Sys - numeric
+// owner. Symlinks are detected if src provides a Readlink method; their
+// targets are stored relative to the link's directory. Regular files that
+// are hard links to a file already written are stored as hard links if src
+// provides a SameFile method (as fsx.FS does).
+//
+// ArchiveTar does not compress the stream; wrap w with a gzip.Writer to
+// create a compressed archive.
+func ArchiveTar(w io.Writer, src fs.FS, root string, opts *ArchiveOptions) error {
+	if opts == nil {
+		opts = &ArchiveOptions{}
+	}
+
+	if root == "" {
+		root = "."
+	}
+
+	tw := tar.NewWriter(w)
+	links := newHardLinks(src)
+
+	err := walkTree(src, root, &opts.Filter, func(e treeEntry) error {
+		hdr := &tar.Header{
+			Name:    e.path,
+			Mode:    tarMode(e.info.Mode()),
+			ModTime: e.info.ModTime(),
+		}
+
+		if uid, gid, ok := fileOwner(e.info); ok {
+			hdr.Uid = uid
+			hdr.Gid = gid
+		}
+
+		switch {
+		case e.symlink:
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Mode = 0777
+			hdr.Linkname = archiveLinkname(root, e)
+
+		case e.info.IsDir():
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+
+		case e.info.Mode().IsRegular():
+			if first, ok := links.find(e); ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				break
+			}
+
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = e.info.Size()
+
+		default:
+			return &fs.PathError{
+				Op:   "ArchiveTar",
+				Path: e.path,
+				Err:  ErrNotSupported,
+			}
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			return copyContent(tw, src, joinPath(root, e.path))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// ExtractTar extracts the tar stream read from r into dst. Symlinks are
+// created using LinkFS; hard links are created using LinkFS if supported or
+// copied otherwise. Permissions, modification times (if dst satisfies
+// ChtimesFS) and - if enabled - ownership are restored. Special bits such as
+// setuid are not restored.
+//
+// Entries with absolute names, names escaping the extraction root as well as
+// symlinks pointing outside of the extraction root are rejected with an error
+// wrapping ErrUnsafePath. ExtractTar stops with an error wrapping
+// ErrLimitExceeded if a limit set in opts is exceeded. Files extracted before
+// an error occurred are not removed.
+func ExtractTar(dst FS, r io.Reader, opts *ExtractOptions) error {
+	x, err := newExtractor(dst, opts)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
+		name, ok, err := x.begin(hdr.Name, hdr.Typeflag == tar.TypeDir)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		meta := extractMeta{
+			perm:  hdr.FileInfo().Mode().Perm(),
+			mtime: hdr.ModTime,
+			uid:   hdr.Uid,
+			gid:   hdr.Gid,
+			owner: true,
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = x.dir(name, meta)
+		case tar.TypeReg:
+			err = x.file(name, meta, hdr.Size, tr)
+		case tar.TypeSymlink:
+			err = x.symlink(name, hdr.Linkname)
+		case tar.TypeLink:
+			err = x.link(name, hdr.Linkname, meta)
+		default:
+			err = &fs.PathError{
+				Op:   "Extract",
+				Path: hdr.Name,
+				Err:  fmt.Errorf("%w: tar entry type %q", ErrNotSupported, hdr.Typeflag),
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return x.finish()
+}
+
+// ArchiveZip writes the tree rooted at root in src as a zip archive to w.
+// Names in the archive are relative to root. Files are compressed using
+// deflate. Permissions and modification times are stored with each entry.
+// Symlinks are detected if src provides a Readlink method and are stored
+// using the Info-ZIP convention: the entry's mode contains fs.ModeSymlink and
+// its content holds the target relative to the link's directory. zip does not
+// support hard links; they are stored as separate files.
+func ArchiveZip(w io.Writer, src fs.FS, root string, opts *ArchiveOptions) error {
+	if opts == nil {
+		opts = &ArchiveOptions{}
+	}
+
+	if root == "" {
+		root = "."
+	}
+
+	zw := zip.NewWriter(w)
+
+	err := walkTree(src, root, &opts.Filter, func(e treeEntry) error {
+		hdr := &zip.FileHeader{
+			Name:     e.path,
+			Method:   zip.Deflate,
+			Modified: e.info.ModTime(),
+		}
+
+		switch {
+		case e.symlink:
+			hdr.SetMode(fs.ModeSymlink | 0777)
+			hdr.Method = zip.Store
+
+			out, err := zw.CreateHeader(hdr)
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(out, archiveLinkname(root, e))
+			return err
+
+		case e.info.IsDir():
+			hdr.Name += "/"
+			hdr.Method = zip.Store
+			hdr.SetMode(e.info.Mode())
+
+			_, err := zw.CreateHeader(hdr)
+			return err
+
+		case e.info.Mode().IsRegular():
+			hdr.SetMode(e.info.Mode())
+
+			out, err := zw.CreateHeader(hdr)
+			if err != nil {
+				return err
+			}
+			return copyContent(out, src, joinPath(root, e.path))
+
+		default:
+			return &fs.PathError{
+				Op:   "ArchiveZip",
+				Path: e.path,
+				Err:  ErrNotSupported,
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// ExtractZip extracts the zip archive of the given size read from r into
+// dst. It works like ExtractTar. Symlinks stored using the Info-ZIP
+// convention are created using LinkFS.
+func ExtractZip(dst FS, r io.ReaderAt, size int64, opts *ExtractOptions) error {
+	x, err := newExtractor(dst, opts)
+	if err != nil {
+		return err
+	}
+
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range zr.File {
+		isDir := strings.HasSuffix(f.Name, "/")
+
+		name, ok, err := x.begin(f.Name, isDir)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		meta := extractMeta{
+			perm:  f.Mode().Perm(),
+			mtime: f.Modified,
+		}
+
+		switch {
+		case isDir || f.Mode().IsDir():
+			err = x.dir(name, meta)
+
+		case f.Mode()&fs.ModeSymlink != 0:
+			var target string
+			target, err = readZipLink(f)
+			if err == nil {
+				err = x.symlink(name, target)
+			}
+
+		case f.Mode().IsRegular():
+			var rc io.ReadCloser
+			rc, err = f.Open()
+			if err == nil {
+				err = x.file(name, meta, int64(f.UncompressedSize64), rc)
+				rc.Close()
+			}
+
+		default:
+			err = &fs.PathError{
+				Op:   "Extract",
+				Path: f.Name,
+				Err:  fmt.Errorf("%w: zip entry mode %s", ErrNotSupported, f.Mode()),
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return x.finish()
+}
+
+// maxLinkTargetLen limits the size of a symlink target read from a zip
+// archive.
+const maxLinkTargetLen = 4096
+
+func readZipLink(f *zip.File) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	target, err := io.ReadAll(io.LimitReader(rc, maxLinkTargetLen+1))
+	if err != nil {
+		return "", err
+	}
+
+	if len(target) > maxLinkTargetLen {
+		return "", &fs.PathError{
+			Op:   "Extract",
+			Path: f.Name,
+			Err:  ErrLimitExceeded,
+		}
+	}
+
+	return string(target), nil
+}
+
+// --
+
+// tarMode converts m to the mode bits stored in a tar header.
+func tarMode(m fs.FileMode) int64 {
+	mode := int64(m.Perm())
+	if m&fs.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if m&fs.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if m&fs.ModeSticky != 0 {
+		mode |= 01000
+	}
+	return mode
+}
+
+// fileOwner extracts the numeric owner and group from info's Sys value. It
+// supports all values that are structs (or pointers to structs) with integer
+// fields named Uid and Gid, such as syscall.Stat_t, memfs.Stat or
+// tar.Header.
+func fileOwner(info fs.FileInfo) (uid, gid int, ok bool) {
+	v := reflect.ValueOf(info.Sys())
+	if v.Kind() == reflect.Pointer {
+		v = v.Elem()
+	}
+
+	if v.Kind() != reflect.Struct {
+		return 0, 0, false
+	}
+
+	uid, ok = intField(v, "Uid")
+	if !ok {
+		return 0, 0, false
+	}
+
+	gid, ok = intField(v, "Gid")
+	return uid, gid, ok
+}
+
+func intField(v reflect.Value, name string) (int, bool) {
+	f := v.FieldByName(name)
+	switch f.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return int(f.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int(f.Uint()), true
+	default:
+		return 0, false
+	}
+}
+
+// archiveLinkname returns the target of the symlink e relative to the link's
+// directory.
+func archiveLinkname(root string, e treeEntry) string {
+	return relativePath(path.Dir(joinPath(root, e.path)), e.target)
+}
+
+// relativePath returns the path of target relative to the directory dir.
+// Both paths must be relative to the same root.
+func relativePath(dir, target string) string {
+	from := pathElements(dir)
+	to := pathElements(target)
+
+	common := 0
+	for common < len(from) && common < len(to) && from[common] == to[common] {
+		common++
+	}
+
+	parts := make([]string, 0, len(from)-common+len(to)-common)
+	for i := common; i < len(from); i++ {
+		parts = append(parts, "..")
+	}
+	parts = append(parts, to[common:]...)
+
+	if len(parts) == 0 {
+		return "."
+	}
+	return strings.Join(parts, "/")
+}
+
+// pathElements returns the elements of the cleaned path p. The root "."
+// has no elements.
+func pathElements(p string) []string {
+	p = path.Clean(p)
+	if p == "." {
+		return nil
+	}
+	return splitAll(p)
+}
+
+// copyContent copies the content of the file name in fsys to w.
+func copyContent(w io.Writer, fsys fs.FS, name string) error {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// hardLinks detects regular files that are hard links to a file seen before.
+type hardLinks struct {
+	sameFile func(fi1, fi2 fs.FileInfo) bool
+	bySize   map[int64][]treeEntry
+}
+
+func newHardLinks(fsys fs.FS) *hardLinks {
+	h := &hardLinks{bySize: make(map[int64][]treeEntry)}
+
+	if sf, ok := fsys.(interface {
+		SameFile(fi1, fi2 fs.FileInfo) bool
+	}); ok {
+		h.sameFile = sf.SameFile
+	}
+
+	return h
+}
+
+// find returns the path of a previously seen file that is the same file as e.
+// If no such file exists, e is recorded and false is returned.
+func (h *hardLinks) find(e treeEntry) (string, bool) {
+	if h.sameFile == nil {
+		return "", false
+	}
+
+	size := e.info.Size()
+	for _, c := range h.bySize[size] {
+		if h.sameFile(c.info, e.info) {
+			return c.path, true
+		}
+	}
+
+	h.bySize[size] = append(h.bySize[size], e)
+	return "", false
+}
+
+// --
+
+// extractMeta holds the metadata applied to extracted entries.
+type extractMeta struct {
+	perm     fs.FileMode
+	mtime    time.Time
+	uid, gid int
+	owner    bool
+}
+
+type pendingSymlink struct {
+	name, target string
+}
+
+type pendingDir struct {
+	name string
+	meta extractMeta
+}
+
+// extractor implements the shared logic of ExtractTar and ExtractZip.
+type extractor struct {
+	dst      FS
+	opts     *ExtractOptions
+	root     string
+	entries  int
+	total    int64
+	symlinks []pendingSymlink
+	dirs     []pendingDir
+}
+
+func newExtractor(dst FS, opts *ExtractOptions) (*extractor, error) {
+	if opts == nil {
+		opts = &ExtractOptions{}
+	}
+
+	root := opts.Root
+	if root == "" {
+		root = "."
+	}
+
+	if root != "." {
+		if err := MkdirAll(dst, root, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	return &extractor{
+		dst:  dst,
+		opts: opts,
+		root: root,
+	}, nil
+}
+
+// safeName validates and cleans the name of an archive entry or link target.
+func safeName(name string) (string, error) {
+	if strings.HasPrefix(name, "/") || strings.Contains(name, "\\") || (len(name) > 1 && name[1] == ':') {
+		return "", ErrUnsafePath
+	}
+
+	clean := path.Clean(strings.TrimSuffix(name, "/"))
+	if !fs.ValidPath(clean) {
+		return "", ErrUnsafePath
+	}
+
+	return clean, nil
+}
+
+// begin counts and validates the entry name. It returns the cleaned name and
+// false if the entry should be skipped.
+func (x *extractor) begin(name string, isDir bool) (string, bool, error) {
+	x.entries++
+	if x.opts.MaxEntries > 0 && x.entries > x.opts.MaxEntries {
+		return "", false, &fs.PathError{
+			Op:   "Extract",
+			Path: name,
+			Err:  fmt.Errorf("%w: more than %d entries", ErrLimitExceeded, x.opts.MaxEntries),
+		}
+	}
+
+	clean, err := safeName(name)
+	if err != nil {
+		return "", false, &fs.PathError{
+			Op:   "Extract",
+			Path: name,
+			Err:  err,
+		}
+	}
+
+	if clean == "." || !x.opts.Filter.Match(clean, isDir) {
+		return "", false, nil
+	}
+
+	return clean, true, nil
+}
+
+// path returns the destination path of the archive entry name.
+func (x *extractor) path(name string) string {
+	return joinPath(x.root, name)
+}
+
+// prepare creates the parent directories of name and removes a symlink or
+// file found at name. Removing symlinks prevents writing through a link
+// pointing outside of the extraction root.
+func (x *extractor) prepare(name string) error {
+	p := x.path(name)
+
+	if dir := path.Dir(p); dir != "." {
+		if err := MkdirAll(x.dst, dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	if _, ok := linkutil.Readlink(x.dst, p); ok {
+		return x.dst.Remove(p)
+	}
+
+	if info, err := fs.Stat(x.dst, p); err == nil && !info.IsDir() {
+		return x.dst.Remove(p)
+	}
+
+	return nil
+}
+
+func (x *extractor) dir(name string, meta extractMeta) error {
+	if _, ok := linkutil.Readlink(x.dst, x.path(name)); ok {
+		if err := x.dst.Remove(x.path(name)); err != nil {
+			return err
+		}
+	}
+
+	if err := MkdirAll(x.dst, x.path(name), 0755); err != nil {
+		return err
+	}
+
+	// Permissions and times are applied after all children have been
+	// extracted.
+	x.dirs = append(x.dirs, pendingDir{name: name, meta: meta})
+	return nil
+}
+
+func (x *extractor) file(name string, meta extractMeta, size int64, r io.Reader) (err error) {
+	limit := int64(-1)
+	if x.opts.MaxFileSize > 0 {
+		limit = x.opts.MaxFileSize
+	}
+	if x.opts.MaxTotalSize > 0 && (limit < 0 || x.opts.MaxTotalSize-x.total < limit) {
+		limit = x.opts.MaxTotalSize - x.total
+	}
+
+	if limit >= 0 && size > limit {
+		return &fs.PathError{
+			Op:   "Extract",
+			Path: name,
+			Err:  fmt.Errorf("%w: size %d", ErrLimitExceeded, size),
+		}
+	}
+
+	if err := x.prepare(name); err != nil {
+		return err
+	}
+
+	p := x.path(name)
+
+	f, err := x.dst.OpenFile(p, O_WRONLY|O_CREATE|O_TRUNC, meta.perm)
+	if err != nil {
+		return err
+	}
+
+	if limit >= 0 {
+		// Do not trust the size stored in the archive.
+		r = io.LimitReader(r, limit+1)
+	}
+
+	n, err := io.Copy(f, r)
+	if cerr := f.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	x.total += n
+	if limit >= 0 && n > limit {
+		return &fs.PathError{
+			Op:   "Extract",
+			Path: name,
+			Err:  fmt.Errorf("%w: size exceeds %d", ErrLimitExceeded, limit),
+		}
+	}
+
+	return x.apply(p, meta)
+}
+
+func (x *extractor) symlink(name, linkname string) error {
+	if strings.HasPrefix(linkname, "/") {
+		return &fs.PathError{
+			Op:   "Extract",
+			Path: name,
+			Err:  fmt.Errorf("%w: absolute link target %s", ErrUnsafePath, linkname),
+		}
+	}
+
+	target, err := safeName(path.Join(path.Dir(name), linkname))
+	if err != nil {
+		return &fs.PathError{
+			Op:   "Extract",
+			Path: name,
+			Err:  fmt.Errorf("%w: link target %s", err, linkname),
+		}
+	}
+
+	// Symlinks are created last as filesystems may require the target to
+	// exist.
+	x.symlinks = append(x.symlinks, pendingSymlink{name: name, target: target})
+	return nil
+}
+
+func (x *extractor) link(name, linkname string, meta extractMeta) error {
+	target, err := safeName(linkname)
+	if err != nil {
+		return &fs.PathError{
+			Op:   "Extract",
+			Path: name,
+			Err:  fmt.Errorf("%w: link target %s", err, linkname),
+		}
+	}
+
+	if err := x.prepare(name); err != nil {
+		return err
+	}
+
+	if lfs, ok := x.dst.(LinkFS); ok {
+		return lfs.Link(x.path(target), x.path(name))
+	}
+
+	info, err := fs.Stat(x.dst, x.path(target))
+	if err != nil {
+		return err
+	}
+
+	// The copy counts towards the total size like a regular entry.
+	if x.opts.MaxTotalSize > 0 && info.Size() > x.opts.MaxTotalSize-x.total {
+		return &fs.PathError{
+			Op:   "Extract",
+			Path: name,
+			Err:  fmt.Errorf("%w: size %d", ErrLimitExceeded, info.Size()),
+		}
+	}
+
+	if err := copyFile(x.dst, x.path(name), x.dst, x.path(target), info.Mode().Perm()); err != nil {
+		return err
+	}
+	x.total += info.Size()
+
+	return x.apply(x.path(name), meta)
+}
+
+// apply applies ownership and modification time to the extracted entry p.
+func (x *extractor) apply(p string, meta extractMeta) error {
+	if err := Chmod(x.dst, p, meta.perm); err != nil {
+		return err
+	}
+
+	if x.opts.PreserveOwner && meta.owner {
+		if err := Chown(x.dst, p, meta.uid, meta.gid); err != nil {
+			return err
+		}
+	}
+
+	if cfs, ok := x.dst.(ChtimesFS); ok && !meta.mtime.IsZero() {
+		if err := cfs.Chtimes(p, meta.mtime, meta.mtime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// finish creates pending symlinks and applies the metadata of directories.
+func (x *extractor) finish() error {
+	if len(x.symlinks) > 0 {
+		lfs, ok := x.dst.(LinkFS)
+		if !ok {
+			return &fs.PathError{
+				Op:   "Extract",
+				Path: x.symlinks[0].name,
+				Err:  ErrNotSupported,
+			}
+		}
+
+		for _, l := range x.symlinks {
+			if err := x.prepare(l.name); err != nil {
+				return err
+			}
+
+			if err := lfs.Symlink(x.path(l.target), x.path(l.name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Apply directory metadata to children before their parents.
+	sort.SliceStable(x.dirs, func(i, j int) bool { return x.dirs[i].name > x.dirs[j].name })
+	for _, d := range x.dirs {
+		if err := x.apply(x.path(d.name), d.meta); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
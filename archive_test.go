@@ -0,0 +1,288 @@
+package fsx_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	"github.com/halimath/fixture"
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/memfs"
+)
+
+var archiveMtime = time.Date(2023, 5, 17, 10, 30, 0, 0, time.UTC)
+
+func archiveSource(t *testing.T) fsx.LinkFS {
+	t.Helper()
+
+	fsys := mustFromTxtar(t, `-- bin/run.sh mode=0755 --
+#!/bin/sh
+-- docs/ mode=0700 --
+-- docs/index.md --
+# Docs
+-- README.md -> docs/index.md --
+`)
+
+	expect.That(t, expect.FailNow(is.NoError(fsys.Link("bin/run.sh", "bin/start.sh"))))
+
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == "." {
+			return err
+		}
+		return fsys.(fsx.ChtimesFS).Chtimes(p, archiveMtime, archiveMtime)
+	})
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	return fsys
+}
+
+func expectArchiveTree(t *testing.T, fsys fsx.LinkFS, hardLinks bool) {
+	t.Helper()
+
+	dump, err := fsx.DumpTxtar(fsys)
+	expect.That(t, expect.FailNow(is.NoError(err)), is.EqualToStringByLines(string(dump), `-- README.md -> docs/index.md --
+-- bin/run.sh mode=0755 --
+#!/bin/sh
+-- bin/start.sh mode=0755 --
+#!/bin/sh
+-- docs/ mode=0700 --
+-- docs/index.md --
+# Docs
+`))
+
+	info, err := fs.Stat(fsys, "bin/run.sh")
+	expect.That(t, expect.FailNow(is.NoError(err)), is.EqualTo(info.ModTime().UTC(), archiveMtime))
+
+	info, err = fs.Stat(fsys, "docs")
+	expect.That(t, expect.FailNow(is.NoError(err)), is.EqualTo(info.ModTime().UTC(), archiveMtime))
+
+	if hardLinks {
+		info2, err := fs.Stat(fsys, "bin/start.sh")
+		expect.That(t, expect.FailNow(is.NoError(err)), is.EqualTo(fsys.SameFile(info, info2), false))
+
+		info, _ = fs.Stat(fsys, "bin/run.sh")
+		expect.That(t, is.EqualTo(fsys.SameFile(info, info2), true))
+	}
+}
+
+func TestArchiveTar(t *testing.T) {
+	var buf bytes.Buffer
+	expect.That(t, expect.FailNow(is.NoError(fsx.ArchiveTar(&buf, archiveSource(t), ".", nil))))
+
+	var names []string
+	var linkType byte
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, hdr.Name)
+		if hdr.Name == "bin/start.sh" {
+			linkType = hdr.Typeflag
+		}
+	}
+
+	expect.That(t,
+		is.DeepEqualTo(names, []string{"README.md", "bin/", "bin/run.sh", "bin/start.sh", "docs/", "docs/index.md"}),
+		is.EqualTo(linkType, tar.TypeLink),
+	)
+
+	dst := memfs.New()
+	expect.That(t, expect.FailNow(is.NoError(fsx.ExtractTar(dst, &buf, nil))))
+
+	expectArchiveTree(t, dst, true)
+}
+
+func TestArchiveTar_osfs(t *testing.T) {
+	fixture.With(t, new(interfaceFixture)).
+		Run("roundTrip", func(t *testing.T, f *interfaceFixture) {
+			var buf bytes.Buffer
+			expect.That(t, expect.FailNow(is.NoError(fsx.ArchiveTar(&buf, archiveSource(t), ".", nil))))
+
+			expect.That(t, expect.FailNow(is.NoError(fsx.ExtractTar(f.fs, bytes.NewReader(buf.Bytes()), &fsx.ExtractOptions{Root: "out"}))))
+
+			sub, err := fs.Sub(f.fs, "out")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			content, err := fs.ReadFile(sub, "README.md")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "# Docs\n"))
+
+			target, err := f.fs.(fsx.LinkFS).Readlink("out/README.md")
+			expect.That(t, is.NoError(err), is.EqualTo(target, "out/docs/index.md"))
+
+			var again bytes.Buffer
+			expect.That(t, expect.FailNow(is.NoError(fsx.ArchiveTar(&again, f.fs, "out", nil))))
+
+			dst := memfs.New()
+			expect.That(t, expect.FailNow(is.NoError(fsx.ExtractTar(dst, &again, nil))))
+			expectArchiveTree(t, dst, true)
+		})
+}
+
+func TestArchiveZip(t *testing.T) {
+	var buf bytes.Buffer
+	expect.That(t, expect.FailNow(is.NoError(fsx.ArchiveZip(&buf, archiveSource(t), ".", nil))))
+
+	dst := memfs.New()
+	expect.That(t, expect.FailNow(is.NoError(fsx.ExtractZip(dst, bytes.NewReader(buf.Bytes()), int64(buf.Len()), nil))))
+
+	expectArchiveTree(t, dst, false)
+}
+
+func TestArchiveTar_root(t *testing.T) {
+	var buf bytes.Buffer
+	expect.That(t, expect.FailNow(is.NoError(fsx.ArchiveTar(&buf, archiveSource(t), "docs", nil))))
+
+	dst := memfs.New()
+	expect.That(t, expect.FailNow(is.NoError(fsx.ExtractTar(dst, &buf, nil))))
+
+	content, err := fs.ReadFile(dst, "index.md")
+	expect.That(t, is.NoError(err), is.EqualTo(string(content), "# Docs\n"))
+}
+
+type tarEntry struct {
+	hdr  tar.Header
+	data string
+}
+
+func createTar(t *testing.T, entries ...tarEntry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.data))
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractTar_unsafe(t *testing.T) {
+	tests := map[string][]tarEntry{
+		"parent":          {{hdr: tar.Header{Name: "../evil"}, data: "x"}},
+		"nestedParent":    {{hdr: tar.Header{Name: "a/../../evil"}, data: "x"}},
+		"absolute":        {{hdr: tar.Header{Name: "/etc/passwd"}, data: "x"}},
+		"backslash":       {{hdr: tar.Header{Name: `..\evil`}, data: "x"}},
+		"symlinkAbsolute": {{hdr: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc"}}},
+		"symlinkParent":   {{hdr: tar.Header{Name: "a/link", Typeflag: tar.TypeSymlink, Linkname: "../../etc"}}},
+		"hardlinkParent":  {{hdr: tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: "../etc/passwd"}}},
+	}
+
+	for name, entries := range tests {
+		t.Run(name, func(t *testing.T) {
+			dst := memfs.New()
+			err := fsx.ExtractTar(dst, bytes.NewReader(createTar(t, entries...)), nil)
+			expect.That(t, is.Error(err, fsx.ErrUnsafePath))
+		})
+	}
+}
+
+func TestExtractTar_limits(t *testing.T) {
+	data := createTar(t,
+		tarEntry{hdr: tar.Header{Name: "a"}, data: "0123456789"},
+		tarEntry{hdr: tar.Header{Name: "b"}, data: "0123456789"},
+		tarEntry{hdr: tar.Header{Name: "c"}, data: "0123456789"},
+	)
+
+	tests := map[string]fsx.ExtractOptions{
+		"entries":   {MaxEntries: 2},
+		"fileSize":  {MaxFileSize: 9},
+		"totalSize": {MaxTotalSize: 25},
+	}
+
+	for name, opts := range tests {
+		opts := opts
+		t.Run(name, func(t *testing.T) {
+			err := fsx.ExtractTar(memfs.New(), bytes.NewReader(data), &opts)
+			expect.That(t, is.Error(err, fsx.ErrLimitExceeded))
+		})
+	}
+
+	expect.That(t, is.NoError(fsx.ExtractTar(memfs.New(), bytes.NewReader(data), &fsx.ExtractOptions{
+		MaxEntries:   3,
+		MaxFileSize:  10,
+		MaxTotalSize: 30,
+	})))
+}
+
+// noLinkFS hides the LinkFS implementation of the wrapped filesystem.
+type noLinkFS struct {
+	fsx.FS
+}
+
+func TestExtractTar_hardLinkCopyLimit(t *testing.T) {
+	data := createTar(t,
+		tarEntry{hdr: tar.Header{Name: "a"}, data: "0123456789"},
+		tarEntry{hdr: tar.Header{Name: "b", Typeflag: tar.TypeLink, Linkname: "a"}},
+		tarEntry{hdr: tar.Header{Name: "c", Typeflag: tar.TypeLink, Linkname: "a"}},
+	)
+
+	// Without LinkFS, hard links are extracted as copies counting towards
+	// the total size.
+	err := fsx.ExtractTar(noLinkFS{memfs.New()}, bytes.NewReader(data), &fsx.ExtractOptions{MaxTotalSize: 25})
+	expect.That(t, is.Error(err, fsx.ErrLimitExceeded))
+
+	dst := memfs.New()
+	expect.That(t, is.NoError(fsx.ExtractTar(noLinkFS{dst}, bytes.NewReader(data), &fsx.ExtractOptions{MaxTotalSize: 30})))
+
+	content, err := fs.ReadFile(dst, "c")
+	expect.That(t, is.NoError(err), is.EqualTo(string(content), "0123456789"))
+}
+
+func TestExtractTar_filterAndOwner(t *testing.T) {
+	data := createTar(t,
+		tarEntry{hdr: tar.Header{Name: "keep.txt", Uid: 1000, Gid: 100}, data: "keep"},
+		tarEntry{hdr: tar.Header{Name: "skip.log"}, data: "skip"},
+	)
+
+	dst := memfs.New()
+	expect.That(t, expect.FailNow(is.NoError(fsx.ExtractTar(dst, bytes.NewReader(data), &fsx.ExtractOptions{
+		Filter:        fsx.Filter{Exclude: []string{"*.log"}},
+		PreserveOwner: true,
+	}))))
+
+	_, err := fs.Stat(dst, "skip.log")
+	expect.That(t, is.Error(err, fs.ErrNotExist))
+
+	info, err := fs.Stat(dst, "keep.txt")
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	expect.That(t,
+		is.EqualTo(info.Sys().(memfs.Stat).Uid, 1000),
+		is.EqualTo(info.Sys().(memfs.Stat).Gid, 100),
+	)
+}
+
+func TestExtractZip_unsafe(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	hdr := &zip.FileHeader{Name: "link"}
+	hdr.SetMode(fs.ModeSymlink | 0777)
+	w, err := zw.CreateHeader(hdr)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	_, err = w.Write([]byte("../outside"))
+	expect.That(t, expect.FailNow(is.NoError(err)), expect.FailNow(is.NoError(zw.Close())))
+
+	err = fsx.ExtractZip(memfs.New(), bytes.NewReader(buf.Bytes()), int64(buf.Len()), nil)
+	expect.That(t, is.Error(err, fsx.ErrUnsafePath))
+}
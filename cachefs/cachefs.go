@@ -0,0 +1,424 @@
+// Package cachefs provides a read-through caching layer for slow fs.FS
+// implementations, such as network or archive backed filesystems.
+//
+// File contents and directory listings read from the origin filesystem are
+// stored in a second fsx.FS (e.g. a memfs or an osfs.DirFS) and served from
+// there on subsequent reads. Cached entries are served without contacting
+// the origin for the configured TTL. Afterwards, an entry is validated by
+// comparing the origin's size and modification time with the cached ones;
+// changed entries are fetched again. The total size of cached content is
+// bounded; the least recently used entries are evicted first.
+//
+// If the origin implements fsx.FS, the cache is writable. All modifications
+// are passed to the origin and invalidate the affected cache entries,
+// including those of symlink targets when modifying a file through a link.
+// Modifications made to the origin bypassing the cache are detected when an
+// entry is validated.
+//
+// The cache's index is kept in memory. Cached data is stored below the
+// directory "cachefs" of the cache filesystem; data left there by a previous
+// cache is removed when creating a new one. Other entries of the cache
+// filesystem are never touched.
+package cachefs
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/internal/linkutil"
+)
+
+const (
+	// DefaultTTL is the default duration an entry is served without being
+	// validated.
+	DefaultTTL = time.Minute
+
+	// DefaultMaxSize is the default number of bytes stored in the cache.
+	DefaultMaxSize = 64 << 20
+
+	// rootDir is the directory of the cache filesystem holding all cached
+	// data.
+	rootDir  = "cachefs"
+	filesDir = rootDir + "/files"
+	dirsDir  = rootDir + "/dirs"
+)
+
+// Option defines a function used to customize a cachefs.
+type Option func(*options)
+
+type options struct {
+	ttl     time.Duration
+	maxSize int64
+}
+
+// WithTTL sets the duration cached entries are served without validating
+// them against the origin. A TTL of 0 validates entries on every access; a
+// negative TTL disables validation.
+func WithTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.ttl = ttl
+	}
+}
+
+// WithMaxSize sets the maximum number of bytes stored in the cache. Files
+// larger than size are never cached.
+func WithMaxSize(size int64) Option {
+	return func(o *options) {
+		o.maxSize = size
+	}
+}
+
+// Stats contains statistics describing the usage of a cache.
+type Stats struct {
+	// Hits counts reads served from the cache.
+	Hits uint64
+	// Misses counts reads served from the origin.
+	Misses uint64
+	// Evictions counts entries removed to make room for other entries.
+	Evictions uint64
+	// Invalidations counts entries removed because the origin changed.
+	Invalidations uint64
+
+	// Entries contains the number of cached entries.
+	Entries int
+	// Size contains the number of bytes used by cached entries.
+	Size int64
+}
+
+// FS defines the interface of a caching filesystem. Besides the filesystem
+// operations, it reports statistics on the cache's use and allows to drop
+// cached entries.
+type FS interface {
+	fsx.LinkFS
+	fsx.ChmodFS
+	fsx.ChownFS
+	fsx.ChtimesFS
+	fsx.RemoveAllFS
+	fs.StatFS
+	fs.ReadDirFS
+	fs.ReadFileFS
+
+	// Stats returns the cache's statistics.
+	Stats() Stats
+
+	// Invalidate removes all entries for name and its children from the
+	// cache.
+	Invalidate(name string)
+
+	// Purge removes all entries from the cache.
+	Purge() error
+}
+
+// entry describes a cached file or directory listing.
+type entry struct {
+	key       string
+	name      string
+	cachePath string
+	info      *fileInfo
+	size      int64
+	validated time.Time
+	elem      *list.Element
+}
+
+type cachefs struct {
+	origin fs.FS
+	cache  fsx.FS
+	opts   options
+	now    func() time.Time
+
+	// mu guards the index; it is never held while accessing the origin.
+	mu      sync.Mutex
+	entries map[string]*entry
+	lru     *list.List
+	size    int64
+	stats   Stats
+
+	// fetching contains a channel for each key currently fetched from the
+	// origin. The channel is closed when the fetch completes.
+	fetching map[string]chan struct{}
+	// epoch is incremented whenever entries are invalidated, so that data
+	// fetched concurrently to an invalidation is not added to the cache.
+	epoch uint64
+}
+
+// New creates a cache for origin storing cached data in the directory
+// "cachefs" of cache. The directory is created if needed; data left in it is
+// removed.
+func New(origin fs.FS, cache fsx.FS, opts ...Option) (FS, error) {
+	o := options{
+		ttl:     DefaultTTL,
+		maxSize: DefaultMaxSize,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.maxSize <= 0 {
+		return nil, fmt.Errorf("cachefs: invalid max size: %d", o.maxSize)
+	}
+
+	fsys := &cachefs{
+		origin:   origin,
+		cache:    cache,
+		opts:     o,
+		now:      time.Now,
+		entries:  make(map[string]*entry),
+		lru:      list.New(),
+		fetching: make(map[string]chan struct{}),
+	}
+
+	if err := fsys.reset(); err != nil {
+		return nil, err
+	}
+
+	return fsys, nil
+}
+
+// reset removes and recreates the cache's directories.
+func (fsys *cachefs) reset() error {
+	if err := fsx.RemoveAll(fsys.cache, rootDir); err != nil {
+		return err
+	}
+
+	for _, dir := range []string{filesDir, dirsDir} {
+		if err := fsx.MkdirAll(fsys.cache, dir, 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileKey and dirKey return the keys of cached files and listings.
+func fileKey(name string) string { return "f:" + name }
+func dirKey(name string) string  { return "d:" + name }
+
+// cachePath returns the path used to store key in the cache filesystem.
+func cachePath(key string) string {
+	h := sha256.Sum256([]byte(key))
+	dir := filesDir
+	if strings.HasPrefix(key, "d:") {
+		dir = dirsDir
+	}
+	return dir + "/" + hex.EncodeToString(h[:])
+}
+
+// lookup returns the entry for key if it exists and is still valid. Entries
+// exceeding the TTL are validated against the origin without holding
+// fsys.mu. It must be called without fsys.mu held.
+func (fsys *cachefs) lookup(key string) *entry {
+	fsys.mu.Lock()
+	e, ok := fsys.entries[key]
+	if !ok {
+		fsys.mu.Unlock()
+		return nil
+	}
+
+	now := fsys.now()
+	if fsys.opts.ttl < 0 || now.Sub(e.validated) < fsys.opts.ttl {
+		fsys.lru.MoveToFront(e.elem)
+		fsys.mu.Unlock()
+		return e
+	}
+	fsys.mu.Unlock()
+
+	info, err := fs.Stat(fsys.origin, e.name)
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	if fsys.entries[key] != e {
+		// The entry has been removed or replaced while validating it.
+		return nil
+	}
+
+	if err != nil || !e.info.matches(info) {
+		fsys.stats.Invalidations++
+		fsys.remove(e)
+		return nil
+	}
+
+	e.validated = now
+	fsys.lru.MoveToFront(e.elem)
+	return e
+}
+
+// hit counts a read served from the cache.
+func (fsys *cachefs) hit() {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	fsys.stats.Hits++
+}
+
+// acquire registers the caller as fetching key from the origin and counts a
+// miss. If another goroutine is already fetching key, acquire waits for it
+// to complete and reports false; the caller should look key up again.
+// Otherwise, acquire returns the current epoch, which must be passed to add,
+// and the caller must call release once done.
+func (fsys *cachefs) acquire(key string) (epoch uint64, ok bool) {
+	fsys.mu.Lock()
+	if done, busy := fsys.fetching[key]; busy {
+		fsys.mu.Unlock()
+		<-done
+		return 0, false
+	}
+	defer fsys.mu.Unlock()
+
+	fsys.fetching[key] = make(chan struct{})
+	fsys.stats.Misses++
+	return fsys.epoch, true
+}
+
+// release marks the fetch of key as completed.
+func (fsys *cachefs) release(key string) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	close(fsys.fetching[key])
+	delete(fsys.fetching, key)
+}
+
+// add stores data for key in the cache and evicts least recently used
+// entries if the cache exceeds its size. add returns nil if data is too large
+// to be cached or if entries have been invalidated since epoch, as data might
+// be stale. It must be called with fsys.mu held.
+func (fsys *cachefs) add(key, name string, info *fileInfo, data []byte, epoch uint64) (*entry, error) {
+	if int64(len(data)) > fsys.opts.maxSize || epoch != fsys.epoch {
+		return nil, nil
+	}
+
+	if old, ok := fsys.entries[key]; ok {
+		fsys.remove(old)
+	}
+
+	e := &entry{
+		key:       key,
+		name:      name,
+		cachePath: cachePath(key),
+		info:      info,
+		size:      int64(len(data)),
+		validated: fsys.now(),
+	}
+
+	if err := fsx.WriteFile(fsys.cache, e.cachePath, data, 0600); err != nil {
+		return nil, err
+	}
+
+	e.elem = fsys.lru.PushFront(e)
+	fsys.entries[key] = e
+	fsys.size += e.size
+
+	for fsys.size > fsys.opts.maxSize {
+		oldest := fsys.lru.Back().Value.(*entry)
+		fsys.stats.Evictions++
+		fsys.remove(oldest)
+	}
+
+	return e, nil
+}
+
+// readCached reads the cached data of e. ok is false if e has been removed
+// from the cache in the meantime.
+func (fsys *cachefs) readCached(e *entry) (data []byte, ok bool, err error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	if fsys.entries[e.key] != e {
+		return nil, false, nil
+	}
+
+	data, err = fs.ReadFile(fsys.cache, e.cachePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		// The cached data has been removed; drop the entry.
+		fsys.remove(e)
+		return nil, false, nil
+	}
+	return data, err == nil, err
+}
+
+// remove removes e from the cache. It must be called with fsys.mu held.
+func (fsys *cachefs) remove(e *entry) {
+	fsys.lru.Remove(e.elem)
+	delete(fsys.entries, e.key)
+	fsys.size -= e.size
+
+	// A failure to remove the data only wastes space; the entry is gone.
+	fsys.cache.Remove(e.cachePath)
+}
+
+// invalidate removes all entries for names, their children and the listings
+// of their parent directories.
+func (fsys *cachefs) invalidate(names ...string) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	for _, name := range names {
+		fsys.invalidateLocked(name)
+	}
+}
+
+// affected returns the names to invalidate when modifying name: name itself
+// and, if a symlink is involved, the name it resolves to in the origin.
+// Symlinks are resolved when calling affected, so it must be called before
+// modifying the origin.
+func (fsys *cachefs) affected(name string) []string {
+	resolved, err := linkutil.Resolve(fsys.origin, name)
+	if err != nil || resolved == name {
+		return []string{name}
+	}
+	return []string{name, resolved}
+}
+
+func (fsys *cachefs) invalidateLocked(name string) {
+	fsys.epoch++
+
+	parent := "."
+	if i := strings.LastIndexByte(name, '/'); i >= 0 {
+		parent = name[:i]
+	}
+
+	for _, e := range fsys.entries {
+		if e.name == name || name == "." || strings.HasPrefix(e.name, name+"/") || e.key == dirKey(parent) {
+			fsys.stats.Invalidations++
+			fsys.remove(e)
+		}
+	}
+}
+
+// Stats returns the cache's statistics.
+func (fsys *cachefs) Stats() Stats {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	s := fsys.stats
+	s.Entries = len(fsys.entries)
+	s.Size = fsys.size
+	return s
+}
+
+// Invalidate removes all entries for name, its children and the listing of
+// its parent directory from the cache.
+func (fsys *cachefs) Invalidate(name string) {
+	fsys.invalidate(name)
+}
+
+// Purge removes all entries from the cache.
+func (fsys *cachefs) Purge() error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	fsys.entries = make(map[string]*entry)
+	fsys.lru.Init()
+	fsys.size = 0
+	fsys.epoch++
+
+	return fsys.reset()
+}
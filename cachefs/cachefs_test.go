@@ -0,0 +1,374 @@
+package cachefs
+
+import (
+	"io"
+	"io/fs"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	. "github.com/halimath/fixture"
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/memfs"
+	"github.com/halimath/fsx/osfs"
+)
+
+// countingFS counts the files opened in the origin.
+type countingFS struct {
+	fsx.LinkFS
+
+	mu    sync.Mutex
+	opens map[string]int
+}
+
+func (c *countingFS) Open(name string) (fs.File, error) {
+	c.mu.Lock()
+	c.opens[name]++
+	c.mu.Unlock()
+
+	return c.LinkFS.Open(name)
+}
+
+func (c *countingFS) count(name string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.opens[name]
+}
+
+// blockingFS blocks opening the file name until unblock is closed. started
+// is closed when name is opened for the first time.
+type blockingFS struct {
+	fs.FS
+	name    string
+	once    sync.Once
+	started chan struct{}
+	unblock chan struct{}
+
+	mu    sync.Mutex
+	opens int
+}
+
+func (b *blockingFS) Open(name string) (fs.File, error) {
+	if name == b.name {
+		b.once.Do(func() { close(b.started) })
+		<-b.unblock
+
+		b.mu.Lock()
+		b.opens++
+		b.mu.Unlock()
+	}
+	return b.FS.Open(name)
+}
+
+type cachefsFixture struct {
+	origin *countingFS
+	cache  fsx.LinkFS
+	fs     FS
+	now    time.Time
+}
+
+func (f *cachefsFixture) BeforeEach(t *testing.T) error {
+	f.origin = &countingFS{LinkFS: memfs.New(), opens: make(map[string]int)}
+	f.cache = osfs.DirFS(t.TempDir())
+
+	var err error
+	f.fs, err = New(f.origin, f.cache, WithTTL(time.Minute), WithMaxSize(1000))
+	if err != nil {
+		return err
+	}
+
+	f.now = time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	f.fs.(*cachefs).now = func() time.Time { return f.now }
+
+	if err := fsx.MkdirAll(f.origin, "etc/ssl", 0755); err != nil {
+		return err
+	}
+	if err := fsx.WriteFile(f.origin, "etc/hosts", []byte("127.0.0.1 localhost\n"), 0644); err != nil {
+		return err
+	}
+	return fsx.WriteFile(f.origin, "etc/ssl/cert.pem", []byte("cert"), 0600)
+}
+
+// readFile reads name from the cache and expects its content to be want.
+func (f *cachefsFixture) readFile(t *testing.T, name, want string) {
+	t.Helper()
+
+	got, err := f.fs.ReadFile(name)
+	expect.That(t, is.NoError(err), is.EqualTo(string(got), want))
+}
+
+func TestCacheFS(t *testing.T) {
+	With(t, new(cachefsFixture)).
+		Run("fstest", func(t *testing.T, f *cachefsFixture) {
+			for i := 0; i < 2; i++ {
+				expect.That(t, is.NoError(fstest.TestFS(f.fs, "etc/hosts", "etc/ssl/cert.pem")))
+			}
+
+			stats := f.fs.Stats()
+			expect.That(t, is.EqualTo(stats.Hits > 0, true), is.EqualTo(stats.Size <= 1000, true))
+		}).
+		Run("hitsAndMisses", func(t *testing.T, f *cachefsFixture) {
+			f.readFile(t, "etc/hosts", "127.0.0.1 localhost\n")
+			f.readFile(t, "etc/hosts", "127.0.0.1 localhost\n")
+
+			file, err := f.fs.Open("etc/hosts")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			info, err := file.Stat()
+			expect.That(t, is.NoError(err), is.EqualTo(info.Name(), "hosts"), is.EqualTo(info.Size(), int64(20)))
+			expect.That(t, is.NoError(file.Close()))
+
+			expect.That(t,
+				is.EqualTo(f.origin.count("etc/hosts"), 2),
+				is.DeepEqualTo(f.fs.Stats(), Stats{Hits: 2, Misses: 1, Entries: 1, Size: 20}),
+			)
+		}).
+		Run("directoryListings", func(t *testing.T, f *cachefsFixture) {
+			for i := 0; i < 2; i++ {
+				entries, err := f.fs.ReadDir("etc")
+				expect.That(t, expect.FailNow(is.NoError(err)), expect.FailNow(is.SliceOfLen(entries, 2)))
+				expect.That(t, is.EqualTo(entries[0].Name(), "hosts"), is.EqualTo(entries[1].IsDir(), true))
+			}
+
+			stats := f.fs.Stats()
+			expect.That(t, is.EqualTo(stats.Hits, uint64(1)), is.EqualTo(stats.Misses, uint64(1)))
+		}).
+		Run("ttl", func(t *testing.T, f *cachefsFixture) {
+			f.readFile(t, "etc/hosts", "127.0.0.1 localhost\n")
+			opens := f.origin.count("etc/hosts")
+
+			// Modifications bypassing the cache are not seen within the TTL.
+			mtime := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+			expect.That(t,
+				expect.FailNow(is.NoError(fsx.WriteFile(f.origin, "etc/hosts", []byte("::1 localhost\n"), 0644))),
+				expect.FailNow(is.NoError(f.origin.LinkFS.(fsx.ChtimesFS).Chtimes("etc/hosts", mtime, mtime))),
+			)
+			f.readFile(t, "etc/hosts", "127.0.0.1 localhost\n")
+			expect.That(t, is.EqualTo(f.origin.count("etc/hosts"), opens))
+
+			f.now = f.now.Add(2 * time.Minute)
+			f.readFile(t, "etc/hosts", "::1 localhost\n")
+
+			stats := f.fs.Stats()
+			expect.That(t, is.EqualTo(stats.Misses, uint64(2)), is.EqualTo(stats.Invalidations, uint64(1)))
+		}).
+		Run("validation", func(t *testing.T, f *cachefsFixture) {
+			f.readFile(t, "etc/hosts", "127.0.0.1 localhost\n")
+			opens := f.origin.count("etc/hosts")
+
+			f.now = f.now.Add(2 * time.Minute)
+			f.readFile(t, "etc/hosts", "127.0.0.1 localhost\n")
+
+			// Validation only stats the file.
+			expect.That(t,
+				is.EqualTo(f.origin.count("etc/hosts"), opens+1),
+				is.EqualTo(f.fs.Stats().Hits, uint64(1)),
+			)
+		}).
+		Run("eviction", func(t *testing.T, f *cachefsFixture) {
+			for _, name := range []string{"a", "b", "c"} {
+				expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(f.origin, name, []byte(strings.Repeat(name, 400)), 0644))))
+			}
+
+			f.readFile(t, "a", strings.Repeat("a", 400))
+			f.readFile(t, "b", strings.Repeat("b", 400))
+			f.readFile(t, "a", strings.Repeat("a", 400))
+			f.readFile(t, "c", strings.Repeat("c", 400))
+
+			stats := f.fs.Stats()
+			expect.That(t,
+				is.EqualTo(stats.Evictions, uint64(1)),
+				is.EqualTo(stats.Entries, 2),
+				is.EqualTo(stats.Size, int64(800)),
+			)
+
+			f.readFile(t, "a", strings.Repeat("a", 400))
+			f.readFile(t, "b", strings.Repeat("b", 400))
+			expect.That(t, is.EqualTo(f.fs.Stats().Misses, uint64(4)))
+
+			entries, err := fs.ReadDir(f.cache, filesDir)
+			expect.That(t, is.NoError(err), is.SliceOfLen(entries, 2))
+		}).
+		Run("largeFile", func(t *testing.T, f *cachefsFixture) {
+			expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(f.origin, "large.bin", make([]byte, 2000), 0644))))
+
+			for i := 0; i < 2; i++ {
+				f.readFile(t, "large.bin", string(make([]byte, 2000)))
+			}
+
+			file, err := f.fs.Open("large.bin")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			info, err := file.Stat()
+			expect.That(t, is.NoError(err), is.EqualTo(info.Size(), int64(2000)), is.NoError(file.Close()))
+
+			stats := f.fs.Stats()
+			expect.That(t, is.EqualTo(stats.Misses, uint64(3)), is.EqualTo(stats.Entries, 0))
+		}).
+		Run("writeInvalidates", func(t *testing.T, f *cachefsFixture) {
+			f.readFile(t, "etc/hosts", "127.0.0.1 localhost\n")
+			_, err := f.fs.ReadDir("etc")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			expect.That(t,
+				is.NoError(fsx.WriteFile(f.fs, "etc/hosts", []byte("::1 localhost\n"), 0644)),
+				is.NoError(fsx.WriteFile(f.fs, "etc/resolv.conf", []byte("nameserver ::1\n"), 0644)),
+			)
+
+			f.readFile(t, "etc/hosts", "::1 localhost\n")
+
+			entries, err := f.fs.ReadDir("etc")
+			expect.That(t, is.NoError(err), is.SliceOfLen(entries, 3))
+
+			expect.That(t, is.NoError(f.fs.Rename("etc", "config")))
+			_, err = f.fs.ReadFile("etc/hosts")
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+			f.readFile(t, "config/hosts", "::1 localhost\n")
+
+			expect.That(t, is.NoError(f.fs.RemoveAll("config")))
+			_, err = f.fs.Stat("config/hosts")
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+		}).
+		Run("writeThroughSymlink", func(t *testing.T, f *cachefsFixture) {
+			expect.That(t,
+				expect.FailNow(is.NoError(fsx.WriteFile(f.origin, "target", []byte("old"), 0644))),
+				expect.FailNow(is.NoError(f.origin.Mkdir("l", 0755))),
+				expect.FailNow(is.NoError(f.origin.Symlink("target", "l/link"))),
+			)
+
+			f.readFile(t, "target", "old")
+			f.readFile(t, "l/link", "old")
+
+			expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(f.fs, "l/link", []byte("new"), 0644))))
+
+			f.readFile(t, "target", "new")
+			f.readFile(t, "l/link", "new")
+		}).
+		Run("invalidateAndPurge", func(t *testing.T, f *cachefsFixture) {
+			f.readFile(t, "etc/hosts", "127.0.0.1 localhost\n")
+			f.readFile(t, "etc/ssl/cert.pem", "cert")
+
+			f.fs.Invalidate("etc/ssl")
+			expect.That(t, is.EqualTo(f.fs.Stats().Entries, 1))
+
+			expect.That(t, is.NoError(f.fs.Purge()))
+			expect.That(t, is.EqualTo(f.fs.Stats().Entries, 0))
+
+			entries, err := fs.ReadDir(f.cache, filesDir)
+			expect.That(t, is.NoError(err), is.SliceOfLen(entries, 0))
+
+			f.readFile(t, "etc/hosts", "127.0.0.1 localhost\n")
+		}).
+		Run("notExist", func(t *testing.T, f *cachefsFixture) {
+			_, err := f.fs.ReadFile("missing")
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+
+			_, err = f.fs.Open("missing")
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+		})
+}
+
+func TestNew(t *testing.T) {
+	cache := memfs.New()
+	expect.That(t, expect.FailNow(is.NoError(fsx.MkdirAll(cache, filesDir, 0755))))
+	expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(cache, filesDir+"/stale", []byte("x"), 0644))))
+
+	_, err := New(fstest.MapFS{}, cache)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	_, err = fs.Stat(cache, filesDir+"/stale")
+	expect.That(t, is.Error(err, fs.ErrNotExist))
+
+	expect.That(t, expect.FailNow(is.NoError(fsx.MkdirAll(cache, "files", 0755))))
+	expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(cache, "files/keep", []byte("x"), 0644))))
+
+	fsys, err := New(fstest.MapFS{}, cache)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	expect.That(t, is.NoError(fsys.Purge()))
+
+	_, err = fs.Stat(cache, "files/keep")
+	expect.That(t, is.NoError(err))
+
+	_, err = New(fstest.MapFS{}, cache, WithMaxSize(0))
+	expect.That(t, is.EqualTo(err != nil, true))
+}
+
+func TestReadOnlyOrigin(t *testing.T) {
+	origin := fstest.MapFS{
+		"a/b.txt": &fstest.MapFile{Data: []byte("b"), Mode: 0644, ModTime: time.Now()},
+	}
+
+	fsys, err := New(origin, osfs.DirFS(t.TempDir()), WithTTL(-1))
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	expect.That(t, is.NoError(fstest.TestFS(fsys, "a/b.txt")))
+
+	// Without validation changes to the origin are not seen.
+	origin["a/b.txt"].Data = []byte("changed")
+	content, err := fsys.ReadFile("a/b.txt")
+	expect.That(t, is.NoError(err), is.EqualTo(string(content), "b"))
+
+	// Files too large to be cached are streamed from the origin.
+	origin["large.bin"] = &fstest.MapFile{Data: []byte(strings.Repeat("x", 20)), Mode: 0644}
+	fsys, err = New(origin, memfs.New(), WithMaxSize(10))
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	f, err := fsys.Open("large.bin")
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	_, streamed := f.(*originFile)
+	content, err = io.ReadAll(f)
+	expect.That(t,
+		is.EqualTo(streamed, true),
+		is.NoError(err),
+		is.EqualTo(string(content), strings.Repeat("x", 20)),
+		is.NoError(f.Close()),
+	)
+
+	expect.That(t,
+		is.Error(fsx.WriteFile(fsys, "a/c.txt", nil, 0644), fsx.ErrNotSupported),
+		is.Error(fsys.Mkdir("c", 0755), fsx.ErrNotSupported),
+		is.Error(fsys.Remove("a/b.txt"), fsx.ErrNotSupported),
+	)
+}
+
+func TestConcurrentFetch(t *testing.T) {
+	origin := &blockingFS{
+		FS: fstest.MapFS{
+			"slow.txt": &fstest.MapFile{Data: []byte("slow"), Mode: 0644},
+			"fast.txt": &fstest.MapFile{Data: []byte("fast"), Mode: 0644},
+		},
+		name:    "slow.txt",
+		started: make(chan struct{}),
+		unblock: make(chan struct{}),
+	}
+
+	fsys, err := New(origin, memfs.New())
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	var wg sync.WaitGroup
+	results := make([]string, 2)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data, _ := fsys.ReadFile("slow.txt")
+			results[i] = string(data)
+		}(i)
+	}
+
+	// Other files are served while slow.txt is fetched.
+	<-origin.started
+	content, err := fsys.ReadFile("fast.txt")
+	expect.That(t, is.NoError(err), is.EqualTo(string(content), "fast"))
+
+	close(origin.unblock)
+	wg.Wait()
+
+	// slow.txt has been fetched once: stat and read.
+	expect.That(t,
+		is.DeepEqualTo(results, []string{"slow", "slow"}),
+		is.EqualTo(origin.opens, 2),
+	)
+}
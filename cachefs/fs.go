@@ -0,0 +1,534 @@
+package cachefs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/internal/buffile"
+	"github.com/halimath/fsx/internal/wrapfs"
+)
+
+// fileInfo holds the information about a cached file or directory. It is
+// also used to store directory listings.
+type fileInfo struct {
+	FileName    string      `json:"name"`
+	FileSize    int64       `json:"size"`
+	FileMode    fs.FileMode `json:"mode"`
+	FileModTime int64       `json:"mtime"`
+}
+
+// newFileInfo captures info. The modification time is stored with
+// nanosecond precision and reported in the local time zone.
+func newFileInfo(info fs.FileInfo) *fileInfo {
+	return &fileInfo{
+		FileName:    info.Name(),
+		FileSize:    info.Size(),
+		FileMode:    info.Mode(),
+		FileModTime: info.ModTime().UnixNano(),
+	}
+}
+
+func (i *fileInfo) Name() string       { return i.FileName }
+func (i *fileInfo) Size() int64        { return i.FileSize }
+func (i *fileInfo) Mode() fs.FileMode  { return i.FileMode }
+func (i *fileInfo) ModTime() time.Time { return time.Unix(0, i.FileModTime) }
+func (i *fileInfo) IsDir() bool        { return i.FileMode.IsDir() }
+func (i *fileInfo) Sys() any           { return nil }
+
+// matches reports whether info describes the same content as i. Directory
+// listings are compared by modification time only.
+func (i *fileInfo) matches(info fs.FileInfo) bool {
+	if info.ModTime().UnixNano() != i.FileModTime || info.Mode().Type() != i.FileMode.Type() {
+		return false
+	}
+	return i.IsDir() || info.Size() == i.FileSize
+}
+
+// cachedFile is a file opened from the cache filesystem (or the origin for
+// files too large to be cached) reporting the cached file info.
+type cachedFile struct {
+	fsx.File
+	info *fileInfo
+}
+
+func (f *cachedFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+// originFile is a file opened from an origin not implementing fsx.FS. It
+// can only be read.
+type originFile struct {
+	fs.File
+	name string
+	info *fileInfo
+}
+
+func (f *originFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *originFile) Write([]byte) (int, error) {
+	return 0, wrapfs.PathError("Write", f.name, fs.ErrPermission)
+}
+
+func (f *originFile) Chmod(fs.FileMode) error {
+	return wrapfs.PathError("Chmod", f.name, fsx.ErrNotSupported)
+}
+
+func (f *originFile) Chown(int, int) error { return nil }
+
+func (f *originFile) Seek(offset int64, whence int) (int64, error) {
+	s, ok := f.File.(io.Seeker)
+	if !ok {
+		return 0, wrapfs.PathError("Seek", f.name, fsx.ErrNotSupported)
+	}
+	return s.Seek(offset, whence)
+}
+
+// writeFile is a file opened for writing in the origin filesystem. Closing
+// it invalidates the cache entries again, as the file might have been read
+// and cached while being written.
+type writeFile struct {
+	fsx.File
+	fsys  *cachefs
+	names []string
+}
+
+func (f *writeFile) Close() error {
+	defer f.fsys.invalidate(f.names...)
+	return f.File.Close()
+}
+
+// -- Reading
+
+// file returns the cache entry for the regular file name, fetching it from
+// the origin if needed. data is only set if the file has been read from the
+// origin. If the file is too large to be cached, both e and data are nil.
+// Concurrent calls for the same file fetch it only once. It must be called
+// without fsys.mu held.
+func (fsys *cachefs) file(name string) (e *entry, data []byte, err error) {
+	key := fileKey(name)
+	for {
+		if e := fsys.lookup(key); e != nil {
+			fsys.hit()
+			return e, nil, nil
+		}
+
+		epoch, ok := fsys.acquire(key)
+		if !ok {
+			continue
+		}
+		return fsys.fetchFile(key, name, epoch)
+	}
+}
+
+// fetchFile reads the file name from the origin and adds it to the cache.
+// The caller must have acquired key.
+func (fsys *cachefs) fetchFile(key, name string, epoch uint64) (*entry, []byte, error) {
+	defer fsys.release(key)
+
+	info, err := fs.Stat(fsys.origin, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		return nil, nil, wrapfs.PathError("ReadFile", name, buffile.ErrIsDirectory)
+	}
+	if info.Size() > fsys.opts.maxSize {
+		return nil, nil, nil
+	}
+
+	data, err := fs.ReadFile(fsys.origin, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	e, err := fsys.add(key, name, newFileInfo(info), data, epoch)
+	return e, data, err
+}
+
+// listing returns the entries of the directory name, reading them from the
+// cache if possible. Concurrent calls for the same directory fetch it only
+// once. It must be called without fsys.mu held.
+func (fsys *cachefs) listing(name string) ([]fs.DirEntry, error) {
+	key := dirKey(name)
+	for {
+		if e := fsys.lookup(key); e != nil {
+			data, ok, err := fsys.readCached(e)
+			if err == nil && !ok {
+				continue
+			}
+
+			var infos []*fileInfo
+			if err == nil {
+				err = json.Unmarshal(data, &infos)
+			}
+			if err != nil {
+				return nil, wrapfs.PathError("ReadDir", name, fmt.Errorf("cachefs: invalid cached listing: %w", err))
+			}
+
+			fsys.hit()
+			return dirEntries(infos), nil
+		}
+
+		epoch, ok := fsys.acquire(key)
+		if !ok {
+			continue
+		}
+
+		infos, err := fsys.fetchListing(key, name, epoch)
+		if err != nil {
+			return nil, err
+		}
+		return dirEntries(infos), nil
+	}
+}
+
+// dirEntries converts infos to directory entries.
+func dirEntries(infos []*fileInfo) []fs.DirEntry {
+	entries := make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+	return entries
+}
+
+// fetchListing reads the directory name from the origin and adds its
+// listing to the cache. The caller must have acquired key.
+func (fsys *cachefs) fetchListing(key, name string, epoch uint64) ([]*fileInfo, error) {
+	defer fsys.release(key)
+
+	info, err := fs.Stat(fsys.origin, name)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := fs.ReadDir(fsys.origin, name)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]*fileInfo, 0, len(entries))
+	for _, de := range entries {
+		info, err := de.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, newFileInfo(info))
+	}
+
+	data, err := json.Marshal(infos)
+	if err != nil {
+		return nil, err
+	}
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	if _, err := fsys.add(key, name, newFileInfo(info), data, epoch); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// -- fs.FS
+
+// Open opens the named file for reading.
+func (fsys *cachefs) Open(name string) (fs.File, error) {
+	return fsys.OpenFile(name, fsx.O_RDONLY, 0)
+}
+
+// -- fsx.FS
+
+func (fsys *cachefs) originFS(op, name string) (fsx.FS, error) {
+	origin, ok := fsys.origin.(fsx.FS)
+	if !ok {
+		return nil, wrapfs.PathError(op, name, fsx.ErrNotSupported)
+	}
+	return origin, nil
+}
+
+// OpenFile opens the named file. Files opened for reading are served from
+// the cache; files opened for writing are opened in the origin.
+func (fsys *cachefs) OpenFile(name string, flag int, perm fs.FileMode) (fsx.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, wrapfs.PathError("OpenFile", name, fs.ErrInvalid)
+	}
+
+	if flag&(fsx.O_WRONLY|fsx.O_RDWR|fsx.O_CREATE|fsx.O_TRUNC) != 0 {
+		origin, err := fsys.originFS("OpenFile", name)
+		if err != nil {
+			return nil, err
+		}
+
+		names := fsys.affected(name)
+		fsys.invalidate(names...)
+
+		f, err := origin.OpenFile(name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		return &writeFile{File: f, fsys: fsys, names: names}, nil
+	}
+
+	info, err := fsys.stat(name)
+	if err != nil {
+		return nil, wrapfs.PathError("OpenFile", name, err)
+	}
+
+	if info.IsDir() {
+		entries, err := fsys.listing(name)
+		if err != nil {
+			return nil, err
+		}
+
+		return buffile.NewDir(name, func() (fs.FileInfo, error) {
+			return info, nil
+		}, entries), nil
+	}
+
+	for {
+		e, data, err := fsys.file(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if data != nil {
+			return buffile.New(name, data, buffile.Options{
+				Stat: func(int64) (fs.FileInfo, error) { return info, nil },
+			}), nil
+		}
+
+		if e == nil {
+			// The file is too large to be cached.
+			return fsys.openOrigin(name, flag, perm, info)
+		}
+
+		f, err := fsys.openCached(e)
+		if err != nil {
+			return nil, wrapfs.PathError("OpenFile", name, err)
+		}
+		if f != nil {
+			return &cachedFile{File: f, info: e.info}, nil
+		}
+	}
+}
+
+// openCached opens the cached data of e. It returns nil if e has been
+// removed from the cache in the meantime.
+func (fsys *cachefs) openCached(e *entry) (fsx.File, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	if fsys.entries[e.key] != e {
+		return nil, nil
+	}
+
+	f, err := fsys.cache.OpenFile(e.cachePath, fsx.O_RDONLY, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		// The cached data has been removed; drop the entry.
+		fsys.remove(e)
+		return nil, nil
+	}
+	return f, err
+}
+
+// openOrigin opens the named file from the origin for reading.
+func (fsys *cachefs) openOrigin(name string, flag int, perm fs.FileMode, info *fileInfo) (fsx.File, error) {
+	if origin, ok := fsys.origin.(fsx.FS); ok {
+		f, err := origin.OpenFile(name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		return &cachedFile{File: f, info: info}, nil
+	}
+
+	f, err := fsys.origin.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &originFile{File: f, name: name, info: info}, nil
+}
+
+// stat returns the info of name, either from a valid cache entry or from
+// the origin. It must be called without fsys.mu held.
+func (fsys *cachefs) stat(name string) (*fileInfo, error) {
+	for _, key := range []string{fileKey(name), dirKey(name)} {
+		if e := fsys.lookup(key); e != nil {
+			return e.info, nil
+		}
+	}
+
+	info, err := fs.Stat(fsys.origin, name)
+	if err != nil {
+		return nil, err
+	}
+	return newFileInfo(info), nil
+}
+
+// Mkdir creates the named directory in the origin.
+func (fsys *cachefs) Mkdir(name string, perm fs.FileMode) error {
+	origin, err := fsys.originFS("Mkdir", name)
+	if err != nil {
+		return err
+	}
+
+	defer fsys.invalidate(fsys.affected(name)...)
+	return origin.Mkdir(name, perm)
+}
+
+// Remove removes the named file or empty directory from the origin.
+func (fsys *cachefs) Remove(name string) error {
+	origin, err := fsys.originFS("Remove", name)
+	if err != nil {
+		return err
+	}
+
+	defer fsys.invalidate(fsys.affected(name)...)
+	return origin.Remove(name)
+}
+
+// Rename renames oldpath to newpath in the origin.
+func (fsys *cachefs) Rename(oldpath, newpath string) error {
+	origin, err := fsys.originFS("Rename", oldpath)
+	if err != nil {
+		return err
+	}
+
+	defer fsys.invalidate(fsys.affected(newpath)...)
+	defer fsys.invalidate(fsys.affected(oldpath)...)
+	return origin.Rename(oldpath, newpath)
+}
+
+// SameFile reports whether fi1 and fi2 describe the same file. Cached file
+// infos are compared by name, mode, size and modification time as the
+// origin's infos are not retained.
+func (fsys *cachefs) SameFile(fi1, fi2 fs.FileInfo) bool {
+	i1, ok1 := fi1.(*fileInfo)
+	i2, ok2 := fi2.(*fileInfo)
+	if ok1 && ok2 {
+		return *i1 == *i2
+	}
+
+	if origin, ok := fsys.origin.(fsx.FS); ok {
+		return origin.SameFile(fi1, fi2)
+	}
+	return false
+}
+
+// -- fsx.ChmodFS, fsx.ChownFS, fsx.ChtimesFS, fsx.RemoveAllFS
+
+// Chmod changes the mode of the named file in the origin.
+func (fsys *cachefs) Chmod(name string, mode fs.FileMode) error {
+	origin, err := fsys.originFS("Chmod", name)
+	if err != nil {
+		return err
+	}
+
+	defer fsys.invalidate(fsys.affected(name)...)
+	return fsx.Chmod(origin, name, mode)
+}
+
+// Chown changes the numeric owner and group of the named file in the
+// origin.
+func (fsys *cachefs) Chown(name string, uid, gid int) error {
+	origin, err := fsys.originFS("Chown", name)
+	if err != nil {
+		return err
+	}
+
+	defer fsys.invalidate(fsys.affected(name)...)
+	return fsx.Chown(origin, name, uid, gid)
+}
+
+// Chtimes changes the access and modification time of the named file in the
+// origin.
+func (fsys *cachefs) Chtimes(name string, atime, mtime time.Time) error {
+	defer fsys.invalidate(fsys.affected(name)...)
+	return wrapfs.Chtimes(fsys.origin, name, atime, mtime)
+}
+
+// RemoveAll removes name and all of its children from the origin.
+func (fsys *cachefs) RemoveAll(name string) error {
+	origin, err := fsys.originFS("RemoveAll", name)
+	if err != nil {
+		return err
+	}
+
+	defer fsys.invalidate(fsys.affected(name)...)
+	return fsx.RemoveAll(origin, name)
+}
+
+// -- fsx.LinkFS
+
+// Readlink returns the target of the named symlink. Link targets are not
+// cached.
+func (fsys *cachefs) Readlink(name string) (string, error) {
+	return wrapfs.Readlink(fsys.origin, name)
+}
+
+// Link creates newname as a hard link to oldname in the origin.
+func (fsys *cachefs) Link(oldname, newname string) error {
+	defer fsys.invalidate(fsys.affected(newname)...)
+	return wrapfs.Link(fsys.origin, oldname, newname)
+}
+
+// Symlink creates newname as a symlink to oldname in the origin.
+func (fsys *cachefs) Symlink(oldname, newname string) error {
+	defer fsys.invalidate(fsys.affected(newname)...)
+	return wrapfs.Symlink(fsys.origin, oldname, newname)
+}
+
+// -- fs.StatFS, fs.ReadDirFS, fs.ReadFileFS
+
+// Stat returns a fs.FileInfo describing the named file. Cached entries are
+// served from the cache.
+func (fsys *cachefs) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, wrapfs.PathError("Stat", name, fs.ErrInvalid)
+	}
+
+	info, err := fsys.stat(name)
+	if err != nil {
+		return nil, wrapfs.PathError("Stat", name, err)
+	}
+	return info, nil
+}
+
+// ReadDir returns the sorted entries of the named directory.
+func (fsys *cachefs) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, wrapfs.PathError("ReadDir", name, fs.ErrInvalid)
+	}
+
+	return fsys.listing(name)
+}
+
+// ReadFile returns the content of the named file.
+func (fsys *cachefs) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, wrapfs.PathError("ReadFile", name, fs.ErrInvalid)
+	}
+
+	for {
+		e, data, err := fsys.file(name)
+		if err != nil || data != nil {
+			return data, err
+		}
+		if e == nil {
+			// The file is too large to be cached.
+			return fs.ReadFile(fsys.origin, name)
+		}
+
+		data, ok, err := fsys.readCached(e)
+		if err != nil || ok {
+			return data, err
+		}
+	}
+}
+
+var _ FS = &cachefs{}
@@ -0,0 +1,217 @@
+package casfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/bits"
+	"path"
+	"strings"
+
+	"github.com/halimath/fsx"
+)
+
+const (
+	// blobDir is the directory in the backing filesystem containing all
+	// chunks.
+	blobDir = "blobs"
+
+	// tmpSuffix is appended to the names of files being written. Leftovers
+	// are removed by GC.
+	tmpSuffix = ".tmp"
+)
+
+// blobName returns the name of the blob with the hex encoded digest h in the
+// backing filesystem.
+func blobName(h string) string {
+	return blobDir + "/" + h[:2] + "/" + h[2:]
+}
+
+// validDigest reports whether h is a hex encoded SHA-256 digest.
+func validDigest(h string) bool {
+	if len(h) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(h)
+	return err == nil
+}
+
+// gear contains the random values used by the rolling hash of the chunker.
+var gear [256]uint64
+
+func init() {
+	// Values are generated with splitmix64 using a fixed seed to make chunk
+	// boundaries stable across processes.
+	var s uint64 = 0x6361736673 // "casfs"
+	for i := range gear {
+		s += 0x9e3779b97f4a7c15
+		z := s
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// chunker splits data into content defined chunks using a gear hash. Chunk
+// boundaries only depend on the surrounding bytes so inserting or removing
+// data only changes the chunks next to the modification.
+type chunker struct {
+	min, max int
+	mask     uint64
+}
+
+// newChunker creates a chunker producing chunks of about avg bytes. avg is
+// rounded down to a power of two.
+func newChunker(avg int) chunker {
+	b := bits.Len(uint(avg)) - 1
+	avg = 1 << b
+
+	return chunker{
+		min: avg / 4,
+		max: avg * 8,
+		// Use the hash's most significant bits which depend on the last 64
+		// bytes.
+		mask: (uint64(1)<<b - 1) << (64 - b),
+	}
+}
+
+// split returns the chunks of data. The chunks share data's backing array.
+func (c chunker) split(data []byte) [][]byte {
+	var chunks [][]byte
+
+	for len(data) > 0 {
+		n := c.next(data)
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+
+	return chunks
+}
+
+// next returns the length of the next chunk at the start of data.
+func (c chunker) next(data []byte) int {
+	if len(data) <= c.min {
+		return len(data)
+	}
+
+	limit := len(data)
+	if limit > c.max {
+		limit = c.max
+	}
+
+	var fp uint64
+	for i := 0; i < limit; i++ {
+		fp = fp<<1 + gear[data[i]]
+		if i >= c.min && fp&c.mask == 0 {
+			return i + 1
+		}
+	}
+
+	return limit
+}
+
+// blobStore stores chunks in a backing filesystem.
+type blobStore struct {
+	fs fsx.FS
+}
+
+// put stores chunk unless a blob with the same digest exists and returns the
+// hex encoded digest.
+func (s *blobStore) put(chunk []byte) (string, error) {
+	sum := sha256.Sum256(chunk)
+	h := hex.EncodeToString(sum[:])
+	name := blobName(h)
+
+	if _, err := fs.Stat(s.fs, name); err == nil {
+		return h, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+
+	if err := fsx.MkdirAll(s.fs, path.Dir(name), 0755); err != nil {
+		return "", err
+	}
+
+	return h, writeAtomic(s.fs, name, chunk)
+}
+
+// get reads the blob h and verifies its digest.
+func (s *blobStore) get(h string) ([]byte, error) {
+	data, err := fs.ReadFile(s.fs, blobName(h))
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != h {
+		return nil, fmt.Errorf("%w: blob %s", ErrCorrupt, h)
+	}
+
+	return data, nil
+}
+
+// list calls fn for each file found in the blob directory passing the file's
+// name in the backing filesystem and the blob's digest. The digest is empty
+// for files not being a blob.
+func (s *blobStore) list(fn func(name, h string, size int64) error) error {
+	dirs, err := fs.ReadDir(s.fs, blobDir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+
+		entries, err := fs.ReadDir(s.fs, blobDir+"/"+d.Name())
+		if err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			if e.IsDir() {
+				continue
+			}
+
+			info, err := e.Info()
+			if err != nil {
+				return err
+			}
+
+			name := blobDir + "/" + d.Name() + "/" + e.Name()
+			h := d.Name() + e.Name()
+			if strings.HasSuffix(e.Name(), tmpSuffix) || !validDigest(h) {
+				h = ""
+			}
+
+			if err := fn(name, h, info.Size()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// writeAtomic writes data to a temporary file and renames it to name.
+func writeAtomic(fsys fsx.FS, name string, data []byte) error {
+	tmp := name + tmpSuffix
+
+	if err := fsx.WriteFile(fsys, tmp, data, 0644); err != nil {
+		fsys.Remove(tmp)
+		return err
+	}
+
+	if err := fsys.Rename(tmp, name); err != nil {
+		fsys.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
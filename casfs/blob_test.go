@@ -0,0 +1,46 @@
+package casfs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+)
+
+func TestChunker(t *testing.T) {
+	c := newChunker(1000)
+	data := randomData(6, 200_000)
+
+	t.Run("roundedSize", func(t *testing.T) {
+		expect.That(t, is.EqualTo(c.min, 128), is.EqualTo(c.max, 4096))
+	})
+
+	t.Run("bounds", func(t *testing.T) {
+		chunks := c.split(data)
+
+		expect.That(t, is.EqualTo(bytes.Equal(bytes.Join(chunks, nil), data), true))
+		for i, chunk := range chunks {
+			if i < len(chunks)-1 {
+				expect.That(t, is.EqualTo(len(chunk) > c.min, true))
+			}
+			expect.That(t, is.EqualTo(len(chunk) <= c.max, true))
+		}
+	})
+
+	t.Run("stable", func(t *testing.T) {
+		expect.That(t, is.DeepEqualTo(c.split(data), c.split(append([]byte(nil), data...))))
+	})
+
+	t.Run("constantData", func(t *testing.T) {
+		chunks := c.split(make([]byte, 10_000))
+		expect.That(t, is.SliceOfLen(chunks, 3), is.EqualTo(len(chunks[0]), c.max))
+	})
+
+	t.Run("small", func(t *testing.T) {
+		expect.That(t,
+			is.SliceOfLen(c.split(nil), 0),
+			is.SliceOfLen(c.split([]byte("x")), 1),
+		)
+	})
+}
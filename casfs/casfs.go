@@ -0,0 +1,406 @@
+// Package casfs provides a fsx.LinkFS implementation storing file content in
+// a content-addressable way inside a backing fsx.FS (e.g. an osfs.DirFS).
+//
+// File content is split into content defined chunks. Each chunk is stored as
+// a blob named by the hex encoded SHA-256 digest of its content:
+//
+//	blobs/<2 hex digits>/<62 hex digits>
+//
+// Identical files as well as identical chunks of similar files are thus
+// stored only once. Chunk boundaries are derived from the content using a
+// rolling hash, so inserting data into a file only affects the chunks next to
+// the modification.
+//
+// The namespace - directories, files referring to their chunks, symlinks and
+// metadata - is kept in memory and written as a JSON manifest to
+// manifest.json when calling Flush or Close. Renaming files and directories
+// as well as creating hard links and symlinks only modify the namespace.
+// Blobs are written when a file is closed; blobs no longer referenced by any
+// file (e.g. after removing or overwriting files) are deleted by GC.
+//
+// A backing filesystem must not be used by multiple instances at the same
+// time. Symlink targets are interpreted relative to the filesystem's root.
+//
+// Modes and ownership are stored in the manifest only; blobs are always
+// written with mode 0644 regardless of the files referencing them. New
+// entries are owned by uid and gid 0 until changed using Chown. Modes are
+// recorded but never checked, so files without write permission can still
+// be opened for writing.
+package casfs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/halimath/fsx"
+)
+
+const (
+	// DefaultChunkSize is the default average size of a chunk.
+	DefaultChunkSize = 64 << 10
+
+	// manifestName is the name of the manifest in the backing filesystem.
+	manifestName = "manifest.json"
+
+	// manifestVersion is the version of the manifest's format.
+	manifestVersion = 1
+)
+
+// ErrCorrupt is returned when reading a malformed manifest or a blob whose
+// content does not match its digest.
+var ErrCorrupt = errors.New("casfs: corrupt store")
+
+// Option defines a function used to customize a casfs.
+type Option func(*options)
+
+type options struct {
+	chunkSize int
+}
+
+// WithChunkSize sets the average size of chunks. size is rounded down to a
+// power of two; chunks are at least size/4 and at most size*8 bytes long.
+// Smaller chunks increase the deduplication of similar files at the cost of
+// more blobs. Changing the chunk size for an existing store only affects
+// files written afterwards.
+func WithChunkSize(size int) Option {
+	return func(o *options) {
+		o.chunkSize = size
+	}
+}
+
+// FS defines the interface of a content-addressable filesystem.
+type FS interface {
+	fsx.LinkFS
+	fsx.ChmodFS
+	fsx.ChownFS
+	fsx.ChtimesFS
+	fsx.RemoveAllFS
+	fs.StatFS
+	fs.ReadDirFS
+	fs.ReadFileFS
+
+	// Lstat returns a fs.FileInfo describing the named file without
+	// following a final symlink.
+	Lstat(name string) (fs.FileInfo, error)
+
+	// Flush writes the manifest to the backing filesystem.
+	Flush() error
+
+	// GC flushes the manifest and removes all blobs not referenced by any
+	// file as well as leftovers of interrupted writes.
+	GC() (GCStats, error)
+
+	// Close flushes the manifest and closes the filesystem. The filesystem
+	// must not be used after Close.
+	Close() error
+}
+
+// GCStats describes the result of a garbage collection.
+type GCStats struct {
+	// Retained is the number of blobs still referenced.
+	Retained int
+	// Removed is the number of removed files.
+	Removed int
+	// RemovedBytes is the total size of all removed files.
+	RemovedBytes int64
+}
+
+// Stat defines the structure returned from fs.FileInfo.Sys() for all entries
+// of a casfs.
+type Stat struct {
+	// The owner's UID.
+	Uid int
+	// The owner's GID.
+	Gid int
+	// The time the element was last accessed.
+	Atime time.Time
+	// Chunks contains the hex encoded SHA-256 digests of a file's chunks.
+	Chunks []string
+}
+
+// permBits defines the mode bits stored for an inode.
+const permBits = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+
+// inode holds the metadata of a file, directory or symlink. Hard links are
+// represented by multiple names referring to the same inode.
+type inode struct {
+	mode         fs.FileMode
+	uid, gid     int
+	mtime, atime time.Time
+	target       string
+	size         int64
+	chunks       []string
+}
+
+func (n *inode) isDir() bool     { return n.mode.IsDir() }
+func (n *inode) isSymlink() bool { return n.mode&fs.ModeSymlink != 0 }
+func (n *inode) isRegular() bool { return n.mode.IsRegular() }
+
+// Touch marks the directory n as modified at t.
+func (n *inode) Touch(t time.Time) { n.mtime = t }
+
+type fileInfo struct {
+	name string
+	n    *inode
+}
+
+func (i *fileInfo) Name() string       { return path.Base(i.name) }
+func (i *fileInfo) Size() int64        { return i.n.size }
+func (i *fileInfo) Mode() fs.FileMode  { return i.n.mode }
+func (i *fileInfo) ModTime() time.Time { return i.n.mtime }
+func (i *fileInfo) IsDir() bool        { return i.n.isDir() }
+
+func (i *fileInfo) Sys() any {
+	return Stat{
+		Uid:    i.n.uid,
+		Gid:    i.n.gid,
+		Atime:  i.n.atime,
+		Chunks: append([]string(nil), i.n.chunks...),
+	}
+}
+
+type casfs struct {
+	mu      sync.RWMutex
+	entries map[string]*inode
+	blobs   blobStore
+	chunker chunker
+	closed  bool
+}
+
+// New creates a filesystem storing its data in backing. If backing contains
+// a manifest, the namespace is read from it; otherwise the filesystem starts
+// empty.
+func New(backing fsx.FS, opts ...Option) (FS, error) {
+	o := options{chunkSize: DefaultChunkSize}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.chunkSize < 64 {
+		return nil, fmt.Errorf("casfs: invalid chunk size %d", o.chunkSize)
+	}
+
+	fsys := &casfs{
+		entries: map[string]*inode{
+			".": newDirInode(0755),
+		},
+		blobs:   blobStore{fs: backing},
+		chunker: newChunker(o.chunkSize),
+	}
+
+	data, err := fs.ReadFile(backing, manifestName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fsys, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fsys.decodeManifest(data); err != nil {
+		return nil, err
+	}
+
+	return fsys, nil
+}
+
+func newDirInode(perm fs.FileMode) *inode {
+	now := time.Now()
+	return &inode{
+		mode:  fs.ModeDir | perm&permBits,
+		mtime: now,
+		atime: now,
+	}
+}
+
+// -- Manifest
+
+type manifest struct {
+	Version int             `json:"version"`
+	Inodes  []manifestInode `json:"inodes"`
+	// Entries maps all names to the index of their inode.
+	Entries map[string]int `json:"entries"`
+}
+
+type manifestInode struct {
+	Mode   fs.FileMode `json:"mode"`
+	Uid    int         `json:"uid,omitempty"`
+	Gid    int         `json:"gid,omitempty"`
+	Atime  time.Time   `json:"atime"`
+	Mtime  time.Time   `json:"mtime"`
+	Target string      `json:"target,omitempty"`
+	Size   int64       `json:"size,omitempty"`
+	Chunks []string    `json:"chunks,omitempty"`
+}
+
+// encodeManifest encodes the namespace. fsys.mu must be held.
+func (fsys *casfs) encodeManifest() ([]byte, error) {
+	names := make([]string, 0, len(fsys.entries))
+	for name := range fsys.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	m := manifest{
+		Version: manifestVersion,
+		Entries: make(map[string]int, len(names)),
+	}
+
+	index := make(map[*inode]int)
+	for _, name := range names {
+		n := fsys.entries[name]
+
+		i, ok := index[n]
+		if !ok {
+			i = len(m.Inodes)
+			index[n] = i
+			m.Inodes = append(m.Inodes, manifestInode{
+				Mode:   n.mode,
+				Uid:    n.uid,
+				Gid:    n.gid,
+				Atime:  n.atime,
+				Mtime:  n.mtime,
+				Target: n.target,
+				Size:   n.size,
+				Chunks: n.chunks,
+			})
+		}
+
+		m.Entries[name] = i
+	}
+
+	return json.Marshal(m)
+}
+
+// decodeManifest replaces the namespace with the one stored in data.
+func (fsys *casfs) decodeManifest(data []byte) error {
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("%w: manifest: %v", ErrCorrupt, err)
+	}
+
+	if m.Version != manifestVersion {
+		return fmt.Errorf("%w: manifest: unsupported version %d", ErrCorrupt, m.Version)
+	}
+
+	inodes := make([]*inode, len(m.Inodes))
+	for i, mi := range m.Inodes {
+		for _, h := range mi.Chunks {
+			if !validDigest(h) {
+				return fmt.Errorf("%w: manifest: invalid digest %q", ErrCorrupt, h)
+			}
+		}
+
+		inodes[i] = &inode{
+			mode:   mi.Mode,
+			uid:    mi.Uid,
+			gid:    mi.Gid,
+			atime:  mi.Atime,
+			mtime:  mi.Mtime,
+			target: mi.Target,
+			size:   mi.Size,
+			chunks: mi.Chunks,
+		}
+	}
+
+	entries := make(map[string]*inode, len(m.Entries))
+	for name, i := range m.Entries {
+		if !fs.ValidPath(name) || i < 0 || i >= len(inodes) {
+			return fmt.Errorf("%w: manifest: invalid entry %q", ErrCorrupt, name)
+		}
+		entries[name] = inodes[i]
+	}
+
+	if root, ok := entries["."]; !ok || !root.isDir() {
+		return fmt.Errorf("%w: manifest: missing root directory", ErrCorrupt)
+	}
+
+	for name := range entries {
+		if name == "." {
+			continue
+		}
+		if d, ok := entries[path.Dir(name)]; !ok || !d.isDir() {
+			return fmt.Errorf("%w: manifest: missing parent of %q", ErrCorrupt, name)
+		}
+	}
+
+	fsys.entries = entries
+	return nil
+}
+
+// flush writes the manifest. fsys.mu must be held.
+func (fsys *casfs) flush() error {
+	if fsys.closed {
+		return fs.ErrClosed
+	}
+
+	data, err := fsys.encodeManifest()
+	if err != nil {
+		return err
+	}
+
+	return writeAtomic(fsys.blobs.fs, manifestName, data)
+}
+
+// Flush writes the manifest to the backing filesystem.
+func (fsys *casfs) Flush() error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	return fsys.flush()
+}
+
+// Close flushes the manifest and closes fsys.
+func (fsys *casfs) Close() error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	if err := fsys.flush(); err != nil {
+		return err
+	}
+
+	fsys.closed = true
+	return nil
+}
+
+// GC flushes the manifest and removes all unreferenced blobs.
+func (fsys *casfs) GC() (GCStats, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	var stats GCStats
+
+	// Flush first so the persisted manifest never refers to removed blobs.
+	if err := fsys.flush(); err != nil {
+		return stats, err
+	}
+
+	referenced := make(map[string]struct{})
+	for _, n := range fsys.entries {
+		for _, h := range n.chunks {
+			referenced[h] = struct{}{}
+		}
+	}
+
+	err := fsys.blobs.list(func(name, h string, size int64) error {
+		if _, ok := referenced[h]; ok && h != "" {
+			stats.Retained++
+			return nil
+		}
+
+		if err := fsys.blobs.fs.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+
+		stats.Removed++
+		stats.RemovedBytes += size
+		return nil
+	})
+
+	return stats, err
+}
@@ -0,0 +1,262 @@
+package casfs
+
+import (
+	"bytes"
+	"io/fs"
+	"math/rand"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	. "github.com/halimath/fixture"
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/memfs"
+)
+
+type casfsFixture struct {
+	backing fsx.LinkFS
+	fs      FS
+}
+
+func (f *casfsFixture) BeforeEach(t *testing.T) error {
+	f.backing = memfs.New()
+
+	var err error
+	f.fs, err = New(f.backing, WithChunkSize(256))
+	if err != nil {
+		return err
+	}
+
+	if err := fsx.MkdirAll(f.fs, "etc/ssl", 0755); err != nil {
+		return err
+	}
+	if err := fsx.WriteFile(f.fs, "etc/hosts", []byte("127.0.0.1 localhost\n"), 0644); err != nil {
+		return err
+	}
+	if err := fsx.WriteFile(f.fs, "etc/ssl/cert.pem", []byte("cert"), 0600); err != nil {
+		return err
+	}
+	return f.fs.Symlink("etc/hosts", "hosts")
+}
+
+// blobs returns the names of all blobs found in the backing filesystem.
+func (f *casfsFixture) blobs(t *testing.T) []string {
+	var names []string
+	err := fs.WalkDir(f.backing, ".", func(p string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && strings.HasPrefix(p, blobDir+"/") {
+			names = append(names, p)
+		}
+		return err
+	})
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	return names
+}
+
+func randomData(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestCASFS(t *testing.T) {
+	With(t, new(casfsFixture)).
+		Run("fstest", func(t *testing.T, f *casfsFixture) {
+			expect.That(t, is.NoError(fstest.TestFS(f.fs, "etc/hosts", "etc/ssl/cert.pem", "hosts")))
+		}).
+		Run("readAndWrite", func(t *testing.T, f *casfsFixture) {
+			content, err := fs.ReadFile(f.fs, "hosts")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "127.0.0.1 localhost\n"))
+
+			file, err := f.fs.OpenFile("hosts", fsx.O_WRONLY|fsx.O_APPEND, 0)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			_, err = file.Write([]byte("::1 localhost\n"))
+			expect.That(t, is.NoError(err), is.NoError(file.Close()))
+
+			info, err := f.fs.Stat("etc/hosts")
+			expect.That(t, is.NoError(err), is.EqualTo(info.Size(), int64(34)))
+
+			content, err = f.fs.ReadFile("etc/hosts")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "127.0.0.1 localhost\n::1 localhost\n"))
+		}).
+		Run("largeFile", func(t *testing.T, f *casfsFixture) {
+			data := randomData(1, 100_000)
+			expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(f.fs, "large.bin", data, 0644))))
+
+			got, err := f.fs.ReadFile("large.bin")
+			expect.That(t, is.NoError(err), is.EqualTo(bytes.Equal(got, data), true))
+
+			info, err := f.fs.Stat("large.bin")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			chunks := info.Sys().(Stat).Chunks
+			expect.That(t, is.EqualTo(len(chunks) > 1, true))
+		}).
+		Run("identicalFiles", func(t *testing.T, f *casfsFixture) {
+			data := randomData(2, 10_000)
+			before := len(f.blobs(t))
+
+			expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(f.fs, "a.bin", data, 0644))))
+			afterFirst := len(f.blobs(t))
+
+			expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(f.fs, "b.bin", data, 0644))))
+
+			expect.That(t,
+				is.EqualTo(afterFirst > before, true),
+				is.EqualTo(len(f.blobs(t)), afterFirst),
+			)
+
+			a, _ := f.fs.Stat("a.bin")
+			b, _ := f.fs.Stat("b.bin")
+			expect.That(t,
+				is.DeepEqualTo(a.Sys().(Stat).Chunks, b.Sys().(Stat).Chunks),
+				is.EqualTo(f.fs.SameFile(a, b), false),
+			)
+		}).
+		Run("similarFiles", func(t *testing.T, f *casfsFixture) {
+			data := randomData(3, 50_000)
+			modified := append(append(append([]byte(nil), data[:20_000]...), "inserted"...), data[20_000:]...)
+
+			expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(f.fs, "v1.bin", data, 0644))))
+			expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(f.fs, "v2.bin", modified, 0644))))
+
+			v1, _ := f.fs.Stat("v1.bin")
+			v2, _ := f.fs.Stat("v2.bin")
+
+			shared := make(map[string]bool)
+			for _, h := range v1.Sys().(Stat).Chunks {
+				shared[h] = true
+			}
+			differing := 0
+			for _, h := range v2.Sys().(Stat).Chunks {
+				if !shared[h] {
+					differing++
+				}
+			}
+
+			expect.That(t, is.EqualTo(differing <= 3, true))
+
+			got, err := f.fs.ReadFile("v2.bin")
+			expect.That(t, is.NoError(err), is.EqualTo(bytes.Equal(got, modified), true))
+		}).
+		Run("metadataOnly", func(t *testing.T, f *casfsFixture) {
+			blobs := f.blobs(t)
+
+			expect.That(t,
+				is.NoError(f.fs.Rename("etc", "config")),
+				is.NoError(f.fs.Link("config/hosts", "hosts.link")),
+				is.NoError(f.fs.Symlink("config/ssl/cert.pem", "cert.pem")),
+			)
+
+			expect.That(t, is.DeepEqualTo(f.blobs(t), blobs))
+
+			content, err := f.fs.ReadFile("cert.pem")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "cert"))
+
+			a, _ := f.fs.Stat("config/hosts")
+			b, _ := f.fs.Stat("hosts.link")
+			expect.That(t, is.EqualTo(f.fs.SameFile(a, b), true))
+
+			_, err = f.fs.Stat("hosts")
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+		}).
+		Run("persistence", func(t *testing.T, f *casfsFixture) {
+			mtime := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+			expect.That(t,
+				is.NoError(f.fs.Link("etc/hosts", "etc/hosts.bak")),
+				is.NoError(f.fs.Chmod("etc/hosts", 0600)),
+				is.NoError(f.fs.Chown("etc/hosts", 1000, 100)),
+				is.NoError(f.fs.Chtimes("etc/hosts", time.Time{}, mtime)),
+				is.NoError(f.fs.Close()),
+			)
+
+			_, err := f.fs.Stat("etc/hosts")
+			expect.That(t, is.Error(err, fs.ErrClosed))
+
+			reopened, err := New(f.backing)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			expect.That(t, is.NoError(fstest.TestFS(reopened, "etc/hosts", "etc/hosts.bak", "etc/ssl/cert.pem", "hosts")))
+
+			info, err := reopened.Stat("etc/hosts")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			expect.That(t,
+				is.EqualTo(info.Mode(), fs.FileMode(0600)),
+				is.EqualTo(info.ModTime().Equal(mtime), true),
+				is.EqualTo(info.Sys().(Stat).Uid, 1000),
+				is.EqualTo(info.Sys().(Stat).Gid, 100),
+			)
+
+			bak, err := reopened.Stat("etc/hosts.bak")
+			expect.That(t, is.NoError(err), is.EqualTo(reopened.SameFile(info, bak), true))
+
+			target, err := reopened.Readlink("hosts")
+			expect.That(t, is.NoError(err), is.EqualTo(target, "etc/hosts"))
+		}).
+		Run("gc", func(t *testing.T, f *casfsFixture) {
+			expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(f.fs, "a.bin", randomData(4, 5_000), 0644))))
+			expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(f.fs, "b.bin", randomData(5, 5_000), 0644))))
+			expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(f.fs, "a.bin", []byte("replaced"), 0644))))
+			expect.That(t, expect.FailNow(is.NoError(f.fs.Remove("b.bin"))))
+			expect.That(t, expect.FailNow(is.NoError(fsx.MkdirAll(f.backing, blobDir+"/00", 0755))))
+			expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(f.backing, blobDir+"/00/leftover"+tmpSuffix, []byte("x"), 0644))))
+
+			stats, err := f.fs.GC()
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			expect.That(t,
+				is.EqualTo(stats.Retained, 3),
+				is.EqualTo(stats.Removed > 2, true),
+				is.EqualTo(stats.RemovedBytes, int64(10_001)),
+				is.SliceOfLen(f.blobs(t), 3),
+			)
+
+			for name, want := range map[string]string{"a.bin": "replaced", "hosts": "127.0.0.1 localhost\n", "etc/ssl/cert.pem": "cert"} {
+				content, err := f.fs.ReadFile(name)
+				expect.That(t, is.NoError(err), is.EqualTo(string(content), want))
+			}
+
+			_, err = fs.Stat(f.backing, manifestName)
+			expect.That(t, is.NoError(err))
+		}).
+		Run("corruptBlob", func(t *testing.T, f *casfsFixture) {
+			info, _ := f.fs.Stat("etc/ssl/cert.pem")
+			h := info.Sys().(Stat).Chunks[0]
+			expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(f.backing, blobName(h), []byte("tampered"), 0644))))
+
+			_, err := f.fs.ReadFile("etc/ssl/cert.pem")
+			expect.That(t, is.Error(err, ErrCorrupt))
+		}).
+		Run("corruptManifest", func(t *testing.T, f *casfsFixture) {
+			for _, manifest := range []string{
+				"not json",
+				`{"version":2}`,
+				`{"version":1,"inodes":[],"entries":{}}`,
+				`{"version":1,"inodes":[{"mode":2147484141}],"entries":{".":0,"a/b":0}}`,
+				`{"version":1,"inodes":[{"mode":2147484141},{"chunks":["abc"]}],"entries":{".":0,"a":1}}`,
+			} {
+				expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(f.backing, manifestName, []byte(manifest), 0644))))
+
+				_, err := New(f.backing)
+				expect.That(t, is.Error(err, ErrCorrupt))
+			}
+		}).
+		Run("invalidChunkSize", func(t *testing.T, f *casfsFixture) {
+			_, err := New(f.backing, WithChunkSize(0))
+			expect.That(t, is.EqualTo(err != nil, true))
+		}).
+		Run("removeNonEmptyDir", func(t *testing.T, f *casfsFixture) {
+			expect.That(t,
+				is.Error(f.fs.Remove("etc"), fsx.ErrDirNotEmpty),
+				is.NoError(f.fs.RemoveAll("etc")),
+				is.NoError(f.fs.RemoveAll("etc")),
+			)
+
+			_, err := f.fs.Stat("hosts")
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+
+			info, err := f.fs.Lstat("hosts")
+			expect.That(t, is.NoError(err), is.EqualTo(info.Mode().Type(), fs.ModeSymlink))
+		})
+}
@@ -0,0 +1,615 @@
+package casfs
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/internal/buffile"
+	"github.com/halimath/fsx/internal/pathtree"
+)
+
+// maxSymlinkDepth limits the number of symlinks resolved when looking up a
+// single name.
+const maxSymlinkDepth = 40
+
+func pathError(op, name string, err error) error {
+	if _, ok := err.(*fs.PathError); ok {
+		return err
+	}
+
+	return &fs.PathError{
+		Op:   op,
+		Path: name,
+		Err:  err,
+	}
+}
+
+// resolve looks up name and returns the resolved name (with all symlinks in
+// directory components replaced) and the inode. If followLast is true, a
+// final symlink is followed as well. fsys.mu must be held.
+func (fsys *casfs) resolve(op, name string, followLast bool) (string, *inode, error) {
+	if fsys.closed {
+		return "", nil, pathError(op, name, fs.ErrClosed)
+	}
+
+	if !fs.ValidPath(name) {
+		return "", nil, pathError(op, name, fs.ErrInvalid)
+	}
+
+	resolved, n, err := fsys.tree().Resolve(name, followLast, maxSymlinkDepth)
+	if err != nil {
+		return "", nil, pathError(op, name, err)
+	}
+	return resolved, n, nil
+}
+
+// tree returns the tree of fsys' inodes. fsys.mu must be held.
+func (fsys *casfs) tree() pathtree.Tree[*inode] {
+	return pathtree.Tree[*inode]{
+		Root: fsys.entries["."],
+		Child: func(_ *inode, name string) (*inode, bool, error) {
+			n, ok := fsys.entries[name]
+			return n, ok, nil
+		},
+		IsDir: (*inode).isDir,
+		Link: func(_ string, n *inode) (string, bool, error) {
+			if !n.isSymlink() {
+				return "", false, nil
+			}
+			return n.target, true, nil
+		},
+	}
+}
+
+// resolveParent resolves the directory containing name and returns the
+// resolved name.
+func (fsys *casfs) resolveParent(op, name string) (string, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return "", pathError(op, name, fs.ErrInvalid)
+	}
+
+	dirName, base := path.Split(name)
+	dirName = strings.TrimSuffix(dirName, "/")
+	if dirName == "" {
+		dirName = "."
+	}
+
+	resolvedDir, d, err := fsys.resolve(op, dirName, true)
+	if err != nil {
+		return "", err
+	}
+
+	if !d.isDir() {
+		return "", pathError(op, name, fs.ErrInvalid)
+	}
+
+	return path.Join(resolvedDir, base), nil
+}
+
+// children returns the sorted names of all direct children of dir.
+func (fsys *casfs) children(dir string) []string {
+	var names []string
+	for name := range fsys.entries {
+		if name != "." && path.Dir(name) == dir {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// readData assembles the content of the regular file n from its chunks.
+func (fsys *casfs) readData(n *inode) ([]byte, error) {
+	data := make([]byte, 0, n.size)
+	for _, h := range n.chunks {
+		chunk, err := fsys.blobs.get(h)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+	}
+	return data, nil
+}
+
+// writeData stores data as chunks and updates n. fsys.mu must be held.
+func (fsys *casfs) writeData(n *inode, data []byte) error {
+	var chunks []string
+	for _, chunk := range fsys.chunker.split(data) {
+		h, err := fsys.blobs.put(chunk)
+		if err != nil {
+			return err
+		}
+		chunks = append(chunks, h)
+	}
+
+	n.chunks = chunks
+	n.size = int64(len(data))
+	n.mtime = time.Now()
+
+	return nil
+}
+
+// -- fs.FS
+
+// Open opens the named file for reading.
+func (fsys *casfs) Open(name string) (fs.File, error) {
+	return fsys.OpenFile(name, fsx.O_RDONLY, 0)
+}
+
+// -- fsx.FS
+
+// OpenFile opens the file named name using flag. If the file is created, it
+// is created with permission perm. The file's content is stored when the
+// file is closed.
+func (fsys *casfs) OpenFile(name string, flag int, perm fs.FileMode) (fsx.File, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	writable := flag&(fsx.O_WRONLY|fsx.O_RDWR) != 0
+
+	resolved, n, err := fsys.resolve("OpenFile", name, true)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) || flag&fsx.O_CREATE == 0 {
+			return nil, err
+		}
+
+		resolved, err = fsys.resolveParent("OpenFile", name)
+		if err != nil {
+			return nil, err
+		}
+
+		if l, ok := fsys.entries[resolved]; ok && l.isSymlink() {
+			// Dangling symlink: create the link's target.
+			resolved = l.target
+			if _, err := fsys.resolveParent("OpenFile", resolved); err != nil {
+				return nil, err
+			}
+		}
+
+		now := time.Now()
+		n = &inode{
+			mode:  perm & permBits,
+			mtime: now,
+			atime: now,
+		}
+		fsys.entries[resolved] = n
+		pathtree.Touch(fsys.entries, resolved)
+
+		return fsys.newFileHandle(name, resolved, n, nil, flag, true), nil
+	}
+
+	if flag&fsx.O_CREATE != 0 && flag&fsx.O_EXCL != 0 {
+		return nil, pathError("OpenFile", name, fs.ErrExist)
+	}
+
+	if n.isDir() {
+		if writable {
+			return nil, pathError("OpenFile", name, buffile.ErrIsDirectory)
+		}
+
+		return buffile.NewDir(name, func() (fs.FileInfo, error) {
+			fsys.mu.RLock()
+			defer fsys.mu.RUnlock()
+			return &fileInfo{name: resolved, n: n}, nil
+		}, fsys.readDir(resolved)), nil
+	}
+
+	if writable && !n.isRegular() {
+		return nil, pathError("OpenFile", name, fs.ErrInvalid)
+	}
+
+	var data []byte
+	if flag&fsx.O_TRUNC == 0 || !writable {
+		if data, err = fsys.readData(n); err != nil {
+			return nil, pathError("OpenFile", name, err)
+		}
+	}
+
+	return fsys.newFileHandle(name, resolved, n, data, flag, false), nil
+}
+
+func (fsys *casfs) newFileHandle(name, resolved string, n *inode, data []byte, flag int, created bool) fsx.File {
+	return buffile.New(name, data, buffile.Options{
+		Flag:  flag,
+		Dirty: created,
+		Stat: func(size int64) (fs.FileInfo, error) {
+			fsys.mu.RLock()
+			defer fsys.mu.RUnlock()
+
+			return &fileInfo{name: resolved, n: n}, nil
+		},
+		Commit: func(data []byte) error {
+			fsys.mu.Lock()
+			defer fsys.mu.Unlock()
+
+			if fsys.closed {
+				return pathError("Close", name, fs.ErrClosed)
+			}
+
+			if err := fsys.writeData(n, data); err != nil {
+				return pathError("Close", name, err)
+			}
+			return nil
+		},
+		Chmod: func(mode fs.FileMode) error {
+			fsys.mu.Lock()
+			defer fsys.mu.Unlock()
+
+			n.mode = n.mode.Type() | mode&permBits
+			return nil
+		},
+		Chown: func(uid, gid int) error {
+			fsys.mu.Lock()
+			defer fsys.mu.Unlock()
+
+			n.uid, n.gid = uid, gid
+			return nil
+		},
+	})
+}
+
+// readDir returns the entries of the directory dir. fsys.mu must be held.
+func (fsys *casfs) readDir(dir string) []fs.DirEntry {
+	names := fsys.children(dir)
+	entries := make([]fs.DirEntry, len(names))
+	for i, name := range names {
+		entries[i] = fs.FileInfoToDirEntry(&fileInfo{name: name, n: fsys.entries[name]})
+	}
+	return entries
+}
+
+// Mkdir creates a directory named name with permission perm.
+func (fsys *casfs) Mkdir(name string, perm fs.FileMode) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	resolved, err := fsys.resolveParent("Mkdir", name)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := fsys.entries[resolved]; ok {
+		return pathError("Mkdir", name, fs.ErrExist)
+	}
+
+	fsys.entries[resolved] = newDirInode(perm)
+	pathtree.Touch(fsys.entries, resolved)
+
+	return nil
+}
+
+// Remove removes the named file or empty directory. The file's blobs are
+// kept until the next GC.
+func (fsys *casfs) Remove(name string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	resolved, n, err := fsys.resolve("Remove", name, false)
+	if err != nil {
+		return err
+	}
+
+	if resolved == "." {
+		return pathError("Remove", name, fs.ErrInvalid)
+	}
+
+	if n.isDir() && pathtree.HasChildren(fsys.entries, resolved) {
+		return pathError("Remove", name, fsx.ErrDirNotEmpty)
+	}
+
+	delete(fsys.entries, resolved)
+	pathtree.Touch(fsys.entries, resolved)
+
+	return nil
+}
+
+// RemoveAll removes name and all of its children. It returns nil if name does
+// not exist.
+func (fsys *casfs) RemoveAll(name string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	resolved, _, err := fsys.resolve("RemoveAll", name, false)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	if resolved == "." {
+		return pathError("RemoveAll", name, fs.ErrInvalid)
+	}
+
+	for p := range fsys.entries {
+		if p == resolved || strings.HasPrefix(p, resolved+"/") {
+			delete(fsys.entries, p)
+		}
+	}
+	pathtree.Touch(fsys.entries, resolved)
+
+	return nil
+}
+
+// Rename renames oldpath to newpath. If newpath exists and is not a non-empty
+// directory, it is replaced. Only the namespace is modified.
+func (fsys *casfs) Rename(oldpath, newpath string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	from, n, err := fsys.resolve("Rename", oldpath, false)
+	if err != nil {
+		return err
+	}
+
+	if from == "." {
+		return pathError("Rename", oldpath, fs.ErrInvalid)
+	}
+
+	to, err := fsys.resolveParent("Rename", newpath)
+	if err != nil {
+		return err
+	}
+
+	if to == from {
+		return nil
+	}
+
+	if strings.HasPrefix(to, from+"/") {
+		return pathError("Rename", newpath, fs.ErrInvalid)
+	}
+
+	if existing, ok := fsys.entries[to]; ok {
+		switch {
+		case existing.isDir() && !n.isDir():
+			return pathError("Rename", newpath, fs.ErrExist)
+		case existing.isDir() && pathtree.HasChildren(fsys.entries, to):
+			return pathError("Rename", newpath, fsx.ErrDirNotEmpty)
+		case !existing.isDir() && n.isDir():
+			return pathError("Rename", newpath, fs.ErrExist)
+		}
+		delete(fsys.entries, to)
+	}
+
+	for p, e := range fsys.entries {
+		if p == from {
+			delete(fsys.entries, p)
+			fsys.entries[to] = e
+		} else if strings.HasPrefix(p, from+"/") {
+			delete(fsys.entries, p)
+			fsys.entries[to+p[len(from):]] = e
+		}
+	}
+
+	pathtree.Touch(fsys.entries, from)
+	pathtree.Touch(fsys.entries, to)
+
+	return nil
+}
+
+// SameFile reports whether fi1 and fi2 describe the same inode, i.e. the same
+// file or hard links to the same file.
+func (fsys *casfs) SameFile(fi1, fi2 fs.FileInfo) bool {
+	i1, ok := fi1.(*fileInfo)
+	if !ok {
+		return false
+	}
+
+	i2, ok := fi2.(*fileInfo)
+	if !ok {
+		return false
+	}
+
+	return i1.n == i2.n
+}
+
+// -- fsx.ChmodFS, fsx.ChownFS, fsx.ChtimesFS
+
+// Chmod changes the mode of the named file.
+func (fsys *casfs) Chmod(name string, mode fs.FileMode) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	_, n, err := fsys.resolve("Chmod", name, true)
+	if err != nil {
+		return err
+	}
+
+	n.mode = n.mode.Type() | mode&permBits
+
+	return nil
+}
+
+// Chown changes the numeric owner and group of the named file.
+func (fsys *casfs) Chown(name string, uid, gid int) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	_, n, err := fsys.resolve("Chown", name, true)
+	if err != nil {
+		return err
+	}
+
+	n.uid, n.gid = uid, gid
+
+	return nil
+}
+
+// Chtimes changes the access and modification time of the named file. A zero
+// value keeps the current value.
+func (fsys *casfs) Chtimes(name string, atime, mtime time.Time) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	_, n, err := fsys.resolve("Chtimes", name, true)
+	if err != nil {
+		return err
+	}
+
+	if !atime.IsZero() {
+		n.atime = atime
+	}
+	if !mtime.IsZero() {
+		n.mtime = mtime
+	}
+
+	return nil
+}
+
+// -- fsx.LinkFS
+
+// Readlink returns the target of the symlink name relative to the
+// filesystem's root.
+func (fsys *casfs) Readlink(name string) (string, error) {
+	fsys.mu.RLock()
+	defer fsys.mu.RUnlock()
+
+	_, n, err := fsys.resolve("Readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+
+	if !n.isSymlink() {
+		return "", pathError("Readlink", name, fs.ErrInvalid)
+	}
+
+	return n.target, nil
+}
+
+// Link creates newname as a hard link to oldname. Both names share the same
+// content and metadata.
+func (fsys *casfs) Link(oldname, newname string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	_, n, err := fsys.resolve("Link", oldname, false)
+	if err != nil {
+		return err
+	}
+
+	if n.isDir() {
+		return pathError("Link", oldname, fs.ErrInvalid)
+	}
+
+	to, err := fsys.resolveParent("Link", newname)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := fsys.entries[to]; ok {
+		return pathError("Link", newname, fs.ErrExist)
+	}
+
+	fsys.entries[to] = n
+	pathtree.Touch(fsys.entries, to)
+
+	return nil
+}
+
+// Symlink creates newname as a symlink to oldname. oldname is interpreted
+// relative to the filesystem's root and does not need to exist.
+func (fsys *casfs) Symlink(oldname, newname string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	if !fs.ValidPath(oldname) {
+		return pathError("Symlink", oldname, fs.ErrInvalid)
+	}
+
+	to, err := fsys.resolveParent("Symlink", newname)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := fsys.entries[to]; ok {
+		return pathError("Symlink", newname, fs.ErrExist)
+	}
+
+	now := time.Now()
+	fsys.entries[to] = &inode{
+		mode:   fs.ModeSymlink | 0777,
+		mtime:  now,
+		atime:  now,
+		target: oldname,
+		size:   int64(len(oldname)),
+	}
+	pathtree.Touch(fsys.entries, to)
+
+	return nil
+}
+
+// -- fs.StatFS, fs.ReadDirFS, fs.ReadFileFS
+
+// Stat returns a fs.FileInfo describing the named file following symlinks.
+// The info's Sys method returns a Stat value.
+func (fsys *casfs) Stat(name string) (fs.FileInfo, error) {
+	fsys.mu.RLock()
+	defer fsys.mu.RUnlock()
+
+	resolved, n, err := fsys.resolve("Stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileInfo{name: resolved, n: n}, nil
+}
+
+// Lstat returns a fs.FileInfo describing the named file without following a
+// final symlink.
+func (fsys *casfs) Lstat(name string) (fs.FileInfo, error) {
+	fsys.mu.RLock()
+	defer fsys.mu.RUnlock()
+
+	resolved, n, err := fsys.resolve("Lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileInfo{name: resolved, n: n}, nil
+}
+
+// ReadDir returns the sorted entries of the named directory. Symlinks are
+// reported with fs.ModeSymlink and are not followed.
+func (fsys *casfs) ReadDir(name string) ([]fs.DirEntry, error) {
+	fsys.mu.RLock()
+	defer fsys.mu.RUnlock()
+
+	resolved, n, err := fsys.resolve("ReadDir", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if !n.isDir() {
+		return nil, pathError("ReadDir", name, fs.ErrInvalid)
+	}
+
+	return fsys.readDir(resolved), nil
+}
+
+// ReadFile returns the content of the named file.
+func (fsys *casfs) ReadFile(name string) ([]byte, error) {
+	fsys.mu.RLock()
+	defer fsys.mu.RUnlock()
+
+	_, n, err := fsys.resolve("ReadFile", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.isDir() {
+		return nil, pathError("ReadFile", name, buffile.ErrIsDirectory)
+	}
+
+	data, err := fsys.readData(n)
+	if err != nil {
+		return nil, pathError("ReadFile", name, err)
+	}
+	return data, nil
+}
+
+var _ FS = &casfs{}
@@ -0,0 +1,545 @@
+// Package compressfs provides a fsx.FS wrapper that transparently compresses
+// files stored in another fsx.FS (e.g. an osfs.DirFS).
+//
+// Files are compressed using flate or gzip in independently compressed
+// chunks. An index stored at the end of each compressed file allows Seek and
+// ReadAt to only decompress the chunks containing the requested data. Stat
+// and ReadDir report uncompressed sizes.
+//
+// Rules select the compression method based on a file's path, so text files
+// can be compressed while already compressed formats are stored as they are.
+// Rules are applied when a file is written; reading detects compressed files
+// by their content, so renaming a file or changing the rules never renders a
+// file unreadable. Files stored uncompressed whose content starts like a
+// compressed file are marked as stored, so they read back unchanged.
+//
+// Compressed files opened write-only with fsx.O_APPEND are appended to in
+// place: new data is compressed into new chunks and only the last chunk, the
+// index and the trailer are rewritten. Otherwise, compressed files are written
+// as a whole: a compressed file opened for writing is decompressed into memory
+// and compressed again when it is closed. Files stored uncompressed are
+// written directly to the backing filesystem.
+package compressfs
+
+import (
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/internal/buffile"
+	"github.com/halimath/fsx/internal/wrapfs"
+)
+
+// ErrCorrupt is returned when reading a compressed file that is damaged.
+var ErrCorrupt = errors.New("compressfs: corrupt file")
+
+// Method defines how a file is stored.
+type Method uint8
+
+const (
+	// Store stores files uncompressed.
+	Store Method = iota
+	// Flate compresses files using raw deflate.
+	Flate
+	// Gzip compresses each chunk as a gzip member, including a header and a
+	// checksum.
+	Gzip
+)
+
+// DefaultChunkSize is the default size of the uncompressed chunks.
+const DefaultChunkSize = 64 << 10
+
+// Rule selects the method used to store files whose path matches Pattern.
+// Patterns use the syntax of path.Match. A pattern containing a slash is
+// matched against the full path, otherwise against the file's base name.
+type Rule struct {
+	Pattern string
+	Method  Method
+}
+
+// Option defines a function used to customize a compressfs.
+type Option func(*options)
+
+type options struct {
+	rules     []Rule
+	method    Method
+	level     int
+	chunkSize int
+}
+
+// WithRules adds rules selecting the method used to store files. Rules are
+// evaluated in order; the first matching rule wins.
+func WithRules(rules ...Rule) Option {
+	return func(o *options) {
+		o.rules = append(o.rules, rules...)
+	}
+}
+
+// WithMethod sets the method used for files not matched by any rule. The
+// default is Flate.
+func WithMethod(method Method) Option {
+	return func(o *options) {
+		o.method = method
+	}
+}
+
+// WithLevel sets the compression level as defined by compress/flate. The
+// default is flate.DefaultCompression.
+func WithLevel(level int) Option {
+	return func(o *options) {
+		o.level = level
+	}
+}
+
+// WithChunkSize sets the size of the uncompressed chunks. Smaller chunks
+// speed up random access at the cost of a lower compression ratio.
+func WithChunkSize(size int) Option {
+	return func(o *options) {
+		o.chunkSize = size
+	}
+}
+
+// FS defines the interface of a compressing filesystem. Stat, ReadDir and
+// ReadFile report and return uncompressed contents; all other operations act
+// on the backing files unchanged.
+type FS interface {
+	fsx.LinkFS
+	fsx.ChmodFS
+	fsx.ChownFS
+	fsx.ChtimesFS
+	fsx.RemoveAllFS
+	fs.StatFS
+	fs.ReadDirFS
+	fs.ReadFileFS
+}
+
+type compressfs struct {
+	backing fsx.FS
+	opts    options
+}
+
+// New creates a filesystem storing compressed files in backing.
+func New(backing fsx.FS, opts ...Option) (FS, error) {
+	o := options{
+		method:    Flate,
+		level:     flate.DefaultCompression,
+		chunkSize: DefaultChunkSize,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.chunkSize <= 0 || int64(o.chunkSize) > 1<<31 {
+		return nil, fmt.Errorf("compressfs: invalid chunk size: %d", o.chunkSize)
+	}
+
+	if o.level < flate.HuffmanOnly || o.level > flate.BestCompression {
+		return nil, fmt.Errorf("compressfs: invalid compression level: %d", o.level)
+	}
+
+	for _, r := range append(o.rules, Rule{Method: o.method}) {
+		if _, err := path.Match(r.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("compressfs: invalid pattern %q: %w", r.Pattern, err)
+		}
+		if r.Method > Gzip {
+			return nil, fmt.Errorf("compressfs: invalid method: %d", r.Method)
+		}
+	}
+
+	return &compressfs{
+		backing: backing,
+		opts:    o,
+	}, nil
+}
+
+// method returns the method used to store name.
+func (fsys *compressfs) method(name string) Method {
+	for _, r := range fsys.opts.rules {
+		subject := name
+		if !strings.Contains(r.Pattern, "/") {
+			subject = path.Base(name)
+		}
+
+		if ok, _ := path.Match(r.Pattern, subject); ok {
+			return r.Method
+		}
+	}
+	return fsys.opts.method
+}
+
+// fileInfo reports the uncompressed size of a backing file.
+type fileInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (i *fileInfo) Size() int64 { return i.size }
+
+// dirEntry wraps a backing entry reporting the uncompressed size.
+type dirEntry struct {
+	fs.DirEntry
+	fsys *compressfs
+	name string
+}
+
+func (e *dirEntry) Info() (fs.FileInfo, error) {
+	info, err := e.DirEntry.Info()
+	if err != nil || !info.Mode().IsRegular() {
+		return info, err
+	}
+	return e.fsys.wrapInfo(e.name, info)
+}
+
+// wrapInfo reports the uncompressed size of the regular file name described
+// by info.
+func (fsys *compressfs) wrapInfo(name string, info fs.FileInfo) (fs.FileInfo, error) {
+	if info.Size() < headerSize+trailerSize {
+		return info, nil
+	}
+
+	f, err := fsys.backing.OpenFile(name, fsx.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := inspect(f, info.Size())
+	if err != nil {
+		return nil, wrapfs.PathError("Stat", name, err)
+	}
+	if c == nil {
+		return info, nil
+	}
+
+	return &fileInfo{FileInfo: info, size: c.size}, nil
+}
+
+// openRead opens name for reading. It returns either a *compressedFile or
+// the backing file.
+func (fsys *compressfs) openRead(name string) (fsx.File, error) {
+	f, err := fsys.backing.OpenFile(name, fsx.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	c, err := inspect(f, info.Size())
+	if err == nil && c != nil {
+		var cf *compressedFile
+		if cf, err = newCompressedFile(name, f, c); err == nil {
+			return cf, nil
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, wrapfs.PathError("OpenFile", name, err)
+	}
+
+	if _, err := f.Seek(0, fsx.SeekWhenceRelativeOrigin); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// -- fs.FS
+
+// Open opens the named file for reading.
+func (fsys *compressfs) Open(name string) (fs.File, error) {
+	return fsys.OpenFile(name, fsx.O_RDONLY, 0)
+}
+
+// -- fsx.FS
+
+// OpenFile opens the named file. Compressed files opened write-only with
+// fsx.O_APPEND are appended to in place if the rules select the method they
+// are stored with. Other files to be stored compressed and existing compressed
+// files opened for writing are buffered in memory and written when closed.
+func (fsys *compressfs) OpenFile(name string, flag int, perm fs.FileMode) (fsx.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, wrapfs.PathError("OpenFile", name, fs.ErrInvalid)
+	}
+
+	if info, err := fs.Stat(fsys.backing, name); err == nil && info.IsDir() {
+		if flag&(fsx.O_WRONLY|fsx.O_RDWR) != 0 {
+			return nil, wrapfs.PathError("OpenFile", name, buffile.ErrIsDirectory)
+		}
+
+		entries, err := fsys.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+
+		return buffile.NewDir(name, func() (fs.FileInfo, error) {
+			return fsys.Stat(name)
+		}, entries), nil
+	}
+
+	if flag&(fsx.O_WRONLY|fsx.O_RDWR) == 0 {
+		return fsys.openRead(name)
+	}
+
+	var existing fsx.File
+	if flag&fsx.O_TRUNC == 0 {
+		var err error
+		if existing, err = fsys.openRead(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	_, compressed := existing.(*compressedFile)
+	method := fsys.method(name)
+
+	if method == Store && !compressed {
+		if existing != nil {
+			existing.Close()
+		}
+
+		f, err := fsys.backing.OpenFile(name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		return &storedFile{File: f, fsys: fsys, name: name}, nil
+	}
+
+	if compressed && flag&(fsx.O_WRONLY|fsx.O_APPEND) == fsx.O_WRONLY|fsx.O_APPEND {
+		if cf := existing.(*compressedFile); cf.c.method == method {
+			return fsys.openAppend(cf, flag, perm)
+		}
+	}
+
+	var data []byte
+	if existing != nil {
+		var err error
+		if compressed {
+			data, err = existing.(*compressedFile).readAll()
+		} else {
+			data, err = io.ReadAll(existing)
+		}
+		existing.Close()
+
+		if err != nil {
+			return nil, wrapfs.PathError("OpenFile", name, err)
+		}
+	}
+
+	// Open the backing file to create it and to check permissions.
+	f, err := fsys.backing.OpenFile(name, flag&^(fsx.O_APPEND|fsx.O_TRUNC), perm)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	return buffile.New(name, data, buffile.Options{
+		Flag: flag,
+		Stat: func(size int64) (fs.FileInfo, error) {
+			info, err := fs.Stat(fsys.backing, name)
+			if err != nil {
+				return nil, err
+			}
+			return &fileInfo{FileInfo: info, size: size}, nil
+		},
+		Commit: func(data []byte) error {
+			return fsys.write(name, data, method)
+		},
+		Chmod: func(mode fs.FileMode) error {
+			return fsx.Chmod(fsys.backing, name, mode)
+		},
+		Chown: func(uid, gid int) error {
+			return fsx.Chown(fsys.backing, name, uid, gid)
+		},
+	}), nil
+}
+
+// openAppend opens the compressed file cf for appending. cf is closed.
+func (fsys *compressfs) openAppend(cf *compressedFile, flag int, perm fs.FileMode) (fsx.File, error) {
+	a, err := newAppendFile(cf, fsys.opts.level)
+	cf.Close()
+	if err != nil {
+		return nil, wrapfs.PathError("OpenFile", cf.name, err)
+	}
+
+	// The chunks are written at explicit offsets.
+	if a.f, err = fsys.backing.OpenFile(cf.name, flag&^fsx.O_APPEND, perm); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// write replaces the content of the existing file name with data stored
+// using method. Data to be stored uncompressed is wrapped in a container if
+// it would otherwise be mistaken for a compressed file.
+func (fsys *compressfs) write(name string, data []byte, method Method) error {
+	if method != Store || isContainer(data) {
+		var err error
+		if data, err = encode(data, method, fsys.opts.chunkSize, fsys.opts.level); err != nil {
+			return wrapfs.PathError("Close", name, err)
+		}
+	}
+
+	f, err := fsys.backing.OpenFile(name, fsx.O_WRONLY|fsx.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+// escape wraps the content of the uncompressed file name in a container
+// using method Store if it would otherwise be mistaken for a compressed file.
+// Files that cannot be read are left as they are.
+func (fsys *compressfs) escape(name string) error {
+	f, err := fsys.backing.OpenFile(name, fsx.O_RDONLY, 0)
+	if errors.Is(err, fs.ErrPermission) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	prefix := make([]byte, len(magic))
+	if _, err := io.ReadFull(f, prefix); err != nil || !isContainer(prefix) {
+		f.Close()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		return err
+	}
+
+	rest, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return fsys.write(name, append(prefix, rest...), Store)
+}
+
+// Mkdir creates the named directory.
+func (fsys *compressfs) Mkdir(name string, perm fs.FileMode) error {
+	return fsys.backing.Mkdir(name, perm)
+}
+
+// Remove removes the named file or empty directory.
+func (fsys *compressfs) Remove(name string) error {
+	return fsys.backing.Remove(name)
+}
+
+// Rename renames oldpath to newpath. The file is not recompressed, even if
+// different rules apply to newpath.
+func (fsys *compressfs) Rename(oldpath, newpath string) error {
+	return fsys.backing.Rename(oldpath, newpath)
+}
+
+// SameFile reports whether fi1 and fi2 describe the same backing file.
+func (fsys *compressfs) SameFile(fi1, fi2 fs.FileInfo) bool {
+	if i, ok := fi1.(*fileInfo); ok {
+		fi1 = i.FileInfo
+	}
+	if i, ok := fi2.(*fileInfo); ok {
+		fi2 = i.FileInfo
+	}
+	return fsys.backing.SameFile(fi1, fi2)
+}
+
+// -- fsx.ChmodFS, fsx.ChownFS, fsx.ChtimesFS, fsx.RemoveAllFS
+
+// Chmod changes the mode of the named file.
+func (fsys *compressfs) Chmod(name string, mode fs.FileMode) error {
+	return fsx.Chmod(fsys.backing, name, mode)
+}
+
+// Chown changes the numeric owner and group of the named file.
+func (fsys *compressfs) Chown(name string, uid, gid int) error {
+	return fsx.Chown(fsys.backing, name, uid, gid)
+}
+
+// Chtimes changes the access and modification time of the named file.
+func (fsys *compressfs) Chtimes(name string, atime, mtime time.Time) error {
+	return wrapfs.Chtimes(fsys.backing, name, atime, mtime)
+}
+
+// RemoveAll removes name and all of its children.
+func (fsys *compressfs) RemoveAll(name string) error {
+	return fsx.RemoveAll(fsys.backing, name)
+}
+
+// -- fsx.LinkFS
+
+// Readlink returns the target of the named symlink.
+func (fsys *compressfs) Readlink(name string) (string, error) {
+	return wrapfs.Readlink(fsys.backing, name)
+}
+
+// Link creates newname as a hard link to oldname.
+func (fsys *compressfs) Link(oldname, newname string) error {
+	return wrapfs.Link(fsys.backing, oldname, newname)
+}
+
+// Symlink creates newname as a symlink to oldname.
+func (fsys *compressfs) Symlink(oldname, newname string) error {
+	return wrapfs.Symlink(fsys.backing, oldname, newname)
+}
+
+// -- fs.StatFS, fs.ReadDirFS, fs.ReadFileFS
+
+// Stat returns a fs.FileInfo describing the named file reporting the
+// uncompressed size.
+func (fsys *compressfs) Stat(name string) (fs.FileInfo, error) {
+	info, err := fs.Stat(fsys.backing, name)
+	if err != nil || !info.Mode().IsRegular() {
+		return info, err
+	}
+	return fsys.wrapInfo(name, info)
+}
+
+// ReadDir returns the sorted entries of the named directory. Entries' Info
+// reports uncompressed sizes.
+func (fsys *compressfs) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(fsys.backing, name)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, e := range entries {
+		entries[i] = &dirEntry{DirEntry: e, fsys: fsys, name: path.Join(name, e.Name())}
+	}
+	return entries, nil
+}
+
+// ReadFile reads and decompresses the named file.
+func (fsys *compressfs) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, wrapfs.PathError("ReadFile", name, fs.ErrInvalid)
+	}
+
+	f, err := fsys.openRead(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if cf, ok := f.(*compressedFile); ok {
+		data, err := cf.readAll()
+		return data, wrapfs.PathError("ReadFile", name, err)
+	}
+	return io.ReadAll(f)
+}
+
+var _ FS = &compressfs{}
@@ -0,0 +1,290 @@
+package compressfs
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"testing"
+	"testing/fstest"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	. "github.com/halimath/fixture"
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/memfs"
+	"github.com/halimath/fsx/osfs"
+)
+
+// logData returns n bytes of compressible log lines.
+func logData(n int) []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < n; i++ {
+		fmt.Fprintf(&buf, "2023-01-02T03:04:05Z INFO request %d handled\n", i)
+	}
+	return buf.Bytes()[:n]
+}
+
+func randomData(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+type compressfsFixture struct {
+	backing fsx.LinkFS
+	fs      FS
+	log     []byte
+	image   []byte
+}
+
+func (f *compressfsFixture) BeforeEach(t *testing.T) error {
+	f.backing = memfs.New()
+
+	var err error
+	f.fs, err = New(f.backing,
+		WithChunkSize(1024),
+		WithRules(
+			Rule{Pattern: "*.png", Method: Store},
+			Rule{Pattern: "archive/*", Method: Gzip},
+		),
+	)
+	if err != nil {
+		return err
+	}
+
+	f.log = logData(10_000)
+	f.image = randomData(1, 3_000)
+
+	if err := fsx.MkdirAll(f.fs, "var/log", 0755); err != nil {
+		return err
+	}
+	if err := fsx.WriteFile(f.fs, "var/log/app.log", f.log, 0644); err != nil {
+		return err
+	}
+	if err := fsx.WriteFile(f.fs, "var/logo.png", f.image, 0644); err != nil {
+		return err
+	}
+	return fsx.WriteFile(f.fs, "var/empty.log", nil, 0644)
+}
+
+// backingSize returns the size of name in the backing filesystem.
+func (f *compressfsFixture) backingSize(t *testing.T, name string) int64 {
+	info, err := fs.Stat(f.backing, name)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	return info.Size()
+}
+
+func TestCompressFS(t *testing.T) {
+	With(t, new(compressfsFixture)).
+		Run("stored", func(t *testing.T, f *compressfsFixture) {
+			expect.That(t,
+				is.EqualTo(f.backingSize(t, "var/log/app.log") < int64(len(f.log))/4, true),
+				is.EqualTo(f.backingSize(t, "var/logo.png"), int64(len(f.image))),
+				is.EqualTo(f.backingSize(t, "var/empty.log"), int64(0)),
+			)
+
+			raw, err := fs.ReadFile(f.backing, "var/logo.png")
+			expect.That(t, is.NoError(err), is.DeepEqualTo(raw, f.image))
+		}).
+		Run("sizes", func(t *testing.T, f *compressfsFixture) {
+			info, err := f.fs.Stat("var/log/app.log")
+			expect.That(t, is.NoError(err), is.EqualTo(info.Size(), int64(len(f.log))))
+
+			entries, err := f.fs.ReadDir("var")
+			expect.That(t, expect.FailNow(is.NoError(err)), expect.FailNow(is.SliceOfLen(entries, 3)))
+
+			sizes := make(map[string]int64)
+			for _, e := range entries {
+				info, err := e.Info()
+				expect.That(t, expect.FailNow(is.NoError(err)))
+				sizes[e.Name()] = info.Size()
+			}
+			expect.That(t, is.DeepEqualTo(sizes, map[string]int64{
+				"empty.log": 0,
+				"log":       sizes["log"],
+				"logo.png":  int64(len(f.image)),
+			}))
+		}).
+		Run("randomAccess", func(t *testing.T, f *compressfsFixture) {
+			file, err := f.fs.Open("var/log/app.log")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			defer file.Close()
+
+			buf := make([]byte, 100)
+			n, err := file.(io.ReaderAt).ReadAt(buf, 5_000)
+			expect.That(t, is.NoError(err), is.EqualTo(n, 100), is.DeepEqualTo(buf, f.log[5_000:5_100]))
+
+			pos, err := file.(io.Seeker).Seek(-10, fsx.SeekWhenceRelativeEnd)
+			expect.That(t, is.NoError(err), is.EqualTo(pos, int64(len(f.log)-10)))
+
+			rest, err := io.ReadAll(file)
+			expect.That(t, is.NoError(err), is.DeepEqualTo(rest, f.log[len(f.log)-10:]))
+		}).
+		Run("append", func(t *testing.T, f *compressfsFixture) {
+			file, err := f.fs.OpenFile("var/log/app.log", fsx.O_WRONLY|fsx.O_APPEND, 0)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			_, err = file.Write([]byte("appended\n"))
+			expect.That(t, is.NoError(err), is.NoError(file.Close()))
+
+			content, err := f.fs.ReadFile("var/log/app.log")
+			expect.That(t, is.NoError(err), is.DeepEqualTo(content, append(f.log, "appended\n"...)))
+		}).
+		Run("appendChunks", func(t *testing.T, f *compressfsFixture) {
+			before, err := fs.ReadFile(f.backing, "var/log/app.log")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			more := logData(5_000)
+			file, err := f.fs.OpenFile("var/log/app.log", fsx.O_WRONLY|fsx.O_APPEND, 0)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			_, inPlace := file.(*appendFile)
+			expect.That(t, is.EqualTo(inPlace, true))
+
+			for _, p := range [][]byte{more[:100], more[100:3_000], more[3_000:]} {
+				_, err = file.Write(p)
+				expect.That(t, is.NoError(err))
+			}
+
+			info, err := file.Stat()
+			expect.That(t, is.NoError(err), is.EqualTo(info.Size(), int64(15_000)))
+			expect.That(t, is.NoError(file.Close()))
+
+			content, err := f.fs.ReadFile("var/log/app.log")
+			expect.That(t, is.NoError(err), is.DeepEqualTo(content, append(f.log, more...)))
+
+			// The complete chunks written before are left unchanged.
+			after, err := fs.ReadFile(f.backing, "var/log/app.log")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			r, err := f.fs.Open("var/log/app.log")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			defer r.Close()
+			last := r.(*compressedFile).offsets[9]
+			expect.That(t, is.DeepEqualTo(after[:last], before[:last]))
+		}).
+		Run("writeUncompressed", func(t *testing.T, f *compressfsFixture) {
+			file, err := f.fs.OpenFile("var/logo.png", fsx.O_RDWR, 0)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			_, err = file.Write([]byte("PNG"))
+			expect.That(t, is.NoError(err), is.NoError(file.Close()))
+
+			raw, err := fs.ReadFile(f.backing, "var/logo.png")
+			expect.That(t, is.NoError(err), is.DeepEqualTo(raw, append([]byte("PNG"), f.image[3:]...)))
+		}).
+		Run("storedContainer", func(t *testing.T, f *compressfsFixture) {
+			encoded, err := encode(f.log, Flate, 1024, flate.BestSpeed)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			expect.That(t, is.NoError(fsx.WriteFile(f.fs, "var/encoded.png", encoded, 0644)))
+
+			content, err := f.fs.ReadFile("var/encoded.png")
+			expect.That(t, is.NoError(err), is.DeepEqualTo(content, encoded))
+
+			info, err := f.fs.Stat("var/encoded.png")
+			expect.That(t, is.NoError(err), is.EqualTo(info.Size(), int64(len(encoded))))
+
+			file, err := f.fs.OpenFile("var/encoded.png", fsx.O_WRONLY|fsx.O_APPEND, 0)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			_, err = file.Write([]byte("x"))
+			expect.That(t, is.NoError(err), is.NoError(file.Close()))
+
+			content, err = f.fs.ReadFile("var/encoded.png")
+			expect.That(t, is.NoError(err), is.DeepEqualTo(content, append(encoded, 'x')))
+		}).
+		Run("gzip", func(t *testing.T, f *compressfsFixture) {
+			expect.That(t,
+				is.NoError(f.fs.Mkdir("archive", 0755)),
+				is.NoError(fsx.WriteFile(f.fs, "archive/app.log", f.log, 0644)),
+			)
+
+			raw, err := fs.ReadFile(f.backing, "archive/app.log")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			expect.That(t, is.EqualTo(raw[5], byte(Gzip)), is.DeepEqualTo(raw[headerSize:headerSize+2], []byte{0x1f, 0x8b}))
+
+			content, err := f.fs.ReadFile("archive/app.log")
+			expect.That(t, is.NoError(err), is.DeepEqualTo(content, f.log))
+		}).
+		Run("renameAcrossRules", func(t *testing.T, f *compressfsFixture) {
+			expect.That(t,
+				is.NoError(f.fs.Rename("var/log/app.log", "var/app.png")),
+				is.NoError(f.fs.Rename("var/logo.png", "var/logo.log")),
+			)
+
+			content, err := f.fs.ReadFile("var/app.png")
+			expect.That(t, is.NoError(err), is.DeepEqualTo(content, f.log))
+
+			content, err = f.fs.ReadFile("var/logo.log")
+			expect.That(t, is.NoError(err), is.DeepEqualTo(content, f.image))
+
+			// Writing applies the rules of the new path.
+			file, err := f.fs.OpenFile("var/app.png", fsx.O_WRONLY|fsx.O_APPEND, 0)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			_, err = file.Write([]byte("x"))
+			expect.That(t, is.NoError(err), is.NoError(file.Close()))
+
+			expect.That(t, is.EqualTo(f.backingSize(t, "var/app.png"), int64(len(f.log)+1)))
+		}).
+		Run("links", func(t *testing.T, f *compressfsFixture) {
+			expect.That(t,
+				is.NoError(f.fs.Symlink("var/log/app.log", "app.log")),
+				is.NoError(f.fs.Link("var/logo.png", "logo.png")),
+			)
+
+			target, err := f.fs.Readlink("app.log")
+			expect.That(t, is.NoError(err), is.EqualTo(target, "var/log/app.log"))
+
+			a, _ := f.fs.Stat("var/logo.png")
+			b, _ := f.fs.Stat("logo.png")
+			expect.That(t, is.EqualTo(f.fs.SameFile(a, b), true))
+		}).
+		Run("corrupt", func(t *testing.T, f *compressfsFixture) {
+			raw, err := fs.ReadFile(f.backing, "var/log/app.log")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			raw[headerSize+10] ^= 0xff
+			expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(f.backing, "var/log/app.log", raw, 0644))))
+
+			_, err = f.fs.ReadFile("var/log/app.log")
+			expect.That(t, is.Error(err, ErrCorrupt))
+		}).
+		Run("readOnlyFile", func(t *testing.T, f *compressfsFixture) {
+			file, err := f.fs.Open("var/log/app.log")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			defer file.Close()
+
+			_, err = file.(fsx.File).Write([]byte("x"))
+			expect.That(t, is.Error(err, fs.ErrPermission))
+		})
+}
+
+func TestNew(t *testing.T) {
+	for _, opts := range [][]Option{
+		{WithChunkSize(0)},
+		{WithLevel(10)},
+		{WithMethod(Method(3))},
+		{WithRules(Rule{Pattern: "[", Method: Store})},
+	} {
+		_, err := New(memfs.New(), opts...)
+		expect.That(t, is.EqualTo(err != nil, true))
+	}
+}
+
+func TestOSFS(t *testing.T) {
+	fsys, err := New(osfs.DirFS(t.TempDir()), WithChunkSize(4096), WithRules(Rule{Pattern: "*.png", Method: Store}))
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	data := logData(100_000)
+	expect.That(t,
+		is.NoError(fsx.MkdirAll(fsys, "a/b", 0755)),
+		is.NoError(fsx.WriteFile(fsys, "a/b/c.log", data, 0644)),
+		is.NoError(fsx.WriteFile(fsys, "a/logo.png", randomData(1, 3_000), 0644)),
+		is.NoError(fsx.WriteFile(fsys, "empty.log", nil, 0644)),
+		is.NoError(fsys.Symlink("a/b/c.log", "link")),
+	)
+
+	expect.That(t, is.NoError(fstest.TestFS(fsys, "a/b/c.log", "a/logo.png", "empty.log", "link")))
+
+	content, err := fsys.ReadFile("link")
+	expect.That(t, is.NoError(err), is.DeepEqualTo(content, data))
+}
@@ -0,0 +1,275 @@
+package compressfs
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/halimath/fsx"
+)
+
+// Container format
+//
+// A compressed file consists of a header, the compressed chunks, an index
+// and a trailer:
+//
+//	header:  magic (4 bytes) | version (1 byte) | method (1 byte) | reserved (2 bytes) | chunk size (uint32)
+//	chunks:  each chunk compressed independently
+//	index:   per chunk: compressed length (uint32) | CRC-32 of the uncompressed chunk (uint32)
+//	trailer: uncompressed size (uint64) | number of chunks (uint32) | magic (4 bytes)
+//
+// All integers are stored big endian. Every chunk except the last one holds
+// exactly chunk size uncompressed bytes. The trailer allows to determine the
+// uncompressed size by reading the end of a file; the index allows to locate
+// the chunk containing any offset without decompressing the file. Empty files
+// are stored as empty files.
+//
+// Chunks of method Store are not compressed. Files stored uncompressed are
+// written as they are unless their content starts with the magic number; such
+// files are wrapped in a container using method Store, so they are not
+// mistaken for compressed files when read.
+
+const (
+	version       = 1
+	headerSize    = 12
+	trailerSize   = 16
+	indexItemSize = 8
+)
+
+var magic = []byte("FSXZ")
+
+// container describes a compressed file read from its header and trailer.
+type container struct {
+	method    Method
+	chunkSize int64
+	size      int64
+	count     int64
+
+	// indexOffset is the offset of the index in the compressed file.
+	indexOffset int64
+}
+
+// parseContainer parses header and trailer read from a file of fileSize
+// bytes. It returns nil if the file is not a compressed file and ErrCorrupt
+// if the file has both magic numbers but is invalid.
+func parseContainer(header, trailer []byte, fileSize int64) (*container, error) {
+	if !bytes.Equal(header[:4], magic) || !bytes.Equal(trailer[12:], magic) {
+		return nil, nil
+	}
+
+	c := &container{
+		method:    Method(header[5]),
+		chunkSize: int64(binary.BigEndian.Uint32(header[8:])),
+		size:      int64(binary.BigEndian.Uint64(trailer)),
+		count:     int64(binary.BigEndian.Uint32(trailer[8:])),
+	}
+	c.indexOffset = fileSize - trailerSize - c.count*indexItemSize
+
+	switch {
+	case header[4] != version:
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrCorrupt, header[4])
+	case c.method > Gzip:
+		return nil, fmt.Errorf("%w: unsupported method %d", ErrCorrupt, header[5])
+	case c.chunkSize == 0 || c.size < 0:
+		return nil, fmt.Errorf("%w: invalid header", ErrCorrupt)
+	case c.count != (c.size+c.chunkSize-1)/c.chunkSize:
+		return nil, fmt.Errorf("%w: invalid number of chunks %d", ErrCorrupt, c.count)
+	case c.indexOffset < headerSize:
+		return nil, fmt.Errorf("%w: invalid index", ErrCorrupt)
+	}
+
+	return c, nil
+}
+
+// readIndex reads the index of c from f. It returns the offsets of all chunks
+// followed by the offset of the index and the chunks' checksums.
+func (c *container) readIndex(f fsx.File) (offsets []int64, crcs []uint32, err error) {
+	buf := make([]byte, c.count*indexItemSize)
+	if err := readAt(f, buf, c.indexOffset); err != nil {
+		return nil, nil, err
+	}
+
+	offsets = make([]int64, c.count+1)
+	crcs = make([]uint32, c.count)
+
+	offsets[0] = headerSize
+	for i := int64(0); i < c.count; i++ {
+		item := buf[i*indexItemSize:]
+		offsets[i+1] = offsets[i] + int64(binary.BigEndian.Uint32(item))
+		crcs[i] = binary.BigEndian.Uint32(item[4:])
+	}
+
+	if offsets[c.count] != c.indexOffset {
+		return nil, nil, fmt.Errorf("%w: index does not match chunks", ErrCorrupt)
+	}
+
+	return offsets, crcs, nil
+}
+
+// chunkLen returns the uncompressed length of chunk i.
+func (c *container) chunkLen(i int64) int64 {
+	if i == c.count-1 {
+		return c.size - i*c.chunkSize
+	}
+	return c.chunkSize
+}
+
+// decodeChunk decompresses chunk i from compressed and verifies its length
+// and checksum.
+func (c *container) decodeChunk(i int64, compressed []byte, crc uint32) ([]byte, error) {
+	var r io.Reader
+	switch c.method {
+	case Store:
+		r = bytes.NewReader(compressed)
+	case Gzip:
+		zr, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, fmt.Errorf("%w: chunk %d: %v", ErrCorrupt, i, err)
+		}
+		r = zr
+	default:
+		r = flate.NewReader(bytes.NewReader(compressed))
+	}
+
+	data := make([]byte, c.chunkLen(i))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("%w: chunk %d: %v", ErrCorrupt, i, err)
+	}
+
+	if n, err := r.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		return nil, fmt.Errorf("%w: chunk %d: trailing data", ErrCorrupt, i)
+	}
+
+	if crc32.ChecksumIEEE(data) != crc {
+		return nil, fmt.Errorf("%w: chunk %d: checksum mismatch", ErrCorrupt, i)
+	}
+
+	return data, nil
+}
+
+// isContainer reports whether data would be read as a container. Data stored
+// uncompressed must be wrapped in a container using method Store if so.
+func isContainer(data []byte) bool {
+	return bytes.HasPrefix(data, magic)
+}
+
+// encoder compresses chunks using a method.
+type encoder struct {
+	method Method
+	zw     interface {
+		io.WriteCloser
+		Flush() error
+		Reset(io.Writer)
+	}
+}
+
+func newEncoder(method Method, level int) (*encoder, error) {
+	e := &encoder{method: method}
+
+	var err error
+	switch method {
+	case Gzip:
+		e.zw, err = gzip.NewWriterLevel(nil, level)
+	case Flate:
+		e.zw, err = flate.NewWriter(nil, level)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// chunk writes data compressed as a single chunk to out and returns the
+// chunk's index item. Compressed chunks shorter than minLen bytes are padded
+// with empty blocks, which allows to rewrite the last chunk of a file in
+// place without leaving stale bytes at its end. Chunks of method Store are
+// never padded.
+func (e *encoder) chunk(out *bytes.Buffer, data []byte, minLen int) ([]byte, error) {
+	start := out.Len()
+
+	if e.method == Store {
+		out.Write(data)
+	}
+
+	for pad := 0; e.method != Store; pad++ {
+		out.Truncate(start)
+		e.zw.Reset(out)
+		if _, err := e.zw.Write(data); err != nil {
+			return nil, err
+		}
+		for i := 0; i < pad; i++ {
+			if err := e.zw.Flush(); err != nil {
+				return nil, err
+			}
+		}
+		if err := e.zw.Close(); err != nil {
+			return nil, err
+		}
+
+		if out.Len()-start >= minLen {
+			break
+		}
+	}
+
+	item := binary.BigEndian.AppendUint32(nil, uint32(out.Len()-start))
+	return binary.BigEndian.AppendUint32(item, crc32.ChecksumIEEE(data)), nil
+}
+
+// header returns the header of a container using method and chunkSize.
+func header(method Method, chunkSize int) []byte {
+	h := append([]byte(nil), magic...)
+	h = append(h, version, byte(method), 0, 0)
+	return binary.BigEndian.AppendUint32(h, uint32(chunkSize))
+}
+
+// trailer returns the trailer of a container holding size uncompressed bytes
+// in count chunks.
+func trailer(size int64, count int64) []byte {
+	t := binary.BigEndian.AppendUint64(nil, uint64(size))
+	t = binary.BigEndian.AppendUint32(t, uint32(count))
+	return append(t, magic...)
+}
+
+// encode compresses data using method in chunks of chunkSize bytes. Empty
+// data produces an empty result.
+func encode(data []byte, method Method, chunkSize int, level int) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	e, err := newEncoder(method, level)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	out.Write(header(method, chunkSize))
+
+	size := len(data)
+	index := make([]byte, 0, (size/chunkSize+1)*indexItemSize)
+	count := 0
+	for len(data) > 0 {
+		n := chunkSize
+		if n > len(data) {
+			n = len(data)
+		}
+
+		item, err := e.chunk(&out, data[:n], 0)
+		if err != nil {
+			return nil, err
+		}
+		index = append(index, item...)
+
+		data = data[n:]
+		count++
+	}
+
+	out.Write(index)
+	out.Write(trailer(int64(size), int64(count)))
+
+	return out.Bytes(), nil
+}
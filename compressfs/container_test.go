@@ -0,0 +1,143 @@
+package compressfs
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"testing"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/memfs"
+)
+
+// openContainer writes encoded to a memfs and opens it.
+func openContainer(t *testing.T, encoded []byte) (fsx.File, int64) {
+	fsys := memfs.New()
+	expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(fsys, "f", encoded, 0644))))
+
+	f, err := fsys.OpenFile("f", fsx.O_RDONLY, 0)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	t.Cleanup(func() { f.Close() })
+
+	return f, int64(len(encoded))
+}
+
+func TestContainer(t *testing.T) {
+	data := logData(10_000)
+
+	t.Run("roundTrip", func(t *testing.T) {
+		for _, method := range []Method{Store, Flate, Gzip} {
+			encoded, err := encode(data, method, 4096, flate.BestSpeed)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			f, size := openContainer(t, encoded)
+			c, err := inspect(f, size)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			expect.That(t,
+				is.EqualTo(c.method, method),
+				is.EqualTo(c.size, int64(len(data))),
+				is.EqualTo(c.count, int64(3)),
+				is.EqualTo(c.chunkLen(2), int64(10_000-8192)),
+			)
+
+			cf, err := newCompressedFile("f", f, c)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			got, err := cf.readAll()
+			expect.That(t, is.NoError(err), is.DeepEqualTo(got, data))
+		}
+	})
+
+	t.Run("padding", func(t *testing.T) {
+		e, err := newEncoder(Flate, flate.BestSpeed)
+		expect.That(t, expect.FailNow(is.NoError(err)))
+
+		var buf bytes.Buffer
+		_, err = e.chunk(&buf, data[:4096], 0)
+		expect.That(t, expect.FailNow(is.NoError(err)))
+		n := buf.Len()
+
+		buf.Reset()
+		item, err := e.chunk(&buf, data[:4096], n+20)
+		expect.That(t, expect.FailNow(is.NoError(err)), is.EqualTo(buf.Len() >= n+20, true))
+		expect.That(t, is.EqualTo(binary.BigEndian.Uint32(item), uint32(buf.Len())))
+
+		c := &container{method: Flate, chunkSize: 4096, size: 4096, count: 1}
+		got, err := c.decodeChunk(0, buf.Bytes(), binary.BigEndian.Uint32(item[4:]))
+		expect.That(t, is.NoError(err), is.DeepEqualTo(got, data[:4096]))
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		encoded, err := encode(nil, Flate, 4096, flate.BestSpeed)
+		expect.That(t, is.NoError(err), is.SliceOfLen(encoded, 0))
+	})
+
+	t.Run("notCompressed", func(t *testing.T) {
+		f, size := openContainer(t, data)
+		c, err := inspect(f, size)
+		expect.That(t, is.NoError(err), is.EqualTo(c == nil, true))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		encoded, err := encode(data, Flate, 4096, flate.BestSpeed)
+		expect.That(t, expect.FailNow(is.NoError(err)))
+
+		for name, modify := range map[string]func(b []byte){
+			"version": func(b []byte) { b[4] = 2 },
+			"method":  func(b []byte) { b[5] = byte(Gzip + 1) },
+			"count": func(b []byte) {
+				binary.BigEndian.PutUint32(b[len(b)-8:], 4)
+			},
+			"size": func(b []byte) {
+				binary.BigEndian.PutUint64(b[len(b)-trailerSize:], 20_000)
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				b := append([]byte(nil), encoded...)
+				modify(b)
+
+				f, size := openContainer(t, b)
+				_, err := inspect(f, size)
+				expect.That(t, is.Error(err, ErrCorrupt))
+			})
+		}
+	})
+
+	t.Run("invalidIndex", func(t *testing.T) {
+		encoded, err := encode(data, Flate, 4096, flate.BestSpeed)
+		expect.That(t, expect.FailNow(is.NoError(err)))
+
+		index := len(encoded) - trailerSize - 3*indexItemSize
+		binary.BigEndian.PutUint32(encoded[index:], 1)
+
+		f, size := openContainer(t, encoded)
+		c, err := inspect(f, size)
+		expect.That(t, expect.FailNow(is.NoError(err)))
+
+		_, err = newCompressedFile("f", f, c)
+		expect.That(t, is.Error(err, ErrCorrupt))
+	})
+
+	t.Run("checksum", func(t *testing.T) {
+		encoded, err := encode(data, Flate, 4096, flate.BestSpeed)
+		expect.That(t, expect.FailNow(is.NoError(err)))
+
+		crc := len(encoded) - trailerSize - indexItemSize + 4
+		encoded[crc] ^= 1
+
+		f, size := openContainer(t, encoded)
+		c, err := inspect(f, size)
+		expect.That(t, expect.FailNow(is.NoError(err)))
+
+		cf, err := newCompressedFile("f", f, c)
+		expect.That(t, expect.FailNow(is.NoError(err)))
+
+		_, err = cf.ReadAt(make([]byte, 10), 0)
+		expect.That(t, is.NoError(err))
+
+		_, err = cf.ReadAt(make([]byte, 10), 9_000)
+		expect.That(t, is.Error(err, ErrCorrupt))
+	})
+}
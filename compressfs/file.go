@@ -0,0 +1,487 @@
+package compressfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/fs"
+
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/internal/wrapfs"
+)
+
+// readAt reads exactly len(p) bytes from f at off.
+func readAt(f fsx.File, p []byte, off int64) error {
+	if ra, ok := f.(io.ReaderAt); ok {
+		n, err := ra.ReadAt(p, off)
+		if n == len(p) {
+			return nil
+		}
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	if _, err := f.Seek(off, fsx.SeekWhenceRelativeOrigin); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(f, p)
+	return err
+}
+
+// inspect reads the header and trailer of f which contains size bytes. It
+// returns nil if f is not a compressed file.
+func inspect(f fsx.File, size int64) (*container, error) {
+	if size < headerSize+trailerSize {
+		return nil, nil
+	}
+
+	header := make([]byte, headerSize)
+	if err := readAt(f, header, 0); err != nil {
+		return nil, err
+	}
+	if string(header[:4]) != string(magic) {
+		return nil, nil
+	}
+
+	trailer := make([]byte, trailerSize)
+	if err := readAt(f, trailer, size-trailerSize); err != nil {
+		return nil, err
+	}
+
+	return parseContainer(header, trailer, size)
+}
+
+// compressedFile implements a read-only fsx.File for a compressed file.
+type compressedFile struct {
+	name string
+	f    fsx.File
+	c    *container
+
+	offsets []int64
+	crcs    []uint32
+
+	offset int64
+	closed bool
+
+	// cached holds the uncompressed content of chunk cachedIndex, so small
+	// sequential reads do not decompress the same chunk repeatedly.
+	cached      []byte
+	cachedIndex int64
+}
+
+func newCompressedFile(name string, f fsx.File, c *container) (*compressedFile, error) {
+	offsets, crcs, err := c.readIndex(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return &compressedFile{
+		name:    name,
+		f:       f,
+		c:       c,
+		offsets: offsets,
+		crcs:    crcs,
+	}, nil
+}
+
+func (f *compressedFile) pathError(op string, err error) error {
+	return wrapfs.PathError(op, f.name, err)
+}
+
+// chunk returns the uncompressed content of chunk i.
+func (f *compressedFile) chunk(i int64) ([]byte, error) {
+	if f.cached != nil && f.cachedIndex == i {
+		return f.cached, nil
+	}
+
+	compressed := make([]byte, f.offsets[i+1]-f.offsets[i])
+	if err := readAt(f.f, compressed, f.offsets[i]); err != nil {
+		return nil, err
+	}
+
+	data, err := f.c.decodeChunk(i, compressed, f.crcs[i])
+	if err != nil {
+		return nil, err
+	}
+
+	f.cached, f.cachedIndex = data, i
+	return data, nil
+}
+
+// pread reads uncompressed content at off.
+func (f *compressedFile) pread(p []byte, off int64) (int, error) {
+	if off >= f.c.size {
+		return 0, io.EOF
+	}
+
+	n := 0
+	for n < len(p) && off < f.c.size {
+		i := off / f.c.chunkSize
+		chunk, err := f.chunk(i)
+		if err != nil {
+			return n, err
+		}
+
+		c := copy(p[n:], chunk[off-i*f.c.chunkSize:])
+		n += c
+		off += int64(c)
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readAll returns the complete uncompressed content.
+func (f *compressedFile) readAll() ([]byte, error) {
+	data := make([]byte, f.c.size)
+	if _, err := f.pread(data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data, nil
+}
+
+// -- fsx.File
+
+// Stat returns the backing file's info reporting the uncompressed size.
+func (f *compressedFile) Stat() (fs.FileInfo, error) {
+	if f.closed {
+		return nil, f.pathError("Stat", fs.ErrClosed)
+	}
+
+	info, err := f.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{FileInfo: info, size: f.c.size}, nil
+}
+
+// Read reads up to len(p) bytes from the current offset.
+func (f *compressedFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, f.pathError("Read", fs.ErrClosed)
+	}
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	n, err := f.pread(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	if err != nil && err != io.EOF {
+		err = f.pathError("Read", err)
+	}
+	return n, err
+}
+
+// ReadAt reads len(p) bytes starting at off. Only the chunks containing the
+// requested range are decompressed.
+func (f *compressedFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, f.pathError("ReadAt", fs.ErrClosed)
+	}
+	if off < 0 {
+		return 0, f.pathError("ReadAt", fs.ErrInvalid)
+	}
+
+	n, err := f.pread(p, off)
+	if err != nil && err != io.EOF {
+		err = f.pathError("ReadAt", err)
+	}
+	return n, err
+}
+
+// Write returns an error as compressed files are only written as a whole.
+func (f *compressedFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, f.pathError("Write", fs.ErrClosed)
+	}
+	return 0, f.pathError("Write", fs.ErrPermission)
+}
+
+// Seek sets the offset for the next Read.
+func (f *compressedFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, f.pathError("Seek", fs.ErrClosed)
+	}
+
+	var pos int64
+	switch whence {
+	case fsx.SeekWhenceRelativeOrigin:
+		pos = offset
+	case fsx.SeekWhenceRelativeCurrentOffset:
+		pos = f.offset + offset
+	case fsx.SeekWhenceRelativeEnd:
+		pos = f.c.size + offset
+	default:
+		return 0, f.pathError("Seek", fsx.ErrInvalidWhence)
+	}
+
+	if pos < 0 {
+		return 0, f.pathError("Seek", fs.ErrInvalid)
+	}
+
+	f.offset = pos
+	return pos, nil
+}
+
+// Chmod changes the backing file's mode.
+func (f *compressedFile) Chmod(mode fs.FileMode) error {
+	if f.closed {
+		return f.pathError("Chmod", fs.ErrClosed)
+	}
+	return f.f.Chmod(mode)
+}
+
+// Chown changes the backing file's ownership.
+func (f *compressedFile) Chown(uid, gid int) error {
+	if f.closed {
+		return f.pathError("Chown", fs.ErrClosed)
+	}
+	return f.f.Chown(uid, gid)
+}
+
+// Close closes the backing file.
+func (f *compressedFile) Close() error {
+	if f.closed {
+		return f.pathError("Close", fs.ErrClosed)
+	}
+	f.closed = true
+	return f.f.Close()
+}
+
+// appendFile implements a write-only fsx.File appending to a compressed
+// file. Complete chunks are compressed and written as soon as they are
+// filled. Only the last chunk, which may be filled partially, is rewritten
+// along with the index and the trailer.
+type appendFile struct {
+	name string
+	f    fsx.File
+	c    *container
+	enc  *encoder
+
+	// index contains the index items of all chunks written.
+	index []byte
+	// offset is the offset the next chunk is written to.
+	offset int64
+	// end is the size of the compressed file when opened.
+	end int64
+	// pending holds the uncompressed content of the last chunk.
+	pending []byte
+	size    int64
+	pos     int64
+
+	dirty, closed bool
+}
+
+// newAppendFile creates an appendFile for the compressed file cf. The last
+// chunk of cf is decompressed if it is not filled completely. The backing
+// file to write to must be set before the file is used.
+func newAppendFile(cf *compressedFile, level int) (*appendFile, error) {
+	enc, err := newEncoder(cf.c.method, level)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &appendFile{
+		name:   cf.name,
+		c:      cf.c,
+		enc:    enc,
+		offset: cf.c.indexOffset,
+		end:    cf.c.indexOffset + cf.c.count*indexItemSize + trailerSize,
+		size:   cf.c.size,
+	}
+
+	keep := cf.c.count
+	if last := keep - 1; last >= 0 && cf.c.chunkLen(last) < cf.c.chunkSize {
+		chunk, err := cf.chunk(last)
+		if err != nil {
+			return nil, err
+		}
+		a.pending = append([]byte(nil), chunk...)
+		a.offset = cf.offsets[last]
+		keep = last
+	}
+
+	for i := int64(0); i < keep; i++ {
+		a.index = binary.BigEndian.AppendUint32(a.index, uint32(cf.offsets[i+1]-cf.offsets[i]))
+		a.index = binary.BigEndian.AppendUint32(a.index, cf.crcs[i])
+	}
+
+	return a, nil
+}
+
+func (a *appendFile) pathError(op string, err error) error {
+	return wrapfs.PathError(op, a.name, err)
+}
+
+// writeAt writes p to the backing file at off.
+func (a *appendFile) writeAt(p []byte, off int64) error {
+	if _, err := a.f.Seek(off, fsx.SeekWhenceRelativeOrigin); err != nil {
+		return err
+	}
+	_, err := a.f.Write(p)
+	return err
+}
+
+// flush compresses and writes data as the next chunk. The compressed chunk
+// spans at least minLen bytes.
+func (a *appendFile) flush(data []byte, minLen int) error {
+	var buf bytes.Buffer
+	item, err := a.enc.chunk(&buf, data, minLen)
+	if err != nil {
+		return err
+	}
+
+	if err := a.writeAt(buf.Bytes(), a.offset); err != nil {
+		return err
+	}
+
+	a.offset += int64(buf.Len())
+	a.index = append(a.index, item...)
+	return nil
+}
+
+// Stat returns the backing file's info reporting the uncompressed size.
+func (a *appendFile) Stat() (fs.FileInfo, error) {
+	if a.closed {
+		return nil, a.pathError("Stat", fs.ErrClosed)
+	}
+
+	info, err := a.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{FileInfo: info, size: a.size}, nil
+}
+
+// Read returns an error as the file is opened for writing only.
+func (a *appendFile) Read(p []byte) (int, error) {
+	if a.closed {
+		return 0, a.pathError("Read", fs.ErrClosed)
+	}
+	return 0, a.pathError("Read", fs.ErrPermission)
+}
+
+// Write appends p to the file.
+func (a *appendFile) Write(p []byte) (int, error) {
+	if a.closed {
+		return 0, a.pathError("Write", fs.ErrClosed)
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	a.pending = append(a.pending, p...)
+	a.size += int64(len(p))
+	a.pos = a.size
+	a.dirty = true
+
+	// Keep the last chunk pending, so it can be padded when closing.
+	for int64(len(a.pending)) > a.c.chunkSize {
+		if err := a.flush(a.pending[:a.c.chunkSize], 0); err != nil {
+			return 0, a.pathError("Write", err)
+		}
+		a.pending = append(a.pending[:0], a.pending[a.c.chunkSize:]...)
+	}
+
+	return len(p), nil
+}
+
+// Seek sets the file's offset. As with fsx.O_APPEND, writes always append to
+// the end of the file regardless of the offset.
+func (a *appendFile) Seek(offset int64, whence int) (int64, error) {
+	if a.closed {
+		return 0, a.pathError("Seek", fs.ErrClosed)
+	}
+
+	var pos int64
+	switch whence {
+	case fsx.SeekWhenceRelativeOrigin:
+		pos = offset
+	case fsx.SeekWhenceRelativeCurrentOffset:
+		pos = a.pos + offset
+	case fsx.SeekWhenceRelativeEnd:
+		pos = a.size + offset
+	default:
+		return 0, a.pathError("Seek", fsx.ErrInvalidWhence)
+	}
+
+	if pos < 0 {
+		return 0, a.pathError("Seek", fs.ErrInvalid)
+	}
+
+	a.pos = pos
+	return pos, nil
+}
+
+// Chmod changes the backing file's mode.
+func (a *appendFile) Chmod(mode fs.FileMode) error {
+	if a.closed {
+		return a.pathError("Chmod", fs.ErrClosed)
+	}
+	return a.f.Chmod(mode)
+}
+
+// Chown changes the backing file's ownership.
+func (a *appendFile) Chown(uid, gid int) error {
+	if a.closed {
+		return a.pathError("Chown", fs.ErrClosed)
+	}
+	return a.f.Chown(uid, gid)
+}
+
+// Close writes the last chunk, the index and the trailer and closes the
+// backing file. The last chunk is padded so that the file does not shrink.
+func (a *appendFile) Close() error {
+	if a.closed {
+		return a.pathError("Close", fs.ErrClosed)
+	}
+	a.closed = true
+
+	if !a.dirty {
+		return a.f.Close()
+	}
+
+	count := int64(len(a.index)/indexItemSize) + 1
+	minLen := a.end - a.offset - count*indexItemSize - trailerSize
+
+	err := a.flush(a.pending, int(minLen))
+	if err == nil {
+		tail := append(a.index, trailer(a.size, count)...)
+		err = a.writeAt(tail, a.offset)
+	}
+
+	if err1 := a.f.Close(); err == nil {
+		err = err1
+	}
+	return a.pathError("Close", err)
+}
+
+// storedFile wraps a backing file written uncompressed.
+type storedFile struct {
+	fsx.File
+	fsys *compressfs
+	name string
+}
+
+// Close closes the backing file and marks its content as stored if it would
+// otherwise be mistaken for a compressed file.
+func (f *storedFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	return wrapfs.PathError("Close", f.name, f.fsys.escape(f.name))
+}
+
+var (
+	_ fsx.File    = &compressedFile{}
+	_ io.ReaderAt = &compressedFile{}
+	_ fsx.File    = &appendFile{}
+)
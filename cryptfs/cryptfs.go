@@ -0,0 +1,553 @@
+// Package cryptfs provides a fsx.FS wrapper that transparently encrypts the
+// content of all files stored in another fsx.FS (e.g. an osfs.DirFS).
+//
+// File contents are encrypted using AES-GCM in authenticated chunks of
+// ChunkSize bytes. Files thus support random access: Seek, ReadAt and
+// writes at arbitrary offsets only decrypt and re-encrypt the affected
+// chunks. Stat and ReadDir report the plaintext size.
+//
+// Each file records the id of the key used to encrypt it. Files are read
+// using any of the keys passed to New while new files are always written
+// using the primary key. Rekey re-encrypts a file using the primary key, so
+// keys can be rotated by adding a new primary key, rekeying all files and
+// removing the old key afterwards.
+//
+// File and directory names are stored in plain text unless name encryption
+// is enabled with WithNameEncryption. Names are encrypted deterministically
+// per path component, so lookups do not require to scan directories. Equal
+// names thus produce equal ciphertexts, even in different directories.
+// Encrypted names are longer than their plaintext; the backing filesystem's
+// limit on the length of a name applies to the encrypted name. Symlink
+// targets are encrypted the same way.
+//
+// Permissions, ownership, modification times and the directory structure are
+// not encrypted.
+package cryptfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/internal/buffile"
+	"github.com/halimath/fsx/internal/wrapfs"
+)
+
+var (
+	// ErrCorrupt is returned when the content or name of a file cannot be
+	// authenticated, e.g. because it has been modified or has been encrypted
+	// using a different key.
+	ErrCorrupt = errors.New("cryptfs: corrupt data")
+
+	// ErrUnknownKey is returned when opening a file encrypted with a key not
+	// passed to New.
+	ErrUnknownKey = errors.New("cryptfs: unknown key")
+)
+
+// Key is a secret used to encrypt file contents. The ID is stored with each
+// file and used to select the key when reading the file.
+type Key struct {
+	ID uint32
+	// Secret is the key material. It must contain 16, 24 or 32 random bytes.
+	Secret []byte
+}
+
+// Option defines a function used to customize a cryptfs.
+type Option func(*options)
+
+type options struct {
+	keys       []Key
+	nameSecret []byte
+}
+
+// WithKeys adds keys used to read files encrypted with previous keys.
+func WithKeys(keys ...Key) Option {
+	return func(o *options) {
+		o.keys = append(o.keys, keys...)
+	}
+}
+
+// WithNameEncryption enables the encryption of file names using secret. The
+// name secret is independent of the content keys and cannot be rotated
+// without renaming all files.
+func WithNameEncryption(secret []byte) Option {
+	return func(o *options) {
+		o.nameSecret = secret
+	}
+}
+
+// FS defines the interface of an encrypting filesystem. Besides reading and
+// writing plaintext, it reports the keys files are encrypted with and
+// re-encrypts files using the primary key.
+type FS interface {
+	fsx.LinkFS
+	fsx.ChmodFS
+	fsx.ChownFS
+	fsx.ChtimesFS
+	fsx.RemoveAllFS
+	fs.StatFS
+	fs.ReadDirFS
+	fs.ReadFileFS
+
+	// KeyID returns the id of the key used to encrypt the named file. ok is
+	// false for empty files, which are not encrypted.
+	KeyID(name string) (id uint32, ok bool, err error)
+
+	// Rekey re-encrypts the named file using the primary key unless the file
+	// already uses it.
+	Rekey(name string) error
+}
+
+type cryptfs struct {
+	backing fsx.FS
+	primary uint32
+	keys    map[uint32][]byte
+	names   *nameCipher
+}
+
+// New creates a filesystem storing encrypted files in backing. primary is
+// used to encrypt new files; additional keys to read existing files can be
+// passed using WithKeys.
+func New(backing fsx.FS, primary Key, opts ...Option) (FS, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	fsys := &cryptfs{
+		backing: backing,
+		primary: primary.ID,
+		keys:    make(map[uint32][]byte),
+	}
+
+	for _, k := range append([]Key{primary}, o.keys...) {
+		switch len(k.Secret) {
+		case 16, 24, 32:
+		default:
+			return nil, fmt.Errorf("cryptfs: invalid length of key %d: %d", k.ID, len(k.Secret))
+		}
+
+		if _, ok := fsys.keys[k.ID]; ok {
+			return nil, fmt.Errorf("cryptfs: duplicate key %d", k.ID)
+		}
+		fsys.keys[k.ID] = k.Secret
+	}
+
+	if o.nameSecret != nil {
+		var err error
+		if fsys.names, err = newNameCipher(o.nameSecret); err != nil {
+			return nil, err
+		}
+	}
+
+	return fsys, nil
+}
+
+// resolve validates name and returns its name in the backing filesystem.
+func (fsys *cryptfs) resolve(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", wrapfs.PathError(op, name, fs.ErrInvalid)
+	}
+	return fsys.names.encryptPath(name), nil
+}
+
+// wrapError replaces the backing name in a *fs.PathError with name.
+func wrapError(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return &fs.PathError{Op: op, Path: name, Err: pathErr.Err}
+	}
+	return wrapfs.PathError(op, name, err)
+}
+
+// fileInfo reports the plaintext name and size of a backing file.
+type fileInfo struct {
+	fs.FileInfo
+	name string
+	size int64
+}
+
+func (i *fileInfo) Name() string { return i.name }
+func (i *fileInfo) Size() int64  { return i.size }
+
+// wrapInfo creates a fileInfo for the backing info found for name.
+func wrapInfo(name string, info fs.FileInfo) fs.FileInfo {
+	size := info.Size()
+	if info.Mode().IsRegular() {
+		// Files with an invalid size report 0; reading them fails.
+		size, _ = plainSize(size)
+	}
+	return &fileInfo{FileInfo: info, name: path.Base(name), size: size}
+}
+
+// dirEntry wraps a backing entry reporting the plaintext name and size.
+type dirEntry struct {
+	fs.DirEntry
+	name string
+}
+
+func (e *dirEntry) Name() string { return e.name }
+
+func (e *dirEntry) Info() (fs.FileInfo, error) {
+	info, err := e.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+	return wrapInfo(e.name, info), nil
+}
+
+// -- fs.FS
+
+// Open opens the named file for reading.
+func (fsys *cryptfs) Open(name string) (fs.File, error) {
+	return fsys.OpenFile(name, fsx.O_RDONLY, 0)
+}
+
+// -- fsx.FS
+
+// OpenFile opens the named file. Writable files are opened read-write in the
+// backing filesystem as partial writes require to decrypt existing chunks.
+func (fsys *cryptfs) OpenFile(name string, flag int, perm fs.FileMode) (fsx.File, error) {
+	bname, err := fsys.resolve("OpenFile", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if info, err := fs.Stat(fsys.backing, bname); err == nil && info.IsDir() {
+		if flag&(fsx.O_WRONLY|fsx.O_RDWR) != 0 {
+			return nil, wrapfs.PathError("OpenFile", name, buffile.ErrIsDirectory)
+		}
+
+		entries, err := fsys.ReadDir(name)
+		if err != nil {
+			return nil, wrapError("OpenFile", name, err)
+		}
+
+		return buffile.NewDir(name, func() (fs.FileInfo, error) {
+			return fsys.Stat(name)
+		}, entries), nil
+	}
+
+	bflag := flag &^ (fsx.O_WRONLY | fsx.O_APPEND)
+	if flag&(fsx.O_WRONLY|fsx.O_RDWR) != 0 {
+		bflag |= fsx.O_RDWR
+	}
+
+	f, err := fsys.backing.OpenFile(bname, bflag, perm)
+	if err != nil {
+		return nil, wrapError("OpenFile", name, err)
+	}
+
+	cf, err := fsys.openFile(name, f, flag)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return cf, nil
+}
+
+// Mkdir creates the named directory.
+func (fsys *cryptfs) Mkdir(name string, perm fs.FileMode) error {
+	bname, err := fsys.resolve("Mkdir", name)
+	if err != nil {
+		return err
+	}
+	return wrapError("Mkdir", name, fsys.backing.Mkdir(bname, perm))
+}
+
+// Remove removes the named file or empty directory.
+func (fsys *cryptfs) Remove(name string) error {
+	bname, err := fsys.resolve("Remove", name)
+	if err != nil {
+		return err
+	}
+	if err := fsys.backing.Remove(bname); err != nil {
+		return wrapError("Remove", name, err)
+	}
+	return nil
+}
+
+// Rename renames oldpath to newpath.
+func (fsys *cryptfs) Rename(oldpath, newpath string) error {
+	from, err := fsys.resolve("Rename", oldpath)
+	if err != nil {
+		return err
+	}
+	to, err := fsys.resolve("Rename", newpath)
+	if err != nil {
+		return err
+	}
+	if err := fsys.backing.Rename(from, to); err != nil {
+		return wrapError("Rename", oldpath, err)
+	}
+	return nil
+}
+
+// SameFile reports whether fi1 and fi2 describe the same backing file.
+func (fsys *cryptfs) SameFile(fi1, fi2 fs.FileInfo) bool {
+	if i, ok := fi1.(*fileInfo); ok {
+		fi1 = i.FileInfo
+	}
+	if i, ok := fi2.(*fileInfo); ok {
+		fi2 = i.FileInfo
+	}
+	return fsys.backing.SameFile(fi1, fi2)
+}
+
+// -- fsx.ChmodFS, fsx.ChownFS, fsx.ChtimesFS, fsx.RemoveAllFS
+
+// Chmod changes the mode of the named file.
+func (fsys *cryptfs) Chmod(name string, mode fs.FileMode) error {
+	bname, err := fsys.resolve("Chmod", name)
+	if err != nil {
+		return err
+	}
+	if err := fsx.Chmod(fsys.backing, bname, mode); err != nil {
+		return wrapError("Chmod", name, err)
+	}
+	return nil
+}
+
+// Chown changes the numeric owner and group of the named file.
+func (fsys *cryptfs) Chown(name string, uid, gid int) error {
+	bname, err := fsys.resolve("Chown", name)
+	if err != nil {
+		return err
+	}
+	if err := fsx.Chown(fsys.backing, bname, uid, gid); err != nil {
+		return wrapError("Chown", name, err)
+	}
+	return nil
+}
+
+// Chtimes changes the access and modification time of the named file.
+func (fsys *cryptfs) Chtimes(name string, atime, mtime time.Time) error {
+	bname, err := fsys.resolve("Chtimes", name)
+	if err != nil {
+		return err
+	}
+	if err := wrapfs.Chtimes(fsys.backing, bname, atime, mtime); err != nil {
+		return wrapError("Chtimes", name, err)
+	}
+	return nil
+}
+
+// RemoveAll removes name and all of its children.
+func (fsys *cryptfs) RemoveAll(name string) error {
+	bname, err := fsys.resolve("RemoveAll", name)
+	if err != nil {
+		return err
+	}
+	if err := fsx.RemoveAll(fsys.backing, bname); err != nil {
+		return wrapError("RemoveAll", name, err)
+	}
+	return nil
+}
+
+// -- fsx.LinkFS
+
+// Readlink returns the decrypted target of the named symlink.
+func (fsys *cryptfs) Readlink(name string) (string, error) {
+	bname, err := fsys.resolve("Readlink", name)
+	if err != nil {
+		return "", err
+	}
+
+	target, err := wrapfs.Readlink(fsys.backing, bname)
+	if err != nil {
+		return "", wrapError("Readlink", name, err)
+	}
+
+	target, err = fsys.names.decryptPath(target)
+	if err != nil {
+		return "", wrapfs.PathError("Readlink", name, err)
+	}
+	return target, nil
+}
+
+// Link creates newname as a hard link to oldname.
+func (fsys *cryptfs) Link(oldname, newname string) error {
+	from, err := fsys.resolve("Link", oldname)
+	if err != nil {
+		return err
+	}
+	to, err := fsys.resolve("Link", newname)
+	if err != nil {
+		return err
+	}
+
+	if err := wrapfs.Link(fsys.backing, from, to); err != nil {
+		return wrapError("Link", newname, err)
+	}
+	return nil
+}
+
+// Symlink creates newname as a symlink to oldname. The target is encrypted
+// the same way as names.
+func (fsys *cryptfs) Symlink(oldname, newname string) error {
+	target, err := fsys.resolve("Symlink", oldname)
+	if err != nil {
+		return err
+	}
+	to, err := fsys.resolve("Symlink", newname)
+	if err != nil {
+		return err
+	}
+
+	if err := wrapfs.Symlink(fsys.backing, target, to); err != nil {
+		return wrapError("Symlink", newname, err)
+	}
+	return nil
+}
+
+// -- fs.StatFS, fs.ReadDirFS, fs.ReadFileFS
+
+// Stat returns a fs.FileInfo describing the named file reporting the
+// plaintext size.
+func (fsys *cryptfs) Stat(name string) (fs.FileInfo, error) {
+	bname, err := fsys.resolve("Stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := fs.Stat(fsys.backing, bname)
+	if err != nil {
+		return nil, wrapError("Stat", name, err)
+	}
+
+	return wrapInfo(name, info), nil
+}
+
+// ReadDir returns the sorted entries of the named directory. If name
+// encryption is enabled, entries whose name cannot be decrypted are skipped.
+func (fsys *cryptfs) ReadDir(name string) ([]fs.DirEntry, error) {
+	bname, err := fsys.resolve("ReadDir", name)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := fs.ReadDir(fsys.backing, bname)
+	if err != nil {
+		return nil, wrapError("ReadDir", name, err)
+	}
+
+	res := make([]fs.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		plain := e.Name()
+		if fsys.names != nil {
+			if plain, err = fsys.names.decrypt(e.Name()); err != nil {
+				continue
+			}
+		}
+		res = append(res, &dirEntry{DirEntry: e, name: plain})
+	}
+
+	if fsys.names != nil {
+		sort.Slice(res, func(i, j int) bool { return res[i].Name() < res[j].Name() })
+	}
+
+	return res, nil
+}
+
+// ReadFile reads and decrypts the named file.
+func (fsys *cryptfs) ReadFile(name string) ([]byte, error) {
+	f, err := fsys.OpenFile(name, fsx.O_RDONLY, 0)
+	if err != nil {
+		return nil, wrapError("ReadFile", name, err)
+	}
+	defer f.Close()
+
+	cf, ok := f.(*cryptFile)
+	if !ok {
+		return nil, wrapfs.PathError("ReadFile", name, buffile.ErrIsDirectory)
+	}
+
+	data := make([]byte, cf.size)
+	if _, err := cf.pread(data, 0); err != nil && err != io.EOF {
+		return nil, wrapfs.PathError("ReadFile", name, err)
+	}
+	return data, nil
+}
+
+// -- Key rotation
+
+// KeyID returns the id of the key used to encrypt the named file.
+func (fsys *cryptfs) KeyID(name string) (uint32, bool, error) {
+	f, err := fsys.OpenFile(name, fsx.O_RDONLY, 0)
+	if err != nil {
+		return 0, false, wrapError("KeyID", name, err)
+	}
+	defer f.Close()
+
+	cf, ok := f.(*cryptFile)
+	if !ok {
+		return 0, false, wrapfs.PathError("KeyID", name, buffile.ErrIsDirectory)
+	}
+
+	if cf.header == nil {
+		return 0, false, nil
+	}
+	return binary.BigEndian.Uint32(cf.header[4:]), true, nil
+}
+
+// Rekey re-encrypts the named file using the primary key. The file is
+// written to a temporary file in the same directory which then replaces the
+// original file. The original modification time is preserved if the backing
+// filesystem implements fsx.ChtimesFS.
+func (fsys *cryptfs) Rekey(name string) error {
+	id, ok, err := fsys.KeyID(name)
+	if err != nil {
+		return wrapError("Rekey", name, err)
+	}
+	if !ok || id == fsys.primary {
+		return nil
+	}
+
+	info, err := fsys.Stat(name)
+	if err != nil {
+		return wrapError("Rekey", name, err)
+	}
+
+	data, err := fsys.ReadFile(name)
+	if err != nil {
+		return wrapError("Rekey", name, err)
+	}
+
+	tmp := path.Join(path.Dir(name), "."+path.Base(name)+".rekey")
+	if err := fsx.WriteFile(fsys, tmp, data, info.Mode().Perm()); err != nil {
+		fsys.Remove(tmp)
+		return wrapError("Rekey", name, err)
+	}
+
+	if err := fsys.Rename(tmp, name); err != nil {
+		fsys.Remove(tmp)
+		return wrapError("Rekey", name, err)
+	}
+
+	// The file has just been read and rewritten, so its access time is set
+	// to now; the modification time is preserved as the content did not
+	// change.
+	if cfs, ok := fsys.backing.(fsx.ChtimesFS); ok {
+		bname, err := fsys.resolve("Rekey", name)
+		if err != nil {
+			return wrapError("Rekey", name, err)
+		}
+		if err := cfs.Chtimes(bname, time.Now(), info.ModTime()); err != nil {
+			return wrapError("Rekey", name, err)
+		}
+	}
+
+	return nil
+}
+
+var _ FS = &cryptfs{}
@@ -0,0 +1,263 @@
+package cryptfs
+
+import (
+	"bytes"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	. "github.com/halimath/fixture"
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/memfs"
+	"github.com/halimath/fsx/osfs"
+)
+
+var (
+	key1 = Key{ID: 1, Secret: bytes.Repeat([]byte{1}, 32)}
+	key2 = Key{ID: 2, Secret: bytes.Repeat([]byte{2}, 16)}
+)
+
+type cryptfsFixture struct {
+	backing fsx.LinkFS
+	fs      FS
+	opts    []Option
+}
+
+func (f *cryptfsFixture) BeforeEach(t *testing.T) error {
+	f.backing = memfs.New()
+
+	var err error
+	f.fs, err = New(f.backing, key1, f.opts...)
+	if err != nil {
+		return err
+	}
+
+	if err := fsx.MkdirAll(f.fs, "etc/ssl", 0755); err != nil {
+		return err
+	}
+	if err := fsx.WriteFile(f.fs, "etc/hosts", []byte("127.0.0.1 localhost\n"), 0644); err != nil {
+		return err
+	}
+	if err := fsx.WriteFile(f.fs, "etc/ssl/cert.pem", []byte("cert"), 0600); err != nil {
+		return err
+	}
+	if err := fsx.WriteFile(f.fs, "empty", nil, 0644); err != nil {
+		return err
+	}
+	return f.fs.Symlink("etc/hosts", "etc/ssl/hosts")
+}
+
+// backingFiles returns the contents of all regular files in the backing
+// filesystem.
+func (f *cryptfsFixture) backingFiles(t *testing.T) map[string][]byte {
+	files := make(map[string][]byte)
+	err := fs.WalkDir(f.backing, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		files[p], err = fs.ReadFile(f.backing, p)
+		return err
+	})
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	return files
+}
+
+func testCryptFS(t *testing.T, f *cryptfsFixture) {
+	With(t, f).
+		Run("fstest", func(t *testing.T, f *cryptfsFixture) {
+			expect.That(t, is.NoError(fstest.TestFS(f.fs, "etc/hosts", "etc/ssl/cert.pem", "empty", "etc/ssl/hosts")))
+		}).
+		Run("encrypted", func(t *testing.T, f *cryptfsFixture) {
+			files := f.backingFiles(t)
+			for _, data := range files {
+				expect.That(t, is.EqualTo(bytes.Contains(data, []byte("localhost")), false))
+				if len(data) > 0 {
+					expect.That(t, is.EqualTo(bytes.HasPrefix(data, magic), true))
+				}
+			}
+
+			_, plain := files["etc/hosts"]
+			expect.That(t, is.EqualTo(plain, f.fs.(*cryptfs).names == nil))
+		}).
+		Run("plaintextSizes", func(t *testing.T, f *cryptfsFixture) {
+			info, err := f.fs.Stat("etc/hosts")
+			expect.That(t, is.NoError(err), is.EqualTo(info.Size(), int64(20)), is.EqualTo(info.Name(), "hosts"))
+
+			entries, err := f.fs.ReadDir("etc")
+			expect.That(t, expect.FailNow(is.NoError(err)), expect.FailNow(is.SliceOfLen(entries, 2)))
+			expect.That(t, is.EqualTo(entries[0].Name(), "hosts"), is.EqualTo(entries[1].Name(), "ssl"))
+
+			info, err = entries[0].Info()
+			expect.That(t, is.NoError(err), is.EqualTo(info.Size(), int64(20)))
+
+			info, err = f.fs.Stat("empty")
+			expect.That(t, is.NoError(err), is.EqualTo(info.Size(), int64(0)))
+		}).
+		Run("readAndWrite", func(t *testing.T, f *cryptfsFixture) {
+			file, err := f.fs.OpenFile("etc/hosts", fsx.O_WRONLY|fsx.O_APPEND, 0)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			_, err = file.Write([]byte("::1 localhost\n"))
+			expect.That(t, is.NoError(err), is.NoError(file.Close()))
+
+			content, err := f.fs.ReadFile("etc/hosts")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "127.0.0.1 localhost\n::1 localhost\n"))
+
+			expect.That(t, is.NoError(fsx.WriteFile(f.fs, "etc/hosts", []byte("replaced"), 0644)))
+			content, err = fs.ReadFile(f.fs, "etc/ssl/hosts")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "replaced"))
+		}).
+		Run("gap", func(t *testing.T, f *cryptfsFixture) {
+			file, err := f.fs.OpenFile("etc/hosts", fsx.O_RDWR, 0)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			_, err = file.Seek(2*ChunkSize+10, fsx.SeekWhenceRelativeOrigin)
+			expect.That(t, is.NoError(err))
+			_, err = file.Write([]byte("x"))
+			expect.That(t, is.NoError(err), is.NoError(file.Close()))
+
+			content, err := f.fs.ReadFile("etc/hosts")
+			expect.That(t,
+				is.NoError(err),
+				expect.FailNow(is.SliceOfLen(content, 2*ChunkSize+11)),
+				is.EqualTo(string(content[:20]), "127.0.0.1 localhost\n"),
+				is.EqualTo(bytes.Count(content[20:2*ChunkSize+10], []byte{0}), 2*ChunkSize-10),
+				is.EqualTo(content[2*ChunkSize+10], byte('x')),
+			)
+		}).
+		Run("links", func(t *testing.T, f *cryptfsFixture) {
+			target, err := f.fs.Readlink("etc/ssl/hosts")
+			expect.That(t, is.NoError(err), is.EqualTo(target, "etc/hosts"))
+
+			expect.That(t,
+				is.NoError(f.fs.Link("etc/ssl/cert.pem", "cert.pem")),
+				is.NoError(f.fs.Rename("etc/ssl", "ssl")),
+			)
+
+			a, _ := f.fs.Stat("cert.pem")
+			b, _ := f.fs.Stat("ssl/cert.pem")
+			expect.That(t, is.EqualTo(f.fs.SameFile(a, b), true))
+		}).
+		Run("keyRotation", func(t *testing.T, f *cryptfsFixture) {
+			rotated, err := New(f.backing, key2, append(f.opts, WithKeys(key1))...)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			expect.That(t, is.NoError(fsx.WriteFile(rotated, "new", []byte("new"), 0644)))
+
+			id, ok, err := rotated.KeyID("etc/hosts")
+			expect.That(t, is.NoError(err), is.EqualTo(ok, true), is.EqualTo(id, uint32(1)))
+			id, _, err = rotated.KeyID("new")
+			expect.That(t, is.NoError(err), is.EqualTo(id, uint32(2)))
+			_, ok, err = rotated.KeyID("empty")
+			expect.That(t, is.NoError(err), is.EqualTo(ok, false))
+
+			_, err = f.fs.ReadFile("new")
+			expect.That(t, is.Error(err, ErrUnknownKey))
+
+			before, err := rotated.Stat("etc/hosts")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			expect.That(t, is.NoError(rotated.Rekey("etc/hosts")), is.NoError(rotated.Rekey("empty")))
+
+			id, _, err = rotated.KeyID("etc/hosts")
+			expect.That(t, is.NoError(err), is.EqualTo(id, uint32(2)))
+
+			content, err := rotated.ReadFile("etc/hosts")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "127.0.0.1 localhost\n"))
+
+			info, err := rotated.Stat("etc/hosts")
+			expect.That(t,
+				is.NoError(err),
+				is.EqualTo(info.Mode(), fs.FileMode(0644)),
+				is.EqualTo(info.ModTime().Equal(before.ModTime()), true),
+			)
+
+			entries, err := rotated.ReadDir("etc")
+			expect.That(t, is.NoError(err), is.SliceOfLen(entries, 2))
+
+			current, err := New(f.backing, key2, f.opts...)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			content, err = current.ReadFile("etc/hosts")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "127.0.0.1 localhost\n"))
+		}).
+		Run("corrupt", func(t *testing.T, f *cryptfsFixture) {
+			for name, data := range f.backingFiles(t) {
+				if len(data) == 0 {
+					continue
+				}
+				data[len(data)-1] ^= 1
+				expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(f.backing, name, data, 0644))))
+			}
+
+			_, err := f.fs.ReadFile("etc/hosts")
+			expect.That(t, is.Error(err, ErrCorrupt))
+		})
+}
+
+func TestCryptFS(t *testing.T) {
+	t.Run("plainNames", func(t *testing.T) {
+		testCryptFS(t, new(cryptfsFixture))
+	})
+
+	t.Run("encryptedNames", func(t *testing.T) {
+		testCryptFS(t, &cryptfsFixture{opts: []Option{WithNameEncryption([]byte("names"))}})
+	})
+}
+
+func TestNew(t *testing.T) {
+	backing := memfs.New()
+
+	for _, opts := range [][]Option{
+		{WithKeys(Key{ID: 2, Secret: []byte("short")})},
+		{WithKeys(Key{ID: 1, Secret: key2.Secret})},
+	} {
+		_, err := New(backing, key1, opts...)
+		expect.That(t, is.EqualTo(err != nil, true))
+	}
+}
+
+func TestNameEncryption(t *testing.T) {
+	backing := memfs.New()
+	fsys, err := New(backing, key1, WithNameEncryption([]byte("names")))
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	expect.That(t,
+		is.NoError(fsx.WriteFile(fsys, "a", []byte("a"), 0644)),
+		is.NoError(fsx.WriteFile(backing, "foreign", []byte("b"), 0644)),
+	)
+
+	entries, err := fsys.ReadDir(".")
+	expect.That(t, expect.FailNow(is.NoError(err)), expect.FailNow(is.SliceOfLen(entries, 1)))
+	expect.That(t, is.EqualTo(entries[0].Name(), "a"))
+
+	other, err := New(backing, key1, WithNameEncryption([]byte("other")))
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	_, err = other.Stat("a")
+	expect.That(t, is.Error(err, fs.ErrNotExist))
+
+	entries, err = other.ReadDir(".")
+	expect.That(t, is.NoError(err), is.SliceOfLen(entries, 0))
+}
+
+func TestOSFS(t *testing.T) {
+	dir := t.TempDir()
+	fsys, err := New(osfs.DirFS(dir), key1, WithNameEncryption([]byte("names")))
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), ChunkSize/8)
+	expect.That(t,
+		is.NoError(fsx.MkdirAll(fsys, "a/b", 0755)),
+		is.NoError(fsx.WriteFile(fsys, "a/b/c", data, 0644)),
+		is.NoError(fsys.Symlink("a/b/c", "link")),
+	)
+
+	content, err := fsys.ReadFile("link")
+	expect.That(t, is.NoError(err), is.EqualTo(bytes.Equal(content, data), true))
+
+	expect.That(t, is.NoError(fstest.TestFS(fsys, "a/b/c", "link")))
+
+	expect.That(t, is.NoError(fsys.RemoveAll("a")))
+	_, err = fsys.Stat("a")
+	expect.That(t, is.Error(err, fs.ErrNotExist))
+}
@@ -0,0 +1,544 @@
+package cryptfs
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/internal/wrapfs"
+)
+
+// File format
+//
+// An encrypted file starts with a header followed by the encrypted chunks:
+//
+//	header: magic (4 bytes) | key id (uint32) | file id (16 random bytes)
+//	chunk:  nonce (12 bytes) | ciphertext (up to ChunkSize bytes) | tag (16 bytes)
+//
+// Each file's content key is derived from the key identified by the header's
+// key id and the file id. A chunk's additional data contains the header, the
+// chunk's index and a flag marking the last chunk, so chunks cannot be
+// reordered, moved between files or removed from the end of a file without
+// being detected. Empty files are stored without a header.
+
+const (
+	// ChunkSize is the size of the plaintext stored in each encrypted chunk.
+	ChunkSize = 64 << 10
+
+	headerSize    = 4 + 4 + 16
+	nonceSize     = 12
+	tagSize       = 16
+	chunkOverhead = nonceSize + tagSize
+	encChunkSize  = ChunkSize + chunkOverhead
+)
+
+var magic = []byte("CFS1")
+
+// plainSize returns the plaintext size of an encrypted file of size bytes
+// and false if size is not a valid size of an encrypted file.
+func plainSize(size int64) (int64, bool) {
+	if size == 0 {
+		return 0, true
+	}
+
+	body := size - headerSize
+	if body <= 0 {
+		return 0, false
+	}
+
+	n, rem := body/encChunkSize, body%encChunkSize
+	switch {
+	case rem == 0:
+		return n * ChunkSize, true
+	case rem <= chunkOverhead:
+		return 0, false
+	default:
+		return n*ChunkSize + rem - chunkOverhead, true
+	}
+}
+
+// lastChunk returns the index of the last chunk of a file of size plaintext
+// bytes or -1 for an empty file.
+func lastChunk(size int64) int64 {
+	return (size+ChunkSize-1)/ChunkSize - 1
+}
+
+// newFileAEAD creates the AEAD used for the content of the file with the
+// given id.
+func newFileAEAD(secret, fileID []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, deriveKey(secret, "file encryption"))
+	mac.Write(fileID)
+
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// cryptFile implements fsx.File for an encrypted regular file.
+type cryptFile struct {
+	fsys *cryptfs
+	name string
+	f    fsx.File
+
+	readable, writable, append bool
+
+	header []byte
+	aead   cipher.AEAD
+
+	size   int64
+	offset int64
+	closed bool
+
+	// cached holds the plaintext of chunk cachedIndex, so small sequential
+	// reads do not decrypt the same chunk repeatedly.
+	cached      []byte
+	cachedIndex int64
+}
+
+// openFile wraps the backing file f. The header is read if f is not empty.
+func (fsys *cryptfs) openFile(name string, f fsx.File, flag int) (*cryptFile, error) {
+	cf := &cryptFile{
+		fsys: fsys,
+		name: name,
+		f:    f,
+	}
+
+	switch {
+	case flag&fsx.O_WRONLY != 0:
+		cf.writable = true
+	case flag&fsx.O_RDWR != 0:
+		cf.readable = true
+		cf.writable = true
+	default:
+		cf.readable = true
+	}
+	cf.append = cf.writable && flag&fsx.O_APPEND != 0
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// Some filesystems report the size before truncation until the file is
+	// closed.
+	if info.Size() == 0 || cf.writable && flag&fsx.O_TRUNC != 0 {
+		return cf, nil
+	}
+
+	var ok bool
+	if cf.size, ok = plainSize(info.Size()); !ok {
+		return nil, cf.pathError("OpenFile", fmt.Errorf("%w: invalid size %d", ErrCorrupt, info.Size()))
+	}
+
+	header := make([]byte, headerSize)
+	if err := cf.readAt(header, 0); err != nil {
+		return nil, cf.pathError("OpenFile", err)
+	}
+
+	if err := cf.init(header); err != nil {
+		return nil, cf.pathError("OpenFile", err)
+	}
+
+	return cf, nil
+}
+
+// init sets the header and creates the file's AEAD.
+func (f *cryptFile) init(header []byte) error {
+	if !bytes.Equal(header[:4], magic) {
+		return fmt.Errorf("%w: invalid header", ErrCorrupt)
+	}
+
+	id := binary.BigEndian.Uint32(header[4:])
+	secret, ok := f.fsys.keys[id]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrUnknownKey, id)
+	}
+
+	aead, err := newFileAEAD(secret, header[8:])
+	if err != nil {
+		return err
+	}
+
+	f.header, f.aead = header, aead
+	return nil
+}
+
+// writeHeader creates and writes a new header using the primary key.
+func (f *cryptFile) writeHeader() error {
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	binary.BigEndian.PutUint32(header[4:], f.fsys.primary)
+	if _, err := rand.Read(header[8:]); err != nil {
+		return err
+	}
+
+	if err := f.init(header); err != nil {
+		return err
+	}
+
+	return f.writeAt(header, 0)
+}
+
+func (f *cryptFile) pathError(op string, err error) error {
+	return wrapfs.PathError(op, f.name, err)
+}
+
+// readAt reads exactly len(p) bytes from the backing file at off.
+func (f *cryptFile) readAt(p []byte, off int64) error {
+	if ra, ok := f.f.(io.ReaderAt); ok {
+		n, err := ra.ReadAt(p, off)
+		if n == len(p) {
+			return nil
+		}
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	if _, err := f.f.Seek(off, fsx.SeekWhenceRelativeOrigin); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(f.f, p)
+	return err
+}
+
+// writeAt writes p to the backing file at off.
+func (f *cryptFile) writeAt(p []byte, off int64) error {
+	if wa, ok := f.f.(io.WriterAt); ok {
+		_, err := wa.WriteAt(p, off)
+		return err
+	}
+
+	if _, err := f.f.Seek(off, fsx.SeekWhenceRelativeOrigin); err != nil {
+		return err
+	}
+	_, err := f.f.Write(p)
+	return err
+}
+
+func (f *cryptFile) additionalData(i int64, final bool) []byte {
+	ad := make([]byte, 0, headerSize+9)
+	ad = append(ad, f.header...)
+	ad = binary.BigEndian.AppendUint64(ad, uint64(i))
+	if final {
+		return append(ad, 1)
+	}
+	return append(ad, 0)
+}
+
+// readChunk reads and decrypts chunk i of a file of size plaintext bytes.
+func (f *cryptFile) readChunk(i, size int64) ([]byte, error) {
+	if f.cached != nil && f.cachedIndex == i {
+		return f.cached, nil
+	}
+
+	n := size - i*ChunkSize
+	if n > ChunkSize {
+		n = ChunkSize
+	}
+
+	buf := make([]byte, n+chunkOverhead)
+	if err := f.readAt(buf, headerSize+i*encChunkSize); err != nil {
+		return nil, err
+	}
+
+	plain, err := f.aead.Open(buf[nonceSize:nonceSize], buf[:nonceSize], buf[nonceSize:], f.additionalData(i, i == lastChunk(size)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: chunk %d: authentication failed", ErrCorrupt, i)
+	}
+
+	f.cached, f.cachedIndex = plain, i
+	return plain, nil
+}
+
+// writeChunk encrypts and writes chunk i.
+func (f *cryptFile) writeChunk(i int64, plain []byte, final bool) error {
+	f.cached = nil
+
+	buf := make([]byte, nonceSize, len(plain)+chunkOverhead)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+
+	buf = f.aead.Seal(buf, buf[:nonceSize], plain, f.additionalData(i, final))
+	return f.writeAt(buf, headerSize+i*encChunkSize)
+}
+
+// pread reads plaintext at off.
+func (f *cryptFile) pread(p []byte, off int64) (int, error) {
+	if off >= f.size {
+		return 0, io.EOF
+	}
+
+	n := 0
+	for n < len(p) && off < f.size {
+		i := off / ChunkSize
+		chunk, err := f.readChunk(i, f.size)
+		if err != nil {
+			return n, err
+		}
+
+		c := copy(p[n:], chunk[off-i*ChunkSize:])
+		n += c
+		off += int64(c)
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// pwrite writes plaintext at off. Gaps between the current end of file and
+// off are filled with zeros.
+func (f *cryptFile) pwrite(p []byte, off int64) error {
+	if len(p) == 0 {
+		return nil
+	}
+
+	if f.header == nil {
+		if err := f.writeHeader(); err != nil {
+			return err
+		}
+	}
+
+	// The gap is filled one chunk at a time, so writing far beyond the end
+	// of file does not allocate the whole gap.
+	if off > f.size {
+		zeros := make([]byte, ChunkSize)
+		for f.size < off {
+			n := ChunkSize - f.size%ChunkSize
+			if gap := off - f.size; gap < n {
+				n = gap
+			}
+			if err := f.pwrite(zeros[:n], f.size); err != nil {
+				return err
+			}
+		}
+	}
+
+	oldSize := f.size
+	newSize := off + int64(len(p))
+	if newSize < oldSize {
+		newSize = oldSize
+	}
+
+	oldLast, newLast := lastChunk(oldSize), lastChunk(newSize)
+	first, last := off/ChunkSize, (off+int64(len(p))-1)/ChunkSize
+
+	// The previous last chunk is no longer final; re-encrypt it unless it is
+	// rewritten anyway.
+	if oldLast >= 0 && oldLast < first && oldLast != newLast {
+		chunk, err := f.readChunk(oldLast, oldSize)
+		if err != nil {
+			return err
+		}
+		if err := f.writeChunk(oldLast, chunk, false); err != nil {
+			return err
+		}
+	}
+
+	for i := first; i <= last; i++ {
+		start := i * ChunkSize
+
+		var chunk []byte
+		if i <= oldLast {
+			var err error
+			if chunk, err = f.readChunk(i, oldSize); err != nil {
+				return err
+			}
+		}
+
+		end := off + int64(len(p)) - start
+		if end > ChunkSize {
+			end = ChunkSize
+		}
+		if int64(len(chunk)) < end {
+			chunk = append(chunk, make([]byte, end-int64(len(chunk)))...)
+		}
+
+		from := off - start
+		if from < 0 {
+			from = 0
+		}
+		copy(chunk[from:], p[start+from-off:])
+
+		if err := f.writeChunk(i, chunk, i == newLast); err != nil {
+			return err
+		}
+	}
+
+	f.size = newSize
+	return nil
+}
+
+// -- fsx.File
+
+// Stat returns the backing file's info reporting the plaintext size.
+func (f *cryptFile) Stat() (fs.FileInfo, error) {
+	if f.closed {
+		return nil, f.pathError("Stat", fs.ErrClosed)
+	}
+
+	info, err := f.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileInfo{FileInfo: info, name: path.Base(f.name), size: f.size}, nil
+}
+
+// Read reads up to len(p) bytes from the current offset.
+func (f *cryptFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, f.pathError("Read", fs.ErrClosed)
+	}
+	if !f.readable {
+		return 0, f.pathError("Read", fs.ErrPermission)
+	}
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	n, err := f.pread(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	if err != nil && err != io.EOF {
+		err = f.pathError("Read", err)
+	}
+	return n, err
+}
+
+// ReadAt reads len(p) bytes starting at off.
+func (f *cryptFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, f.pathError("ReadAt", fs.ErrClosed)
+	}
+	if !f.readable {
+		return 0, f.pathError("ReadAt", fs.ErrPermission)
+	}
+	if off < 0 {
+		return 0, f.pathError("ReadAt", fs.ErrInvalid)
+	}
+
+	n, err := f.pread(p, off)
+	if err != nil && err != io.EOF {
+		err = f.pathError("ReadAt", err)
+	}
+	return n, err
+}
+
+// Write writes p at the current offset or at the end of the file if the file
+// has been opened with fsx.O_APPEND.
+func (f *cryptFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, f.pathError("Write", fs.ErrClosed)
+	}
+	if !f.writable {
+		return 0, f.pathError("Write", fs.ErrPermission)
+	}
+
+	if f.append {
+		f.offset = f.size
+	}
+
+	if err := f.pwrite(p, f.offset); err != nil {
+		return 0, f.pathError("Write", err)
+	}
+
+	f.offset += int64(len(p))
+	return len(p), nil
+}
+
+// WriteAt writes p starting at off.
+func (f *cryptFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, f.pathError("WriteAt", fs.ErrClosed)
+	}
+	if !f.writable {
+		return 0, f.pathError("WriteAt", fs.ErrPermission)
+	}
+	if off < 0 {
+		return 0, f.pathError("WriteAt", fs.ErrInvalid)
+	}
+	if f.append {
+		return 0, f.pathError("WriteAt", fs.ErrInvalid)
+	}
+
+	if err := f.pwrite(p, off); err != nil {
+		return 0, f.pathError("WriteAt", err)
+	}
+	return len(p), nil
+}
+
+// Seek sets the offset for the next Read or Write.
+func (f *cryptFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, f.pathError("Seek", fs.ErrClosed)
+	}
+
+	var pos int64
+	switch whence {
+	case fsx.SeekWhenceRelativeOrigin:
+		pos = offset
+	case fsx.SeekWhenceRelativeCurrentOffset:
+		pos = f.offset + offset
+	case fsx.SeekWhenceRelativeEnd:
+		pos = f.size + offset
+	default:
+		return 0, f.pathError("Seek", fsx.ErrInvalidWhence)
+	}
+
+	if pos < 0 {
+		return 0, f.pathError("Seek", fs.ErrInvalid)
+	}
+
+	f.offset = pos
+	return pos, nil
+}
+
+// Chmod changes the backing file's mode.
+func (f *cryptFile) Chmod(mode fs.FileMode) error {
+	if f.closed {
+		return f.pathError("Chmod", fs.ErrClosed)
+	}
+	return f.f.Chmod(mode)
+}
+
+// Chown changes the backing file's ownership.
+func (f *cryptFile) Chown(uid, gid int) error {
+	if f.closed {
+		return f.pathError("Chown", fs.ErrClosed)
+	}
+	return f.f.Chown(uid, gid)
+}
+
+// Close closes the backing file.
+func (f *cryptFile) Close() error {
+	if f.closed {
+		return f.pathError("Close", fs.ErrClosed)
+	}
+	f.closed = true
+	return f.f.Close()
+}
+
+var (
+	_ fsx.File    = &cryptFile{}
+	_ io.ReaderAt = &cryptFile{}
+	_ io.WriterAt = &cryptFile{}
+)
@@ -0,0 +1,209 @@
+package cryptfs
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"math/rand"
+	"testing"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	. "github.com/halimath/fixture"
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/memfs"
+)
+
+func TestPlainSize(t *testing.T) {
+	for size, want := range map[int64]int64{
+		0:                                0,
+		headerSize + chunkOverhead + 1:   1,
+		headerSize + encChunkSize:        ChunkSize,
+		headerSize + encChunkSize + 29:   ChunkSize + 1,
+		headerSize + 3*encChunkSize - 10: 3*ChunkSize - 10,
+	} {
+		got, ok := plainSize(size)
+		expect.That(t, is.EqualTo(ok, true), is.EqualTo(got, want))
+	}
+
+	for _, size := range []int64{1, headerSize, headerSize + chunkOverhead, headerSize + encChunkSize + 28} {
+		_, ok := plainSize(size)
+		expect.That(t, is.EqualTo(ok, false))
+	}
+}
+
+type fileFixture struct {
+	backing fsx.LinkFS
+	fs      FS
+	data    []byte
+}
+
+func (f *fileFixture) BeforeEach(t *testing.T) error {
+	f.backing = memfs.New()
+
+	var err error
+	f.fs, err = New(f.backing, key1)
+	if err != nil {
+		return err
+	}
+
+	f.data = make([]byte, 2*ChunkSize+100)
+	rand.New(rand.NewSource(1)).Read(f.data)
+
+	return fsx.WriteFile(f.fs, "data", f.data, 0644)
+}
+
+// open opens the test file with flag.
+func (f *fileFixture) open(t *testing.T, flag int) fsx.File {
+	file, err := f.fs.OpenFile("data", flag, 0644)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	return file
+}
+
+// expectContent reads the test file and compares it to want.
+func (f *fileFixture) expectContent(t *testing.T, want []byte) {
+	t.Helper()
+
+	got, err := f.fs.ReadFile("data")
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	expect.That(t, is.EqualTo(len(got), len(want)), is.EqualTo(bytes.Equal(got, want), true))
+}
+
+func TestFile(t *testing.T) {
+	With(t, new(fileFixture)).
+		Run("size", func(t *testing.T, f *fileFixture) {
+			raw, err := fs.Stat(f.backing, "data")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			expect.That(t, is.EqualTo(raw.Size(), int64(headerSize+3*chunkOverhead+len(f.data))))
+
+			file := f.open(t, fsx.O_RDONLY)
+			defer file.Close()
+
+			info, err := file.Stat()
+			expect.That(t, is.NoError(err), is.EqualTo(info.Size(), int64(len(f.data))))
+		}).
+		Run("seekAndRead", func(t *testing.T, f *fileFixture) {
+			file := f.open(t, fsx.O_RDONLY)
+			defer file.Close()
+
+			pos, err := file.Seek(ChunkSize-10, fsx.SeekWhenceRelativeOrigin)
+			expect.That(t, is.NoError(err), is.EqualTo(pos, int64(ChunkSize-10)))
+
+			buf := make([]byte, 20)
+			_, err = io.ReadFull(file, buf)
+			expect.That(t, is.NoError(err), is.DeepEqualTo(buf, f.data[ChunkSize-10:ChunkSize+10]))
+
+			pos, err = file.Seek(-5, fsx.SeekWhenceRelativeEnd)
+			expect.That(t, is.NoError(err), is.EqualTo(pos, int64(len(f.data)-5)))
+
+			rest, err := io.ReadAll(file)
+			expect.That(t, is.NoError(err), is.DeepEqualTo(rest, f.data[len(f.data)-5:]))
+
+			_, err = file.Seek(0, 42)
+			expect.That(t, is.Error(err, fsx.ErrInvalidWhence))
+		}).
+		Run("readAt", func(t *testing.T, f *fileFixture) {
+			file := f.open(t, fsx.O_RDONLY)
+			defer file.Close()
+
+			ra := file.(io.ReaderAt)
+
+			buf := make([]byte, ChunkSize+2)
+			n, err := ra.ReadAt(buf, ChunkSize-1)
+			expect.That(t, is.NoError(err), is.EqualTo(n, len(buf)), is.DeepEqualTo(buf, f.data[ChunkSize-1:2*ChunkSize+1]))
+
+			n, err = ra.ReadAt(buf[:200], int64(len(f.data)-50))
+			expect.That(t, is.Error(err, io.EOF), is.EqualTo(n, 50))
+
+			_, err = file.Write([]byte("x"))
+			expect.That(t, is.Error(err, fs.ErrPermission))
+		}).
+		Run("writeAt", func(t *testing.T, f *fileFixture) {
+			file := f.open(t, fsx.O_RDWR)
+
+			patch := bytes.Repeat([]byte("x"), 30)
+			_, err := file.(io.WriterAt).WriteAt(patch, ChunkSize-15)
+			expect.That(t, is.NoError(err), is.NoError(file.Close()))
+
+			copy(f.data[ChunkSize-15:], patch)
+			f.expectContent(t, f.data)
+		}).
+		Run("overwriteEnd", func(t *testing.T, f *fileFixture) {
+			file := f.open(t, fsx.O_WRONLY)
+
+			_, err := file.Seek(-10, fsx.SeekWhenceRelativeEnd)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			_, err = file.Write(bytes.Repeat([]byte("y"), 100))
+			expect.That(t, is.NoError(err), is.NoError(file.Close()))
+
+			f.expectContent(t, append(f.data[:len(f.data)-10], bytes.Repeat([]byte("y"), 100)...))
+		}).
+		Run("gap", func(t *testing.T, f *fileFixture) {
+			file := f.open(t, fsx.O_WRONLY)
+
+			_, err := file.Seek(4*ChunkSize, fsx.SeekWhenceRelativeOrigin)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			_, err = file.Write([]byte("end"))
+			expect.That(t, is.NoError(err), is.NoError(file.Close()))
+
+			want := append(f.data, make([]byte, 4*ChunkSize-len(f.data))...)
+			f.expectContent(t, append(want, "end"...))
+		}).
+		Run("append", func(t *testing.T, f *fileFixture) {
+			file := f.open(t, fsx.O_WRONLY|fsx.O_APPEND)
+
+			_, err := file.Seek(0, fsx.SeekWhenceRelativeOrigin)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			_, err = file.Write([]byte("appended"))
+			expect.That(t, is.NoError(err))
+
+			_, err = file.(io.WriterAt).WriteAt([]byte("x"), 0)
+			expect.That(t, is.Error(err, fs.ErrInvalid), is.NoError(file.Close()))
+
+			f.expectContent(t, append(f.data, "appended"...))
+		}).
+		Run("truncate", func(t *testing.T, f *fileFixture) {
+			file := f.open(t, fsx.O_WRONLY|fsx.O_TRUNC)
+			_, err := file.Write([]byte("short"))
+			expect.That(t, is.NoError(err), is.NoError(file.Close()))
+
+			f.expectContent(t, []byte("short"))
+		}).
+		Run("truncatedBackingFile", func(t *testing.T, f *fileFixture) {
+			raw, err := fs.ReadFile(f.backing, "data")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			// Removing the last chunk yields a valid size but the new last chunk
+			// is not marked final.
+			raw = raw[:headerSize+2*encChunkSize]
+			expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(f.backing, "data", raw, 0644))))
+
+			info, err := f.fs.Stat("data")
+			expect.That(t, is.NoError(err), is.EqualTo(info.Size(), int64(2*ChunkSize)))
+
+			_, err = f.fs.ReadFile("data")
+			expect.That(t, is.Error(err, ErrCorrupt))
+		}).
+		Run("swappedChunks", func(t *testing.T, f *fileFixture) {
+			raw, err := fs.ReadFile(f.backing, "data")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			first := append([]byte(nil), raw[headerSize:headerSize+encChunkSize]...)
+			copy(raw[headerSize:], raw[headerSize+encChunkSize:headerSize+2*encChunkSize])
+			copy(raw[headerSize+encChunkSize:], first)
+			expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(f.backing, "data", raw, 0644))))
+
+			file := f.open(t, fsx.O_RDONLY)
+			defer file.Close()
+
+			_, err = file.(io.ReaderAt).ReadAt(make([]byte, 10), ChunkSize)
+			expect.That(t, is.Error(err, ErrCorrupt))
+		}).
+		Run("closed", func(t *testing.T, f *fileFixture) {
+			file := f.open(t, fsx.O_RDONLY)
+			expect.That(t, is.NoError(file.Close()))
+
+			_, err := file.Read(make([]byte, 1))
+			expect.That(t, is.Error(err, fs.ErrClosed), is.Error(file.Close(), fs.ErrClosed))
+		})
+}
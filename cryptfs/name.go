@@ -0,0 +1,103 @@
+package cryptfs
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// deriveKey derives a 256 bit key for purpose from secret.
+func deriveKey(secret []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("cryptfs " + purpose))
+	return mac.Sum(nil)
+}
+
+// nameCipher encrypts single path components deterministically. The nonce
+// is derived from the plaintext using HMAC-SHA256 (a synthetic IV), so equal
+// names always produce equal ciphertexts while the GCM tag authenticates the
+// name.
+type nameCipher struct {
+	aead   cipher.AEAD
+	macKey []byte
+}
+
+func newNameCipher(secret []byte) (*nameCipher, error) {
+	block, err := aes.NewCipher(deriveKey(secret, "name encryption"))
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &nameCipher{
+		aead:   aead,
+		macKey: deriveKey(secret, "name authentication"),
+	}, nil
+}
+
+func (c *nameCipher) nonce(name string) []byte {
+	mac := hmac.New(sha256.New, c.macKey)
+	mac.Write([]byte(name))
+	return mac.Sum(nil)[:c.aead.NonceSize()]
+}
+
+// encrypt encrypts the single path component name.
+func (c *nameCipher) encrypt(name string) string {
+	nonce := c.nonce(name)
+	return base64.RawURLEncoding.EncodeToString(c.aead.Seal(nonce, nonce, []byte(name), nil))
+}
+
+// decrypt decrypts the single path component name.
+func (c *nameCipher) decrypt(name string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(name)
+	if err != nil || len(data) < c.aead.NonceSize()+c.aead.Overhead() {
+		return "", fmt.Errorf("%w: invalid name %q", ErrCorrupt, name)
+	}
+
+	nonce, ciphertext := data[:c.aead.NonceSize()], data[c.aead.NonceSize():]
+	plain, err := c.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil || !bytes.Equal(c.nonce(string(plain)), nonce) {
+		return "", fmt.Errorf("%w: invalid name %q", ErrCorrupt, name)
+	}
+
+	return string(plain), nil
+}
+
+// encryptPath encrypts all components of the slash separated path p.
+func (c *nameCipher) encryptPath(p string) string {
+	if c == nil || p == "." || p == "" {
+		return p
+	}
+
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = c.encrypt(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// decryptPath decrypts all components of the slash separated path p.
+func (c *nameCipher) decryptPath(p string) (string, error) {
+	if c == nil || p == "." || p == "" {
+		return p, nil
+	}
+
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		plain, err := c.decrypt(part)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = plain
+	}
+	return strings.Join(parts, "/"), nil
+}
@@ -0,0 +1,440 @@
+package fsx
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ChangeKind describes the kind of change reported for an entry by Diff.
+// Values are bit flags; a single entry may report multiple kinds of changes
+// (e.g. content and mode changes).
+type ChangeKind int
+
+const (
+	// Added reports an entry that exists only in the second filesystem.
+	Added ChangeKind = 1 << iota
+	// Removed reports an entry that exists only in the first filesystem.
+	Removed
+	// ContentChanged reports a regular file with different content.
+	ContentChanged
+	// ModeChanged reports an entry with different permission bits.
+	ModeChanged
+	// TypeChanged reports an entry that changed its type, e.g. a file that
+	// has been replaced by a directory or a symlink.
+	TypeChanged
+	// TargetChanged reports a symlink pointing to a different target.
+	TargetChanged
+)
+
+var changeKindNames = []struct {
+	kind ChangeKind
+	name string
+}{
+	{Added, "added"},
+	{Removed, "removed"},
+	{ContentChanged, "content"},
+	{ModeChanged, "mode"},
+	{TypeChanged, "type"},
+	{TargetChanged, "target"},
+}
+
+// Has reports whether k contains all flags in other.
+func (k ChangeKind) Has(other ChangeKind) bool { return k&other == other }
+
+// String returns a textual representation of k with the names of all flags
+// separated by a pipe.
+func (k ChangeKind) String() string {
+	var names []string
+	for _, n := range changeKindNames {
+		if k&n.kind != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (k ChangeKind) MarshalText() ([]byte, error) { return []byte(k.String()), nil }
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (k *ChangeKind) UnmarshalText(text []byte) error {
+	*k = 0
+	if len(text) == 0 {
+		return nil
+	}
+
+outer:
+	for _, s := range strings.Split(string(text), "|") {
+		for _, n := range changeKindNames {
+			if n.name == s {
+				*k |= n.kind
+				continue outer
+			}
+		}
+		return fmt.Errorf("invalid change kind: %q", s)
+	}
+
+	return nil
+}
+
+// Change describes a single difference between two trees as reported by
+// Diff. The Old* fields describe the entry in the first filesystem, the New*
+// fields the entry in the second one. Fields describing a missing entry hold
+// their zero value.
+type Change struct {
+	Path string     `json:"path"`
+	Kind ChangeKind `json:"kind"`
+
+	OldMode    fs.FileMode `json:"oldMode,omitempty"`
+	NewMode    fs.FileMode `json:"newMode,omitempty"`
+	OldSize    int64       `json:"oldSize,omitempty"`
+	NewSize    int64       `json:"newSize,omitempty"`
+	OldModTime time.Time   `json:"oldModTime,omitempty"`
+	NewModTime time.Time   `json:"newModTime,omitempty"`
+	OldTarget  string      `json:"oldTarget,omitempty"`
+	NewTarget  string      `json:"newTarget,omitempty"`
+}
+
+// CompareMode defines how Diff detects content changes of regular files.
+type CompareMode int
+
+const (
+	// CompareContent compares files by size and - if equal - by a SHA-256
+	// hash of their content.
+	CompareContent CompareMode = iota
+	// CompareModTime compares files by size and modification time only. This
+	// is much faster but may report false positives or miss changes.
+	CompareModTime
+)
+
+// DiffOptions customize the behavior of Diff. A nil *DiffOptions is
+// equivalent to the zero value.
+type DiffOptions struct {
+	Filter
+
+	// Root defines the directory to compare in both filesystems. Defaults to
+	// ".".
+	Root string
+
+	// Compare defines how file contents are compared.
+	Compare CompareMode
+
+	// ModTimePrecision defines the precision used when comparing
+	// modification times with CompareModTime. Use this to compare trees from
+	// filesystems with different time resolutions.
+	ModTimePrecision time.Duration
+
+	// IgnoreMode disables reporting of permission changes.
+	IgnoreMode bool
+}
+
+// DiffResult contains the result of comparing two trees with Diff.
+type DiffResult struct {
+	// Changes lists all changes sorted by path.
+	Changes []Change
+
+	a, b fs.FS
+	root string
+}
+
+// Empty reports whether r contains no changes.
+func (r *DiffResult) Empty() bool { return len(r.Changes) == 0 }
+
+// Diff compares the trees found in a and b and reports all entries that have
+// been added, removed or modified when going from a to b. Symlinks are
+// compared by their target if a filesystem provides a Readlink method; they
+// are never followed.
+//
+// Entries inside an added or removed directory are reported individually.
+func Diff(a, b fs.FS, opts *DiffOptions) (*DiffResult, error) {
+	if opts == nil {
+		opts = &DiffOptions{}
+	}
+
+	root := opts.Root
+	if root == "" {
+		root = "."
+	}
+
+	aEntries, err := collectTree(a, root, &opts.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	bEntries, err := collectTree(b, root, &opts.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(aEntries)+len(bEntries))
+	for p := range aEntries {
+		paths = append(paths, p)
+	}
+	for p := range bEntries {
+		if _, ok := aEntries[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	result := &DiffResult{
+		a:    a,
+		b:    b,
+		root: root,
+	}
+
+	for _, p := range paths {
+		ae, aok := aEntries[p]
+		be, bok := bEntries[p]
+
+		c := Change{Path: p}
+
+		if aok {
+			c.OldMode = ae.mode()
+			c.OldModTime = ae.info.ModTime()
+			c.OldTarget = ae.target
+			if ae.info.Mode().IsRegular() && !ae.symlink {
+				c.OldSize = ae.info.Size()
+			}
+		}
+
+		if bok {
+			c.NewMode = be.mode()
+			c.NewModTime = be.info.ModTime()
+			c.NewTarget = be.target
+			if be.info.Mode().IsRegular() && !be.symlink {
+				c.NewSize = be.info.Size()
+			}
+		}
+
+		switch {
+		case !aok:
+			c.Kind = Added
+		case !bok:
+			c.Kind = Removed
+		default:
+			c.Kind, err = compareEntries(a, b, joinPath(root, p), joinPath(root, p), ae, be, opts)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if c.Kind != 0 {
+			result.Changes = append(result.Changes, c)
+		}
+	}
+
+	return result, nil
+}
+
+// collectTree walks fsys and returns all entries indexed by their path.
+func collectTree(fsys fs.FS, root string, filter *Filter) (map[string]treeEntry, error) {
+	entries := make(map[string]treeEntry)
+	err := walkTree(fsys, root, filter, func(e treeEntry) error {
+		entries[e.path] = e
+		return nil
+	})
+	return entries, err
+}
+
+// compareEntries compares the entry ae found at ap in a with the entry be
+// found at bp in b.
+func compareEntries(a, b fs.FS, ap, bp string, ae, be treeEntry, opts *DiffOptions) (ChangeKind, error) {
+	var kind ChangeKind
+
+	if ae.mode().Type() != be.mode().Type() {
+		return TypeChanged, nil
+	}
+
+	if !opts.IgnoreMode && ae.mode().Perm() != be.mode().Perm() && !ae.symlink {
+		kind |= ModeChanged
+	}
+
+	switch {
+	case ae.symlink:
+		if ae.target != be.target {
+			kind |= TargetChanged
+		}
+
+	case ae.mode().IsRegular():
+		changed, err := contentChanged(a, b, ap, bp, ae.info, be.info, opts)
+		if err != nil {
+			return 0, err
+		}
+		if changed {
+			kind |= ContentChanged
+		}
+	}
+
+	return kind, nil
+}
+
+// contentChanged compares the regular file ap in a with the regular file bp in
+// b.
+func contentChanged(a, b fs.FS, ap, bp string, ai, bi fs.FileInfo, opts *DiffOptions) (bool, error) {
+	if ai.Size() != bi.Size() {
+		return true, nil
+	}
+
+	if opts.Compare == CompareModTime {
+		at, bt := ai.ModTime(), bi.ModTime()
+		if opts.ModTimePrecision > 0 {
+			at = at.Truncate(opts.ModTimePrecision)
+			bt = bt.Truncate(opts.ModTimePrecision)
+		}
+		return !at.Equal(bt), nil
+	}
+
+	ah, err := hashFile(a, ap)
+	if err != nil {
+		return false, err
+	}
+
+	bh, err := hashFile(b, bp)
+	if err != nil {
+		return false, err
+	}
+
+	return !bytes.Equal(ah, bh), nil
+}
+
+// hashFile returns the SHA-256 hash of the content of the file p in fsys.
+func hashFile(fsys fs.FS, p string) ([]byte, error) {
+	f, err := fsys.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// --
+
+// maxTextDiffSize limits the size of files rendered as text diffs by
+// WriteUnified. Larger files are reported like binary files.
+const maxTextDiffSize = 1 << 20
+
+// WriteUnified writes a human readable representation of r to w. Changes of
+// text files are rendered as unified diffs; binary files, type, mode and
+// symlink changes are reported similar to the output of git diff.
+func (r *DiffResult) WriteUnified(w io.Writer) error {
+	for _, c := range r.Changes {
+		if err := r.writeChange(w, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// String returns the unified representation of r as produced by
+// WriteUnified. Errors reading file contents are rendered inline.
+func (r *DiffResult) String() string {
+	var sb strings.Builder
+	if err := r.WriteUnified(&sb); err != nil {
+		fmt.Fprintf(&sb, "error: %v\n", err)
+	}
+	return sb.String()
+}
+
+func (r *DiffResult) writeChange(w io.Writer, c Change) error {
+	oldName, newName := "a/"+c.Path, "b/"+c.Path
+
+	if _, err := fmt.Fprintf(w, "diff %s %s\n", oldName, newName); err != nil {
+		return err
+	}
+
+	switch {
+	case c.Kind.Has(Added):
+		fmt.Fprintf(w, "new file mode %s\n", c.NewMode)
+		oldName = "/dev/null"
+	case c.Kind.Has(Removed):
+		fmt.Fprintf(w, "deleted file mode %s\n", c.OldMode)
+		newName = "/dev/null"
+	case c.Kind.Has(TypeChanged):
+		_, err := fmt.Fprintf(w, "type changed %s => %s\n", c.OldMode, c.NewMode)
+		return err
+	}
+
+	if c.Kind.Has(ModeChanged) {
+		fmt.Fprintf(w, "old mode %s\nnew mode %s\n", c.OldMode, c.NewMode)
+	}
+
+	if c.OldTarget != c.NewTarget {
+		_, err := fmt.Fprintf(w, "symlink %q => %q\n", c.OldTarget, c.NewTarget)
+		return err
+	}
+
+	isFile := c.OldMode.IsRegular() && c.Kind.Has(Removed) ||
+		c.NewMode.IsRegular() && (c.Kind.Has(Added) || c.Kind.Has(ContentChanged))
+	if !isFile {
+		return nil
+	}
+
+	var oldContent, newContent []byte
+	var err error
+
+	if !c.Kind.Has(Added) {
+		if oldContent, err = readForDiff(r.a, joinPath(r.root, c.Path), c.OldSize); err != nil {
+			return err
+		}
+	}
+
+	if !c.Kind.Has(Removed) {
+		if newContent, err = readForDiff(r.b, joinPath(r.root, c.Path), c.NewSize); err != nil {
+			return err
+		}
+	}
+
+	if oldContent == nil && !c.Kind.Has(Added) || newContent == nil && !c.Kind.Has(Removed) {
+		_, err = fmt.Fprintf(w, "Binary files %s and %s differ\n", oldName, newName)
+		return err
+	}
+
+	_, err = io.WriteString(w, unifiedDiff(oldName, newName, string(oldContent), string(newContent)))
+	return err
+}
+
+// readForDiff reads the file p from fsys if it is a text file of limited size.
+// It returns nil if p is considered binary.
+func readForDiff(fsys fs.FS, p string, size int64) ([]byte, error) {
+	if size > maxTextDiffSize {
+		return nil, nil
+	}
+
+	data, err := fs.ReadFile(fsys, p)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isText(data) {
+		return nil, nil
+	}
+
+	if data == nil {
+		data = []byte{}
+	}
+
+	return data, nil
+}
+
+// isText reports whether data looks like UTF-8 encoded text.
+func isText(data []byte) bool {
+	probe := data
+	if len(probe) > 8000 {
+		probe = probe[:8000]
+	}
+	return bytes.IndexByte(probe, 0) < 0 && utf8.Valid(data)
+}
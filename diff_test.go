@@ -0,0 +1,114 @@
+package fsx_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/memfs"
+)
+
+func mustFromTxtar(t *testing.T, data string) fsx.LinkFS {
+	t.Helper()
+
+	fsys, err := memfs.FromTxtar([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys
+}
+
+func TestDiff(t *testing.T) {
+	a := mustFromTxtar(t, `-- same.txt --
+same
+-- changed.txt --
+line 1
+line 2
+-- removed.txt --
+removed
+-- mode.sh --
+#!/bin/sh
+-- typechange --
+file
+-- link -> same.txt --
+-- skip.log --
+old
+`)
+
+	b := mustFromTxtar(t, `-- same.txt --
+same
+-- changed.txt --
+line 1
+line two
+-- added/new.txt --
+new
+-- mode.sh mode=0755 --
+#!/bin/sh
+-- typechange/ --
+-- link -> changed.txt --
+-- skip.log --
+new
+`)
+
+	got, err := fsx.Diff(a, b, &fsx.DiffOptions{
+		Filter: fsx.Filter{Exclude: []string{"*.log"}},
+	})
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	kinds := make(map[string]fsx.ChangeKind)
+	for _, c := range got.Changes {
+		kinds[c.Path] = c.Kind
+	}
+
+	expect.That(t,
+		is.DeepEqualTo(kinds, map[string]fsx.ChangeKind{
+			"added":         fsx.Added,
+			"added/new.txt": fsx.Added,
+			"changed.txt":   fsx.ContentChanged,
+			"link":          fsx.TargetChanged,
+			"mode.sh":       fsx.ModeChanged,
+			"removed.txt":   fsx.Removed,
+			"typechange":    fsx.TypeChanged,
+		}),
+	)
+
+	expect.That(t, is.StringContaining(got.String(), `diff a/changed.txt b/changed.txt
+--- a/changed.txt
++++ b/changed.txt
+@@ -1,2 +1,2 @@
+ line 1
+-line 2
++line two
+`))
+
+	data, err := json.Marshal(got.Changes[0])
+	expect.That(t, is.NoError(err), is.StringContaining(string(data), `"kind":"added"`))
+}
+
+func TestDiff_modTime(t *testing.T) {
+	a := mustFromTxtar(t, "-- f --\nabc\n")
+	b := mustFromTxtar(t, "-- f --\nxyz\n")
+
+	now := time.Now()
+	expect.That(t, expect.FailNow(
+		is.NoError(a.(fsx.ChtimesFS).Chtimes("f", now, now)),
+		is.NoError(b.(fsx.ChtimesFS).Chtimes("f", now, now)),
+	))
+
+	got, err := fsx.Diff(a, b, &fsx.DiffOptions{Compare: fsx.CompareModTime})
+	expect.That(t, is.NoError(err), is.EqualTo(got.Empty(), true))
+
+	got, err = fsx.Diff(a, b, nil)
+	expect.That(t, is.NoError(err), is.SliceOfLen(got.Changes, 1))
+}
+
+func TestChangeKind_UnmarshalText(t *testing.T) {
+	var k fsx.ChangeKind
+	expect.That(t,
+		is.NoError(k.UnmarshalText([]byte("content|mode"))),
+		is.EqualTo(k, fsx.ContentChanged|fsx.ModeChanged),
+	)
+}
@@ -0,0 +1,68 @@
+package fsx
+
+import (
+	"path"
+	"strings"
+)
+
+// Filter selects paths based on glob patterns as understood by path.Match.
+// Patterns containing a Separator are matched against the full,
+// slash-separated path relative to the tree's root. Patterns without a
+// separator are matched against every element of the path, so "*.log" matches
+// "a/b/c.log" and "node_modules" matches "web/node_modules/x.js".
+//
+// A nil *Filter as well as the zero value match all paths.
+type Filter struct {
+	// Include lists patterns of non-directory entries to include. If empty,
+	// all entries are included. Directories are always traversed unless
+	// excluded, as they may contain included entries.
+	Include []string
+
+	// Exclude lists patterns of entries to exclude. An excluded directory is
+	// excluded with all of its children. Exclude takes precedence over
+	// Include.
+	Exclude []string
+}
+
+// Match reports whether the entry named p should be included. isDir must be
+// true if p names a directory.
+func (f *Filter) Match(p string, isDir bool) bool {
+	if f == nil {
+		return true
+	}
+
+	for _, pattern := range f.Exclude {
+		if matchPattern(pattern, p) {
+			return false
+		}
+	}
+
+	if isDir || len(f.Include) == 0 {
+		return true
+	}
+
+	for _, pattern := range f.Include {
+		if matchPattern(pattern, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchPattern matches p against pattern using the rules described for
+// Filter. Malformed patterns never match.
+func matchPattern(pattern, p string) bool {
+	if strings.ContainsRune(pattern, Separator) {
+		ok, _ := path.Match(pattern, p)
+		return ok
+	}
+
+	for _, elem := range splitAll(p) {
+		if ok, _ := path.Match(pattern, elem); ok {
+			return true
+		}
+	}
+
+	return false
+}
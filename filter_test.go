@@ -0,0 +1,32 @@
+package fsx_test
+
+import (
+	"testing"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	"github.com/halimath/fsx"
+)
+
+func TestFilter_Match(t *testing.T) {
+	tests := []struct {
+		filter *fsx.Filter
+		path   string
+		isDir  bool
+		want   bool
+	}{
+		{nil, "a/b.txt", false, true},
+		{&fsx.Filter{}, "a/b.txt", false, true},
+		{&fsx.Filter{Include: []string{"*.go"}}, "a/b.txt", false, false},
+		{&fsx.Filter{Include: []string{"*.go"}}, "a/b.go", false, true},
+		{&fsx.Filter{Include: []string{"*.go"}}, "a", true, true},
+		{&fsx.Filter{Include: []string{"a/*.go"}}, "b/c.go", false, false},
+		{&fsx.Filter{Exclude: []string{"node_modules"}}, "web/node_modules", true, false},
+		{&fsx.Filter{Exclude: []string{"node_modules"}}, "web/node_modules/x.js", false, false},
+		{&fsx.Filter{Include: []string{"*.js"}, Exclude: []string{"vendor"}}, "vendor/x.js", false, false},
+	}
+
+	for _, test := range tests {
+		expect.That(t, is.EqualTo(test.filter.Match(test.path, test.isDir), test.want))
+	}
+}
@@ -0,0 +1,157 @@
+// Package foldfs provides a fsx.FS wrapper performing case-insensitive,
+// case-preserving lookups of names on another fsx.FS (e.g. an osfs.DirFS on
+// a case-sensitive filesystem). This mimics the behavior of the default
+// filesystems of macOS and Windows, where "Readme.md" and "README.md" denote
+// the same file and names in different Unicode normalization forms are
+// considered equal.
+//
+// Names are compared by their key: the name normalized using the configured
+// Unicode normalization form and folded using Unicode case folding. Entries
+// are created using the name passed by the caller, so the spelling of names
+// is preserved.
+//
+// Operations creating an entry fail with an error wrapping fs.ErrExist if an
+// entry with the same key but a different name already exists. This applies
+// to OpenFile with O_CREATE, Mkdir, Rename, Link and Symlink. Renaming an
+// entry to a name only differing in spelling is permitted.
+//
+// Lint scans any fs.FS for names that collide or are not portable to other
+// platforms.
+package foldfs
+
+import (
+	"fmt"
+	"io/fs"
+	"sync"
+
+	"github.com/halimath/fsx"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Normalization defines the Unicode normalization form applied to names
+// before comparing them.
+type Normalization int
+
+const (
+	// NFC defines the canonical composition form. This is the default.
+	NFC Normalization = iota
+	// NFD defines the canonical decomposition form.
+	NFD
+	// NFKC defines the compatibility composition form.
+	NFKC
+	// NFKD defines the compatibility decomposition form.
+	NFKD
+	// NoNormalization disables normalization; names are compared by their
+	// case folded code points only.
+	NoNormalization
+)
+
+// Option defines a function used to customize a foldfs.
+type Option func(*options)
+
+type options struct {
+	normalization Normalization
+	caseSensitive bool
+}
+
+// WithNormalization sets the Unicode normalization form applied to names
+// before comparing them. Defaults to NFC.
+func WithNormalization(n Normalization) Option {
+	return func(o *options) {
+		o.normalization = n
+	}
+}
+
+// WithCaseSensitive disables case folding; names are compared by their
+// normalized form only.
+func WithCaseSensitive() Option {
+	return func(o *options) {
+		o.caseSensitive = true
+	}
+}
+
+func newOptions(opts []Option) (options, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.normalization < NFC || o.normalization > NoNormalization {
+		return o, fmt.Errorf("foldfs: invalid normalization: %d", o.normalization)
+	}
+
+	return o, nil
+}
+
+// forms maps Normalization values to the corresponding norm.Form.
+var forms = [...]norm.Form{norm.NFC, norm.NFD, norm.NFKC, norm.NFKD}
+
+// key returns the key names are compared by.
+func (o options) key(name string) string {
+	normalize := func(s string) string {
+		if o.normalization < NFC || o.normalization >= NoNormalization {
+			return s
+		}
+		return forms[o.normalization].String(s)
+	}
+
+	name = normalize(name)
+	if o.caseSensitive {
+		return name
+	}
+
+	// Case folding may produce unnormalized strings, so the folded name is
+	// normalized again.
+	return normalize(cases.Fold().String(name))
+}
+
+// KeyFunc returns the function mapping names to the keys compared by a
+// foldfs created with opts. Invalid normalization forms are treated like
+// NoNormalization.
+func KeyFunc(opts ...Option) func(name string) string {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o.key
+}
+
+// FS defines the interface of a case-insensitive filesystem. Names passed to
+// its operations are resolved to the stored names of the entries sharing
+// their keys.
+type FS interface {
+	fsx.LinkFS
+	fsx.ChmodFS
+	fsx.ChownFS
+	fsx.ChtimesFS
+	fsx.RemoveAllFS
+	fsx.WriteFileFS
+	fs.StatFS
+	fs.ReadDirFS
+	fs.ReadFileFS
+
+	// Resolve returns the name of the entry name refers to as stored in the
+	// backing filesystem. ok is false if no such entry exists.
+	Resolve(name string) (resolved string, ok bool)
+}
+
+type foldfs struct {
+	backing fsx.FS
+	opts    options
+
+	// mu serializes all operations creating entries, so that checking for
+	// collisions and creating the entry is atomic.
+	mu sync.Mutex
+}
+
+// New creates a case-insensitive, case-preserving filesystem wrapping
+// backing.
+func New(backing fsx.FS, opts ...Option) (FS, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &foldfs{backing: backing, opts: o}, nil
+}
@@ -0,0 +1,244 @@
+package foldfs
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	. "github.com/halimath/fixture"
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/memfs"
+	"github.com/halimath/fsx/osfs"
+)
+
+const (
+	// cafeNFC contains "café" using a precomposed é.
+	cafeNFC = "caf\u00e9"
+	// cafeNFD contains "café" using e followed by a combining acute accent.
+	cafeNFD = "cafe\u0301"
+)
+
+type foldfsFixture struct {
+	backing fsx.LinkFS
+	fs      FS
+	opts    []Option
+}
+
+func (f *foldfsFixture) BeforeEach(t *testing.T) error {
+	f.backing = memfs.New()
+
+	if err := fsx.MkdirAll(f.backing, "Docs/"+cafeNFD, 0755); err != nil {
+		return err
+	}
+	if err := fsx.WriteFile(f.backing, "Docs/README.md", []byte("readme"), 0644); err != nil {
+		return err
+	}
+
+	var err error
+	f.fs, err = New(f.backing, f.opts...)
+	return err
+}
+
+// expectNames expects dir to contain entries named names in the backing
+// filesystem.
+func (f *foldfsFixture) expectNames(t *testing.T, dir string, names ...string) {
+	t.Helper()
+
+	entries, err := fs.ReadDir(f.backing, dir)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	got := make([]string, len(entries))
+	for i, e := range entries {
+		got[i] = e.Name()
+	}
+	expect.That(t, is.DeepEqualTo(got, names))
+}
+
+func TestFoldFS(t *testing.T) {
+	With(t, new(foldfsFixture)).
+		Run("lookup", func(t *testing.T, f *foldfsFixture) {
+			data, err := f.fs.ReadFile("docs/readme.MD")
+			expect.That(t, is.NoError(err), is.EqualTo(string(data), "readme"))
+
+			info, err := f.fs.Stat("DOCS/" + cafeNFC)
+			expect.That(t, is.NoError(err), is.EqualTo(info.IsDir(), true))
+
+			resolved, ok := f.fs.Resolve("docs/Café")
+			expect.That(t, is.EqualTo(ok, true), is.EqualTo(resolved, "Docs/"+cafeNFD))
+
+			_, err = f.fs.Stat("docs/missing.md")
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+		}).
+		Run("preserveCase", func(t *testing.T, f *foldfsFixture) {
+			expect.That(t,
+				is.NoError(f.fs.WriteFile("docs/ChangeLog.md", []byte("log"), 0644)),
+				is.NoError(f.fs.Mkdir("DOCS/Images", 0755)),
+			)
+			f.expectNames(t, "Docs", "ChangeLog.md", "Images", "README.md", cafeNFD)
+
+			// Writing the exact name replaces the file.
+			expect.That(t, is.NoError(f.fs.WriteFile("docs/ChangeLog.md", []byte("log 2"), 0644)))
+			data, err := f.fs.ReadFile("docs/changelog.md")
+			expect.That(t, is.NoError(err), is.EqualTo(string(data), "log 2"))
+
+			file, err := f.fs.OpenFile("docs/readme.md", fsx.O_WRONLY|fsx.O_APPEND, 0)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			_, err = file.Write([]byte("!"))
+			expect.That(t, is.NoError(err), is.NoError(file.Close()))
+
+			data, err = fs.ReadFile(f.backing, "Docs/README.md")
+			expect.That(t, is.NoError(err), is.EqualTo(string(data), "readme!"))
+		}).
+		Run("collisions", func(t *testing.T, f *foldfsFixture) {
+			_, err := f.fs.OpenFile("docs/readme.md", fsx.O_WRONLY|fsx.O_CREATE|fsx.O_TRUNC, 0644)
+			expect.That(t, is.Error(err, fs.ErrExist))
+
+			expect.That(t,
+				is.Error(f.fs.WriteFile("Docs/Readme.md", []byte("other"), 0644), fs.ErrExist),
+				is.Error(f.fs.Mkdir("Docs/"+cafeNFC, 0755), fs.ErrExist),
+				is.Error(f.fs.Mkdir("Docs/"+cafeNFD, 0755), fs.ErrExist),
+				is.Error(f.fs.Symlink("README.md", "Docs/readme.md"), fs.ErrExist),
+				is.Error(f.fs.Link("Docs/README.md", "docs/Readme.md"), fs.ErrExist),
+			)
+
+			expect.That(t, is.NoError(f.fs.WriteFile("Docs/notes.md", []byte("notes"), 0644)))
+			expect.That(t, is.Error(f.fs.Rename("Docs/notes.md", "Docs/readme.md"), fs.ErrExist))
+
+			f.expectNames(t, "Docs", "README.md", cafeNFD, "notes.md")
+		}).
+		Run("rename", func(t *testing.T, f *foldfsFixture) {
+			// Renaming an entry to a different spelling of its own name.
+			expect.That(t,
+				is.NoError(f.fs.Rename("docs/README.md", "docs/Readme.md")),
+				is.NoError(f.fs.Rename("docs", "docs")),
+			)
+			f.expectNames(t, ".", "docs")
+			f.expectNames(t, "docs", "Readme.md", cafeNFD)
+
+			// Renaming over an entry with exactly the same name replaces it.
+			expect.That(t, is.NoError(f.fs.WriteFile("notes.md", []byte("notes"), 0644)))
+			expect.That(t, is.NoError(f.fs.Rename("NOTES.md", "DOCS/Readme.md")))
+
+			data, err := f.fs.ReadFile("docs/readme.md")
+			expect.That(t, is.NoError(err), is.EqualTo(string(data), "notes"))
+		}).
+		Run("symlink", func(t *testing.T, f *foldfsFixture) {
+			expect.That(t, expect.FailNow(is.NoError(f.fs.Symlink("docs/readme.md", "link"))))
+
+			target, err := f.backing.Readlink("link")
+			expect.That(t, is.NoError(err), is.EqualTo(target, "Docs/README.md"))
+
+			got, err := fs.ReadFile(f.backing, "link")
+			expect.That(t, is.NoError(err), is.EqualTo(string(got), "readme"))
+		}).
+		Run("remove", func(t *testing.T, f *foldfsFixture) {
+			expect.That(t,
+				is.NoError(f.fs.Remove("DOCS/readme.md")),
+				is.Error(f.fs.Remove("DOCS/readme.md"), fs.ErrNotExist),
+				is.NoError(f.fs.RemoveAll("docs")),
+				is.NoError(f.fs.RemoveAll("docs")),
+			)
+			f.expectNames(t, ".")
+		})
+
+	With(t, &foldfsFixture{opts: []Option{WithCaseSensitive()}}).
+		Run("caseSensitive", func(t *testing.T, f *foldfsFixture) {
+			_, err := f.fs.Stat("docs/README.md")
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+
+			_, err = f.fs.Stat("Docs/" + cafeNFC)
+			expect.That(t, is.NoError(err))
+
+			expect.That(t, is.NoError(f.fs.WriteFile("Docs/readme.md", []byte("lower"), 0644)))
+			f.expectNames(t, "Docs", "README.md", cafeNFD, "readme.md")
+		})
+
+	With(t, &foldfsFixture{opts: []Option{WithNormalization(NoNormalization)}}).
+		Run("noNormalization", func(t *testing.T, f *foldfsFixture) {
+			_, err := f.fs.Stat("docs/" + cafeNFC)
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+
+			_, err = f.fs.Stat("docs/readme.md")
+			expect.That(t, is.NoError(err))
+		})
+}
+
+func TestOSFS(t *testing.T) {
+	fsys, err := New(osfs.DirFS(t.TempDir()))
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	expect.That(t,
+		is.NoError(fsx.MkdirAll(fsys, "Docs/Guides", 0755)),
+		is.NoError(fsx.WriteFile(fsys, "Docs/README.md", []byte("readme"), 0644)),
+	)
+
+	_, err = fs.Stat(fsys, "docs/readme.md")
+	expect.That(t, is.NoError(err), is.NoError(fstest.TestFS(fsys, "Docs/README.md", "Docs/Guides")))
+}
+
+func TestNew(t *testing.T) {
+	for _, n := range []Normalization{-1, NoNormalization + 1} {
+		_, err := New(memfs.New(), WithNormalization(n))
+		expect.That(t, is.EqualTo(err != nil, true))
+	}
+}
+
+func TestKeyFunc(t *testing.T) {
+	key := KeyFunc()
+	expect.That(t,
+		is.EqualTo(key("README.md"), key("readme.md")),
+		is.EqualTo(key(cafeNFC), key(cafeNFD)),
+		is.EqualTo(key("Straße"), key("STRASSE")),
+	)
+
+	key = KeyFunc(WithCaseSensitive(), WithNormalization(NFD))
+	expect.That(t,
+		is.EqualTo(key(cafeNFC), cafeNFD),
+		is.EqualTo(key("README.md") == key("readme.md"), false),
+	)
+}
+
+func TestLint(t *testing.T) {
+	fsys := fstest.MapFS{
+		"README.md":           {Data: []byte("a")},
+		"docs/Readme.md":      {Data: []byte("b")},
+		"docs/readme.MD":      {Data: []byte("c")},
+		"docs/" + cafeNFC:     {Data: []byte("d")},
+		"docs/" + cafeNFD:     {Data: []byte("e")},
+		"src/CON.go":          {Data: []byte("f")},
+		"src/nul":             {Data: []byte("g")},
+		"src/console.go":      {Data: []byte("h")},
+		"src/draft.":          {Data: []byte("i")},
+		"src/a:b? ":           {Data: []byte("j")},
+		"Src/main.go":         {Data: []byte("k")},
+		"src/COM1.tar.gz":     {Data: []byte("l")},
+		"src/nested/COM10.go": {Data: []byte("m")},
+		"tmp/prn":             {Data: []byte("n")},
+		"tmp.x:":              {Data: []byte("o")},
+	}
+
+	issues, err := Lint(fsys)
+	expect.That(t, is.NoError(err), is.DeepEqualTo(issues, []Issue{
+		{Path: "docs/" + cafeNFC, Kind: Collision, Other: "docs/" + cafeNFD},
+		{Path: "docs/readme.MD", Kind: Collision, Other: "docs/Readme.md"},
+		{Path: "src", Kind: Collision, Other: "Src"},
+		{Path: "src/COM1.tar.gz", Kind: Reserved},
+		{Path: "src/CON.go", Kind: Reserved},
+		{Path: "src/a:b? ", Kind: TrailingDotOrSpace},
+		{Path: "src/a:b? ", Kind: InvalidCharacter},
+		{Path: "src/draft.", Kind: TrailingDotOrSpace},
+		{Path: "src/nul", Kind: Reserved},
+		{Path: "tmp.x:", Kind: InvalidCharacter},
+		{Path: "tmp/prn", Kind: Reserved},
+	}))
+
+	expect.That(t,
+		is.EqualTo(issues[1].String(), "docs/readme.MD: collision with docs/Readme.md"),
+		is.EqualTo(issues[3].String(), "src/COM1.tar.gz: reserved"),
+	)
+
+	issues, err = Lint(fsys, WithCaseSensitive())
+	expect.That(t, is.NoError(err), is.EqualTo(len(issues), 9))
+}
@@ -0,0 +1,332 @@
+package foldfs
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/internal/wrapfs"
+)
+
+// Resolve returns the name of the entry name refers to as stored in the
+// backing filesystem.
+func (fsys *foldfs) Resolve(name string) (string, bool) {
+	if !fs.ValidPath(name) {
+		return "", false
+	}
+	return fsys.resolve(name)
+}
+
+// resolve resolves name element by element. If an element does not exist,
+// resolve returns the resolved parent joined with the remaining elements as
+// given and false.
+func (fsys *foldfs) resolve(name string) (string, bool) {
+	if name == "." {
+		return name, true
+	}
+
+	resolved := "."
+	rest := name
+	for rest != "" {
+		var elem string
+		elem, rest, _ = strings.Cut(rest, "/")
+
+		match, ok := fsys.lookup(resolved, elem)
+		if !ok {
+			return path.Join(resolved, elem, rest), false
+		}
+		resolved = path.Join(resolved, match)
+	}
+
+	return resolved, true
+}
+
+// lookup returns the name of the entry of dir matching name. An entry named
+// exactly like name is preferred over entries only sharing its key; it is
+// found using Stat, so dir is only read if no such entry exists (or if it is
+// a dangling symlink).
+func (fsys *foldfs) lookup(dir, name string) (string, bool) {
+	_, err := fs.Stat(fsys.backing, path.Join(dir, name))
+	if err == nil {
+		return name, true
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", false
+	}
+
+	entries, err := fs.ReadDir(fsys.backing, dir)
+	if err != nil {
+		return "", false
+	}
+
+	key := fsys.opts.key(name)
+	match := ""
+	for _, e := range entries {
+		if e.Name() == name {
+			return name, true
+		}
+		if match == "" && fsys.opts.key(e.Name()) == key {
+			match = e.Name()
+		}
+	}
+
+	return match, match != ""
+}
+
+// target resolves name for op creating an entry. exists reports whether an
+// entry with exactly the same name exists. If an entry spelled differently
+// exists, target returns an error wrapping fs.ErrExist. It must be called
+// with fsys.mu held.
+func (fsys *foldfs) target(op, name string) (resolved string, exists bool, err error) {
+	if !fs.ValidPath(name) || name == "." {
+		return "", false, wrapfs.PathError(op, name, fs.ErrInvalid)
+	}
+
+	resolved, exists = fsys.resolve(name)
+	if exists && path.Base(resolved) != path.Base(name) {
+		return "", false, wrapfs.PathError(op, name, fs.ErrExist)
+	}
+	return resolved, exists, nil
+}
+
+// existing resolves name for op requiring the entry to exist.
+func (fsys *foldfs) existing(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", wrapfs.PathError(op, name, fs.ErrInvalid)
+	}
+
+	resolved, ok := fsys.resolve(name)
+	if !ok {
+		return "", wrapfs.PathError(op, name, fs.ErrNotExist)
+	}
+	return resolved, nil
+}
+
+// Open opens the named file for reading.
+func (fsys *foldfs) Open(name string) (fs.File, error) {
+	resolved, err := fsys.existing("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return fsys.backing.Open(resolved)
+}
+
+// OpenFile opens the named file. If flag contains O_CREATE and an entry
+// spelled differently exists, OpenFile fails with an error wrapping
+// fs.ErrExist.
+func (fsys *foldfs) OpenFile(name string, flag int, perm fs.FileMode) (fsx.File, error) {
+	if flag&fsx.O_CREATE == 0 {
+		resolved, err := fsys.existing("OpenFile", name)
+		if err != nil {
+			return nil, err
+		}
+		return fsys.backing.OpenFile(resolved, flag, perm)
+	}
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	resolved, _, err := fsys.target("OpenFile", name)
+	if err != nil {
+		return nil, err
+	}
+	return fsys.backing.OpenFile(resolved, flag, perm)
+}
+
+// Mkdir creates the named directory.
+func (fsys *foldfs) Mkdir(name string, perm fs.FileMode) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	resolved, exists, err := fsys.target("Mkdir", name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return wrapfs.PathError("Mkdir", name, fs.ErrExist)
+	}
+	return fsys.backing.Mkdir(resolved, perm)
+}
+
+// Remove removes the named file or empty directory.
+func (fsys *foldfs) Remove(name string) error {
+	resolved, err := fsys.existing("Remove", name)
+	if err != nil {
+		return err
+	}
+	return fsys.backing.Remove(resolved)
+}
+
+// Rename renames oldpath to newpath. If an entry spelled differently than
+// newpath exists, Rename fails with an error wrapping fs.ErrExist unless the
+// entry is oldpath itself; renaming an entry to a name only differing in
+// spelling changes the entry's stored name.
+func (fsys *foldfs) Rename(oldpath, newpath string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	oldResolved, err := fsys.existing("Rename", oldpath)
+	if err != nil {
+		return err
+	}
+
+	if !fs.ValidPath(newpath) || newpath == "." {
+		return wrapfs.PathError("Rename", newpath, fs.ErrInvalid)
+	}
+
+	newResolved, exists := fsys.resolve(newpath)
+	if exists && path.Base(newResolved) != path.Base(newpath) {
+		if newResolved != oldResolved {
+			return wrapfs.PathError("Rename", newpath, fs.ErrExist)
+		}
+		newResolved = path.Join(path.Dir(newResolved), path.Base(newpath))
+	}
+
+	return fsys.backing.Rename(oldResolved, newResolved)
+}
+
+// SameFile reports whether fi1 and fi2 describe the same file.
+func (fsys *foldfs) SameFile(fi1, fi2 fs.FileInfo) bool {
+	return fsys.backing.SameFile(fi1, fi2)
+}
+
+// -- fsx.WriteFileFS
+
+// WriteFile writes data to the named file. If an entry spelled differently
+// exists, WriteFile fails with an error wrapping fs.ErrExist.
+func (fsys *foldfs) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	resolved, _, err := fsys.target("WriteFile", name)
+	if err != nil {
+		return err
+	}
+	return fsx.WriteFile(fsys.backing, resolved, data, perm)
+}
+
+// -- fsx.ChmodFS, fsx.ChownFS, fsx.ChtimesFS, fsx.RemoveAllFS
+
+// Chmod changes the mode of the named file.
+func (fsys *foldfs) Chmod(name string, mode fs.FileMode) error {
+	resolved, err := fsys.existing("Chmod", name)
+	if err != nil {
+		return err
+	}
+	return fsx.Chmod(fsys.backing, resolved, mode)
+}
+
+// Chown changes the numeric owner and group of the named file.
+func (fsys *foldfs) Chown(name string, uid, gid int) error {
+	resolved, err := fsys.existing("Chown", name)
+	if err != nil {
+		return err
+	}
+	return fsx.Chown(fsys.backing, resolved, uid, gid)
+}
+
+// Chtimes changes the access and modification time of the named file.
+func (fsys *foldfs) Chtimes(name string, atime, mtime time.Time) error {
+	resolved, err := fsys.existing("Chtimes", name)
+	if err != nil {
+		return err
+	}
+
+	return wrapfs.Chtimes(fsys.backing, resolved, atime, mtime)
+}
+
+// RemoveAll removes name including all of its children. If name does not
+// exist, RemoveAll returns nil.
+func (fsys *foldfs) RemoveAll(name string) error {
+	if !fs.ValidPath(name) {
+		return wrapfs.PathError("RemoveAll", name, fs.ErrInvalid)
+	}
+
+	resolved, ok := fsys.resolve(name)
+	if !ok {
+		return nil
+	}
+	return fsx.RemoveAll(fsys.backing, resolved)
+}
+
+// -- fsx.LinkFS
+
+// Readlink returns the target of the named symlink. The target is returned
+// as stored.
+func (fsys *foldfs) Readlink(name string) (string, error) {
+	resolved, err := fsys.existing("Readlink", name)
+	if err != nil {
+		return "", err
+	}
+	return wrapfs.Readlink(fsys.backing, resolved)
+}
+
+// Link creates newname as a hard link to oldname.
+func (fsys *foldfs) Link(oldname, newname string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	oldResolved, err := fsys.existing("Link", oldname)
+	if err != nil {
+		return err
+	}
+
+	newResolved, _, err := fsys.target("Link", newname)
+	if err != nil {
+		return err
+	}
+	return wrapfs.Link(fsys.backing, oldResolved, newResolved)
+}
+
+// Symlink creates newname as a symbolic link to oldname. oldname is resolved
+// like any other name, so the link refers to the stored spelling of an
+// existing target. The unresolved rest of a missing target is stored as
+// given.
+func (fsys *foldfs) Symlink(oldname, newname string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	target := oldname
+	if fs.ValidPath(oldname) {
+		target, _ = fsys.resolve(oldname)
+	}
+
+	newResolved, _, err := fsys.target("Symlink", newname)
+	if err != nil {
+		return err
+	}
+	return wrapfs.Symlink(fsys.backing, target, newResolved)
+}
+
+// -- fs.StatFS, fs.ReadDirFS, fs.ReadFileFS
+
+// Stat returns a fs.FileInfo describing the named file.
+func (fsys *foldfs) Stat(name string) (fs.FileInfo, error) {
+	resolved, err := fsys.existing("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.Stat(fsys.backing, resolved)
+}
+
+// ReadDir reads the named directory. Entries are reported using their
+// stored names.
+func (fsys *foldfs) ReadDir(name string) ([]fs.DirEntry, error) {
+	resolved, err := fsys.existing("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.ReadDir(fsys.backing, resolved)
+}
+
+// ReadFile reads the named file.
+func (fsys *foldfs) ReadFile(name string) ([]byte, error) {
+	resolved, err := fsys.existing("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.ReadFile(fsys.backing, resolved)
+}
@@ -0,0 +1,142 @@
+package foldfs
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// IssueKind describes the kind of portability issue reported by Lint.
+type IssueKind int
+
+const (
+	// Collision reports an entry sharing its key with a sibling. Both
+	// entries denote the same file on case-insensitive filesystems.
+	Collision IssueKind = iota + 1
+	// Reserved reports a name reserved for devices on Windows, such as CON
+	// or NUL - with or without an extension.
+	Reserved
+	// TrailingDotOrSpace reports a name ending with a dot or space, which
+	// Windows strips.
+	TrailingDotOrSpace
+	// InvalidCharacter reports a name containing a character not permitted
+	// on Windows, such as a colon or a control character.
+	InvalidCharacter
+)
+
+var issueKindNames = map[IssueKind]string{
+	Collision:          "collision",
+	Reserved:           "reserved",
+	TrailingDotOrSpace: "trailing dot or space",
+	InvalidCharacter:   "invalid character",
+}
+
+// String returns a textual representation of k.
+func (k IssueKind) String() string {
+	if n, ok := issueKindNames[k]; ok {
+		return n
+	}
+	return fmt.Sprintf("IssueKind(%d)", int(k))
+}
+
+// Issue describes a single portability issue found by Lint.
+type Issue struct {
+	// Path contains the path of the offending entry.
+	Path string
+	Kind IssueKind
+	// Other contains the path of the entry Path collides with for Collision
+	// issues and is empty otherwise.
+	Other string
+}
+
+func (i Issue) String() string {
+	if i.Kind == Collision {
+		return fmt.Sprintf("%s: %s with %s", i.Path, i.Kind, i.Other)
+	}
+	return fmt.Sprintf("%s: %s", i.Path, i.Kind)
+}
+
+// reservedNames contains the device names reserved on Windows.
+var reservedNames = map[string]struct{}{
+	"CON": {}, "PRN": {}, "AUX": {}, "NUL": {},
+	"COM0": {}, "COM1": {}, "COM2": {}, "COM3": {}, "COM4": {},
+	"COM5": {}, "COM6": {}, "COM7": {}, "COM8": {}, "COM9": {},
+	"LPT0": {}, "LPT1": {}, "LPT2": {}, "LPT3": {}, "LPT4": {},
+	"LPT5": {}, "LPT6": {}, "LPT7": {}, "LPT8": {}, "LPT9": {},
+}
+
+// Lint scans fsys for names that are not portable to other platforms. Names
+// are compared for collisions using the keys defined by opts; the defaults
+// match the behavior of macOS and Windows. Symlinks are not followed. Issues
+// are reported in lexical order of the entries' paths.
+func Lint(fsys fs.FS, opts ...Option) ([]Issue, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	issues := make([]Issue, 0)
+	if err := lintDir(fsys, ".", o, &issues); err != nil {
+		return nil, err
+	}
+
+	// The walk reports a directory's children before its siblings, e.g.
+	// "a/x" before "a.txt".
+	sort.SliceStable(issues, func(i, j int) bool { return issues[i].Path < issues[j].Path })
+
+	return issues, nil
+}
+
+func lintDir(fsys fs.FS, dir string, o options, issues *[]Issue) error {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]string, len(entries))
+
+	for _, e := range entries {
+		p := path.Join(dir, e.Name())
+
+		for _, k := range lintName(e.Name()) {
+			*issues = append(*issues, Issue{Path: p, Kind: k})
+		}
+
+		key := o.key(e.Name())
+		if other, ok := seen[key]; ok {
+			*issues = append(*issues, Issue{Path: p, Kind: Collision, Other: other})
+		} else {
+			seen[key] = p
+		}
+
+		if e.IsDir() {
+			if err := lintDir(fsys, p, o, issues); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// lintName returns the kinds of issues found for name.
+func lintName(name string) []IssueKind {
+	var kinds []IssueKind
+
+	stem, _, _ := strings.Cut(name, ".")
+	if _, ok := reservedNames[strings.ToUpper(strings.TrimRight(stem, " "))]; ok {
+		kinds = append(kinds, Reserved)
+	}
+
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		kinds = append(kinds, TrailingDotOrSpace)
+	}
+
+	if strings.ContainsAny(name, `<>:"\|?*`) || strings.IndexFunc(name, func(r rune) bool { return r < 0x20 }) >= 0 {
+		kinds = append(kinds, InvalidCharacter)
+	}
+
+	return kinds
+}
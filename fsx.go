@@ -79,6 +79,15 @@ const (
 
 var (
 	ErrInvalidWhence = errors.New("invalid whence")
+
+	// ErrNotSupported is returned by operations that require a capability the
+	// given filesystem does not provide (e.g. creating a symlink in a FS that
+	// does not satisfy LinkFS).
+	ErrNotSupported = errors.New("operation not supported")
+
+	// ErrDirNotEmpty is returned when removing or replacing a directory
+	// that still contains entries.
+	ErrDirNotEmpty = errors.New("directory not empty")
 )
 
 // File defines the interface for a writable file in a FS. It composes fs.File
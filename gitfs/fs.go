@@ -0,0 +1,380 @@
+package gitfs
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/halimath/fsx/internal/buffile"
+	"github.com/halimath/fsx/internal/pathtree"
+)
+
+// maxSymlinkDepth limits the number of symlinks resolved when looking up a
+// single name.
+const maxSymlinkDepth = 40
+
+// Git tree entry modes.
+const (
+	modeDir     = 0o040000
+	modeFile    = 0o100644
+	modeExec    = 0o100755
+	modeSymlink = 0o120000
+	modeGitlink = 0o160000
+)
+
+// FS defines the interface of the filesystem returned by Repository.FS.
+type FS interface {
+	fs.ReadDirFS
+	fs.ReadFileFS
+	fs.StatFS
+
+	// Lstat returns a fs.FileInfo describing the named file without
+	// following a final symlink.
+	Lstat(name string) (fs.FileInfo, error)
+
+	// Readlink returns the target of the symlink name relative to the
+	// filesystem's root.
+	Readlink(name string) (string, error)
+}
+
+// treeEntry is a single entry of a tree object.
+type treeEntry struct {
+	name string
+	mode uint32
+	hash Hash
+}
+
+func (e treeEntry) isDir() bool     { return e.mode == modeDir || e.mode == modeGitlink }
+func (e treeEntry) isSymlink() bool { return e.mode == modeSymlink }
+
+func (e treeEntry) fileMode() fs.FileMode {
+	switch {
+	case e.isDir():
+		return fs.ModeDir | 0755
+	case e.isSymlink():
+		return fs.ModeSymlink | 0777
+	case e.mode&0o111 != 0:
+		return 0755
+	default:
+		return 0644
+	}
+}
+
+// tree reads and decodes the tree h. The entries are sorted by name.
+func (r *Repository) tree(h Hash) ([]treeEntry, error) {
+	r.mu.Lock()
+	entries, ok := r.trees[h]
+	r.mu.Unlock()
+	if ok {
+		return entries, nil
+	}
+
+	data, err := r.readTyped(h, typeTree)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err = parseTree(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: tree %s: %v", ErrCorrupt, h, err)
+	}
+
+	r.mu.Lock()
+	if len(r.trees) >= maxCacheSize {
+		r.trees = make(map[Hash][]treeEntry)
+	}
+	r.trees[h] = entries
+	r.mu.Unlock()
+
+	return entries, nil
+}
+
+// parseTree decodes the entries of a tree object. Each entry is encoded as
+// "<octal mode> <name>\0<20 byte hash>".
+func parseTree(data []byte) ([]treeEntry, error) {
+	var entries []treeEntry
+
+	for len(data) > 0 {
+		sp := bytes.IndexByte(data, ' ')
+		nul := bytes.IndexByte(data, 0)
+		if sp < 0 || nul < sp || len(data) < nul+1+len(Hash{}) {
+			return nil, fmt.Errorf("truncated entry")
+		}
+
+		mode, err := strconv.ParseUint(string(data[:sp]), 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mode %q", data[:sp])
+		}
+
+		e := treeEntry{
+			name: string(data[sp+1 : nul]),
+			mode: uint32(mode),
+		}
+		copy(e.hash[:], data[nul+1:])
+		data = data[nul+1+len(Hash{}):]
+
+		if e.name == "" || e.name == "." || e.name == ".." || strings.Contains(e.name, "/") {
+			return nil, fmt.Errorf("invalid name %q", e.name)
+		}
+
+		entries = append(entries, e)
+	}
+
+	// Git sorts directories as if their names had a trailing slash.
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+
+	return entries, nil
+}
+
+// FS returns the tree of the commit identified by rev as a read-only
+// filesystem. See Resolve for the supported revision syntax.
+func (r *Repository) FS(rev string) (FS, error) {
+	c, err := r.Commit(rev)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gitfs{
+		r:     r,
+		root:  treeEntry{name: ".", mode: modeDir, hash: c.Tree},
+		mtime: c.Committer.When,
+	}, nil
+}
+
+type gitfs struct {
+	r     *Repository
+	root  treeEntry
+	mtime time.Time
+}
+
+func pathError(op, name string, err error) error {
+	if _, ok := err.(*fs.PathError); ok {
+		return err
+	}
+
+	return &fs.PathError{
+		Op:   op,
+		Path: name,
+		Err:  err,
+	}
+}
+
+// linkTarget resolves the target stored for the symlink at linkPath to a path
+// relative to the filesystem's root.
+func linkTarget(linkPath, target string) string {
+	if strings.HasPrefix(target, "/") {
+		// Absolute targets point outside of the tree.
+		return target
+	}
+	return path.Join(path.Dir(linkPath), target)
+}
+
+// readDir returns the entries of the directory e.
+func (fsys *gitfs) readDir(e treeEntry) ([]treeEntry, error) {
+	if e.mode == modeGitlink {
+		// Submodule contents are not part of the repository.
+		return nil, nil
+	}
+	return fsys.r.tree(e.hash)
+}
+
+// resolve looks up name and returns the resolved name (with all symlinks in
+// directory components replaced) and its entry. If followLast is true, a
+// final symlink is followed as well.
+func (fsys *gitfs) resolve(op, name string, followLast bool) (string, treeEntry, error) {
+	if !fs.ValidPath(name) {
+		return "", treeEntry{}, pathError(op, name, fs.ErrInvalid)
+	}
+
+	resolved, e, err := fsys.tree().Resolve(name, followLast, maxSymlinkDepth)
+	if err != nil {
+		return "", treeEntry{}, pathError(op, name, err)
+	}
+	return resolved, e, nil
+}
+
+// tree returns the repository's tree of entries.
+func (fsys *gitfs) tree() pathtree.Tree[treeEntry] {
+	return pathtree.Tree[treeEntry]{
+		Root: fsys.root,
+		Child: func(dir treeEntry, name string) (treeEntry, bool, error) {
+			entries, err := fsys.readDir(dir)
+			if err != nil {
+				return treeEntry{}, false, err
+			}
+
+			base := path.Base(name)
+			j := sort.Search(len(entries), func(j int) bool { return entries[j].name >= base })
+			if j == len(entries) || entries[j].name != base {
+				return treeEntry{}, false, nil
+			}
+			return entries[j], true, nil
+		},
+		IsDir: treeEntry.isDir,
+		Link: func(name string, e treeEntry) (string, bool, error) {
+			if !e.isSymlink() {
+				return "", false, nil
+			}
+
+			data, err := fsys.r.readTyped(e.hash, typeBlob)
+			if err != nil {
+				return "", false, err
+			}
+			return linkTarget(name, string(data)), true, nil
+		},
+	}
+}
+
+// info creates the fs.FileInfo for the entry e found at name.
+func (fsys *gitfs) info(name string, e treeEntry) (fs.FileInfo, error) {
+	var size int64
+	if !e.isDir() {
+		data, err := fsys.r.readTyped(e.hash, typeBlob)
+		if err != nil {
+			return nil, err
+		}
+		size = int64(len(data))
+	}
+
+	return &buffile.Info{
+		FileName:    path.Base(name),
+		FileSize:    size,
+		FileMode:    e.fileMode(),
+		FileModTime: fsys.mtime,
+		FileSys:     e.hash,
+	}, nil
+}
+
+// Open opens the named file for reading.
+func (fsys *gitfs) Open(name string) (fs.File, error) {
+	resolved, e, err := fsys.resolve("Open", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.isDir() {
+		entries, err := fsys.ReadDir(resolved)
+		if err != nil {
+			return nil, pathError("Open", name, err)
+		}
+
+		return buffile.NewDir(name, func() (fs.FileInfo, error) { return fsys.info(resolved, e) }, entries), nil
+	}
+
+	data, err := fsys.r.readTyped(e.hash, typeBlob)
+	if err != nil {
+		return nil, pathError("Open", name, err)
+	}
+
+	return buffile.New(name, data, buffile.Options{
+		Stat: func(size int64) (fs.FileInfo, error) { return fsys.info(resolved, e) },
+	}), nil
+}
+
+// ReadFile reads the named file's content.
+func (fsys *gitfs) ReadFile(name string) ([]byte, error) {
+	_, e, err := fsys.resolve("ReadFile", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.isDir() {
+		return nil, pathError("ReadFile", name, buffile.ErrIsDirectory)
+	}
+
+	data, err := fsys.r.readTyped(e.hash, typeBlob)
+	if err != nil {
+		return nil, pathError("ReadFile", name, err)
+	}
+
+	// Blobs are cached and shared; callers may modify the returned slice.
+	return append([]byte(nil), data...), nil
+}
+
+// ReadDir returns the sorted entries of the named directory. Symlinks are
+// reported with fs.ModeSymlink and are not followed.
+func (fsys *gitfs) ReadDir(name string) ([]fs.DirEntry, error) {
+	resolved, e, err := fsys.resolve("ReadDir", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if !e.isDir() {
+		return nil, pathError("ReadDir", name, fs.ErrInvalid)
+	}
+
+	entries, err := fsys.readDir(e)
+	if err != nil {
+		return nil, pathError("ReadDir", name, err)
+	}
+
+	res := make([]fs.DirEntry, len(entries))
+	for i, child := range entries {
+		res[i] = &dirEntry{fsys: fsys, name: path.Join(resolved, child.name), e: child}
+	}
+	return res, nil
+}
+
+// Stat returns a fs.FileInfo describing the named file. Symlinks are
+// followed.
+func (fsys *gitfs) Stat(name string) (fs.FileInfo, error) {
+	return fsys.stat("Stat", name, true)
+}
+
+// Lstat returns a fs.FileInfo describing the named file without following a
+// final symlink.
+func (fsys *gitfs) Lstat(name string) (fs.FileInfo, error) {
+	return fsys.stat("Lstat", name, false)
+}
+
+func (fsys *gitfs) stat(op, name string, followLast bool) (fs.FileInfo, error) {
+	resolved, e, err := fsys.resolve(op, name, followLast)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := fsys.info(resolved, e)
+	if err != nil {
+		return nil, pathError(op, name, err)
+	}
+	return info, nil
+}
+
+// Readlink returns the target of the symlink name relative to the
+// filesystem's root.
+func (fsys *gitfs) Readlink(name string) (string, error) {
+	resolved, e, err := fsys.resolve("Readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+
+	if !e.isSymlink() {
+		return "", pathError("Readlink", name, fs.ErrInvalid)
+	}
+
+	data, err := fsys.r.readTyped(e.hash, typeBlob)
+	if err != nil {
+		return "", pathError("Readlink", name, err)
+	}
+
+	return linkTarget(resolved, string(data)), nil
+}
+
+// dirEntry implements fs.DirEntry and reads a file's size on demand.
+type dirEntry struct {
+	fsys *gitfs
+	name string
+	e    treeEntry
+}
+
+func (d *dirEntry) Name() string               { return d.e.name }
+func (d *dirEntry) IsDir() bool                { return d.e.isDir() }
+func (d *dirEntry) Type() fs.FileMode          { return d.e.fileMode().Type() }
+func (d *dirEntry) Info() (fs.FileInfo, error) { return d.fsys.info(d.name, d.e) }
+
+var _ FS = &gitfs{}
@@ -0,0 +1,158 @@
+// Package gitfs provides read-only access to the trees committed to a local
+// git repository.
+//
+// A Repository is opened from a fs.FS (e.g. an osfs.DirFS) containing either
+// a work tree with a .git directory or a bare repository. Objects are read
+// from loose object files and packfiles (index version 2) using only the
+// standard library's zlib implementation; deltified objects are resolved.
+// Only repositories using SHA-1 object names are supported; alternates,
+// commit graphs and other optional data structures are ignored.
+//
+// Repository.FS returns the tree of a commit as a fs.FS. Git does not store
+// permissions or modification times. Files report a mode of 0644 or 0755
+// depending on their executable bit, directories report 0755 and symlinks
+// fs.ModeSymlink|0777. Submodules are reported as empty directories. All
+// entries report the commit's committer time as their modification time.
+//
+// Symlink targets are stored relative to the link's directory. Readlink
+// returns them relative to the tree's root, just like the other fsx
+// implementations. Symlinks pointing outside of the tree cannot be followed.
+package gitfs
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"sync"
+
+	"github.com/halimath/fsx"
+)
+
+// Hash is the SHA-1 name of a git object.
+type Hash [20]byte
+
+// String returns the hexadecimal representation of h.
+func (h Hash) String() string { return hex.EncodeToString(h[:]) }
+
+// ParseHash parses the hexadecimal representation of a hash.
+func ParseHash(s string) (Hash, error) {
+	var h Hash
+	if len(s) != 2*len(h) {
+		return h, fmt.Errorf("gitfs: invalid hash: %q", s)
+	}
+	if _, err := hex.Decode(h[:], []byte(s)); err != nil {
+		return h, fmt.Errorf("gitfs: invalid hash: %q", s)
+	}
+	return h, nil
+}
+
+var (
+	// ErrCorrupt is returned when reading malformed objects, packfiles or
+	// references.
+	ErrCorrupt = errors.New("gitfs: corrupt repository")
+
+	// ErrAmbiguous is returned when resolving an abbreviated object name
+	// matching multiple objects.
+	ErrAmbiguous = errors.New("gitfs: ambiguous object name")
+)
+
+// Repository provides access to the objects and references of a git
+// repository. A Repository is safe for concurrent use.
+type Repository struct {
+	fsys  fs.FS
+	packs []*pack
+
+	mu    sync.Mutex
+	trees map[Hash][]treeEntry
+	cache map[cacheKey]object
+}
+
+// Open opens the repository found in fsys. fsys may either contain a .git
+// directory or be the git directory itself (i.e. a bare repository).
+func Open(fsys fs.FS) (*Repository, error) {
+	if !isGitDir(fsys) {
+		sub, err := fs.Sub(fsys, ".git")
+		if err != nil || !isGitDir(sub) {
+			return nil, fmt.Errorf("gitfs: not a git repository: %w", fs.ErrNotExist)
+		}
+		fsys = sub
+	}
+
+	if err := checkConfig(fsys); err != nil {
+		return nil, err
+	}
+
+	r := &Repository{
+		fsys:  fsys,
+		trees: make(map[Hash][]treeEntry),
+		cache: make(map[cacheKey]object),
+	}
+
+	entries, err := fs.ReadDir(fsys, "objects/pack")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		base, ok := strings.CutSuffix(e.Name(), ".idx")
+		if !ok || e.IsDir() {
+			continue
+		}
+
+		p, err := openPack(fsys, "objects/pack/"+base)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.packs = append(r.packs, p)
+	}
+
+	return r, nil
+}
+
+// isGitDir reports whether fsys looks like a git directory.
+func isGitDir(fsys fs.FS) bool {
+	if info, err := fs.Stat(fsys, "HEAD"); err != nil || info.IsDir() {
+		return false
+	}
+	info, err := fs.Stat(fsys, "objects")
+	return err == nil && info.IsDir()
+}
+
+// checkConfig rejects repositories using an unsupported object format.
+func checkConfig(fsys fs.FS) error {
+	data, err := fs.ReadFile(fsys, "config")
+	if err != nil {
+		// The config is optional for reading objects.
+		return nil
+	}
+
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		key, value, ok := strings.Cut(strings.ToLower(string(line)), "=")
+		if !ok || strings.TrimSpace(key) != "objectformat" {
+			continue
+		}
+		if f := strings.TrimSpace(value); f != "sha1" {
+			return fmt.Errorf("gitfs: %w: object format %s", fsx.ErrNotSupported, f)
+		}
+	}
+
+	return nil
+}
+
+// Close closes all packfiles.
+func (r *Repository) Close() error {
+	var errs []error
+	for _, p := range r.packs {
+		if err := p.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+var _ io.Closer = &Repository{}
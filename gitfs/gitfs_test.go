@@ -0,0 +1,579 @@
+package gitfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	. "github.com/halimath/fixture"
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/memfs"
+)
+
+// hashObject computes the name of an object.
+func hashObject(typ objectType, data []byte) Hash {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s %d\x00", typ, len(data))
+	h.Write(data)
+
+	var res Hash
+	copy(res[:], h.Sum(nil))
+	return res
+}
+
+func compress(data []byte) []byte {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+// repoBuilder writes objects and references to a bare repository.
+type repoBuilder struct {
+	fs fsx.FS
+}
+
+func (b *repoBuilder) write(name string, data []byte) error {
+	if err := fsx.MkdirAll(b.fs, path.Dir(name), 0755); err != nil {
+		return err
+	}
+	return fsx.WriteFile(b.fs, name, data, 0644)
+}
+
+// loose writes a loose object and returns its name.
+func (b *repoBuilder) loose(typ objectType, data []byte) (Hash, error) {
+	h := hashObject(typ, data)
+	s := h.String()
+
+	var content bytes.Buffer
+	fmt.Fprintf(&content, "%s %d\x00", typ, len(data))
+	content.Write(data)
+
+	return h, b.write("objects/"+s[:2]+"/"+s[2:], compress(content.Bytes()))
+}
+
+type testEntry struct {
+	mode uint32
+	name string
+	hash Hash
+}
+
+func encodeTree(entries ...testEntry) []byte {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		fmt.Fprintf(&buf, "%o %s\x00", e.mode, e.name)
+		buf.Write(e.hash[:])
+	}
+	return buf.Bytes()
+}
+
+func encodeCommit(tree Hash, when int64, msg string, parents ...Hash) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "tree %s\n", tree)
+	for _, p := range parents {
+		fmt.Fprintf(&buf, "parent %s\n", p)
+	}
+	fmt.Fprintf(&buf, "author Jane Doe <jane@example.com> %d +0200\n", when)
+	fmt.Fprintf(&buf, "committer John Doe <john@example.com> %d -0130\n", when+60)
+	fmt.Fprintf(&buf, "\n%s", msg)
+	return buf.Bytes()
+}
+
+// packObject describes an entry of a packfile. For delta entries data holds
+// the delta instructions and hash the name of the resolved object.
+type packObject struct {
+	typ  objectType
+	data []byte
+	hash Hash
+	base int
+	ref  Hash
+}
+
+// makeDelta creates delta instructions copying the first n bytes from base
+// and inserting the remainder of target.
+func makeDelta(base, target []byte, n int) []byte {
+	delta := binary.AppendUvarint(nil, uint64(len(base)))
+	delta = binary.AppendUvarint(delta, uint64(len(target)))
+
+	// Copy with offset 0 and a two byte size.
+	delta = append(delta, 0x80|0x10|0x20, byte(n), byte(n>>8))
+
+	for rest := target[n:]; len(rest) > 0; {
+		c := len(rest)
+		if c > 127 {
+			c = 127
+		}
+		delta = append(delta, byte(c))
+		delta = append(delta, rest[:c]...)
+		rest = rest[c:]
+	}
+
+	return delta
+}
+
+// writePack writes a packfile and its version 2 index.
+func (b *repoBuilder) writePack(name string, objects []packObject) error {
+	var pack bytes.Buffer
+	pack.WriteString("PACK")
+	binary.Write(&pack, binary.BigEndian, uint32(2))
+	binary.Write(&pack, binary.BigEndian, uint32(len(objects)))
+
+	offsets := make([]int, len(objects))
+	for i, o := range objects {
+		offsets[i] = pack.Len()
+
+		size := len(o.data)
+		c := byte(o.typ)<<4 | byte(size&0x0f)
+		size >>= 4
+		for size > 0 {
+			pack.WriteByte(c | 0x80)
+			c = byte(size & 0x7f)
+			size >>= 7
+		}
+		pack.WriteByte(c)
+
+		switch o.typ {
+		case typeOfsDelta:
+			rel := offsets[i] - offsets[o.base]
+			enc := []byte{byte(rel & 0x7f)}
+			for rel >>= 7; rel > 0; rel >>= 7 {
+				rel--
+				enc = append([]byte{0x80 | byte(rel&0x7f)}, enc...)
+			}
+			pack.Write(enc)
+		case typeRefDelta:
+			pack.Write(o.ref[:])
+		}
+
+		pack.Write(compress(o.data))
+	}
+	sum := sha1.Sum(pack.Bytes())
+	pack.Write(sum[:])
+
+	order := make([]int, len(objects))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return bytes.Compare(objects[order[i]].hash[:], objects[order[j]].hash[:]) < 0
+	})
+
+	var idx bytes.Buffer
+	idx.Write(idxMagic)
+	binary.Write(&idx, binary.BigEndian, uint32(2))
+	for i := 0; i < 256; i++ {
+		n := 0
+		for _, o := range objects {
+			if int(o.hash[0]) <= i {
+				n++
+			}
+		}
+		binary.Write(&idx, binary.BigEndian, uint32(n))
+	}
+	for _, i := range order {
+		idx.Write(objects[i].hash[:])
+	}
+	idx.Write(make([]byte, 4*len(objects)))
+	for _, i := range order {
+		binary.Write(&idx, binary.BigEndian, uint32(offsets[i]))
+	}
+	idx.Write(sum[:])
+	idxSum := sha1.Sum(idx.Bytes())
+	idx.Write(idxSum[:])
+
+	if err := b.write("objects/pack/"+name+".pack", pack.Bytes()); err != nil {
+		return err
+	}
+	return b.write("objects/pack/"+name+".idx", idx.Bytes())
+}
+
+var (
+	readmeV1 = []byte("# Example\n\nThis is an example repository used for testing.\n")
+	readmeV2 = []byte("# Example\n\nThis is an example repository used for testing.\nIt has been updated.\n")
+	guide    = []byte("# Example\n\nRead the guide.\n")
+)
+
+const (
+	time1 = 1700000000
+	time2 = 1700086400
+)
+
+type repoFixture struct {
+	fs      fsx.LinkFS
+	repo    *Repository
+	commit1 Hash
+	commit2 Hash
+	tag     Hash
+}
+
+// BeforeEach creates a bare repository containing two commits. The blobs of
+// README.md and docs/guide.txt are stored in a packfile using deltas; all
+// other objects are stored as loose objects.
+func (f *repoFixture) BeforeEach(t *testing.T) error {
+	f.fs = memfs.New()
+	b := &repoBuilder{fs: f.fs}
+
+	readme1 := hashObject(typeBlob, readmeV1)
+	readme2 := hashObject(typeBlob, readmeV2)
+	guideHash := hashObject(typeBlob, guide)
+
+	err := b.writePack("pack-test", []packObject{
+		{typ: typeBlob, data: readmeV1, hash: readme1},
+		{typ: typeOfsDelta, data: makeDelta(readmeV1, readmeV2, len(readmeV1)), hash: readme2, base: 0},
+		{typ: typeRefDelta, data: makeDelta(readmeV1, guide, 11), hash: guideHash, ref: readme1},
+	})
+	if err != nil {
+		return err
+	}
+
+	script, err := b.loose(typeBlob, []byte("#!/bin/sh\necho hello\n"))
+	if err != nil {
+		return err
+	}
+	link, err := b.loose(typeBlob, []byte("README.md"))
+	if err != nil {
+		return err
+	}
+	nestedLink, err := b.loose(typeBlob, []byte("../README.md"))
+	if err != nil {
+		return err
+	}
+	outsideLink, err := b.loose(typeBlob, []byte("../../etc/passwd"))
+	if err != nil {
+		return err
+	}
+
+	bin, err := b.loose(typeTree, encodeTree(testEntry{modeExec, "run.sh", script}))
+	if err != nil {
+		return err
+	}
+	docs1, err := b.loose(typeTree, encodeTree(testEntry{modeFile, "guide.txt", guideHash}))
+	if err != nil {
+		return err
+	}
+	docs2, err := b.loose(typeTree, encodeTree(
+		testEntry{modeFile, "guide.txt", guideHash},
+		testEntry{modeSymlink, "outside", outsideLink},
+		testEntry{modeSymlink, "readme", nestedLink},
+	))
+	if err != nil {
+		return err
+	}
+
+	submodule, _ := ParseHash("0123456789abcdef0123456789abcdef01234567")
+
+	tree1, err := b.loose(typeTree, encodeTree(
+		testEntry{modeFile, "README.md", readme1},
+		testEntry{modeDir, "bin", bin},
+		testEntry{modeDir, "docs", docs1},
+		testEntry{modeSymlink, "link", link},
+		testEntry{modeGitlink, "vendor", submodule},
+	))
+	if err != nil {
+		return err
+	}
+	tree2, err := b.loose(typeTree, encodeTree(
+		testEntry{modeFile, "README.md", readme2},
+		testEntry{modeDir, "bin", bin},
+		testEntry{modeDir, "docs", docs2},
+		testEntry{modeSymlink, "link", link},
+	))
+	if err != nil {
+		return err
+	}
+
+	if f.commit1, err = b.loose(typeCommit, encodeCommit(tree1, time1, "Initial commit\n")); err != nil {
+		return err
+	}
+	if f.commit2, err = b.loose(typeCommit, encodeCommit(tree2, time2, "Update readme\n", f.commit1)); err != nil {
+		return err
+	}
+
+	tag := fmt.Sprintf("object %s\ntype commit\ntag v1\ntagger Jane Doe <jane@example.com> %d +0000\n\nVersion 1\n", f.commit1, time1)
+	if f.tag, err = b.loose(typeTag, []byte(tag)); err != nil {
+		return err
+	}
+
+	if err := b.write("HEAD", []byte("ref: refs/heads/main\n")); err != nil {
+		return err
+	}
+	if err := b.write("config", []byte("[core]\n\trepositoryformatversion = 0\n\tbare = true\n")); err != nil {
+		return err
+	}
+	if err := b.write("refs/heads/main", []byte(f.commit2.String()+"\n")); err != nil {
+		return err
+	}
+
+	packed := fmt.Sprintf("# pack-refs with: peeled fully-peeled sorted\n%s refs/heads/initial\n%s refs/tags/v1\n^%s\n", f.commit1, f.tag, f.commit1)
+	if err := b.write("packed-refs", []byte(packed)); err != nil {
+		return err
+	}
+
+	f.repo, err = Open(f.fs)
+	return err
+}
+
+func (f *repoFixture) AfterEach(t *testing.T) error {
+	return f.repo.Close()
+}
+
+func TestOpen(t *testing.T) {
+	With(t, new(repoFixture)).
+		Run("notARepository", func(t *testing.T, f *repoFixture) {
+			_, err := Open(memfs.New())
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+		}).
+		Run("workTree", func(t *testing.T, f *repoFixture) {
+			work := memfs.New()
+			err := fs.WalkDir(f.fs, ".", func(p string, d fs.DirEntry, err error) error {
+				if err != nil || d.IsDir() {
+					return err
+				}
+				data, err := fs.ReadFile(f.fs, p)
+				if err != nil {
+					return err
+				}
+				return (&repoBuilder{fs: work}).write(path.Join(".git", p), data)
+			})
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			r, err := Open(work)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			defer r.Close()
+
+			h, err := r.Resolve("HEAD")
+			expect.That(t, is.NoError(err), is.EqualTo(h, f.commit2))
+		}).
+		Run("unsupportedObjectFormat", func(t *testing.T, f *repoFixture) {
+			expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(f.fs, "config", []byte("[extensions]\n\tobjectFormat = sha256\n"), 0644))))
+
+			_, err := Open(f.fs)
+			expect.That(t, is.Error(err, fsx.ErrNotSupported))
+		}).
+		Run("corruptPack", func(t *testing.T, f *repoFixture) {
+			// The packfile is kept open by the repository.
+			expect.That(t, expect.FailNow(is.NoError(f.repo.Close())))
+			f.repo = new(Repository)
+
+			expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(f.fs, "objects/pack/pack-test.pack", []byte("garbage"), 0644))))
+
+			_, err := Open(f.fs)
+			expect.That(t, is.Error(err, ErrCorrupt))
+		})
+}
+
+func TestRepository_Resolve(t *testing.T) {
+	With(t, new(repoFixture)).
+		Run("references", func(t *testing.T, f *repoFixture) {
+			for rev, want := range map[string]Hash{
+				"HEAD":                 f.commit2,
+				"@":                    f.commit2,
+				"main":                 f.commit2,
+				"heads/main":           f.commit2,
+				"refs/heads/main":      f.commit2,
+				"initial":              f.commit1,
+				"v1":                   f.commit1,
+				"HEAD~1":               f.commit1,
+				"HEAD^":                f.commit1,
+				"main^1":               f.commit1,
+				"HEAD^0":               f.commit2,
+				"v1~0":                 f.commit1,
+				f.commit2.String():     f.commit2,
+				f.commit1.String()[:8]: f.commit1,
+			} {
+				h, err := f.repo.Resolve(rev)
+				expect.That(t, is.NoError(err), is.EqualTo(h, want))
+			}
+		}).
+		Run("notFound", func(t *testing.T, f *repoFixture) {
+			for _, rev := range []string{"unknown", "HEAD~2", "HEAD^2", "deadbeef"} {
+				_, err := f.repo.Resolve(rev)
+				expect.That(t, is.Error(err, fs.ErrNotExist))
+			}
+		}).
+		Run("invalid", func(t *testing.T, f *repoFixture) {
+			_, err := f.repo.Resolve("HEAD~x")
+			expect.That(t, is.Error(err, fs.ErrInvalid))
+
+			_, err = f.repo.Resolve(hashObject(typeBlob, readmeV1).String())
+			expect.That(t, is.Error(err, fs.ErrInvalid))
+		}).
+		Run("commit", func(t *testing.T, f *repoFixture) {
+			c, err := f.repo.Commit("main")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			expect.That(t,
+				is.EqualTo(c.Hash, f.commit2),
+				is.DeepEqualTo(c.Parents, []Hash{f.commit1}),
+				is.EqualTo(c.Message, "Update readme\n"),
+				is.EqualTo(c.Author.Name, "Jane Doe"),
+				is.EqualTo(c.Author.Email, "jane@example.com"),
+				is.EqualTo(c.Committer.Name, "John Doe"),
+				is.EqualTo(c.Committer.When.Unix(), int64(time2+60)),
+			)
+
+			_, offset := c.Committer.When.Zone()
+			expect.That(t, is.EqualTo(offset, -90*60))
+		})
+}
+
+func TestRepository_FS(t *testing.T) {
+	With(t, new(repoFixture)).
+		Run("fstest", func(t *testing.T, f *repoFixture) {
+			fsys, err := f.repo.FS("v1")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			expect.That(t, is.NoError(fstest.TestFS(fsys, "README.md", "bin/run.sh", "docs/guide.txt", "link", "vendor")))
+		}).
+		Run("readFile", func(t *testing.T, f *repoFixture) {
+			fsys1, err := f.repo.FS("v1")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			fsys2, err := f.repo.FS("HEAD")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			data, err := fsys1.ReadFile("README.md")
+			expect.That(t, is.NoError(err), is.DeepEqualTo(data, readmeV1))
+
+			data, err = fsys2.ReadFile("README.md")
+			expect.That(t, is.NoError(err), is.DeepEqualTo(data, readmeV2))
+
+			data, err = fsys2.ReadFile("docs/guide.txt")
+			expect.That(t, is.NoError(err), is.DeepEqualTo(data, guide))
+
+			_, err = fsys2.ReadFile("docs")
+			expect.That(t, is.EqualTo(err != nil, true))
+
+			_, err = fsys2.ReadFile("missing.txt")
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+		}).
+		Run("open", func(t *testing.T, f *repoFixture) {
+			fsys, err := f.repo.FS("HEAD")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			file, err := fsys.Open("bin/run.sh")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			defer file.Close()
+
+			data, err := io.ReadAll(file)
+			expect.That(t, is.NoError(err), is.EqualTo(string(data), "#!/bin/sh\necho hello\n"))
+
+			_, err = file.(io.Writer).Write([]byte("x"))
+			expect.That(t, is.EqualTo(err != nil, true))
+		}).
+		Run("modes", func(t *testing.T, f *repoFixture) {
+			fsys, err := f.repo.FS("v1")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			for name, want := range map[string]fs.FileMode{
+				".":          fs.ModeDir | 0755,
+				"README.md":  0644,
+				"bin":        fs.ModeDir | 0755,
+				"bin/run.sh": 0755,
+				"link":       0644,
+				"vendor":     fs.ModeDir | 0755,
+			} {
+				info, err := fsys.Stat(name)
+				expect.That(t, is.NoError(err), is.EqualTo(info.Mode(), want))
+			}
+
+			info, err := fsys.Lstat("link")
+			expect.That(t, is.NoError(err), is.EqualTo(info.Mode(), fs.ModeSymlink|0777), is.EqualTo(info.Size(), int64(9)))
+		}).
+		Run("fileInfo", func(t *testing.T, f *repoFixture) {
+			fsys, err := f.repo.FS("HEAD")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			info, err := fsys.Stat("README.md")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			expect.That(t,
+				is.EqualTo(info.Name(), "README.md"),
+				is.EqualTo(info.Size(), int64(len(readmeV2))),
+				is.EqualTo(info.ModTime().Equal(time.Unix(time2+60, 0)), true),
+				is.EqualTo(info.Sys(), any(hashObject(typeBlob, readmeV2))),
+			)
+		}).
+		Run("readDir", func(t *testing.T, f *repoFixture) {
+			fsys, err := f.repo.FS("HEAD")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			entries, err := fsys.ReadDir("docs")
+			expect.That(t, expect.FailNow(is.NoError(err)), is.SliceOfLen(entries, 3))
+
+			expect.That(t,
+				is.EqualTo(entries[0].Name(), "guide.txt"),
+				is.EqualTo(entries[1].Name(), "outside"),
+				is.EqualTo(entries[1].Type(), fs.ModeSymlink),
+				is.EqualTo(entries[2].Name(), "readme"),
+			)
+
+			_, err = fsys.ReadDir("README.md")
+			expect.That(t, is.Error(err, fs.ErrInvalid))
+		}).
+		Run("submodule", func(t *testing.T, f *repoFixture) {
+			fsys, err := f.repo.FS("v1")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			entries, err := fsys.ReadDir("vendor")
+			expect.That(t, is.NoError(err), is.SliceOfLen(entries, 0))
+		}).
+		Run("symlinks", func(t *testing.T, f *repoFixture) {
+			fsys, err := f.repo.FS("HEAD")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			target, err := fsys.Readlink("link")
+			expect.That(t, is.NoError(err), is.EqualTo(target, "README.md"))
+
+			target, err = fsys.Readlink("docs/readme")
+			expect.That(t, is.NoError(err), is.EqualTo(target, "README.md"))
+
+			data, err := fsys.ReadFile("docs/readme")
+			expect.That(t, is.NoError(err), is.DeepEqualTo(data, readmeV2))
+
+			_, err = fsys.Readlink("README.md")
+			expect.That(t, is.Error(err, fs.ErrInvalid))
+
+			_, err = fsys.Stat("docs/outside")
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+
+			info, err := fsys.Lstat("docs/outside")
+			expect.That(t, is.NoError(err), is.EqualTo(info.Mode().Type(), fs.ModeSymlink))
+		}).
+		Run("invalidPath", func(t *testing.T, f *repoFixture) {
+			fsys, err := f.repo.FS("HEAD")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			_, err = fsys.Open("/README.md")
+			expect.That(t, is.Error(err, fs.ErrInvalid))
+
+			_, err = fsys.Open("README.md/x")
+			expect.That(t, is.EqualTo(errors.Is(err, fs.ErrInvalid) || errors.Is(err, fs.ErrNotExist), true))
+		}).
+		Run("sync", func(t *testing.T, f *repoFixture) {
+			fsys, err := f.repo.FS("v1")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			dst := memfs.New()
+			_, err = fsx.Sync(dst, fsys, nil)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			data, err := fs.ReadFile(dst, "bin/run.sh")
+			expect.That(t, is.NoError(err), is.EqualTo(string(data), "#!/bin/sh\necho hello\n"))
+
+			info, err := fs.Stat(dst, "bin/run.sh")
+			expect.That(t, is.NoError(err), is.EqualTo(info.Mode(), fs.FileMode(0755)))
+		})
+}
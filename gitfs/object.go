@@ -0,0 +1,196 @@
+package gitfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+	"strings"
+)
+
+// objectType defines the type of an object as encoded in packfiles.
+type objectType int
+
+const (
+	typeCommit   objectType = 1
+	typeTree     objectType = 2
+	typeBlob     objectType = 3
+	typeTag      objectType = 4
+	typeOfsDelta objectType = 6
+	typeRefDelta objectType = 7
+)
+
+func (t objectType) String() string {
+	switch t {
+	case typeCommit:
+		return "commit"
+	case typeTree:
+		return "tree"
+	case typeBlob:
+		return "blob"
+	case typeTag:
+		return "tag"
+	default:
+		return "unknown"
+	}
+}
+
+func parseObjectType(s string) (objectType, bool) {
+	switch s {
+	case "commit":
+		return typeCommit, true
+	case "tree":
+		return typeTree, true
+	case "blob":
+		return typeBlob, true
+	case "tag":
+		return typeTag, true
+	default:
+		return 0, false
+	}
+}
+
+// object is a decoded object.
+type object struct {
+	typ  objectType
+	data []byte
+}
+
+// cacheKey identifies an object inside a packfile.
+type cacheKey struct {
+	p   *pack
+	off int64
+}
+
+// maxCacheSize limits the number of objects kept in the delta base cache.
+const maxCacheSize = 256
+
+func (r *Repository) cached(k cacheKey) (object, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	o, ok := r.cache[k]
+	return o, ok
+}
+
+func (r *Repository) addCached(k cacheKey, o object) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.cache) >= maxCacheSize {
+		r.cache = make(map[cacheKey]object)
+	}
+	r.cache[k] = o
+}
+
+// readObject reads the object h from a packfile or a loose object file.
+func (r *Repository) readObject(h Hash) (object, error) {
+	for _, p := range r.packs {
+		if off, ok := p.find(h); ok {
+			return r.readPacked(p, off)
+		}
+	}
+
+	o, err := r.readLoose(h)
+	if errors.Is(err, fs.ErrNotExist) {
+		return object{}, fmt.Errorf("gitfs: object %s: %w", h, fs.ErrNotExist)
+	}
+	return o, err
+}
+
+// readTyped reads the object h and checks its type.
+func (r *Repository) readTyped(h Hash, typ objectType) ([]byte, error) {
+	o, err := r.readObject(h)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.typ != typ {
+		return nil, fmt.Errorf("%w: object %s is a %s, not a %s", ErrCorrupt, h, o.typ, typ)
+	}
+
+	return o.data, nil
+}
+
+// readLoose reads a zlib compressed object file.
+func (r *Repository) readLoose(h Hash) (object, error) {
+	s := h.String()
+
+	f, err := r.fsys.Open("objects/" + s[:2] + "/" + s[2:])
+	if err != nil {
+		return object{}, err
+	}
+	defer f.Close()
+
+	zr, err := zlib.NewReader(f)
+	if err != nil {
+		return object{}, fmt.Errorf("%w: object %s: %v", ErrCorrupt, h, err)
+	}
+	defer zr.Close()
+
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return object{}, fmt.Errorf("%w: object %s: %v", ErrCorrupt, h, err)
+	}
+
+	header, content, ok := bytes.Cut(data, []byte{0})
+	if !ok {
+		return object{}, fmt.Errorf("%w: object %s: missing header", ErrCorrupt, h)
+	}
+
+	typeName, sizeStr, _ := strings.Cut(string(header), " ")
+	typ, ok := parseObjectType(typeName)
+	size, err := strconv.Atoi(sizeStr)
+	if !ok || err != nil || size != len(content) {
+		return object{}, fmt.Errorf("%w: object %s: invalid header", ErrCorrupt, h)
+	}
+
+	return object{typ: typ, data: content}, nil
+}
+
+// expand resolves an abbreviated hexadecimal object name.
+func (r *Repository) expand(prefix string) (Hash, error) {
+	prefix = strings.ToLower(prefix)
+	if len(prefix) < 4 || len(prefix) > 40 {
+		return Hash{}, fs.ErrNotExist
+	}
+	if _, err := hex.DecodeString(prefix[:len(prefix)&^1]); err != nil {
+		return Hash{}, fs.ErrNotExist
+	}
+
+	found := make(map[Hash]struct{})
+
+	for _, p := range r.packs {
+		for _, h := range p.withPrefix(prefix) {
+			found[h] = struct{}{}
+		}
+	}
+
+	entries, err := fs.ReadDir(r.fsys, "objects/"+prefix[:2])
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return Hash{}, err
+	}
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), prefix[2:]) {
+			continue
+		}
+		if h, err := ParseHash(prefix[:2] + e.Name()); err == nil {
+			found[h] = struct{}{}
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return Hash{}, fs.ErrNotExist
+	case 1:
+		for h := range found {
+			return h, nil
+		}
+	}
+
+	return Hash{}, fmt.Errorf("%w: %s", ErrAmbiguous, prefix)
+}
@@ -0,0 +1,332 @@
+package gitfs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"sort"
+	"strings"
+)
+
+var idxMagic = []byte{0xff, 't', 'O', 'c'}
+
+// pack provides access to a packfile using its index.
+type pack struct {
+	name    string
+	r       io.ReaderAt
+	closer  io.Closer
+	fanout  [256]uint32
+	hashes  []byte
+	offsets []byte
+	large   []byte
+}
+
+// openPack opens the index base.idx and the packfile base.pack.
+func openPack(fsys fs.FS, base string) (*pack, error) {
+	idx, err := fs.ReadFile(fsys, base+".idx")
+	if err != nil {
+		return nil, err
+	}
+
+	p := &pack{name: base + ".pack"}
+	if err := p.parseIndex(idx); err != nil {
+		return nil, err
+	}
+
+	f, err := fsys.Open(p.name)
+	if err != nil {
+		return nil, err
+	}
+
+	if ra, ok := f.(io.ReaderAt); ok {
+		p.r, p.closer = ra, f
+	} else {
+		// Fall back to reading the whole packfile for filesystems not
+		// supporting random access.
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		p.r = bytes.NewReader(data)
+	}
+
+	var header [12]byte
+	if _, err := p.r.ReadAt(header[:], 0); err != nil || string(header[:4]) != "PACK" {
+		p.Close()
+		return nil, fmt.Errorf("%w: %s: invalid header", ErrCorrupt, p.name)
+	}
+
+	if v := binary.BigEndian.Uint32(header[4:]); v != 2 && v != 3 {
+		p.Close()
+		return nil, fmt.Errorf("%w: %s: unsupported version %d", ErrCorrupt, p.name, v)
+	}
+
+	return p, nil
+}
+
+// parseIndex parses a version 2 pack index.
+func (p *pack) parseIndex(idx []byte) error {
+	if len(idx) < 8+256*4 || !bytes.Equal(idx[:4], idxMagic) || binary.BigEndian.Uint32(idx[4:]) != 2 {
+		return fmt.Errorf("%w: %s: unsupported index", ErrCorrupt, p.name)
+	}
+
+	for i := range p.fanout {
+		p.fanout[i] = binary.BigEndian.Uint32(idx[8+i*4:])
+	}
+
+	n := int(p.fanout[255])
+	pos := 8 + 256*4
+
+	// Names, CRC32 values and offsets are followed by large offsets and two
+	// checksums.
+	if len(idx) < pos+n*(20+4+4)+2*20 {
+		return fmt.Errorf("%w: %s: truncated index", ErrCorrupt, p.name)
+	}
+
+	p.hashes = idx[pos : pos+n*20]
+	pos += n * 20
+	pos += n * 4
+	p.offsets = idx[pos : pos+n*4]
+	pos += n * 4
+	p.large = idx[pos : len(idx)-2*20]
+
+	return nil
+}
+
+func (p *pack) Close() error {
+	if p.closer != nil {
+		return p.closer.Close()
+	}
+	return nil
+}
+
+func (p *pack) hash(i int) Hash {
+	var h Hash
+	copy(h[:], p.hashes[i*20:])
+	return h
+}
+
+// bucket returns the range of indexes of names starting with b.
+func (p *pack) bucket(b byte) (int, int) {
+	lo := 0
+	if b > 0 {
+		lo = int(p.fanout[b-1])
+	}
+	return lo, int(p.fanout[b])
+}
+
+// find returns the offset of the object h.
+func (p *pack) find(h Hash) (int64, bool) {
+	lo, hi := p.bucket(h[0])
+
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(p.hashes[(lo+i)*20:(lo+i+1)*20], h[:]) >= 0
+	})
+	if i >= hi || !bytes.Equal(p.hashes[i*20:(i+1)*20], h[:]) {
+		return 0, false
+	}
+
+	off := binary.BigEndian.Uint32(p.offsets[i*4:])
+	if off&0x80000000 == 0 {
+		return int64(off), true
+	}
+
+	li := int(off & 0x7fffffff)
+	if len(p.large) < (li+1)*8 {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(p.large[li*8:])), true
+}
+
+// withPrefix returns all names starting with the hexadecimal prefix which
+// contains at least two characters.
+func (p *pack) withPrefix(prefix string) []Hash {
+	b, err := hex.DecodeString(prefix[:2])
+	if err != nil {
+		return nil
+	}
+
+	var res []Hash
+	lo, hi := p.bucket(b[0])
+	for i := lo; i < hi; i++ {
+		h := p.hash(i)
+		if strings.HasPrefix(h.String(), prefix) {
+			res = append(res, h)
+		}
+	}
+	return res
+}
+
+// readPacked reads the object stored at off in p and resolves deltas.
+func (r *Repository) readPacked(p *pack, off int64) (object, error) {
+	key := cacheKey{p: p, off: off}
+	if o, ok := r.cached(key); ok {
+		return o, nil
+	}
+
+	br := bufio.NewReader(io.NewSectionReader(p.r, off, math.MaxInt64-off))
+
+	c, err := br.ReadByte()
+	if err != nil {
+		return object{}, p.corrupt(off, err)
+	}
+
+	typ := objectType((c >> 4) & 7)
+	size := uint64(c & 0x0f)
+	for shift := 4; c&0x80 != 0; shift += 7 {
+		if c, err = br.ReadByte(); err != nil {
+			return object{}, p.corrupt(off, err)
+		}
+		size |= uint64(c&0x7f) << shift
+	}
+
+	var base object
+
+	switch typ {
+	case typeCommit, typeTree, typeBlob, typeTag:
+
+	case typeOfsDelta:
+		c, err := br.ReadByte()
+		if err != nil {
+			return object{}, p.corrupt(off, err)
+		}
+		rel := int64(c & 0x7f)
+		for c&0x80 != 0 {
+			if c, err = br.ReadByte(); err != nil {
+				return object{}, p.corrupt(off, err)
+			}
+			rel = (rel+1)<<7 | int64(c&0x7f)
+		}
+
+		if rel <= 0 || rel > off {
+			return object{}, p.corrupt(off, fmt.Errorf("invalid base offset %d", rel))
+		}
+
+		base, err = r.readPacked(p, off-rel)
+		if err != nil {
+			return object{}, err
+		}
+
+	case typeRefDelta:
+		var h Hash
+		if _, err := io.ReadFull(br, h[:]); err != nil {
+			return object{}, p.corrupt(off, err)
+		}
+
+		base, err = r.readObject(h)
+		if err != nil {
+			return object{}, err
+		}
+
+	default:
+		return object{}, p.corrupt(off, fmt.Errorf("invalid object type %d", typ))
+	}
+
+	zr, err := zlib.NewReader(br)
+	if err != nil {
+		return object{}, p.corrupt(off, err)
+	}
+	defer zr.Close()
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(zr, data); err != nil {
+		return object{}, p.corrupt(off, err)
+	}
+
+	o := object{typ: typ, data: data}
+	if typ == typeOfsDelta || typ == typeRefDelta {
+		data, err := applyDelta(base.data, data)
+		if err != nil {
+			return object{}, p.corrupt(off, err)
+		}
+		o = object{typ: base.typ, data: data}
+	}
+
+	r.addCached(key, o)
+
+	return o, nil
+}
+
+func (p *pack) corrupt(off int64, err error) error {
+	return fmt.Errorf("%w: %s at offset %d: %v", ErrCorrupt, p.name, off, err)
+}
+
+// applyDelta applies the delta instructions in delta to base.
+func applyDelta(base, delta []byte) ([]byte, error) {
+	srcSize, n := binary.Uvarint(delta)
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid delta header")
+	}
+	delta = delta[n:]
+
+	dstSize, n := binary.Uvarint(delta)
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid delta header")
+	}
+	delta = delta[n:]
+
+	if srcSize != uint64(len(base)) {
+		return nil, fmt.Errorf("delta base size mismatch")
+	}
+
+	out := make([]byte, 0, dstSize)
+
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+
+		switch {
+		case op&0x80 != 0:
+			var offset, size uint64
+			for i := 0; i < 4; i++ {
+				if op&(1<<i) != 0 {
+					if len(delta) == 0 {
+						return nil, fmt.Errorf("truncated delta")
+					}
+					offset |= uint64(delta[0]) << (8 * i)
+					delta = delta[1:]
+				}
+			}
+			for i := 0; i < 3; i++ {
+				if op&(0x10<<i) != 0 {
+					if len(delta) == 0 {
+						return nil, fmt.Errorf("truncated delta")
+					}
+					size |= uint64(delta[0]) << (8 * i)
+					delta = delta[1:]
+				}
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+
+			if offset+size > uint64(len(base)) {
+				return nil, fmt.Errorf("delta copy out of range")
+			}
+			out = append(out, base[offset:offset+size]...)
+
+		case op != 0:
+			if int(op) > len(delta) {
+				return nil, fmt.Errorf("truncated delta")
+			}
+			out = append(out, delta[:op]...)
+			delta = delta[op:]
+
+		default:
+			return nil, fmt.Errorf("invalid delta instruction")
+		}
+	}
+
+	if uint64(len(out)) != dstSize {
+		return nil, fmt.Errorf("delta result size mismatch")
+	}
+
+	return out, nil
+}
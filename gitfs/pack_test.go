@@ -0,0 +1,48 @@
+package gitfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+)
+
+func TestApplyDelta(t *testing.T) {
+	base := bytes.Repeat([]byte("0123456789abcdef"), 0x1000+1)
+
+	// delta creates delta instructions with a header for base and a result of
+	// size bytes.
+	delta := func(size int, ops ...byte) []byte {
+		d := binary.AppendUvarint(nil, uint64(len(base)))
+		d = binary.AppendUvarint(d, uint64(size))
+		return append(d, ops...)
+	}
+
+	t.Run("copyAndInsert", func(t *testing.T) {
+		// Copy 4 bytes from offset 10, insert "xy".
+		got, err := applyDelta(base, delta(6, 0x80|0x01|0x10, 10, 4, 2, 'x', 'y'))
+		expect.That(t, is.NoError(err), is.EqualTo(string(got), "abcdxy"))
+	})
+
+	t.Run("copyDefaultSize", func(t *testing.T) {
+		// A copy without size bytes copies 0x10000 bytes.
+		got, err := applyDelta(base, delta(0x10000, 0x80))
+		expect.That(t, is.NoError(err), is.DeepEqualTo(got, base[:0x10000]))
+	})
+
+	for name, d := range map[string][]byte{
+		"baseSizeMismatch":   {1, 1, 1, 'x'},
+		"copyOutOfRange":     delta(1, 0x80|0x0f|0x10, 0xff, 0xff, 0xff, 0xff, 1),
+		"truncatedInsert":    delta(3, 3, 'x'),
+		"invalidInstruction": delta(0, 0),
+		"resultSizeMismatch": delta(5, 1, 'x'),
+	} {
+		d := d
+		t.Run(name, func(t *testing.T) {
+			_, err := applyDelta(base, d)
+			expect.That(t, is.EqualTo(err != nil, true))
+		})
+	}
+}
@@ -0,0 +1,339 @@
+package gitfs
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRefDepth limits the number of symbolic references followed when
+// resolving a single reference.
+const maxRefDepth = 10
+
+// Signature identifies the author or committer of a commit.
+type Signature struct {
+	Name  string
+	Email string
+	When  time.Time
+}
+
+// Commit contains the decoded header fields and the message of a commit.
+type Commit struct {
+	Hash      Hash
+	Tree      Hash
+	Parents   []Hash
+	Author    Signature
+	Committer Signature
+	Message   string
+}
+
+// Resolve resolves the revision rev to the name of a commit. rev may be a
+// full or abbreviated object name or the name of a reference such as HEAD,
+// main, v1.0 or refs/remotes/origin/main, optionally followed by any number
+// of ~N and ^N suffixes selecting ancestors. Annotated tags are peeled to the
+// commit they point to.
+func (r *Repository) Resolve(rev string) (Hash, error) {
+	base, suffix := rev, ""
+	if i := strings.IndexAny(rev, "~^"); i >= 0 {
+		base, suffix = rev[:i], rev[i:]
+	}
+
+	h, err := r.resolveBase(base)
+	if err != nil {
+		return Hash{}, fmt.Errorf("gitfs: resolve %s: %w", rev, err)
+	}
+
+	if h, err = r.peel(h); err != nil {
+		return Hash{}, fmt.Errorf("gitfs: resolve %s: %w", rev, err)
+	}
+
+	for suffix != "" {
+		op := suffix[0]
+		suffix = suffix[1:]
+
+		n := 1
+		digits := suffix
+		if i := strings.IndexAny(suffix, "~^"); i >= 0 {
+			digits = suffix[:i]
+		}
+		if digits != "" {
+			if n, err = strconv.Atoi(digits); err != nil || n < 0 {
+				return Hash{}, fmt.Errorf("gitfs: resolve %s: invalid suffix: %w", rev, fs.ErrInvalid)
+			}
+			suffix = suffix[len(digits):]
+		}
+
+		if op == '^' {
+			if n == 0 {
+				continue
+			}
+			h, err = r.parent(h, n-1)
+		} else {
+			for i := 0; i < n && err == nil; i++ {
+				h, err = r.parent(h, 0)
+			}
+		}
+		if err != nil {
+			return Hash{}, fmt.Errorf("gitfs: resolve %s: %w", rev, err)
+		}
+	}
+
+	return h, nil
+}
+
+// Commit resolves rev and returns the decoded commit.
+func (r *Repository) Commit(rev string) (*Commit, error) {
+	h, err := r.Resolve(rev)
+	if err != nil {
+		return nil, err
+	}
+	return r.readCommit(h)
+}
+
+// resolveBase resolves a revision without suffixes to an object name.
+func (r *Repository) resolveBase(rev string) (Hash, error) {
+	if rev == "" || rev == "@" {
+		rev = "HEAD"
+	}
+
+	if h, err := ParseHash(rev); err == nil {
+		return h, nil
+	}
+
+	candidates := []string{
+		rev,
+		"refs/" + rev,
+		"refs/tags/" + rev,
+		"refs/heads/" + rev,
+		"refs/remotes/" + rev,
+		"refs/remotes/" + rev + "/HEAD",
+	}
+
+	for _, name := range candidates {
+		h, err := r.readRef(name)
+		if err == nil {
+			return h, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return Hash{}, err
+		}
+	}
+
+	return r.expand(rev)
+}
+
+// readRef reads the reference name following symbolic references.
+func (r *Repository) readRef(name string) (Hash, error) {
+	for depth := 0; depth < maxRefDepth; depth++ {
+		if !fs.ValidPath(name) || name == "." {
+			return Hash{}, fs.ErrNotExist
+		}
+
+		if info, err := fs.Stat(r.fsys, name); errors.Is(err, fs.ErrNotExist) || (err == nil && info.IsDir()) {
+			return r.readPackedRef(name)
+		}
+
+		data, err := fs.ReadFile(r.fsys, name)
+		if err != nil {
+			return Hash{}, err
+		}
+
+		s := strings.TrimSpace(string(data))
+		if target, ok := strings.CutPrefix(s, "ref: "); ok {
+			name = strings.TrimSpace(target)
+			continue
+		}
+
+		h, err := ParseHash(s)
+		if err != nil {
+			return Hash{}, fmt.Errorf("%w: reference %s", ErrCorrupt, name)
+		}
+		return h, nil
+	}
+
+	return Hash{}, fmt.Errorf("%w: reference %s: too many levels of symbolic references", ErrCorrupt, name)
+}
+
+// readPackedRef looks up name in the packed-refs file.
+func (r *Repository) readPackedRef(name string) (Hash, error) {
+	data, err := fs.ReadFile(r.fsys, "packed-refs")
+	if err != nil {
+		return Hash{}, err
+	}
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := s.Text()
+		if line == "" || line[0] == '#' || line[0] == '^' {
+			continue
+		}
+
+		hash, ref, ok := strings.Cut(line, " ")
+		if !ok || ref != name {
+			continue
+		}
+
+		h, err := ParseHash(hash)
+		if err != nil {
+			return Hash{}, fmt.Errorf("%w: packed reference %s", ErrCorrupt, name)
+		}
+		return h, nil
+	}
+
+	return Hash{}, fs.ErrNotExist
+}
+
+// peel follows annotated tags until reaching a commit.
+func (r *Repository) peel(h Hash) (Hash, error) {
+	for depth := 0; depth < maxRefDepth; depth++ {
+		o, err := r.readObject(h)
+		if err != nil {
+			return Hash{}, err
+		}
+
+		switch o.typ {
+		case typeCommit:
+			return h, nil
+
+		case typeTag:
+			target, ok := header(o.data, "object")
+			if !ok {
+				return Hash{}, fmt.Errorf("%w: tag %s: missing object", ErrCorrupt, h)
+			}
+			next, err := ParseHash(target)
+			if err != nil {
+				return Hash{}, fmt.Errorf("%w: tag %s: invalid object", ErrCorrupt, h)
+			}
+			h = next
+
+		default:
+			return Hash{}, fmt.Errorf("object %s is a %s, not a commit: %w", h, o.typ, fs.ErrInvalid)
+		}
+	}
+
+	return Hash{}, fmt.Errorf("%w: too many levels of tags", ErrCorrupt)
+}
+
+// parent returns the n-th (zero based) parent of the commit h.
+func (r *Repository) parent(h Hash, n int) (Hash, error) {
+	c, err := r.readCommit(h)
+	if err != nil {
+		return Hash{}, err
+	}
+
+	if n >= len(c.Parents) {
+		return Hash{}, fmt.Errorf("commit %s has no parent %d: %w", h, n+1, fs.ErrNotExist)
+	}
+
+	return c.Parents[n], nil
+}
+
+// header returns the value of the first header line key in data.
+func header(data []byte, key string) (string, bool) {
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			data = nil
+		}
+
+		if len(line) == 0 {
+			break
+		}
+
+		if k, v, ok := strings.Cut(string(line), " "); ok && k == key {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// readCommit reads and decodes the commit h.
+func (r *Repository) readCommit(h Hash) (*Commit, error) {
+	data, err := r.readTyped(h, typeCommit)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Commit{Hash: h}
+
+	headers, message, _ := strings.Cut(string(data), "\n\n")
+	c.Message = message
+
+	haveTree := false
+	for _, line := range strings.Split(headers, "\n") {
+		key, value, _ := strings.Cut(line, " ")
+
+		switch key {
+		case "tree":
+			c.Tree, err = ParseHash(value)
+			haveTree = true
+		case "parent":
+			var p Hash
+			p, err = ParseHash(value)
+			c.Parents = append(c.Parents, p)
+		case "author":
+			c.Author, err = parseSignature(value)
+		case "committer":
+			c.Committer, err = parseSignature(value)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%w: commit %s: %v", ErrCorrupt, h, err)
+		}
+	}
+
+	if !haveTree {
+		return nil, fmt.Errorf("%w: commit %s: missing tree", ErrCorrupt, h)
+	}
+
+	return c, nil
+}
+
+// parseSignature parses a signature of the form
+// "Name <email> seconds +hhmm".
+func parseSignature(s string) (Signature, error) {
+	var sig Signature
+
+	start := strings.IndexByte(s, '<')
+	end := strings.LastIndexByte(s, '>')
+	if start < 0 || end < start {
+		return sig, fmt.Errorf("invalid signature %q", s)
+	}
+
+	sig.Name = strings.TrimSpace(s[:start])
+	sig.Email = s[start+1 : end]
+
+	fields := strings.Fields(s[end+1:])
+	if len(fields) != 2 {
+		return sig, fmt.Errorf("invalid signature %q", s)
+	}
+
+	sec, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return sig, fmt.Errorf("invalid signature %q", s)
+	}
+
+	tz := fields[1]
+	offset, err := strconv.Atoi(tz)
+	if err != nil || len(tz) != 5 {
+		return sig, fmt.Errorf("invalid signature %q", s)
+	}
+	if offset < 0 {
+		offset = -offset
+	}
+	seconds := (offset/100)*3600 + (offset%100)*60
+	if tz[0] == '-' {
+		seconds = -seconds
+	}
+
+	sig.When = time.Unix(sec, 0).In(time.FixedZone(tz, seconds))
+
+	return sig, nil
+}
@@ -5,4 +5,5 @@ go 1.20
 require (
 	github.com/halimath/expect v0.5.1
 	github.com/halimath/fixture v0.1.0
+	golang.org/x/text v0.22.0
 )
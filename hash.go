@@ -0,0 +1,235 @@
+package fsx
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// HashFS defines an interface for filesystems that provide (and possibly
+// cache) digests of a file's content. HashTree uses this interface - if
+// provided - instead of reading a file's content.
+type HashFS interface {
+	fs.FS
+
+	// FileHash returns the digest of the content of the regular file name
+	// computed with a hash.Hash created by newHash. algorithm uniquely names
+	// the hash algorithm created by newHash; implementations may use it as a
+	// key to cache digests. Implementations must invalidate cached digests
+	// when a file's content changes.
+	FileHash(name string, algorithm string, newHash func() hash.Hash) ([]byte, error)
+}
+
+// HashTreeOptions customize the behavior of HashTree. A nil *HashTreeOptions
+// is equivalent to the zero value.
+type HashTreeOptions struct {
+	// Filter selects the entries to include in the tree's digest.
+	Filter
+
+	// Algorithm names the hash algorithm created by the factory passed to
+	// HashTree, e.g. "sha256". If set and the filesystem satisfies HashFS,
+	// content digests are obtained from the filesystem which may cache them.
+	// Leave empty to always compute content digests.
+	Algorithm string
+}
+
+// TreeHash is a node of a Merkle tree computed by HashTree.
+//
+// The digest of a regular file covers its permission and the digest of its
+// content. The digest of a symlink covers its target. The digest of a
+// directory covers its permission as well as the names and digests of all of
+// its children in lexical order. A node's own name is only covered by its
+// parent's digest; two identical trees thus produce the same digest
+// regardless of where they are located.
+type TreeHash struct {
+	// Path holds the node's path relative to the root passed to HashTree. The
+	// root node's path is ".".
+	Path string
+	// Mode holds the node's type and permission bits.
+	Mode fs.FileMode
+	// Target holds the link target if the node is a symlink.
+	Target string
+	// ContentDigest holds the digest of a regular file's content.
+	ContentDigest []byte
+	// Digest holds the node's Merkle digest.
+	Digest []byte
+	// Children holds the child nodes of a directory sorted by name.
+	Children []*TreeHash
+}
+
+// Name returns the node's base name.
+func (t *TreeHash) Name() string { return path.Base(t.Path) }
+
+// String returns the hex encoded digest of t.
+func (t *TreeHash) String() string { return hex.EncodeToString(t.Digest) }
+
+// Find returns the node for the path p relative to t or nil if no such node
+// exists.
+func (t *TreeHash) Find(p string) *TreeHash {
+	if p == "." || p == "" {
+		return t
+	}
+
+	first, rest, _ := strings.Cut(p, string(Separator))
+	for _, c := range t.Children {
+		if c.Name() == first {
+			if rest == "" {
+				return c
+			}
+			return c.Find(rest)
+		}
+	}
+
+	return nil
+}
+
+// Walk calls fn for t and all of its descendants in depth-first, lexical
+// order.
+func (t *TreeHash) Walk(fn func(*TreeHash)) {
+	fn(t)
+	for _, c := range t.Children {
+		c.Walk(fn)
+	}
+}
+
+// HashTree computes a Merkle tree of digests for the tree rooted at root in
+// fsys using hashes created by newHash. The result can be used as a stable
+// fingerprint of a directory, e.g. for build caching. Symlinks are never
+// followed; they are detected if fsys provides a Readlink method.
+func HashTree(fsys fs.FS, root string, newHash func() hash.Hash, opts *HashTreeOptions) (*TreeHash, error) {
+	if opts == nil {
+		opts = &HashTreeOptions{}
+	}
+
+	if root == "" {
+		root = "."
+	}
+
+	info, err := fs.Stat(fsys, root)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return nil, &fs.PathError{
+			Op:   "HashTree",
+			Path: root,
+			Err:  fs.ErrInvalid,
+		}
+	}
+
+	rootNode := &TreeHash{
+		Path: ".",
+		Mode: info.Mode(),
+	}
+
+	dirs := map[string]*TreeHash{".": rootNode}
+
+	h := &treeHasher{
+		fsys:    fsys,
+		newHash: newHash,
+		opts:    opts,
+	}
+
+	err = walkTree(fsys, root, &opts.Filter, func(e treeEntry) error {
+		n := &TreeHash{
+			Path:   e.path,
+			Mode:   e.mode(),
+			Target: e.target,
+		}
+
+		parent := dirs[path.Dir(e.path)]
+		parent.Children = append(parent.Children, n)
+
+		if n.Mode.IsDir() {
+			dirs[e.path] = n
+			return nil
+		}
+
+		if n.Mode.IsRegular() {
+			digest, err := h.contentDigest(joinPath(root, e.path))
+			if err != nil {
+				return err
+			}
+			n.ContentDigest = digest
+		}
+
+		h.digest(n)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	h.digestDir(rootNode)
+
+	return rootNode, nil
+}
+
+type treeHasher struct {
+	fsys    fs.FS
+	newHash func() hash.Hash
+	opts    *HashTreeOptions
+}
+
+// contentDigest returns the digest of the file p's content.
+func (h *treeHasher) contentDigest(p string) ([]byte, error) {
+	if hfs, ok := h.fsys.(HashFS); ok && h.opts.Algorithm != "" {
+		return hfs.FileHash(p, h.opts.Algorithm, h.newHash)
+	}
+
+	f, err := h.fsys.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hh := h.newHash()
+	if _, err := io.Copy(hh, f); err != nil {
+		return nil, err
+	}
+
+	return hh.Sum(nil), nil
+}
+
+// digestDir computes the digests of d and all directories below d. The
+// digests of non-directory children must already be computed.
+func (h *treeHasher) digestDir(d *TreeHash) {
+	for _, c := range d.Children {
+		if c.Mode.IsDir() {
+			h.digestDir(c)
+		}
+	}
+	h.digest(d)
+}
+
+// digest computes n's Merkle digest. The digests of all of n's children must
+// already be computed.
+func (h *treeHasher) digest(n *TreeHash) {
+	hh := h.newHash()
+
+	switch {
+	case n.Mode&fs.ModeSymlink != 0:
+		fmt.Fprintf(hh, "symlink\x00%s\x00", n.Target)
+
+	case n.Mode.IsDir():
+		fmt.Fprintf(hh, "dir %04o\x00", n.Mode.Perm())
+		for _, c := range n.Children {
+			fmt.Fprintf(hh, "%s\x00", c.Name())
+			hh.Write(c.Digest)
+		}
+
+	case n.Mode.IsRegular():
+		fmt.Fprintf(hh, "file %04o\x00", n.Mode.Perm())
+		hh.Write(n.ContentDigest)
+
+	default:
+		fmt.Fprintf(hh, "other %s\x00", n.Mode)
+	}
+
+	n.Digest = hh.Sum(nil)
+}
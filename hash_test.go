@@ -0,0 +1,94 @@
+package fsx_test
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	"github.com/halimath/fsx"
+)
+
+const hashFixture = `-- src/main.go --
+package main
+-- src/lib/lib.go --
+package lib
+-- src/run.sh mode=0755 --
+#!/bin/sh
+-- src/link -> src/main.go --
+-- copy/main.go --
+package main
+-- copy/lib/lib.go --
+package lib
+-- copy/run.sh mode=0755 --
+#!/bin/sh
+-- copy/link -> src/main.go --
+`
+
+func TestHashTree(t *testing.T) {
+	t.Run("stable", func(t *testing.T) {
+		fsys := mustFromTxtar(t, hashFixture)
+
+		src, err := fsx.HashTree(fsys, "src", sha256.New, nil)
+		expect.That(t, expect.FailNow(is.NoError(err)))
+
+		cp, err := fsx.HashTree(fsys, "copy", sha256.New, nil)
+		expect.That(t, expect.FailNow(is.NoError(err)))
+
+		expect.That(t,
+			is.EqualTo(src.String(), cp.String()),
+			is.SliceOfLen(src.Children, 4),
+			is.EqualTo(src.Find("lib/lib.go").Path, "lib/lib.go"),
+			is.EqualTo(src.Find("lib/lib.go").String(), cp.Find("lib/lib.go").String()),
+			is.EqualTo(src.Find("missing") == nil, true),
+		)
+	})
+
+	modifications := map[string]func(fsys fsx.LinkFS) error{
+		"content": func(fsys fsx.LinkFS) error {
+			return fsx.WriteFile(fsys, "copy/lib/lib.go", []byte("package lib2\n"), 0644)
+		},
+		"mode": func(fsys fsx.LinkFS) error {
+			return fsx.Chmod(fsys, "copy/run.sh", 0700)
+		},
+		"name": func(fsys fsx.LinkFS) error {
+			return fsys.Rename("copy/run.sh", "copy/start.sh")
+		},
+		"symlink": func(fsys fsx.LinkFS) error {
+			if err := fsys.Remove("copy/link"); err != nil {
+				return err
+			}
+			return fsys.Symlink("src/run.sh", "copy/link")
+		},
+	}
+
+	for name, modify := range modifications {
+		t.Run(name, func(t *testing.T) {
+			fsys := mustFromTxtar(t, hashFixture)
+			expect.That(t, expect.FailNow(is.NoError(modify(fsys))))
+
+			src, err := fsx.HashTree(fsys, "src", sha256.New, nil)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			cp, err := fsx.HashTree(fsys, "copy", sha256.New, nil)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			expect.That(t, is.EqualTo(src.String() != cp.String(), true))
+		})
+	}
+
+	t.Run("filter", func(t *testing.T) {
+		fsys := mustFromTxtar(t, hashFixture)
+		expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(fsys, "copy/build.log", []byte("log"), 0644))))
+
+		opts := &fsx.HashTreeOptions{Filter: fsx.Filter{Exclude: []string{"*.log"}}}
+
+		src, err := fsx.HashTree(fsys, "src", sha256.New, opts)
+		expect.That(t, expect.FailNow(is.NoError(err)))
+
+		cp, err := fsx.HashTree(fsys, "copy", sha256.New, opts)
+		expect.That(t, expect.FailNow(is.NoError(err)))
+
+		expect.That(t, is.EqualTo(src.String(), cp.String()))
+	})
+}
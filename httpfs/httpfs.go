@@ -0,0 +1,448 @@
+// Package httpfs provides a http.Handler that serves files from a fs.FS and
+// accepts uploads into a fsx.FS - a write-enabled http.FileServer.
+//
+// GET and HEAD requests are served by http.FileServer and thus support range
+// requests, conditional requests and directory listings. If the filesystem
+// satisfies fsx.FS, the handler also accepts
+//
+//   - PUT requests storing the request body as the file named by the URL
+//     path,
+//   - POST requests with a multipart/form-data body storing every file part
+//     inside the directory named by the URL path using the part's file name,
+//   - DELETE requests removing the named file or empty directory.
+//
+// Uploaded content is written to a temporary file inside the target
+// directory which is renamed to its final name once the upload is complete.
+// This way existing files are replaced atomically and partial uploads never
+// become visible. Missing parent directories are created using fsx.MkdirAll.
+//
+// Like http.FileServer, the handler uses the request's URL path to resolve
+// names. Use http.StripPrefix to mount the handler below a prefix.
+package httpfs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/halimath/fsx"
+)
+
+const (
+	// DefaultMaxFileSize is the default limit for the size of a single
+	// uploaded file.
+	DefaultMaxFileSize = 32 << 20
+
+	// DefaultMaxRequestSize is the default limit for the size of a request
+	// body.
+	DefaultMaxRequestSize = 64 << 20
+)
+
+// Option defines a functional option for New.
+type Option func(*Handler)
+
+// WithMaxFileSize sets the maximum size of a single uploaded file. Larger
+// uploads are rejected with 413 Request Entity Too Large. A negative size
+// disables the limit. Defaults to DefaultMaxFileSize.
+func WithMaxFileSize(size int64) Option {
+	return func(h *Handler) {
+		h.maxFileSize = size
+	}
+}
+
+// WithMaxRequestSize sets the maximum size of a PUT or POST request's body.
+// Larger requests are rejected with 413 Request Entity Too Large. A negative
+// size disables the limit. Defaults to DefaultMaxRequestSize.
+func WithMaxRequestSize(size int64) Option {
+	return func(h *Handler) {
+		h.maxRequestSize = size
+	}
+}
+
+// WithAllowedPaths restricts modifications to names matching one of
+// patterns using path.Match. A name also matches if one of its parent
+// directories matches, e.g. the pattern "uploads" allows modifying any file
+// inside the uploads directory. Modifications of other names are rejected
+// with 403 Forbidden. By default, all names may be modified.
+func WithAllowedPaths(patterns ...string) Option {
+	return func(h *Handler) {
+		h.allowed = append(h.allowed, patterns...)
+	}
+}
+
+// WithFileMode sets the permission of created files. Defaults to 0644.
+func WithFileMode(perm fs.FileMode) Option {
+	return func(h *Handler) {
+		h.fileMode = perm.Perm()
+	}
+}
+
+// WithDirMode sets the permission of created directories. Defaults to 0755.
+func WithDirMode(perm fs.FileMode) Option {
+	return func(h *Handler) {
+		h.dirMode = perm.Perm()
+	}
+}
+
+// Handler serves files from a fs.FS and accepts uploads if the filesystem
+// satisfies fsx.FS.
+type Handler struct {
+	fsys           fs.FS
+	files          http.Handler
+	maxFileSize    int64
+	maxRequestSize int64
+	allowed        []string
+	fileMode       fs.FileMode
+	dirMode        fs.FileMode
+}
+
+// New creates a new Handler serving fsys.
+func New(fsys fs.FS, opts ...Option) *Handler {
+	h := &Handler{
+		fsys:           fsys,
+		files:          http.FileServer(http.FS(fsys)),
+		maxFileSize:    DefaultMaxFileSize,
+		maxRequestSize: DefaultMaxRequestSize,
+		fileMode:       0644,
+		dirMode:        0755,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// ServeHTTP dispatches r to the method's handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		h.files.ServeHTTP(w, r)
+		return
+	}
+
+	wfs, ok := h.fsys.(fsx.FS)
+	if !ok {
+		h.methodNotAllowed(w)
+		return
+	}
+
+	name, ok := h.name(r.URL.Path)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	var status int
+	var err error
+
+	switch r.Method {
+	case http.MethodPut:
+		status, err = h.handlePut(wfs, w, r, name)
+	case http.MethodPost:
+		status, err = h.handlePost(wfs, w, r, name)
+	case http.MethodDelete:
+		status, err = h.handleDelete(wfs, w, r, name)
+	default:
+		h.methodNotAllowed(w)
+		return
+	}
+
+	if err != nil {
+		status = statusCode(err)
+	}
+
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+	}
+}
+
+func (h *Handler) methodNotAllowed(w http.ResponseWriter) {
+	allow := "GET, HEAD"
+	if _, ok := h.fsys.(fsx.FS); ok {
+		allow += ", PUT, POST, DELETE"
+	}
+
+	w.Header().Set("Allow", allow)
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+}
+
+// statusCode returns the HTTP status code used to report err.
+func statusCode(err error) int {
+	var mbe *http.MaxBytesError
+
+	switch {
+	case errors.Is(err, errTooLarge), errors.As(err, &mbe):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return http.StatusForbidden
+	case errors.Is(err, fs.ErrExist), errors.Is(err, fsx.ErrDirNotEmpty):
+		return http.StatusConflict
+	case errors.Is(err, fs.ErrInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, fsx.ErrNotSupported):
+		return http.StatusNotImplemented
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// name converts the request path p into a name.
+func (h *Handler) name(p string) (string, bool) {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		p = "."
+	}
+
+	return p, fs.ValidPath(p)
+}
+
+// allows reports whether name may be modified.
+func (h *Handler) allows(name string) bool {
+	if len(h.allowed) == 0 {
+		return true
+	}
+
+	for n := name; n != "."; n = path.Dir(n) {
+		for _, p := range h.allowed {
+			if ok, _ := path.Match(p, n); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// limitedBody records whether reading a body limited by http.MaxBytesReader
+// exceeded the limit. This is required as errors returned by
+// multipart.Reader do not wrap the underlying error.
+type limitedBody struct {
+	io.ReadCloser
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		b.exceeded = true
+	}
+
+	return n, err
+}
+
+// limitBody applies the request size limit to r's body.
+func (h *Handler) limitBody(w http.ResponseWriter, r *http.Request) *limitedBody {
+	b := &limitedBody{ReadCloser: r.Body}
+	if h.maxRequestSize >= 0 {
+		b.ReadCloser = http.MaxBytesReader(w, r.Body, h.maxRequestSize)
+	}
+	r.Body = b
+	return b
+}
+
+func (h *Handler) handlePut(fsys fsx.FS, w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	if name == "." {
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	if !h.allows(name) {
+		return http.StatusForbidden, nil
+	}
+
+	if h.maxFileSize >= 0 && r.ContentLength > h.maxFileSize {
+		return http.StatusRequestEntityTooLarge, nil
+	}
+
+	info, err := fs.Stat(fsys, name)
+	existed := err == nil
+	if existed && info.IsDir() {
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	if existed && r.Header.Get("If-None-Match") == "*" {
+		return http.StatusPreconditionFailed, nil
+	}
+
+	h.limitBody(w, r)
+
+	if _, err := h.store(fsys, name, r.Body); err != nil {
+		return 0, err
+	}
+
+	if existed {
+		return http.StatusNoContent, nil
+	}
+
+	w.Header().Set("Location", r.URL.EscapedPath())
+	return http.StatusCreated, nil
+}
+
+// Upload describes a file stored from a multipart upload.
+type Upload struct {
+	// Name is the name of the stored file.
+	Name string `json:"name"`
+	// Size is the file's size in bytes.
+	Size int64 `json:"size"`
+}
+
+func (h *Handler) handlePost(fsys fsx.FS, w http.ResponseWriter, r *http.Request, dir string) (int, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		return http.StatusUnsupportedMediaType, nil
+	}
+
+	if info, err := fs.Stat(fsys, dir); err == nil && !info.IsDir() {
+		return http.StatusConflict, nil
+	}
+
+	body := h.limitBody(w, r)
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return http.StatusBadRequest, nil
+	}
+
+	uploads := []Upload{}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if body.exceeded {
+				return http.StatusRequestEntityTooLarge, nil
+			}
+			return http.StatusBadRequest, nil
+		}
+
+		filename := part.FileName()
+		if filename == "" {
+			// Skip form values.
+			part.Close()
+			continue
+		}
+
+		if filename == "." || filename == ".." || !fs.ValidPath(filename) {
+			part.Close()
+			return http.StatusBadRequest, nil
+		}
+
+		name := path.Join(dir, filename)
+		if !h.allows(name) {
+			part.Close()
+			return http.StatusForbidden, nil
+		}
+
+		size, err := h.store(fsys, name, part)
+		part.Close()
+		if err != nil {
+			if body.exceeded {
+				return http.StatusRequestEntityTooLarge, nil
+			}
+			return 0, err
+		}
+
+		uploads = append(uploads, Upload{Name: name, Size: size})
+	}
+
+	if len(uploads) == 0 {
+		return http.StatusBadRequest, nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(uploads)
+
+	return 0, nil
+}
+
+func (h *Handler) handleDelete(fsys fsx.FS, w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	if name == "." {
+		return http.StatusForbidden, nil
+	}
+
+	if !h.allows(name) {
+		return http.StatusForbidden, nil
+	}
+
+	// Check explicitly as not all filesystems report missing files or
+	// non-empty directories from Remove.
+	info, err := fs.Stat(fsys, name)
+	if err != nil {
+		return 0, err
+	}
+
+	if info.IsDir() {
+		entries, err := fs.ReadDir(fsys, name)
+		if err != nil {
+			return 0, err
+		}
+		if len(entries) > 0 {
+			return http.StatusConflict, nil
+		}
+	}
+
+	if err := fsys.Remove(name); err != nil {
+		return 0, err
+	}
+
+	return http.StatusNoContent, nil
+}
+
+// errTooLarge is returned by store if the content exceeds the maximum file
+// size.
+var errTooLarge = errors.New("file too large")
+
+// store writes the content read from r to name. The content is written to a
+// temporary file which replaces name once r has been fully read. Missing
+// parent directories are created.
+func (h *Handler) store(fsys fsx.FS, name string, r io.Reader) (int64, error) {
+	dir := path.Dir(name)
+	if err := fsx.MkdirAll(fsys, dir, h.dirMode); err != nil {
+		return 0, err
+	}
+
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	tmp := path.Join(dir, "."+path.Base(name)+"."+hex.EncodeToString(b[:])+".upload")
+
+	f, err := fsys.OpenFile(tmp, fsx.O_WRONLY|fsx.O_CREATE|fsx.O_EXCL, h.fileMode)
+	if err != nil {
+		return 0, err
+	}
+
+	if h.maxFileSize >= 0 {
+		r = io.LimitReader(r, h.maxFileSize+1)
+	}
+
+	n, err := io.Copy(f, r)
+	if err == nil && h.maxFileSize >= 0 && n > h.maxFileSize {
+		err = errTooLarge
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = fsys.Rename(tmp, name)
+	}
+
+	if err != nil {
+		fsys.Remove(tmp)
+		return 0, err
+	}
+
+	return n, nil
+}
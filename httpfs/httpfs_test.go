@@ -0,0 +1,308 @@
+package httpfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	. "github.com/halimath/fixture"
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/memfs"
+)
+
+type httpfsFixture struct {
+	fs  fsx.LinkFS
+	srv *httptest.Server
+}
+
+func (f *httpfsFixture) BeforeEach(t *testing.T) error {
+	f.fs = memfs.New()
+
+	if err := fsx.MkdirAll(f.fs, "uploads", 0755); err != nil {
+		return err
+	}
+	if err := fsx.WriteFile(f.fs, "uploads/report.txt", []byte("quarterly report"), 0644); err != nil {
+		return err
+	}
+	if err := fsx.WriteFile(f.fs, "static.txt", []byte("static"), 0644); err != nil {
+		return err
+	}
+
+	f.srv = httptest.NewServer(New(f.fs,
+		WithMaxFileSize(32),
+		WithMaxRequestSize(1024),
+		WithAllowedPaths("uploads", "*.tmp"),
+	))
+	return nil
+}
+
+func (f *httpfsFixture) AfterEach(t *testing.T) error {
+	f.srv.Close()
+	return nil
+}
+
+// do sends a request and returns the response's status code, headers and
+// body.
+func (f *httpfsFixture) do(t *testing.T, method, p string, body io.Reader, headers ...string) (int, http.Header, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, f.srv.URL+p, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res.StatusCode, res.Header, string(b)
+}
+
+// entries returns the names of all entries inside dir.
+func (f *httpfsFixture) entries(t *testing.T, dir string) []string {
+	t.Helper()
+
+	entries, err := fs.ReadDir(f.fs, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+// multipartBody creates a multipart/form-data body containing files given as
+// pairs of file name and content.
+func multipartBody(t *testing.T, files ...string) (io.Reader, string) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	if err := mw.WriteField("comment", "some value"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < len(files); i += 2 {
+		w, err := mw.CreateFormFile("file", files[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, files[i+1])
+	}
+
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &buf, mw.FormDataContentType()
+}
+
+func TestHandler(t *testing.T) {
+	With(t, new(httpfsFixture)).
+		Run("get", func(t *testing.T, f *httpfsFixture) {
+			status, h, body := f.do(t, http.MethodGet, "/uploads/report.txt", nil)
+			expect.That(t,
+				is.EqualTo(status, http.StatusOK),
+				is.EqualTo(body, "quarterly report"),
+			)
+
+			status, _, body = f.do(t, http.MethodGet, "/uploads/report.txt", nil, "Range", "bytes=10-")
+			expect.That(t,
+				is.EqualTo(status, http.StatusPartialContent),
+				is.EqualTo(body, "report"),
+			)
+
+			status, _, _ = f.do(t, http.MethodGet, "/uploads/report.txt", nil, "If-Modified-Since", h.Get("Last-Modified"))
+			expect.That(t, is.EqualTo(status, http.StatusNotModified))
+
+			status, _, _ = f.do(t, http.MethodGet, "/missing", nil)
+			expect.That(t, is.EqualTo(status, http.StatusNotFound))
+		}).
+		Run("put", func(t *testing.T, f *httpfsFixture) {
+			status, h, _ := f.do(t, http.MethodPut, "/uploads/2023/q4/summary.txt", strings.NewReader("summary"))
+			expect.That(t,
+				is.EqualTo(status, http.StatusCreated),
+				is.EqualTo(h.Get("Location"), "/uploads/2023/q4/summary.txt"),
+			)
+
+			content, err := fs.ReadFile(f.fs, "uploads/2023/q4/summary.txt")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "summary"))
+
+			status, _, _ = f.do(t, http.MethodPut, "/uploads/report.txt", strings.NewReader("updated report"))
+			expect.That(t, is.EqualTo(status, http.StatusNoContent))
+
+			content, err = fs.ReadFile(f.fs, "uploads/report.txt")
+			expect.That(t,
+				is.NoError(err),
+				is.EqualTo(string(content), "updated report"),
+				is.DeepEqualTo(f.entries(t, "uploads"), []string{"2023", "report.txt"}),
+			)
+
+			status, _, _ = f.do(t, http.MethodPut, "/uploads/report.txt", strings.NewReader("other"), "If-None-Match", "*")
+			expect.That(t, is.EqualTo(status, http.StatusPreconditionFailed))
+
+			status, _, _ = f.do(t, http.MethodPut, "/uploads", strings.NewReader("other"))
+			expect.That(t, is.EqualTo(status, http.StatusMethodNotAllowed))
+
+			status, _, _ = f.do(t, http.MethodPut, "/notes.tmp", strings.NewReader("notes"))
+			expect.That(t, is.EqualTo(status, http.StatusCreated))
+		}).
+		Run("putTooLarge", func(t *testing.T, f *httpfsFixture) {
+			status, _, _ := f.do(t, http.MethodPut, "/uploads/report.txt", strings.NewReader(strings.Repeat("x", 33)))
+			expect.That(t, is.EqualTo(status, http.StatusRequestEntityTooLarge))
+
+			// Without a known length, the limit is enforced while reading.
+			status, _, _ = f.do(t, http.MethodPut, "/uploads/report.txt", io.MultiReader(strings.NewReader(strings.Repeat("x", 33))))
+			expect.That(t, is.EqualTo(status, http.StatusRequestEntityTooLarge))
+
+			content, err := fs.ReadFile(f.fs, "uploads/report.txt")
+			expect.That(t,
+				is.NoError(err),
+				is.EqualTo(string(content), "quarterly report"),
+				is.DeepEqualTo(f.entries(t, "uploads"), []string{"report.txt"}),
+			)
+		}).
+		Run("notAllowed", func(t *testing.T, f *httpfsFixture) {
+			status, _, _ := f.do(t, http.MethodPut, "/static.txt", strings.NewReader("changed"))
+			expect.That(t, is.EqualTo(status, http.StatusForbidden))
+
+			status, _, _ = f.do(t, http.MethodDelete, "/static.txt", nil)
+			expect.That(t, is.EqualTo(status, http.StatusForbidden))
+
+			body, contentType := multipartBody(t, "static.txt", "changed")
+			status, _, _ = f.do(t, http.MethodPost, "/", body, "Content-Type", contentType)
+			expect.That(t, is.EqualTo(status, http.StatusForbidden))
+
+			content, err := fs.ReadFile(f.fs, "static.txt")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "static"))
+		}).
+		Run("post", func(t *testing.T, f *httpfsFixture) {
+			body, contentType := multipartBody(t, "a.txt", "first", "b.txt", "second")
+			status, h, resp := f.do(t, http.MethodPost, "/uploads/batch", body, "Content-Type", contentType)
+			expect.That(t,
+				is.EqualTo(status, http.StatusCreated),
+				is.EqualTo(h.Get("Content-Type"), "application/json"),
+			)
+
+			var uploads []Upload
+			expect.That(t,
+				is.NoError(json.Unmarshal([]byte(resp), &uploads)),
+				is.DeepEqualTo(uploads, []Upload{
+					{Name: "uploads/batch/a.txt", Size: 5},
+					{Name: "uploads/batch/b.txt", Size: 6},
+				}),
+				is.DeepEqualTo(f.entries(t, "uploads/batch"), []string{"a.txt", "b.txt"}),
+			)
+
+			content, err := fs.ReadFile(f.fs, "uploads/batch/b.txt")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "second"))
+
+			body, contentType = multipartBody(t, "large.txt", strings.Repeat("x", 33))
+			status, _, _ = f.do(t, http.MethodPost, "/uploads", body, "Content-Type", contentType)
+			expect.That(t, is.EqualTo(status, http.StatusRequestEntityTooLarge))
+
+			body, contentType = multipartBody(t)
+			status, _, _ = f.do(t, http.MethodPost, "/uploads", body, "Content-Type", contentType)
+			expect.That(t, is.EqualTo(status, http.StatusBadRequest))
+
+			status, _, _ = f.do(t, http.MethodPost, "/uploads", strings.NewReader("data"), "Content-Type", "text/plain")
+			expect.That(t, is.EqualTo(status, http.StatusUnsupportedMediaType))
+
+			expect.That(t, is.DeepEqualTo(f.entries(t, "uploads"), []string{"batch", "report.txt"}))
+		}).
+		Run("postTooLarge", func(t *testing.T, f *httpfsFixture) {
+			files := make([]string, 0, 80)
+			for i := 0; i < 40; i++ {
+				files = append(files, "file.txt", strings.Repeat("x", 30))
+			}
+
+			body, contentType := multipartBody(t, files...)
+			status, _, _ := f.do(t, http.MethodPost, "/uploads", body, "Content-Type", contentType)
+			expect.That(t, is.EqualTo(status, http.StatusRequestEntityTooLarge))
+		}).
+		Run("delete", func(t *testing.T, f *httpfsFixture) {
+			status, _, _ := f.do(t, http.MethodDelete, "/uploads", nil)
+			expect.That(t, is.EqualTo(status, http.StatusConflict))
+
+			status, _, _ = f.do(t, http.MethodDelete, "/uploads/report.txt", nil)
+			expect.That(t, is.EqualTo(status, http.StatusNoContent))
+
+			status, _, _ = f.do(t, http.MethodDelete, "/uploads/report.txt", nil)
+			expect.That(t, is.EqualTo(status, http.StatusNotFound))
+
+			status, _, _ = f.do(t, http.MethodDelete, "/uploads", nil)
+			expect.That(t, is.EqualTo(status, http.StatusNoContent))
+		}).
+		Run("methodNotAllowed", func(t *testing.T, f *httpfsFixture) {
+			status, h, _ := f.do(t, http.MethodPatch, "/uploads/report.txt", nil)
+			expect.That(t,
+				is.EqualTo(status, http.StatusMethodNotAllowed),
+				is.EqualTo(h.Get("Allow"), "GET, HEAD, PUT, POST, DELETE"),
+			)
+		})
+}
+
+func TestHandler_readOnly(t *testing.T) {
+	srv := httptest.NewServer(New(fstest.MapFS{
+		"index.txt": &fstest.MapFile{Data: []byte("read only")},
+	}))
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/index.txt")
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+
+	expect.That(t,
+		is.EqualTo(res.StatusCode, http.StatusOK),
+		is.EqualTo(string(body), "read only"),
+	)
+
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+"/index.txt", strings.NewReader("changed"))
+	res, err = http.DefaultClient.Do(req)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	res.Body.Close()
+
+	expect.That(t,
+		is.EqualTo(res.StatusCode, http.StatusMethodNotAllowed),
+		is.EqualTo(res.Header.Get("Allow"), "GET, HEAD"),
+	)
+}
+
+func TestHandler_allows(t *testing.T) {
+	h := New(memfs.New(), WithAllowedPaths("uploads", "*.tmp", "data/*/in"))
+
+	expect.That(t,
+		is.EqualTo(h.allows("uploads"), true),
+		is.EqualTo(h.allows("uploads/a/b.txt"), true),
+		is.EqualTo(h.allows("notes.tmp"), true),
+		is.EqualTo(h.allows("data/x/in/file"), true),
+		is.EqualTo(h.allows("data/x/out/file"), false),
+		is.EqualTo(h.allows("uploads.txt"), false),
+		is.EqualTo(New(memfs.New()).allows("any/file"), true),
+	)
+}
@@ -0,0 +1,294 @@
+// Package buffile provides an implementation of fsx.File that operates on an
+// in-memory buffer. It is used by filesystem implementations that cannot
+// modify their backing store in place (e.g. archives or remote stores) and
+// instead stage a file's content in memory and commit it when the file is
+// closed.
+package buffile
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/halimath/fsx"
+)
+
+// Options define the callbacks and flags used by a File.
+type Options struct {
+	// Flag contains the flags passed to OpenFile.
+	Flag int
+
+	// Stat is called to create the file's fs.FileInfo. size contains the
+	// current size of the buffer.
+	Stat func(size int64) (fs.FileInfo, error)
+
+	// Commit is called from Close with the buffer's content if the file has
+	// been opened for writing and the content has been modified, truncated
+	// or the file has been created. If Commit is nil, writing is not
+	// permitted.
+	Commit func(data []byte) error
+
+	// Chmod is called from File.Chmod. If nil, Chmod returns an error
+	// wrapping fsx.ErrNotSupported.
+	Chmod func(mode fs.FileMode) error
+
+	// Chown is called from File.Chown. If nil, Chown is a no-op.
+	Chown func(uid, gid int) error
+
+	// Dirty marks the content as modified even if no write happens, e.g.
+	// for newly created files.
+	Dirty bool
+}
+
+// File implements fsx.File on an in-memory buffer.
+type File struct {
+	name                       string
+	opts                       Options
+	buf                        []byte
+	cursor                     int64
+	readable, writable, append bool
+	dirty, closed              bool
+}
+
+// New creates a new File named name operating on data. If the file is
+// writable, data is copied before being modified. If opts.Flag contains
+// fsx.O_TRUNC, the file starts empty.
+func New(name string, data []byte, opts Options) *File {
+	f := &File{
+		name:  name,
+		opts:  opts,
+		buf:   data,
+		dirty: opts.Dirty,
+	}
+
+	switch {
+	case opts.Flag&fsx.O_WRONLY != 0:
+		f.writable = true
+	case opts.Flag&fsx.O_RDWR != 0:
+		f.readable = true
+		f.writable = true
+	default:
+		f.readable = true
+	}
+
+	if f.writable {
+		f.append = opts.Flag&fsx.O_APPEND != 0
+
+		if opts.Flag&fsx.O_TRUNC != 0 {
+			f.buf = nil
+			f.dirty = true
+		} else {
+			f.buf = append([]byte(nil), data...)
+		}
+	}
+
+	return f
+}
+
+// Bytes returns the file's current content. The returned slice must not be
+// modified.
+func (f *File) Bytes() []byte { return f.buf }
+
+func (f *File) pathError(op string, err error) error {
+	return &fs.PathError{
+		Op:   op,
+		Path: f.name,
+		Err:  err,
+	}
+}
+
+// Stat returns the file's info as created by the Stat callback.
+func (f *File) Stat() (fs.FileInfo, error) {
+	if f.closed {
+		return nil, f.pathError("Stat", fs.ErrClosed)
+	}
+	return f.opts.Stat(int64(len(f.buf)))
+}
+
+// Read reads up to len(p) bytes from the current offset.
+func (f *File) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, f.pathError("Read", fs.ErrClosed)
+	}
+
+	if !f.readable {
+		return 0, f.pathError("Read", fs.ErrPermission)
+	}
+
+	if f.cursor >= int64(len(f.buf)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.buf[f.cursor:])
+	f.cursor += int64(n)
+
+	return n, nil
+}
+
+// ReadAt reads len(p) bytes starting at off. It implements io.ReaderAt.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, f.pathError("ReadAt", fs.ErrClosed)
+	}
+
+	if !f.readable {
+		return 0, f.pathError("ReadAt", fs.ErrPermission)
+	}
+
+	if off < 0 {
+		return 0, f.pathError("ReadAt", fs.ErrInvalid)
+	}
+
+	if off >= int64(len(f.buf)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// Write writes p at the current offset or at the end of the file if it has
+// been opened with fsx.O_APPEND.
+func (f *File) Write(p []byte) (int, error) {
+	if f.append {
+		f.cursor = int64(len(f.buf))
+	}
+
+	n, err := f.WriteAt(p, f.cursor)
+	f.cursor += int64(n)
+
+	return n, err
+}
+
+// WriteAt writes p starting at off growing the buffer as needed. It
+// implements io.WriterAt.
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, f.pathError("Write", fs.ErrClosed)
+	}
+
+	if !f.writable || f.opts.Commit == nil {
+		return 0, f.pathError("Write", fs.ErrPermission)
+	}
+
+	if off < 0 {
+		return 0, f.pathError("Write", fs.ErrInvalid)
+	}
+
+	end := off + int64(len(p))
+	if end > int64(len(f.buf)) {
+		if end > int64(cap(f.buf)) {
+			grown := make([]byte, end, 2*end)
+			copy(grown, f.buf)
+			f.buf = grown
+		} else {
+			f.buf = f.buf[:end]
+		}
+	}
+
+	copy(f.buf[off:], p)
+	f.dirty = true
+
+	return len(p), nil
+}
+
+// Truncate changes the size of the file to size.
+func (f *File) Truncate(size int64) error {
+	if f.closed {
+		return f.pathError("Truncate", fs.ErrClosed)
+	}
+
+	if !f.writable || f.opts.Commit == nil {
+		return f.pathError("Truncate", fs.ErrPermission)
+	}
+
+	if size < 0 {
+		return f.pathError("Truncate", fs.ErrInvalid)
+	}
+
+	if size <= int64(len(f.buf)) {
+		f.buf = f.buf[:size]
+	} else {
+		f.buf = append(f.buf, make([]byte, size-int64(len(f.buf)))...)
+	}
+	f.dirty = true
+
+	return nil
+}
+
+// Seek sets the offset for the next Read or Write.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, f.pathError("Seek", fs.ErrClosed)
+	}
+
+	var pos int64
+	switch whence {
+	case fsx.SeekWhenceRelativeOrigin:
+		pos = offset
+	case fsx.SeekWhenceRelativeCurrentOffset:
+		pos = f.cursor + offset
+	case fsx.SeekWhenceRelativeEnd:
+		pos = int64(len(f.buf)) + offset
+	default:
+		return 0, f.pathError("Seek", fmt.Errorf("%w: %d", fsx.ErrInvalidWhence, whence))
+	}
+
+	if pos < 0 {
+		return 0, f.pathError("Seek", fs.ErrInvalid)
+	}
+
+	f.cursor = pos
+	return pos, nil
+}
+
+// Chmod changes the file's mode using the Chmod callback.
+func (f *File) Chmod(mode fs.FileMode) error {
+	if f.closed {
+		return f.pathError("Chmod", fs.ErrClosed)
+	}
+
+	if f.opts.Chmod == nil {
+		return f.pathError("Chmod", fsx.ErrNotSupported)
+	}
+
+	return f.opts.Chmod(mode)
+}
+
+// Chown changes the file's ownership using the Chown callback.
+func (f *File) Chown(uid, gid int) error {
+	if f.closed {
+		return f.pathError("Chown", fs.ErrClosed)
+	}
+
+	if f.opts.Chown == nil {
+		return nil
+	}
+
+	return f.opts.Chown(uid, gid)
+}
+
+// Close closes the file and commits the buffer's content if it has been
+// modified.
+func (f *File) Close() error {
+	if f.closed {
+		return f.pathError("Close", fs.ErrClosed)
+	}
+	f.closed = true
+
+	if f.writable && f.dirty && f.opts.Commit != nil {
+		return f.opts.Commit(f.buf)
+	}
+
+	return nil
+}
+
+var (
+	_ fsx.File    = &File{}
+	_ io.ReaderAt = &File{}
+	_ io.WriterAt = &File{}
+)
@@ -0,0 +1,112 @@
+package buffile
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"time"
+
+	"github.com/halimath/fsx"
+)
+
+// ErrIsDirectory is returned when reading from or writing to a directory.
+var ErrIsDirectory = errors.New("is a directory")
+
+// Dir implements fsx.File for a directory with a fixed list of entries.
+type Dir struct {
+	name    string
+	stat    func() (fs.FileInfo, error)
+	entries []fs.DirEntry
+	offset  int
+	closed  bool
+}
+
+// NewDir creates a directory handle named name. stat is called to obtain the
+// directory's info; entries must be sorted by name.
+func NewDir(name string, stat func() (fs.FileInfo, error), entries []fs.DirEntry) *Dir {
+	return &Dir{
+		name:    name,
+		stat:    stat,
+		entries: entries,
+	}
+}
+
+func (d *Dir) pathError(op string, err error) error {
+	return &fs.PathError{
+		Op:   op,
+		Path: d.name,
+		Err:  err,
+	}
+}
+
+// Stat returns the directory's info.
+func (d *Dir) Stat() (fs.FileInfo, error) { return d.stat() }
+
+// Read always fails with ErrIsDirectory.
+func (d *Dir) Read([]byte) (int, error) { return 0, d.pathError("Read", ErrIsDirectory) }
+
+// Write always fails with ErrIsDirectory.
+func (d *Dir) Write([]byte) (int, error) { return 0, d.pathError("Write", ErrIsDirectory) }
+
+// Seek always fails with ErrIsDirectory.
+func (d *Dir) Seek(int64, int) (int64, error) { return 0, d.pathError("Seek", ErrIsDirectory) }
+
+// Chmod is not supported on directory handles; use the filesystem's Chmod.
+func (d *Dir) Chmod(fs.FileMode) error { return d.pathError("Chmod", fsx.ErrNotSupported) }
+
+// Chown is a no-op.
+func (d *Dir) Chown(uid, gid int) error { return nil }
+
+// Close closes the handle.
+func (d *Dir) Close() error {
+	if d.closed {
+		return d.pathError("Close", fs.ErrClosed)
+	}
+	d.closed = true
+	return nil
+}
+
+// ReadDir reads the directory's entries as defined by fs.ReadDirFile.
+func (d *Dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.offset:]
+
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return append([]fs.DirEntry(nil), remaining...), nil
+	}
+
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+
+	d.offset += n
+	return append([]fs.DirEntry(nil), remaining[:n]...), nil
+}
+
+// --
+
+// Info is a simple implementation of fs.FileInfo.
+type Info struct {
+	FileName    string
+	FileSize    int64
+	FileMode    fs.FileMode
+	FileModTime time.Time
+	FileSys     any
+}
+
+func (i *Info) Name() string       { return i.FileName }
+func (i *Info) Size() int64        { return i.FileSize }
+func (i *Info) Mode() fs.FileMode  { return i.FileMode }
+func (i *Info) ModTime() time.Time { return i.FileModTime }
+func (i *Info) IsDir() bool        { return i.FileMode.IsDir() }
+func (i *Info) Sys() any           { return i.FileSys }
+
+var (
+	_ fsx.File       = &Dir{}
+	_ fs.ReadDirFile = &Dir{}
+	_ fs.FileInfo    = &Info{}
+)
@@ -0,0 +1,144 @@
+// Package linkutil provides helpers to inspect symlinks on filesystems that
+// do not define an Lstat operation. It is used by filesystem wrappers that
+// must not follow symlinks when tracking or modifying entries and by
+// functions copying trees including their symlinks.
+package linkutil
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// maxLinks limits the number of symlinks followed by Resolve.
+const maxLinks = 255
+
+// ErrTooManyLinks is returned by Resolve if resolving a path exceeds the
+// maximum number of symlinks to follow, e.g. due to a cycle.
+var ErrTooManyLinks = errors.New("too many levels of symbolic links")
+
+// readlinkFS is satisfied by fsx.LinkFS implementations.
+type readlinkFS interface {
+	Readlink(name string) (string, error)
+}
+
+// readLinkFS is satisfied by filesystems following the naming convention of
+// the standard library's os.DirFS (starting with Go 1.25).
+type readLinkFS interface {
+	ReadLink(name string) (string, error)
+}
+
+// Readlink returns the target of the symlink name in fsys and true if name is
+// a symlink that could be read. It returns false if name is not a symlink or
+// fsys does not support reading links.
+//
+// The target is returned relative to the filesystem's root, following the
+// convention of fsx.LinkFS. Relative targets read using a ReadLink method are
+// relative to the link's directory and converted accordingly.
+func Readlink(fsys fs.FS, name string) (string, bool) {
+	switch l := fsys.(type) {
+	case readlinkFS:
+		target, err := l.Readlink(name)
+		if err != nil {
+			return "", false
+		}
+		return target, true
+
+	case readLinkFS:
+		target, err := l.ReadLink(name)
+		if err != nil {
+			return "", false
+		}
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(name), target)
+		}
+		return target, true
+
+	default:
+		return "", false
+	}
+}
+
+// Lstat returns the info of name without following a final symlink. As
+// fs.FS does not define Lstat, the entry is looked up in its parent
+// directory.
+func Lstat(fsys fs.FS, name string) (fs.FileInfo, error) {
+	if name == "." {
+		return fs.Stat(fsys, name)
+	}
+
+	dir, base := path.Split(name)
+	if dir == "" {
+		dir = "."
+	}
+
+	entries, err := fs.ReadDir(fsys, path.Clean(dir))
+	if err != nil {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: fs.ErrNotExist}
+	}
+
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].Name() >= base })
+	if i == len(entries) || entries[i].Name() != base {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: fs.ErrNotExist}
+	}
+	return entries[i].Info()
+}
+
+// Resolve returns name with all symlinks resolved. Symlink targets are
+// interpreted relative to the filesystem's root, following the convention of
+// fsx.LinkFS. The non-existing tail of name, if any, is kept verbatim, so the
+// result names the entry that would be created when creating name. If fsys
+// does not support reading links, name is returned unchanged.
+func Resolve(fsys fs.FS, name string) (string, error) {
+	rfs, ok := fsys.(readlinkFS)
+	if !ok || name == "." {
+		return name, nil
+	}
+
+	resolved := "."
+	rest := strings.Split(name, "/")
+	links := 0
+
+	for len(rest) > 0 {
+		p := path.Join(resolved, rest[0])
+		rest = rest[1:]
+
+		info, err := Lstat(fsys, p)
+		if errors.Is(err, fs.ErrNotExist) {
+			return path.Join(append([]string{p}, rest...)...), nil
+		}
+		if err != nil {
+			return "", err
+		}
+
+		// Some filesystems (e.g. memfs) report the target's mode for
+		// symlinks in directory entries, so links are detected by reading
+		// them.
+		target, err := rfs.Readlink(p)
+		if err != nil {
+			if info.Mode()&fs.ModeSymlink != 0 {
+				return "", err
+			}
+			resolved = p
+			continue
+		}
+
+		links++
+		if links > maxLinks {
+			return "", &fs.PathError{Op: "resolve", Path: name, Err: ErrTooManyLinks}
+		}
+		target = path.Clean(target)
+		if !fs.ValidPath(target) {
+			return "", &fs.PathError{Op: "resolve", Path: name, Err: fs.ErrInvalid}
+		}
+
+		resolved = "."
+		if target != "." {
+			rest = append(strings.Split(target, "/"), rest...)
+		}
+	}
+
+	return resolved, nil
+}
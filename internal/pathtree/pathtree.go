@@ -0,0 +1,129 @@
+// Package pathtree provides helpers shared by filesystems keeping their
+// entries in memory, such as the archive and repository backed filesystems.
+// Entries are either looked up in a tree walked component by component or in
+// a map keyed by the entries' paths.
+package pathtree
+
+import (
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+)
+
+// Tree describes a tree of entries of type N names are resolved in.
+type Tree[N any] struct {
+	// Root is the root directory.
+	Root N
+
+	// Child returns the entry name, which is a direct child of the directory
+	// dir. ok is false if no such entry exists.
+	Child func(dir N, name string) (child N, ok bool, err error)
+
+	// IsDir reports whether n is a directory.
+	IsDir func(n N) bool
+
+	// Link returns the target of the entry n found at name relative to the
+	// tree's root. ok is false if n is not a symlink.
+	Link func(name string, n N) (target string, ok bool, err error)
+}
+
+// Resolve looks up name and returns the resolved name (with all symlinks in
+// directory components replaced) and its entry. If followLast is true, a
+// final symlink is followed as well. Resolving fails with fs.ErrInvalid if
+// more than maxDepth symlinks need to be followed. Errors are returned
+// unwrapped; callers are expected to wrap them in a *fs.PathError.
+func (t Tree[N]) Resolve(name string, followLast bool, maxDepth int) (string, N, error) {
+	current := name
+	for depth := 0; depth < maxDepth; depth++ {
+		resolved, n, rest, err := t.resolveOnce(current, followLast)
+		if err != nil {
+			var zero N
+			return "", zero, err
+		}
+
+		if rest == "" {
+			return resolved, n, nil
+		}
+
+		current = rest
+	}
+
+	var zero N
+	return "", zero, fs.ErrInvalid
+}
+
+// resolveOnce walks name's components until it hits a symlink that needs to
+// be followed. In this case it returns the rewritten path in rest.
+func (t Tree[N]) resolveOnce(name string, followLast bool) (resolved string, n N, rest string, err error) {
+	var zero N
+	current := "."
+	n = t.Root
+
+	if name == "." || name == "" {
+		return current, n, "", nil
+	}
+
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		if !t.IsDir(n) {
+			return "", zero, "", fs.ErrInvalid
+		}
+
+		next := path.Join(current, part)
+		child, ok, err := t.Child(n, next)
+		if err != nil {
+			return "", zero, "", err
+		}
+		if !ok {
+			return "", zero, "", fs.ErrNotExist
+		}
+
+		last := i == len(parts)-1
+		if !last || followLast {
+			target, ok, err := t.Link(next, child)
+			if err != nil {
+				return "", zero, "", err
+			}
+			if ok {
+				if !fs.ValidPath(target) {
+					return "", zero, "", fs.ErrNotExist
+				}
+				return "", zero, path.Join(append([]string{target}, parts[i+1:]...)...), nil
+			}
+		}
+
+		current = next
+		n = child
+	}
+
+	return current, n, "", nil
+}
+
+// HasChildren reports whether the directory dir contains any of the entries
+// keyed by path.
+func HasChildren[N any](entries map[string]N, dir string) bool {
+	for name := range entries {
+		if name != "." && path.Dir(name) == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// Toucher is implemented by directory entries which can be marked as
+// modified.
+type Toucher interface {
+	// Touch marks the entry as modified at t.
+	Touch(t time.Time)
+}
+
+// Touch marks the directory containing name as modified.
+func Touch[N Toucher](entries map[string]N, name string) {
+	if name == "." {
+		return
+	}
+	if d, ok := entries[path.Dir(name)]; ok {
+		d.Touch(time.Now())
+	}
+}
@@ -0,0 +1,67 @@
+// Package wrapfs provides helpers shared by filesystems wrapping another
+// fsx.FS. The helpers forward optional operations to the wrapped filesystem
+// and fail with an error wrapping fsx.ErrNotSupported if it does not provide
+// them.
+package wrapfs
+
+import (
+	"io/fs"
+	"time"
+
+	"github.com/halimath/fsx"
+)
+
+// PathError returns err wrapped in a *fs.PathError describing op and name.
+// nil and errors that already are a *fs.PathError are returned unchanged.
+func PathError(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := err.(*fs.PathError); ok {
+		return err
+	}
+
+	return &fs.PathError{
+		Op:   op,
+		Path: name,
+		Err:  err,
+	}
+}
+
+// Chtimes changes the access and modification time of the named file in
+// fsys.
+func Chtimes(fsys fs.FS, name string, atime, mtime time.Time) error {
+	cfs, ok := fsys.(fsx.ChtimesFS)
+	if !ok {
+		return PathError("Chtimes", name, fsx.ErrNotSupported)
+	}
+	return cfs.Chtimes(name, atime, mtime)
+}
+
+// Readlink returns the target of the named symlink in fsys.
+func Readlink(fsys fs.FS, name string) (string, error) {
+	lfs, ok := fsys.(fsx.LinkFS)
+	if !ok {
+		return "", PathError("Readlink", name, fsx.ErrNotSupported)
+	}
+	return lfs.Readlink(name)
+}
+
+// Link creates newname as a hard link to oldname in fsys.
+func Link(fsys fs.FS, oldname, newname string) error {
+	lfs, ok := fsys.(fsx.LinkFS)
+	if !ok {
+		return PathError("Link", newname, fsx.ErrNotSupported)
+	}
+	return lfs.Link(oldname, newname)
+}
+
+// Symlink creates newname as a symlink to oldname in fsys.
+func Symlink(fsys fs.FS, oldname, newname string) error {
+	lfs, ok := fsys.(fsx.LinkFS)
+	if !ok {
+		return PathError("Symlink", newname, fsx.ErrNotSupported)
+	}
+	return lfs.Symlink(oldname, newname)
+}
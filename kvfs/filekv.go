@@ -0,0 +1,395 @@
+package kvfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+// ErrCorruptLog is returned when opening a FileKV whose log contains an
+// invalid record that is not the log's last record.
+var ErrCorruptLog = errors.New("kvfs: corrupt log")
+
+const (
+	opPut    byte = 'P'
+	opDelete byte = 'D'
+)
+
+// logOp is a single modification recorded in the log.
+type logOp struct {
+	op    byte
+	key   string
+	value []byte
+}
+
+// FileKV is a simple append-only, file backed implementation of TxKV. All
+// data is kept in memory; every modification is appended to a log file that
+// is replayed when opening the store.
+//
+// The log consists of records. Each record contains one or more
+// modifications and is protected by a checksum; a record written by a
+// transaction contains all of the transaction's modifications. When opening
+// the store, a truncated or corrupt last record - e.g. caused by a crash
+// while writing - is discarded.
+//
+// FileKV is meant for tests and small datasets. Use Compact to rewrite the
+// log containing only the current data.
+type FileKV struct {
+	mu   sync.RWMutex
+	path string
+	f    *os.File
+	data store
+}
+
+// OpenFileKV opens the log file found at path or creates it if it does not
+// exist.
+func OpenFileKV(path string) (*FileKV, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	kv := &FileKV{
+		path: path,
+		f:    f,
+		data: make(store),
+	}
+
+	valid, err := kv.replay()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// Discard a partially written record.
+	if err := f.Truncate(valid); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return kv, nil
+}
+
+// replay reads all records and returns the offset after the last valid one.
+func (kv *FileKV) replay() (int64, error) {
+	info, err := kv.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+
+	r := bufio.NewReader(kv.f)
+	var offset int64
+
+	for {
+		ops, n, err := readRecord(r)
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			if offset+n >= size || errors.Is(err, io.ErrUnexpectedEOF) {
+				// The last record is incomplete.
+				return offset, nil
+			}
+			return 0, fmt.Errorf("%w: at offset %d: %v", ErrCorruptLog, offset, err)
+		}
+
+		for _, op := range ops {
+			apply(kv.data, op)
+		}
+		offset += n
+	}
+}
+
+func apply(s store, op logOp) {
+	switch op.op {
+	case opPut:
+		s[op.key] = op.value
+	case opDelete:
+		delete(s, op.key)
+	}
+}
+
+// readRecord reads a single record. It returns the number of bytes consumed.
+func readRecord(r *bufio.Reader) ([]logOp, int64, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		if err == io.EOF {
+			return nil, 0, io.EOF
+		}
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	n := int64(uvarintLen(length)) + int64(length) + 4
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, n, io.ErrUnexpectedEOF
+	}
+
+	var sum [4]byte
+	if _, err := io.ReadFull(r, sum[:]); err != nil {
+		return nil, n, io.ErrUnexpectedEOF
+	}
+
+	if binary.BigEndian.Uint32(sum[:]) != crc32.ChecksumIEEE(body) {
+		return nil, n, errors.New("checksum mismatch")
+	}
+
+	ops, err := decodeOps(body)
+	return ops, n, err
+}
+
+func uvarintLen(v uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], v)
+}
+
+func decodeOps(body []byte) ([]logOp, error) {
+	r := bytes.NewReader(body)
+
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	ops := make([]logOp, 0, count)
+	for i := uint64(0); i < count; i++ {
+		op, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+
+		o := logOp{op: op, key: string(key)}
+
+		switch op {
+		case opPut:
+			o.value, err = readBytes(r)
+			if err != nil {
+				return nil, err
+			}
+		case opDelete:
+		default:
+			return nil, fmt.Errorf("invalid operation %q", op)
+		}
+
+		ops = append(ops, o)
+	}
+
+	return ops, nil
+}
+
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if l > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	b := make([]byte, l)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
+// encodeRecord encodes ops as a single record.
+func encodeRecord(ops []logOp) []byte {
+	var body []byte
+	body = binary.AppendUvarint(body, uint64(len(ops)))
+	for _, op := range ops {
+		body = append(body, op.op)
+		body = binary.AppendUvarint(body, uint64(len(op.key)))
+		body = append(body, op.key...)
+		if op.op == opPut {
+			body = binary.AppendUvarint(body, uint64(len(op.value)))
+			body = append(body, op.value...)
+		}
+	}
+
+	rec := binary.AppendUvarint(nil, uint64(len(body)))
+	rec = append(rec, body...)
+	return binary.BigEndian.AppendUint32(rec, crc32.ChecksumIEEE(body))
+}
+
+// write appends ops to the log and applies them to data. kv.mu must be held.
+func (kv *FileKV) write(ops []logOp) error {
+	if kv.f == nil {
+		return os.ErrClosed
+	}
+
+	if len(ops) == 0 {
+		return nil
+	}
+
+	if _, err := kv.f.Write(encodeRecord(ops)); err != nil {
+		return err
+	}
+
+	for _, op := range ops {
+		apply(kv.data, op)
+	}
+
+	return nil
+}
+
+// Get returns the value stored for key.
+func (kv *FileKV) Get(key string) ([]byte, error) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	v, err := kv.data.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), v...), nil
+}
+
+// Put stores value for key.
+func (kv *FileKV) Put(key string, value []byte) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	return kv.write([]logOp{{op: opPut, key: key, value: append([]byte(nil), value...)}})
+}
+
+// Delete removes key.
+func (kv *FileKV) Delete(key string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	return kv.write([]logOp{{op: opDelete, key: key}})
+}
+
+// Scan calls fn for all keys starting with prefix.
+func (kv *FileKV) Scan(prefix string, fn func(key string, value []byte) error) error {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	return kv.data.Scan(prefix, fn)
+}
+
+// Update runs fn in a transaction. All modifications made by fn are written
+// as a single log record.
+func (kv *FileKV) Update(fn func(tx KV) error) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	tx := &fileTx{overlay: newOverlay(kv.data)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return kv.write(tx.ops)
+}
+
+// Sync commits the log file to stable storage.
+func (kv *FileKV) Sync() error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if kv.f == nil {
+		return os.ErrClosed
+	}
+
+	return kv.f.Sync()
+}
+
+// Compact rewrites the log so that it contains only the current data. The
+// new log is written to a temporary file which replaces the log afterwards.
+func (kv *FileKV) Compact() error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if kv.f == nil {
+		return os.ErrClosed
+	}
+
+	ops := make([]logOp, 0, len(kv.data))
+	kv.data.Scan("", func(key string, value []byte) error {
+		ops = append(ops, logOp{op: opPut, key: key, value: value})
+		return nil
+	})
+
+	tmp := kv.path + ".compact"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if len(ops) > 0 {
+		if _, err := f.Write(encodeRecord(ops)); err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, kv.path); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	kv.f.Close()
+	kv.f = f
+
+	return nil
+}
+
+// Close closes the log file.
+func (kv *FileKV) Close() error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if kv.f == nil {
+		return os.ErrClosed
+	}
+
+	err := kv.f.Close()
+	kv.f = nil
+	return err
+}
+
+// fileTx records the modifications of a transaction.
+type fileTx struct {
+	*overlay
+	ops []logOp
+}
+
+func (tx *fileTx) Put(key string, value []byte) error {
+	tx.overlay.Put(key, value)
+	tx.ops = append(tx.ops, logOp{op: opPut, key: key, value: tx.changes[key]})
+	return nil
+}
+
+func (tx *fileTx) Delete(key string) error {
+	tx.overlay.Delete(key)
+	tx.ops = append(tx.ops, logOp{op: opDelete, key: key})
+	return nil
+}
+
+var _ TxKV = &FileKV{}
@@ -0,0 +1,229 @@
+package kvfs
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrKeyNotFound is returned from KV.Get if the requested key does not exist.
+var ErrKeyNotFound = errors.New("kvfs: key not found")
+
+// KV defines the minimal interface of a key-value store used by kvfs.
+// Implementations must be safe for concurrent use.
+type KV interface {
+	// Get returns the value stored for key or an error wrapping
+	// ErrKeyNotFound.
+	Get(key string) ([]byte, error)
+
+	// Put stores value for key replacing any existing value.
+	Put(key string, value []byte) error
+
+	// Delete removes key. Deleting a non-existing key is not an error.
+	Delete(key string) error
+
+	// Scan calls fn for every key starting with prefix in lexical order of
+	// the keys. If fn returns an error, Scan stops and returns that error.
+	// fn must not modify the store.
+	Scan(prefix string, fn func(key string, value []byte) error) error
+}
+
+// TxKV defines an optional interface for KV implementations that support
+// transactions. kvfs uses transactions if provided to apply each operation
+// atomically.
+type TxKV interface {
+	KV
+
+	// Update calls fn with a KV that operates inside a transaction. If fn
+	// returns nil, all modifications are committed atomically; otherwise
+	// they are discarded and the error is returned.
+	Update(fn func(tx KV) error) error
+}
+
+// store implements an unsynchronized map based KV.
+type store map[string][]byte
+
+func (s store) Get(key string) ([]byte, error) {
+	v, ok := s[key]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return v, nil
+}
+
+func (s store) Put(key string, value []byte) error {
+	s[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (s store) Delete(key string) error {
+	delete(s, key)
+	return nil
+}
+
+func (s store) Scan(prefix string, fn func(key string, value []byte) error) error {
+	keys := make([]string, 0)
+	for k := range s {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if err := fn(k, s[k]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// overlay implements a KV recording modifications on top of a store without
+// changing it. Only the keys modified are copied, so transactions cost in
+// proportion to their modifications rather than to the size of the store.
+type overlay struct {
+	base store
+	// changes contains the modified keys' values; deleted keys map to nil.
+	changes map[string][]byte
+}
+
+func newOverlay(base store) *overlay {
+	return &overlay{base: base, changes: make(map[string][]byte)}
+}
+
+func (o *overlay) Get(key string) ([]byte, error) {
+	v, ok := o.changes[key]
+	if !ok {
+		return o.base.Get(key)
+	}
+	if v == nil {
+		return nil, ErrKeyNotFound
+	}
+	return v, nil
+}
+
+func (o *overlay) Put(key string, value []byte) error {
+	o.changes[key] = append(make([]byte, 0, len(value)), value...)
+	return nil
+}
+
+func (o *overlay) Delete(key string) error {
+	o.changes[key] = nil
+	return nil
+}
+
+func (o *overlay) Scan(prefix string, fn func(key string, value []byte) error) error {
+	keys := make([]string, 0)
+	for k := range o.base {
+		if _, ok := o.changes[k]; !ok && strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	for k, v := range o.changes {
+		if v != nil && strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v, ok := o.changes[k]
+		if !ok {
+			v = o.base[k]
+		}
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// commit applies the recorded modifications to the base store.
+func (o *overlay) commit() {
+	for k, v := range o.changes {
+		if v == nil {
+			delete(o.base, k)
+		} else {
+			o.base[k] = v
+		}
+	}
+}
+
+// MemKV is an in-memory implementation of TxKV.
+type MemKV struct {
+	mu   sync.RWMutex
+	data store
+}
+
+// NewMemKV creates a new, empty MemKV.
+func NewMemKV() *MemKV {
+	return &MemKV{data: make(store)}
+}
+
+// Get returns the value stored for key.
+func (m *MemKV) Get(key string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	v, err := m.data.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), v...), nil
+}
+
+// Put stores value for key.
+func (m *MemKV) Put(key string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.data.Put(key, value)
+}
+
+// Delete removes key.
+func (m *MemKV) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.data.Delete(key)
+}
+
+// Scan calls fn for all keys starting with prefix.
+func (m *MemKV) Scan(prefix string, fn func(key string, value []byte) error) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.data.Scan(prefix, fn)
+}
+
+// Len returns the number of keys stored in m.
+func (m *MemKV) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return len(m.data)
+}
+
+// Update runs fn in a transaction recording its modifications separately
+// from the store's data. Transactions are serialized.
+func (m *MemKV) Update(fn func(tx KV) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx := newOverlay(m.data)
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	tx.commit()
+	return nil
+}
+
+var (
+	_ TxKV = &MemKV{}
+	_ KV   = store{}
+	_ KV   = &overlay{}
+)
@@ -0,0 +1,171 @@
+package kvfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+)
+
+func scanKeys(t *testing.T, kv KV, prefix string) []string {
+	t.Helper()
+
+	keys := make([]string, 0)
+	if err := kv.Scan(prefix, func(key string, _ []byte) error {
+		keys = append(keys, key)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func testKV(t *testing.T, kv TxKV) {
+	t.Helper()
+
+	expect.That(t,
+		is.NoError(kv.Put("a/1", []byte("one"))),
+		is.NoError(kv.Put("a/2", []byte("two"))),
+		is.NoError(kv.Put("b/1", []byte("three"))),
+		is.NoError(kv.Delete("b/1")),
+		is.NoError(kv.Delete("missing")),
+	)
+
+	v, err := kv.Get("a/2")
+	expect.That(t, is.NoError(err), is.EqualTo(string(v), "two"))
+
+	_, err = kv.Get("b/1")
+	expect.That(t, is.Error(err, ErrKeyNotFound))
+
+	expect.That(t, is.DeepEqualTo(scanKeys(t, kv, "a/"), []string{"a/1", "a/2"}))
+
+	failed := errors.New("failed")
+	err = kv.Update(func(tx KV) error {
+		tx.Put("a/3", []byte("three"))
+		tx.Delete("a/1")
+		return failed
+	})
+	expect.That(t,
+		is.Error(err, failed),
+		is.DeepEqualTo(scanKeys(t, kv, ""), []string{"a/1", "a/2"}),
+	)
+
+	err = kv.Update(func(tx KV) error {
+		tx.Put("a/3", []byte("three"))
+		tx.Delete("a/1")
+
+		_, err := tx.Get("a/1")
+		if !errors.Is(err, ErrKeyNotFound) {
+			return errors.New("expected a/1 to be deleted inside the transaction")
+		}
+
+		expect.That(t, is.DeepEqualTo(scanKeys(t, tx, "a/"), []string{"a/2", "a/3"}))
+		return nil
+	})
+	expect.That(t,
+		is.NoError(err),
+		is.DeepEqualTo(scanKeys(t, kv, ""), []string{"a/2", "a/3"}),
+	)
+}
+
+func TestMemKV(t *testing.T) {
+	testKV(t, NewMemKV())
+}
+
+func TestFileKV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+
+	kv, err := OpenFileKV(path)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	testKV(t, kv)
+	expect.That(t, is.NoError(kv.Close()))
+
+	kv, err = OpenFileKV(path)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	defer kv.Close()
+
+	v, err := kv.Get("a/3")
+	expect.That(t,
+		is.NoError(err),
+		is.EqualTo(string(v), "three"),
+		is.DeepEqualTo(scanKeys(t, kv, ""), []string{"a/2", "a/3"}),
+	)
+}
+
+func TestFileKV_truncatedTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+
+	kv, err := OpenFileKV(path)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	expect.That(t,
+		is.NoError(kv.Put("a", []byte("1"))),
+		is.NoError(kv.Put("b", []byte("2"))),
+		is.NoError(kv.Close()),
+	)
+
+	info, err := os.Stat(path)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	expect.That(t, expect.FailNow(is.NoError(os.Truncate(path, info.Size()-2))))
+
+	kv, err = OpenFileKV(path)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	expect.That(t,
+		is.DeepEqualTo(scanKeys(t, kv, ""), []string{"a"}),
+		is.NoError(kv.Put("c", []byte("3"))),
+		is.NoError(kv.Close()),
+	)
+
+	kv, err = OpenFileKV(path)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	defer kv.Close()
+	expect.That(t, is.DeepEqualTo(scanKeys(t, kv, ""), []string{"a", "c"}))
+}
+
+func TestFileKV_corrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+
+	kv, err := OpenFileKV(path)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	expect.That(t,
+		is.NoError(kv.Put("a", []byte("1"))),
+		is.NoError(kv.Put("b", []byte("2"))),
+		is.NoError(kv.Close()),
+	)
+
+	data, err := os.ReadFile(path)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	data[4] ^= 0xff
+	expect.That(t, expect.FailNow(is.NoError(os.WriteFile(path, data, 0644))))
+
+	_, err = OpenFileKV(path)
+	expect.That(t, is.Error(err, ErrCorruptLog))
+}
+
+func TestFileKV_Compact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+
+	kv, err := OpenFileKV(path)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	for i := 0; i < 100; i++ {
+		expect.That(t, expect.FailNow(is.NoError(kv.Put("key", []byte("a value that is overwritten")))))
+	}
+
+	before, _ := os.Stat(path)
+	expect.That(t,
+		expect.FailNow(is.NoError(kv.Compact())),
+		is.NoError(kv.Put("other", []byte("x"))),
+		is.NoError(kv.Close()),
+	)
+
+	after, _ := os.Stat(path)
+	expect.That(t, is.EqualTo(after.Size() < before.Size()/10, true))
+
+	kv, err = OpenFileKV(path)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	defer kv.Close()
+	expect.That(t, is.DeepEqualTo(scanKeys(t, kv, ""), []string{"key", "other"}))
+}
@@ -0,0 +1,1047 @@
+// Package kvfs provides a fsx.LinkFS implementation that stores files and
+// directories in a key-value store.
+//
+// The store only needs to implement the minimal KV interface. If it also
+// implements TxKV, every filesystem operation is applied atomically.
+//
+// Each file, directory and symlink is represented by an inode identified by
+// a unique number. The filesystem uses four kinds of keys:
+//
+//	i/<ino>          the inode's metadata (JSON encoded)
+//	d/<ino>          the content of a regular file
+//	e/<ino>/<name>   a directory entry in directory <ino> referring to an inode
+//	p/<ino>          the inode number of directory <ino>'s parent
+//
+// Directory entries are stored separately from inodes. Renaming a file or
+// directory thus only moves a single directory entry regardless of the
+// size of the renamed subtree; hard links are multiple directory entries
+// referring to the same inode.
+//
+// Symlink targets are interpreted relative to the filesystem's root.
+//
+// Modes and ownership are part of an inode's metadata and shared by all hard
+// links referring to it. New inodes are owned by uid and gid 0 until changed
+// using Chown. The modes are reported by Stat but not checked by any
+// operation.
+package kvfs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/internal/buffile"
+)
+
+const (
+	rootIno = 1
+
+	keyNextIno = "meta/next-ino"
+
+	// maxSymlinkDepth limits the number of symlinks resolved when looking
+	// up a single name.
+	maxSymlinkDepth = 40
+)
+
+// FS defines the interface of a KV backed filesystem.
+type FS interface {
+	fsx.LinkFS
+	fsx.ChmodFS
+	fsx.ChownFS
+	fsx.ChtimesFS
+	fsx.RemoveAllFS
+	fs.StatFS
+	fs.ReadDirFS
+	fs.ReadFileFS
+
+	// Lstat returns a fs.FileInfo describing the named file without
+	// following a final symlink.
+	Lstat(name string) (fs.FileInfo, error)
+}
+
+// Stat defines the structure returned from fs.FileInfo.Sys() for all entries
+// of a kvfs.
+type Stat struct {
+	// Ino is the inode's number.
+	Ino uint64
+	// Nlink is the number of directory entries referring to the inode.
+	Nlink int
+	// The owner's UID.
+	Uid int
+	// The owner's GID.
+	Gid int
+	// The time the element was last accessed.
+	Atime time.Time
+}
+
+// inode holds the persisted metadata of a file, directory or symlink.
+type inode struct {
+	Mode   fs.FileMode `json:"mode"`
+	Uid    int         `json:"uid,omitempty"`
+	Gid    int         `json:"gid,omitempty"`
+	Atime  time.Time   `json:"atime"`
+	Mtime  time.Time   `json:"mtime"`
+	Nlink  int         `json:"nlink"`
+	Size   int64       `json:"size,omitempty"`
+	Target string      `json:"target,omitempty"`
+}
+
+func inodeKey(ino uint64) string { return fmt.Sprintf("i/%016x", ino) }
+func dataKey(ino uint64) string  { return fmt.Sprintf("d/%016x", ino) }
+func direntPrefix(dir uint64) string {
+	return fmt.Sprintf("e/%016x/", dir)
+}
+func direntKey(dir uint64, name string) string { return direntPrefix(dir) + name }
+func parentKey(dir uint64) string              { return fmt.Sprintf("p/%016x", dir) }
+
+type fileInfo struct {
+	name string
+	ino  uint64
+	n    *inode
+}
+
+func (i *fileInfo) Name() string       { return path.Base(i.name) }
+func (i *fileInfo) Size() int64        { return i.n.Size }
+func (i *fileInfo) Mode() fs.FileMode  { return i.n.Mode }
+func (i *fileInfo) ModTime() time.Time { return i.n.Mtime }
+func (i *fileInfo) IsDir() bool        { return i.n.Mode.IsDir() }
+
+func (i *fileInfo) Sys() any {
+	return Stat{
+		Ino:   i.ino,
+		Nlink: i.n.Nlink,
+		Uid:   i.n.Uid,
+		Gid:   i.n.Gid,
+		Atime: i.n.Atime,
+	}
+}
+
+type kvfs struct {
+	// mu serializes all operations of this filesystem. Transactions provided
+	// by the store protect against concurrent modifications from other
+	// processes.
+	mu sync.Mutex
+	kv KV
+}
+
+// New creates a filesystem operating on kv. If kv does not contain a root
+// directory yet, it is created.
+func New(kv KV) (FS, error) {
+	fsys := &kvfs{kv: kv}
+
+	err := fsys.update(func(tx *txn) error {
+		if _, err := tx.kv.Get(inodeKey(rootIno)); err == nil {
+			return nil
+		} else if !errors.Is(err, ErrKeyNotFound) {
+			return err
+		}
+
+		now := time.Now()
+		if err := tx.putInode(rootIno, &inode{Mode: fs.ModeDir | 0755, Atime: now, Mtime: now, Nlink: 1}); err != nil {
+			return err
+		}
+		return tx.kv.Put(keyNextIno, []byte(strconv.FormatUint(rootIno+1, 10)))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return fsys, nil
+}
+
+// update runs fn inside a transaction if the store supports them.
+func (fsys *kvfs) update(fn func(tx *txn) error) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	if t, ok := fsys.kv.(TxKV); ok {
+		return t.Update(func(kv KV) error {
+			return fn(&txn{kv: kv})
+		})
+	}
+
+	return fn(&txn{kv: fsys.kv})
+}
+
+// view runs fn for read-only access.
+func (fsys *kvfs) view(fn func(tx *txn) error) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	return fn(&txn{kv: fsys.kv})
+}
+
+// txn provides the filesystem's primitives on top of a KV.
+type txn struct {
+	kv KV
+}
+
+func (tx *txn) getInode(ino uint64) (*inode, error) {
+	data, err := tx.kv.Get(inodeKey(ino))
+	if err != nil {
+		if errors.Is(err, ErrKeyNotFound) {
+			return nil, fs.ErrNotExist
+		}
+		return nil, err
+	}
+
+	var n inode
+	if err := json.Unmarshal(data, &n); err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+func (tx *txn) putInode(ino uint64, n *inode) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	return tx.kv.Put(inodeKey(ino), data)
+}
+
+func (tx *txn) nextIno() (uint64, error) {
+	data, err := tx.kv.Get(keyNextIno)
+	if err != nil {
+		return 0, err
+	}
+
+	ino, err := strconv.ParseUint(string(data), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.kv.Put(keyNextIno, []byte(strconv.FormatUint(ino+1, 10))); err != nil {
+		return 0, err
+	}
+
+	return ino, nil
+}
+
+// lookup returns the inode number of the entry name in directory dir.
+func (tx *txn) lookup(dir uint64, name string) (uint64, error) {
+	data, err := tx.kv.Get(direntKey(dir, name))
+	if err != nil {
+		if errors.Is(err, ErrKeyNotFound) {
+			return 0, fs.ErrNotExist
+		}
+		return 0, err
+	}
+
+	return strconv.ParseUint(string(data), 16, 64)
+}
+
+// parent returns the inode number of directory dir's parent.
+func (tx *txn) parent(dir uint64) (uint64, error) {
+	data, err := tx.kv.Get(parentKey(dir))
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(string(data), 16, 64)
+}
+
+func (tx *txn) putParent(dir, parent uint64) error {
+	return tx.kv.Put(parentKey(dir), []byte(strconv.FormatUint(parent, 16)))
+}
+
+func (tx *txn) putDirent(dir uint64, name string, ino uint64) error {
+	return tx.kv.Put(direntKey(dir, name), []byte(strconv.FormatUint(ino, 16)))
+}
+
+// children returns the names and inode numbers of all entries of dir.
+func (tx *txn) children(dir uint64) ([]string, []uint64, error) {
+	var names []string
+	var inos []uint64
+
+	prefix := direntPrefix(dir)
+	err := tx.kv.Scan(prefix, func(key string, value []byte) error {
+		ino, err := strconv.ParseUint(string(value), 16, 64)
+		if err != nil {
+			return err
+		}
+		names = append(names, key[len(prefix):])
+		inos = append(inos, ino)
+		return nil
+	})
+
+	return names, inos, err
+}
+
+func (tx *txn) hasChildren(dir uint64) (bool, error) {
+	found := errors.New("found")
+	err := tx.kv.Scan(direntPrefix(dir), func(string, []byte) error { return found })
+	if err == found {
+		return true, nil
+	}
+	return false, err
+}
+
+// touch updates the modification time of directory dir.
+func (tx *txn) touch(dir uint64) error {
+	n, err := tx.getInode(dir)
+	if err != nil {
+		return err
+	}
+	n.Mtime = time.Now()
+	return tx.putInode(dir, n)
+}
+
+// unlink removes the entry name from directory dir referring to ino and
+// deletes the inode if it is no longer referenced.
+func (tx *txn) unlink(dir uint64, name string, ino uint64, n *inode) error {
+	if err := tx.kv.Delete(direntKey(dir, name)); err != nil {
+		return err
+	}
+
+	n.Nlink--
+	if n.Nlink > 0 {
+		return tx.putInode(ino, n)
+	}
+
+	if err := tx.kv.Delete(dataKey(ino)); err != nil {
+		return err
+	}
+	if err := tx.kv.Delete(parentKey(ino)); err != nil {
+		return err
+	}
+	return tx.kv.Delete(inodeKey(ino))
+}
+
+// removeAll removes the entry name in dir recursively.
+func (tx *txn) removeAll(dir uint64, name string, ino uint64) error {
+	n, err := tx.getInode(ino)
+	if err != nil {
+		return err
+	}
+
+	if n.Mode.IsDir() {
+		names, inos, err := tx.children(ino)
+		if err != nil {
+			return err
+		}
+
+		for i := range names {
+			if err := tx.removeAll(ino, names[i], inos[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.unlink(dir, name, ino, n)
+}
+
+// resolved describes the result of resolving a name.
+type resolved struct {
+	// dir is the inode number of the directory containing the entry.
+	dir uint64
+	// base is the entry's name inside dir.
+	base string
+	// ino is the entry's inode number or 0 if the entry does not exist.
+	ino uint64
+	n   *inode
+}
+
+// resolve resolves name following symlinks in all but the last component. If
+// followLast is true, a final symlink is followed as well. If only the last
+// component does not exist, resolve returns a resolved value with ino set to
+// 0 and no error.
+func (tx *txn) resolve(name string, followLast bool) (resolved, error) {
+	if !fs.ValidPath(name) {
+		return resolved{}, fs.ErrInvalid
+	}
+
+	parts := splitPath(name)
+	if len(parts) == 0 {
+		n, err := tx.getInode(rootIno)
+		return resolved{dir: rootIno, base: ".", ino: rootIno, n: n}, err
+	}
+
+	depth := 0
+	dir := uint64(rootIno)
+
+	for i := 0; i < len(parts); i++ {
+		part := parts[i]
+		last := i == len(parts)-1
+
+		d, err := tx.getInode(dir)
+		if err != nil {
+			return resolved{}, err
+		}
+		if !d.Mode.IsDir() {
+			return resolved{}, fs.ErrInvalid
+		}
+
+		ino, err := tx.lookup(dir, part)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && last {
+				return resolved{dir: dir, base: part}, nil
+			}
+			return resolved{}, err
+		}
+
+		n, err := tx.getInode(ino)
+		if err != nil {
+			return resolved{}, err
+		}
+
+		if n.Mode&fs.ModeSymlink != 0 && (!last || followLast) {
+			depth++
+			if depth > maxSymlinkDepth {
+				return resolved{}, fs.ErrInvalid
+			}
+
+			// Restart resolving from the root with the link's target.
+			parts = append(splitPath(n.Target), parts[i+1:]...)
+			dir = rootIno
+			i = -1
+
+			if len(parts) == 0 {
+				n, err := tx.getInode(rootIno)
+				return resolved{dir: rootIno, base: ".", ino: rootIno, n: n}, err
+			}
+			continue
+		}
+
+		if last {
+			return resolved{dir: dir, base: part, ino: ino, n: n}, nil
+		}
+
+		dir = ino
+	}
+
+	// Not reached.
+	return resolved{}, fs.ErrInvalid
+}
+
+func splitPath(p string) []string {
+	p = path.Clean(p)
+	if p == "." || p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+func pathError(op, name string, err error) error {
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		return err
+	}
+
+	return &fs.PathError{
+		Op:   op,
+		Path: name,
+		Err:  err,
+	}
+}
+
+// -- fs.FS
+
+// Open opens the named file for reading.
+func (fsys *kvfs) Open(name string) (fs.File, error) {
+	return fsys.OpenFile(name, fsx.O_RDONLY, 0)
+}
+
+// -- fsx.FS
+
+// OpenFile opens the named file. The content of regular files is read when
+// opening the file; modifications are written to the store when the file is
+// closed.
+func (fsys *kvfs) OpenFile(name string, flag int, perm fs.FileMode) (fsx.File, error) {
+	writable := flag&(fsx.O_WRONLY|fsx.O_RDWR) != 0
+
+	var ino uint64
+	var n *inode
+	var data []byte
+	var created bool
+	var entries []fs.DirEntry
+
+	op := func(tx *txn) error {
+		r, err := tx.resolve(name, true)
+		if err != nil {
+			return err
+		}
+
+		if r.ino == 0 {
+			if flag&fsx.O_CREATE == 0 {
+				return fs.ErrNotExist
+			}
+
+			ino, err = tx.nextIno()
+			if err != nil {
+				return err
+			}
+
+			now := time.Now()
+			n = &inode{Mode: perm.Perm(), Atime: now, Mtime: now, Nlink: 1}
+			created = true
+
+			if err := tx.putInode(ino, n); err != nil {
+				return err
+			}
+			if err := tx.putDirent(r.dir, r.base, ino); err != nil {
+				return err
+			}
+			return tx.touch(r.dir)
+		}
+
+		if flag&fsx.O_CREATE != 0 && flag&fsx.O_EXCL != 0 {
+			return fs.ErrExist
+		}
+
+		ino, n = r.ino, r.n
+
+		if n.Mode.IsDir() {
+			if writable {
+				return buffile.ErrIsDirectory
+			}
+
+			entries, err = fsys.readDir(tx, name, ino)
+			return err
+		}
+
+		data, err = tx.kv.Get(dataKey(ino))
+		if errors.Is(err, ErrKeyNotFound) {
+			err = nil
+		}
+		return err
+	}
+
+	var err error
+	if flag&fsx.O_CREATE != 0 {
+		err = fsys.update(op)
+	} else {
+		err = fsys.view(op)
+	}
+	if err != nil {
+		return nil, pathError("OpenFile", name, err)
+	}
+
+	if n.Mode.IsDir() {
+		return buffile.NewDir(name, func() (fs.FileInfo, error) {
+			return fsys.statIno(name, ino)
+		}, entries), nil
+	}
+
+	if writable && !n.Mode.IsRegular() {
+		return nil, pathError("OpenFile", name, fs.ErrInvalid)
+	}
+
+	return buffile.New(name, data, buffile.Options{
+		Flag:  flag,
+		Dirty: created,
+		Stat: func(size int64) (fs.FileInfo, error) {
+			info, err := fsys.statIno(name, ino)
+			if err != nil {
+				return nil, err
+			}
+			fi := info.(*fileInfo)
+			fi.n.Size = size
+			return fi, nil
+		},
+		Commit: func(data []byte) error {
+			return fsys.update(func(tx *txn) error {
+				n, err := tx.getInode(ino)
+				if errors.Is(err, fs.ErrNotExist) {
+					// The file has been removed while being open.
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+
+				n.Size = int64(len(data))
+				n.Mtime = time.Now()
+				if err := tx.kv.Put(dataKey(ino), data); err != nil {
+					return err
+				}
+				return tx.putInode(ino, n)
+			})
+		},
+		Chmod: func(mode fs.FileMode) error {
+			return fsys.modifyIno(ino, func(n *inode) { n.Mode = n.Mode.Type() | mode.Perm() })
+		},
+		Chown: func(uid, gid int) error {
+			return fsys.modifyIno(ino, func(n *inode) { n.Uid, n.Gid = uid, gid })
+		},
+	}), nil
+}
+
+func (fsys *kvfs) statIno(name string, ino uint64) (fs.FileInfo, error) {
+	var info fs.FileInfo
+	err := fsys.view(func(tx *txn) error {
+		n, err := tx.getInode(ino)
+		if err != nil {
+			return err
+		}
+		info = &fileInfo{name: name, ino: ino, n: n}
+		return nil
+	})
+	if err != nil {
+		return nil, pathError("Stat", name, err)
+	}
+	return info, nil
+}
+
+func (fsys *kvfs) modifyIno(ino uint64, fn func(n *inode)) error {
+	return fsys.update(func(tx *txn) error {
+		n, err := tx.getInode(ino)
+		if err != nil {
+			return err
+		}
+		fn(n)
+		return tx.putInode(ino, n)
+	})
+}
+
+// modify resolves name and applies fn to its inode.
+func (fsys *kvfs) modify(op, name string, followLast bool, fn func(n *inode)) error {
+	err := fsys.update(func(tx *txn) error {
+		r, err := tx.resolve(name, followLast)
+		if err != nil {
+			return err
+		}
+		if r.ino == 0 {
+			return fs.ErrNotExist
+		}
+
+		fn(r.n)
+		return tx.putInode(r.ino, r.n)
+	})
+	if err != nil {
+		return pathError(op, name, err)
+	}
+	return nil
+}
+
+// readDir returns the sorted entries of directory ino. Symlinks are reported
+// with fs.ModeSymlink and not followed.
+func (fsys *kvfs) readDir(tx *txn, name string, ino uint64) ([]fs.DirEntry, error) {
+	names, inos, err := tx.children(ino)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]fs.DirEntry, len(names))
+	for i := range names {
+		n, err := tx.getInode(inos[i])
+		if err != nil {
+			return nil, err
+		}
+		entries[i] = fs.FileInfoToDirEntry(&fileInfo{name: path.Join(name, names[i]), ino: inos[i], n: n})
+	}
+
+	return entries, nil
+}
+
+// Mkdir creates a directory named name with permission perm.
+func (fsys *kvfs) Mkdir(name string, perm fs.FileMode) error {
+	err := fsys.update(func(tx *txn) error {
+		r, err := tx.resolve(name, false)
+		if err != nil {
+			return err
+		}
+		if r.ino != 0 {
+			return fs.ErrExist
+		}
+
+		ino, err := tx.nextIno()
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if err := tx.putInode(ino, &inode{Mode: fs.ModeDir | perm.Perm(), Atime: now, Mtime: now, Nlink: 1}); err != nil {
+			return err
+		}
+		if err := tx.putParent(ino, r.dir); err != nil {
+			return err
+		}
+		if err := tx.putDirent(r.dir, r.base, ino); err != nil {
+			return err
+		}
+		return tx.touch(r.dir)
+	})
+	if err != nil {
+		return pathError("Mkdir", name, err)
+	}
+	return nil
+}
+
+// Remove removes the named file or empty directory.
+func (fsys *kvfs) Remove(name string) error {
+	err := fsys.update(func(tx *txn) error {
+		r, err := tx.resolve(name, false)
+		if err != nil {
+			return err
+		}
+		if r.ino == 0 {
+			return fs.ErrNotExist
+		}
+		if r.ino == rootIno {
+			return fs.ErrInvalid
+		}
+
+		if r.n.Mode.IsDir() {
+			nonEmpty, err := tx.hasChildren(r.ino)
+			if err != nil {
+				return err
+			}
+			if nonEmpty {
+				return fsx.ErrDirNotEmpty
+			}
+		}
+
+		if err := tx.unlink(r.dir, r.base, r.ino, r.n); err != nil {
+			return err
+		}
+		return tx.touch(r.dir)
+	})
+	if err != nil {
+		return pathError("Remove", name, err)
+	}
+	return nil
+}
+
+// RemoveAll removes name and all of its children. It returns nil if name does
+// not exist.
+func (fsys *kvfs) RemoveAll(name string) error {
+	err := fsys.update(func(tx *txn) error {
+		r, err := tx.resolve(name, false)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if r.ino == 0 {
+			return nil
+		}
+		if r.ino == rootIno {
+			return fs.ErrInvalid
+		}
+
+		if err := tx.removeAll(r.dir, r.base, r.ino); err != nil {
+			return err
+		}
+		return tx.touch(r.dir)
+	})
+	if err != nil {
+		return pathError("RemoveAll", name, err)
+	}
+	return nil
+}
+
+// Rename renames oldpath to newpath by moving a single directory entry. If
+// newpath exists and is not a non-empty directory, it is replaced.
+func (fsys *kvfs) Rename(oldpath, newpath string) error {
+	err := fsys.update(func(tx *txn) error {
+		from, err := tx.resolve(oldpath, false)
+		if err != nil {
+			return err
+		}
+		if from.ino == 0 {
+			return fs.ErrNotExist
+		}
+		if from.ino == rootIno {
+			return fs.ErrInvalid
+		}
+
+		to, err := tx.resolve(newpath, false)
+		if err != nil {
+			return err
+		}
+
+		if to.ino == from.ino {
+			return nil
+		}
+
+		if from.n.Mode.IsDir() {
+			// Make sure the directory is not moved into itself.
+			for d := to.dir; d != rootIno; {
+				if d == from.ino {
+					return fs.ErrInvalid
+				}
+				d, err = tx.parent(d)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if to.ino != 0 {
+			switch {
+			case to.n.Mode.IsDir() != from.n.Mode.IsDir():
+				return fs.ErrExist
+			case to.n.Mode.IsDir():
+				nonEmpty, err := tx.hasChildren(to.ino)
+				if err != nil {
+					return err
+				}
+				if nonEmpty {
+					return fsx.ErrDirNotEmpty
+				}
+			}
+
+			if err := tx.unlink(to.dir, to.base, to.ino, to.n); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.kv.Delete(direntKey(from.dir, from.base)); err != nil {
+			return err
+		}
+		if err := tx.putDirent(to.dir, to.base, from.ino); err != nil {
+			return err
+		}
+
+		if from.n.Mode.IsDir() {
+			if err := tx.putParent(from.ino, to.dir); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.touch(from.dir); err != nil {
+			return err
+		}
+		return tx.touch(to.dir)
+	})
+	if err != nil {
+		return pathError("Rename", oldpath, err)
+	}
+	return nil
+}
+
+// SameFile reports whether fi1 and fi2 describe the same inode.
+func (fsys *kvfs) SameFile(fi1, fi2 fs.FileInfo) bool {
+	i1, ok := fi1.(*fileInfo)
+	if !ok {
+		return false
+	}
+
+	i2, ok := fi2.(*fileInfo)
+	if !ok {
+		return false
+	}
+
+	return i1.ino == i2.ino
+}
+
+// -- fsx.ChmodFS, fsx.ChownFS, fsx.ChtimesFS
+
+// Chmod changes the permission of the named file.
+func (fsys *kvfs) Chmod(name string, mode fs.FileMode) error {
+	return fsys.modify("Chmod", name, true, func(n *inode) {
+		n.Mode = n.Mode.Type() | mode.Perm()
+	})
+}
+
+// Chown changes the numeric owner and group of the named file.
+func (fsys *kvfs) Chown(name string, uid, gid int) error {
+	return fsys.modify("Chown", name, true, func(n *inode) {
+		n.Uid, n.Gid = uid, gid
+	})
+}
+
+// Chtimes changes the access and modification time of the named file. A zero
+// value keeps the current value.
+func (fsys *kvfs) Chtimes(name string, atime, mtime time.Time) error {
+	return fsys.modify("Chtimes", name, true, func(n *inode) {
+		if !atime.IsZero() {
+			n.Atime = atime
+		}
+		if !mtime.IsZero() {
+			n.Mtime = mtime
+		}
+	})
+}
+
+// -- fsx.LinkFS
+
+// Readlink returns the target of the symlink name.
+func (fsys *kvfs) Readlink(name string) (string, error) {
+	var target string
+	err := fsys.view(func(tx *txn) error {
+		r, err := tx.resolve(name, false)
+		if err != nil {
+			return err
+		}
+		if r.ino == 0 {
+			return fs.ErrNotExist
+		}
+		if r.n.Mode&fs.ModeSymlink == 0 {
+			return fs.ErrInvalid
+		}
+		target = r.n.Target
+		return nil
+	})
+	if err != nil {
+		return "", pathError("Readlink", name, err)
+	}
+	return target, nil
+}
+
+// Link creates newname as a hard link to oldname. Directories cannot be
+// linked.
+func (fsys *kvfs) Link(oldname, newname string) error {
+	err := fsys.update(func(tx *txn) error {
+		from, err := tx.resolve(oldname, false)
+		if err != nil {
+			return err
+		}
+		if from.ino == 0 {
+			return fs.ErrNotExist
+		}
+		if from.n.Mode.IsDir() {
+			return fs.ErrInvalid
+		}
+
+		to, err := tx.resolve(newname, false)
+		if err != nil {
+			return err
+		}
+		if to.ino != 0 {
+			return fs.ErrExist
+		}
+
+		from.n.Nlink++
+		if err := tx.putInode(from.ino, from.n); err != nil {
+			return err
+		}
+		if err := tx.putDirent(to.dir, to.base, from.ino); err != nil {
+			return err
+		}
+		return tx.touch(to.dir)
+	})
+	if err != nil {
+		return pathError("Link", newname, err)
+	}
+	return nil
+}
+
+// Symlink creates newname as a symlink to oldname. oldname is interpreted
+// relative to the filesystem's root and does not need to exist.
+func (fsys *kvfs) Symlink(oldname, newname string) error {
+	err := fsys.update(func(tx *txn) error {
+		if !fs.ValidPath(oldname) {
+			return fs.ErrInvalid
+		}
+
+		to, err := tx.resolve(newname, false)
+		if err != nil {
+			return err
+		}
+		if to.ino != 0 {
+			return fs.ErrExist
+		}
+
+		ino, err := tx.nextIno()
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if err := tx.putInode(ino, &inode{Mode: fs.ModeSymlink | 0777, Atime: now, Mtime: now, Nlink: 1, Target: oldname}); err != nil {
+			return err
+		}
+		if err := tx.putDirent(to.dir, to.base, ino); err != nil {
+			return err
+		}
+		return tx.touch(to.dir)
+	})
+	if err != nil {
+		return pathError("Symlink", newname, err)
+	}
+	return nil
+}
+
+// -- fs.StatFS, fs.ReadDirFS, fs.ReadFileFS
+
+func (fsys *kvfs) stat(op, name string, followLast bool) (fs.FileInfo, error) {
+	var info fs.FileInfo
+	err := fsys.view(func(tx *txn) error {
+		r, err := tx.resolve(name, followLast)
+		if err != nil {
+			return err
+		}
+		if r.ino == 0 {
+			return fs.ErrNotExist
+		}
+		info = &fileInfo{name: name, ino: r.ino, n: r.n}
+		return nil
+	})
+	if err != nil {
+		return nil, pathError(op, name, err)
+	}
+	return info, nil
+}
+
+// Stat returns a fs.FileInfo describing the named file following symlinks.
+func (fsys *kvfs) Stat(name string) (fs.FileInfo, error) {
+	return fsys.stat("Stat", name, true)
+}
+
+// Lstat returns a fs.FileInfo describing the named file without following a
+// final symlink.
+func (fsys *kvfs) Lstat(name string) (fs.FileInfo, error) {
+	return fsys.stat("Lstat", name, false)
+}
+
+// ReadDir returns the sorted entries of the named directory.
+func (fsys *kvfs) ReadDir(name string) ([]fs.DirEntry, error) {
+	var entries []fs.DirEntry
+	err := fsys.view(func(tx *txn) error {
+		r, err := tx.resolve(name, true)
+		if err != nil {
+			return err
+		}
+		if r.ino == 0 {
+			return fs.ErrNotExist
+		}
+		if !r.n.Mode.IsDir() {
+			return fs.ErrInvalid
+		}
+		entries, err = fsys.readDir(tx, name, r.ino)
+		return err
+	})
+	if err != nil {
+		return nil, pathError("ReadDir", name, err)
+	}
+	return entries, nil
+}
+
+// ReadFile returns the content of the named file.
+func (fsys *kvfs) ReadFile(name string) ([]byte, error) {
+	var data []byte
+	err := fsys.view(func(tx *txn) error {
+		r, err := tx.resolve(name, true)
+		if err != nil {
+			return err
+		}
+		if r.ino == 0 {
+			return fs.ErrNotExist
+		}
+		if r.n.Mode.IsDir() {
+			return buffile.ErrIsDirectory
+		}
+
+		data, err = tx.kv.Get(dataKey(r.ino))
+		if errors.Is(err, ErrKeyNotFound) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, pathError("ReadFile", name, err)
+	}
+	return data, nil
+}
+
+var _ FS = &kvfs{}
@@ -0,0 +1,243 @@
+package kvfs
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	. "github.com/halimath/fixture"
+	"github.com/halimath/fsx"
+)
+
+type kvfsFixture struct {
+	kv *MemKV
+	fs FS
+}
+
+func (f *kvfsFixture) BeforeEach(t *testing.T) error {
+	f.kv = NewMemKV()
+
+	var err error
+	f.fs, err = New(f.kv)
+	if err != nil {
+		return err
+	}
+
+	if err := fsx.MkdirAll(f.fs, "etc/ssl", 0755); err != nil {
+		return err
+	}
+	if err := fsx.WriteFile(f.fs, "etc/hosts", []byte("127.0.0.1 localhost\n"), 0644); err != nil {
+		return err
+	}
+	if err := fsx.WriteFile(f.fs, "etc/ssl/cert.pem", []byte("cert"), 0600); err != nil {
+		return err
+	}
+	return f.fs.Symlink("etc/hosts", "hosts")
+}
+
+func TestKVFS(t *testing.T) {
+	With(t, new(kvfsFixture)).
+		Run("fstest", func(t *testing.T, f *kvfsFixture) {
+			expect.That(t, is.NoError(fstest.TestFS(f.fs, "etc/hosts", "etc/ssl/cert.pem", "hosts")))
+		}).
+		Run("readAndWrite", func(t *testing.T, f *kvfsFixture) {
+			content, err := fs.ReadFile(f.fs, "hosts")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "127.0.0.1 localhost\n"))
+
+			file, err := f.fs.OpenFile("hosts", fsx.O_WRONLY|fsx.O_APPEND, 0)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			_, err = file.Write([]byte("::1 localhost\n"))
+			expect.That(t, is.NoError(err), is.NoError(file.Close()))
+
+			info, err := f.fs.Stat("etc/hosts")
+			expect.That(t, is.NoError(err), is.EqualTo(info.Size(), int64(34)))
+		}).
+		Run("createExclusive", func(t *testing.T, f *kvfsFixture) {
+			_, err := f.fs.OpenFile("etc/hosts", fsx.O_WRONLY|fsx.O_CREATE|fsx.O_EXCL, 0644)
+			expect.That(t, is.Error(err, fs.ErrExist))
+
+			_, err = f.fs.OpenFile("missing/file", fsx.O_WRONLY|fsx.O_CREATE, 0644)
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+		}).
+		Run("mkdirAndRemove", func(t *testing.T, f *kvfsFixture) {
+			keys := f.kv.Len()
+
+			expect.That(t,
+				is.NoError(f.fs.Mkdir("var", 0700)),
+				is.Error(f.fs.Mkdir("var", 0700), fs.ErrExist),
+				is.Error(f.fs.Mkdir("missing/child", 0700), fs.ErrNotExist),
+				is.Error(f.fs.Remove("etc"), fsx.ErrDirNotEmpty),
+				is.NoError(f.fs.Remove("var")),
+				is.Error(f.fs.Remove("var"), fs.ErrNotExist),
+				is.EqualTo(f.kv.Len(), keys),
+				is.NoError(f.fs.RemoveAll("etc")),
+				is.NoError(f.fs.RemoveAll("etc")),
+			)
+
+			// Only the root inode, the counter and the dangling symlink remain.
+			expect.That(t, is.DeepEqualTo(scanKeys(t, f.kv, "d/"), []string{}), is.EqualTo(f.kv.Len(), 4))
+		}).
+		Run("rename", func(t *testing.T, f *kvfsFixture) {
+			before := snapshot(t, f.kv)
+
+			expect.That(t, expect.FailNow(is.NoError(f.fs.Rename("etc", "config"))))
+
+			after := snapshot(t, f.kv)
+			var changed []string
+			for k, v := range after {
+				if before[k] != v {
+					changed = append(changed, k)
+				}
+			}
+			for k := range before {
+				if _, ok := after[k]; !ok {
+					changed = append(changed, k)
+				}
+			}
+
+			// The two dirents plus the moved directory's parent and the
+			// modification times of the affected directories.
+			for _, k := range changed {
+				expect.That(t, is.EqualTo(strings.HasPrefix(k, "e/") || strings.HasPrefix(k, "p/") || k == inodeKey(rootIno), true))
+			}
+
+			_, err := f.fs.Stat("etc/hosts")
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+
+			content, err := fs.ReadFile(f.fs, "config/ssl/cert.pem")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "cert"))
+
+			expect.That(t,
+				is.Error(f.fs.Rename("config", "config/ssl/sub"), fs.ErrInvalid),
+				is.NoError(f.fs.Rename("config/hosts", "config/ssl/cert.pem")),
+			)
+
+			content, err = fs.ReadFile(f.fs, "config/ssl/cert.pem")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "127.0.0.1 localhost\n"))
+		}).
+		Run("link", func(t *testing.T, f *kvfsFixture) {
+			expect.That(t,
+				expect.FailNow(is.NoError(f.fs.Link("etc/hosts", "hosts.bak"))),
+				is.Error(f.fs.Link("etc", "etc2"), fs.ErrInvalid),
+				is.Error(f.fs.Link("etc/hosts", "hosts"), fs.ErrExist),
+			)
+
+			expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(f.fs, "hosts.bak", []byte("::1 localhost\n"), 0644))))
+
+			content, err := fs.ReadFile(f.fs, "etc/hosts")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "::1 localhost\n"))
+
+			i1, _ := f.fs.Stat("etc/hosts")
+			i2, _ := f.fs.Stat("hosts.bak")
+			expect.That(t,
+				is.EqualTo(f.fs.SameFile(i1, i2), true),
+				is.EqualTo(i1.Sys().(Stat).Nlink, 2),
+			)
+
+			expect.That(t, is.NoError(f.fs.Remove("etc/hosts")))
+
+			content, err = fs.ReadFile(f.fs, "hosts.bak")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "::1 localhost\n"))
+		}).
+		Run("symlink", func(t *testing.T, f *kvfsFixture) {
+			target, err := f.fs.Readlink("hosts")
+			expect.That(t, is.NoError(err), is.EqualTo(target, "etc/hosts"))
+
+			info, err := f.fs.Lstat("hosts")
+			expect.That(t, is.NoError(err), is.EqualTo(info.Mode()&fs.ModeSymlink, fs.ModeSymlink))
+
+			expect.That(t,
+				is.NoError(f.fs.Symlink("etc", "config")),
+				is.Error(f.fs.Symlink("etc", "config"), fs.ErrExist),
+				is.NoError(f.fs.Symlink("missing", "dangling")),
+			)
+
+			content, err := fs.ReadFile(f.fs, "config/ssl/cert.pem")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "cert"))
+
+			_, err = f.fs.Stat("dangling")
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+
+			_, err = f.fs.Readlink("etc/hosts")
+			expect.That(t, is.Error(err, fs.ErrInvalid))
+		}).
+		Run("metadata", func(t *testing.T, f *kvfsFixture) {
+			changed := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+			expect.That(t,
+				is.NoError(f.fs.Chmod("hosts", 0600)),
+				is.NoError(f.fs.Chown("etc/hosts", 1000, 100)),
+				is.NoError(f.fs.Chtimes("etc/hosts", time.Time{}, changed)),
+			)
+
+			info, err := f.fs.Stat("etc/hosts")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			expect.That(t,
+				is.EqualTo(info.Mode(), fs.FileMode(0600)),
+				is.EqualTo(info.ModTime().UTC(), changed),
+				is.EqualTo(info.Sys().(Stat).Uid, 1000),
+				is.EqualTo(info.Sys().(Stat).Gid, 100),
+			)
+		}).
+		Run("readDir", func(t *testing.T, f *kvfsFixture) {
+			entries, err := f.fs.ReadDir(".")
+			expect.That(t, expect.FailNow(is.NoError(err)), expect.FailNow(is.SliceOfLen(entries, 2)))
+
+			expect.That(t,
+				is.EqualTo(entries[0].Name(), "etc"),
+				is.EqualTo(entries[0].IsDir(), true),
+				is.EqualTo(entries[1].Name(), "hosts"),
+				is.EqualTo(entries[1].Type(), fs.ModeSymlink),
+			)
+		})
+}
+
+func snapshot(t *testing.T, kv KV) map[string]string {
+	t.Helper()
+
+	m := make(map[string]string)
+	if err := kv.Scan("", func(key string, value []byte) error {
+		m[key] = string(value)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestKVFS_persistent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fs.log")
+
+	kv, err := OpenFileKV(path)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	fsys, err := New(kv)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	expect.That(t,
+		is.NoError(fsys.Mkdir("docs", 0755)),
+		is.NoError(fsx.WriteFile(fsys, "docs/index.md", []byte("# Docs\n"), 0644)),
+		is.NoError(fsys.Rename("docs", "pages")),
+		is.NoError(kv.Close()),
+	)
+
+	kv, err = OpenFileKV(path)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	defer kv.Close()
+
+	fsys, err = New(kv)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	content, err := fs.ReadFile(fsys, "pages/index.md")
+	expect.That(t, is.NoError(err), is.EqualTo(string(content), "# Docs\n"))
+
+	expect.That(t, is.NoError(fsx.WriteFile(fsys, "pages/new.md", nil, 0644)))
+
+	entries, err := fsys.ReadDir("pages")
+	expect.That(t, is.NoError(err), is.SliceOfLen(entries, 2))
+}
@@ -20,6 +20,9 @@ type dir struct {
 	uid, gid     int
 	perm         fs.FileMode
 	children     map[string]entry
+	// names maps the keys of the children's names to the sorted names
+	// sharing that key. It is only maintained if names are compared by keys.
+	names map[string][]string
 }
 
 func (d *dir) stat(fsys *memfs, path string) (fs.FileInfo, error) {
@@ -109,9 +112,10 @@ func lsplit(name string) (dir, remainder string) {
 }
 
 // find finds the named entry inside d and returns it. It returns nil if the
-// entry cannot be found.
-func (d *dir) find(name string) entry {
-	if len(name) == 0 {
+// entry cannot be found. If key is not nil, names are compared by the keys
+// returned from key.
+func (d *dir) find(key func(string) string, name string) entry {
+	if len(name) == 0 || name == "." {
 		return d
 	}
 
@@ -121,10 +125,11 @@ func (d *dir) find(name string) entry {
 	dirName, remainder := lsplit(name)
 
 	if len(dirName) == 0 {
-		return d.children[remainder]
+		_, e, _ := d.child(key, remainder)
+		return e
 	}
 
-	c, ok := d.children[dirName]
+	_, c, ok := d.child(key, dirName)
 	if !ok {
 		return nil
 	}
@@ -134,7 +139,71 @@ func (d *dir) find(name string) entry {
 		return nil
 	}
 
-	return subDir.find(remainder)
+	return subDir.find(key, remainder)
+}
+
+// child returns the stored name and the entry of d's child matching name.
+// A child named exactly name is preferred. Otherwise, if key is not nil, the
+// lexically smallest child sharing name's key matches. d must be locked by
+// the caller.
+func (d *dir) child(key func(string) string, name string) (string, entry, bool) {
+	if e, ok := d.children[name]; ok {
+		return name, e, true
+	}
+
+	if key == nil {
+		return "", nil, false
+	}
+
+	names := d.names[key(name)]
+	if len(names) == 0 {
+		return "", nil, false
+	}
+	return names[0], d.children[names[0]], true
+}
+
+// setChild stores e as d's child name. d must be locked by the caller.
+func (d *dir) setChild(key func(string) string, name string, e entry) {
+	if _, ok := d.children[name]; !ok && key != nil {
+		if d.names == nil {
+			d.names = make(map[string][]string)
+		}
+
+		k := key(name)
+		names := d.names[k]
+		i := sort.SearchStrings(names, name)
+		names = append(names, "")
+		copy(names[i+1:], names[i:])
+		names[i] = name
+		d.names[k] = names
+	}
+
+	d.children[name] = e
+}
+
+// removeChild removes d's child name. d must be locked by the caller.
+func (d *dir) removeChild(key func(string) string, name string) {
+	if _, ok := d.children[name]; !ok {
+		return
+	}
+	delete(d.children, name)
+
+	if key == nil {
+		return
+	}
+
+	k := key(name)
+	names := d.names[k]
+	i := sort.SearchStrings(names, name)
+	if i < len(names) && names[i] == name {
+		names = append(names[:i], names[i+1:]...)
+	}
+
+	if len(names) == 0 {
+		delete(d.names, k)
+	} else {
+		d.names[k] = names
+	}
 }
 
 func newDir(perm fs.FileMode) *dir {
@@ -158,6 +227,7 @@ type dirHandle struct {
 	entries        []fs.DirEntry
 	lastEntryIndex int
 	writable       bool
+	closed         bool
 }
 
 func (d *dirHandle) Stat() (fs.FileInfo, error) {
@@ -189,6 +259,15 @@ func (d *dirHandle) Write([]byte) (int, error) {
 }
 
 func (d *dirHandle) Close() error {
+	if d.closed {
+		return &fs.PathError{
+			Op:   "Close",
+			Path: d.path,
+			Err:  fs.ErrClosed,
+		}
+	}
+	d.closed = true
+
 	if d.writable {
 		d.mtime = time.Now()
 		d.atime = d.mtime
@@ -256,16 +335,17 @@ func (d *dirHandle) ReadDir(n int) ([]fs.DirEntry, error) {
 		}
 	}
 
-	if d.lastEntryIndex >= len(d.entries) {
-		return nil, io.EOF
-	}
-
 	if n <= 0 {
-		ret := make([]fs.DirEntry, len(d.entries))
-		copy(ret, d.entries)
+		ret := make([]fs.DirEntry, len(d.entries)-d.lastEntryIndex)
+		copy(ret, d.entries[d.lastEntryIndex:])
+		d.lastEntryIndex = len(d.entries)
 		return ret, nil
 	}
 
+	if d.lastEntryIndex >= len(d.entries) {
+		return nil, io.EOF
+	}
+
 	max := d.lastEntryIndex + n
 	if max > len(d.entries) {
 		max = len(d.entries)
@@ -50,8 +50,8 @@ func TestDir_find(t *testing.T) {
 	}
 
 	expect.That(t,
-		is.EqualTo(d.find("some/nested/file"), entry(f)),
-		is.EqualTo(d.find("some/nested/file/subfile"), nil),
+		is.EqualTo(d.find(nil, "some/nested/file"), entry(f)),
+		is.EqualTo(d.find(nil, "some/nested/file/subfile"), nil),
 	)
 }
 
@@ -240,6 +240,24 @@ func TestDirHandle_ReadDir(t *testing.T) {
 					},
 				}),
 			)
+		}).
+		Run("(2)(-1)", func(t *testing.T, d *dirFixture) {
+			_, err := d.h.ReadDir(2)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			// ReadDir(-1) returns the remaining entries only.
+			e, err := d.h.ReadDir(-1)
+			expect.That(t,
+				expect.FailNow(is.NoError(err)),
+				expect.FailNow(is.EqualTo(len(e), 2)),
+				is.EqualTo(e[0].Name(), "f1"),
+				is.EqualTo(e[1].Name(), "f2"),
+			)
+
+			// At the end of the directory, ReadDir(-1) returns an empty slice
+			// and no error.
+			e, err = d.h.ReadDir(-1)
+			expect.That(t, is.NoError(err), is.EqualTo(len(e), 0))
 		})
 }
 
@@ -250,3 +268,13 @@ func TestDirHandle_Seek(t *testing.T) {
 			expect.That(t, is.Error(err, ErrIsDirectory))
 		})
 }
+
+func TestDirHandle_Close(t *testing.T) {
+	fixture.With(t, new(dirFixture)).
+		Run("twice", func(t *testing.T, d *dirFixture) {
+			expect.That(t,
+				is.NoError(d.h.Close()),
+				is.Error(d.h.Close(), fs.ErrClosed),
+			)
+		})
+}
@@ -17,6 +17,11 @@ type file struct {
 	uid, gid     int
 	perm         fs.FileMode
 	content      []byte
+
+	// digestMu guards digests which caches content digests by algorithm
+	// name. The cache is reset whenever a writable handle is closed.
+	digestMu sync.Mutex
+	digests  map[string][]byte
 }
 
 func newFile(perm fs.FileMode, content []byte) *file {
@@ -81,6 +86,10 @@ func (f *file) open(fsys *memfs, path string, flag int) (fsx.File, error) {
 			handle.append = true
 		}
 		f.Lock()
+		if flag&fsx.O_TRUNC != 0 {
+			handle.buf = nil
+			handle.resize("open", 0)
+		}
 	} else {
 		f.RLock()
 	}
@@ -126,6 +135,7 @@ type fileHandle struct {
 	fsys                       *memfs
 	path                       string
 	readable, writable, append bool
+	closed                     bool
 	flag                       int
 	buf                        []byte
 	cursor                     int
@@ -138,6 +148,15 @@ func min(a, b int) int {
 	return b
 }
 
+// resize accounts for the new size of f's content. Handles not opened from a
+// memfs are not accounted.
+func (f *fileHandle) resize(op string, size int) error {
+	if f.fsys == nil {
+		return nil
+	}
+	return f.fsys.acct.resize(op, f.path, f.file, int64(size))
+}
+
 func (f *fileHandle) Stat() (fs.FileInfo, error) {
 	return f.file.stat(f.fsys, f.path)
 }
@@ -182,6 +201,17 @@ func (f *fileHandle) Write(p []byte) (n int, err error) {
 		}
 	}
 
+	size := f.cursor + len(p)
+	if f.append {
+		size = len(f.buf) + len(p)
+	} else if size < len(f.buf) {
+		size = len(f.buf)
+	}
+
+	if err := f.resize("Write", size); err != nil {
+		return 0, err
+	}
+
 	if f.append {
 		f.buf = append(f.buf, p...)
 		return len(p), nil
@@ -201,8 +231,18 @@ func (f *fileHandle) Write(p []byte) (n int, err error) {
 }
 
 func (f *fileHandle) Close() error {
+	if f.closed {
+		return &fs.PathError{
+			Op:   "Close",
+			Path: f.path,
+			Err:  fs.ErrClosed,
+		}
+	}
+	f.closed = true
+
 	if f.writable {
 		f.file.content = f.buf
+		f.file.invalidateDigests()
 	}
 
 	if f.writable {
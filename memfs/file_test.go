@@ -295,3 +295,18 @@ func TestFile_ReadAt(t *testing.T) {
 		expect.That(t, is.Error(err, io.EOF))
 	})
 }
+
+func TestFileHandle_Close(t *testing.T) {
+	fsys := New()
+	expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(fsys, "f", []byte("hello"), 0644))))
+
+	for _, flag := range []int{fsx.O_RDONLY, fsx.O_RDWR} {
+		f, err := fsys.OpenFile("f", flag, 0)
+		expect.That(t, expect.FailNow(is.NoError(err)))
+
+		expect.That(t,
+			is.NoError(f.Close()),
+			is.Error(f.Close(), fs.ErrClosed),
+		)
+	}
+}
@@ -0,0 +1,216 @@
+package memfs
+
+import (
+	"io/fs"
+	"strings"
+	"testing/fstest"
+	"time"
+
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/internal/linkutil"
+)
+
+// WithRoot configures NewFrom to copy the tree rooted at dir inside the
+// source filesystem instead of the whole filesystem. Paths inside the created
+// memfs are relative to dir.
+func WithRoot(dir string) Option {
+	return func(o *options) {
+		o.srcRoot = dir
+	}
+}
+
+// WithFilter configures NewFrom to only copy entries for which filter returns
+// true. path is the entry's path relative to the source root. If filter
+// rejects a directory, the whole directory is skipped.
+func WithFilter(filter func(path string, d fs.DirEntry) bool) Option {
+	return func(o *options) {
+		o.filter = filter
+	}
+}
+
+// NewFrom creates a new in-memory filesystem containing a deep copy of the
+// tree found in src. This makes it easy to seed a memfs from fixtures provided
+// via embed.FS, fstest.MapFS or os.DirFS.
+//
+// NewFrom copies file contents, permissions and modification times. If src
+// provides a Readlink (or ReadLink) method, symlinks are copied as symlinks;
+// otherwise they are resolved using fs.Stat and copied as regular files.
+// Symlink targets are converted to be relative to the root of the created
+// memfs; targets read using ReadLink are relative to the link's directory
+// following the convention of os.DirFS. If a source entry reports a memfs Stat
+// from its Sys method, ownership and access times are copied as well.
+func NewFrom(src fs.FS, opts ...Option) (fsx.LinkFS, error) {
+	o := newOptions(opts)
+
+	fsys := newMemfs(o)
+
+	type dirTimes struct {
+		d    *dir
+		info fs.FileInfo
+	}
+	var dirs []dirTimes
+
+	err := fs.WalkDir(src, o.srcRoot, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel := relPath(o.srcRoot, p)
+
+		if rel != "." && o.filter != nil && !o.filter(rel, d) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if target, ok := linkutil.Readlink(src, p); ok && rel != "." {
+			if err := fsys.insert(rel, &symlink{targetPath: relPath(o.srcRoot, target)}); err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		info, err := fs.Stat(src, p)
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			var nd *dir
+			if rel == "." {
+				nd = fsys.root
+				nd.perm = info.Mode().Perm()
+			} else {
+				nd = newDir(info.Mode().Perm())
+				if err := fsys.insert(rel, nd); err != nil {
+					return err
+				}
+			}
+			// Times are applied after all children have been copied.
+			dirs = append(dirs, dirTimes{nd, info})
+			return nil
+		}
+
+		content, err := fs.ReadFile(src, p)
+		if err != nil {
+			return err
+		}
+
+		f := newFile(info.Mode().Perm(), content)
+		copyMetadata(info, &f.atime, &f.mtime, &f.uid, &f.gid)
+
+		return fsys.insert(rel, f)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range dirs {
+		copyMetadata(d.info, &d.d.atime, &d.d.mtime, &d.d.uid, &d.d.gid)
+	}
+
+	return fsys, nil
+}
+
+// copyMetadata copies times and ownership from info to the given targets.
+func copyMetadata(info fs.FileInfo, atime, mtime *time.Time, uid, gid *int) {
+	*mtime = info.ModTime()
+	*atime = info.ModTime()
+
+	if s, ok := info.Sys().(Stat); ok {
+		*atime = s.Atime
+		*uid = s.Uid
+		*gid = s.Gid
+	}
+}
+
+// relPath returns p relative to root. Both p and root are expected to be
+// valid fs paths.
+func relPath(root, p string) string {
+	if root == "." {
+		return p
+	}
+	if p == root {
+		return "."
+	}
+	return strings.TrimPrefix(p, root+"/")
+}
+
+// insert adds e as name to fsys. The parent directory of name must exist.
+func (fsys *memfs) insert(name string, e entry) error {
+	dirName, baseName := split(name)
+
+	parent, ok := fsys.root.find(fsys.key, dirName).(*dir)
+	if !ok {
+		return &fs.PathError{
+			Op:   "NewFrom",
+			Path: name,
+			Err:  fs.ErrNotExist,
+		}
+	}
+
+	if _, _, ok := parent.child(fsys.key, baseName); ok {
+		return &fs.PathError{
+			Op:   "NewFrom",
+			Path: name,
+			Err:  fs.ErrExist,
+		}
+	}
+
+	if err := fsys.acct.add("NewFrom", name, e); err != nil {
+		return err
+	}
+
+	parent.setChild(fsys.key, baseName, e)
+	return nil
+}
+
+// ToMapFS exports the tree found in fsys to a fstest.MapFS which can be
+// used with fstest.TestFS or compared to a map of expected entries. Symlinks
+// are followed, i.e. the resulting map contains the link targets' contents.
+// File contents, modes and modification times are preserved. The values
+// returned from Sys are also kept.
+func ToMapFS(fsys fs.FS) (fstest.MapFS, error) {
+	m := make(fstest.MapFS)
+
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if p == "." {
+			return nil
+		}
+
+		info, err := fs.Stat(fsys, p)
+		if err != nil {
+			return err
+		}
+
+		mf := &fstest.MapFile{
+			Mode:    info.Mode(),
+			ModTime: info.ModTime(),
+			Sys:     info.Sys(),
+		}
+
+		if !info.IsDir() {
+			mf.Data, err = fs.ReadFile(fsys, p)
+			if err != nil {
+				return err
+			}
+		}
+
+		m[p] = mf
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
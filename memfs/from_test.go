@@ -0,0 +1,137 @@
+package memfs
+
+import (
+	"embed"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	"github.com/halimath/fsx"
+)
+
+//go:embed testdata
+var testdata embed.FS
+
+func TestNewFrom(t *testing.T) {
+	mtime := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	src := fstest.MapFS{
+		"a.txt":         {Data: []byte("a"), Mode: 0600, ModTime: mtime},
+		"dir/b.txt":     {Data: []byte("b"), Mode: 0644, ModTime: mtime},
+		"dir/sub/c.txt": {Data: []byte("c"), Mode: 0644, ModTime: mtime},
+		"dir":           {Mode: fs.ModeDir | 0700, ModTime: mtime},
+	}
+
+	t.Run("mapfs", func(t *testing.T) {
+		fsys, err := NewFrom(src)
+		expect.That(t, expect.FailNow(is.NoError(err)))
+
+		info, err := fs.Stat(fsys, "a.txt")
+		expect.That(t,
+			is.NoError(err),
+			is.EqualTo(info.Mode(), 0600),
+			is.EqualTo(info.ModTime(), mtime),
+		)
+
+		info, err = fs.Stat(fsys, "dir")
+		expect.That(t,
+			is.NoError(err),
+			is.EqualTo(info.Mode(), fs.ModeDir|0700),
+			is.EqualTo(info.ModTime(), mtime),
+		)
+
+		got, err := fs.ReadFile(fsys, "dir/sub/c.txt")
+		expect.That(t, is.NoError(err), is.EqualTo(string(got), "c"))
+	})
+
+	t.Run("embed", func(t *testing.T) {
+		fsys, err := NewFrom(testdata, WithRoot("testdata"))
+		expect.That(t, expect.FailNow(is.NoError(err)))
+
+		_, err = fs.Stat(fsys, "tree.txtar")
+		expect.That(t, is.NoError(err))
+	})
+
+	t.Run("filter", func(t *testing.T) {
+		fsys, err := NewFrom(src, WithFilter(func(p string, d fs.DirEntry) bool {
+			return p != "dir/sub"
+		}))
+		expect.That(t, expect.FailNow(is.NoError(err)))
+
+		_, err = fs.Stat(fsys, "dir/b.txt")
+		expect.That(t, is.NoError(err))
+
+		_, err = fs.Stat(fsys, "dir/sub")
+		expect.That(t, is.Error(err, fs.ErrNotExist))
+	})
+
+	t.Run("symlinks", func(t *testing.T) {
+		m := New()
+		expect.That(t, expect.FailNow(
+			is.NoError(fsx.WriteFile(m, "f", []byte("hello"), 0644)),
+			is.NoError(m.Symlink("f", "l")),
+			is.NoError(fsx.Chown(m, "f", 1, 2)),
+		))
+
+		fsys, err := NewFrom(m)
+		expect.That(t, expect.FailNow(is.NoError(err)))
+
+		target, err := fsys.Readlink("l")
+		expect.That(t, is.NoError(err), is.EqualTo(target, "f"))
+
+		info, err := fs.Stat(fsys, "f")
+		expect.That(t, is.NoError(err), is.EqualTo(info.Sys().(Stat).Gid, 2))
+	})
+
+	t.Run("relativeSymlinks", func(t *testing.T) {
+		fsys, err := NewFrom(readLinkFS{fstest.MapFS{
+			"dir/f": {Data: []byte("hello"), Mode: 0644},
+			"dir/l": {Data: []byte("f"), Mode: fs.ModeSymlink | 0777},
+		}})
+		expect.That(t, expect.FailNow(is.NoError(err)))
+
+		target, err := fsys.Readlink("dir/l")
+		expect.That(t, is.NoError(err), is.EqualTo(target, "dir/f"))
+
+		got, err := fs.ReadFile(fsys, "dir/l")
+		expect.That(t, is.NoError(err), is.EqualTo(string(got), "hello"))
+	})
+}
+
+// readLinkFS stores symlink targets as file data and reports them relative to
+// the link's directory like os.DirFS.
+type readLinkFS struct {
+	fstest.MapFS
+}
+
+func (f readLinkFS) ReadLink(name string) (string, error) {
+	file, ok := f.MapFS[name]
+	if !ok || file.Mode&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return string(file.Data), nil
+}
+
+func TestToMapFS(t *testing.T) {
+	fsys, err := FromTxtar([]byte(`-- a.txt --
+hello
+-- dir/b.txt mode=0600 --
+world
+-- empty/ --
+-- link -> a.txt --
+`))
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	m, err := ToMapFS(fsys)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	expect.That(t,
+		is.EqualTo(string(m["link"].Data), "hello\n"),
+		is.EqualTo(m["dir/b.txt"].Mode, 0600),
+		is.EqualTo(m["empty"].Mode.IsDir(), true),
+		is.NoError(fstest.TestFS(m, "a.txt", "dir/b.txt", "link")),
+	)
+}
@@ -0,0 +1,81 @@
+package memfs
+
+import (
+	"hash"
+	"io/fs"
+
+	"github.com/halimath/fsx"
+)
+
+// digest returns the digest of f's content using the hash algorithm named
+// algorithm. Digests are cached until the content is modified.
+func (f *file) digest(algorithm string, newHash func() hash.Hash) []byte {
+	f.RLock()
+	defer f.RUnlock()
+
+	f.digestMu.Lock()
+	defer f.digestMu.Unlock()
+
+	if d, ok := f.digests[algorithm]; ok {
+		return d
+	}
+
+	h := newHash()
+	h.Write(f.content)
+	d := h.Sum(nil)
+
+	if f.digests == nil {
+		f.digests = make(map[string][]byte)
+	}
+	f.digests[algorithm] = d
+
+	return d
+}
+
+// invalidateDigests clears all cached digests.
+func (f *file) invalidateDigests() {
+	f.digestMu.Lock()
+	defer f.digestMu.Unlock()
+
+	f.digests = nil
+}
+
+// -- fsx.HashFS
+
+// FileHash returns the digest of the content of the regular file name
+// computed with a hash.Hash created by newHash. Digests are cached per file
+// and algorithm and are invalidated when a writable handle to the file is
+// closed.
+func (fsys *memfs) FileHash(name string, algorithm string, newHash func() hash.Hash) ([]byte, error) {
+	e := fsys.root.find(fsys.key, name)
+
+	// Resolve symlinks.
+	for i := 0; i < maxSymlinkDepth; i++ {
+		l, ok := e.(*symlink)
+		if !ok {
+			break
+		}
+		e = fsys.root.find(fsys.key, l.targetPath)
+	}
+
+	if e == nil {
+		return nil, &fs.PathError{
+			Op:   "FileHash",
+			Path: name,
+			Err:  fs.ErrNotExist,
+		}
+	}
+
+	f, ok := e.(*file)
+	if !ok {
+		return nil, &fs.PathError{
+			Op:   "FileHash",
+			Path: name,
+			Err:  fs.ErrInvalid,
+		}
+	}
+
+	return f.digest(algorithm, newHash), nil
+}
+
+var _ fsx.HashFS = &memfs{}
@@ -0,0 +1,41 @@
+package memfs
+
+import (
+	"crypto/sha256"
+	"hash"
+	"testing"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	"github.com/halimath/fsx"
+)
+
+func TestMemfs_FileHash(t *testing.T) {
+	fsys := New()
+	expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(fsys, "f", []byte("hello"), 0644))))
+
+	calls := 0
+	newHash := func() hash.Hash {
+		calls++
+		return sha256.New()
+	}
+
+	hfs := fsys.(fsx.HashFS)
+
+	d1, err := hfs.FileHash("f", "sha256", newHash)
+	expect.That(t, is.NoError(err), is.EqualTo(calls, 1))
+
+	d2, err := hfs.FileHash("f", "sha256", newHash)
+	expect.That(t, is.NoError(err), is.EqualTo(calls, 1), is.DeepEqualTo(d1, d2))
+
+	expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(fsys, "f", []byte("world"), 0644))))
+
+	d3, err := hfs.FileHash("f", "sha256", newHash)
+	expect.That(t, is.NoError(err), is.EqualTo(calls, 2))
+
+	want := sha256.Sum256([]byte("world"))
+	expect.That(t, is.DeepEqualTo(d3, want[:]))
+
+	tree, err := fsx.HashTree(fsys, ".", newHash, &fsx.HashTreeOptions{Algorithm: "sha256"})
+	expect.That(t, is.NoError(err), is.DeepEqualTo(tree.Find("f").ContentDigest, want[:]))
+}
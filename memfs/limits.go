@@ -0,0 +1,191 @@
+package memfs
+
+import (
+	"io/fs"
+	"sync"
+
+	"github.com/halimath/fsx"
+)
+
+// ErrNoSpace is returned when an operation would exceed one of the limits
+// configured with WithMaxSize, WithMaxFiles or WithMaxFileSize.
+// errors.Is(ErrNoSpace, syscall.ENOSPC) reports true on all platforms
+// defining ENOSPC.
+var ErrNoSpace error = noSpace{}
+
+type noSpace struct{}
+
+func (noSpace) Error() string { return "memfs: no space left" }
+
+// WithMaxSize limits the total number of bytes held by all files. A size of
+// 0 means unlimited.
+func WithMaxSize(size int64) Option {
+	return func(o *options) {
+		o.limits.size = size
+	}
+}
+
+// WithMaxFiles limits the number of entries (files, directories and symlinks)
+// held by the filesystem as reported by Usage. A value of 0 means unlimited.
+func WithMaxFiles(n int) Option {
+	return func(o *options) {
+		o.limits.files = n
+	}
+}
+
+// WithMaxFileSize limits the size of a single file. A size of 0 means
+// unlimited.
+func WithMaxFileSize(size int64) Option {
+	return func(o *options) {
+		o.limits.fileSize = size
+	}
+}
+
+// Usage describes the resources held by a memfs.
+type Usage struct {
+	// Bytes contains the sum of the sizes of all files. Files with multiple
+	// hard links are counted once. Data written to open files is included.
+	Bytes int64
+	// Entries contains the number of files, directories and symlinks,
+	// excluding the root directory. Files with multiple hard links are
+	// counted once.
+	Entries int
+}
+
+// UsageFS is implemented by all filesystems created by this package.
+type UsageFS interface {
+	fsx.LinkFS
+
+	// Usage returns the resources currently held by the filesystem.
+	Usage() Usage
+}
+
+// limits defines the limits of a memfs. A zero value means unlimited.
+type limits struct {
+	size     int64
+	files    int
+	fileSize int64
+}
+
+// accounted holds the accounting information of a single entry.
+type accounted struct {
+	links int
+	size  int64
+}
+
+// accounting tracks the resources held by a memfs and enforces its limits.
+// accounting's mutex must never be held while acquiring an entry's lock.
+type accounting struct {
+	mu      sync.Mutex
+	limits  limits
+	usage   Usage
+	entries map[entry]*accounted
+}
+
+func newAccounting(l limits) *accounting {
+	return &accounting{
+		limits:  l,
+		entries: make(map[entry]*accounted),
+	}
+}
+
+// add accounts for a new name referring to e. If e is not accounted yet, its
+// size is taken from its content and the limits are checked. Directories
+// must be empty when added.
+func (a *accounting) add(op, path string, e entry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if acc, ok := a.entries[e]; ok {
+		acc.links++
+		return nil
+	}
+
+	var size int64
+	if f, ok := e.(*file); ok {
+		size = int64(len(f.content))
+	}
+
+	if a.limits.files > 0 && a.usage.Entries+1 > a.limits.files ||
+		a.limits.fileSize > 0 && size > a.limits.fileSize ||
+		a.limits.size > 0 && a.usage.Bytes+size > a.limits.size {
+		return noSpaceError(op, path)
+	}
+
+	a.entries[e] = &accounted{links: 1, size: size}
+	a.usage.Entries++
+	a.usage.Bytes += size
+	return nil
+}
+
+// drop releases a name referring to e. If e is a directory, all names
+// contained in it are released as well. drop acquires the locks of all
+// directories contained in e and thus must not be called with a lock of one
+// of them held.
+func (a *accounting) drop(e entry) {
+	names := []entry{e}
+	for i := 0; i < len(names); i++ {
+		if d, ok := names[i].(*dir); ok {
+			d.RLock()
+			for _, c := range d.children {
+				names = append(names, c)
+			}
+			d.RUnlock()
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, e := range names {
+		acc, ok := a.entries[e]
+		if !ok {
+			continue
+		}
+
+		acc.links--
+		if acc.links == 0 {
+			delete(a.entries, e)
+			a.usage.Entries--
+			a.usage.Bytes -= acc.size
+		}
+	}
+}
+
+// resize changes the size accounted for f. Growing f fails if it exceeds a
+// limit. Files not referred to by any name are not accounted.
+func (a *accounting) resize(op, path string, f *file, size int64) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	acc, ok := a.entries[f]
+	if !ok {
+		return nil
+	}
+
+	if size > acc.size {
+		if a.limits.fileSize > 0 && size > a.limits.fileSize ||
+			a.limits.size > 0 && a.usage.Bytes+size-acc.size > a.limits.size {
+			return noSpaceError(op, path)
+		}
+	}
+
+	a.usage.Bytes += size - acc.size
+	acc.size = size
+	return nil
+}
+
+func (a *accounting) current() Usage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.usage
+}
+
+func noSpaceError(op, path string) error {
+	return &fs.PathError{
+		Op:   op,
+		Path: path,
+		Err:  ErrNoSpace,
+	}
+}
@@ -0,0 +1,137 @@
+package memfs
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	"github.com/halimath/fsx"
+)
+
+func expectUsage(t *testing.T, fsys fsx.LinkFS, want Usage) {
+	t.Helper()
+	expect.That(t, is.DeepEqualTo(fsys.(UsageFS).Usage(), want))
+}
+
+func TestMemfs_Usage(t *testing.T) {
+	fsys := New()
+
+	expect.That(t, expect.FailNow(
+		is.NoError(fsx.MkdirAll(fsys, "a/b", 0755)),
+		is.NoError(fsx.WriteFile(fsys, "a/b/f", []byte("hello"), 0644)),
+		is.NoError(fsx.WriteFile(fsys, "a/g", []byte("world!"), 0644)),
+		is.NoError(fsys.Link("a/b/f", "h")),
+		is.NoError(fsys.Symlink("a/g", "a/l")),
+	))
+
+	// The hard link h is counted once.
+	expectUsage(t, fsys, Usage{Bytes: 11, Entries: 5})
+
+	expect.That(t, is.NoError(fsys.Remove("a/b")))
+	expectUsage(t, fsys, Usage{Bytes: 11, Entries: 4})
+
+	expect.That(t, is.NoError(fsys.Remove("h")))
+	expectUsage(t, fsys, Usage{Bytes: 6, Entries: 3})
+
+	f, err := fsys.OpenFile("a/g", fsx.O_WRONLY|fsx.O_TRUNC, 0)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	expectUsage(t, fsys, Usage{Bytes: 0, Entries: 3})
+
+	_, err = f.Write([]byte("abc"))
+	expect.That(t, is.NoError(err))
+	expectUsage(t, fsys, Usage{Bytes: 3, Entries: 3})
+	expect.That(t, is.NoError(f.Close()))
+
+	expect.That(t,
+		is.NoError(fsx.WriteFile(fsys, "x", []byte("x"), 0644)),
+		is.NoError(fsys.Rename("x", "a/g")),
+	)
+	expectUsage(t, fsys, Usage{Bytes: 1, Entries: 3})
+}
+
+func TestMemfs_limits(t *testing.T) {
+	t.Run("maxSize", func(t *testing.T) {
+		fsys := New(WithMaxSize(10))
+
+		f, err := fsys.OpenFile("f", fsx.O_RDWR|fsx.O_CREATE, 0644)
+		expect.That(t, expect.FailNow(is.NoError(err)))
+
+		n, err := f.Write([]byte("12345678"))
+		expect.That(t, is.NoError(err), is.EqualTo(n, 8))
+
+		n, err = f.Write([]byte("abc"))
+		expect.That(t, is.Error(err, ErrNoSpace), is.EqualTo(n, 0))
+
+		// Overwriting existing data does not need additional space.
+		_, err = f.(interface {
+			Seek(int64, int) (int64, error)
+		}).Seek(0, fsx.SeekWhenceRelativeOrigin)
+		expect.That(t, is.NoError(err))
+		_, err = f.Write([]byte("abcdefghij"))
+		expect.That(t, is.NoError(err), is.NoError(f.Close()))
+
+		content, err := fs.ReadFile(fsys, "f")
+		expect.That(t, is.NoError(err), is.EqualTo(string(content), "abcdefghij"))
+
+		err = fsx.WriteFile(fsys, "g", []byte("x"), 0644)
+		expect.That(t, is.Error(err, ErrNoSpace))
+	})
+
+	t.Run("maxFileSize", func(t *testing.T) {
+		fsys := New(WithMaxFileSize(4))
+
+		expect.That(t,
+			is.NoError(fsx.WriteFile(fsys, "a", []byte("1234"), 0644)),
+			is.NoError(fsx.WriteFile(fsys, "b", []byte("1234"), 0644)),
+			is.Error(fsx.WriteFile(fsys, "c", []byte("12345"), 0644), ErrNoSpace),
+		)
+
+		f, err := fsys.OpenFile("a", fsx.O_WRONLY|fsx.O_APPEND, 0)
+		expect.That(t, expect.FailNow(is.NoError(err)))
+		_, err = f.Write([]byte("5"))
+		expect.That(t, is.Error(err, ErrNoSpace), is.NoError(f.Close()))
+
+		content, err := fs.ReadFile(fsys, "a")
+		expect.That(t, is.NoError(err), is.EqualTo(string(content), "1234"))
+	})
+
+	t.Run("maxFiles", func(t *testing.T) {
+		fsys := New(WithMaxFiles(3))
+
+		expect.That(t, expect.FailNow(
+			is.NoError(fsys.Mkdir("d", 0755)),
+			is.NoError(fsx.WriteFile(fsys, "d/f", nil, 0644)),
+			is.NoError(fsys.Symlink("d/f", "l")),
+		))
+
+		_, err := fsys.OpenFile("d/g", fsx.O_WRONLY|fsx.O_CREATE, 0644)
+		expect.That(t,
+			is.Error(err, ErrNoSpace),
+			is.Error(fsys.Mkdir("e", 0755), ErrNoSpace),
+			is.Error(fsys.Symlink("d/f", "m"), ErrNoSpace),
+			is.NoError(fsys.Link("d/f", "h")),
+		)
+
+		_, err = fs.ReadFile(fsys, "d/g")
+		expect.That(t, is.EqualTo(err != nil, true))
+
+		expect.That(t, is.NoError(fsys.Remove("l")), is.NoError(fsys.Mkdir("e", 0755)))
+		expectUsage(t, fsys, Usage{Entries: 3})
+	})
+
+	t.Run("newFrom", func(t *testing.T) {
+		src := fstest.MapFS{
+			"a": &fstest.MapFile{Data: []byte("12345"), Mode: 0644},
+			"b": &fstest.MapFile{Data: []byte("12345"), Mode: 0644},
+		}
+
+		_, err := NewFrom(src, WithMaxSize(8))
+		expect.That(t, is.Error(err, ErrNoSpace))
+
+		fsys, err := NewFrom(src, WithMaxSize(10))
+		expect.That(t, is.NoError(err))
+		expectUsage(t, fsys, Usage{Bytes: 10, Entries: 2})
+	})
+}
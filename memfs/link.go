@@ -14,7 +14,7 @@ type symlink struct {
 }
 
 func (l *symlink) stat(fsys *memfs, path string) (fs.FileInfo, error) {
-	e := fsys.root.find(l.targetPath)
+	e := fsys.root.find(fsys.key, l.targetPath)
 	if e == nil {
 		return nil, &fs.PathError{
 			Op:   "stat",
@@ -27,7 +27,7 @@ func (l *symlink) stat(fsys *memfs, path string) (fs.FileInfo, error) {
 }
 
 func (l *symlink) open(fsys *memfs, path string, flag int) (fsx.File, error) {
-	e := fsys.root.find(l.targetPath)
+	e := fsys.root.find(fsys.key, l.targetPath)
 	if e == nil {
 		return nil, &fs.PathError{
 			Op:   "open",
@@ -40,7 +40,7 @@ func (l *symlink) open(fsys *memfs, path string, flag int) (fsx.File, error) {
 }
 
 func (l *symlink) chmod(fsys *memfs, mode fs.FileMode) error {
-	e := fsys.root.find(l.targetPath)
+	e := fsys.root.find(fsys.key, l.targetPath)
 	if e == nil {
 		return &fs.PathError{
 			Op:   "chmod",
@@ -53,7 +53,7 @@ func (l *symlink) chmod(fsys *memfs, mode fs.FileMode) error {
 }
 
 func (l *symlink) chown(fsys *memfs, uid, gid int) error {
-	e := fsys.root.find(l.targetPath)
+	e := fsys.root.find(fsys.key, l.targetPath)
 	if e == nil {
 		return &fs.PathError{
 			Op:   "chown",
@@ -66,7 +66,7 @@ func (l *symlink) chown(fsys *memfs, uid, gid int) error {
 }
 
 func (l *symlink) chtimes(fsys *memfs, atime, mtime time.Time) error {
-	e := fsys.root.find(l.targetPath)
+	e := fsys.root.find(fsys.key, l.targetPath)
 	if e == nil {
 		return &fs.PathError{
 			Op:   "chtimes",
@@ -77,3 +77,7 @@ func (l *symlink) chtimes(fsys *memfs, atime, mtime time.Time) error {
 
 	return e.chtimes(fsys, atime, mtime)
 }
+
+// maxSymlinkDepth limits the number of symlinks resolved in a row to detect
+// cycles.
+const maxSymlinkDepth = 40
@@ -68,15 +68,69 @@ func split(p string) (dirName, fileName string) {
 
 type memfs struct {
 	root *dir
+	acct *accounting
+	// key maps names to the keys they are compared by. It is nil if names
+	// are compared as is.
+	key func(string) string
 }
 
-// New creates a new, empty in-memory filesystem.
-func New() fsx.LinkFS {
+// Option defines a function used to customize a memfs.
+type Option func(*options)
+
+type options struct {
+	// srcRoot defines the directory of the source filesystem to copy when
+	// using NewFrom.
+	srcRoot string
+	// filter is an optional predicate deciding which entries to copy when
+	// using NewFrom.
+	filter func(path string, d fs.DirEntry) bool
+	// limits defines the resource limits of the created memfs.
+	limits limits
+	// key maps names to the keys they are compared by.
+	key func(string) string
+}
+
+// WithFolding makes lookups case-insensitive and case-preserving the same
+// way as foldfs does: names are compared by the keys returned from key and
+// operations creating an entry fail with an error wrapping fs.ErrExist if an
+// entry with the same key but a different name exists. Use foldfs.KeyFunc to
+// compare names the same way as a foldfs.
+func WithFolding(key func(name string) string) Option {
+	return func(o *options) {
+		o.key = key
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		srcRoot: ".",
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// New creates a new, empty in-memory filesystem. Use WithMaxSize,
+// WithMaxFiles and WithMaxFileSize to limit the resources held by it and
+// WithFolding to make lookups case-insensitive.
+func New(opts ...Option) fsx.LinkFS {
+	return newMemfs(newOptions(opts))
+}
+
+func newMemfs(o options) *memfs {
 	return &memfs{
 		root: newDir(0777),
+		acct: newAccounting(o.limits),
+		key:  o.key,
 	}
 }
 
+// Usage returns the resources currently held by fsys.
+func (fsys *memfs) Usage() Usage {
+	return fsys.acct.current()
+}
+
 // -- fs.FS
 
 // Open opens the named file.
@@ -89,7 +143,7 @@ func New() fsx.LinkFS {
 // ValidPath(name), returning a *PathError with Err set to
 // ErrInvalid or ErrNotExist.
 func (fsys *memfs) Open(name string) (fs.File, error) {
-	e := fsys.root.find(name)
+	e := fsys.root.find(fsys.key, name)
 	if e == nil {
 		return nil, &fs.PathError{
 			Op:   "Open",
@@ -111,7 +165,7 @@ func (fsys *memfs) OpenFile(filePath string, flag int, perm fs.FileMode) (fsx.Fi
 	fsys.root.RLock()
 
 	dirName, name := split(filePath)
-	parent := fsys.root.find(dirName)
+	parent := fsys.root.find(fsys.key, dirName)
 	if parent == nil {
 		fsys.root.RUnlock()
 		return nil, &fs.PathError{
@@ -136,7 +190,15 @@ func (fsys *memfs) OpenFile(filePath string, flag int, perm fs.FileMode) (fsx.Fi
 	parentDir.Lock()
 	defer parentDir.Unlock()
 
-	e, ok := parentDir.children[name]
+	stored, e, ok := parentDir.child(fsys.key, name)
+	if ok && stored != name && flag&fsx.O_CREATE != 0 {
+		return nil, &fs.PathError{
+			Op:   "OpenFile",
+			Path: filePath,
+			Err:  fs.ErrExist,
+		}
+	}
+
 	if !ok {
 		if flag&fsx.O_CREATE == 0 {
 			return nil, &fs.PathError{
@@ -155,7 +217,10 @@ func (fsys *memfs) OpenFile(filePath string, flag int, perm fs.FileMode) (fsx.Fi
 		}
 
 		e = newFile(perm, nil)
-		parentDir.children[name] = e
+		if err := fsys.acct.add("OpenFile", filePath, e); err != nil {
+			return nil, err
+		}
+		parentDir.setChild(fsys.key, name, e)
 	}
 
 	return e.open(fsys, filePath, flag)
@@ -166,7 +231,7 @@ func (fsys *memfs) OpenFile(filePath string, flag int, perm fs.FileMode) (fsx.Fi
 func (fsys *memfs) Mkdir(name string, perm fs.FileMode) error {
 	dirName, name := split(name)
 
-	e := fsys.root.find(dirName)
+	e := fsys.root.find(fsys.key, dirName)
 	if e == nil {
 		return &fs.PathError{
 			Op:   "Mkdir",
@@ -187,7 +252,24 @@ func (fsys *memfs) Mkdir(name string, perm fs.FileMode) error {
 	dir.Lock()
 	defer dir.Unlock()
 
-	dir.children[name] = newDir(perm)
+	stored, old, ok := dir.child(fsys.key, name)
+	if ok && stored != name {
+		return &fs.PathError{
+			Op:   "Mkdir",
+			Path: name,
+			Err:  fs.ErrExist,
+		}
+	}
+
+	nd := newDir(perm)
+	if err := fsys.acct.add("Mkdir", name, nd); err != nil {
+		return err
+	}
+
+	if ok {
+		fsys.acct.drop(old)
+	}
+	dir.setChild(fsys.key, name, nd)
 
 	return nil
 }
@@ -198,7 +280,7 @@ func (fsys *memfs) Remove(p string) error {
 
 	fsys.root.RLock()
 
-	e := fsys.root.find(d)
+	e := fsys.root.find(fsys.key, d)
 	if e == nil {
 		fsys.root.RUnlock()
 		return &fs.PathError{
@@ -223,7 +305,10 @@ func (fsys *memfs) Remove(p string) error {
 	parentDir.Lock()
 	defer parentDir.Unlock()
 
-	delete(parentDir.children, name)
+	if stored, e, ok := parentDir.child(fsys.key, name); ok {
+		parentDir.removeChild(fsys.key, stored)
+		fsys.acct.drop(e)
+	}
 
 	return nil
 }
@@ -235,7 +320,7 @@ func (fsys *memfs) Rename(oldpath, newpath string) error {
 
 	fsys.root.RLock()
 
-	old := fsys.root.find(oldparent)
+	old := fsys.root.find(fsys.key, oldparent)
 	if old == nil {
 		fsys.root.RUnlock()
 		return &fs.PathError{
@@ -245,7 +330,7 @@ func (fsys *memfs) Rename(oldpath, newpath string) error {
 		}
 	}
 
-	newD := fsys.root.find(newparent)
+	newD := fsys.root.find(fsys.key, newparent)
 	if newD == nil {
 		fsys.root.RUnlock()
 		return &fs.PathError{
@@ -283,7 +368,7 @@ func (fsys *memfs) Rename(oldpath, newpath string) error {
 		}
 	}
 
-	toRename, ok := oldDir.children[oldname]
+	storedOld, toRename, ok := oldDir.child(fsys.key, oldname)
 	if !ok {
 		return &fs.PathError{
 			Op:   "Rename",
@@ -292,14 +377,30 @@ func (fsys *memfs) Rename(oldpath, newpath string) error {
 		}
 	}
 
-	delete(oldDir.children, oldname)
-	newDir.children[newname] = toRename
+	// An entry only differing in spelling may be replaced by renaming the
+	// entry itself.
+	storedNew, replaced, ok := newDir.child(fsys.key, newname)
+	if ok && storedNew != newname && replaced != toRename {
+		return &fs.PathError{
+			Op:   "Rename",
+			Path: newpath,
+			Err:  fs.ErrExist,
+		}
+	}
+
+	oldDir.removeChild(fsys.key, storedOld)
+	newDir.setChild(fsys.key, newname, toRename)
+
+	if ok && replaced != toRename {
+		fsys.acct.drop(replaced)
+	}
 
 	return nil
 }
 
 // SameFile returns true iff fi1 and fi2 both represent the same
-// filesystem's file.
+// filesystem's file. Hard links created with Link are reported as the same
+// file.
 func (fsys *memfs) SameFile(fi1, fi2 fs.FileInfo) bool {
 	fix1, ok := fi1.(*fileInfo)
 	if !ok {
@@ -311,13 +412,18 @@ func (fsys *memfs) SameFile(fi1, fi2 fs.FileInfo) bool {
 		return false
 	}
 
-	return fix1.path == fix2.path
+	if fix1.path == fix2.path {
+		return true
+	}
+
+	e1 := fsys.root.find(fsys.key, fix1.path)
+	return e1 != nil && e1 == fsys.root.find(fsys.key, fix2.path)
 }
 
 // Chmod changes the mode of the named file to mode. This operation reflects
 // os.Chmod.
 func (fsys *memfs) Chmod(name string, mode fs.FileMode) error {
-	e := fsys.root.find(name)
+	e := fsys.root.find(fsys.key, name)
 	if e == nil {
 		return &fs.PathError{
 			Op:   "Chmod",
@@ -335,7 +441,7 @@ func (fsys *memfs) Chmod(name string, mode fs.FileMode) error {
 // Chown changes ownership of the named file to the numeric values given
 // as uid and gid.
 func (fsys *memfs) Chown(name string, uid, gid int) error {
-	e := fsys.root.find(name)
+	e := fsys.root.find(fsys.key, name)
 	if e == nil {
 		return &fs.PathError{
 			Op:   "Chown",
@@ -353,7 +459,7 @@ func (fsys *memfs) Chown(name string, uid, gid int) error {
 // Chtimes changes the access and modification time of the named file. A
 // zero value for either atime of mtime causes these values to be kept.
 func (fsys *memfs) Chtimes(name string, atime time.Time, mtime time.Time) error {
-	e := fsys.root.find(name)
+	e := fsys.root.find(fsys.key, name)
 	if e == nil {
 		return &fs.PathError{
 			Op:   "Chtimes",
@@ -372,7 +478,7 @@ func (fsys *memfs) Chtimes(name string, atime time.Time, mtime time.Time) error
 
 // Readlink returns the target of link name or an error.
 func (fsys *memfs) Readlink(name string) (string, error) {
-	e := fsys.root.find(name)
+	e := fsys.root.find(fsys.key, name)
 	if e == nil {
 		return "", &fs.PathError{
 			Op:   "Readlink",
@@ -395,7 +501,7 @@ func (fsys *memfs) Readlink(name string) (string, error) {
 
 // Link creates a hardlink newname pointing to oldname.
 func (fsys *memfs) Link(oldname, newname string) error {
-	e := fsys.root.find(oldname)
+	e := fsys.root.find(fsys.key, oldname)
 	if e == nil {
 		return &fs.PathError{
 			Op:   "Link",
@@ -405,7 +511,7 @@ func (fsys *memfs) Link(oldname, newname string) error {
 	}
 
 	dirname, linkname := split(newname)
-	de := fsys.root.find(dirname)
+	de := fsys.root.find(fsys.key, dirname)
 	if de == nil {
 		return &fs.PathError{
 			Op:   "Link",
@@ -423,7 +529,23 @@ func (fsys *memfs) Link(oldname, newname string) error {
 		}
 	}
 
-	d.children[linkname] = e
+	stored, old, ok := d.child(fsys.key, linkname)
+	if ok && stored != linkname {
+		return &fs.PathError{
+			Op:   "Link",
+			Path: newname,
+			Err:  fs.ErrExist,
+		}
+	}
+
+	if err := fsys.acct.add("Link", newname, e); err != nil {
+		return err
+	}
+
+	if ok {
+		fsys.acct.drop(old)
+	}
+	d.setChild(fsys.key, linkname, e)
 
 	return nil
 }
@@ -431,7 +553,7 @@ func (fsys *memfs) Link(oldname, newname string) error {
 // Symlink creates a symbolic link newname pointing to oldname. The behavior
 // when creating a symbolic link to a non-existing target is not specified.
 func (fsys *memfs) Symlink(oldname, newname string) error {
-	e := fsys.root.find(oldname)
+	e := fsys.root.find(fsys.key, oldname)
 	if e == nil {
 		return &fs.PathError{
 			Op:   "Symlink",
@@ -441,7 +563,7 @@ func (fsys *memfs) Symlink(oldname, newname string) error {
 	}
 
 	dirname, linkname := split(newname)
-	de := fsys.root.find(dirname)
+	de := fsys.root.find(fsys.key, dirname)
 	if de == nil {
 		return &fs.PathError{
 			Op:   "Symlink",
@@ -459,9 +581,26 @@ func (fsys *memfs) Symlink(oldname, newname string) error {
 		}
 	}
 
-	d.children[linkname] = &symlink{
+	stored, old, ok := d.child(fsys.key, linkname)
+	if ok && stored != linkname {
+		return &fs.PathError{
+			Op:   "Symlink",
+			Path: newname,
+			Err:  fs.ErrExist,
+		}
+	}
+
+	l := &symlink{
 		targetPath: oldname,
 	}
+	if err := fsys.acct.add("Symlink", newname, l); err != nil {
+		return err
+	}
+
+	if ok {
+		fsys.acct.drop(old)
+	}
+	d.setChild(fsys.key, linkname, l)
 
 	return nil
 }
@@ -478,7 +617,7 @@ func (fsys *memfs) Stat(path string) (fs.FileInfo, error) {
 	fsys.root.RLock()
 	defer fsys.root.RUnlock()
 
-	e := fsys.root.find(path)
+	e := fsys.root.find(fsys.key, path)
 	if e == nil {
 		return nil, &fs.PathError{
 			Op:   "Stat",
@@ -10,6 +10,7 @@ import (
 	"github.com/halimath/expect/is"
 	. "github.com/halimath/fixture"
 	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/foldfs"
 )
 
 type memfsFixture struct {
@@ -97,6 +98,15 @@ func TestMemfs_OpenFile(t *testing.T) {
 
 			_, err := f.fs.OpenFile("file", fsx.O_WRONLY, 0400)
 			expect.That(t, is.Error(err, fs.ErrPermission))
+		}).
+		Run("truncate", func(t *testing.T, f *memfsFixture) {
+			expect.That(t,
+				expect.FailNow(is.NoError(fsx.WriteFile(f.fs, "file", []byte("hello, world"), 0644))),
+				expect.FailNow(is.NoError(fsx.WriteFile(f.fs, "file", []byte("bye"), 0644))),
+			)
+
+			got, err := fs.ReadFile(f.fs, "file")
+			expect.That(t, is.NoError(err), is.EqualTo(string(got), "bye"))
 		})
 }
 
@@ -106,6 +116,15 @@ func TestMemfs_Open(t *testing.T) {
 			_, err := f.fs.Open("not_found")
 			expect.That(t, expect.FailNow(is.Error(err, fs.ErrNotExist)))
 		}).
+		Run("root", func(t *testing.T, f *memfsFixture) {
+			expect.That(t, expect.FailNow(is.NoError(f.fs.Mkdir("dir", 0777))))
+
+			info, err := fs.Stat(f.fs, ".")
+			expect.That(t, is.NoError(err), is.EqualTo(info.IsDir(), true))
+
+			entries, err := fs.ReadDir(f.fs, ".")
+			expect.That(t, is.NoError(err), expect.FailNow(is.EqualTo(len(entries), 1)), is.EqualTo(entries[0].Name(), "dir"))
+		}).
 		Run("success", func(t *testing.T, f *memfsFixture) {
 			file, err := f.fs.OpenFile("open", fsx.O_RDWR|fsx.O_CREATE, 0644)
 			expect.That(t, expect.FailNow(is.NoError(err)))
@@ -205,6 +224,18 @@ func TestMemfs_SameFile(t *testing.T) {
 			fi2, err := fs.Stat(f.fs, "f2")
 			expect.That(t, expect.FailNow(is.NoError(err)), is.EqualTo(f.fs.SameFile(fi1, fi2), false))
 
+		}).
+		Run("hardlink", func(t *testing.T, f *memfsFixture) {
+			expect.That(t, expect.FailNow(
+				is.NoError(fsx.WriteFile(f.fs, "f1", []byte("hello, world"), 0644)),
+				is.NoError(f.fs.Link("f1", "f2")),
+			))
+
+			fi1, err := fs.Stat(f.fs, "f1")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			fi2, err := fs.Stat(f.fs, "f2")
+			expect.That(t, expect.FailNow(is.NoError(err)), is.EqualTo(f.fs.SameFile(fi1, fi2), true))
 		})
 }
 
@@ -432,3 +463,39 @@ func TestMemfs_Readlink(t *testing.T) {
 
 		})
 }
+
+func TestMemfs_folding(t *testing.T) {
+	fsys := New(WithFolding(foldfs.KeyFunc()))
+
+	expect.That(t, expect.FailNow(
+		is.NoError(fsx.MkdirAll(fsys, "Docs", 0755)),
+		is.NoError(fsx.WriteFile(fsys, "Docs/README.md", []byte("readme"), 0644)),
+	))
+
+	data, err := fs.ReadFile(fsys, "docs/readme.md")
+	expect.That(t, is.NoError(err), is.EqualTo(string(data), "readme"))
+
+	_, err = fsys.OpenFile("DOCS/Readme.md", fsx.O_WRONLY|fsx.O_CREATE, 0644)
+	expect.That(t, is.Error(err, fs.ErrExist))
+
+	expect.That(t,
+		is.Error(fsys.Mkdir("docs", 0755), fs.ErrExist),
+		is.Error(fsys.Symlink("Docs/README.md", "docs/readme.md"), fs.ErrExist),
+		is.Error(fsys.Link("Docs/README.md", "docs/readme.md"), fs.ErrExist),
+		is.NoError(fsx.WriteFile(fsys, "docs/notes.md", []byte("notes"), 0644)),
+		is.Error(fsys.Rename("docs/notes.md", "docs/readme.md"), fs.ErrExist),
+		is.NoError(fsys.Rename("docs/readme.md", "docs/Readme.md")),
+		is.NoError(fsys.Remove("DOCS/NOTES.md")),
+	)
+
+	entries, err := fs.ReadDir(fsys, "docs")
+	expect.That(t,
+		is.NoError(err),
+		expect.FailNow(is.EqualTo(len(entries), 1)),
+		is.EqualTo(entries[0].Name(), "Readme.md"),
+	)
+
+	expect.That(t, is.NoError(fsys.Remove("docs/README.MD")))
+	_, err = fs.Stat(fsys, "docs/readme.md")
+	expect.That(t, is.Error(err, fs.ErrNotExist))
+}
@@ -0,0 +1,9 @@
+//go:build !plan9
+// +build !plan9
+
+package memfs
+
+import "syscall"
+
+// Is makes errors.Is(ErrNoSpace, syscall.ENOSPC) report true.
+func (noSpace) Is(target error) bool { return target == syscall.ENOSPC }
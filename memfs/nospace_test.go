@@ -0,0 +1,20 @@
+//go:build !plan9
+// +build !plan9
+
+package memfs
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	"github.com/halimath/fsx"
+)
+
+func TestErrNoSpace_errno(t *testing.T) {
+	fsys := New(WithMaxSize(1))
+
+	err := fsx.WriteFile(fsys, "f", []byte("ab"), 0644)
+	expect.That(t, is.Error(err, ErrNoSpace), is.Error(err, syscall.ENOSPC))
+}
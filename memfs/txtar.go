@@ -0,0 +1,25 @@
+package memfs
+
+import (
+	"io/fs"
+
+	"github.com/halimath/fsx"
+)
+
+// FromTxtar creates a new in-memory filesystem populated with the files,
+// directories and symlinks described by the txtar archive data. See
+// fsx.LoadTxtar for a description of the supported header annotations.
+func FromTxtar(data []byte) (fsx.LinkFS, error) {
+	fsys := New()
+	if err := fsx.LoadTxtar(fsys, data); err != nil {
+		return nil, err
+	}
+	return fsys, nil
+}
+
+// ToTxtar formats the tree contained in fsys as a txtar archive. The output is
+// deterministic and suitable to be used as a golden file. See fsx.DumpTxtar
+// for details.
+func ToTxtar(fsys fs.FS) ([]byte, error) {
+	return fsx.DumpTxtar(fsys)
+}
@@ -0,0 +1,34 @@
+package memfs
+
+import (
+	"io/fs"
+	"os"
+	"testing"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	"github.com/halimath/fsx"
+)
+
+func TestTxtar(t *testing.T) {
+	golden, err := os.ReadFile("testdata/tree.txtar")
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	fsys, err := FromTxtar(golden)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	got, err := fs.ReadFile(fsys, "README.md")
+	expect.That(t, is.NoError(err), is.EqualTo(string(got), "# Index\n"))
+
+	d, err := fsx.TxtarDiff(fsys, golden)
+	expect.That(t, is.NoError(err), is.EqualTo(d, ""))
+
+	data, err := ToTxtar(fsys)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	roundtrip, err := FromTxtar(data)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	d, err = fsx.TxtarDiff(roundtrip, golden)
+	expect.That(t, is.NoError(err), is.EqualTo(d, ""))
+}
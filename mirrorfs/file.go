@@ -0,0 +1,241 @@
+package mirrorfs
+
+import (
+	"io"
+	"io/fs"
+	"sync"
+
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/internal/wrapfs"
+)
+
+// file implements a fsx.File opened for writing on all backends. Backends
+// failing an operation are dropped from the file and marked divergent.
+type file struct {
+	fsys *mirrorfs
+	name string
+	// readable is set if the file has been opened with O_RDONLY or O_RDWR.
+	readable bool
+
+	mu sync.Mutex
+	// files contains the file opened on each backend or nil if the backend
+	// has been dropped.
+	files []fsx.File
+}
+
+// fanOut calls fn for all files not dropped concurrently, drops the files
+// fn fails for and evaluates the result using mirrorfs.result. It must be
+// called with f.mu held.
+func (f *file) fanOut(op string, fn func(i int, file fsx.File) error) error {
+	f.fsys.repair.RLock()
+	defer f.fsys.repair.RUnlock()
+
+	errs := make([]error, len(f.files))
+
+	var wg sync.WaitGroup
+	for i, file := range f.files {
+		if file == nil {
+			errs[i] = errDropped
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, file fsx.File) {
+			defer wg.Done()
+			errs[i] = fn(i, file)
+		}(i, file)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil && f.files[i] != nil {
+			f.files[i].Close()
+			f.files[i] = nil
+		}
+	}
+
+	return f.fsys.result(op, f.name, errs)
+}
+
+// primary returns the index of the first file not dropped in read order or
+// -1 if all files have been dropped. It must be called with f.mu held.
+func (f *file) primary() int {
+	for _, i := range f.fsys.readOrder() {
+		if f.files[i] != nil {
+			return i
+		}
+	}
+	return -1
+}
+
+// Stat returns a fs.FileInfo describing the file.
+func (f *file) Stat() (fs.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p := f.primary()
+	if p < 0 {
+		return nil, wrapfs.PathError("Stat", f.name, fs.ErrClosed)
+	}
+	return f.files[p].Stat()
+}
+
+// Read reads from the first backend's file not dropped and advances the
+// offsets of all other files accordingly. If reading fails, reading is
+// retried with the next file. Files failing to read are dropped only if
+// reading succeeds for another file; if reading fails for all files, the
+// first error is returned and no file is dropped.
+func (f *file) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.readable {
+		return 0, wrapfs.PathError("Read", f.name, fs.ErrPermission)
+	}
+
+	var failed []int
+	var first error
+
+	for _, i := range f.fsys.readOrder() {
+		if f.files[i] == nil {
+			continue
+		}
+
+		n, err := f.files[i].Read(p)
+		if err != nil && err != io.EOF {
+			if first == nil {
+				first = err
+			}
+			failed = append(failed, i)
+			continue
+		}
+
+		for _, j := range failed {
+			f.drop(j)
+		}
+
+		if n > 0 {
+			f.advance(i, int64(n))
+		}
+
+		return n, err
+	}
+
+	if first == nil {
+		return 0, wrapfs.PathError("Read", f.name, fs.ErrClosed)
+	}
+	return 0, first
+}
+
+// advance seeks all files except the file at index skip by n bytes. Files
+// failing to seek are dropped. It must be called with f.mu held.
+func (f *file) advance(skip int, n int64) {
+	for i, file := range f.files {
+		if i == skip || file == nil {
+			continue
+		}
+		if _, err := file.Seek(n, fsx.SeekWhenceRelativeCurrentOffset); err != nil {
+			f.drop(i)
+		}
+	}
+}
+
+// dropped returns the number of dropped files. It must be called with f.mu
+// held.
+func (f *file) dropped() int {
+	n := 0
+	for _, file := range f.files {
+		if file == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// drop closes the file at index i and marks the backend divergent. It must
+// be called with f.mu held.
+func (f *file) drop(i int) {
+	f.files[i].Close()
+	f.files[i] = nil
+
+	f.fsys.mu.Lock()
+	f.fsys.divergent[i] = true
+	f.fsys.mu.Unlock()
+}
+
+// Write writes p to all files.
+func (f *file) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := f.fanOut("Write", func(_ int, file fsx.File) error {
+		n, err := file.Write(p)
+		if err == nil && n != len(p) {
+			err = io.ErrShortWrite
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Seek sets the offset of all files.
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	offsets := make([]int64, len(f.files))
+	err := f.fanOut("Seek", func(i int, file fsx.File) (err error) {
+		offsets[i], err = file.Seek(offset, whence)
+		return
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return offsets[f.primary()], nil
+}
+
+// Chmod changes the mode of all files.
+func (f *file) Chmod(mode fs.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.fanOut("Chmod", func(_ int, file fsx.File) error {
+		return file.Chmod(mode)
+	})
+}
+
+// Chown changes the numeric owner and group of all files.
+func (f *file) Chown(uid, gid int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.fanOut("Chown", func(_ int, file fsx.File) error {
+		return file.Chown(uid, gid)
+	})
+}
+
+// Close closes all files.
+func (f *file) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.dropped() == len(f.files) {
+		return wrapfs.PathError("Close", f.name, fs.ErrClosed)
+	}
+
+	errs := make([]error, len(f.files))
+	for i, file := range f.files {
+		if file == nil {
+			errs[i] = errDropped
+			continue
+		}
+		errs[i] = file.Close()
+		f.files[i] = nil
+	}
+
+	return f.fsys.result("Close", f.name, errs)
+}
@@ -0,0 +1,179 @@
+package mirrorfs
+
+import (
+	"io/fs"
+	"time"
+
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/internal/wrapfs"
+)
+
+// Open opens the named file for reading from the first backend the file can
+// be opened from.
+func (fsys *mirrorfs) Open(name string) (f fs.File, err error) {
+	err = fsys.read(func(b fsx.FS) error {
+		f, err = b.Open(name)
+		return err
+	})
+	return
+}
+
+// OpenFile opens the named file. Files opened for reading only are opened
+// from a single backend like Open. Files opened for writing are opened on
+// all backends.
+func (fsys *mirrorfs) OpenFile(name string, flag int, perm fs.FileMode) (fsx.File, error) {
+	if flag&(fsx.O_WRONLY|fsx.O_RDWR|fsx.O_CREATE|fsx.O_TRUNC|fsx.O_APPEND) == 0 {
+		var f fsx.File
+		err := fsys.read(func(b fsx.FS) (err error) {
+			f, err = b.OpenFile(name, flag, perm)
+			return
+		})
+		return f, err
+	}
+
+	files := make([]fsx.File, len(fsys.backends))
+
+	err := fsys.fanOutIndexed("OpenFile", name, func(i int, b fsx.FS) (err error) {
+		files[i], err = b.OpenFile(name, flag, perm)
+		return
+	})
+
+	if err != nil {
+		for _, f := range files {
+			if f != nil {
+				f.Close()
+			}
+		}
+		return nil, err
+	}
+
+	return &file{fsys: fsys, name: name, readable: flag&fsx.O_WRONLY == 0, files: files}, nil
+}
+
+// Mkdir creates the named directory on all backends.
+func (fsys *mirrorfs) Mkdir(name string, perm fs.FileMode) error {
+	return fsys.fanOut("Mkdir", name, func(b fsx.FS) error {
+		return b.Mkdir(name, perm)
+	})
+}
+
+// Remove removes the named file or empty directory from all backends.
+func (fsys *mirrorfs) Remove(name string) error {
+	return fsys.fanOut("Remove", name, func(b fsx.FS) error {
+		return b.Remove(name)
+	})
+}
+
+// Rename renames oldpath to newpath on all backends.
+func (fsys *mirrorfs) Rename(oldpath, newpath string) error {
+	return fsys.fanOut("Rename", oldpath, func(b fsx.FS) error {
+		return b.Rename(oldpath, newpath)
+	})
+}
+
+// SameFile reports whether fi1 and fi2 describe the same file. As fi1 and
+// fi2 may have been obtained from any backend, SameFile reports true if any
+// backend considers them the same.
+func (fsys *mirrorfs) SameFile(fi1, fi2 fs.FileInfo) bool {
+	for _, b := range fsys.backends {
+		if b.SameFile(fi1, fi2) {
+			return true
+		}
+	}
+	return false
+}
+
+// -- fsx.WriteFileFS
+
+// WriteFile writes data to the named file on all backends.
+func (fsys *mirrorfs) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return fsys.fanOut("WriteFile", name, func(b fsx.FS) error {
+		return fsx.WriteFile(b, name, data, perm)
+	})
+}
+
+// -- fsx.ChmodFS, fsx.ChownFS, fsx.ChtimesFS, fsx.RemoveAllFS
+
+// Chmod changes the mode of the named file on all backends.
+func (fsys *mirrorfs) Chmod(name string, mode fs.FileMode) error {
+	return fsys.fanOut("Chmod", name, func(b fsx.FS) error {
+		return fsx.Chmod(b, name, mode)
+	})
+}
+
+// Chown changes the numeric owner and group of the named file on all
+// backends.
+func (fsys *mirrorfs) Chown(name string, uid, gid int) error {
+	return fsys.fanOut("Chown", name, func(b fsx.FS) error {
+		return fsx.Chown(b, name, uid, gid)
+	})
+}
+
+// Chtimes changes the access and modification time of the named file on all
+// backends.
+func (fsys *mirrorfs) Chtimes(name string, atime, mtime time.Time) error {
+	return fsys.fanOut("Chtimes", name, func(b fsx.FS) error {
+		return wrapfs.Chtimes(b, name, atime, mtime)
+	})
+}
+
+// RemoveAll removes name including all of its children from all backends.
+func (fsys *mirrorfs) RemoveAll(name string) error {
+	return fsys.fanOut("RemoveAll", name, func(b fsx.FS) error {
+		return fsx.RemoveAll(b, name)
+	})
+}
+
+// -- fsx.LinkFS
+
+// Readlink returns the target of the named symlink.
+func (fsys *mirrorfs) Readlink(name string) (target string, err error) {
+	err = fsys.read(func(b fsx.FS) error {
+		target, err = wrapfs.Readlink(b, name)
+		return err
+	})
+	return
+}
+
+// Link creates newname as a hard link to oldname on all backends.
+func (fsys *mirrorfs) Link(oldname, newname string) error {
+	return fsys.fanOut("Link", newname, func(b fsx.FS) error {
+		return wrapfs.Link(b, oldname, newname)
+	})
+}
+
+// Symlink creates newname as a symbolic link to oldname on all backends.
+func (fsys *mirrorfs) Symlink(oldname, newname string) error {
+	return fsys.fanOut("Symlink", newname, func(b fsx.FS) error {
+		return wrapfs.Symlink(b, oldname, newname)
+	})
+}
+
+// -- fs.StatFS, fs.ReadDirFS, fs.ReadFileFS
+
+// Stat returns a fs.FileInfo describing the named file.
+func (fsys *mirrorfs) Stat(name string) (info fs.FileInfo, err error) {
+	err = fsys.read(func(b fsx.FS) error {
+		info, err = fs.Stat(b, name)
+		return err
+	})
+	return
+}
+
+// ReadDir reads the named directory.
+func (fsys *mirrorfs) ReadDir(name string) (entries []fs.DirEntry, err error) {
+	err = fsys.read(func(b fsx.FS) error {
+		entries, err = fs.ReadDir(b, name)
+		return err
+	})
+	return
+}
+
+// ReadFile reads the named file.
+func (fsys *mirrorfs) ReadFile(name string) (data []byte, err error) {
+	err = fsys.read(func(b fsx.FS) error {
+		data, err = fs.ReadFile(b, name)
+		return err
+	})
+	return
+}
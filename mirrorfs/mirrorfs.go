@@ -0,0 +1,346 @@
+// Package mirrorfs provides a fsx.FS replicating all modifications to
+// multiple backing filesystems.
+//
+// The first backend is the primary; all others are replicas. Every
+// modifying operation - including writes to files opened for writing - is
+// performed on all backends concurrently. An operation succeeds if it
+// succeeds on at least a quorum of backends (all backends by default).
+// Backends failing an operation that succeeded on a quorum are marked
+// divergent. If an operation misses the quorum, the backends it succeeded on
+// are marked divergent instead.
+//
+// Reads are served by the primary. If reading from the primary fails, the
+// replicas are tried in order. Divergent backends are only used if reading
+// from all other backends failed.
+//
+// Scrub compares all replicas to a reference backend - the first backend
+// not marked divergent - and reports their differences; Repair re-syncs
+// divergent replicas to the reference and clears the divergent marks.
+package mirrorfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"sync"
+
+	"github.com/halimath/fsx"
+)
+
+// Option defines a function used to customize a mirrorfs.
+type Option func(*options)
+
+type options struct {
+	quorum  int
+	compare fsx.CompareMode
+}
+
+// WithQuorum sets the number of backends an operation must succeed on.
+// Defaults to the number of backends.
+func WithQuorum(n int) Option {
+	return func(o *options) {
+		o.quorum = n
+	}
+}
+
+// WithCompare sets the mode used by Scrub and Repair to compare file
+// contents. Defaults to fsx.CompareContent.
+func WithCompare(mode fsx.CompareMode) Option {
+	return func(o *options) {
+		o.compare = mode
+	}
+}
+
+// Error reports an operation that failed on too many backends to reach the
+// quorum. errors.Is and errors.As check the errors of all backends.
+type Error struct {
+	Op   string
+	Path string
+	// Errs contains the error of each backend or nil if the operation
+	// succeeded on the backend.
+	Errs []error
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	failed := 0
+	for i, err := range e.Errs {
+		if err == nil {
+			continue
+		}
+		failed++
+		fmt.Fprintf(&b, "; backend %d: %s", i, err)
+	}
+	return fmt.Sprintf("mirrorfs: %s %s: failed on %d of %d backends%s", e.Op, e.Path, failed, len(e.Errs), b.String())
+}
+
+// Unwrap returns the errors of all failed backends.
+func (e *Error) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errs))
+	for _, err := range e.Errs {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// errDropped is reported for backends whose file has been closed after a
+// previous failure.
+var errDropped = errors.New("mirrorfs: file dropped after previous failure")
+
+// Divergence describes the differences of a backend from the reference
+// backend.
+type Divergence struct {
+	// Backend contains the index of the divergent backend.
+	Backend int
+	// Changes lists the changes going from the reference to the backend.
+	Changes []fsx.Change
+}
+
+// FS defines the interface of a mirroring filesystem. A backend not
+// supporting an operation, e.g. Symlink, counts as failing it and is marked
+// divergent if the operation reaches the quorum on the other backends.
+type FS interface {
+	fsx.LinkFS
+	fsx.ChmodFS
+	fsx.ChownFS
+	fsx.ChtimesFS
+	fsx.RemoveAllFS
+	fsx.WriteFileFS
+	fs.StatFS
+	fs.ReadDirFS
+	fs.ReadFileFS
+
+	// Divergent returns the indexes of all backends marked divergent.
+	Divergent() []int
+
+	// Scrub compares all backends to the reference backend and returns the
+	// differences found.
+	Scrub() ([]Divergence, error)
+
+	// Repair syncs all backends differing from the reference backend and
+	// clears the divergent marks. It returns the differences repaired.
+	Repair() ([]Divergence, error)
+}
+
+type mirrorfs struct {
+	backends []fsx.FS
+	opts     options
+
+	// repair is held for writing while repairing the backends and for
+	// reading by all other operations.
+	repair sync.RWMutex
+
+	mu        sync.Mutex
+	divergent []bool
+}
+
+// New creates a filesystem mirroring all modifications to backends. The
+// first backend is the primary.
+func New(backends []fsx.FS, opts ...Option) (FS, error) {
+	if len(backends) == 0 {
+		return nil, errors.New("mirrorfs: no backends")
+	}
+
+	o := options{quorum: len(backends)}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.quorum < 1 || o.quorum > len(backends) {
+		return nil, fmt.Errorf("mirrorfs: invalid quorum: %d", o.quorum)
+	}
+
+	return &mirrorfs{
+		backends:  backends,
+		opts:      o,
+		divergent: make([]bool, len(backends)),
+	}, nil
+}
+
+// Divergent returns the indexes of all backends marked divergent.
+func (fsys *mirrorfs) Divergent() []int {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	idx := make([]int, 0)
+	for i, d := range fsys.divergent {
+		if d {
+			idx = append(idx, i)
+		}
+	}
+	return idx
+}
+
+// readOrder returns the indexes of all backends in the order used to serve
+// reads: backends not marked divergent first.
+func (fsys *mirrorfs) readOrder() []int {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	order := make([]int, 0, len(fsys.backends))
+	for i, d := range fsys.divergent {
+		if !d {
+			order = append(order, i)
+		}
+	}
+	for i, d := range fsys.divergent {
+		if d {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+// read calls fn for the backends in read order until fn succeeds. If fn
+// fails for all backends, the first error is returned.
+func (fsys *mirrorfs) read(fn func(b fsx.FS) error) error {
+	fsys.repair.RLock()
+	defer fsys.repair.RUnlock()
+
+	var first error
+	for _, i := range fsys.readOrder() {
+		err := fn(fsys.backends[i])
+		if err == nil {
+			return nil
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// fanOut calls fn for all backends concurrently and evaluates the result
+// using result.
+func (fsys *mirrorfs) fanOut(op, name string, fn func(b fsx.FS) error) error {
+	return fsys.fanOutIndexed(op, name, func(_ int, b fsx.FS) error {
+		return fn(b)
+	})
+}
+
+// fanOutIndexed works like fanOut but also passes the backend's index to fn.
+func (fsys *mirrorfs) fanOutIndexed(op, name string, fn func(i int, b fsx.FS) error) error {
+	fsys.repair.RLock()
+	defer fsys.repair.RUnlock()
+
+	errs := make([]error, len(fsys.backends))
+
+	var wg sync.WaitGroup
+	for i, b := range fsys.backends {
+		wg.Add(1)
+		go func(i int, b fsx.FS) {
+			defer wg.Done()
+			errs[i] = fn(i, b)
+		}(i, b)
+	}
+	wg.Wait()
+
+	return fsys.result(op, name, errs)
+}
+
+// result evaluates the errors of an operation performed on all backends. If
+// the operation succeeded on a quorum of backends, all failed backends are
+// marked divergent. Otherwise, the backends the operation succeeded on are
+// marked divergent, so that Repair reverts the operation, and an *Error is
+// returned.
+func (fsys *mirrorfs) result(op, name string, errs []error) error {
+	succeeded := 0
+	for _, err := range errs {
+		if err == nil {
+			succeeded++
+		}
+	}
+
+	if succeeded == len(errs) {
+		return nil
+	}
+
+	quorum := succeeded >= fsys.opts.quorum
+
+	if succeeded > 0 {
+		fsys.mu.Lock()
+		for i, err := range errs {
+			if (err == nil) != quorum {
+				fsys.divergent[i] = true
+			}
+		}
+		fsys.mu.Unlock()
+	}
+
+	if quorum {
+		return nil
+	}
+
+	return &Error{Op: op, Path: name, Errs: errs}
+}
+
+// reference returns the index of the first backend not marked divergent or
+// 0 if all backends are divergent.
+func (fsys *mirrorfs) reference() int {
+	return fsys.readOrder()[0]
+}
+
+// Scrub compares all backends to the reference backend.
+func (fsys *mirrorfs) Scrub() ([]Divergence, error) {
+	fsys.repair.RLock()
+	defer fsys.repair.RUnlock()
+
+	return fsys.scrub(fsys.reference())
+}
+
+// scrub compares all backends to the backend ref. It must be called with
+// fsys.repair held.
+func (fsys *mirrorfs) scrub(ref int) ([]Divergence, error) {
+	divergences := make([]Divergence, 0)
+
+	for i, b := range fsys.backends {
+		if i == ref {
+			continue
+		}
+
+		d, err := fsx.Diff(fsys.backends[ref], b, &fsx.DiffOptions{Compare: fsys.opts.compare})
+		if err != nil {
+			return nil, fmt.Errorf("mirrorfs: failed to scrub backend %d: %w", i, err)
+		}
+
+		if !d.Empty() {
+			divergences = append(divergences, Divergence{Backend: i, Changes: d.Changes})
+		}
+	}
+
+	return divergences, nil
+}
+
+// Repair syncs all backends differing from the reference backend.
+func (fsys *mirrorfs) Repair() ([]Divergence, error) {
+	fsys.repair.Lock()
+	defer fsys.repair.Unlock()
+
+	ref := fsys.reference()
+
+	divergences, err := fsys.scrub(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range divergences {
+		_, err := fsx.Sync(fsys.backends[d.Backend], fsys.backends[ref], &fsx.SyncOptions{
+			Compare: fsys.opts.compare,
+			Delete:  true,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("mirrorfs: failed to repair backend %d: %w", d.Backend, err)
+		}
+	}
+
+	fsys.mu.Lock()
+	for i := range fsys.divergent {
+		fsys.divergent[i] = false
+	}
+	fsys.mu.Unlock()
+
+	return divergences, nil
+}
@@ -0,0 +1,339 @@
+package mirrorfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	. "github.com/halimath/fixture"
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/memfs"
+	"github.com/halimath/fsx/osfs"
+)
+
+var errInjected = errors.New("injected failure")
+
+// failingFS wraps a FS and fails all operations while failing is set.
+// Files opened while failing is not set fail writes once failing is set.
+type failingFS struct {
+	fsx.LinkFS
+	failing bool
+}
+
+func (f *failingFS) Open(name string) (fs.File, error) {
+	if f.failing {
+		return nil, errInjected
+	}
+	return f.LinkFS.Open(name)
+}
+
+func (f *failingFS) OpenFile(name string, flag int, perm fs.FileMode) (fsx.File, error) {
+	if f.failing {
+		return nil, errInjected
+	}
+	file, err := f.LinkFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &failingFile{File: file, fsys: f}, nil
+}
+
+func (f *failingFS) Mkdir(name string, perm fs.FileMode) error {
+	if f.failing {
+		return errInjected
+	}
+	return f.LinkFS.Mkdir(name, perm)
+}
+
+func (f *failingFS) Remove(name string) error {
+	if f.failing {
+		return errInjected
+	}
+	return f.LinkFS.Remove(name)
+}
+
+type failingFile struct {
+	fsx.File
+	fsys *failingFS
+}
+
+func (f *failingFile) Write(p []byte) (int, error) {
+	if f.fsys.failing {
+		return 0, errInjected
+	}
+	return f.File.Write(p)
+}
+
+type mirrorfsFixture struct {
+	backends []*failingFS
+	fs       FS
+	opts     []Option
+}
+
+func (f *mirrorfsFixture) BeforeEach(t *testing.T) error {
+	f.backends = make([]*failingFS, 3)
+	backends := make([]fsx.FS, len(f.backends))
+	for i := range f.backends {
+		f.backends[i] = &failingFS{LinkFS: memfs.New()}
+		backends[i] = f.backends[i]
+	}
+
+	var err error
+	f.fs, err = New(backends, f.opts...)
+	if err != nil {
+		return err
+	}
+
+	return fsx.WriteFile(f.fs, "report.txt", []byte("report"), 0644)
+}
+
+// expectContent expects name to contain want on all backends.
+func (f *mirrorfsFixture) expectContent(t *testing.T, name, want string) {
+	t.Helper()
+
+	for _, b := range f.backends {
+		data, err := fs.ReadFile(b.LinkFS, name)
+		expect.That(t, is.NoError(err), is.EqualTo(string(data), want))
+	}
+}
+
+func TestMirrorFS(t *testing.T) {
+	With(t, new(mirrorfsFixture)).
+		Run("fanOut", func(t *testing.T, f *mirrorfsFixture) {
+			expect.That(t,
+				is.NoError(fsx.MkdirAll(f.fs, "docs/drafts", 0755)),
+				is.NoError(f.fs.Rename("report.txt", "docs/report.txt")),
+				is.NoError(f.fs.Symlink("docs/report.txt", "link")),
+				is.NoError(f.fs.Chmod("docs/report.txt", 0600)),
+				is.NoError(f.fs.Remove("docs/drafts")),
+			)
+
+			f.expectContent(t, "docs/report.txt", "report")
+
+			for _, b := range f.backends {
+				info, err := fs.Stat(b.LinkFS, "docs/report.txt")
+				expect.That(t, is.NoError(err), is.EqualTo(info.Mode(), fs.FileMode(0600)))
+
+				_, err = fs.Stat(b.LinkFS, "docs/drafts")
+				expect.That(t, is.Error(err, fs.ErrNotExist))
+
+				target, err := b.Readlink("link")
+				expect.That(t, is.NoError(err), is.EqualTo(target, "docs/report.txt"))
+			}
+
+			expect.That(t, is.DeepEqualTo(f.fs.Divergent(), []int{}))
+		}).
+		Run("allFailed", func(t *testing.T, f *mirrorfsFixture) {
+			err := f.fs.Chmod("missing.txt", 0600)
+
+			var merr *Error
+			expect.That(t,
+				is.Error(err, fs.ErrNotExist),
+				expect.FailNow(is.EqualTo(errors.As(err, &merr), true)),
+			)
+			expect.That(t,
+				is.EqualTo(merr.Op, "Chmod"),
+				is.EqualTo(len(merr.Unwrap()), 3),
+			)
+
+			// No backend applied the operation, so none diverged.
+			expect.That(t, is.DeepEqualTo(f.fs.Divergent(), []int{}))
+		}).
+		Run("noQuorum", func(t *testing.T, f *mirrorfsFixture) {
+			f.backends[1].failing = true
+
+			err := f.fs.Mkdir("docs", 0755)
+			expect.That(t, is.Error(err, errInjected))
+
+			// The backends applying the failed operation diverged, so Repair
+			// reverts it.
+			expect.That(t, is.DeepEqualTo(f.fs.Divergent(), []int{0, 2}))
+
+			f.backends[1].failing = false
+			_, err = f.fs.Repair()
+			expect.That(t, is.NoError(err))
+
+			for _, b := range f.backends {
+				_, err = fs.Stat(b.LinkFS, "docs")
+				expect.That(t, is.Error(err, fs.ErrNotExist))
+			}
+		}).
+		Run("readFallback", func(t *testing.T, f *mirrorfsFixture) {
+			f.backends[0].failing = true
+
+			data, err := f.fs.ReadFile("report.txt")
+			expect.That(t, is.NoError(err), is.EqualTo(string(data), "report"))
+
+			f.backends[1].failing = true
+			f.backends[2].failing = true
+
+			_, err = f.fs.Stat("report.txt")
+			expect.That(t, is.Error(err, errInjected))
+		}).
+		Run("file", func(t *testing.T, f *mirrorfsFixture) {
+			file, err := f.fs.OpenFile("report.txt", fsx.O_RDWR, 0)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			buf := make([]byte, 3)
+			n, err := file.Read(buf)
+			expect.That(t, is.NoError(err), is.EqualTo(string(buf[:n]), "rep"))
+
+			// All files advanced when reading, so the write replaces the
+			// same bytes everywhere.
+			_, err = file.Write([]byte("ORT"))
+			expect.That(t, is.NoError(err))
+
+			pos, err := file.Seek(0, fsx.SeekWhenceRelativeEnd)
+			expect.That(t, is.NoError(err), is.EqualTo(pos, int64(6)))
+
+			_, err = file.Write([]byte("!"))
+			expect.That(t, is.NoError(err), is.NoError(file.Close()))
+			expect.That(t, is.Error(file.Close(), fs.ErrClosed))
+
+			f.expectContent(t, "report.txt", "repORT!")
+		}).
+		Run("writeOnly", func(t *testing.T, f *mirrorfsFixture) {
+			file, err := f.fs.OpenFile("a.txt", fsx.O_WRONLY|fsx.O_CREATE, 0644)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			_, err = file.Read(make([]byte, 1))
+			expect.That(t, is.Error(err, fs.ErrPermission))
+
+			_, err = file.Write([]byte("data"))
+			expect.That(t, is.NoError(err), is.NoError(file.Close()))
+
+			f.expectContent(t, "a.txt", "data")
+			expect.That(t, is.DeepEqualTo(f.fs.Divergent(), []int{}))
+		})
+
+	With(t, &mirrorfsFixture{opts: []Option{WithQuorum(2)}}).
+		Run("quorum", func(t *testing.T, f *mirrorfsFixture) {
+			f.backends[2].failing = true
+
+			expect.That(t,
+				is.NoError(f.fs.WriteFile("a.txt", []byte("a"), 0644)),
+				is.DeepEqualTo(f.fs.Divergent(), []int{2}),
+			)
+
+			f.backends[1].failing = true
+
+			err := f.fs.WriteFile("b.txt", []byte("b"), 0644)
+			expect.That(t, is.Error(err, errInjected))
+			expect.That(t, is.DeepEqualTo(f.fs.Divergent(), []int{0, 2}))
+		}).
+		Run("fileQuorum", func(t *testing.T, f *mirrorfsFixture) {
+			file, err := fsx.Create(f.fs, "a.txt")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			_, err = file.Write([]byte("a"))
+			expect.That(t, is.NoError(err))
+
+			f.backends[0].failing = true
+			_, err = file.Write([]byte("b"))
+			expect.That(t, is.NoError(err))
+
+			f.backends[1].failing = true
+			_, err = file.Write([]byte("c"))
+			expect.That(t, is.Error(err, errInjected))
+
+			f.backends[0].failing = false
+			f.backends[1].failing = false
+			expect.That(t, is.Error(file.Close(), errDropped))
+
+			// The last write has been applied to the remaining backend
+			// although it failed to reach the quorum, so that backend
+			// diverged.
+			data, err := fs.ReadFile(f.backends[2].LinkFS, "a.txt")
+			expect.That(t, is.NoError(err), is.EqualTo(string(data), "abc"))
+
+			// Reads are served by the only backend not diverged.
+			expect.That(t, is.DeepEqualTo(f.fs.Divergent(), []int{0, 2}))
+			data, err = f.fs.ReadFile("a.txt")
+			expect.That(t, is.NoError(err), is.EqualTo(string(data), "ab"))
+		}).
+		Run("scrubAndRepair", func(t *testing.T, f *mirrorfsFixture) {
+			f.backends[1].failing = true
+			expect.That(t, is.NoError(f.fs.WriteFile("a.txt", []byte("a"), 0644)))
+			f.backends[1].failing = false
+
+			expect.That(t, is.NoError(fsx.WriteFile(f.backends[2].LinkFS, "report.txt", []byte("changed"), 0644)))
+
+			divergences, err := f.fs.Scrub()
+			expect.That(t,
+				is.NoError(err),
+				expect.FailNow(is.EqualTo(len(divergences), 2)),
+				is.EqualTo(divergences[0].Backend, 1),
+				is.EqualTo(len(divergences[0].Changes), 1),
+				is.EqualTo(divergences[0].Changes[0].Path, "a.txt"),
+				is.EqualTo(divergences[0].Changes[0].Kind, fsx.Removed),
+				is.EqualTo(divergences[1].Backend, 2),
+				is.EqualTo(divergences[1].Changes[0].Path, "report.txt"),
+			)
+
+			repaired, err := f.fs.Repair()
+			expect.That(t, is.NoError(err), is.DeepEqualTo(repaired, divergences))
+
+			f.expectContent(t, "a.txt", "a")
+			f.expectContent(t, "report.txt", "report")
+
+			divergences, err = f.fs.Scrub()
+			expect.That(t,
+				is.NoError(err),
+				is.EqualTo(len(divergences), 0),
+				is.DeepEqualTo(f.fs.Divergent(), []int{}),
+			)
+		})
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(nil)
+	expect.That(t, is.EqualTo(err != nil, true))
+
+	for _, opts := range [][]Option{
+		{WithQuorum(0)},
+		{WithQuorum(3)},
+	} {
+		_, err := New([]fsx.FS{memfs.New(), memfs.New()}, opts...)
+		expect.That(t, is.EqualTo(err != nil, true))
+	}
+}
+
+func TestOSFS(t *testing.T) {
+	primary := osfs.DirFS(t.TempDir())
+	replica := osfs.DirFS(t.TempDir())
+
+	fsys, err := New([]fsx.FS{primary, replica})
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	expect.That(t,
+		is.NoError(fsx.MkdirAll(fsys, "home/docs", 0755)),
+		is.NoError(fsx.WriteFile(fsys, "home/docs/a.txt", []byte("a"), 0644)),
+	)
+
+	f, err := fsys.OpenFile("home/docs/a.txt", fsx.O_WRONLY|fsx.O_APPEND, 0)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	_, err = io.WriteString(f, "b")
+	expect.That(t, is.NoError(err), is.NoError(f.Close()))
+
+	expect.That(t,
+		is.NoError(fstest.TestFS(fsys, "home/docs/a.txt")),
+		is.NoError(fsys.Symlink("home/docs/a.txt", "home/link")),
+	)
+
+	for _, b := range []fsx.FS{primary, replica} {
+		data, err := fs.ReadFile(b, "home/link")
+		expect.That(t, is.NoError(err), is.EqualTo(string(data), "ab"))
+	}
+
+	expect.That(t, is.NoError(replica.Remove("home/link")))
+
+	divergences, err := fsys.Repair()
+	expect.That(t, is.NoError(err), is.EqualTo(len(divergences), 1))
+
+	target, err := replica.(fsx.LinkFS).Readlink("home/link")
+	expect.That(t, is.NoError(err), is.EqualTo(target, "home/docs/a.txt"))
+}
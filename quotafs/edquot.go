@@ -0,0 +1,9 @@
+//go:build !plan9
+// +build !plan9
+
+package quotafs
+
+import "syscall"
+
+// Is makes errors.Is(ErrQuotaExceeded, syscall.EDQUOT) report true.
+func (quotaExceeded) Is(target error) bool { return target == syscall.EDQUOT }
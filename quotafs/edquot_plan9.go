@@ -0,0 +1,7 @@
+//go:build plan9
+// +build plan9
+
+package quotafs
+
+// Is reports false for all targets as plan9 does not define EDQUOT.
+func (quotaExceeded) Is(target error) bool { return false }
@@ -0,0 +1,16 @@
+//go:build !plan9
+// +build !plan9
+
+package quotafs
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+)
+
+func TestErrQuotaExceeded_errno(t *testing.T) {
+	expect.That(t, is.Error(ErrQuotaExceeded, syscall.EDQUOT))
+}
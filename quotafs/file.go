@@ -0,0 +1,151 @@
+package quotafs
+
+import (
+	"io"
+	"sync"
+
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/internal/wrapfs"
+)
+
+// file wraps a file opened for writing and tracks the bytes written to it.
+// The file's size is tracked per handle; concurrent writers to the same file
+// may cause the usage to drift until the next Rescan.
+type file struct {
+	fsx.File
+	fsys *quotafs
+	// name is the path usage is charged to, with all symlinks resolved.
+	name   string
+	append bool
+
+	mu     sync.Mutex
+	size   int64
+	offset int64
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n, err := f.File.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	s, ok := f.File.(io.Seeker)
+	if !ok {
+		return 0, wrapfs.PathError("seek", f.name, fsx.ErrNotSupported)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pos, err := s.Seek(offset, whence)
+	if err == nil {
+		f.offset = pos
+	}
+	return pos, err
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	r, ok := f.File.(io.ReaderAt)
+	if !ok {
+		return 0, wrapfs.PathError("readat", f.name, fsx.ErrNotSupported)
+	}
+	return r.ReadAt(p, off)
+}
+
+// Write writes p at the current offset (or the end of the file in append
+// mode). If growing the file exceeds a quota, nothing is written.
+func (f *file) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pos := f.offset
+	if f.append {
+		pos = f.size
+	}
+
+	n, err := f.write("write", pos, p, f.File.Write)
+	f.offset = pos + int64(n)
+	return n, err
+}
+
+// WriteAt writes p at off. If growing the file exceeds a quota, nothing is
+// written.
+func (f *file) WriteAt(p []byte, off int64) (int, error) {
+	w, ok := f.File.(io.WriterAt)
+	if !ok {
+		return 0, wrapfs.PathError("writeat", f.name, fsx.ErrNotSupported)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.write("writeat", off, p, func(p []byte) (int, error) {
+		return w.WriteAt(p, off)
+	})
+}
+
+// write reserves the bytes needed to write p at off, writes p using fn and
+// releases the reserved bytes not used. It must be called with f.mu held.
+func (f *file) write(op string, off int64, p []byte, fn func([]byte) (int, error)) (int, error) {
+	growth := off + int64(len(p)) - f.size
+	if growth < 0 {
+		growth = 0
+	}
+
+	if growth > 0 {
+		f.fsys.mu.Lock()
+		err := f.fsys.reserve(op, f.name, Usage{Bytes: growth})
+		f.fsys.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := fn(p)
+
+	var used int64
+	if end := off + int64(n); end > f.size {
+		used = end - f.size
+		f.size = end
+	}
+
+	if used < growth {
+		f.fsys.mu.Lock()
+		f.fsys.release(f.name, Usage{Bytes: growth - used})
+		f.fsys.mu.Unlock()
+	}
+
+	return n, err
+}
+
+// Truncate changes the size of the file. Growing the file fails if it
+// exceeds a quota; shrinking it releases the bytes.
+func (f *file) Truncate(size int64) error {
+	t, ok := f.File.(interface{ Truncate(int64) error })
+	if !ok {
+		return wrapfs.PathError("truncate", f.name, fsx.ErrNotSupported)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+
+	delta := Usage{Bytes: size - f.size}
+	if err := f.fsys.reserve("truncate", f.name, delta); err != nil {
+		return err
+	}
+
+	if err := t.Truncate(size); err != nil {
+		f.fsys.release(f.name, delta)
+		return err
+	}
+
+	f.size = size
+	return nil
+}
@@ -0,0 +1,288 @@
+package quotafs
+
+import (
+	"errors"
+	"io/fs"
+	"time"
+
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/internal/linkutil"
+	"github.com/halimath/fsx/internal/wrapfs"
+)
+
+// Open opens the named file for reading.
+func (fsys *quotafs) Open(name string) (fs.File, error) {
+	return fsys.backing.Open(name)
+}
+
+// OpenFile opens the named file. Creating a file reserves an inode;
+// truncating a file releases its bytes. Files opened for writing track the
+// bytes written. Opening a symlink charges the usage to the link's target.
+func (fsys *quotafs) OpenFile(name string, flag int, perm fs.FileMode) (fsx.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, wrapfs.PathError("OpenFile", name, fs.ErrInvalid)
+	}
+
+	if flag&(fsx.O_WRONLY|fsx.O_RDWR|fsx.O_CREATE|fsx.O_TRUNC) == 0 {
+		return fsys.backing.OpenFile(name, flag, perm)
+	}
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	// Usage is charged to the file name finally refers to.
+	target, err := linkutil.Resolve(fsys.backing, name)
+	if err != nil {
+		return nil, wrapfs.PathError("OpenFile", name, err)
+	}
+
+	info, err := fs.Stat(fsys.backing, target)
+	exists := err == nil
+
+	var reserved Usage
+	if errors.Is(err, fs.ErrNotExist) && flag&fsx.O_CREATE != 0 {
+		reserved.Inodes = 1
+		if err := fsys.reserve("OpenFile", target, reserved); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := fsys.backing.OpenFile(name, flag, perm)
+	if err != nil {
+		fsys.release(target, reserved)
+		return nil, err
+	}
+
+	var size int64
+	if exists && info.Mode().IsRegular() {
+		size = info.Size()
+		if flag&fsx.O_TRUNC != 0 {
+			fsys.release(target, Usage{Bytes: size})
+			size = 0
+		}
+	}
+
+	return &file{
+		File:   f,
+		fsys:   fsys,
+		name:   target,
+		append: flag&fsx.O_APPEND != 0,
+		size:   size,
+	}, nil
+}
+
+// Mkdir creates the named directory reserving an inode.
+func (fsys *quotafs) Mkdir(name string, perm fs.FileMode) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	delta := Usage{Inodes: 1}
+	if err := fsys.reserve("Mkdir", name, delta); err != nil {
+		return err
+	}
+
+	if err := fsys.backing.Mkdir(name, perm); err != nil {
+		fsys.release(name, delta)
+		return err
+	}
+	return nil
+}
+
+// Remove removes the named file or empty directory releasing its usage.
+func (fsys *quotafs) Remove(name string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	info, err := linkutil.Lstat(fsys.backing, name)
+	if err := fsys.backing.Remove(name); err != nil {
+		return err
+	}
+
+	if err == nil {
+		fsys.release(name, usageOf(info))
+	}
+	return nil
+}
+
+// Rename renames oldpath to newpath. Moving entries between subtrees fails
+// if the usage of oldpath exceeds the destination's quotas. Subtrees rooted
+// inside oldpath or newpath are rescanned afterwards.
+func (fsys *quotafs) Rename(oldpath, newpath string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	u, err := fsys.measure(oldpath)
+	if err != nil {
+		return fsys.backing.Rename(oldpath, newpath)
+	}
+
+	changes := []change{
+		{name: oldpath, delta: Usage{}.sub(u)},
+		{name: newpath, delta: u},
+	}
+	if replaced, err := fsys.measure(newpath); err == nil {
+		changes = append(changes, change{name: newpath, delta: Usage{}.sub(replaced)})
+	}
+
+	if err := fsys.apply("Rename", newpath, changes...); err != nil {
+		return err
+	}
+
+	if err := fsys.backing.Rename(oldpath, newpath); err != nil {
+		fsys.revert(changes...)
+		return err
+	}
+
+	if err := fsys.rescanWithin(oldpath); err != nil {
+		return err
+	}
+	return fsys.rescanWithin(newpath)
+}
+
+// SameFile reports whether fi1 and fi2 describe the same file.
+func (fsys *quotafs) SameFile(fi1, fi2 fs.FileInfo) bool {
+	return fsys.backing.SameFile(fi1, fi2)
+}
+
+// -- fsx.WriteFileFS
+
+// WriteFile writes data to the named file. The write fails without
+// modifying the file if the resulting size exceeds a quota. Writing through
+// a symlink charges the usage to the link's target.
+func (fsys *quotafs) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	target, err := linkutil.Resolve(fsys.backing, name)
+	if err != nil {
+		return wrapfs.PathError("WriteFile", name, err)
+	}
+
+	delta := Usage{Bytes: int64(len(data))}
+	info, err := fs.Stat(fsys.backing, target)
+	if err == nil {
+		if info.Mode().IsRegular() {
+			delta.Bytes -= info.Size()
+		}
+	} else if errors.Is(err, fs.ErrNotExist) {
+		delta.Inodes = 1
+	}
+
+	if err := fsys.reserve("WriteFile", target, delta); err != nil {
+		return err
+	}
+
+	if err := fsx.WriteFile(fsys.backing, name, data, perm); err != nil {
+		fsys.release(target, delta)
+		return err
+	}
+	return nil
+}
+
+// -- fsx.ChmodFS, fsx.ChownFS, fsx.ChtimesFS, fsx.RemoveAllFS
+
+// Chmod changes the mode of the named file.
+func (fsys *quotafs) Chmod(name string, mode fs.FileMode) error {
+	return fsx.Chmod(fsys.backing, name, mode)
+}
+
+// Chown changes the numeric owner and group of the named file.
+func (fsys *quotafs) Chown(name string, uid, gid int) error {
+	return fsx.Chown(fsys.backing, name, uid, gid)
+}
+
+// Chtimes changes the access and modification time of the named file.
+func (fsys *quotafs) Chtimes(name string, atime, mtime time.Time) error {
+	return wrapfs.Chtimes(fsys.backing, name, atime, mtime)
+}
+
+// RemoveAll removes name and all of its children releasing their usage.
+// If RemoveAll fails, the usage of the entries removed so far is released.
+func (fsys *quotafs) RemoveAll(name string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	before, err := fsys.measure(name)
+	if err != nil {
+		return fsx.RemoveAll(fsys.backing, name)
+	}
+
+	rerr := fsx.RemoveAll(fsys.backing, name)
+
+	after, err := fsys.measure(name)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		fsys.release(name, before)
+	case err == nil:
+		fsys.release(name, before.sub(after))
+	}
+
+	if err := fsys.rescanWithin(name); err != nil && rerr == nil {
+		rerr = err
+	}
+	return rerr
+}
+
+// -- fsx.LinkFS
+
+// Readlink returns the target of the named symlink.
+func (fsys *quotafs) Readlink(name string) (string, error) {
+	return wrapfs.Readlink(fsys.backing, name)
+}
+
+// Link creates newname as a hard link to oldname. As usage is computed per
+// path, the link reserves an inode and the size of oldname.
+func (fsys *quotafs) Link(oldname, newname string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	info, err := linkutil.Lstat(fsys.backing, oldname)
+	if err != nil {
+		return wrapfs.Link(fsys.backing, oldname, newname)
+	}
+
+	delta := usageOf(info)
+	if err := fsys.reserve("Link", newname, delta); err != nil {
+		return err
+	}
+
+	if err := wrapfs.Link(fsys.backing, oldname, newname); err != nil {
+		fsys.release(newname, delta)
+		return err
+	}
+	return nil
+}
+
+// Symlink creates newname as a symlink to oldname reserving an inode.
+func (fsys *quotafs) Symlink(oldname, newname string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	delta := Usage{Inodes: 1}
+	if err := fsys.reserve("Symlink", newname, delta); err != nil {
+		return err
+	}
+
+	if err := wrapfs.Symlink(fsys.backing, oldname, newname); err != nil {
+		fsys.release(newname, delta)
+		return err
+	}
+	return nil
+}
+
+// -- fs.StatFS, fs.ReadDirFS, fs.ReadFileFS
+
+// Stat returns a fs.FileInfo describing the named file.
+func (fsys *quotafs) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(fsys.backing, name)
+}
+
+// ReadDir reads the named directory.
+func (fsys *quotafs) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(fsys.backing, name)
+}
+
+// ReadFile reads the named file.
+func (fsys *quotafs) ReadFile(name string) ([]byte, error) {
+	return fs.ReadFile(fsys.backing, name)
+}
@@ -0,0 +1,311 @@
+// Package quotafs provides a fsx.FS wrapper enforcing quotas on the number
+// of bytes and inodes used by subtrees of another fsx.FS (e.g. an
+// osfs.DirFS).
+//
+// Quotas are configured per subtree using WithQuota. Subtrees may be nested;
+// an operation must satisfy the quotas of all subtrees containing the
+// affected path. The usage of each subtree is initialized by scanning it
+// when creating the filesystem and tracked for all operations performed
+// through the wrapper afterwards. Changes made bypassing the wrapper are
+// picked up by Rescan.
+//
+// Usage is computed per path: every entry (file, directory or symlink) of a
+// subtree counts as one inode, excluding the subtree's root directory, and
+// the sizes of all regular files are summed up. A file with multiple hard
+// links is counted once per link. Writing through a symlink charges the
+// subtrees containing the link's target.
+//
+// Operations exceeding a quota fail with an error wrapping ErrQuotaExceeded
+// and do not modify the filesystem. In particular, a Write exceeding a quota
+// writes no data at all.
+package quotafs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/internal/linkutil"
+	"github.com/halimath/fsx/internal/wrapfs"
+)
+
+// ErrQuotaExceeded is returned when an operation would exceed a quota.
+// errors.Is(ErrQuotaExceeded, syscall.EDQUOT) reports true on all platforms
+// defining EDQUOT.
+var ErrQuotaExceeded error = quotaExceeded{}
+
+type quotaExceeded struct{}
+
+func (quotaExceeded) Error() string { return "quotafs: quota exceeded" }
+
+// Quota defines the limits of a subtree. A limit of 0 means unlimited.
+type Quota struct {
+	// Bytes limits the sum of the sizes of all regular files.
+	Bytes int64
+	// Inodes limits the number of files, directories and symlinks.
+	Inodes int64
+}
+
+// Usage describes the resources used by a subtree.
+type Usage struct {
+	Bytes  int64
+	Inodes int64
+}
+
+func (u Usage) add(o Usage) Usage {
+	return Usage{Bytes: u.Bytes + o.Bytes, Inodes: u.Inodes + o.Inodes}
+}
+
+func (u Usage) sub(o Usage) Usage {
+	return Usage{Bytes: u.Bytes - o.Bytes, Inodes: u.Inodes - o.Inodes}
+}
+
+// Option defines a function used to customize a quotafs.
+type Option func(*options)
+
+type options struct {
+	quotas map[string]Quota
+}
+
+// WithQuota sets the quota for the subtree rooted at root. Use "." to limit
+// the whole filesystem.
+func WithQuota(root string, q Quota) Option {
+	return func(o *options) {
+		o.quotas[root] = q
+	}
+}
+
+// FS defines the interface of a quota enforcing filesystem. Operations
+// creating entries or growing files reserve their usage before modifying the
+// backing filesystem; removing entries releases it.
+type FS interface {
+	fsx.LinkFS
+	fsx.ChmodFS
+	fsx.ChownFS
+	fsx.ChtimesFS
+	fsx.RemoveAllFS
+	fsx.WriteFileFS
+	fs.StatFS
+	fs.ReadDirFS
+	fs.ReadFileFS
+
+	// Usage returns the usage and quota of the subtree rooted at root. ok is
+	// false if no quota has been configured for root.
+	Usage(root string) (usage Usage, quota Quota, ok bool)
+
+	// Rescan recomputes the usage of all subtrees by scanning them.
+	Rescan() error
+}
+
+// tracker tracks the usage of a subtree.
+type tracker struct {
+	root  string
+	quota Quota
+	usage Usage
+}
+
+// contains reports whether name is part of the tracked subtree.
+func (t *tracker) contains(name string) bool {
+	if t.root == "." {
+		return name != "."
+	}
+	return strings.HasPrefix(name, t.root+"/")
+}
+
+// exceeds reports whether adding delta exceeds t's quota. Deltas not
+// increasing the usage never exceed a quota, even if the usage already does.
+func (t *tracker) exceeds(delta Usage) bool {
+	return delta.Bytes > 0 && t.quota.Bytes > 0 && t.usage.Bytes+delta.Bytes > t.quota.Bytes ||
+		delta.Inodes > 0 && t.quota.Inodes > 0 && t.usage.Inodes+delta.Inodes > t.quota.Inodes
+}
+
+type quotafs struct {
+	backing  fsx.FS
+	mu       sync.Mutex
+	trackers []*tracker
+}
+
+// New creates a filesystem enforcing quotas on backing. The usage of all
+// subtrees is initialized by scanning them.
+func New(backing fsx.FS, opts ...Option) (FS, error) {
+	o := options{quotas: make(map[string]Quota)}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	fsys := &quotafs{backing: backing}
+
+	for root, q := range o.quotas {
+		if !fs.ValidPath(root) {
+			return nil, fmt.Errorf("quotafs: invalid root: %q", root)
+		}
+		if q.Bytes < 0 || q.Inodes < 0 {
+			return nil, fmt.Errorf("quotafs: invalid quota for %s", root)
+		}
+		fsys.trackers = append(fsys.trackers, &tracker{root: root, quota: q})
+	}
+
+	sort.Slice(fsys.trackers, func(i, j int) bool { return fsys.trackers[i].root < fsys.trackers[j].root })
+
+	if err := fsys.Rescan(); err != nil {
+		return nil, err
+	}
+
+	return fsys, nil
+}
+
+// Rescan recomputes the usage of all subtrees by scanning them.
+func (fsys *quotafs) Rescan() error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	for _, t := range fsys.trackers {
+		if err := fsys.scan(t); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rescanWithin rescans all subtrees rooted at name or one of its children,
+// as their usage can not be tracked by operations on name. It must be
+// called with fsys.mu held.
+func (fsys *quotafs) rescanWithin(name string) error {
+	for _, t := range fsys.trackers {
+		if name == "." || t.root == name || strings.HasPrefix(t.root, name+"/") {
+			if err := fsys.scan(t); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// scan computes the usage of t's subtree. It must be called with fsys.mu
+// held.
+func (fsys *quotafs) scan(t *tracker) error {
+	u, err := fsys.measure(t.root)
+	if errors.Is(err, fs.ErrNotExist) {
+		t.usage = Usage{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// The subtree's root is not counted.
+	u.Inodes--
+	t.usage = u
+	return nil
+}
+
+// Usage returns the usage and quota of the subtree rooted at root.
+func (fsys *quotafs) Usage(root string) (Usage, Quota, bool) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	for _, t := range fsys.trackers {
+		if t.root == root {
+			return t.usage, t.quota, true
+		}
+	}
+	return Usage{}, Quota{}, false
+}
+
+// change describes a change of usage caused by an operation on name.
+type change struct {
+	name  string
+	delta Usage
+}
+
+// reserve adds delta to the usage of all subtrees containing name. If delta
+// exceeds any quota, no usage is changed and an error wrapping
+// ErrQuotaExceeded is returned. It must be called with fsys.mu held.
+func (fsys *quotafs) reserve(op, name string, delta Usage) error {
+	return fsys.apply(op, name, change{name: name, delta: delta})
+}
+
+// apply applies multiple changes atomically: either all of them are applied
+// or, if the sum of changes exceeds any quota, none. It must be called with
+// fsys.mu held.
+func (fsys *quotafs) apply(op, name string, changes ...change) error {
+	sums := make([]Usage, len(fsys.trackers))
+	for i, t := range fsys.trackers {
+		for _, c := range changes {
+			if t.contains(c.name) {
+				sums[i] = sums[i].add(c.delta)
+			}
+		}
+	}
+
+	for i, t := range fsys.trackers {
+		if t.exceeds(sums[i]) {
+			return wrapfs.PathError(op, name, ErrQuotaExceeded)
+		}
+	}
+
+	for i, t := range fsys.trackers {
+		t.usage = t.usage.add(sums[i])
+	}
+	return nil
+}
+
+// revert reverts changes previously applied. It must be called with fsys.mu
+// held.
+func (fsys *quotafs) revert(changes ...change) {
+	for _, c := range changes {
+		fsys.release(c.name, c.delta)
+	}
+}
+
+// release subtracts u from the usage of all subtrees containing name. It
+// must be called with fsys.mu held.
+func (fsys *quotafs) release(name string, u Usage) {
+	for _, t := range fsys.trackers {
+		if t.contains(name) {
+			t.usage = t.usage.sub(u)
+		}
+	}
+}
+
+// usageOf returns the usage of the single entry described by info.
+func usageOf(info fs.FileInfo) Usage {
+	u := Usage{Inodes: 1}
+	if info.Mode().IsRegular() {
+		u.Bytes = info.Size()
+	}
+	return u
+}
+
+// measure returns the usage of name including all of its children.
+func (fsys *quotafs) measure(name string) (Usage, error) {
+	info, err := linkutil.Lstat(fsys.backing, name)
+	if err != nil {
+		return Usage{}, err
+	}
+
+	if !info.IsDir() {
+		return usageOf(info), nil
+	}
+
+	var u Usage
+	err = fs.WalkDir(fsys.backing, name, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		u = u.add(usageOf(info))
+		return nil
+	})
+
+	return u, err
+}
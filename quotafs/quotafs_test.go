@@ -0,0 +1,306 @@
+package quotafs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	. "github.com/halimath/fixture"
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/memfs"
+	"github.com/halimath/fsx/osfs"
+)
+
+type quotafsFixture struct {
+	backing fsx.LinkFS
+	fs      FS
+}
+
+func (f *quotafsFixture) BeforeEach(t *testing.T) error {
+	f.backing = memfs.New()
+
+	if err := fsx.MkdirAll(f.backing, "jobs/a/out", 0755); err != nil {
+		return err
+	}
+	if err := fsx.MkdirAll(f.backing, "jobs/b", 0755); err != nil {
+		return err
+	}
+	if err := fsx.WriteFile(f.backing, "jobs/a/out/result.txt", []byte(strings.Repeat("a", 40)), 0644); err != nil {
+		return err
+	}
+	if err := fsx.WriteFile(f.backing, "jobs/b/result.txt", []byte(strings.Repeat("b", 20)), 0644); err != nil {
+		return err
+	}
+
+	var err error
+	f.fs, err = New(f.backing,
+		WithQuota("jobs/a", Quota{Bytes: 100, Inodes: 4}),
+		WithQuota("jobs/b", Quota{Bytes: 50}),
+		WithQuota(".", Quota{Bytes: 200}),
+	)
+	return err
+}
+
+// expectUsage expects the usage of the subtree root to be want.
+func (f *quotafsFixture) expectUsage(t *testing.T, root string, want Usage) {
+	t.Helper()
+
+	got, _, ok := f.fs.Usage(root)
+	expect.That(t, is.EqualTo(ok, true), is.DeepEqualTo(got, want))
+}
+
+// expectQuotaExceeded expects err to be a quota error.
+func expectQuotaExceeded(t *testing.T, err error) {
+	t.Helper()
+
+	var pathErr *fs.PathError
+	expect.That(t,
+		is.Error(err, ErrQuotaExceeded),
+		is.EqualTo(errors.As(err, &pathErr), true),
+	)
+}
+
+func TestQuotaFS(t *testing.T) {
+	With(t, new(quotafsFixture)).
+		Run("scan", func(t *testing.T, f *quotafsFixture) {
+			f.expectUsage(t, "jobs/a", Usage{Bytes: 40, Inodes: 2})
+			f.expectUsage(t, "jobs/b", Usage{Bytes: 20, Inodes: 1})
+			f.expectUsage(t, ".", Usage{Bytes: 60, Inodes: 6})
+
+			_, q, ok := f.fs.Usage("jobs/a")
+			expect.That(t, is.EqualTo(ok, true), is.DeepEqualTo(q, Quota{Bytes: 100, Inodes: 4}))
+
+			_, _, ok = f.fs.Usage("jobs")
+			expect.That(t, is.EqualTo(ok, false))
+		}).
+		Run("write", func(t *testing.T, f *quotafsFixture) {
+			file, err := f.fs.OpenFile("jobs/a/log.txt", fsx.O_WRONLY|fsx.O_CREATE, 0644)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			n, err := file.Write([]byte(strings.Repeat("x", 50)))
+			expect.That(t, is.NoError(err), is.EqualTo(n, 50))
+
+			n, err = file.Write([]byte(strings.Repeat("y", 20)))
+			expectQuotaExceeded(t, err)
+			expect.That(t, is.EqualTo(n, 0))
+
+			n, err = file.Write([]byte(strings.Repeat("z", 10)))
+			expect.That(t, is.NoError(err), is.EqualTo(n, 10), is.NoError(file.Close()))
+
+			content, err := f.fs.ReadFile("jobs/a/log.txt")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), strings.Repeat("x", 50)+strings.Repeat("z", 10)))
+
+			f.expectUsage(t, "jobs/a", Usage{Bytes: 100, Inodes: 3})
+			f.expectUsage(t, ".", Usage{Bytes: 120, Inodes: 7})
+		}).
+		Run("overwrite", func(t *testing.T, f *quotafsFixture) {
+			file, err := f.fs.OpenFile("jobs/a/out/result.txt", fsx.O_RDWR, 0)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			// Overwriting existing bytes does not grow the file.
+			_, err = file.Write([]byte(strings.Repeat("c", 40)))
+			expect.That(t, is.NoError(err))
+			_, err = file.Write([]byte(strings.Repeat("c", 61)))
+			expectQuotaExceeded(t, err)
+			expect.That(t, is.NoError(file.Close()))
+
+			f.expectUsage(t, "jobs/a", Usage{Bytes: 40, Inodes: 2})
+		}).
+		Run("append", func(t *testing.T, f *quotafsFixture) {
+			file, err := f.fs.OpenFile("jobs/b/result.txt", fsx.O_WRONLY|fsx.O_APPEND, 0)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			_, err = file.Write([]byte(strings.Repeat("b", 30)))
+			expect.That(t, is.NoError(err))
+			_, err = file.Write([]byte("b"))
+			expectQuotaExceeded(t, err)
+			expect.That(t, is.NoError(file.Close()))
+
+			f.expectUsage(t, "jobs/b", Usage{Bytes: 50, Inodes: 1})
+		}).
+		Run("truncate", func(t *testing.T, f *quotafsFixture) {
+			file, err := f.fs.OpenFile("jobs/a/out/result.txt", fsx.O_WRONLY|fsx.O_TRUNC, 0)
+			expect.That(t, expect.FailNow(is.NoError(err)), is.NoError(file.Close()))
+
+			f.expectUsage(t, "jobs/a", Usage{Bytes: 0, Inodes: 2})
+		}).
+		Run("writeFile", func(t *testing.T, f *quotafsFixture) {
+			err := fsx.WriteFile(f.fs, "jobs/b/result.txt", []byte(strings.Repeat("b", 51)), 0644)
+			expectQuotaExceeded(t, err)
+
+			content, err := f.fs.ReadFile("jobs/b/result.txt")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), strings.Repeat("b", 20)))
+
+			expect.That(t, is.NoError(fsx.WriteFile(f.fs, "jobs/b/result.txt", []byte(strings.Repeat("b", 50)), 0644)))
+			f.expectUsage(t, "jobs/b", Usage{Bytes: 50, Inodes: 1})
+
+			expect.That(t, is.NoError(fsx.WriteFile(f.fs, "jobs/b/result.txt", []byte("b"), 0644)))
+			f.expectUsage(t, "jobs/b", Usage{Bytes: 1, Inodes: 1})
+		}).
+		Run("inodes", func(t *testing.T, f *quotafsFixture) {
+			expect.That(t,
+				is.NoError(f.fs.Mkdir("jobs/a/tmp", 0755)),
+				is.NoError(f.fs.Symlink("jobs/a/out/result.txt", "jobs/a/result")),
+			)
+
+			expectQuotaExceeded(t, f.fs.Mkdir("jobs/a/other", 0755))
+			_, err := f.fs.OpenFile("jobs/a/tmp/file", fsx.O_WRONLY|fsx.O_CREATE, 0644)
+			expectQuotaExceeded(t, err)
+			expectQuotaExceeded(t, fsx.WriteFile(f.fs, "jobs/a/file", nil, 0644))
+
+			_, err = f.fs.Stat("jobs/a/tmp/file")
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+
+			expect.That(t, is.NoError(f.fs.Remove("jobs/a/tmp")))
+			f.expectUsage(t, "jobs/a", Usage{Bytes: 40, Inodes: 3})
+
+			expect.That(t, is.NoError(fsx.WriteFile(f.fs, "jobs/a/file", nil, 0644)))
+		}).
+		Run("remove", func(t *testing.T, f *quotafsFixture) {
+			expect.That(t, is.NoError(f.fs.Remove("jobs/a/out/result.txt")))
+			f.expectUsage(t, "jobs/a", Usage{Bytes: 0, Inodes: 1})
+			f.expectUsage(t, ".", Usage{Bytes: 20, Inodes: 5})
+
+			f.fs.Remove("jobs/a/missing")
+			f.expectUsage(t, "jobs/a", Usage{Bytes: 0, Inodes: 1})
+		}).
+		Run("removeAll", func(t *testing.T, f *quotafsFixture) {
+			expect.That(t, is.NoError(f.fs.RemoveAll("jobs/a")))
+			f.expectUsage(t, "jobs/a", Usage{})
+			f.expectUsage(t, ".", Usage{Bytes: 20, Inodes: 3})
+		}).
+		Run("rename", func(t *testing.T, f *quotafsFixture) {
+			// Moving 40 bytes into jobs/b exceeds its quota.
+			expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(f.fs, "jobs/b/result.txt", []byte(strings.Repeat("b", 30)), 0644))))
+			expectQuotaExceeded(t, f.fs.Rename("jobs/a/out", "jobs/b/out"))
+
+			_, err := f.fs.Stat("jobs/a/out/result.txt")
+			expect.That(t, is.NoError(err))
+
+			// Replacing a file releases the replaced file's usage.
+			expect.That(t, is.NoError(f.fs.Rename("jobs/a/out/result.txt", "jobs/b/result.txt")))
+			f.expectUsage(t, "jobs/a", Usage{Bytes: 0, Inodes: 1})
+			f.expectUsage(t, "jobs/b", Usage{Bytes: 40, Inodes: 1})
+			f.expectUsage(t, ".", Usage{Bytes: 40, Inodes: 5})
+		}).
+		Run("link", func(t *testing.T, f *quotafsFixture) {
+			expect.That(t, is.NoError(f.fs.Link("jobs/a/out/result.txt", "jobs/a/result.txt")))
+			f.expectUsage(t, "jobs/a", Usage{Bytes: 80, Inodes: 3})
+
+			expectQuotaExceeded(t, f.fs.Link("jobs/a/out/result.txt", "jobs/b/result2.txt"))
+			f.expectUsage(t, "jobs/b", Usage{Bytes: 20, Inodes: 1})
+		}).
+		Run("nested", func(t *testing.T, f *quotafsFixture) {
+			// The root quota applies outside of jobs/a and jobs/b as well.
+			expectQuotaExceeded(t, fsx.WriteFile(f.fs, "data.bin", make([]byte, 141), 0644))
+			expect.That(t, is.NoError(fsx.WriteFile(f.fs, "data.bin", make([]byte, 140), 0644)))
+
+			expectQuotaExceeded(t, fsx.WriteFile(f.fs, "jobs/a/data.bin", []byte("x"), 0644))
+		}).
+		Run("rescan", func(t *testing.T, f *quotafsFixture) {
+			expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(f.backing, "jobs/b/other.txt", []byte("other"), 0644))))
+			f.expectUsage(t, "jobs/b", Usage{Bytes: 20, Inodes: 1})
+
+			expect.That(t, is.NoError(f.fs.Rescan()))
+			f.expectUsage(t, "jobs/b", Usage{Bytes: 25, Inodes: 2})
+		})
+}
+
+func TestNew(t *testing.T) {
+	for _, opts := range [][]Option{
+		{WithQuota("/a", Quota{})},
+		{WithQuota("a", Quota{Bytes: -1})},
+	} {
+		_, err := New(memfs.New(), opts...)
+		expect.That(t, is.EqualTo(err != nil, true))
+	}
+
+	fsys, err := New(memfs.New(), WithQuota("missing", Quota{Inodes: 1}))
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	u, _, _ := fsys.Usage("missing")
+	expect.That(t, is.DeepEqualTo(u, Usage{}))
+}
+
+func TestOSFS(t *testing.T) {
+	fsys, err := New(osfs.DirFS(t.TempDir()), WithQuota("a", Quota{Bytes: 100}))
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	expect.That(t,
+		is.NoError(fsx.MkdirAll(fsys, "a/b", 0755)),
+		is.NoError(fsx.WriteFile(fsys, "a/b/c.txt", []byte("hello"), 0644)),
+		is.NoError(fsys.Symlink("a/b/c.txt", "link")),
+	)
+
+	expect.That(t, is.NoError(fstest.TestFS(fsys, "a/b/c.txt", "link")))
+
+	file, err := fsys.OpenFile("a/b/c.txt", fsx.O_RDWR, 0)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	defer file.Close()
+
+	// Writing beyond the end grows the file including the gap.
+	_, err = file.(io.WriterAt).WriteAt([]byte("x"), 100)
+	expectQuotaExceeded(t, err)
+	_, err = file.(io.WriterAt).WriteAt([]byte("x"), 99)
+	expect.That(t, is.NoError(err))
+
+	u, _, _ := fsys.Usage("a")
+	expect.That(t, is.DeepEqualTo(u, Usage{Bytes: 100, Inodes: 2}))
+
+	truncater := file.(interface{ Truncate(int64) error })
+	expectQuotaExceeded(t, truncater.Truncate(101))
+	expect.That(t, is.NoError(truncater.Truncate(10)))
+
+	info, err := fsys.Stat("a/b/c.txt")
+	expect.That(t, is.NoError(err), is.EqualTo(info.Size(), int64(10)))
+
+	u, _, _ = fsys.Usage("a")
+	expect.That(t, is.DeepEqualTo(u, Usage{Bytes: 10, Inodes: 2}))
+}
+
+func TestOSFS_symlink(t *testing.T) {
+	fsys, err := New(osfs.DirFS(t.TempDir()), WithQuota("a", Quota{Bytes: 10}), WithQuota("b", Quota{}))
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	expect.That(t,
+		is.NoError(fsx.MkdirAll(fsys, "a", 0755)),
+		is.NoError(fsx.MkdirAll(fsys, "b", 0755)),
+		is.NoError(fsx.WriteFile(fsys, "a/big.txt", nil, 0644)),
+		is.NoError(fsys.Symlink("a/big.txt", "b/link")),
+	)
+
+	// Writes through the link are charged to the target's subtree.
+	expectQuotaExceeded(t, fsx.WriteFile(fsys, "b/link", make([]byte, 100), 0644))
+	expect.That(t, is.NoError(fsx.WriteFile(fsys, "b/link", make([]byte, 8), 0644)))
+
+	u, _, _ := fsys.Usage("a")
+	expect.That(t, is.DeepEqualTo(u, Usage{Bytes: 8, Inodes: 1}))
+	u, _, _ = fsys.Usage("b")
+	expect.That(t, is.DeepEqualTo(u, Usage{Bytes: 0, Inodes: 1}))
+
+	file, err := fsys.OpenFile("b/link", fsx.O_WRONLY|fsx.O_TRUNC, 0)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	_, err = file.Write(make([]byte, 11))
+	expectQuotaExceeded(t, err)
+	expect.That(t, is.NoError(file.Close()))
+
+	u, _, _ = fsys.Usage("a")
+	expect.That(t, is.DeepEqualTo(u, Usage{Bytes: 0, Inodes: 1}))
+
+	// Creating a file through a dangling link or a link to a directory
+	// charges the target's subtree as well.
+	expect.That(t,
+		is.NoError(fsys.Symlink("a/new.txt", "b/new")),
+		is.NoError(fsys.Symlink("a", "b/dir")),
+		is.NoError(fsx.WriteFile(fsys, "b/new", []byte("new"), 0644)),
+	)
+	expectQuotaExceeded(t, fsx.WriteFile(fsys, "b/dir/other.txt", make([]byte, 8), 0644))
+
+	u, _, _ = fsys.Usage("a")
+	expect.That(t, is.DeepEqualTo(u, Usage{Bytes: 3, Inodes: 2}))
+}
@@ -0,0 +1,381 @@
+package s3fs
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error is returned for requests rejected by the object store. Errors with a
+// status code of 404 match fs.ErrNotExist and errors with a status code of
+// 403 match fs.ErrPermission when used with errors.Is.
+type Error struct {
+	// StatusCode is the response's HTTP status code.
+	StatusCode int
+	// Code is the error code reported by the store, e.g. NoSuchKey.
+	Code string
+	// Message is the error message reported by the store.
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3fs: unexpected status code %d", e.StatusCode)
+	}
+	return fmt.Sprintf("s3fs: %s (%d): %s", e.Code, e.StatusCode, e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case fs.ErrNotExist:
+		return e.StatusCode == http.StatusNotFound
+	case fs.ErrPermission:
+		return e.StatusCode == http.StatusForbidden
+	default:
+		return false
+	}
+}
+
+type errorResponse struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// object describes an object as returned from HEAD or list requests.
+type object struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	Size         int64     `xml:"Size"`
+	ETag         string    `xml:"ETag"`
+}
+
+type listResult struct {
+	Contents       []object `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+// client implements the object store's HTTP API.
+type client struct {
+	endpoint        *url.URL
+	bucket          string
+	http            *http.Client
+	region          string
+	accessKeyID     string
+	secretAccessKey string
+}
+
+// do sends a request for key. A non-2xx response is returned as an *Error.
+// The caller must close the response's body.
+func (c *client) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(c.endpoint.Path, "/") + "/" + c.bucket + "/" + key
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	if body == nil {
+		req.Body = http.NoBody
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	if c.accessKeyID != "" {
+		payloadHash := emptyBodySHA256
+		if len(body) > 0 {
+			payloadHash = sha256Hex(body)
+		}
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+		sign(req, payloadHash, c.accessKeyID, c.secretAccessKey, c.region, "s3", time.Now())
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return res, nil
+	}
+
+	defer res.Body.Close()
+
+	e := &Error{StatusCode: res.StatusCode}
+	var er errorResponse
+	if data, err := io.ReadAll(io.LimitReader(res.Body, 64<<10)); err == nil && xml.Unmarshal(data, &er) == nil {
+		e.Code, e.Message = er.Code, er.Message
+	}
+
+	return nil, e
+}
+
+// call sends a request and decodes the XML response into v unless v is nil.
+func (c *client) call(method, key string, query url.Values, header http.Header, body []byte, v any) error {
+	res, err := c.do(method, key, query, header, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if v == nil {
+		_, err = io.Copy(io.Discard, res.Body)
+		return err
+	}
+
+	return xml.NewDecoder(res.Body).Decode(v)
+}
+
+func (c *client) head(key string) (object, error) {
+	res, err := c.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return object{}, err
+	}
+	res.Body.Close()
+
+	o := object{
+		Key:  key,
+		Size: res.ContentLength,
+		ETag: res.Header.Get("ETag"),
+	}
+	if t, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		o.LastModified = t
+	}
+
+	return o, nil
+}
+
+// get requests the content of key starting at offset. If length is
+// negative, the content is read to the end.
+func (c *client) get(key string, offset, length int64) (io.ReadCloser, error) {
+	var header http.Header
+	if offset > 0 || length >= 0 {
+		r := "bytes=" + strconv.FormatInt(offset, 10) + "-"
+		if length >= 0 {
+			r += strconv.FormatInt(offset+length-1, 10)
+		}
+		header = http.Header{"Range": {r}}
+	}
+
+	res, err := c.do(http.MethodGet, key, nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (c *client) put(key string, data []byte) error {
+	return c.call(http.MethodPut, key, nil, nil, data, nil)
+}
+
+func (c *client) delete(key string) error {
+	return c.call(http.MethodDelete, key, nil, nil, nil, nil)
+}
+
+func (c *client) copy(src, dst string) error {
+	return c.call(http.MethodPut, dst, nil, http.Header{
+		"X-Amz-Copy-Source": {uriEncode("/"+c.bucket+"/"+src, false)},
+	}, nil, nil)
+}
+
+// list lists the objects starting with prefix. If delimiter is not empty,
+// keys containing delimiter after prefix are grouped into common prefixes.
+// fn is called for each page of results. If max is positive, at most max
+// keys are requested and only a single page is returned.
+func (c *client) list(prefix, delimiter string, max int, fn func(*listResult) error) error {
+	token := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+		}
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if max > 0 {
+			query.Set("max-keys", strconv.Itoa(max))
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		var res listResult
+		if err := c.call(http.MethodGet, "", query, nil, nil, &res); err != nil {
+			return err
+		}
+
+		if err := fn(&res); err != nil {
+			return err
+		}
+
+		if max > 0 || !res.IsTruncated || res.NextContinuationToken == "" {
+			return nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+func (c *client) createMultipartUpload(key string) (string, error) {
+	var res initiateMultipartUploadResult
+	if err := c.call(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil, &res); err != nil {
+		return "", err
+	}
+	return res.UploadID, nil
+}
+
+func (c *client) uploadPart(key, uploadID string, number int, data []byte) (string, error) {
+	res, err := c.do(http.MethodPut, key, url.Values{
+		"partNumber": {strconv.Itoa(number)},
+		"uploadId":   {uploadID},
+	}, nil, data)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	_, err = io.Copy(io.Discard, res.Body)
+	return res.Header.Get("ETag"), err
+}
+
+func (c *client) completeMultipartUpload(key, uploadID string, parts []completedPart) error {
+	body, err := xml.Marshal(completeMultipartUpload{Parts: parts})
+	if err != nil {
+		return err
+	}
+
+	return c.call(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, body, nil)
+}
+
+func (c *client) abortMultipartUpload(key, uploadID string) error {
+	return c.call(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil, nil)
+}
+
+// uploader uploads an object's content written in chunks. Content exceeding
+// partSize is uploaded using a multipart upload.
+type uploader struct {
+	c        *client
+	key      string
+	partSize int
+	buf      []byte
+	uploadID string
+	parts    []completedPart
+	size     int64
+}
+
+func (u *uploader) Write(p []byte) (int, error) {
+	start := u.size
+	u.buf = append(u.buf, p...)
+	u.size += int64(len(p))
+
+	// Keep at least one byte buffered so that the last part is never empty
+	// and small objects are uploaded with a single request.
+	for len(u.buf) > u.partSize {
+		if err := u.uploadPart(u.buf[:u.partSize]); err != nil {
+			return u.reject(start), err
+		}
+		u.buf = append(u.buf[:0], u.buf[u.partSize:]...)
+	}
+
+	return len(p), nil
+}
+
+// reject drops the bytes of a write starting at offset start that have not
+// been uploaded yet. It returns the number of bytes accepted.
+func (u *uploader) reject(start int64) int {
+	uploaded := u.size - int64(len(u.buf))
+
+	n := uploaded - start
+	if n < 0 {
+		n = 0
+	}
+
+	u.buf = u.buf[:start+n-uploaded]
+	u.size = start + n
+	return int(n)
+}
+
+func (u *uploader) uploadPart(data []byte) error {
+	if u.uploadID == "" {
+		id, err := u.c.createMultipartUpload(u.key)
+		if err != nil {
+			return err
+		}
+		u.uploadID = id
+	}
+
+	number := len(u.parts) + 1
+	etag, err := u.c.uploadPart(u.key, u.uploadID, number, data)
+	if err != nil {
+		return err
+	}
+
+	u.parts = append(u.parts, completedPart{PartNumber: number, ETag: etag})
+	return nil
+}
+
+// finish uploads the remaining content and completes the upload.
+func (u *uploader) finish() error {
+	if u.uploadID == "" {
+		return u.c.put(u.key, u.buf)
+	}
+
+	if err := u.uploadPart(u.buf); err != nil {
+		return err
+	}
+	u.buf = nil
+
+	return u.c.completeMultipartUpload(u.key, u.uploadID, u.parts)
+}
+
+// abort aborts a started multipart upload.
+func (u *uploader) abort() error {
+	if u.uploadID == "" {
+		return nil
+	}
+	return u.c.abortMultipartUpload(u.key, u.uploadID)
+}
+
+// upload uploads data as the content of key.
+func (c *client) upload(key string, data []byte, partSize int) error {
+	u := &uploader{c: c, key: key, partSize: partSize}
+	if _, err := u.Write(data); err != nil {
+		u.abort()
+		return err
+	}
+
+	if err := u.finish(); err != nil {
+		u.abort()
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,242 @@
+package s3fs
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/halimath/fsx"
+)
+
+// objectFile provides read access to an object. Content is requested lazily
+// starting at the current offset; seeking discards the current response.
+type objectFile struct {
+	fsys   *s3fs
+	name   string
+	info   *fileInfo
+	body   io.ReadCloser
+	pos    int64
+	closed bool
+}
+
+func (f *objectFile) pathError(op string, err error) error {
+	return &fs.PathError{
+		Op:   op,
+		Path: f.name,
+		Err:  err,
+	}
+}
+
+func (f *objectFile) Stat() (fs.FileInfo, error) {
+	if f.closed {
+		return nil, f.pathError("Stat", fs.ErrClosed)
+	}
+	return f.info, nil
+}
+
+func (f *objectFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, f.pathError("Read", fs.ErrClosed)
+	}
+
+	if f.pos >= f.info.size {
+		return 0, io.EOF
+	}
+
+	if f.body == nil {
+		body, err := f.fsys.c.get(f.fsys.key(f.name), f.pos, -1)
+		if err != nil {
+			return 0, f.pathError("Read", err)
+		}
+		f.body = body
+	}
+
+	n, err := f.body.Read(p)
+	f.pos += int64(n)
+	return n, err
+}
+
+// ReadAt reads len(p) bytes starting at off using a range request.
+func (f *objectFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, f.pathError("ReadAt", fs.ErrClosed)
+	}
+
+	if off < 0 {
+		return 0, f.pathError("ReadAt", fs.ErrInvalid)
+	}
+
+	if off >= f.info.size {
+		return 0, io.EOF
+	}
+
+	length := int64(len(p))
+	if off+length > f.info.size {
+		length = f.info.size - off
+	}
+
+	if length == 0 {
+		return 0, nil
+	}
+
+	body, err := f.fsys.c.get(f.fsys.key(f.name), off, length)
+	if err != nil {
+		return 0, f.pathError("ReadAt", err)
+	}
+	defer body.Close()
+
+	n, err := io.ReadFull(body, p[:length])
+	if err != nil {
+		return n, f.pathError("ReadAt", err)
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *objectFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, f.pathError("Seek", fs.ErrClosed)
+	}
+
+	var pos int64
+	switch whence {
+	case fsx.SeekWhenceRelativeOrigin:
+		pos = offset
+	case fsx.SeekWhenceRelativeCurrentOffset:
+		pos = f.pos + offset
+	case fsx.SeekWhenceRelativeEnd:
+		pos = f.info.size + offset
+	default:
+		return 0, f.pathError("Seek", fmt.Errorf("%w: %d", fsx.ErrInvalidWhence, whence))
+	}
+
+	if pos < 0 {
+		return 0, f.pathError("Seek", fs.ErrInvalid)
+	}
+
+	if pos != f.pos && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+
+	f.pos = pos
+	return pos, nil
+}
+
+func (f *objectFile) Write(p []byte) (int, error) {
+	return 0, f.pathError("Write", fs.ErrPermission)
+}
+
+func (f *objectFile) Chmod(mode fs.FileMode) error {
+	return f.pathError("Chmod", fsx.ErrNotSupported)
+}
+
+// Chown is a no-op as object stores do not store ownership.
+func (f *objectFile) Chown(uid, gid int) error { return nil }
+
+func (f *objectFile) Close() error {
+	if f.closed {
+		return f.pathError("Close", fs.ErrClosed)
+	}
+
+	f.closed = true
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
+
+// uploadFile streams content written to an object. The object is created or
+// replaced when the file is closed.
+type uploadFile struct {
+	name   string
+	info   *fileInfo
+	u      *uploader
+	err    error
+	closed bool
+}
+
+func (f *uploadFile) pathError(op string, err error) error {
+	return &fs.PathError{
+		Op:   op,
+		Path: f.name,
+		Err:  err,
+	}
+}
+
+func (f *uploadFile) Stat() (fs.FileInfo, error) {
+	if f.closed {
+		return nil, f.pathError("Stat", fs.ErrClosed)
+	}
+
+	i := *f.info
+	i.size = f.u.size
+	return &i, nil
+}
+
+func (f *uploadFile) Read(p []byte) (int, error) {
+	return 0, f.pathError("Read", fs.ErrPermission)
+}
+
+func (f *uploadFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, f.pathError("Write", fs.ErrClosed)
+	}
+
+	if f.err != nil {
+		return 0, f.pathError("Write", f.err)
+	}
+
+	n, err := f.u.Write(p)
+	if err != nil {
+		f.err = err
+		return n, f.pathError("Write", err)
+	}
+	return n, nil
+}
+
+// Seek only supports querying the current offset as content is streamed.
+func (f *uploadFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, f.pathError("Seek", fs.ErrClosed)
+	}
+
+	switch {
+	case whence == fsx.SeekWhenceRelativeCurrentOffset && offset == 0,
+		whence == fsx.SeekWhenceRelativeOrigin && offset == f.u.size,
+		whence == fsx.SeekWhenceRelativeEnd && offset == 0:
+		return f.u.size, nil
+	}
+
+	return 0, f.pathError("Seek", fsx.ErrNotSupported)
+}
+
+func (f *uploadFile) Chmod(mode fs.FileMode) error {
+	return f.pathError("Chmod", fsx.ErrNotSupported)
+}
+
+// Chown is a no-op as object stores do not store ownership.
+func (f *uploadFile) Chown(uid, gid int) error { return nil }
+
+// Close uploads the remaining content. If a previous write failed, the
+// upload is aborted.
+func (f *uploadFile) Close() error {
+	if f.closed {
+		return f.pathError("Close", fs.ErrClosed)
+	}
+	f.closed = true
+
+	if f.err == nil {
+		f.err = f.u.finish()
+	}
+
+	if f.err != nil {
+		f.u.abort()
+		return f.pathError("Close", f.err)
+	}
+
+	return nil
+}
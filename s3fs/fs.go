@@ -0,0 +1,528 @@
+package s3fs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/internal/buffile"
+)
+
+type fileInfo struct {
+	name    string
+	size    int64
+	dir     bool
+	modTime time.Time
+}
+
+func (i *fileInfo) Name() string       { return path.Base(i.name) }
+func (i *fileInfo) Size() int64        { return i.size }
+func (i *fileInfo) ModTime() time.Time { return i.modTime }
+func (i *fileInfo) IsDir() bool        { return i.dir }
+func (i *fileInfo) Sys() any           { return nil }
+
+func (i *fileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+type s3fs struct {
+	c        *client
+	prefix   string
+	partSize int
+}
+
+// key returns the object key for name.
+func (fsys *s3fs) key(name string) string {
+	if name == "." {
+		return strings.TrimSuffix(fsys.prefix, "/")
+	}
+	return fsys.prefix + name
+}
+
+// dirKey returns the key prefix shared by all entries of directory name.
+// This is also the key of the directory's marker object.
+func (fsys *s3fs) dirKey(name string) string {
+	if name == "." {
+		return fsys.prefix
+	}
+	return fsys.prefix + name + "/"
+}
+
+func pathError(op, name string, err error) error {
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		return err
+	}
+
+	return &fs.PathError{
+		Op:   op,
+		Path: name,
+		Err:  err,
+	}
+}
+
+// stat returns the info for name. A name refers to a directory if any key
+// starts with the directory's key prefix.
+func (fsys *s3fs) stat(name string) (*fileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, fs.ErrInvalid
+	}
+
+	if name == "." {
+		return &fileInfo{name: name, dir: true}, nil
+	}
+
+	o, err := fsys.c.head(fsys.key(name))
+	if err == nil {
+		return &fileInfo{name: name, size: o.Size, modTime: o.LastModified}, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	exists := false
+	err = fsys.c.list(fsys.dirKey(name), "", 1, func(res *listResult) error {
+		exists = len(res.Contents) > 0
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fs.ErrNotExist
+	}
+
+	// Directories report a zero modification time as they are not stored
+	// as objects of their own.
+	return &fileInfo{name: name, dir: true}, nil
+}
+
+// checkParent makes sure the parent directory of name exists.
+func (fsys *s3fs) checkParent(name string) error {
+	parent := path.Dir(name)
+	if parent == "." {
+		return nil
+	}
+
+	info, err := fsys.stat(parent)
+	if err != nil {
+		return err
+	}
+	if !info.dir {
+		return fs.ErrInvalid
+	}
+	return nil
+}
+
+// keepDir creates a marker for directory name if no other key with the
+// directory's prefix exists. This keeps a directory after removing its last
+// entry.
+func (fsys *s3fs) keepDir(name string) error {
+	if name == "." {
+		return nil
+	}
+
+	empty := true
+	err := fsys.c.list(fsys.dirKey(name), "", 1, func(res *listResult) error {
+		empty = len(res.Contents) == 0
+		return nil
+	})
+	if err != nil || !empty {
+		return err
+	}
+
+	return fsys.c.put(fsys.dirKey(name), nil)
+}
+
+// keys returns all keys starting with prefix.
+func (fsys *s3fs) keys(prefix string) ([]string, error) {
+	var keys []string
+	err := fsys.c.list(prefix, "", 0, func(res *listResult) error {
+		for _, o := range res.Contents {
+			keys = append(keys, o.Key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// -- fs.FS
+
+// Open opens the named file for reading.
+func (fsys *s3fs) Open(name string) (fs.File, error) {
+	return fsys.OpenFile(name, fsx.O_RDONLY, 0)
+}
+
+// -- fsx.FS
+
+// OpenFile opens the named file.
+func (fsys *s3fs) OpenFile(name string, flag int, perm fs.FileMode) (fsx.File, error) {
+	writable := flag&(fsx.O_WRONLY|fsx.O_RDWR) != 0
+
+	info, err := fsys.stat(name)
+	created := false
+
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if flag&fsx.O_CREATE == 0 {
+			return nil, pathError("OpenFile", name, err)
+		}
+		if err := fsys.checkParent(name); err != nil {
+			return nil, pathError("OpenFile", name, err)
+		}
+		created = true
+		info = &fileInfo{name: name, modTime: time.Now()}
+
+	case err != nil:
+		return nil, pathError("OpenFile", name, err)
+
+	case flag&fsx.O_CREATE != 0 && flag&fsx.O_EXCL != 0:
+		return nil, pathError("OpenFile", name, fs.ErrExist)
+
+	case info.dir:
+		if writable {
+			return nil, pathError("OpenFile", name, buffile.ErrIsDirectory)
+		}
+
+		entries, err := fsys.readDir(name)
+		if err != nil {
+			return nil, pathError("OpenFile", name, err)
+		}
+
+		return buffile.NewDir(name, func() (fs.FileInfo, error) { return info, nil }, entries), nil
+	}
+
+	if !writable {
+		return &objectFile{fsys: fsys, name: name, info: info}, nil
+	}
+
+	if flag&fsx.O_WRONLY != 0 && flag&fsx.O_APPEND == 0 && (created || flag&fsx.O_TRUNC != 0) {
+		return &uploadFile{
+			name: name,
+			info: info,
+			u:    &uploader{c: fsys.c, key: fsys.key(name), partSize: fsys.partSize},
+		}, nil
+	}
+
+	var data []byte
+	if !created && flag&fsx.O_TRUNC == 0 {
+		data, err = fsys.readFile(name)
+		if err != nil {
+			return nil, pathError("OpenFile", name, err)
+		}
+	}
+
+	return buffile.New(name, data, buffile.Options{
+		Flag:  flag,
+		Dirty: created,
+		Stat: func(size int64) (fs.FileInfo, error) {
+			i := *info
+			i.size = size
+			return &i, nil
+		},
+		Commit: func(data []byte) error {
+			return fsys.c.upload(fsys.key(name), data, fsys.partSize)
+		},
+	}), nil
+}
+
+func (fsys *s3fs) readFile(name string) ([]byte, error) {
+	r, err := fsys.c.get(fsys.key(name), 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// readDir lists the entries of directory name sorted by name.
+func (fsys *s3fs) readDir(name string) ([]fs.DirEntry, error) {
+	prefix := fsys.dirKey(name)
+
+	var entries []fs.DirEntry
+	err := fsys.c.list(prefix, "/", 0, func(res *listResult) error {
+		for _, p := range res.CommonPrefixes {
+			n := strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/")
+			if n == "" {
+				continue
+			}
+			entries = append(entries, fs.FileInfoToDirEntry(&fileInfo{name: path.Join(name, n), dir: true}))
+		}
+
+		for _, o := range res.Contents {
+			n := strings.TrimPrefix(o.Key, prefix)
+			if n == "" {
+				// The directory's marker
+				continue
+			}
+			entries = append(entries, fs.FileInfoToDirEntry(&fileInfo{name: path.Join(name, n), size: o.Size, modTime: o.LastModified}))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	return entries, nil
+}
+
+// Mkdir creates a directory by creating a marker object.
+func (fsys *s3fs) Mkdir(name string, perm fs.FileMode) error {
+	_, err := fsys.stat(name)
+	if err == nil {
+		return pathError("Mkdir", name, fs.ErrExist)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return pathError("Mkdir", name, err)
+	}
+
+	if err := fsys.checkParent(name); err != nil {
+		return pathError("Mkdir", name, err)
+	}
+
+	if err := fsys.c.put(fsys.dirKey(name), nil); err != nil {
+		return pathError("Mkdir", name, err)
+	}
+
+	return nil
+}
+
+// Remove removes the named file or empty directory.
+func (fsys *s3fs) Remove(name string) error {
+	if name == "." {
+		return pathError("Remove", name, fs.ErrInvalid)
+	}
+
+	info, err := fsys.stat(name)
+	if err != nil {
+		return pathError("Remove", name, err)
+	}
+
+	if info.dir {
+		prefix := fsys.dirKey(name)
+		err = fsys.c.list(prefix, "", 2, func(res *listResult) error {
+			for _, o := range res.Contents {
+				if o.Key != prefix {
+					return fsx.ErrDirNotEmpty
+				}
+			}
+			return nil
+		})
+		if err == nil {
+			err = fsys.c.delete(prefix)
+		}
+	} else {
+		err = fsys.c.delete(fsys.key(name))
+	}
+
+	if err == nil {
+		err = fsys.keepDir(path.Dir(name))
+	}
+
+	if err != nil {
+		return pathError("Remove", name, err)
+	}
+	return nil
+}
+
+// RemoveAll removes name and all of its children. It returns nil if name does
+// not exist.
+func (fsys *s3fs) RemoveAll(name string) error {
+	if !fs.ValidPath(name) || name == "." {
+		return pathError("RemoveAll", name, fs.ErrInvalid)
+	}
+
+	keys, err := fsys.keys(fsys.dirKey(name))
+	if err != nil {
+		return pathError("RemoveAll", name, err)
+	}
+
+	if _, err := fsys.c.head(fsys.key(name)); err == nil {
+		keys = append(keys, fsys.key(name))
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return pathError("RemoveAll", name, err)
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	for _, k := range keys {
+		if err := fsys.c.delete(k); err != nil {
+			return pathError("RemoveAll", name, err)
+		}
+	}
+
+	if err := fsys.keepDir(path.Dir(name)); err != nil {
+		return pathError("RemoveAll", name, err)
+	}
+
+	return nil
+}
+
+// Rename renames oldpath to newpath by copying all affected objects and
+// deleting the sources afterwards. If newpath exists and is not a non-empty
+// directory, it is replaced.
+func (fsys *s3fs) Rename(oldpath, newpath string) error {
+	if oldpath == "." || newpath == "." {
+		return pathError("Rename", oldpath, fs.ErrInvalid)
+	}
+
+	from, err := fsys.stat(oldpath)
+	if err != nil {
+		return pathError("Rename", oldpath, err)
+	}
+
+	if oldpath == newpath {
+		return nil
+	}
+
+	if strings.HasPrefix(newpath, oldpath+"/") {
+		return pathError("Rename", newpath, fs.ErrInvalid)
+	}
+
+	to, err := fsys.stat(newpath)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if err := fsys.checkParent(newpath); err != nil {
+			return pathError("Rename", newpath, err)
+		}
+
+	case err != nil:
+		return pathError("Rename", newpath, err)
+
+	case to.dir != from.dir:
+		return pathError("Rename", newpath, fs.ErrExist)
+
+	case to.dir:
+		keys, err := fsys.keys(fsys.dirKey(newpath))
+		if err != nil {
+			return pathError("Rename", newpath, err)
+		}
+		if len(keys) > 1 || len(keys) == 1 && keys[0] != fsys.dirKey(newpath) {
+			return pathError("Rename", newpath, fsx.ErrDirNotEmpty)
+		}
+	}
+
+	if from.dir {
+		err = fsys.renameDir(oldpath, newpath)
+	} else {
+		err = fsys.c.copy(fsys.key(oldpath), fsys.key(newpath))
+		if err == nil {
+			err = fsys.c.delete(fsys.key(oldpath))
+		}
+	}
+
+	if err == nil {
+		err = fsys.keepDir(path.Dir(oldpath))
+	}
+
+	if err != nil {
+		return pathError("Rename", oldpath, err)
+	}
+	return nil
+}
+
+func (fsys *s3fs) renameDir(oldpath, newpath string) error {
+	from, to := fsys.dirKey(oldpath), fsys.dirKey(newpath)
+
+	keys, err := fsys.keys(from)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		if err := fsys.c.copy(k, to+strings.TrimPrefix(k, from)); err != nil {
+			return err
+		}
+	}
+
+	for _, k := range keys {
+		if err := fsys.c.delete(k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SameFile reports whether fi1 and fi2 describe the same object. As object
+// stores do not support links, this is the case if both have the same name
+// and type.
+func (fsys *s3fs) SameFile(fi1, fi2 fs.FileInfo) bool {
+	i1, ok := fi1.(*fileInfo)
+	if !ok {
+		return false
+	}
+
+	i2, ok := fi2.(*fileInfo)
+	if !ok {
+		return false
+	}
+
+	return i1.name == i2.name && i1.dir == i2.dir
+}
+
+// -- fs.StatFS, fs.ReadDirFS, fs.ReadFileFS
+
+// Stat returns a fs.FileInfo describing the named file.
+func (fsys *s3fs) Stat(name string) (fs.FileInfo, error) {
+	info, err := fsys.stat(name)
+	if err != nil {
+		return nil, pathError("Stat", name, err)
+	}
+	return info, nil
+}
+
+// ReadDir returns the sorted entries of the named directory.
+func (fsys *s3fs) ReadDir(name string) ([]fs.DirEntry, error) {
+	info, err := fsys.stat(name)
+	if err != nil {
+		return nil, pathError("ReadDir", name, err)
+	}
+	if !info.dir {
+		return nil, pathError("ReadDir", name, fs.ErrInvalid)
+	}
+
+	entries, err := fsys.readDir(name)
+	if err != nil {
+		return nil, pathError("ReadDir", name, err)
+	}
+	return entries, nil
+}
+
+// ReadFile returns the content of the named file.
+func (fsys *s3fs) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, pathError("ReadFile", name, fs.ErrInvalid)
+	}
+
+	if name == "." {
+		return nil, pathError("ReadFile", name, buffile.ErrIsDirectory)
+	}
+
+	data, err := fsys.readFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		// name might refer to a directory.
+		if info, serr := fsys.stat(name); serr == nil && info.dir {
+			err = buffile.ErrIsDirectory
+		}
+	}
+	if err != nil {
+		return nil, pathError("ReadFile", name, err)
+	}
+	return data, nil
+}
+
+var _ FS = &s3fs{}
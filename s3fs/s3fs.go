@@ -0,0 +1,164 @@
+// Package s3fs provides a fsx.FS implementation that stores files as objects
+// in a bucket of an S3-compatible object store.
+//
+// s3fs talks to the store using plain HTTP requests (GetObject, PutObject,
+// DeleteObject, CopyObject, ListObjectsV2 and the multipart upload API) and
+// signs them using AWS Signature Version 4 if credentials are given. Buckets
+// are addressed path-style, i.e. as https://endpoint/bucket/key.
+//
+// Object stores have no directories. s3fs emulates them based on key
+// prefixes: a directory exists if any key starts with the directory's name
+// followed by a slash. Mkdir creates an empty marker object named after the
+// directory with a trailing slash so that empty directories can exist. When
+// removing or renaming the last entry of a directory, s3fs creates such a
+// marker to keep the directory.
+//
+// Renaming is emulated by copying every affected object and deleting the
+// source afterwards; it is neither atomic nor cheap for large directories.
+// Objects copied this way are limited to 5 GiB by the CopyObject API.
+//
+// Files opened for reading fetch their content lazily using range requests.
+// Files opened write-only and truncated (or newly created) stream their
+// content to the store; content exceeding the configured part size is
+// uploaded using a multipart upload. All other writable files are buffered in
+// memory and uploaded when closed. A file becomes visible to other clients
+// when it is closed.
+//
+// Object stores do not support permissions, ownership, symlinks or
+// modification times set by clients. All files report a mode of 0644 and
+// all directories a mode of 0755; directories report a zero modification
+// time.
+package s3fs
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/halimath/fsx"
+)
+
+const (
+	// DefaultPartSize is the default size of the parts used for multipart
+	// uploads.
+	DefaultPartSize = 8 << 20
+
+	// DefaultRegion is the default region used to sign requests.
+	DefaultRegion = "us-east-1"
+)
+
+// Option defines a functional option for New.
+type Option func(*options)
+
+type options struct {
+	client          *http.Client
+	region          string
+	accessKeyID     string
+	secretAccessKey string
+	prefix          string
+	partSize        int
+}
+
+// WithHTTPClient sets the HTTP client used to send requests. Defaults to
+// http.DefaultClient. Use a client with a timeout to limit the duration of
+// requests.
+func WithHTTPClient(c *http.Client) Option {
+	return func(o *options) {
+		o.client = c
+	}
+}
+
+// WithCredentials sets the credentials used to sign requests. Without
+// credentials, requests are sent unsigned which is only useful for public
+// buckets and test servers.
+func WithCredentials(accessKeyID, secretAccessKey string) Option {
+	return func(o *options) {
+		o.accessKeyID = accessKeyID
+		o.secretAccessKey = secretAccessKey
+	}
+}
+
+// WithRegion sets the region used to sign requests. Defaults to
+// DefaultRegion.
+func WithRegion(region string) Option {
+	return func(o *options) {
+		o.region = region
+	}
+}
+
+// WithPrefix sets a key prefix which is used as the filesystem's root
+// directory. The prefix is separated from names using a slash.
+func WithPrefix(prefix string) Option {
+	return func(o *options) {
+		o.prefix = strings.Trim(prefix, "/")
+	}
+}
+
+// WithPartSize sets the size of the parts used for multipart uploads. Files
+// not larger than size are uploaded using a single request. Note that S3
+// requires parts (except for the last one) to be at least 5 MiB.
+func WithPartSize(size int) Option {
+	return func(o *options) {
+		o.partSize = size
+	}
+}
+
+// FS defines the interface of an object store backed filesystem.
+type FS interface {
+	fsx.FS
+	fsx.RemoveAllFS
+	fs.StatFS
+	fs.ReadDirFS
+	fs.ReadFileFS
+}
+
+// New creates a filesystem operating on bucket of the object store reachable
+// at endpoint, e.g. https://s3.eu-central-1.amazonaws.com. New does not
+// contact the store.
+func New(endpoint, bucket string, opts ...Option) (FS, error) {
+	o := options{
+		client:   http.DefaultClient,
+		region:   DefaultRegion,
+		partSize: DefaultPartSize,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("s3fs: invalid endpoint: %q", endpoint)
+	}
+
+	if bucket == "" || strings.Contains(bucket, "/") {
+		return nil, fmt.Errorf("s3fs: invalid bucket: %q", bucket)
+	}
+
+	if o.partSize <= 0 {
+		return nil, fmt.Errorf("s3fs: invalid part size: %d", o.partSize)
+	}
+
+	prefix := o.prefix
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	return &s3fs{
+		c: &client{
+			endpoint:        u,
+			bucket:          bucket,
+			http:            o.client,
+			region:          o.region,
+			accessKeyID:     o.accessKeyID,
+			secretAccessKey: o.secretAccessKey,
+		},
+		prefix:   prefix,
+		partSize: o.partSize,
+	}, nil
+}
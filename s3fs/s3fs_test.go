@@ -0,0 +1,266 @@
+package s3fs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	. "github.com/halimath/fixture"
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/internal/buffile"
+	"github.com/halimath/fsx/s3fs/s3test"
+)
+
+const bucket = "test"
+
+type s3fsFixture struct {
+	srv *s3test.Server
+	fs  FS
+}
+
+func (f *s3fsFixture) BeforeEach(t *testing.T) error {
+	f.srv = s3test.NewServer(bucket)
+
+	var err error
+	f.fs, err = New(f.srv.URL, bucket, WithPrefix("root"), WithPartSize(16), WithCredentials("key", "secret"))
+	if err != nil {
+		return err
+	}
+
+	if err := fsx.MkdirAll(f.fs, "etc/ssl", 0755); err != nil {
+		return err
+	}
+	if err := fsx.WriteFile(f.fs, "etc/hosts", []byte("127.0.0.1 localhost\n"), 0644); err != nil {
+		return err
+	}
+	return fsx.WriteFile(f.fs, "etc/ssl/cert.pem", []byte("cert"), 0600)
+}
+
+func (f *s3fsFixture) AfterEach(t *testing.T) error {
+	f.srv.Close()
+	return nil
+}
+
+func TestS3FS(t *testing.T) {
+	With(t, new(s3fsFixture)).
+		Run("fstest", func(t *testing.T, f *s3fsFixture) {
+			expect.That(t, is.NoError(fstest.TestFS(f.fs, "etc/hosts", "etc/ssl/cert.pem")))
+		}).
+		Run("keys", func(t *testing.T, f *s3fsFixture) {
+			expect.That(t, is.DeepEqualTo(f.srv.Keys(bucket), []string{
+				"root/etc/",
+				"root/etc/hosts",
+				"root/etc/ssl/",
+				"root/etc/ssl/cert.pem",
+			}))
+
+			for _, r := range f.srv.Requests() {
+				expect.That(t, is.EqualTo(r.Bucket, bucket))
+			}
+		}).
+		Run("multipart", func(t *testing.T, f *s3fsFixture) {
+			data := bytes.Repeat([]byte("0123456789"), 5)
+
+			expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(f.fs, "large", data, 0644))))
+
+			content, ok := f.srv.Object(bucket, "root/large")
+			expect.That(t,
+				is.EqualTo(ok, true),
+				is.DeepEqualTo(content, data),
+				is.EqualTo(f.srv.Uploads(), 0),
+			)
+
+			parts := 0
+			for _, r := range f.srv.Requests() {
+				if r.Method == http.MethodPut && r.Key == "root/large" && r.Query.Has("partNumber") {
+					parts++
+				}
+			}
+			expect.That(t, is.EqualTo(parts, 4))
+
+			// Modify the large file using a buffered file.
+			file, err := f.fs.OpenFile("large", fsx.O_RDWR, 0)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			_, err = file.Seek(10, io.SeekStart)
+			expect.That(t, is.NoError(err))
+			_, err = file.Write([]byte("abcdefghij"))
+			expect.That(t, is.NoError(err), is.NoError(file.Close()))
+
+			content, err = fs.ReadFile(f.fs, "large")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "0123456789abcdefghij012345678901234567890123456789"))
+		}).
+		Run("readAt", func(t *testing.T, f *s3fsFixture) {
+			file, err := f.fs.Open("etc/hosts")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			defer file.Close()
+
+			buf := make([]byte, 9)
+			n, err := file.(io.ReaderAt).ReadAt(buf, 10)
+			expect.That(t, is.NoError(err), is.EqualTo(string(buf[:n]), "localhost"))
+
+			_, err = file.(io.Seeker).Seek(10, io.SeekStart)
+			expect.That(t, is.NoError(err))
+
+			rest, err := io.ReadAll(file)
+			expect.That(t, is.NoError(err), is.EqualTo(string(rest), "localhost\n"))
+		}).
+		Run("createExclusive", func(t *testing.T, f *s3fsFixture) {
+			_, err := f.fs.OpenFile("etc/hosts", fsx.O_WRONLY|fsx.O_CREATE|fsx.O_EXCL, 0644)
+			expect.That(t, is.Error(err, fs.ErrExist))
+
+			_, err = f.fs.OpenFile("missing/file", fsx.O_WRONLY|fsx.O_CREATE, 0644)
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+
+			_, err = f.fs.OpenFile("etc", fsx.O_WRONLY, 0644)
+			expect.That(t, is.Error(err, buffile.ErrIsDirectory))
+		}).
+		Run("mkdirAndRemove", func(t *testing.T, f *s3fsFixture) {
+			expect.That(t,
+				is.NoError(f.fs.Mkdir("var", 0700)),
+				is.Error(f.fs.Mkdir("var", 0700), fs.ErrExist),
+				is.Error(f.fs.Mkdir("missing/child", 0700), fs.ErrNotExist),
+				is.Error(f.fs.Remove("etc"), fsx.ErrDirNotEmpty),
+				is.NoError(f.fs.Remove("var")),
+				is.Error(f.fs.Remove("var"), fs.ErrNotExist),
+				is.NoError(f.fs.Remove("etc/ssl/cert.pem")),
+			)
+
+			// The emptied directory is kept.
+			info, err := f.fs.Stat("etc/ssl")
+			expect.That(t, is.NoError(err), is.EqualTo(info.IsDir(), true))
+
+			expect.That(t,
+				is.NoError(f.fs.RemoveAll("etc")),
+				is.NoError(f.fs.RemoveAll("etc")),
+				is.DeepEqualTo(f.srv.Keys(bucket), []string{}),
+			)
+		}).
+		Run("rename", func(t *testing.T, f *s3fsFixture) {
+			expect.That(t, expect.FailNow(is.NoError(f.fs.Rename("etc", "config"))))
+
+			_, err := f.fs.Stat("etc/hosts")
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+
+			content, err := fs.ReadFile(f.fs, "config/ssl/cert.pem")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "cert"))
+
+			expect.That(t,
+				is.Error(f.fs.Rename("config", "config/ssl/sub"), fs.ErrInvalid),
+				is.Error(f.fs.Rename("config/hosts", "config/ssl"), fs.ErrExist),
+				is.NoError(f.fs.Rename("config/hosts", "config/ssl/cert.pem")),
+			)
+
+			content, err = fs.ReadFile(f.fs, "config/ssl/cert.pem")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "127.0.0.1 localhost\n"))
+
+			expect.That(t, is.DeepEqualTo(f.srv.Keys(bucket), []string{
+				"root/config/",
+				"root/config/ssl/",
+				"root/config/ssl/cert.pem",
+			}))
+		}).
+		Run("readDir", func(t *testing.T, f *s3fsFixture) {
+			expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(f.fs, "etc.txt", []byte("x"), 0644))))
+
+			entries, err := f.fs.ReadDir(".")
+			expect.That(t, expect.FailNow(is.NoError(err)), expect.FailNow(is.SliceOfLen(entries, 2)))
+			expect.That(t,
+				is.EqualTo(entries[0].Name(), "etc"),
+				is.EqualTo(entries[0].IsDir(), true),
+				is.EqualTo(entries[1].Name(), "etc.txt"),
+			)
+
+			_, err = f.fs.ReadDir("etc/hosts")
+			expect.That(t, is.Error(err, fs.ErrInvalid))
+		}).
+		Run("specialNames", func(t *testing.T, f *s3fsFixture) {
+			name := "etc/a b+c&d=ä.txt"
+			expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(f.fs, name, []byte("special"), 0644))))
+
+			content, err := fs.ReadFile(f.fs, name)
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "special"))
+
+			_, ok := f.srv.Object(bucket, "root/"+name)
+			expect.That(t, is.EqualTo(ok, true))
+		})
+}
+
+func TestS3FS_paging(t *testing.T) {
+	srv := s3test.NewServer(bucket)
+	defer srv.Close()
+
+	fsys, err := New(srv.URL, bucket)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	expect.That(t, expect.FailNow(is.NoError(fsys.Mkdir("dir", 0755))))
+	for i := 0; i < 1100; i++ {
+		expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(fsys, fmt.Sprintf("dir/%04d", i), nil, 0644))))
+	}
+
+	entries, err := fsys.ReadDir("dir")
+	expect.That(t, expect.FailNow(is.NoError(err)), is.SliceOfLen(entries, 1100))
+	expect.That(t, is.EqualTo(entries[1099].Name(), "1099"))
+
+	expect.That(t,
+		is.NoError(fsys.RemoveAll("dir")),
+		is.DeepEqualTo(srv.Keys(bucket), []string{}),
+	)
+}
+
+func TestS3FS_partialWrite(t *testing.T) {
+	srv := s3test.NewServer(bucket)
+	defer srv.Close()
+
+	// Fail uploading the second part.
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("partNumber") == "2" {
+			http.Error(w, "failed", http.StatusInternalServerError)
+			return
+		}
+		srv.ServeHTTP(w, r)
+	}))
+	defer failing.Close()
+
+	fsys, err := New(failing.URL, bucket, WithPartSize(16))
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	f, err := fsys.OpenFile("large", fsx.O_WRONLY|fsx.O_CREATE|fsx.O_TRUNC, 0644)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	defer f.Close()
+
+	n, err := f.Write(bytes.Repeat([]byte("0123456789"), 4))
+	expect.That(t, is.EqualTo(err != nil, true), is.EqualTo(n, 16))
+}
+
+func TestNew(t *testing.T) {
+	_, err := New("ftp://example.com", bucket)
+	expect.That(t, is.EqualTo(err != nil, true))
+
+	_, err = New("http://example.com", "a/b")
+	expect.That(t, is.EqualTo(err != nil, true))
+}
+
+func TestError(t *testing.T) {
+	srv := s3test.NewServer(bucket)
+	defer srv.Close()
+
+	fsys, err := New(srv.URL, "missing")
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	err = fsx.WriteFile(fsys, "file", nil, 0644)
+
+	var e *Error
+	expect.That(t,
+		is.Error(err, fs.ErrNotExist),
+		expect.FailNow(is.EqualTo(errors.As(err, &e), true)),
+		is.EqualTo(e.Code, "NoSuchBucket"),
+	)
+}
@@ -0,0 +1,519 @@
+// Package s3test provides an in-process fake of an S3-compatible object store
+// for testing code using s3fs without network access.
+//
+// The server keeps all data in memory and supports the subset of the S3 API
+// used by s3fs: creating buckets, PutObject, GetObject (including range
+// requests), HeadObject, DeleteObject, CopyObject, ListObjectsV2 and
+// multipart uploads. Buckets are addressed path-style. Requests are not
+// authenticated.
+package s3test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request describes a request received by the server.
+type Request struct {
+	Method string
+	Bucket string
+	Key    string
+	Query  url.Values
+}
+
+type object struct {
+	data    []byte
+	etag    string
+	modTime time.Time
+}
+
+type upload struct {
+	bucket string
+	key    string
+	parts  map[int]*object
+}
+
+// Server implements a fake object store. Use URL as the endpoint passed to
+// s3fs.New.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	buckets  map[string]map[string]*object
+	uploads  map[string]*upload
+	nextID   int
+	requests []Request
+}
+
+// NewServer starts a new server with the given buckets. The caller must call
+// Close when finished.
+func NewServer(buckets ...string) *Server {
+	s := &Server{
+		buckets: make(map[string]map[string]*object),
+		uploads: make(map[string]*upload),
+	}
+
+	for _, b := range buckets {
+		s.buckets[b] = make(map[string]*object)
+	}
+
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// Keys returns the sorted keys of all objects stored in bucket.
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.buckets[bucket]))
+	for k := range s.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Object returns the content of the object key in bucket.
+func (s *Server) Object(bucket, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.buckets[bucket][key]
+	if !ok {
+		return nil, false
+	}
+	return o.data, true
+}
+
+// Requests returns all requests received so far.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Request(nil), s.requests...)
+}
+
+// Uploads returns the number of multipart uploads that have been started
+// but neither completed nor aborted.
+func (s *Server) Uploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.uploads)
+}
+
+func newObject(data []byte) *object {
+	sum := md5.Sum(data)
+	return &object{
+		data:    data,
+		etag:    `"` + hex.EncodeToString(sum[:]) + `"`,
+		modTime: time.Now().UTC().Truncate(time.Second),
+	}
+}
+
+type apiError struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+	status  int
+}
+
+var (
+	errNoSuchBucket    = &apiError{Code: "NoSuchBucket", Message: "The specified bucket does not exist.", status: http.StatusNotFound}
+	errNoSuchKey       = &apiError{Code: "NoSuchKey", Message: "The specified key does not exist.", status: http.StatusNotFound}
+	errNoSuchUpload    = &apiError{Code: "NoSuchUpload", Message: "The specified upload does not exist.", status: http.StatusNotFound}
+	errInvalidPart     = &apiError{Code: "InvalidPart", Message: "One or more of the specified parts could not be found.", status: http.StatusBadRequest}
+	errInvalidRange    = &apiError{Code: "InvalidRange", Message: "The requested range is not satisfiable.", status: http.StatusRequestedRangeNotSatisfiable}
+	errMalformedXML    = &apiError{Code: "MalformedXML", Message: "The XML you provided was not well-formed.", status: http.StatusBadRequest}
+	errInvalidArgument = &apiError{Code: "InvalidArgument", Message: "Invalid argument.", status: http.StatusBadRequest}
+	errNotImplemented  = &apiError{Code: "NotImplemented", Message: "The requested operation is not implemented.", status: http.StatusNotImplemented}
+)
+
+func writeError(w http.ResponseWriter, r *http.Request, e *apiError) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(e.status)
+	if r.Method != http.MethodHead {
+		xml.NewEncoder(w).Encode(e)
+	}
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
+
+// ServeHTTP dispatches requests to the API's operations.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests = append(s.requests, Request{Method: r.Method, Bucket: bucket, Key: key, Query: query})
+
+	if key == "" {
+		switch r.Method {
+		case http.MethodPut:
+			if _, ok := s.buckets[bucket]; !ok {
+				s.buckets[bucket] = make(map[string]*object)
+			}
+		case http.MethodHead:
+			if _, ok := s.buckets[bucket]; !ok {
+				writeError(w, r, errNoSuchBucket)
+			}
+		case http.MethodGet:
+			s.list(w, r, bucket, query)
+		default:
+			writeError(w, r, errNotImplemented)
+		}
+		return
+	}
+
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.nextID++
+		id := strconv.Itoa(s.nextID)
+		s.uploads[id] = &upload{bucket: bucket, key: key, parts: make(map[int]*object)}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string   `xml:"Bucket"`
+			Key      string   `xml:"Key"`
+			UploadID string   `xml:"UploadId"`
+		}{Bucket: bucket, Key: key, UploadID: id})
+
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		s.completeUpload(w, r, objects, bucket, key, query.Get("uploadId"), body)
+
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		u, ok := s.uploads[query.Get("uploadId")]
+		if !ok || u.bucket != bucket || u.key != key {
+			writeError(w, r, errNoSuchUpload)
+			return
+		}
+		number, err := strconv.Atoi(query.Get("partNumber"))
+		if err != nil || number < 1 || number > 10000 {
+			writeError(w, r, errInvalidArgument)
+			return
+		}
+		part := newObject(body)
+		u.parts[number] = part
+		w.Header().Set("ETag", part.etag)
+
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		u, ok := s.uploads[query.Get("uploadId")]
+		if !ok || u.bucket != bucket || u.key != key {
+			writeError(w, r, errNoSuchUpload)
+			return
+		}
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		s.copy(w, r, objects)
+
+	case r.Method == http.MethodPut:
+		objects[key] = newObject(body)
+		w.Header().Set("ETag", objects[key].etag)
+
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+		s.get(w, r, objects[key])
+
+	case r.Method == http.MethodDelete:
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, r, errNotImplemented)
+	}
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request, o *object) {
+	if o == nil {
+		writeError(w, r, errNoSuchKey)
+		return
+	}
+
+	w.Header().Set("ETag", o.etag)
+	w.Header().Set("Last-Modified", o.modTime.Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	data := o.data
+	status := http.StatusOK
+
+	if rng := r.Header.Get("Range"); rng != "" {
+		start, end, ok := parseRange(rng, int64(len(data)))
+		if !ok {
+			writeError(w, r, errInvalidRange)
+			return
+		}
+
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		data = data[start : end+1]
+		status = http.StatusPartialContent
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+
+	if r.Method != http.MethodHead {
+		w.Write(data)
+	}
+}
+
+// parseRange parses a range header of the form bytes=start-[end].
+func parseRange(rng string, size int64) (int64, int64, bool) {
+	spec, ok := strings.CutPrefix(rng, "bytes=")
+	if !ok {
+		return 0, 0, false
+	}
+
+	from, to, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, false
+	}
+
+	start, err := strconv.ParseInt(from, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+
+	end := size - 1
+	if to != "" {
+		end, err = strconv.ParseInt(to, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+
+	return start, end, true
+}
+
+func (s *Server) copy(w http.ResponseWriter, r *http.Request, objects map[string]*object) {
+	src, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		writeError(w, r, errInvalidArgument)
+		return
+	}
+
+	srcBucket, srcKey, _ := strings.Cut(strings.TrimPrefix(src, "/"), "/")
+	b, ok := s.buckets[srcBucket]
+	if !ok {
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+
+	o, ok := b[srcKey]
+	if !ok {
+		writeError(w, r, errNoSuchKey)
+		return
+	}
+
+	_, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	c := newObject(o.data)
+	objects[key] = c
+
+	writeXML(w, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		ETag         string   `xml:"ETag"`
+		LastModified string   `xml:"LastModified"`
+	}{ETag: c.etag, LastModified: c.modTime.Format(time.RFC3339)})
+}
+
+func (s *Server) completeUpload(w http.ResponseWriter, r *http.Request, objects map[string]*object, bucket, key, id string, body []byte) {
+	u, ok := s.uploads[id]
+	if !ok || u.bucket != bucket || u.key != key {
+		writeError(w, r, errNoSuchUpload)
+		return
+	}
+
+	var req struct {
+		Parts []struct {
+			PartNumber int    `xml:"PartNumber"`
+			ETag       string `xml:"ETag"`
+		} `xml:"Part"`
+	}
+	if err := xml.Unmarshal(body, &req); err != nil || len(req.Parts) == 0 {
+		writeError(w, r, errMalformedXML)
+		return
+	}
+
+	var data bytes.Buffer
+	var sums []byte
+	last := 0
+	for _, p := range req.Parts {
+		part, ok := u.parts[p.PartNumber]
+		if !ok || part.etag != p.ETag || p.PartNumber <= last {
+			writeError(w, r, errInvalidPart)
+			return
+		}
+		last = p.PartNumber
+
+		data.Write(part.data)
+		sum := md5.Sum(part.data)
+		sums = append(sums, sum[:]...)
+	}
+
+	o := newObject(data.Bytes())
+	sum := md5.Sum(sums)
+	o.etag = fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(sum[:]), len(req.Parts))
+
+	objects[key] = o
+	delete(s.uploads, id)
+
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string   `xml:"Bucket"`
+		Key     string   `xml:"Key"`
+		ETag    string   `xml:"ETag"`
+	}{Bucket: bucket, Key: key, ETag: o.etag})
+}
+
+type listEntry struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int    `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type commonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request, bucket string, query url.Values) {
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+
+	if query.Get("list-type") != "2" {
+		writeError(w, r, errNotImplemented)
+		return
+	}
+
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+
+	maxKeys := 1000
+	if v := query.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, r, errInvalidArgument)
+			return
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	after := query.Get("start-after")
+	if t := query.Get("continuation-token"); t != "" {
+		after = t
+	}
+
+	keys := make([]string, 0)
+	for k := range objects {
+		if strings.HasPrefix(k, prefix) && k > after {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var contents []listEntry
+	var prefixes []commonPrefix
+	var last string
+	count := 0
+	truncated := false
+
+	for _, k := range keys {
+		if delimiter != "" {
+			if i := strings.Index(k[len(prefix):], delimiter); i >= 0 {
+				cp := k[:len(prefix)+i+len(delimiter)]
+				if len(prefixes) == 0 || prefixes[len(prefixes)-1].Prefix != cp {
+					if count == maxKeys {
+						truncated = true
+						break
+					}
+					prefixes = append(prefixes, commonPrefix{Prefix: cp})
+					count++
+				}
+				last = k
+				continue
+			}
+		}
+
+		if count == maxKeys {
+			truncated = true
+			break
+		}
+
+		o := objects[k]
+		contents = append(contents, listEntry{
+			Key:          k,
+			LastModified: o.modTime.Format(time.RFC3339),
+			ETag:         o.etag,
+			Size:         len(o.data),
+			StorageClass: "STANDARD",
+		})
+		count++
+		last = k
+	}
+
+	res := struct {
+		XMLName               xml.Name       `xml:"ListBucketResult"`
+		Name                  string         `xml:"Name"`
+		Prefix                string         `xml:"Prefix"`
+		Delimiter             string         `xml:"Delimiter,omitempty"`
+		MaxKeys               int            `xml:"MaxKeys"`
+		KeyCount              int            `xml:"KeyCount"`
+		IsTruncated           bool           `xml:"IsTruncated"`
+		NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+		Contents              []listEntry    `xml:"Contents"`
+		CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+	}{
+		Name:           bucket,
+		Prefix:         prefix,
+		Delimiter:      delimiter,
+		MaxKeys:        maxKeys,
+		KeyCount:       count,
+		IsTruncated:    truncated,
+		Contents:       contents,
+		CommonPrefixes: prefixes,
+	}
+	if truncated {
+		res.NextContinuationToken = last
+	}
+
+	writeXML(w, res)
+}
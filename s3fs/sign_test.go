@@ -0,0 +1,51 @@
+package s3fs
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+)
+
+// The test cases are taken from the AWS Signature Version 4 test suite.
+func TestSign(t *testing.T) {
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+	tests := map[string]struct {
+		url  string
+		want string
+	}{
+		"get-vanilla": {
+			url:  "https://example.amazonaws.com/",
+			want: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		"get-vanilla-query-order-key-case": {
+			url:  "https://example.amazonaws.com/?Param2=value2&Param1=value1",
+			want: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, test.url, nil)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			sign(req, emptyBodySHA256, "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "us-east-1", "service", now)
+
+			expect.That(t,
+				is.EqualTo(req.Header.Get("X-Amz-Date"), "20150830T123600Z"),
+				is.EqualTo(req.Header.Get("Authorization"), test.want),
+			)
+		})
+	}
+}
+
+func TestURIEncode(t *testing.T) {
+	expect.That(t,
+		is.EqualTo(uriEncode("a b/c~d+e", false), "a%20b/c~d%2Be"),
+		is.EqualTo(uriEncode("a b/c", true), "a%20b%2Fc"),
+		is.EqualTo(uriEncode("ä", true), "%C3%A4"),
+	)
+}
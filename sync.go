@@ -0,0 +1,371 @@
+package fsx
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"time"
+)
+
+// SyncOpKind defines the kind of an operation performed by Sync.
+type SyncOpKind int
+
+const (
+	// SyncMkdir creates a directory.
+	SyncMkdir SyncOpKind = iota + 1
+	// SyncCopy copies a regular file's content.
+	SyncCopy
+	// SyncSymlink creates a symlink.
+	SyncSymlink
+	// SyncChmod changes an entry's permission.
+	SyncChmod
+	// SyncChtimes changes an entry's modification time.
+	SyncChtimes
+	// SyncRemove removes an entry from the destination.
+	SyncRemove
+)
+
+func (k SyncOpKind) String() string {
+	switch k {
+	case SyncMkdir:
+		return "mkdir"
+	case SyncCopy:
+		return "copy"
+	case SyncSymlink:
+		return "symlink"
+	case SyncChmod:
+		return "chmod"
+	case SyncChtimes:
+		return "chtimes"
+	case SyncRemove:
+		return "remove"
+	default:
+		return fmt.Sprintf("SyncOpKind(%d)", int(k))
+	}
+}
+
+// SyncOp describes a single operation performed (or planned in dry-run mode)
+// by Sync. Path is relative to the destination root.
+type SyncOp struct {
+	Kind SyncOpKind
+	Path string
+	// Mode holds the permission for SyncMkdir, SyncCopy and SyncChmod.
+	Mode fs.FileMode
+	// Target holds the link target for SyncSymlink.
+	Target string
+	// ModTime holds the modification time for SyncChtimes.
+	ModTime time.Time
+}
+
+func (o SyncOp) String() string {
+	switch o.Kind {
+	case SyncMkdir, SyncCopy, SyncChmod:
+		return fmt.Sprintf("%s %s %s", o.Kind, o.Mode.Perm(), o.Path)
+	case SyncSymlink:
+		return fmt.Sprintf("%s %s -> %s", o.Kind, o.Path, o.Target)
+	case SyncChtimes:
+		return fmt.Sprintf("%s %s %s", o.Kind, o.Path, o.ModTime.Format(time.RFC3339Nano))
+	default:
+		return fmt.Sprintf("%s %s", o.Kind, o.Path)
+	}
+}
+
+// SyncOptions customize the behavior of Sync. A nil *SyncOptions is equivalent
+// to the zero value.
+type SyncOptions struct {
+	// Filter selects the entries to synchronize. Destination entries
+	// excluded by the filter are never deleted.
+	Filter
+
+	// SrcRoot defines the directory inside the source to synchronize.
+	// Defaults to ".".
+	SrcRoot string
+
+	// DstRoot defines the directory inside the destination to synchronize
+	// into. It is created if it does not exist. Defaults to ".".
+	DstRoot string
+
+	// Compare defines how regular files are compared to detect changes.
+	Compare CompareMode
+
+	// ModTimePrecision defines the precision used when comparing
+	// modification times.
+	ModTimePrecision time.Duration
+
+	// Delete enables the removal of destination entries not found in the
+	// source.
+	Delete bool
+
+	// DryRun disables all modifications. Sync only returns the operations it
+	// would perform.
+	DryRun bool
+}
+
+// Sync mirrors the tree found in src into dst by applying only the operations
+// required to make dst equal to src - similar to rsync. Files are copied if
+// their content differs (see SyncOptions.Compare); permissions are updated
+// using Chmod and modification times using ChtimesFS if dst supports it.
+// The times of directories are applied after all of their entries have been
+// written. Symlinks are recreated with the same target using LinkFS; if dst does not
+// satisfy LinkFS, an error wrapping ErrNotSupported is returned.
+//
+// Sync returns the list of operations in the order they have been applied. In
+// dry-run mode the operations are only planned. If an operation fails, Sync
+// returns the operations applied so far and the error.
+func Sync(dst FS, src fs.FS, opts *SyncOptions) ([]SyncOp, error) {
+	if opts == nil {
+		opts = &SyncOptions{}
+	}
+
+	srcRoot := opts.SrcRoot
+	if srcRoot == "" {
+		srcRoot = "."
+	}
+
+	dstRoot := opts.DstRoot
+	if dstRoot == "" {
+		dstRoot = "."
+	}
+
+	plan, err := planSync(dst, src, srcRoot, dstRoot, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.DryRun {
+		return plan, nil
+	}
+
+	if dstRoot != "." {
+		if err := MkdirAll(dst, dstRoot, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, op := range plan {
+		if err := applySyncOp(dst, src, srcRoot, dstRoot, op); err != nil {
+			return plan[:i], err
+		}
+	}
+
+	return plan, nil
+}
+
+// planSync computes the list of operations to sync src into dst.
+func planSync(dst FS, src fs.FS, srcRoot, dstRoot string, opts *SyncOptions) ([]SyncOp, error) {
+	srcEntries, err := collectTree(src, srcRoot, &opts.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	dstEntries := make(map[string]treeEntry)
+	if _, err := fs.Stat(dst, dstRoot); err == nil {
+		dstEntries, err = collectTree(dst, dstRoot, &opts.Filter)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	paths := make([]string, 0, len(srcEntries))
+	for p := range srcEntries {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	diffOpts := &DiffOptions{
+		Compare:          opts.Compare,
+		ModTimePrecision: opts.ModTimePrecision,
+	}
+
+	_, dstSupportsChtimes := dst.(ChtimesFS)
+
+	var plan, links, times []SyncOp
+	var removed []string
+
+	// timed records the paths planned to get their times applied; modified
+	// records the directories whose entries are created or removed.
+	timed := make(map[string]bool)
+	modified := make(map[string]bool)
+
+	for _, p := range paths {
+		se := srcEntries[p]
+		de, exists := dstEntries[p]
+
+		var kind ChangeKind
+		// touched is set if the entry's content is written, which resets its
+		// modification time.
+		touched := !exists
+		if exists {
+			kind, err = compareEntries(src, dst, joinPath(srcRoot, p), joinPath(dstRoot, p), se, de, diffOpts)
+			if err != nil {
+				return nil, err
+			}
+
+			if kind.Has(TypeChanged) || kind.Has(TargetChanged) {
+				plan = append(plan, SyncOp{Kind: SyncRemove, Path: p})
+				removed = append(removed, p)
+				exists = false
+				touched = true
+			}
+		}
+
+		if !exists {
+			modified[path.Dir(p)] = true
+		}
+
+		switch {
+		case se.symlink:
+			if !exists {
+				links = append(links, SyncOp{Kind: SyncSymlink, Path: p, Target: se.target})
+			}
+			continue
+
+		case se.info.IsDir():
+			if !exists {
+				plan = append(plan, SyncOp{Kind: SyncMkdir, Path: p, Mode: se.info.Mode().Perm()})
+			}
+
+		default:
+			if !exists || kind.Has(ContentChanged) {
+				// Copying a file also applies its permission.
+				plan = append(plan, SyncOp{Kind: SyncCopy, Path: p, Mode: se.info.Mode().Perm()})
+				kind &^= ModeChanged
+				touched = true
+			}
+		}
+
+		if exists && kind.Has(ModeChanged) {
+			plan = append(plan, SyncOp{Kind: SyncChmod, Path: p, Mode: se.info.Mode().Perm()})
+		}
+
+		if dstSupportsChtimes && (touched || !sameModTime(se.info.ModTime(), de.info.ModTime(), opts.ModTimePrecision)) {
+			times = append(times, SyncOp{Kind: SyncChtimes, Path: p, ModTime: se.info.ModTime()})
+			timed[p] = true
+		}
+	}
+
+	if opts.Delete {
+		extraneous := make([]string, 0)
+		for p := range dstEntries {
+			if _, ok := srcEntries[p]; !ok {
+				extraneous = append(extraneous, p)
+			}
+		}
+
+		// Remove children before their parents.
+		sort.Sort(sort.Reverse(sort.StringSlice(extraneous)))
+		for _, p := range extraneous {
+			if !isBelowAny(p, removed) {
+				plan = append(plan, SyncOp{Kind: SyncRemove, Path: p})
+				modified[path.Dir(p)] = true
+			}
+		}
+	}
+
+	plan = append(plan, links...)
+
+	// Creating or removing entries changes the modification time of existing
+	// directories, which needs to be restored.
+	if dstSupportsChtimes {
+		for d := range modified {
+			se, ok := srcEntries[d]
+			if !ok || timed[d] || se.symlink || !se.info.IsDir() {
+				continue
+			}
+			times = append(times, SyncOp{Kind: SyncChtimes, Path: d, ModTime: se.info.ModTime()})
+		}
+	}
+
+	// Directory times must be applied after all children have been written;
+	// applying them in reverse order handles nested directories.
+	sort.SliceStable(times, func(i, j int) bool { return times[i].Path > times[j].Path })
+	plan = append(plan, times...)
+
+	return plan, nil
+}
+
+// sameModTime compares a and b using the given precision.
+func sameModTime(a, b time.Time, precision time.Duration) bool {
+	if precision > 0 {
+		a = a.Truncate(precision)
+		b = b.Truncate(precision)
+	}
+	return a.Equal(b)
+}
+
+// isBelowAny reports whether p is a child of any of the paths in dirs.
+func isBelowAny(p string, dirs []string) bool {
+	for _, d := range dirs {
+		if len(p) > len(d) && p[:len(d)] == d && p[len(d)] == Separator {
+			return true
+		}
+	}
+	return false
+}
+
+// applySyncOp applies a single operation to dst.
+func applySyncOp(dst FS, src fs.FS, srcRoot, dstRoot string, op SyncOp) error {
+	dstPath := joinPath(dstRoot, op.Path)
+
+	switch op.Kind {
+	case SyncMkdir:
+		return dst.Mkdir(dstPath, op.Mode)
+
+	case SyncCopy:
+		return copyFile(dst, dstPath, src, joinPath(srcRoot, op.Path), op.Mode)
+
+	case SyncSymlink:
+		lfs, ok := dst.(LinkFS)
+		if !ok {
+			return &fs.PathError{
+				Op:   "Sync",
+				Path: dstPath,
+				Err:  ErrNotSupported,
+			}
+		}
+		return lfs.Symlink(op.Target, dstPath)
+
+	case SyncChmod:
+		return Chmod(dst, dstPath, op.Mode)
+
+	case SyncChtimes:
+		return dst.(ChtimesFS).Chtimes(dstPath, op.ModTime, op.ModTime)
+
+	case SyncRemove:
+		return RemoveAll(dst, dstPath)
+
+	default:
+		return fmt.Errorf("invalid sync operation: %v", op.Kind)
+	}
+}
+
+// copyFile copies the content of the regular file srcPath in src to dstPath
+// in dst, creating or truncating dstPath as needed. The permission of dstPath
+// is set to perm.
+func copyFile(dst FS, dstPath string, src fs.FS, srcPath string, perm fs.FileMode) (err error) {
+	in, err := src.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := dst.OpenFile(dstPath, O_WRONLY|O_CREATE|O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if cerr := out.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		if err == nil {
+			// OpenFile does not change the permission of existing files.
+			err = Chmod(dst, dstPath, perm)
+		}
+	}()
+
+	_, err = io.Copy(out, in)
+	return err
+}
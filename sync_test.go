@@ -0,0 +1,122 @@
+package fsx_test
+
+import (
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	"github.com/halimath/fixture"
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/memfs"
+)
+
+const syncSource = `-- index.html --
+<h1>Hello</h1>
+-- assets/app.js --
+console.log("hello")
+-- bin/run.sh mode=0755 --
+#!/bin/sh
+-- latest -> index.html --
+`
+
+func TestSync(t *testing.T) {
+	fixture.With(t, new(interfaceFixture)).
+		Run("full_copy", func(t *testing.T, f *interfaceFixture) {
+			src := mustFromTxtar(t, syncSource)
+
+			ops, err := fsx.Sync(f.fs, src, nil)
+			expect.That(t, expect.FailNow(is.NoError(err)), is.SliceOfLen(ops, 11))
+
+			d, err := fsx.Diff(src, f.fs, nil)
+			expect.That(t, is.NoError(err), is.EqualTo(d.String(), ""))
+
+			info, err := fs.Stat(f.fs, "bin/run.sh")
+			expect.That(t, is.NoError(err), is.EqualTo(info.Mode().Perm(), 0755))
+
+			srcInfo, _ := fs.Stat(src, "assets/app.js")
+			info, err = fs.Stat(f.fs, "assets/app.js")
+			expect.That(t, is.NoError(err), is.EqualTo(info.ModTime().Equal(srcInfo.ModTime()), true))
+
+			// A second sync must be a no-op.
+			ops, err = fsx.Sync(f.fs, src, nil)
+			expect.That(t, is.NoError(err), is.SliceOfLen(ops, 0))
+		}).
+		Run("incremental", func(t *testing.T, f *interfaceFixture) {
+			src := mustFromTxtar(t, syncSource)
+
+			_, err := fsx.Sync(f.fs, src, nil)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			expect.That(t, expect.FailNow(
+				is.NoError(fsx.WriteFile(src, "index.html", []byte("<h1>Changed</h1>"), 0644)),
+				is.NoError(fsx.WriteFile(f.fs, "extraneous.txt", []byte("delete me"), 0644)),
+			))
+
+			ops, err := fsx.Sync(f.fs, src, &fsx.SyncOptions{Delete: true, DryRun: true})
+			expect.That(t, is.NoError(err), is.DeepEqualTo(opKinds(ops), []string{"copy index.html", "remove extraneous.txt", "chtimes index.html"}))
+
+			_, err = fs.Stat(f.fs, "extraneous.txt")
+			expect.That(t, is.NoError(err))
+
+			_, err = fsx.Sync(f.fs, src, &fsx.SyncOptions{Delete: true})
+			expect.That(t, is.NoError(err))
+
+			_, err = fs.Stat(f.fs, "extraneous.txt")
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+
+			got, err := fs.ReadFile(f.fs, "latest")
+			expect.That(t, is.NoError(err), is.EqualTo(string(got), "<h1>Changed</h1>"))
+		})
+}
+
+func TestSync_modTime(t *testing.T) {
+	src := mustFromTxtar(t, "-- f --\nabc\n")
+	dst := memfs.New()
+
+	_, err := fsx.Sync(dst, src, &fsx.SyncOptions{Compare: fsx.CompareModTime})
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	// Change the content but keep size and mtime.
+	info, _ := fs.Stat(src, "f")
+	expect.That(t, expect.FailNow(
+		is.NoError(fsx.WriteFile(src, "f", []byte("xyz\n"), 0644)),
+		is.NoError(src.(fsx.ChtimesFS).Chtimes("f", time.Time{}, info.ModTime())),
+	))
+
+	ops, err := fsx.Sync(dst, src, &fsx.SyncOptions{Compare: fsx.CompareModTime})
+	expect.That(t, is.NoError(err), is.SliceOfLen(ops, 0))
+
+	ops, err = fsx.Sync(dst, src, nil)
+	expect.That(t, is.NoError(err), is.DeepEqualTo(opKinds(ops), []string{"copy f", "chtimes f"}))
+}
+
+func TestSync_dirTimes(t *testing.T) {
+	src := mustFromTxtar(t, syncSource)
+	dst := memfs.New()
+
+	_, err := fsx.Sync(dst, src, nil)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	// Add a file but keep the directory's mtime.
+	info, _ := fs.Stat(src, "assets")
+	expect.That(t, expect.FailNow(
+		is.NoError(fsx.WriteFile(src, "assets/new.js", []byte("new"), 0644)),
+		is.NoError(src.(fsx.ChtimesFS).Chtimes("assets", time.Time{}, info.ModTime())),
+	))
+
+	ops, err := fsx.Sync(dst, src, nil)
+	expect.That(t, is.NoError(err), is.DeepEqualTo(opKinds(ops), []string{"copy assets/new.js", "chtimes assets/new.js", "chtimes assets"}))
+
+	got, err := fs.Stat(dst, "assets")
+	expect.That(t, is.NoError(err), is.EqualTo(got.ModTime().Equal(info.ModTime()), true))
+}
+
+func opKinds(ops []fsx.SyncOp) []string {
+	s := make([]string, len(ops))
+	for i, op := range ops {
+		s[i] = op.Kind.String() + " " + op.Path
+	}
+	return s
+}
@@ -0,0 +1,648 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/internal/buffile"
+	"github.com/halimath/fsx/internal/pathtree"
+)
+
+// maxSymlinkDepth limits the number of symlinks resolved when looking up a
+// single name.
+const maxSymlinkDepth = 40
+
+// permBits defines the mode bits stored for an inode.
+const permBits = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+
+type fileInfo struct {
+	name string
+	n    *inode
+}
+
+func (i *fileInfo) Name() string       { return path.Base(i.name) }
+func (i *fileInfo) Mode() fs.FileMode  { return i.n.fileMode() }
+func (i *fileInfo) ModTime() time.Time { return i.n.mtime }
+func (i *fileInfo) IsDir() bool        { return i.n.isDir() }
+
+func (i *fileInfo) Size() int64 {
+	if i.n.isRegular() {
+		return int64(len(i.n.data))
+	}
+	return 0
+}
+
+// Sys returns a *tar.Header describing the entry as it would be written to
+// the archive.
+func (i *fileInfo) Sys() any { return i.n.header(i.name) }
+
+// linkTarget resolves the linkname stored for the symlink at linkPath to a
+// path relative to the filesystem's root.
+func linkTarget(linkPath, linkname string) string {
+	if strings.HasPrefix(linkname, "/") {
+		return cleanName(linkname)
+	}
+	return path.Join(path.Dir(linkPath), linkname)
+}
+
+// relativeLinkname converts target - a path relative to the filesystem's root
+// - to a path relative to the directory containing linkPath.
+func relativeLinkname(linkPath, target string) string {
+	from := splitPath(path.Dir(linkPath))
+	to := splitPath(path.Clean(target))
+
+	common := 0
+	for common < len(from) && common < len(to) && from[common] == to[common] {
+		common++
+	}
+
+	parts := make([]string, 0, len(from)-common+len(to)-common)
+	for i := common; i < len(from); i++ {
+		parts = append(parts, "..")
+	}
+	parts = append(parts, to[common:]...)
+
+	if len(parts) == 0 {
+		return "."
+	}
+	return strings.Join(parts, "/")
+}
+
+func splitPath(p string) []string {
+	if p == "." || p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+func pathError(op, name string, err error) error {
+	return &fs.PathError{
+		Op:   op,
+		Path: name,
+		Err:  err,
+	}
+}
+
+// resolve looks up name and returns the resolved name (with all symlinks in
+// directory components replaced) and the inode. If followLast is true, a
+// final symlink is followed as well. fsys.mu must be held.
+func (fsys *tarfs) resolve(op, name string, followLast bool) (string, *inode, error) {
+	if fsys.closed {
+		return "", nil, pathError(op, name, fs.ErrClosed)
+	}
+
+	if !fs.ValidPath(name) {
+		return "", nil, pathError(op, name, fs.ErrInvalid)
+	}
+
+	resolved, n, err := fsys.tree().Resolve(name, followLast, maxSymlinkDepth)
+	if err != nil {
+		return "", nil, pathError(op, name, err)
+	}
+	return resolved, n, nil
+}
+
+// tree returns the tree of fsys' inodes. fsys.mu must be held.
+func (fsys *tarfs) tree() pathtree.Tree[*inode] {
+	return pathtree.Tree[*inode]{
+		Root: fsys.entries["."],
+		Child: func(_ *inode, name string) (*inode, bool, error) {
+			n, ok := fsys.entries[name]
+			return n, ok, nil
+		},
+		IsDir: (*inode).isDir,
+		Link: func(name string, n *inode) (string, bool, error) {
+			if !n.isSymlink() {
+				return "", false, nil
+			}
+			return linkTarget(name, n.linkname), true, nil
+		},
+	}
+}
+
+// resolveParent resolves the directory containing name and returns the
+// resolved name.
+func (fsys *tarfs) resolveParent(op, name string) (string, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return "", pathError(op, name, fs.ErrInvalid)
+	}
+
+	dirName, base := path.Split(name)
+	dirName = strings.TrimSuffix(dirName, "/")
+	if dirName == "" {
+		dirName = "."
+	}
+
+	resolvedDir, d, err := fsys.resolve(op, dirName, true)
+	if err != nil {
+		return "", err
+	}
+
+	if !d.isDir() {
+		return "", pathError(op, name, fs.ErrInvalid)
+	}
+
+	return path.Join(resolvedDir, base), nil
+}
+
+// children returns the sorted names of all direct children of dir.
+func (fsys *tarfs) children(dir string) []string {
+	var names []string
+	for name := range fsys.entries {
+		if name != "." && path.Dir(name) == dir {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// -- fs.FS
+
+// Open opens the named file for reading.
+func (fsys *tarfs) Open(name string) (fs.File, error) {
+	return fsys.OpenFile(name, fsx.O_RDONLY, 0)
+}
+
+// -- fsx.FS
+
+// OpenFile opens the file named name using flag. If the file is created, it
+// is created with permission perm.
+func (fsys *tarfs) OpenFile(name string, flag int, perm fs.FileMode) (fsx.File, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	writable := flag&(fsx.O_WRONLY|fsx.O_RDWR) != 0
+
+	resolved, n, err := fsys.resolve("OpenFile", name, true)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) || flag&fsx.O_CREATE == 0 {
+			return nil, err
+		}
+
+		resolved, err = fsys.resolveParent("OpenFile", name)
+		if err != nil {
+			return nil, err
+		}
+
+		if l, ok := fsys.entries[resolved]; ok && l.isSymlink() {
+			// Dangling symlink: create the link's target.
+			resolved = linkTarget(resolved, l.linkname)
+			if _, err := fsys.resolveParent("OpenFile", resolved); err != nil {
+				return nil, err
+			}
+		}
+
+		n = &inode{
+			typeflag: tar.TypeReg,
+			mode:     perm & permBits,
+			mtime:    time.Now(),
+		}
+		fsys.ensureParents(resolved)
+		fsys.entries[resolved] = n
+		pathtree.Touch(fsys.entries, resolved)
+
+		return fsys.newFileHandle(name, resolved, n, flag, true), nil
+	}
+
+	if flag&fsx.O_CREATE != 0 && flag&fsx.O_EXCL != 0 {
+		return nil, pathError("OpenFile", name, fs.ErrExist)
+	}
+
+	if n.isDir() {
+		if writable {
+			return nil, pathError("OpenFile", name, buffile.ErrIsDirectory)
+		}
+
+		return buffile.NewDir(name, func() (fs.FileInfo, error) {
+			fsys.mu.RLock()
+			defer fsys.mu.RUnlock()
+			return &fileInfo{name: resolved, n: n}, nil
+		}, fsys.readDir(resolved)), nil
+	}
+
+	if writable && !n.isRegular() {
+		return nil, pathError("OpenFile", name, fs.ErrInvalid)
+	}
+
+	return fsys.newFileHandle(name, resolved, n, flag, false), nil
+}
+
+func (fsys *tarfs) newFileHandle(name, resolved string, n *inode, flag int, created bool) fsx.File {
+	return buffile.New(name, n.data, buffile.Options{
+		Flag:  flag,
+		Dirty: created,
+		Stat: func(size int64) (fs.FileInfo, error) {
+			fsys.mu.RLock()
+			defer fsys.mu.RUnlock()
+
+			return &fileInfo{name: resolved, n: n}, nil
+		},
+		Commit: func(data []byte) error {
+			fsys.mu.Lock()
+			defer fsys.mu.Unlock()
+
+			n.data = append([]byte(nil), data...)
+			n.mtime = time.Now()
+			return nil
+		},
+		Chmod: func(mode fs.FileMode) error {
+			fsys.mu.Lock()
+			defer fsys.mu.Unlock()
+
+			n.mode = mode & permBits
+			return nil
+		},
+		Chown: func(uid, gid int) error {
+			fsys.mu.Lock()
+			defer fsys.mu.Unlock()
+
+			n.chown(uid, gid)
+			return nil
+		},
+	})
+}
+
+func (n *inode) chown(uid, gid int) {
+	if n.uid != uid {
+		n.uid = uid
+		n.uname = ""
+	}
+	if n.gid != gid {
+		n.gid = gid
+		n.gname = ""
+	}
+}
+
+// readDir returns the entries of the directory dir. fsys.mu must be held.
+func (fsys *tarfs) readDir(dir string) []fs.DirEntry {
+	names := fsys.children(dir)
+	entries := make([]fs.DirEntry, len(names))
+	for i, name := range names {
+		entries[i] = fs.FileInfoToDirEntry(&fileInfo{name: name, n: fsys.entries[name]})
+	}
+	return entries
+}
+
+// Mkdir creates a directory named name with permission perm.
+func (fsys *tarfs) Mkdir(name string, perm fs.FileMode) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	resolved, err := fsys.resolveParent("Mkdir", name)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := fsys.entries[resolved]; ok {
+		return pathError("Mkdir", name, fs.ErrExist)
+	}
+
+	fsys.entries[resolved] = newDirInode(perm & permBits)
+	pathtree.Touch(fsys.entries, resolved)
+
+	return nil
+}
+
+// Remove removes the named file or empty directory.
+func (fsys *tarfs) Remove(name string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	resolved, n, err := fsys.resolve("Remove", name, false)
+	if err != nil {
+		return err
+	}
+
+	if resolved == "." {
+		return pathError("Remove", name, fs.ErrInvalid)
+	}
+
+	if n.isDir() && pathtree.HasChildren(fsys.entries, resolved) {
+		return pathError("Remove", name, fsx.ErrDirNotEmpty)
+	}
+
+	delete(fsys.entries, resolved)
+	pathtree.Touch(fsys.entries, resolved)
+
+	return nil
+}
+
+// RemoveAll removes name and all of its children. It returns nil if name does
+// not exist.
+func (fsys *tarfs) RemoveAll(name string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	resolved, _, err := fsys.resolve("RemoveAll", name, false)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	if resolved == "." {
+		return pathError("RemoveAll", name, fs.ErrInvalid)
+	}
+
+	for p := range fsys.entries {
+		if p == resolved || strings.HasPrefix(p, resolved+"/") {
+			delete(fsys.entries, p)
+		}
+	}
+	pathtree.Touch(fsys.entries, resolved)
+
+	return nil
+}
+
+// Rename renames oldpath to newpath. If newpath exists and is not a non-empty
+// directory, it is replaced.
+func (fsys *tarfs) Rename(oldpath, newpath string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	from, n, err := fsys.resolve("Rename", oldpath, false)
+	if err != nil {
+		return err
+	}
+
+	if from == "." {
+		return pathError("Rename", oldpath, fs.ErrInvalid)
+	}
+
+	to, err := fsys.resolveParent("Rename", newpath)
+	if err != nil {
+		return err
+	}
+
+	if to == from {
+		return nil
+	}
+
+	if strings.HasPrefix(to, from+"/") {
+		return pathError("Rename", newpath, fs.ErrInvalid)
+	}
+
+	if existing, ok := fsys.entries[to]; ok {
+		switch {
+		case existing.isDir() && !n.isDir():
+			return pathError("Rename", newpath, fs.ErrExist)
+		case existing.isDir() && pathtree.HasChildren(fsys.entries, to):
+			return pathError("Rename", newpath, fsx.ErrDirNotEmpty)
+		case !existing.isDir() && n.isDir():
+			return pathError("Rename", newpath, fs.ErrExist)
+		}
+		delete(fsys.entries, to)
+	}
+
+	for p, e := range fsys.entries {
+		if p == from {
+			delete(fsys.entries, p)
+			fsys.entries[to] = e
+		} else if strings.HasPrefix(p, from+"/") {
+			delete(fsys.entries, p)
+			fsys.entries[to+p[len(from):]] = e
+		}
+	}
+
+	// Symlinks are stored relative to their directory; moving them to another
+	// directory requires to rewrite the stored linkname.
+	if n.isSymlink() && path.Dir(from) != path.Dir(to) {
+		n.linkname = relativeLinkname(to, linkTarget(from, n.linkname))
+	}
+
+	pathtree.Touch(fsys.entries, from)
+	pathtree.Touch(fsys.entries, to)
+
+	return nil
+}
+
+// SameFile reports whether fi1 and fi2 describe the same inode, i.e. the same
+// file or hard links to the same file.
+func (fsys *tarfs) SameFile(fi1, fi2 fs.FileInfo) bool {
+	i1, ok := fi1.(*fileInfo)
+	if !ok {
+		return false
+	}
+
+	i2, ok := fi2.(*fileInfo)
+	if !ok {
+		return false
+	}
+
+	return i1.n == i2.n
+}
+
+// -- fsx.ChmodFS, fsx.ChownFS, fsx.ChtimesFS
+
+// Chmod changes the mode of the named file.
+func (fsys *tarfs) Chmod(name string, mode fs.FileMode) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	_, n, err := fsys.resolve("Chmod", name, true)
+	if err != nil {
+		return err
+	}
+
+	n.mode = mode & permBits
+	n.implicit = false
+
+	return nil
+}
+
+// Chown changes the numeric owner and group of the named file. The stored user
+// and group names are cleared if the ids change.
+func (fsys *tarfs) Chown(name string, uid, gid int) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	_, n, err := fsys.resolve("Chown", name, true)
+	if err != nil {
+		return err
+	}
+
+	n.chown(uid, gid)
+	n.implicit = false
+
+	return nil
+}
+
+// Chtimes changes the access and modification time of the named file. A zero
+// value keeps the current value. Only the modification time is written to the
+// archive.
+func (fsys *tarfs) Chtimes(name string, atime, mtime time.Time) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	_, n, err := fsys.resolve("Chtimes", name, true)
+	if err != nil {
+		return err
+	}
+
+	if !atime.IsZero() {
+		n.atime = atime
+	}
+	if !mtime.IsZero() {
+		n.mtime = mtime
+	}
+	n.implicit = false
+
+	return nil
+}
+
+// -- fsx.LinkFS
+
+// Readlink returns the target of the symlink name relative to the
+// filesystem's root.
+func (fsys *tarfs) Readlink(name string) (string, error) {
+	fsys.mu.RLock()
+	defer fsys.mu.RUnlock()
+
+	resolved, n, err := fsys.resolve("Readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+
+	if !n.isSymlink() {
+		return "", pathError("Readlink", name, fs.ErrInvalid)
+	}
+
+	return linkTarget(resolved, n.linkname), nil
+}
+
+// Link creates newname as a hard link to oldname. Both names share the same
+// content and metadata and are written as a tar hard link.
+func (fsys *tarfs) Link(oldname, newname string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	_, n, err := fsys.resolve("Link", oldname, false)
+	if err != nil {
+		return err
+	}
+
+	if n.isDir() {
+		return pathError("Link", oldname, fs.ErrInvalid)
+	}
+
+	to, err := fsys.resolveParent("Link", newname)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := fsys.entries[to]; ok {
+		return pathError("Link", newname, fs.ErrExist)
+	}
+
+	fsys.entries[to] = n
+	pathtree.Touch(fsys.entries, to)
+
+	return nil
+}
+
+// Symlink creates newname as a symlink to oldname. oldname is interpreted
+// relative to the filesystem's root; it is stored relative to newname's
+// directory. oldname does not need to exist.
+func (fsys *tarfs) Symlink(oldname, newname string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	if !fs.ValidPath(oldname) {
+		return pathError("Symlink", oldname, fs.ErrInvalid)
+	}
+
+	to, err := fsys.resolveParent("Symlink", newname)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := fsys.entries[to]; ok {
+		return pathError("Symlink", newname, fs.ErrExist)
+	}
+
+	fsys.entries[to] = &inode{
+		typeflag: tar.TypeSymlink,
+		mode:     0777,
+		mtime:    time.Now(),
+		linkname: relativeLinkname(to, oldname),
+	}
+	pathtree.Touch(fsys.entries, to)
+
+	return nil
+}
+
+// -- fs.StatFS, fs.ReadDirFS, fs.ReadFileFS
+
+// Stat returns a fs.FileInfo describing the named file following symlinks.
+// The info's Sys method returns a *tar.Header.
+func (fsys *tarfs) Stat(name string) (fs.FileInfo, error) {
+	fsys.mu.RLock()
+	defer fsys.mu.RUnlock()
+
+	resolved, n, err := fsys.resolve("Stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileInfo{name: resolved, n: n}, nil
+}
+
+// Lstat returns a fs.FileInfo describing the named file without following a
+// final symlink.
+func (fsys *tarfs) Lstat(name string) (fs.FileInfo, error) {
+	fsys.mu.RLock()
+	defer fsys.mu.RUnlock()
+
+	resolved, n, err := fsys.resolve("Lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileInfo{name: resolved, n: n}, nil
+}
+
+// ReadDir returns the sorted entries of the named directory. Symlinks are
+// reported with fs.ModeSymlink and are not followed.
+func (fsys *tarfs) ReadDir(name string) ([]fs.DirEntry, error) {
+	fsys.mu.RLock()
+	defer fsys.mu.RUnlock()
+
+	resolved, n, err := fsys.resolve("ReadDir", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if !n.isDir() {
+		return nil, pathError("ReadDir", name, fs.ErrInvalid)
+	}
+
+	return fsys.readDir(resolved), nil
+}
+
+// ReadFile returns the content of the named file.
+func (fsys *tarfs) ReadFile(name string) ([]byte, error) {
+	fsys.mu.RLock()
+	defer fsys.mu.RUnlock()
+
+	_, n, err := fsys.resolve("ReadFile", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.isDir() {
+		return nil, pathError("ReadFile", name, buffile.ErrIsDirectory)
+	}
+
+	return bytes.Clone(n.data), nil
+}
+
+var _ FS = &tarfs{}
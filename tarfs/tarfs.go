@@ -0,0 +1,517 @@
+// Package tarfs provides a writable filesystem backed by a tar archive.
+//
+// A tarfs reads an existing archive (optionally gzip compressed) into memory
+// and exposes its content as a fsx.LinkFS. All modifications are kept in
+// memory. Flush and Close write a new archive to the writer passed on
+// creation. The written archive is deterministic: entries are sorted by name
+// and only the information stored in the archive's headers (name, mode,
+// ownership, modification time and link information) is written.
+//
+// Symlink targets are stored in the archive relative to the link's directory
+// (as done by tar(1)) while the fsx API uses targets relative to the
+// filesystem's root.
+//
+// Modes and ownership are taken from the archive's headers and written back
+// unchanged; Chown clears the stored user and group names if the ids change.
+// New entries are owned by uid and gid 0. Modes are not checked when opening
+// files, so entries without write permission can be modified as well.
+package tarfs
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/halimath/fsx"
+)
+
+var (
+	// ErrNoWriter is returned from Flush if the filesystem has been created
+	// without a writer.
+	ErrNoWriter = errors.New("tarfs: no writer")
+
+	// ErrUnsupportedEntry is returned when reading an archive that contains
+	// entries of an unsupported type.
+	ErrUnsupportedEntry = errors.New("tarfs: unsupported entry type")
+)
+
+// Compression defines the compression applied to the archive written by Flush.
+type Compression int
+
+const (
+	// CompressionAuto uses the same compression as the archive read by Open.
+	// Archives created with New are not compressed.
+	CompressionAuto Compression = iota
+	// CompressionNone writes an uncompressed archive.
+	CompressionNone
+	// CompressionGzip writes a gzip compressed archive.
+	CompressionGzip
+)
+
+// Option defines a function used to customize a tarfs.
+type Option func(*options)
+
+type options struct {
+	compression Compression
+	gzipLevel   int
+}
+
+// WithCompression sets the compression used when writing the archive.
+func WithCompression(c Compression) Option {
+	return func(o *options) {
+		o.compression = c
+	}
+}
+
+// WithGzipLevel sets the gzip compression level (see compress/gzip) and
+// enables gzip compression.
+func WithGzipLevel(level int) Option {
+	return func(o *options) {
+		o.compression = CompressionGzip
+		o.gzipLevel = level
+	}
+}
+
+// FS defines the interface of a tar-backed filesystem.
+type FS interface {
+	fsx.LinkFS
+	fsx.ChmodFS
+	fsx.ChownFS
+	fsx.ChtimesFS
+	fsx.RemoveAllFS
+	fs.StatFS
+	fs.ReadDirFS
+
+	// Lstat returns a fs.FileInfo describing the named file without
+	// following a final symlink.
+	Lstat(name string) (fs.FileInfo, error)
+
+	// WriteTo writes the archive to w.
+	WriteTo(w io.Writer) (int64, error)
+
+	// Flush writes the archive to the writer passed to New or Open. Each call
+	// writes a complete archive.
+	Flush() error
+
+	// Close flushes the archive and closes the filesystem. The filesystem
+	// must not be used after Close.
+	Close() error
+}
+
+// inode holds the data and metadata of a single archive entry. Hard links
+// are represented by multiple names referring to the same inode.
+type inode struct {
+	typeflag     byte
+	mode         fs.FileMode
+	uid, gid     int
+	uname, gname string
+	mtime, atime time.Time
+	linkname     string
+	devmajor     int64
+	devminor     int64
+	pax          map[string]string
+	data         []byte
+	// implicit marks directories that are not part of the source archive but
+	// have been created as parents of other entries.
+	implicit bool
+}
+
+func (n *inode) isDir() bool     { return n.typeflag == tar.TypeDir }
+func (n *inode) isSymlink() bool { return n.typeflag == tar.TypeSymlink }
+func (n *inode) isRegular() bool { return n.typeflag == tar.TypeReg }
+
+// Touch marks the directory n as modified at t.
+func (n *inode) Touch(t time.Time) {
+	n.mtime = t
+	n.implicit = false
+}
+
+// fileMode returns n's mode including type bits.
+func (n *inode) fileMode() fs.FileMode {
+	m := n.mode
+	switch n.typeflag {
+	case tar.TypeDir:
+		m |= fs.ModeDir
+	case tar.TypeSymlink:
+		m |= fs.ModeSymlink
+	case tar.TypeChar:
+		m |= fs.ModeDevice | fs.ModeCharDevice
+	case tar.TypeBlock:
+		m |= fs.ModeDevice
+	case tar.TypeFifo:
+		m |= fs.ModeNamedPipe
+	}
+	return m
+}
+
+// header creates a tar header for n stored as name.
+func (n *inode) header(name string) *tar.Header {
+	hdr := &tar.Header{
+		Typeflag: n.typeflag,
+		Name:     name,
+		Linkname: n.linkname,
+		Mode:     int64(n.mode.Perm()),
+		Uid:      n.uid,
+		Gid:      n.gid,
+		Uname:    n.uname,
+		Gname:    n.gname,
+		ModTime:  n.mtime,
+		Devmajor: n.devmajor,
+		Devminor: n.devminor,
+	}
+
+	if n.mode&fs.ModeSetuid != 0 {
+		hdr.Mode |= 04000
+	}
+	if n.mode&fs.ModeSetgid != 0 {
+		hdr.Mode |= 02000
+	}
+	if n.mode&fs.ModeSticky != 0 {
+		hdr.Mode |= 01000
+	}
+
+	if n.isDir() {
+		hdr.Name += "/"
+	}
+
+	if n.isRegular() {
+		hdr.Size = int64(len(n.data))
+	}
+
+	if len(n.pax) > 0 {
+		hdr.PAXRecords = make(map[string]string, len(n.pax))
+		for k, v := range n.pax {
+			hdr.PAXRecords[k] = v
+		}
+	}
+
+	return hdr
+}
+
+// preservedPAXKey reports whether the PAX record key should be preserved from
+// the source archive. Records that correspond to header fields are recreated
+// from the fields when writing.
+func preservedPAXKey(key string) bool {
+	switch key {
+	case "path", "linkpath", "size", "uid", "gid", "uname", "gname", "mtime", "atime", "ctime":
+		return false
+	}
+	return !strings.HasPrefix(key, "GNU.sparse.")
+}
+
+type tarfs struct {
+	mu      sync.RWMutex
+	entries map[string]*inode
+	w       io.Writer
+	opts    options
+	gzipped bool
+	closed  bool
+}
+
+// New creates a new, empty tar-backed filesystem. The archive is written to w
+// when calling Flush or Close. w may be nil; in this case use WriteTo to write
+// the archive.
+func New(w io.Writer, opts ...Option) FS {
+	fsys := &tarfs{
+		entries: map[string]*inode{
+			".": newDirInode(0755),
+		},
+		w: w,
+	}
+
+	for _, opt := range opts {
+		opt(&fsys.opts)
+	}
+
+	return fsys
+}
+
+// Open reads the tar archive from r and returns a filesystem providing access
+// to the archive's content. gzip compressed archives are detected
+// automatically. The modified archive is written to w when calling Flush or
+// Close. w may be nil; in this case use WriteTo to write the archive.
+func Open(r io.Reader, w io.Writer, opts ...Option) (FS, error) {
+	fsys := New(w, opts...).(*tarfs)
+
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	var src io.Reader = br
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+
+		src = zr
+		fsys.gzipped = true
+	}
+
+	if err := fsys.read(tar.NewReader(src)); err != nil {
+		return nil, err
+	}
+
+	return fsys, nil
+}
+
+func newDirInode(perm fs.FileMode) *inode {
+	return &inode{
+		typeflag: tar.TypeDir,
+		mode:     perm,
+		mtime:    time.Now(),
+	}
+}
+
+// cleanName converts a name found in an archive to a fs path.
+func cleanName(name string) string {
+	name = strings.TrimLeft(name, "/")
+	name = path.Clean(name)
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// read reads all entries from r.
+func (fsys *tarfs) read(r *tar.Reader) error {
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := cleanName(hdr.Name)
+		if !fs.ValidPath(name) {
+			return &fs.PathError{
+				Op:   "Open",
+				Path: hdr.Name,
+				Err:  fs.ErrInvalid,
+			}
+		}
+
+		n := &inode{
+			mode:     hdr.FileInfo().Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky),
+			uid:      hdr.Uid,
+			gid:      hdr.Gid,
+			uname:    hdr.Uname,
+			gname:    hdr.Gname,
+			mtime:    hdr.ModTime,
+			atime:    hdr.AccessTime,
+			devmajor: hdr.Devmajor,
+			devminor: hdr.Devminor,
+		}
+
+		for k, v := range hdr.PAXRecords {
+			if preservedPAXKey(k) {
+				if n.pax == nil {
+					n.pax = make(map[string]string)
+				}
+				n.pax[k] = v
+			}
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeCont:
+			n.typeflag = tar.TypeReg
+			n.data, err = io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+
+		case tar.TypeDir, tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			n.typeflag = hdr.Typeflag
+			n.linkname = hdr.Linkname
+
+		case tar.TypeLink:
+			target, ok := fsys.entries[cleanName(hdr.Linkname)]
+			if !ok {
+				return &fs.PathError{
+					Op:   "Open",
+					Path: hdr.Linkname,
+					Err:  fs.ErrNotExist,
+				}
+			}
+			n = target
+
+		default:
+			return fmt.Errorf("%w: %q for %s", ErrUnsupportedEntry, hdr.Typeflag, hdr.Name)
+		}
+
+		if name == "." {
+			if n.isDir() {
+				fsys.entries["."] = n
+			}
+			continue
+		}
+
+		fsys.ensureParents(name)
+		fsys.entries[name] = n
+	}
+}
+
+// ensureParents creates implicit directories for all missing parents of name.
+func (fsys *tarfs) ensureParents(name string) {
+	for d := path.Dir(name); d != "."; d = path.Dir(d) {
+		if _, ok := fsys.entries[d]; ok {
+			return
+		}
+		n := newDirInode(0755)
+		n.implicit = true
+		n.mtime = time.Time{}
+		fsys.entries[d] = n
+	}
+}
+
+// -- Writing
+
+func (fsys *tarfs) compression() Compression {
+	if fsys.opts.compression != CompressionAuto {
+		return fsys.opts.compression
+	}
+	if fsys.gzipped {
+		return CompressionGzip
+	}
+	return CompressionNone
+}
+
+// WriteTo writes the archive to w.
+func (fsys *tarfs) WriteTo(w io.Writer) (int64, error) {
+	fsys.mu.RLock()
+	defer fsys.mu.RUnlock()
+
+	cw := &countingWriter{w: w}
+
+	var out io.Writer = cw
+	var zw *gzip.Writer
+
+	if fsys.compression() == CompressionGzip {
+		level := fsys.opts.gzipLevel
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+
+		var err error
+		zw, err = gzip.NewWriterLevel(cw, level)
+		if err != nil {
+			return 0, err
+		}
+		out = zw
+	}
+
+	if err := fsys.writeTar(out); err != nil {
+		return cw.n, err
+	}
+
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return cw.n, err
+		}
+	}
+
+	return cw.n, nil
+}
+
+func (fsys *tarfs) writeTar(w io.Writer) error {
+	names := make([]string, 0, len(fsys.entries))
+	for name := range fsys.entries {
+		if name != "." {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	tw := tar.NewWriter(w)
+
+	// written maps inodes of regular files already written to their name.
+	written := make(map[*inode]string)
+
+	for _, name := range names {
+		n := fsys.entries[name]
+
+		if n.implicit {
+			continue
+		}
+
+		hdr := n.header(name)
+
+		if n.isRegular() {
+			if first, ok := written[n]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				written[n] = name
+			}
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := tw.Write(n.data); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tw.Close()
+}
+
+// Flush writes the archive to the writer passed on creation.
+func (fsys *tarfs) Flush() error {
+	if fsys.w == nil {
+		return ErrNoWriter
+	}
+
+	_, err := fsys.WriteTo(fsys.w)
+	return err
+}
+
+// Close flushes the archive if a writer has been given and closes fsys.
+func (fsys *tarfs) Close() error {
+	fsys.mu.Lock()
+	if fsys.closed {
+		fsys.mu.Unlock()
+		return fs.ErrClosed
+	}
+	fsys.mu.Unlock()
+
+	var err error
+	if fsys.w != nil {
+		err = fsys.Flush()
+	}
+
+	fsys.mu.Lock()
+	fsys.closed = true
+	fsys.mu.Unlock()
+
+	return err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,344 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	. "github.com/halimath/fixture"
+	"github.com/halimath/fsx"
+)
+
+var mtime = time.Date(2023, 5, 17, 10, 30, 0, 0, time.UTC)
+
+type testEntry struct {
+	hdr  tar.Header
+	data string
+}
+
+func createTar(t *testing.T, gzipped bool, entries ...testEntry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+
+	var zw *gzip.Writer
+	if gzipped {
+		zw = gzip.NewWriter(&buf)
+		w = zw
+	}
+
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.data))
+		if hdr.ModTime.IsZero() {
+			hdr.ModTime = mtime
+		}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+func readHeaders(t *testing.T, data []byte) []*tar.Header {
+	t.Helper()
+
+	var hdrs []*tar.Header
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return hdrs
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdrs = append(hdrs, hdr)
+	}
+}
+
+func sampleTar(t *testing.T, gzipped bool) []byte {
+	return createTar(t, gzipped,
+		testEntry{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0755}},
+		testEntry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hosts", Mode: 0644, Uid: 1000, Gid: 100, Uname: "user", Gname: "users"}, data: "127.0.0.1 localhost\n"},
+		testEntry{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "etc/hosts.bak", Linkname: "etc/hosts"}},
+		testEntry{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "hosts", Linkname: "etc/hosts", Mode: 0777}},
+		testEntry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "usr/bin/tool", Mode: 04755}, data: "#!/bin/sh\n"},
+	)
+}
+
+func TestOpen(t *testing.T) {
+	for _, gzipped := range []bool{false, true} {
+		fsys, err := Open(bytes.NewReader(sampleTar(t, gzipped)), nil)
+		expect.That(t, expect.FailNow(is.NoError(err)))
+
+		content, err := fs.ReadFile(fsys, "hosts")
+		expect.That(t, is.NoError(err), is.EqualTo(string(content), "127.0.0.1 localhost\n"))
+
+		info, err := fsys.Stat("etc/hosts")
+		expect.That(t,
+			is.NoError(err),
+			is.EqualTo(info.Mode(), 0644),
+			is.EqualTo(info.ModTime().UTC(), mtime),
+		)
+
+		hdr := info.Sys().(*tar.Header)
+		expect.That(t,
+			is.EqualTo(hdr.Uid, 1000),
+			is.EqualTo(hdr.Gid, 100),
+			is.EqualTo(hdr.Uname, "user"),
+		)
+
+		linked, err := fsys.Stat("etc/hosts.bak")
+		expect.That(t, is.NoError(err), is.EqualTo(fsys.SameFile(info, linked), true))
+
+		target, err := fsys.Readlink("hosts")
+		expect.That(t, is.NoError(err), is.EqualTo(target, "etc/hosts"))
+
+		info, err = fsys.Stat("usr/bin/tool")
+		expect.That(t, is.NoError(err), is.EqualTo(info.Mode(), fs.ModeSetuid|0755))
+
+		expect.That(t, is.NoError(fstest.TestFS(fsys, "etc/hosts", "etc/hosts.bak", "hosts", "usr/bin/tool")))
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	data := sampleTar(t, false)
+
+	fsys, err := Open(bytes.NewReader(data), nil)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	var first, second bytes.Buffer
+	_, err = fsys.WriteTo(&first)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	_, err = fsys.WriteTo(&second)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	expect.That(t, is.DeepEqualTo(first.Bytes(), second.Bytes()))
+
+	hdrs := readHeaders(t, first.Bytes())
+	expect.That(t, expect.FailNow(is.SliceOfLen(hdrs, 5)))
+
+	names := make([]string, len(hdrs))
+	for i, h := range hdrs {
+		names[i] = h.Name
+	}
+	expect.That(t, is.DeepEqualTo(names, []string{"etc/", "etc/hosts", "etc/hosts.bak", "hosts", "usr/bin/tool"}))
+
+	expect.That(t,
+		is.EqualTo(hdrs[1].Uid, 1000),
+		is.EqualTo(hdrs[1].Gname, "users"),
+		is.EqualTo(hdrs[1].ModTime.UTC(), mtime),
+		is.EqualTo(hdrs[2].Typeflag, tar.TypeLink),
+		is.EqualTo(hdrs[2].Linkname, "etc/hosts"),
+		is.EqualTo(hdrs[3].Typeflag, tar.TypeSymlink),
+		is.EqualTo(hdrs[3].Linkname, "etc/hosts"),
+		is.EqualTo(hdrs[4].Mode, int64(04755)),
+	)
+}
+
+func TestGzipPreserved(t *testing.T) {
+	var out bytes.Buffer
+	fsys, err := Open(bytes.NewReader(sampleTar(t, true)), &out)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	expect.That(t, expect.FailNow(is.NoError(fsys.Close())))
+
+	zr, err := gzip.NewReader(&out)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	data, err := io.ReadAll(zr)
+	expect.That(t, is.NoError(err), is.SliceOfLen(readHeaders(t, data), 5))
+
+	expect.That(t, is.Error(fsys.Close(), fs.ErrClosed))
+
+	_, err = fsys.Stat("hosts")
+	expect.That(t, is.Error(err, fs.ErrClosed))
+}
+
+type tarfsFixture struct {
+	fs FS
+}
+
+func (f *tarfsFixture) BeforeEach(t *testing.T) error {
+	var err error
+	f.fs, err = Open(bytes.NewReader(sampleTar(t, false)), nil)
+	return err
+}
+
+func (f *tarfsFixture) headers(t *testing.T) map[string]*tar.Header {
+	var buf bytes.Buffer
+	if _, err := f.fs.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	hdrs := make(map[string]*tar.Header)
+	for _, h := range readHeaders(t, buf.Bytes()) {
+		hdrs[h.Name] = h
+	}
+	return hdrs
+}
+
+func TestTarfs(t *testing.T) {
+	With(t, new(tarfsFixture)).
+		Run("writeFile", func(t *testing.T, f *tarfsFixture) {
+			expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(f.fs, "etc/motd", []byte("hello"), 0600))))
+
+			hdrs := f.headers(t)
+			expect.That(t, expect.FailNow(is.EqualTo(hdrs["etc/motd"] != nil, true)))
+			expect.That(t,
+				is.EqualTo(hdrs["etc/motd"].Size, int64(5)),
+				is.EqualTo(hdrs["etc/motd"].Mode, int64(0600)),
+			)
+		}).
+		Run("modifyHardLink", func(t *testing.T, f *tarfsFixture) {
+			expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(f.fs, "etc/hosts.bak", []byte("::1 localhost\n"), 0644))))
+
+			content, err := fs.ReadFile(f.fs, "etc/hosts")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "::1 localhost\n"))
+		}).
+		Run("writeThroughSymlink", func(t *testing.T, f *tarfsFixture) {
+			file, err := f.fs.OpenFile("hosts", fsx.O_WRONLY|fsx.O_APPEND, 0)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			_, err = file.Write([]byte("::1 localhost\n"))
+			expect.That(t, is.NoError(err), is.NoError(file.Close()))
+
+			content, err := fs.ReadFile(f.fs, "etc/hosts")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "127.0.0.1 localhost\n::1 localhost\n"))
+		}).
+		Run("createExclusive", func(t *testing.T, f *tarfsFixture) {
+			_, err := f.fs.OpenFile("etc/hosts", fsx.O_WRONLY|fsx.O_CREATE|fsx.O_EXCL, 0644)
+			expect.That(t, is.Error(err, fs.ErrExist))
+		}).
+		Run("mkdirAndRemove", func(t *testing.T, f *tarfsFixture) {
+			expect.That(t,
+				is.NoError(f.fs.Mkdir("var", 0700)),
+				is.Error(f.fs.Mkdir("var", 0700), fs.ErrExist),
+				is.Error(f.fs.Mkdir("missing/child", 0700), fs.ErrNotExist),
+				is.Error(f.fs.Remove("etc"), fsx.ErrDirNotEmpty),
+				is.NoError(f.fs.Remove("var")),
+				is.Error(f.fs.Remove("var"), fs.ErrNotExist),
+				is.NoError(f.fs.RemoveAll("etc")),
+				is.NoError(f.fs.RemoveAll("etc")),
+			)
+
+			hdrs := f.headers(t)
+			expect.That(t, is.EqualTo(len(hdrs), 2))
+		}).
+		Run("rename", func(t *testing.T, f *tarfsFixture) {
+			expect.That(t, expect.FailNow(is.NoError(f.fs.Rename("etc", "config"))))
+
+			_, err := f.fs.Stat("etc/hosts")
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+
+			content, err := fs.ReadFile(f.fs, "config/hosts.bak")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "127.0.0.1 localhost\n"))
+
+			expect.That(t, is.Error(f.fs.Rename("config", "config/sub"), fs.ErrInvalid))
+		}).
+		Run("renameSymlink", func(t *testing.T, f *tarfsFixture) {
+			expect.That(t, expect.FailNow(is.NoError(f.fs.Rename("hosts", "usr/bin/hosts"))))
+
+			target, err := f.fs.Readlink("usr/bin/hosts")
+			expect.That(t, is.NoError(err), is.EqualTo(target, "etc/hosts"))
+
+			hdrs := f.headers(t)
+			expect.That(t, is.EqualTo(hdrs["usr/bin/hosts"].Linkname, "../../etc/hosts"))
+		}).
+		Run("symlink", func(t *testing.T, f *tarfsFixture) {
+			expect.That(t, expect.FailNow(is.NoError(f.fs.Symlink("usr/bin/tool", "etc/tool"))))
+
+			content, err := fs.ReadFile(f.fs, "etc/tool")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "#!/bin/sh\n"))
+
+			info, err := f.fs.Lstat("etc/tool")
+			expect.That(t, is.NoError(err), is.EqualTo(info.Mode()&fs.ModeSymlink, fs.ModeSymlink))
+
+			hdrs := f.headers(t)
+			expect.That(t, is.EqualTo(hdrs["etc/tool"].Linkname, "../usr/bin/tool"))
+
+			expect.That(t, is.Error(f.fs.Symlink("usr/bin/tool", "etc/tool"), fs.ErrExist))
+		}).
+		Run("link", func(t *testing.T, f *tarfsFixture) {
+			expect.That(t,
+				expect.FailNow(is.NoError(f.fs.Link("usr/bin/tool", "tool"))),
+				is.Error(f.fs.Link("etc", "etc2"), fs.ErrInvalid),
+			)
+
+			hdrs := f.headers(t)
+			expect.That(t,
+				is.EqualTo(hdrs["tool"].Typeflag, tar.TypeReg),
+				is.EqualTo(hdrs["usr/bin/tool"].Typeflag, tar.TypeLink),
+				is.EqualTo(hdrs["usr/bin/tool"].Linkname, "tool"),
+			)
+		}).
+		Run("metadata", func(t *testing.T, f *tarfsFixture) {
+			changed := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+			expect.That(t,
+				is.NoError(f.fs.Chmod("etc/hosts", 0600)),
+				is.NoError(f.fs.Chown("etc/hosts", 0, 0)),
+				is.NoError(f.fs.Chtimes("etc/hosts", time.Time{}, changed)),
+			)
+
+			hdrs := f.headers(t)
+			h := hdrs["etc/hosts"]
+			expect.That(t,
+				is.EqualTo(h.Mode, int64(0600)),
+				is.EqualTo(h.Uid, 0),
+				is.EqualTo(h.Uname, ""),
+				is.EqualTo(h.ModTime.UTC(), changed),
+			)
+		}).
+		Run("readDir", func(t *testing.T, f *tarfsFixture) {
+			entries, err := f.fs.ReadDir(".")
+			expect.That(t, expect.FailNow(is.NoError(err)), expect.FailNow(is.SliceOfLen(entries, 3)))
+
+			expect.That(t,
+				is.EqualTo(entries[0].Name(), "etc"),
+				is.EqualTo(entries[1].Name(), "hosts"),
+				is.EqualTo(entries[1].Type(), fs.ModeSymlink),
+				is.EqualTo(entries[2].Name(), "usr"),
+			)
+		})
+}
+
+func TestNew(t *testing.T) {
+	var out bytes.Buffer
+	fsys := New(&out, WithCompression(CompressionGzip))
+
+	expect.That(t, expect.FailNow(
+		is.NoError(fsx.MkdirAll(fsys, "a/b", 0755)),
+		is.NoError(fsx.WriteFile(fsys, "a/b/c.txt", []byte("c"), 0644)),
+		is.NoError(fsys.Close()),
+	))
+
+	reopened, err := Open(&out, nil)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	content, err := fs.ReadFile(reopened, "a/b/c.txt")
+	expect.That(t, is.NoError(err), is.EqualTo(string(content), "c"))
+}
@@ -0,0 +1,204 @@
+package fsx
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContextLines defines the number of unchanged lines to include before
+// and after each change when rendering a unified diff.
+const diffContextLines = 3
+
+// maxDiffCells limits the size of the table used to compute the longest common
+// subsequence of two texts. If two texts exceed this limit, the diff is
+// rendered as a complete replacement of all lines.
+const maxDiffCells = 16 << 20
+
+// diffOp defines the kind of a single line in a diff.
+type diffOp byte
+
+const (
+	diffEqual  diffOp = ' '
+	diffDelete diffOp = '-'
+	diffInsert diffOp = '+'
+)
+
+type diffLine struct {
+	op   diffOp
+	text string
+}
+
+// splitLines splits s into lines keeping the line terminators.
+func splitLines(s string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+
+	lines := strings.SplitAfter(s, "\n")
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines computes a line based edit script transforming a into b.
+func diffLines(a, b []string) []diffLine {
+	if len(a)*len(b) > maxDiffCells {
+		result := make([]diffLine, 0, len(a)+len(b))
+		for _, l := range a {
+			result = append(result, diffLine{diffDelete, l})
+		}
+		for _, l := range b {
+			result = append(result, diffLine{diffInsert, l})
+		}
+		return result
+	}
+
+	// lcs[i][j] holds the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	result := make([]diffLine, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			result = append(result, diffLine{diffEqual, a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			result = append(result, diffLine{diffDelete, a[i]})
+			i++
+		default:
+			result = append(result, diffLine{diffInsert, b[j]})
+			j++
+		}
+	}
+
+	for ; i < len(a); i++ {
+		result = append(result, diffLine{diffDelete, a[i]})
+	}
+
+	for ; j < len(b); j++ {
+		result = append(result, diffLine{diffInsert, b[j]})
+	}
+
+	return result
+}
+
+// unifiedDiff renders a unified diff transforming a (named oldName) into b
+// (named newName). It returns an empty string if a and b are equal.
+func unifiedDiff(oldName, newName, a, b string) string {
+	if a == b {
+		return ""
+	}
+
+	lines := diffLines(splitLines(a), splitLines(b))
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", oldName, newName)
+
+	// oldLine and newLine hold the 0-based line numbers of lines[i] in a and
+	// b respectively.
+	oldLine, newLine := 0, 0
+
+	for i := 0; i < len(lines); {
+		if lines[i].op == diffEqual {
+			oldLine++
+			newLine++
+			i++
+			continue
+		}
+
+		// Determine the hunk's range including leading and trailing context.
+		start := i - diffContextLines
+		if start < 0 {
+			start = 0
+		}
+
+		end := i
+		for end < len(lines) {
+			if lines[end].op != diffEqual {
+				end++
+				continue
+			}
+
+			// Find the end of the run of equal lines; merge with the next change
+			// if both contexts overlap.
+			run := end
+			for run < len(lines) && lines[run].op == diffEqual {
+				run++
+			}
+
+			if run == len(lines) || run-end > 2*diffContextLines {
+				end += diffContextLines
+				if end > run {
+					end = run
+				}
+				break
+			}
+
+			end = run
+		}
+
+		hunkOldStart := oldLine - (i - start)
+		hunkNewStart := newLine - (i - start)
+		var oldCount, newCount int
+		for _, l := range lines[start:end] {
+			if l.op != diffInsert {
+				oldCount++
+			}
+			if l.op != diffDelete {
+				newCount++
+			}
+		}
+
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(hunkOldStart, oldCount), hunkRange(hunkNewStart, newCount))
+		for _, l := range lines[start:end] {
+			sb.WriteByte(byte(l.op))
+			sb.WriteString(l.text)
+			if !strings.HasSuffix(l.text, "\n") {
+				sb.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+
+		for _, l := range lines[i:end] {
+			if l.op != diffInsert {
+				oldLine++
+			}
+			if l.op != diffDelete {
+				newLine++
+			}
+		}
+		i = end
+	}
+
+	return sb.String()
+}
+
+// hunkRange formats a hunk's range given the 0-based start line and the number
+// of lines.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
@@ -0,0 +1,270 @@
+package trashfs
+
+import (
+	"io/fs"
+	"path"
+	"time"
+
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/internal/linkutil"
+	"github.com/halimath/fsx/internal/wrapfs"
+)
+
+// Open opens the named file for reading.
+func (fsys *trashfs) Open(name string) (fs.File, error) {
+	if err := fsys.check("open", name); err != nil {
+		return nil, err
+	}
+
+	f, err := fsys.backing.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if fsys.encloses(name) {
+		if d, ok := f.(fs.ReadDirFile); ok {
+			return &dir{ReadDirFile: d, fsys: fsys, name: name}, nil
+		}
+	}
+	return f, nil
+}
+
+// OpenFile opens the named file.
+func (fsys *trashfs) OpenFile(name string, flag int, perm fs.FileMode) (fsx.File, error) {
+	if err := fsys.check("OpenFile", name); err != nil {
+		return nil, err
+	}
+	return fsys.backing.OpenFile(name, flag, perm)
+}
+
+// Mkdir creates the named directory.
+func (fsys *trashfs) Mkdir(name string, perm fs.FileMode) error {
+	if err := fsys.check("Mkdir", name); err != nil {
+		return err
+	}
+	return fsys.backing.Mkdir(name, perm)
+}
+
+// Remove moves the named file or empty directory into the trash.
+func (fsys *trashfs) Remove(name string) error {
+	if err := fsys.check("Remove", name); err != nil {
+		return err
+	}
+	if fsys.encloses(name) {
+		return wrapfs.PathError("Remove", name, fs.ErrInvalid)
+	}
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	info, err := linkutil.Lstat(fsys.backing, name)
+	if err != nil {
+		return wrapfs.PathError("Remove", name, fs.ErrNotExist)
+	}
+
+	if info.IsDir() {
+		entries, err := fs.ReadDir(fsys.backing, name)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return wrapfs.PathError("Remove", name, fsx.ErrDirNotEmpty)
+		}
+	}
+
+	return fsys.trash(name)
+}
+
+// Rename renames oldpath to newpath.
+func (fsys *trashfs) Rename(oldpath, newpath string) error {
+	if err := fsys.check("Rename", oldpath); err != nil {
+		return err
+	}
+	if err := fsys.check("Rename", newpath); err != nil {
+		return err
+	}
+	if fsys.encloses(oldpath) {
+		return wrapfs.PathError("Rename", oldpath, fs.ErrPermission)
+	}
+	return fsys.backing.Rename(oldpath, newpath)
+}
+
+// SameFile reports whether fi1 and fi2 describe the same file.
+func (fsys *trashfs) SameFile(fi1, fi2 fs.FileInfo) bool {
+	return fsys.backing.SameFile(fi1, fi2)
+}
+
+// -- fsx.WriteFileFS
+
+// WriteFile writes data to the named file.
+func (fsys *trashfs) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	if err := fsys.check("WriteFile", name); err != nil {
+		return err
+	}
+	return fsx.WriteFile(fsys.backing, name, data, perm)
+}
+
+// -- fsx.ChmodFS, fsx.ChownFS, fsx.ChtimesFS, fsx.RemoveAllFS
+
+// Chmod changes the mode of the named file.
+func (fsys *trashfs) Chmod(name string, mode fs.FileMode) error {
+	if err := fsys.check("Chmod", name); err != nil {
+		return err
+	}
+	return fsx.Chmod(fsys.backing, name, mode)
+}
+
+// Chown changes the numeric owner and group of the named file.
+func (fsys *trashfs) Chown(name string, uid, gid int) error {
+	if err := fsys.check("Chown", name); err != nil {
+		return err
+	}
+	return fsx.Chown(fsys.backing, name, uid, gid)
+}
+
+// Chtimes changes the access and modification time of the named file.
+func (fsys *trashfs) Chtimes(name string, atime, mtime time.Time) error {
+	if err := fsys.check("Chtimes", name); err != nil {
+		return err
+	}
+
+	return wrapfs.Chtimes(fsys.backing, name, atime, mtime)
+}
+
+// RemoveAll moves name including all of its children into the trash as a
+// single entry. If name encloses the trash directory, each of its children
+// is moved into the trash separately. If name does not exist, RemoveAll
+// returns nil.
+func (fsys *trashfs) RemoveAll(name string) error {
+	if err := fsys.check("RemoveAll", name); err != nil {
+		return err
+	}
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	return fsys.removeAll(name)
+}
+
+// removeAll implements RemoveAll. It must be called with fsys.mu held.
+func (fsys *trashfs) removeAll(name string) error {
+	if fsys.encloses(name) {
+		entries, err := fs.ReadDir(fsys.backing, name)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			child := path.Join(name, e.Name())
+			if fsys.hidden(child) {
+				continue
+			}
+			if err := fsys.removeAll(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if _, err := linkutil.Lstat(fsys.backing, name); err != nil {
+		return nil
+	}
+	return fsys.trash(name)
+}
+
+// -- fsx.LinkFS
+
+// Readlink returns the target of the named symlink.
+func (fsys *trashfs) Readlink(name string) (string, error) {
+	if err := fsys.check("Readlink", name); err != nil {
+		return "", err
+	}
+
+	return wrapfs.Readlink(fsys.backing, name)
+}
+
+// Link creates newname as a hard link to oldname.
+func (fsys *trashfs) Link(oldname, newname string) error {
+	if err := fsys.check("Link", oldname); err != nil {
+		return err
+	}
+	if err := fsys.check("Link", newname); err != nil {
+		return err
+	}
+
+	return wrapfs.Link(fsys.backing, oldname, newname)
+}
+
+// Symlink creates newname as a symlink to oldname.
+func (fsys *trashfs) Symlink(oldname, newname string) error {
+	if err := fsys.check("Symlink", newname); err != nil {
+		return err
+	}
+
+	return wrapfs.Symlink(fsys.backing, oldname, newname)
+}
+
+// -- fs.StatFS, fs.ReadDirFS, fs.ReadFileFS
+
+// Stat returns a fs.FileInfo describing the named file.
+func (fsys *trashfs) Stat(name string) (fs.FileInfo, error) {
+	if err := fsys.check("stat", name); err != nil {
+		return nil, err
+	}
+	return fs.Stat(fsys.backing, name)
+}
+
+// ReadDir reads the named directory omitting the trash directory.
+func (fsys *trashfs) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := fsys.check("readdir", name); err != nil {
+		return nil, err
+	}
+
+	entries, err := fs.ReadDir(fsys.backing, name)
+	if err != nil {
+		return nil, err
+	}
+	return fsys.filter(name, entries), nil
+}
+
+// ReadFile reads the named file.
+func (fsys *trashfs) ReadFile(name string) ([]byte, error) {
+	if err := fsys.check("readfile", name); err != nil {
+		return nil, err
+	}
+	return fs.ReadFile(fsys.backing, name)
+}
+
+// filter removes the trash directory from entries read from the
+// directory name.
+func (fsys *trashfs) filter(name string, entries []fs.DirEntry) []fs.DirEntry {
+	if !fsys.encloses(name) {
+		return entries
+	}
+
+	filtered := entries[:0]
+	for _, e := range entries {
+		if !fsys.hidden(path.Join(name, e.Name())) {
+			filtered = append(filtered, e)
+		}
+	}
+	return filtered
+}
+
+// dir wraps a directory enclosing the trash directory and omits it from
+// the entries read.
+type dir struct {
+	fs.ReadDirFile
+	fsys *trashfs
+	name string
+}
+
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	for {
+		entries, err := d.ReadDirFile.ReadDir(n)
+		filtered := d.fsys.filter(d.name, entries)
+		if n <= 0 || len(filtered) > 0 || err != nil {
+			return filtered, err
+		}
+	}
+}
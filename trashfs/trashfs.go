@@ -0,0 +1,471 @@
+// Package trashfs provides a fsx.FS wrapper moving removed entries into a
+// trash directory instead of deleting them.
+//
+// Remove and RemoveAll move the removed file or directory into a trash
+// directory inside the wrapped filesystem. The layout of the trash directory
+// is modelled after the freedesktop.org trash specification: the removed
+// entry is stored in the subdirectory files and a file in the subdirectory
+// info records its original path and deletion time. The trash directory is
+// hidden from all operations performed through the wrapper.
+//
+// Trashed entries can be listed, restored to their original path and purged
+// once they reach a given age.
+package trashfs
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/internal/linkutil"
+	"github.com/halimath/fsx/internal/wrapfs"
+)
+
+const (
+	// DefaultTrashDir is the default directory used to store trashed
+	// entries.
+	DefaultTrashDir = ".trash"
+
+	filesDir   = "files"
+	infoDir    = "info"
+	infoSuffix = ".trashinfo"
+	infoHeader = "[Trash Info]"
+)
+
+// errInvalidInfo is returned when parsing a malformed info file.
+var errInvalidInfo = errors.New("trashfs: invalid trash info")
+
+// Option defines a function used to customize a trashfs.
+type Option func(*options)
+
+type options struct {
+	dir string
+}
+
+// WithTrashDir sets the directory used to store trashed entries.
+func WithTrashDir(dir string) Option {
+	return func(o *options) {
+		o.dir = dir
+	}
+}
+
+// Conflict defines how Restore handles an existing entry at the path to
+// restore to.
+type Conflict int
+
+const (
+	// Fail causes Restore to fail with an error wrapping fs.ErrExist.
+	Fail Conflict = iota
+	// Replace moves the existing entry to the trash before restoring.
+	Replace
+	// Rename restores the entry under a new name derived from the original
+	// one, e.g. "config (1).yaml".
+	Rename
+)
+
+// Entry describes a trashed entry.
+type Entry struct {
+	// ID identifies the entry in the trash.
+	ID string
+	// Path contains the entry's original path.
+	Path string
+	// DeletionTime contains the time the entry has been trashed.
+	DeletionTime time.Time
+	// Mode contains the entry's mode.
+	Mode fs.FileMode
+	// Size contains the entry's size. It is 0 for directories.
+	Size int64
+}
+
+// FS defines the interface of a trash enabled filesystem. Remove and
+// RemoveAll move entries to the trash instead of deleting them; trashed
+// entries are listed, restored and purged using the methods below.
+type FS interface {
+	fsx.LinkFS
+	fsx.ChmodFS
+	fsx.ChownFS
+	fsx.ChtimesFS
+	fsx.RemoveAllFS
+	fsx.WriteFileFS
+	fs.StatFS
+	fs.ReadDirFS
+	fs.ReadFileFS
+
+	// List returns all trashed entries ordered by deletion time. Entries
+	// with malformed info files are skipped.
+	List() ([]Entry, error)
+
+	// Restore moves the trashed entry id back to its original path using c
+	// to handle an existing entry at that path. Missing parent directories
+	// are created. It returns the path the entry has been restored to.
+	Restore(id string, c Conflict) (string, error)
+
+	// Purge permanently removes all entries trashed at least olderThan ago.
+	// Purge(0) empties the trash, including entries with malformed info
+	// files.
+	Purge(olderThan time.Duration) error
+}
+
+type trashfs struct {
+	backing fsx.FS
+	dir     string
+	now     func() time.Time
+
+	mu sync.Mutex
+}
+
+// New creates a trash enabled filesystem wrapping backing.
+func New(backing fsx.FS, opts ...Option) (FS, error) {
+	o := options{dir: DefaultTrashDir}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if !fs.ValidPath(o.dir) || o.dir == "." {
+		return nil, fmt.Errorf("trashfs: invalid trash dir: %q", o.dir)
+	}
+
+	return &trashfs{
+		backing: backing,
+		dir:     o.dir,
+		now:     time.Now,
+	}, nil
+}
+
+// hidden reports whether name is the trash directory or part of it.
+func (fsys *trashfs) hidden(name string) bool {
+	return name == fsys.dir || strings.HasPrefix(name, fsys.dir+"/")
+}
+
+// encloses reports whether the trash directory is located inside name.
+func (fsys *trashfs) encloses(name string) bool {
+	return name == "." || strings.HasPrefix(fsys.dir, name+"/")
+}
+
+// check returns an error if name is not a valid path or hidden.
+func (fsys *trashfs) check(op, name string) error {
+	if !fs.ValidPath(name) {
+		return wrapfs.PathError(op, name, fs.ErrInvalid)
+	}
+	if fsys.hidden(name) {
+		return wrapfs.PathError(op, name, fs.ErrNotExist)
+	}
+	return nil
+}
+
+// filesPath and infoPath return the paths used to store the entry id.
+func (fsys *trashfs) filesPath(id string) string {
+	return path.Join(fsys.dir, filesDir, id)
+}
+
+func (fsys *trashfs) infoPath(id string) string {
+	return path.Join(fsys.dir, infoDir, id+infoSuffix)
+}
+
+// trash moves name into the trash. It must be called with fsys.mu held.
+func (fsys *trashfs) trash(name string) error {
+	for _, dir := range []string{filesDir, infoDir} {
+		if err := fsx.MkdirAll(fsys.backing, path.Join(fsys.dir, dir), 0700); err != nil {
+			return err
+		}
+	}
+
+	id, err := fsys.newID(path.Base(name))
+	if err != nil {
+		return err
+	}
+
+	if err := fsx.WriteFile(fsys.backing, fsys.infoPath(id), formatInfo(name, fsys.now()), 0600); err != nil {
+		return err
+	}
+
+	if err := fsys.backing.Rename(name, fsys.filesPath(id)); err != nil {
+		fsys.backing.Remove(fsys.infoPath(id))
+		return err
+	}
+	return nil
+}
+
+// newID returns an unused ID derived from base. It must be called with
+// fsys.mu held.
+func (fsys *trashfs) newID(base string) (string, error) {
+	for i := 1; ; i++ {
+		id := base
+		if i > 1 {
+			id = base + "." + strconv.Itoa(i)
+		}
+
+		used, err := fsys.exists(fsys.infoPath(id))
+		if err != nil {
+			return "", err
+		}
+		if !used {
+			used, err = fsys.exists(fsys.filesPath(id))
+			if err != nil {
+				return "", err
+			}
+		}
+		if !used {
+			return id, nil
+		}
+	}
+}
+
+// exists reports whether name exists in the backing filesystem.
+func (fsys *trashfs) exists(name string) (bool, error) {
+	_, err := linkutil.Lstat(fsys.backing, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// formatInfo returns the content of an info file.
+func formatInfo(name string, t time.Time) []byte {
+	segments := strings.Split(name, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+
+	return []byte(fmt.Sprintf("%s\nPath=%s\nDeletionDate=%s\n", infoHeader, strings.Join(segments, "/"), t.UTC().Format(time.RFC3339Nano)))
+}
+
+// parseInfo parses the content of an info file.
+func parseInfo(data []byte) (name string, t time.Time, err error) {
+	s := bufio.NewScanner(strings.NewReader(string(data)))
+	if !s.Scan() || s.Text() != infoHeader {
+		return "", time.Time{}, errInvalidInfo
+	}
+
+	for s.Scan() {
+		key, val, ok := strings.Cut(s.Text(), "=")
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case "Path":
+			if name, err = url.PathUnescape(val); err != nil {
+				return "", time.Time{}, fmt.Errorf("%w: %v", errInvalidInfo, err)
+			}
+		case "DeletionDate":
+			if t, err = time.Parse(time.RFC3339Nano, val); err != nil {
+				return "", time.Time{}, fmt.Errorf("%w: %v", errInvalidInfo, err)
+			}
+		}
+	}
+
+	if !fs.ValidPath(name) || name == "." || t.IsZero() {
+		return "", time.Time{}, errInvalidInfo
+	}
+	return name, t, nil
+}
+
+// List returns all trashed entries ordered by deletion time.
+func (fsys *trashfs) List() ([]Entry, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	return fsys.list()
+}
+
+// list implements List. Info files that are malformed or do not describe a
+// trashed entry are skipped. It must be called with fsys.mu held.
+func (fsys *trashfs) list() ([]Entry, error) {
+	ids, err := fsys.ids()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(ids))
+	for _, id := range ids {
+		e, err := fsys.entry(id)
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, errInvalidInfo) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].DeletionTime.Before(entries[j].DeletionTime) })
+
+	return entries, nil
+}
+
+// ids returns the IDs of all info files. It must be called with fsys.mu
+// held.
+func (fsys *trashfs) ids() ([]string, error) {
+	infos, err := fs.ReadDir(fsys.backing, path.Join(fsys.dir, infoDir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(infos))
+	for _, i := range infos {
+		if id, ok := strings.CutSuffix(i.Name(), infoSuffix); ok && i.Type().IsRegular() {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// entry returns the trashed entry id. It must be called with fsys.mu held.
+func (fsys *trashfs) entry(id string) (Entry, error) {
+	if id == "" || strings.Contains(id, "/") || id == "." || id == ".." {
+		return Entry{}, wrapfs.PathError("restore", id, fs.ErrNotExist)
+	}
+
+	data, err := fs.ReadFile(fsys.backing, fsys.infoPath(id))
+	if err != nil {
+		return Entry{}, err
+	}
+
+	name, t, err := parseInfo(data)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	info, err := linkutil.Lstat(fsys.backing, fsys.filesPath(id))
+	if err != nil {
+		return Entry{}, err
+	}
+
+	e := Entry{
+		ID:           id,
+		Path:         name,
+		DeletionTime: t,
+		Mode:         info.Mode(),
+	}
+	if info.Mode().IsRegular() {
+		e.Size = info.Size()
+	}
+	return e, nil
+}
+
+// Restore moves the trashed entry id back to its original path.
+func (fsys *trashfs) Restore(id string, c Conflict) (string, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	e, err := fsys.entry(id)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", wrapfs.PathError("restore", id, fs.ErrNotExist)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if fsys.hidden(e.Path) || fsys.encloses(e.Path) {
+		return "", wrapfs.PathError("restore", e.Path, fs.ErrPermission)
+	}
+
+	target := e.Path
+	exists, err := fsys.exists(target)
+	if err != nil {
+		return "", err
+	}
+
+	if exists {
+		switch c {
+		case Replace:
+			if err := fsys.trash(target); err != nil {
+				return "", err
+			}
+		case Rename:
+			if target, err = fsys.freeName(target); err != nil {
+				return "", err
+			}
+		default:
+			return "", wrapfs.PathError("restore", target, fs.ErrExist)
+		}
+	}
+
+	if err := fsx.MkdirAll(fsys.backing, path.Dir(target), 0755); err != nil {
+		return "", err
+	}
+
+	if err := fsys.backing.Rename(fsys.filesPath(id), target); err != nil {
+		return "", err
+	}
+
+	if err := fsys.backing.Remove(fsys.infoPath(id)); err != nil {
+		return target, err
+	}
+	return target, nil
+}
+
+// freeName returns an unused path derived from name by appending a counter
+// to the name's stem. It must be called with fsys.mu held.
+func (fsys *trashfs) freeName(name string) (string, error) {
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	if ext == name || strings.HasSuffix(stem, "/") {
+		// Names like ".profile" have no extension.
+		stem, ext = name, ""
+	}
+
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", stem, i, ext)
+
+		exists, err := fsys.exists(candidate)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return candidate, nil
+		}
+	}
+}
+
+// Purge permanently removes all entries trashed at least olderThan ago. Info
+// files whose entry is missing are removed as well. Malformed info files and
+// their entries are only removed when emptying the trash.
+func (fsys *trashfs) Purge(olderThan time.Duration) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	ids, err := fsys.ids()
+	if err != nil {
+		return err
+	}
+
+	cutoff := fsys.now().Add(-olderThan)
+	for _, id := range ids {
+		e, err := fsys.entry(id)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			// The info file describes no trashed entry.
+		case errors.Is(err, errInvalidInfo):
+			if olderThan > 0 {
+				continue
+			}
+		case err != nil:
+			return err
+		case e.DeletionTime.After(cutoff):
+			continue
+		}
+
+		if err := fsx.RemoveAll(fsys.backing, fsys.filesPath(id)); err != nil {
+			return err
+		}
+		if err := fsys.backing.Remove(fsys.infoPath(id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,272 @@
+package trashfs
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	. "github.com/halimath/fixture"
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/memfs"
+	"github.com/halimath/fsx/osfs"
+)
+
+type trashfsFixture struct {
+	backing fsx.LinkFS
+	fs      FS
+	now     time.Time
+}
+
+func (f *trashfsFixture) BeforeEach(t *testing.T) error {
+	f.backing = memfs.New()
+
+	if err := fsx.MkdirAll(f.backing, "docs/drafts", 0755); err != nil {
+		return err
+	}
+	if err := fsx.WriteFile(f.backing, "docs/report.txt", []byte("report"), 0644); err != nil {
+		return err
+	}
+	if err := fsx.WriteFile(f.backing, "docs/drafts/draft.txt", []byte("draft"), 0644); err != nil {
+		return err
+	}
+
+	var err error
+	f.fs, err = New(f.backing)
+	if err != nil {
+		return err
+	}
+
+	f.now = time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	f.fs.(*trashfs).now = func() time.Time { return f.now }
+
+	return nil
+}
+
+// list returns the trashed entries expecting no error.
+func (f *trashfsFixture) list(t *testing.T) []Entry {
+	t.Helper()
+
+	entries, err := f.fs.List()
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	return entries
+}
+
+// expectContent expects name to contain want.
+func (f *trashfsFixture) expectContent(t *testing.T, name, want string) {
+	t.Helper()
+
+	data, err := f.fs.ReadFile(name)
+	expect.That(t, is.NoError(err), is.EqualTo(string(data), want))
+}
+
+func TestTrashFS(t *testing.T) {
+	With(t, new(trashfsFixture)).
+		Run("remove", func(t *testing.T, f *trashfsFixture) {
+			expect.That(t, is.NoError(f.fs.Remove("docs/report.txt")))
+
+			_, err := f.fs.Stat("docs/report.txt")
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+
+			entries := f.list(t)
+			expect.That(t, is.DeepEqualTo(entries, []Entry{{
+				ID:           "report.txt",
+				Path:         "docs/report.txt",
+				DeletionTime: f.now,
+				Mode:         0644,
+				Size:         6,
+			}}))
+
+			expect.That(t,
+				is.Error(f.fs.Remove("docs/drafts"), fsx.ErrDirNotEmpty),
+				is.Error(f.fs.Remove("docs/missing"), fs.ErrNotExist),
+			)
+		}).
+		Run("removeAll", func(t *testing.T, f *trashfsFixture) {
+			expect.That(t,
+				is.NoError(f.fs.RemoveAll("docs/drafts")),
+				is.NoError(f.fs.RemoveAll("docs/missing")),
+			)
+
+			entries := f.list(t)
+			expect.That(t,
+				expect.FailNow(is.EqualTo(len(entries), 1)),
+				is.EqualTo(entries[0].Path, "docs/drafts"),
+				is.EqualTo(entries[0].Mode.IsDir(), true),
+			)
+
+			// Removing everything moves each child into the trash.
+			expect.That(t, is.NoError(f.fs.RemoveAll(".")))
+
+			root, err := f.fs.ReadDir(".")
+			expect.That(t, is.NoError(err), is.EqualTo(len(root), 0))
+			expect.That(t, is.EqualTo(len(f.list(t)), 2))
+		}).
+		Run("uniqueIDs", func(t *testing.T, f *trashfsFixture) {
+			expect.That(t, is.NoError(f.fs.Remove("docs/report.txt")))
+			f.now = f.now.Add(time.Second)
+			expect.That(t, is.NoError(fsx.WriteFile(f.fs, "docs/report.txt", []byte("report 2"), 0644)))
+			expect.That(t, is.NoError(f.fs.Remove("docs/report.txt")))
+
+			entries := f.list(t)
+			expect.That(t,
+				expect.FailNow(is.EqualTo(len(entries), 2)),
+				is.EqualTo(entries[0].ID, "report.txt"),
+				is.EqualTo(entries[1].ID, "report.txt.2"),
+				is.EqualTo(entries[1].Size, int64(8)),
+			)
+		}).
+		Run("restore", func(t *testing.T, f *trashfsFixture) {
+			expect.That(t, is.NoError(f.fs.RemoveAll("docs")))
+
+			restored, err := f.fs.Restore("docs", Fail)
+			expect.That(t, is.NoError(err), is.EqualTo(restored, "docs"))
+			f.expectContent(t, "docs/drafts/draft.txt", "draft")
+			expect.That(t, is.EqualTo(len(f.list(t)), 0))
+
+			_, err = f.fs.Restore("docs", Fail)
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+			_, err = f.fs.Restore("../docs", Fail)
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+		}).
+		Run("restoreMissingParent", func(t *testing.T, f *trashfsFixture) {
+			expect.That(t, is.NoError(f.fs.Remove("docs/drafts/draft.txt")))
+			expect.That(t, is.NoError(f.fs.RemoveAll("docs")))
+
+			restored, err := f.fs.Restore("draft.txt", Fail)
+			expect.That(t, is.NoError(err), is.EqualTo(restored, "docs/drafts/draft.txt"))
+			f.expectContent(t, "docs/drafts/draft.txt", "draft")
+		}).
+		Run("restoreConflict", func(t *testing.T, f *trashfsFixture) {
+			expect.That(t, is.NoError(f.fs.Remove("docs/report.txt")))
+			expect.That(t, is.NoError(fsx.WriteFile(f.fs, "docs/report.txt", []byte("new"), 0644)))
+
+			_, err := f.fs.Restore("report.txt", Fail)
+			expect.That(t, is.Error(err, fs.ErrExist))
+			f.expectContent(t, "docs/report.txt", "new")
+
+			restored, err := f.fs.Restore("report.txt", Rename)
+			expect.That(t, is.NoError(err), is.EqualTo(restored, "docs/report (1).txt"))
+			f.expectContent(t, "docs/report (1).txt", "report")
+			f.expectContent(t, "docs/report.txt", "new")
+
+			// Replacing moves the existing file into the trash.
+			expect.That(t, is.NoError(f.fs.Remove("docs/report (1).txt")))
+			restored, err = f.fs.Restore("report (1).txt", Replace)
+			expect.That(t, is.NoError(err), is.EqualTo(restored, "docs/report (1).txt"))
+
+			entries := f.list(t)
+			expect.That(t, expect.FailNow(is.EqualTo(len(entries), 0)))
+
+			expect.That(t, is.NoError(f.fs.Remove("docs/report (1).txt")))
+			expect.That(t, is.NoError(fsx.WriteFile(f.fs, "docs/report (1).txt", []byte("other"), 0644)))
+			_, err = f.fs.Restore("report (1).txt", Replace)
+			expect.That(t, is.NoError(err))
+			f.expectContent(t, "docs/report (1).txt", "report")
+
+			entries = f.list(t)
+			expect.That(t,
+				expect.FailNow(is.EqualTo(len(entries), 1)),
+				is.EqualTo(entries[0].Path, "docs/report (1).txt"),
+				is.EqualTo(entries[0].Size, int64(5)),
+			)
+		}).
+		Run("purge", func(t *testing.T, f *trashfsFixture) {
+			expect.That(t, is.NoError(f.fs.Remove("docs/report.txt")))
+			f.now = f.now.Add(time.Hour)
+			expect.That(t, is.NoError(f.fs.RemoveAll("docs/drafts")))
+			f.now = f.now.Add(time.Minute)
+
+			expect.That(t, is.NoError(f.fs.Purge(time.Hour)))
+
+			entries := f.list(t)
+			expect.That(t,
+				expect.FailNow(is.EqualTo(len(entries), 1)),
+				is.EqualTo(entries[0].Path, "docs/drafts"),
+			)
+
+			expect.That(t, is.NoError(f.fs.Purge(0)))
+			expect.That(t, is.EqualTo(len(f.list(t)), 0))
+
+			files, err := fs.ReadDir(f.backing, DefaultTrashDir+"/files")
+			expect.That(t, is.NoError(err), is.EqualTo(len(files), 0))
+		}).
+		Run("malformedInfo", func(t *testing.T, f *trashfsFixture) {
+			expect.That(t, is.NoError(f.fs.Remove("docs/report.txt")))
+
+			info := DefaultTrashDir + "/info/"
+			expect.That(t,
+				is.NoError(fsx.WriteFile(f.backing, info+"broken.trashinfo", []byte("garbage"), 0600)),
+				is.NoError(fsx.WriteFile(f.backing, DefaultTrashDir+"/files/broken", []byte("broken"), 0600)),
+				is.NoError(fsx.WriteFile(f.backing, info+"orphan.trashinfo", formatInfo("orphan", f.now), 0600)),
+			)
+
+			entries := f.list(t)
+			expect.That(t, expect.FailNow(is.EqualTo(len(entries), 1)), is.EqualTo(entries[0].Path, "docs/report.txt"))
+
+			expect.That(t, is.NoError(f.fs.Purge(time.Hour)))
+			_, err := fs.Stat(f.backing, info+"orphan.trashinfo")
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+			_, err = fs.Stat(f.backing, info+"broken.trashinfo")
+			expect.That(t, is.NoError(err))
+
+			expect.That(t, is.NoError(f.fs.Purge(0)))
+			for _, dir := range []string{"files", "info"} {
+				names, err := fs.ReadDir(f.backing, DefaultTrashDir+"/"+dir)
+				expect.That(t, is.NoError(err), is.EqualTo(len(names), 0))
+			}
+		}).
+		Run("hidden", func(t *testing.T, f *trashfsFixture) {
+			expect.That(t, is.NoError(f.fs.Remove("docs/report.txt")))
+
+			_, err := f.fs.Stat(DefaultTrashDir)
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+			expect.That(t,
+				is.Error(f.fs.RemoveAll(DefaultTrashDir), fs.ErrNotExist),
+				is.Error(f.fs.Rename(DefaultTrashDir+"/files/report.txt", "report.txt"), fs.ErrNotExist),
+			)
+
+			entries, err := f.fs.ReadDir(".")
+			expect.That(t, is.NoError(err), is.EqualTo(len(entries), 1), is.EqualTo(entries[0].Name(), "docs"))
+		})
+}
+
+func TestNew(t *testing.T) {
+	for _, opts := range [][]Option{
+		{WithTrashDir(".")},
+		{WithTrashDir("trash/")},
+	} {
+		_, err := New(memfs.New(), opts...)
+		expect.That(t, is.EqualTo(err != nil, true))
+	}
+}
+
+func TestOSFS(t *testing.T) {
+	fsys, err := New(osfs.DirFS(t.TempDir()), WithTrashDir("home/.local/share/Trash"))
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	expect.That(t,
+		is.NoError(fsx.MkdirAll(fsys, "home/docs", 0755)),
+		is.NoError(fsx.WriteFile(fsys, "home/docs/a.txt", []byte("a"), 0644)),
+		is.NoError(fsys.Symlink("home/docs/a.txt", "home/link")),
+	)
+
+	expect.That(t, is.NoError(fsys.RemoveAll("home")))
+	expect.That(t, is.NoError(fstest.TestFS(fsys, "home")))
+
+	entries, err := fsys.List()
+	expect.That(t, expect.FailNow(is.NoError(err)), expect.FailNow(is.EqualTo(len(entries), 2)))
+
+	for _, e := range entries {
+		_, err := fsys.Restore(e.ID, Fail)
+		expect.That(t, is.NoError(err))
+	}
+
+	target, err := fsys.Readlink("home/link")
+	expect.That(t, is.NoError(err), is.EqualTo(target, "home/docs/a.txt"))
+
+	data, err := fsys.ReadFile("home/link")
+	expect.That(t, is.NoError(err), is.EqualTo(string(data), "a"))
+}
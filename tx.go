@@ -0,0 +1,1141 @@
+package fsx
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/halimath/fsx/internal/linkutil"
+)
+
+var (
+	// ErrConflict is returned by Tx.Commit if an entry read or modified by
+	// the transaction has been changed in the target filesystem after the
+	// transaction observed it.
+	ErrConflict = errors.New("transaction conflict")
+
+	// ErrTxDone is returned by operations performed on a transaction that
+	// has already been committed or rolled back.
+	ErrTxDone = errors.New("transaction has already been committed or rolled back")
+)
+
+// Tx implements a transaction staging modifications of a target FS. A Tx
+// satisfies FS; all modifications are staged in memory and are visible to
+// reads performed through the Tx but not to the target. Commit applies all
+// staged modifications to the target; Rollback discards them.
+//
+// Content read through a Tx is served from the target until it is modified.
+// Every entry observed by the transaction is recorded with its type, size and
+// modification time. Commit fails with an error wrapping ErrConflict if any
+// of these entries has been changed in the target since then, or if an entry
+// observed as missing has been created. The names contained in directories
+// read or removed by the transaction are recorded as well, so Commit also
+// fails if such a directory has gained or lost entries.
+//
+// Commit replays the staged operations in the order they have been
+// performed. File contents are written to a staging directory in the
+// target's root first and renamed into place afterwards. Removed and
+// replaced entries are renamed into the staging directory as well, so a
+// failing operation allows Commit to revert all operations applied so far.
+// Thus, the target needs to support renaming entries between directories.
+//
+// Symlinks and hard links can not be created inside a Tx. Writes to a file
+// are staged when the file is closed; Commit fails if files are still open.
+type Tx struct {
+	target FS
+
+	mu       sync.Mutex
+	root     *txNode
+	ops      []txOp
+	observed map[string]fs.FileInfo
+	listed   map[string]map[string]bool
+	open     int
+	done     bool
+}
+
+// Begin starts a transaction staging modifications to fsys.
+func Begin(fsys FS) *Tx {
+	return &Tx{
+		target:   fsys,
+		root:     &txNode{mode: fs.ModeDir | 0755, base: "."},
+		observed: make(map[string]fs.FileInfo),
+		listed:   make(map[string]map[string]bool),
+	}
+}
+
+// txOpKind defines the kind of a staged operation.
+type txOpKind int
+
+const (
+	txMkdir txOpKind = iota + 1
+	txWrite
+	txRemove
+	txRename
+	txChmod
+)
+
+// txOp describes a staged operation replayed by Commit.
+type txOp struct {
+	kind    txOpKind
+	path    string
+	newpath string
+	perm    fs.FileMode
+	data    []byte
+}
+
+// txNode describes an entry of the staged tree. Nodes are created from the
+// target when a directory's children are accessed for the first time.
+type txNode struct {
+	name    string
+	parent  *txNode
+	mode    fs.FileMode
+	modTime time.Time
+	size    int64
+
+	// base contains the path of the target entry providing the node's
+	// content or children; it is empty for entries created by the Tx.
+	base string
+	// baseInfo describes the target entry at the time it has been read.
+	baseInfo fs.FileInfo
+
+	// data contains the staged content of regular files if staged is true.
+	data   []byte
+	staged bool
+
+	// children contains the node's children or nil if they have not been
+	// read from base yet. baseNames contains the names of the children
+	// found in base.
+	children  map[string]*txNode
+	baseNames map[string]bool
+}
+
+// path returns n's path and true if n is attached to root.
+func (n *txNode) path(root *txNode) (string, bool) {
+	if n == root {
+		return ".", true
+	}
+
+	var segments []string
+	m := n
+	for ; m.parent != nil; m = m.parent {
+		segments = append(segments, m.name)
+	}
+	if m != root {
+		return "", false
+	}
+
+	for i, j := 0, len(segments)-1; i < j; i, j = i+1, j-1 {
+		segments[i], segments[j] = segments[j], segments[i]
+	}
+	return strings.Join(segments, "/"), true
+}
+
+func (n *txNode) info() fs.FileInfo {
+	size := n.size
+	if n.staged {
+		size = int64(len(n.data))
+	}
+	name := n.name
+	if name == "" {
+		name = "."
+	}
+	return &txFileInfo{name: name, size: size, mode: n.mode, modTime: n.modTime, node: n}
+}
+
+type txFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+	node    *txNode
+}
+
+func (i *txFileInfo) Name() string       { return i.name }
+func (i *txFileInfo) Size() int64        { return i.size }
+func (i *txFileInfo) Mode() fs.FileMode  { return i.mode }
+func (i *txFileInfo) ModTime() time.Time { return i.modTime }
+func (i *txFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *txFileInfo) Sys() any           { return nil }
+
+func txPathError(op, name string, err error) error {
+	return &fs.PathError{
+		Op:   op,
+		Path: name,
+		Err:  err,
+	}
+}
+
+// begin locks tx and checks name. It returns an error if tx is done or name
+// is invalid. If begin returns nil, the caller must unlock tx.mu.
+func (tx *Tx) begin(op, name string) error {
+	if !fs.ValidPath(name) {
+		return txPathError(op, name, fs.ErrInvalid)
+	}
+
+	tx.mu.Lock()
+	if tx.done {
+		tx.mu.Unlock()
+		return txPathError(op, name, ErrTxDone)
+	}
+	return nil
+}
+
+// children returns n's children reading them from the target if necessary.
+// It must be called with tx.mu held.
+func (tx *Tx) children(n *txNode) (map[string]*txNode, error) {
+	if n.children != nil {
+		return n.children, nil
+	}
+
+	children := make(map[string]*txNode)
+	n.baseNames = make(map[string]bool)
+
+	if n.base != "" {
+		entries, err := fs.ReadDir(tx.target, n.base)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil {
+				return nil, err
+			}
+
+			children[e.Name()] = &txNode{
+				name:     e.Name(),
+				parent:   n,
+				mode:     info.Mode(),
+				modTime:  info.ModTime(),
+				size:     info.Size(),
+				base:     path.Join(n.base, e.Name()),
+				baseInfo: info,
+			}
+			n.baseNames[e.Name()] = true
+		}
+	}
+
+	n.children = children
+	return children, nil
+}
+
+// lookup returns the node for name or nil if name does not exist. The
+// node's target entry (or its absence) is recorded for conflict detection.
+// It must be called with tx.mu held.
+func (tx *Tx) lookup(name string) (*txNode, error) {
+	n := tx.root
+	if name != "." {
+		for _, seg := range strings.Split(name, "/") {
+			if !n.mode.IsDir() {
+				return nil, nil
+			}
+
+			children, err := tx.children(n)
+			if err != nil {
+				return nil, err
+			}
+
+			c, ok := children[seg]
+			if !ok {
+				if n.base != "" && !n.baseNames[seg] {
+					tx.observe(path.Join(n.base, seg), nil)
+				}
+				return nil, nil
+			}
+			n = c
+		}
+	}
+
+	if n.baseInfo != nil && !n.staged {
+		tx.observe(n.base, n.baseInfo)
+	}
+	return n, nil
+}
+
+// observe records info as the state of the target entry name unless name
+// has already been observed. A nil info records name as missing.
+func (tx *Tx) observe(name string, info fs.FileInfo) {
+	if _, ok := tx.observed[name]; !ok {
+		tx.observed[name] = info
+	}
+}
+
+// observeListing records the names found in the target directory providing
+// n's children unless they have already been recorded. It must be called
+// with tx.mu held.
+func (tx *Tx) observeListing(n *txNode) error {
+	if _, err := tx.children(n); err != nil {
+		return err
+	}
+	if n.base == "" {
+		return nil
+	}
+	if _, ok := tx.listed[n.base]; !ok {
+		tx.listed[n.base] = n.baseNames
+	}
+	return nil
+}
+
+// observeTree records n and all of its descendants read from the target, so
+// that removing n does not silently remove entries created or changed
+// concurrently. It must be called with tx.mu held.
+func (tx *Tx) observeTree(n *txNode) error {
+	if n.baseInfo != nil && !n.staged {
+		tx.observe(n.base, n.baseInfo)
+	}
+	if !n.mode.IsDir() {
+		return nil
+	}
+
+	if err := tx.observeListing(n); err != nil {
+		return err
+	}
+	for _, c := range n.children {
+		if err := tx.observeTree(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupDir returns the node of the directory name or an error.
+func (tx *Tx) lookupDir(op, name string) (*txNode, error) {
+	n, err := tx.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if n == nil {
+		return nil, txPathError(op, name, fs.ErrNotExist)
+	}
+	if !n.mode.IsDir() {
+		return nil, txPathError(op, name, fs.ErrInvalid)
+	}
+	return n, nil
+}
+
+// attach adds n as a child named name to dir. It must be called with tx.mu
+// held.
+func (tx *Tx) attach(dir *txNode, name string, n *txNode) error {
+	children, err := tx.children(dir)
+	if err != nil {
+		return err
+	}
+
+	n.name = name
+	n.parent = dir
+	children[name] = n
+	return nil
+}
+
+// detach removes n from its parent.
+func detach(n *txNode) {
+	delete(n.parent.children, n.name)
+	n.parent = nil
+}
+
+// --
+
+// Open opens the named file or directory for reading.
+func (tx *Tx) Open(name string) (fs.File, error) {
+	if err := tx.begin("open", name); err != nil {
+		return nil, err
+	}
+	defer tx.mu.Unlock()
+
+	n, err := tx.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if n == nil {
+		return nil, txPathError("open", name, fs.ErrNotExist)
+	}
+
+	if n.mode.IsDir() {
+		return tx.openDir(name, n)
+	}
+
+	if !n.staged && n.base != "" {
+		return tx.target.Open(n.base)
+	}
+
+	return &txFile{tx: tx, node: n, name: name, buf: n.data, readable: true}, nil
+}
+
+// openDir opens the directory n for reading. It must be called with tx.mu
+// held.
+func (tx *Tx) openDir(name string, n *txNode) (fs.File, error) {
+	entries, err := tx.readDir(n)
+	if err != nil {
+		return nil, err
+	}
+	return &txDir{info: n.info(), name: name, entries: entries}, nil
+}
+
+// readDir returns n's children sorted by name. It must be called with tx.mu
+// held.
+func (tx *Tx) readDir(n *txNode) ([]fs.DirEntry, error) {
+	if err := tx.observeListing(n); err != nil {
+		return nil, err
+	}
+	children := n.children
+
+	entries := make([]fs.DirEntry, 0, len(children))
+	for _, c := range children {
+		entries = append(entries, fs.FileInfoToDirEntry(c.info()))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	return entries, nil
+}
+
+// OpenFile opens the named file. Content written to the file is staged when
+// the file is closed.
+func (tx *Tx) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	if err := tx.begin("OpenFile", name); err != nil {
+		return nil, err
+	}
+	defer tx.mu.Unlock()
+
+	writable := flag&(O_WRONLY|O_RDWR) != 0
+
+	n, err := tx.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if n != nil {
+		if flag&O_CREATE != 0 && flag&O_EXCL != 0 {
+			return nil, txPathError("OpenFile", name, fs.ErrExist)
+		}
+		if n.mode.IsDir() {
+			return nil, txPathError("OpenFile", name, fs.ErrInvalid)
+		}
+		if !writable && flag&O_TRUNC == 0 && !n.staged && n.base != "" {
+			return tx.target.OpenFile(n.base, flag, 0)
+		}
+
+		f := &txFile{tx: tx, node: n, name: name, readable: flag&O_WRONLY == 0, writable: writable, append: flag&O_APPEND != 0}
+		if flag&O_TRUNC != 0 {
+			f.dirty = true
+		} else if n.staged {
+			f.buf = append([]byte(nil), n.data...)
+		} else if f.buf, err = fs.ReadFile(tx.target, n.base); err != nil {
+			return nil, err
+		}
+
+		if f.writable {
+			tx.open++
+		}
+		return f, nil
+	}
+
+	if flag&O_CREATE == 0 {
+		return nil, txPathError("OpenFile", name, fs.ErrNotExist)
+	}
+
+	dirName, fileName := split(name)
+	if dirName == "" {
+		dirName = "."
+	}
+
+	dir, err := tx.lookupDir("OpenFile", dirName)
+	if err != nil {
+		return nil, err
+	}
+
+	n = &txNode{mode: perm.Perm(), modTime: time.Now(), staged: true}
+	if err := tx.attach(dir, fileName, n); err != nil {
+		return nil, err
+	}
+
+	// The file is created immediately, so that operations performed
+	// before closing the file are replayed on an existing file.
+	tx.ops = append(tx.ops, txOp{kind: txWrite, path: name, perm: perm.Perm()})
+
+	tx.open++
+	return &txFile{tx: tx, node: n, name: name, readable: flag&O_WRONLY == 0, writable: true, append: flag&O_APPEND != 0}, nil
+}
+
+// ReadFile reads the named file.
+func (tx *Tx) ReadFile(name string) ([]byte, error) {
+	f, err := tx.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return io.ReadAll(f)
+}
+
+// Stat returns a fs.FileInfo describing the named file.
+func (tx *Tx) Stat(name string) (fs.FileInfo, error) {
+	if err := tx.begin("stat", name); err != nil {
+		return nil, err
+	}
+	defer tx.mu.Unlock()
+
+	n, err := tx.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if n == nil {
+		return nil, txPathError("stat", name, fs.ErrNotExist)
+	}
+	return n.info(), nil
+}
+
+// ReadDir reads the named directory.
+func (tx *Tx) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := tx.begin("readdir", name); err != nil {
+		return nil, err
+	}
+	defer tx.mu.Unlock()
+
+	n, err := tx.lookupDir("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	return tx.readDir(n)
+}
+
+// Mkdir stages the creation of the named directory.
+func (tx *Tx) Mkdir(name string, perm fs.FileMode) error {
+	if err := tx.begin("Mkdir", name); err != nil {
+		return err
+	}
+	defer tx.mu.Unlock()
+
+	n, err := tx.lookup(name)
+	if err != nil {
+		return err
+	}
+	if n != nil {
+		return txPathError("Mkdir", name, fs.ErrExist)
+	}
+
+	dirName, base := split(name)
+	if dirName == "" {
+		dirName = "."
+	}
+
+	dir, err := tx.lookupDir("Mkdir", dirName)
+	if err != nil {
+		return err
+	}
+
+	n = &txNode{mode: fs.ModeDir | perm.Perm(), modTime: time.Now(), children: make(map[string]*txNode)}
+	if err := tx.attach(dir, base, n); err != nil {
+		return err
+	}
+
+	tx.ops = append(tx.ops, txOp{kind: txMkdir, path: name, perm: perm})
+	return nil
+}
+
+// Remove stages the removal of the named file or empty directory.
+func (tx *Tx) Remove(name string) error {
+	if err := tx.begin("Remove", name); err != nil {
+		return err
+	}
+	defer tx.mu.Unlock()
+
+	if name == "." {
+		return txPathError("Remove", name, fs.ErrInvalid)
+	}
+
+	n, err := tx.lookup(name)
+	if err != nil {
+		return err
+	}
+	if n == nil {
+		return txPathError("Remove", name, fs.ErrNotExist)
+	}
+
+	if n.mode.IsDir() {
+		if err := tx.observeListing(n); err != nil {
+			return err
+		}
+		if len(n.children) > 0 {
+			return txPathError("Remove", name, ErrDirNotEmpty)
+		}
+	}
+
+	detach(n)
+	tx.ops = append(tx.ops, txOp{kind: txRemove, path: name})
+	return nil
+}
+
+// RemoveAll stages the removal of name and all of its children.
+func (tx *Tx) RemoveAll(name string) error {
+	if err := tx.begin("RemoveAll", name); err != nil {
+		return err
+	}
+	defer tx.mu.Unlock()
+
+	n, err := tx.lookup(name)
+	if err != nil || n == nil {
+		return err
+	}
+
+	if err := tx.observeTree(n); err != nil {
+		return err
+	}
+
+	if name != "." {
+		detach(n)
+		tx.ops = append(tx.ops, txOp{kind: txRemove, path: name})
+		return nil
+	}
+
+	children := n.children
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		detach(children[name])
+		tx.ops = append(tx.ops, txOp{kind: txRemove, path: name})
+	}
+	return nil
+}
+
+// Rename stages renaming oldpath to newpath. An existing file or empty
+// directory at newpath is replaced.
+func (tx *Tx) Rename(oldpath, newpath string) error {
+	if !fs.ValidPath(newpath) {
+		return txPathError("Rename", newpath, fs.ErrInvalid)
+	}
+	if err := tx.begin("Rename", oldpath); err != nil {
+		return err
+	}
+	defer tx.mu.Unlock()
+
+	if oldpath == "." || newpath == "." || strings.HasPrefix(newpath, oldpath+"/") {
+		return txPathError("Rename", newpath, fs.ErrInvalid)
+	}
+
+	src, err := tx.lookup(oldpath)
+	if err != nil {
+		return err
+	}
+	if src == nil {
+		return txPathError("Rename", oldpath, fs.ErrNotExist)
+	}
+
+	if oldpath == newpath {
+		return nil
+	}
+
+	dst, err := tx.lookup(newpath)
+	if err != nil {
+		return err
+	}
+	if dst != nil {
+		if dst.mode.IsDir() != src.mode.IsDir() {
+			return txPathError("Rename", newpath, fs.ErrExist)
+		}
+		if dst.mode.IsDir() {
+			children, err := tx.children(dst)
+			if err != nil {
+				return err
+			}
+			if len(children) > 0 {
+				return txPathError("Rename", newpath, ErrDirNotEmpty)
+			}
+		}
+	}
+
+	dirName, base := split(newpath)
+	if dirName == "" {
+		dirName = "."
+	}
+
+	dir, err := tx.lookupDir("Rename", dirName)
+	if err != nil {
+		return err
+	}
+
+	if dst != nil {
+		detach(dst)
+	}
+	detach(src)
+	if err := tx.attach(dir, base, src); err != nil {
+		return err
+	}
+
+	tx.ops = append(tx.ops, txOp{kind: txRename, path: oldpath, newpath: newpath})
+	return nil
+}
+
+// Chmod stages changing the mode of the named file.
+func (tx *Tx) Chmod(name string, mode fs.FileMode) error {
+	if err := tx.begin("Chmod", name); err != nil {
+		return err
+	}
+	defer tx.mu.Unlock()
+
+	n, err := tx.lookup(name)
+	if err != nil {
+		return err
+	}
+	if n == nil {
+		return txPathError("Chmod", name, fs.ErrNotExist)
+	}
+
+	tx.chmod(n, mode)
+	return nil
+}
+
+// chmod changes n's mode and stages the change if n is attached. It must be
+// called with tx.mu held.
+func (tx *Tx) chmod(n *txNode, mode fs.FileMode) {
+	n.mode = n.mode.Type() | mode.Perm()
+	if p, ok := n.path(tx.root); ok {
+		tx.ops = append(tx.ops, txOp{kind: txChmod, path: p, perm: mode.Perm()})
+	}
+}
+
+// SameFile reports whether fi1 and fi2 describe the same entry of tx.
+func (tx *Tx) SameFile(fi1, fi2 fs.FileInfo) bool {
+	i1, ok1 := fi1.(*txFileInfo)
+	i2, ok2 := fi2.(*txFileInfo)
+	return ok1 && ok2 && i1.node == i2.node
+}
+
+// --
+
+// Rollback discards all staged modifications.
+func (tx *Tx) Rollback() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return ErrTxDone
+	}
+
+	tx.done = true
+	tx.root = nil
+	tx.ops = nil
+	return nil
+}
+
+// Commit applies all staged modifications to the target. If an entry
+// observed by the transaction has been changed in the target, Commit fails
+// with an error wrapping ErrConflict without modifying the target. If
+// applying an operation fails, all operations applied so far are reverted.
+// If reverting fails as well, the returned error joins the errors of applying
+// and reverting and the staging directory containing the backups of replaced
+// entries is kept. The transaction is done after Commit returns, even if
+// Commit fails.
+func (tx *Tx) Commit() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return ErrTxDone
+	}
+	if tx.open > 0 {
+		return fmt.Errorf("fsx: cannot commit transaction with %d open files", tx.open)
+	}
+
+	tx.done = true
+
+	if len(tx.ops) == 0 {
+		return nil
+	}
+
+	if err := tx.checkConflicts(); err != nil {
+		return err
+	}
+
+	staging, err := tx.createStaging()
+	if err != nil {
+		return err
+	}
+
+	// The staging directory holds backups of replaced entries; it is kept
+	// if reverting fails so they can be recovered.
+	reverted := true
+	defer func() {
+		if reverted {
+			RemoveAll(tx.target, staging)
+		}
+	}()
+
+	for i, op := range tx.ops {
+		if op.kind != txWrite {
+			continue
+		}
+
+		tmp := stagingPath(staging, "w", i)
+		if err := WriteFile(tx.target, tmp, op.data, op.perm); err != nil {
+			return err
+		}
+		if err := Chmod(tx.target, tmp, op.perm); err != nil {
+			return err
+		}
+	}
+
+	var undo []func() error
+	for i, op := range tx.ops {
+		u, err := tx.apply(staging, i, op)
+		if err != nil {
+			errs := []error{err}
+			for j := len(undo) - 1; j >= 0; j-- {
+				if err := undo[j](); err != nil {
+					errs = append(errs, err)
+				}
+			}
+			reverted = len(errs) == 1
+			return errors.Join(errs...)
+		}
+		undo = append(undo, u)
+	}
+
+	return nil
+}
+
+// checkConflicts compares all observed entries and directory listings with
+// their current state in the target. It must be called with tx.mu held.
+func (tx *Tx) checkConflicts() error {
+	names := make([]string, 0, len(tx.observed))
+	for name := range tx.observed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		want := tx.observed[name]
+		got, err := linkutil.Lstat(tx.target, name)
+
+		switch {
+		case want == nil && errors.Is(err, fs.ErrNotExist):
+			continue
+		case want == nil:
+			return txPathError("commit", name, ErrConflict)
+		case err != nil:
+			if errors.Is(err, fs.ErrNotExist) {
+				return txPathError("commit", name, ErrConflict)
+			}
+			return err
+		case got.Mode().Type() != want.Mode().Type():
+			return txPathError("commit", name, ErrConflict)
+		case !want.IsDir() && (got.Size() != want.Size() || !got.ModTime().Equal(want.ModTime())):
+			return txPathError("commit", name, ErrConflict)
+		}
+	}
+
+	dirs := make([]string, 0, len(tx.listed))
+	for dir := range tx.listed {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	for _, dir := range dirs {
+		want := tx.listed[dir]
+		entries, err := fs.ReadDir(tx.target, dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			return txPathError("commit", dir, ErrConflict)
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(entries) != len(want) {
+			return txPathError("commit", dir, ErrConflict)
+		}
+		for _, e := range entries {
+			if !want[e.Name()] {
+				return txPathError("commit", dir, ErrConflict)
+			}
+		}
+	}
+
+	return nil
+}
+
+// createStaging creates a uniquely named staging directory in the target's
+// root and returns its name.
+func (tx *Tx) createStaging() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+
+	name := ".fsx-tx-" + hex.EncodeToString(b[:])
+	if err := tx.target.Mkdir(name, 0700); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// stagingPath returns the path of the i-th staging file with the given
+// prefix.
+func stagingPath(staging, prefix string, i int) string {
+	return staging + "/" + prefix + strconv.Itoa(i)
+}
+
+// apply applies op to the target and returns a function reverting it.
+func (tx *Tx) apply(staging string, i int, op txOp) (func() error, error) {
+	t := tx.target
+
+	switch op.kind {
+	case txMkdir:
+		if err := t.Mkdir(op.path, op.perm); err != nil {
+			return nil, err
+		}
+		return func() error { return t.Remove(op.path) }, nil
+
+	case txWrite:
+		return tx.replace(staging, i, stagingPath(staging, "w", i), op.path)
+
+	case txRemove:
+		backup := stagingPath(staging, "b", i)
+		if err := t.Rename(op.path, backup); err != nil {
+			return nil, err
+		}
+		return func() error { return t.Rename(backup, op.path) }, nil
+
+	case txRename:
+		return tx.replace(staging, i, op.path, op.newpath)
+
+	case txChmod:
+		info, err := fs.Stat(t, op.path)
+		if err != nil {
+			return nil, err
+		}
+		if err := Chmod(t, op.path, op.perm); err != nil {
+			return nil, err
+		}
+		return func() error { return Chmod(t, op.path, info.Mode().Perm()) }, nil
+	}
+
+	return nil, fmt.Errorf("fsx: invalid transaction operation: %d", op.kind)
+}
+
+// replace renames src to dst moving an existing dst into the staging
+// directory first. It returns a function reverting the replacement.
+func (tx *Tx) replace(staging string, i int, src, dst string) (func() error, error) {
+	t := tx.target
+
+	backup := ""
+	if _, err := linkutil.Lstat(t, dst); err == nil {
+		backup = stagingPath(staging, "b", i)
+		if err := t.Rename(dst, backup); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := t.Rename(src, dst); err != nil {
+		if backup != "" {
+			if rerr := t.Rename(backup, dst); rerr != nil {
+				return nil, errors.Join(err, rerr)
+			}
+		}
+		return nil, err
+	}
+
+	return func() error {
+		if err := t.Rename(dst, src); err != nil {
+			return err
+		}
+		if backup != "" {
+			return t.Rename(backup, dst)
+		}
+		return nil
+	}, nil
+}
+
+// --
+
+// txFile implements File for files opened through a Tx. The file operates
+// on an in-memory buffer which is staged on Close.
+type txFile struct {
+	tx   *Tx
+	node *txNode
+	name string
+
+	buf                        []byte
+	cursor                     int64
+	readable, writable, append bool
+	dirty, closed              bool
+}
+
+func (f *txFile) pathError(op string, err error) error {
+	return txPathError(op, f.name, err)
+}
+
+func (f *txFile) Stat() (fs.FileInfo, error) {
+	if f.closed {
+		return nil, f.pathError("stat", fs.ErrClosed)
+	}
+
+	f.tx.mu.Lock()
+	defer f.tx.mu.Unlock()
+
+	info := f.node.info().(*txFileInfo)
+	info.size = int64(len(f.buf))
+	return info, nil
+}
+
+func (f *txFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.cursor)
+	f.cursor += int64(n)
+	return n, err
+}
+
+func (f *txFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, f.pathError("read", fs.ErrClosed)
+	}
+	if !f.readable {
+		return 0, f.pathError("read", fs.ErrPermission)
+	}
+	if off >= int64(len(f.buf)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *txFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, f.pathError("write", fs.ErrClosed)
+	}
+	if !f.writable {
+		return 0, f.pathError("write", fs.ErrPermission)
+	}
+
+	if f.append {
+		f.cursor = int64(len(f.buf))
+	}
+
+	end := f.cursor + int64(len(p))
+	if end > int64(len(f.buf)) {
+		f.buf = append(f.buf, make([]byte, end-int64(len(f.buf)))...)
+	}
+	copy(f.buf[f.cursor:], p)
+	f.cursor = end
+	f.dirty = true
+
+	return len(p), nil
+}
+
+func (f *txFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, f.pathError("seek", fs.ErrClosed)
+	}
+
+	switch whence {
+	case SeekWhenceRelativeOrigin:
+	case SeekWhenceRelativeCurrentOffset:
+		offset += f.cursor
+	case SeekWhenceRelativeEnd:
+		offset += int64(len(f.buf))
+	default:
+		return 0, f.pathError("seek", ErrInvalidWhence)
+	}
+
+	if offset < 0 {
+		return 0, f.pathError("seek", fs.ErrInvalid)
+	}
+
+	f.cursor = offset
+	return offset, nil
+}
+
+func (f *txFile) Chmod(mode fs.FileMode) error {
+	if f.closed {
+		return f.pathError("chmod", fs.ErrClosed)
+	}
+
+	f.tx.mu.Lock()
+	defer f.tx.mu.Unlock()
+
+	if f.tx.done {
+		return f.pathError("chmod", ErrTxDone)
+	}
+
+	f.tx.chmod(f.node, mode)
+	return nil
+}
+
+func (f *txFile) Chown(uid, gid int) error { return nil }
+
+// Close stages the file's content if it has been modified.
+func (f *txFile) Close() error {
+	if f.closed {
+		return f.pathError("close", fs.ErrClosed)
+	}
+	f.closed = true
+
+	if !f.writable {
+		return nil
+	}
+
+	f.tx.mu.Lock()
+	defer f.tx.mu.Unlock()
+
+	f.tx.open--
+	if f.tx.done || !f.dirty {
+		return nil
+	}
+
+	f.node.data = f.buf
+	f.node.staged = true
+	f.node.modTime = time.Now()
+
+	if p, ok := f.node.path(f.tx.root); ok {
+		f.tx.ops = append(f.tx.ops, txOp{kind: txWrite, path: p, perm: f.node.mode.Perm(), data: f.buf})
+	}
+	return nil
+}
+
+// txDir implements fs.ReadDirFile for directories opened through a Tx.
+type txDir struct {
+	info    fs.FileInfo
+	name    string
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *txDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+
+func (d *txDir) Read([]byte) (int, error) {
+	return 0, txPathError("read", d.name, fs.ErrInvalid)
+}
+
+func (d *txDir) Close() error { return nil }
+
+func (d *txDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.offset += n
+	return rest[:n], nil
+}
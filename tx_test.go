@@ -0,0 +1,271 @@
+package fsx_test
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	"github.com/halimath/fixture"
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/memfs"
+)
+
+const txSource = `-- config/app.yaml --
+version: 1
+-- config/old.yaml --
+old
+-- data/log.txt --
+line 1
+`
+
+var errInjected = errors.New("injected failure")
+
+// failingFS wraps a FS and fails the first rename to each of failRename.
+type failingFS struct {
+	fsx.LinkFS
+	failRename []string
+}
+
+func (f *failingFS) Rename(oldpath, newpath string) error {
+	for i, name := range f.failRename {
+		if newpath == name {
+			f.failRename = append(f.failRename[:i], f.failRename[i+1:]...)
+			return &fs.PathError{Op: "Rename", Path: newpath, Err: errInjected}
+		}
+	}
+	return f.LinkFS.Rename(oldpath, newpath)
+}
+
+// expectTree expects fsys to contain exactly the regular files in want.
+func expectTree(t *testing.T, fsys fs.FS, want map[string]string) {
+	t.Helper()
+
+	got := make(map[string]string)
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+
+		data, err := fs.ReadFile(fsys, p)
+		got[p] = string(data)
+		return err
+	})
+
+	expect.That(t, is.NoError(err), is.DeepEqualTo(got, want))
+}
+
+// migrate performs a set of modifications to tx.
+func migrate(t *testing.T, tx *fsx.Tx) {
+	t.Helper()
+
+	expect.That(t,
+		expect.FailNow(is.NoError(fsx.MkdirAll(tx, "config/v2/extra", 0755))),
+		expect.FailNow(is.NoError(fsx.WriteFile(tx, "config/v2/app.yaml", []byte("version: 2\n"), 0644))),
+		expect.FailNow(is.NoError(tx.Remove("config/v2/extra"))),
+		expect.FailNow(is.NoError(tx.Rename("config/v2/app.yaml", "config/app.yaml"))),
+		expect.FailNow(is.NoError(tx.Remove("config/old.yaml"))),
+		expect.FailNow(is.NoError(tx.Chmod("data/log.txt", 0600))),
+	)
+
+	f, err := tx.OpenFile("data/log.txt", fsx.O_WRONLY|fsx.O_APPEND, 0)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	_, err = f.Write([]byte("line 2\n"))
+	expect.That(t, is.NoError(err), is.NoError(f.Close()))
+}
+
+var migrated = map[string]string{
+	"config/app.yaml": "version: 2\n",
+	"data/log.txt":    "line 1\nline 2\n",
+}
+
+var original = map[string]string{
+	"config/app.yaml": "version: 1\n",
+	"config/old.yaml": "old\n",
+	"data/log.txt":    "line 1\n",
+}
+
+func TestTx(t *testing.T) {
+	fixture.With(t, new(interfaceFixture)).
+		Run("commit", func(t *testing.T, f *interfaceFixture) {
+			expect.That(t, expect.FailNow(is.NoError(fsx.LoadTxtar(f.fs, []byte(txSource)))))
+
+			tx := fsx.Begin(f.fs)
+			migrate(t, tx)
+
+			// Reads through the transaction see the staged state; the
+			// target remains unchanged.
+			expectTree(t, tx, migrated)
+			expectTree(t, f.fs, original)
+
+			info, err := tx.Stat("data/log.txt")
+			expect.That(t, is.NoError(err), is.EqualTo(info.Mode(), fs.FileMode(0600)))
+
+			expect.That(t, is.NoError(tx.Commit()))
+
+			expectTree(t, f.fs, migrated)
+			info, err = fs.Stat(f.fs, "data/log.txt")
+			expect.That(t, is.NoError(err), is.EqualTo(info.Mode(), fs.FileMode(0600)))
+
+			// The staging directory has been removed.
+			entries, err := fs.ReadDir(f.fs, ".")
+			expect.That(t, is.NoError(err), is.EqualTo(len(entries), 2))
+
+			expect.That(t, is.Error(tx.Commit(), fsx.ErrTxDone))
+		}).
+		Run("fstest", func(t *testing.T, f *interfaceFixture) {
+			expect.That(t, expect.FailNow(is.NoError(fsx.LoadTxtar(f.fs, []byte(txSource)))))
+
+			tx := fsx.Begin(f.fs)
+			migrate(t, tx)
+
+			expect.That(t, is.NoError(fstest.TestFS(tx, "config/app.yaml", "data/log.txt")))
+			expect.That(t, is.NoError(tx.Rollback()))
+		}).
+		Run("rollback", func(t *testing.T, f *interfaceFixture) {
+			expect.That(t, expect.FailNow(is.NoError(fsx.LoadTxtar(f.fs, []byte(txSource)))))
+
+			tx := fsx.Begin(f.fs)
+			migrate(t, tx)
+			expect.That(t, is.NoError(tx.Rollback()))
+
+			expectTree(t, f.fs, original)
+
+			_, err := tx.Stat("config/app.yaml")
+			expect.That(t,
+				is.Error(err, fsx.ErrTxDone),
+				is.Error(tx.Rollback(), fsx.ErrTxDone),
+			)
+		}).
+		Run("conflict", func(t *testing.T, f *interfaceFixture) {
+			expect.That(t, expect.FailNow(is.NoError(fsx.LoadTxtar(f.fs, []byte(txSource)))))
+
+			tx := fsx.Begin(f.fs)
+			migrate(t, tx)
+
+			expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(f.fs, "config/old.yaml", []byte("changed\n"), 0644))))
+
+			expect.That(t, is.Error(tx.Commit(), fsx.ErrConflict))
+
+			entries, err := fs.ReadDir(f.fs, ".")
+			expect.That(t, is.NoError(err), is.EqualTo(len(entries), 2))
+		}).
+		Run("conflict_created", func(t *testing.T, f *interfaceFixture) {
+			tx := fsx.Begin(f.fs)
+			expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(tx, "new.txt", []byte("tx"), 0644))))
+
+			expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(f.fs, "new.txt", []byte("external"), 0644))))
+
+			expect.That(t, is.Error(tx.Commit(), fsx.ErrConflict))
+			expectTree(t, f.fs, map[string]string{"new.txt": "external"})
+		}).
+		Run("conflict_removed_dir", func(t *testing.T, f *interfaceFixture) {
+			expect.That(t, expect.FailNow(is.NoError(fsx.LoadTxtar(f.fs, []byte(txSource)))))
+
+			tx := fsx.Begin(f.fs)
+			expect.That(t, expect.FailNow(is.NoError(tx.RemoveAll("config"))))
+
+			expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(f.fs, "config/new.yaml", []byte("external\n"), 0644))))
+
+			expect.That(t, is.Error(tx.Commit(), fsx.ErrConflict))
+
+			want := map[string]string{"config/new.yaml": "external\n"}
+			for name, content := range original {
+				want[name] = content
+			}
+			expectTree(t, f.fs, want)
+		}).
+		Run("conflict_listed_dir", func(t *testing.T, f *interfaceFixture) {
+			expect.That(t, expect.FailNow(is.NoError(fsx.LoadTxtar(f.fs, []byte(txSource)))))
+
+			tx := fsx.Begin(f.fs)
+			entries, err := tx.ReadDir("config")
+			expect.That(t, expect.FailNow(is.NoError(err)), is.EqualTo(len(entries), 2))
+			expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(tx, "data/summary.txt", []byte("2 files\n"), 0644))))
+
+			expect.That(t, expect.FailNow(is.NoError(f.fs.Remove("config/old.yaml"))))
+
+			expect.That(t, is.Error(tx.Commit(), fsx.ErrConflict))
+		}).
+		Run("open_files", func(t *testing.T, f *interfaceFixture) {
+			tx := fsx.Begin(f.fs)
+			file, err := fsx.Create(tx, "new.txt")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			expect.That(t, is.EqualTo(tx.Commit() != nil, true))
+			expect.That(t, is.NoError(file.Close()))
+		})
+}
+
+func TestTx_revert(t *testing.T) {
+	target := &failingFS{LinkFS: mustFromTxtar(t, txSource), failRename: []string{"data/log.txt"}}
+
+	tx := fsx.Begin(target)
+	migrate(t, tx)
+
+	// Replacing data/log.txt is the last operation applied; all others are
+	// reverted.
+	err := tx.Commit()
+	expect.That(t, is.EqualTo(err != nil, true))
+
+	expectTree(t, target, original)
+
+	entries, err := fs.ReadDir(target, ".")
+	expect.That(t, is.NoError(err), is.EqualTo(len(entries), 2))
+
+	_, err = fs.Stat(target, "config/v2")
+	expect.That(t, is.Error(err, fs.ErrNotExist))
+
+	info, err := fs.Stat(target, "data/log.txt")
+	expect.That(t, is.NoError(err), is.EqualTo(info.Mode(), fs.FileMode(0644)))
+}
+
+func TestTx_revertFails(t *testing.T) {
+	target := &failingFS{LinkFS: mustFromTxtar(t, txSource), failRename: []string{"data/log.txt", "config/old.yaml"}}
+
+	tx := fsx.Begin(target)
+	migrate(t, tx)
+
+	// Restoring the removed config/old.yaml fails, so both errors are
+	// reported.
+	err := tx.Commit()
+	joined, ok := err.(interface{ Unwrap() []error })
+	expect.That(t,
+		is.Error(err, errInjected),
+		expect.FailNow(is.EqualTo(ok, true)),
+	)
+	expect.That(t, is.EqualTo(len(joined.Unwrap()), 2))
+
+	// The staging directory containing the backup is kept.
+	entries, err := fs.ReadDir(target, ".")
+	expect.That(t, is.NoError(err), expect.FailNow(is.EqualTo(len(entries), 3)))
+
+	recoverable := false
+	err = fs.WalkDir(target, entries[0].Name(), func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		data, err := fs.ReadFile(target, p)
+		recoverable = recoverable || string(data) == "old\n"
+		return err
+	})
+	expect.That(t, is.NoError(err), is.EqualTo(recoverable, true))
+}
+
+func TestTx_removeAll(t *testing.T) {
+	target := memfs.New()
+	expect.That(t, expect.FailNow(is.NoError(fsx.LoadTxtar(target, []byte(txSource)))))
+
+	tx := fsx.Begin(target)
+	expect.That(t,
+		is.NoError(tx.RemoveAll(".")),
+		is.NoError(fsx.WriteFile(tx, "fresh.txt", []byte("fresh"), 0644)),
+		is.NoError(tx.RemoveAll("missing")),
+	)
+	expectTree(t, tx, map[string]string{"fresh.txt": "fresh"})
+
+	expect.That(t, is.NoError(tx.Commit()))
+	expectTree(t, target, map[string]string{"fresh.txt": "fresh"})
+}
@@ -0,0 +1,401 @@
+package fsx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/halimath/fsx/internal/linkutil"
+)
+
+// This file implements support for the txtar archive format as used by the
+// Go toolchain for test fixtures (see golang.org/x/tools/txtar). A txtar
+// archive consists of an optional comment followed by a sequence of file
+// entries. Each file entry starts with a marker line
+//
+//	-- name --
+//
+// followed by the file's content.
+//
+// fsx extends the marker line with annotations in order to support
+// directories, file modes and symlinks:
+//
+//	-- dir/ --                  an (empty) directory with default permissions
+//	-- bin/ mode=0700 --        a directory with permissions 0700
+//	-- bin/run.sh mode=0755 --  a regular file with permissions 0755
+//	-- README -> docs/index.md --  a symlink pointing to docs/index.md
+//
+// Names must not contain whitespace. Files default to permissions 0644;
+// directories default to 0755. Symlink targets are interpreted relative to
+// the filesystem's root, just like the oldname argument to LinkFS.Symlink.
+//
+// When formatting an archive, a newline is appended to all files whose
+// content does not end with a newline. Modification times and ownership are
+// not part of the archive.
+
+const (
+	txtarDefaultFilePerm fs.FileMode = 0644
+	txtarDefaultDirPerm  fs.FileMode = 0755
+)
+
+var (
+	// ErrInvalidTxtar is returned when parsing a txtar archive with malformed
+	// marker lines.
+	ErrInvalidTxtar = errors.New("invalid txtar archive")
+)
+
+// txtarEntry represents a single entry of a txtar archive.
+type txtarEntry struct {
+	name    string
+	mode    fs.FileMode
+	target  string
+	content []byte
+}
+
+func (e *txtarEntry) header() string {
+	var sb strings.Builder
+	sb.WriteString("-- ")
+	sb.WriteString(e.name)
+
+	switch {
+	case e.mode&fs.ModeSymlink != 0:
+		sb.WriteString(" -> ")
+		sb.WriteString(e.target)
+
+	case e.mode.IsDir():
+		sb.WriteByte('/')
+		if e.mode.Perm() != txtarDefaultDirPerm {
+			fmt.Fprintf(&sb, " mode=%04o", e.mode.Perm())
+		}
+
+	default:
+		if e.mode.Perm() != txtarDefaultFilePerm {
+			fmt.Fprintf(&sb, " mode=%04o", e.mode.Perm())
+		}
+	}
+
+	sb.WriteString(" --\n")
+
+	return sb.String()
+}
+
+// parseTxtarHeader parses the marker line l (without the leading "-- " and
+// the trailing " --") into e.
+func parseTxtarHeader(l string) (txtarEntry, error) {
+	fields := strings.Fields(l)
+	if len(fields) == 0 {
+		return txtarEntry{}, fmt.Errorf("%w: empty name", ErrInvalidTxtar)
+	}
+
+	e := txtarEntry{
+		name: fields[0],
+		mode: txtarDefaultFilePerm,
+	}
+
+	if strings.HasSuffix(e.name, "/") {
+		e.name = strings.TrimSuffix(e.name, "/")
+		e.mode = fs.ModeDir | txtarDefaultDirPerm
+	}
+
+	if !fs.ValidPath(e.name) || e.name == "." {
+		return txtarEntry{}, fmt.Errorf("%w: invalid name %q", ErrInvalidTxtar, fields[0])
+	}
+
+	for i := 1; i < len(fields); i++ {
+		f := fields[i]
+
+		if f == "->" {
+			if i+1 >= len(fields) || e.mode.IsDir() {
+				return txtarEntry{}, fmt.Errorf("%w: invalid symlink %q", ErrInvalidTxtar, l)
+			}
+			i++
+			e.target = fields[i]
+			e.mode = fs.ModeSymlink | 0777
+			continue
+		}
+
+		k, v, ok := strings.Cut(f, "=")
+		if !ok || k != "mode" {
+			return txtarEntry{}, fmt.Errorf("%w: invalid annotation %q", ErrInvalidTxtar, f)
+		}
+
+		perm, err := strconv.ParseUint(v, 8, 32)
+		if err != nil || perm&^uint64(fs.ModePerm) != 0 {
+			return txtarEntry{}, fmt.Errorf("%w: invalid mode %q", ErrInvalidTxtar, v)
+		}
+
+		e.mode = e.mode.Type() | fs.FileMode(perm)
+	}
+
+	return e, nil
+}
+
+// isTxtarMarker reports whether l is a txtar marker line and returns the
+// marker's content.
+func isTxtarMarker(l []byte) (string, bool) {
+	l = bytes.TrimSuffix(l, []byte("\n"))
+	l = bytes.TrimSuffix(l, []byte("\r"))
+	if !bytes.HasPrefix(l, []byte("-- ")) || !bytes.HasSuffix(l, []byte(" --")) || len(l) < 6 {
+		return "", false
+	}
+
+	return string(l[3 : len(l)-3]), true
+}
+
+// parseTxtar parses data into a list of entries. The archive's comment is
+// ignored.
+func parseTxtar(data []byte) ([]txtarEntry, error) {
+	var entries []txtarEntry
+	var current *txtarEntry
+
+	for len(data) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i+1], data[i+1:]
+		} else {
+			line, data = data, nil
+		}
+
+		if h, ok := isTxtarMarker(line); ok {
+			e, err := parseTxtarHeader(h)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, e)
+			current = &entries[len(entries)-1]
+			continue
+		}
+
+		if current == nil {
+			// Still inside the comment section.
+			continue
+		}
+
+		if current.mode&fs.ModeSymlink != 0 || current.mode.IsDir() {
+			if len(bytes.TrimSpace(line)) > 0 {
+				return nil, fmt.Errorf("%w: content given for non-regular file %s", ErrInvalidTxtar, current.name)
+			}
+			continue
+		}
+
+		current.content = append(current.content, line...)
+	}
+
+	return entries, nil
+}
+
+// formatTxtar formats entries as a txtar archive.
+func formatTxtar(entries []txtarEntry) []byte {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		buf.WriteString(e.header())
+
+		if e.mode.IsRegular() && len(e.content) > 0 {
+			buf.Write(e.content)
+			if e.content[len(e.content)-1] != '\n' {
+				buf.WriteByte('\n')
+			}
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// LoadTxtar creates the files, directories and symlinks described by the txtar
+// archive data inside fsys. Parent directories are created as needed using
+// MkdirAll. Existing files are overwritten.
+//
+// Creating symlinks requires fsys to satisfy LinkFS; otherwise an error
+// wrapping ErrNotSupported is returned. Symlinks are created after all other
+// entries so that their targets exist.
+func LoadTxtar(fsys FS, data []byte) error {
+	entries, err := parseTxtar(data)
+	if err != nil {
+		return err
+	}
+
+	var links []txtarEntry
+
+	for _, e := range entries {
+		if e.mode&fs.ModeSymlink != 0 {
+			links = append(links, e)
+			continue
+		}
+
+		if e.mode.IsDir() {
+			if err := MkdirAll(fsys, e.name, e.mode.Perm()); err != nil {
+				return err
+			}
+
+			// MkdirAll does not change the permission of an existing directory.
+			if err := Chmod(fsys, e.name, e.mode.Perm()); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if dir, _ := split(e.name); len(dir) > 0 {
+			if err := MkdirAll(fsys, dir, txtarDefaultDirPerm); err != nil {
+				return err
+			}
+		}
+
+		if err := WriteFile(fsys, e.name, e.content, e.mode.Perm()); err != nil {
+			return err
+		}
+
+		// WriteFile keeps the permission of an existing file.
+		if err := Chmod(fsys, e.name, e.mode.Perm()); err != nil {
+			return err
+		}
+	}
+
+	if len(links) == 0 {
+		return nil
+	}
+
+	lfs, ok := fsys.(LinkFS)
+	if !ok {
+		return &fs.PathError{
+			Op:   "LoadTxtar",
+			Path: links[0].name,
+			Err:  ErrNotSupported,
+		}
+	}
+
+	for _, e := range links {
+		if dir, _ := split(e.name); len(dir) > 0 {
+			if err := MkdirAll(fsys, dir, txtarDefaultDirPerm); err != nil {
+				return err
+			}
+		}
+
+		if err := lfs.Symlink(e.target, e.name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DumpTxtar walks fsys and returns a txtar archive describing all files,
+// directories and symlinks found. Entries are sorted by name. Directories are
+// only included if they are empty or have a non-default permission.
+//
+// Symlinks are detected if fsys provides a Readlink method (i.e. satisfies
+// LinkFS); they are recorded as links and not followed.
+func DumpTxtar(fsys fs.FS) ([]byte, error) {
+	var entries []txtarEntry
+
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if p == "." {
+			return nil
+		}
+
+		if target, ok := linkutil.Readlink(fsys, p); ok {
+			entries = append(entries, txtarEntry{
+				name:   p,
+				mode:   fs.ModeSymlink | 0777,
+				target: target,
+			})
+
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			children, err := fs.ReadDir(fsys, p)
+			if err != nil {
+				return err
+			}
+
+			if len(children) == 0 || info.Mode().Perm() != txtarDefaultDirPerm {
+				entries = append(entries, txtarEntry{
+					name: p,
+					mode: fs.ModeDir | info.Mode().Perm(),
+				})
+			}
+			return nil
+		}
+
+		content, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return err
+		}
+
+		entries = append(entries, txtarEntry{
+			name:    p,
+			mode:    info.Mode().Perm(),
+			content: content,
+		})
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+
+	return formatTxtar(entries), nil
+}
+
+// TxtarDiff compares the tree contained in fsys against the txtar archive
+// want (e.g. a golden file). It returns an empty string if both are equal.
+// Otherwise, it returns a human readable unified diff of want's normalized
+// representation and the one produced from fsys by DumpTxtar.
+//
+// TxtarDiff is intended for use in golden tests:
+//
+//	if d, err := fsx.TxtarDiff(fsys, golden); err != nil || d != "" {
+//		t.Errorf("unexpected tree (err=%v):\n%s", err, d)
+//	}
+func TxtarDiff(fsys fs.FS, want []byte) (string, error) {
+	wantEntries, err := parseTxtar(want)
+	if err != nil {
+		return "", err
+	}
+
+	sort.SliceStable(wantEntries, func(i, j int) bool { return wantEntries[i].name < wantEntries[j].name })
+
+	// Remove directories that are implied by other entries to match the
+	// output of DumpTxtar.
+	implied := make(map[string]bool)
+	for _, e := range wantEntries {
+		for d := path.Dir(e.name); d != "."; d = path.Dir(d) {
+			implied[d] = true
+		}
+	}
+
+	normalized := wantEntries[:0]
+	for _, e := range wantEntries {
+		if e.mode.IsDir() && e.mode.Perm() == txtarDefaultDirPerm && implied[e.name] {
+			continue
+		}
+		normalized = append(normalized, e)
+	}
+
+	got, err := DumpTxtar(fsys)
+	if err != nil {
+		return "", err
+	}
+
+	return unifiedDiff("want", "got", string(formatTxtar(normalized)), string(got)), nil
+}
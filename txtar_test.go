@@ -0,0 +1,93 @@
+package fsx_test
+
+import (
+	"io/fs"
+	"testing"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/memfs"
+)
+
+const txtarFixture = `comment
+-- a.txt --
+hello
+-- dir/b.txt mode=0600 --
+world
+-- empty/ --
+-- private/ mode=0700 --
+-- link -> a.txt --
+`
+
+func TestLoadTxtar(t *testing.T) {
+	fsys := memfs.New()
+	expect.That(t, expect.FailNow(is.NoError(fsx.LoadTxtar(fsys, []byte(txtarFixture)))))
+
+	data, err := fs.ReadFile(fsys, "dir/b.txt")
+	expect.That(t, is.NoError(err), is.EqualTo(string(data), "world\n"))
+
+	info, err := fs.Stat(fsys, "dir/b.txt")
+	expect.That(t, is.NoError(err), is.EqualTo(info.Mode(), 0600))
+
+	info, err = fs.Stat(fsys, "private")
+	expect.That(t, is.NoError(err), is.EqualTo(info.Mode(), fs.ModeDir|0700))
+
+	target, err := fsys.Readlink("link")
+	expect.That(t, is.NoError(err), is.EqualTo(target, "a.txt"))
+}
+
+func TestLoadTxtar_symlinkNotSupported(t *testing.T) {
+	fsys := &plainFS{memfs.New()}
+	expect.That(t, is.Error(fsx.LoadTxtar(fsys, []byte("-- l -> a --\n")), fsx.ErrNotSupported))
+}
+
+func TestLoadTxtar_invalid(t *testing.T) {
+	tests := []string{
+		"-- a.txt foo=bar --\n",
+		"-- a.txt mode=999 --\n",
+		"-- ../a.txt --\n",
+		"-- dir/ --\ncontent\n",
+	}
+
+	for _, test := range tests {
+		expect.That(t, is.Error(fsx.LoadTxtar(memfs.New(), []byte(test)), fsx.ErrInvalidTxtar))
+	}
+}
+
+func TestDumpTxtar(t *testing.T) {
+	fsys := memfs.New()
+	expect.That(t, expect.FailNow(is.NoError(fsx.LoadTxtar(fsys, []byte(txtarFixture)))))
+
+	got, err := fsx.DumpTxtar(fsys)
+	expect.That(t, is.NoError(err), is.EqualToStringByLines(string(got), `-- a.txt --
+hello
+-- dir/b.txt mode=0600 --
+world
+-- empty/ --
+-- link -> a.txt --
+-- private/ mode=0700 --
+`))
+}
+
+func TestTxtarDiff(t *testing.T) {
+	fsys := memfs.New()
+	expect.That(t, expect.FailNow(is.NoError(fsx.LoadTxtar(fsys, []byte(txtarFixture)))))
+
+	d, err := fsx.TxtarDiff(fsys, []byte(txtarFixture))
+	expect.That(t, is.NoError(err), is.EqualTo(d, ""))
+
+	expect.That(t, expect.FailNow(is.NoError(fsx.WriteFile(fsys, "a.txt", []byte("hello\nworld\n"), 0644))))
+
+	d, err = fsx.TxtarDiff(fsys, []byte(txtarFixture))
+	expect.That(t, is.NoError(err), is.EqualTo(d, `--- want
++++ got
+@@ -1,5 +1,6 @@
+ -- a.txt --
+ hello
++world
+ -- dir/b.txt mode=0600 --
+ world
+ -- empty/ --
+`))
+}
@@ -0,0 +1,345 @@
+package versionfs
+
+import (
+	"io/fs"
+	"path"
+	"time"
+
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/internal/linkutil"
+	"github.com/halimath/fsx/internal/wrapfs"
+)
+
+// Open opens the named file for reading.
+func (fsys *versionfs) Open(name string) (fs.File, error) {
+	if err := fsys.check("open", name); err != nil {
+		return nil, err
+	}
+
+	f, err := fsys.backing.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if fsys.encloses(name) {
+		if d, ok := f.(fs.ReadDirFile); ok {
+			return &dir{ReadDirFile: d, fsys: fsys, name: name}, nil
+		}
+	}
+	return f, nil
+}
+
+// OpenFile opens the named file. Opening an existing regular file with
+// O_TRUNC records its content as a new version. If name is a symlink, the
+// version is recorded for the link's target.
+func (fsys *versionfs) OpenFile(name string, flag int, perm fs.FileMode) (fsx.File, error) {
+	if err := fsys.check("OpenFile", name); err != nil {
+		return nil, err
+	}
+
+	if flag&fsx.O_TRUNC == 0 {
+		return fsys.backing.OpenFile(name, flag, perm)
+	}
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	target, err := fsys.resolve("OpenFile", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fsys.record(target, false); err != nil {
+		return nil, err
+	}
+
+	f, err := fsys.backing.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fsys.prune(target); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Mkdir creates the named directory.
+func (fsys *versionfs) Mkdir(name string, perm fs.FileMode) error {
+	if err := fsys.check("Mkdir", name); err != nil {
+		return err
+	}
+	return fsys.backing.Mkdir(name, perm)
+}
+
+// Remove removes the named file or empty directory. Regular files are moved
+// into the history.
+func (fsys *versionfs) Remove(name string) error {
+	if err := fsys.check("Remove", name); err != nil {
+		return err
+	}
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	info, err := linkutil.Lstat(fsys.backing, name)
+	if err != nil || !info.Mode().IsRegular() {
+		return fsys.backing.Remove(name)
+	}
+
+	if err := fsys.record(name, true); err != nil {
+		return err
+	}
+	return fsys.prune(name)
+}
+
+// Rename renames oldpath to newpath. A regular file replaced by the rename
+// is moved into the history. If the rename fails, the replaced file is
+// moved back.
+func (fsys *versionfs) Rename(oldpath, newpath string) error {
+	if err := fsys.check("Rename", oldpath); err != nil {
+		return err
+	}
+	if err := fsys.check("Rename", newpath); err != nil {
+		return err
+	}
+	if fsys.encloses(oldpath) {
+		return wrapfs.PathError("Rename", oldpath, fs.ErrPermission)
+	}
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	if oldpath == newpath {
+		return fsys.backing.Rename(oldpath, newpath)
+	}
+
+	before, err := fsys.versions(newpath)
+	if err != nil {
+		return err
+	}
+
+	if err := fsys.record(newpath, true); err != nil {
+		return err
+	}
+
+	if err := fsys.backing.Rename(oldpath, newpath); err != nil {
+		if after, verr := fsys.versions(newpath); verr == nil && len(after) > len(before) {
+			fsys.backing.Rename(fsys.historyPath(newpath, after[len(after)-1].ID), newpath)
+		}
+		return err
+	}
+
+	return fsys.prune(newpath)
+}
+
+// SameFile reports whether fi1 and fi2 describe the same file.
+func (fsys *versionfs) SameFile(fi1, fi2 fs.FileInfo) bool {
+	return fsys.backing.SameFile(fi1, fi2)
+}
+
+// -- fsx.WriteFileFS
+
+// WriteFile writes data to the named file. The content of an existing
+// regular file is recorded as a new version. If name is a symlink, the
+// version is recorded for the link's target.
+func (fsys *versionfs) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	if err := fsys.check("WriteFile", name); err != nil {
+		return err
+	}
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	target, err := fsys.resolve("WriteFile", name)
+	if err != nil {
+		return err
+	}
+
+	if err := fsys.record(target, false); err != nil {
+		return err
+	}
+
+	if err := fsx.WriteFile(fsys.backing, name, data, perm); err != nil {
+		return err
+	}
+	return fsys.prune(target)
+}
+
+// -- fsx.ChmodFS, fsx.ChownFS, fsx.ChtimesFS, fsx.RemoveAllFS
+
+// Chmod changes the mode of the named file.
+func (fsys *versionfs) Chmod(name string, mode fs.FileMode) error {
+	if err := fsys.check("Chmod", name); err != nil {
+		return err
+	}
+	return fsx.Chmod(fsys.backing, name, mode)
+}
+
+// Chown changes the numeric owner and group of the named file.
+func (fsys *versionfs) Chown(name string, uid, gid int) error {
+	if err := fsys.check("Chown", name); err != nil {
+		return err
+	}
+	return fsx.Chown(fsys.backing, name, uid, gid)
+}
+
+// Chtimes changes the access and modification time of the named file.
+func (fsys *versionfs) Chtimes(name string, atime, mtime time.Time) error {
+	if err := fsys.check("Chtimes", name); err != nil {
+		return err
+	}
+
+	return wrapfs.Chtimes(fsys.backing, name, atime, mtime)
+}
+
+// RemoveAll removes name and all of its children. All regular files removed
+// are moved into the history. The history itself is never removed.
+func (fsys *versionfs) RemoveAll(name string) error {
+	if err := fsys.check("RemoveAll", name); err != nil {
+		return err
+	}
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	return fsys.removeAll(name)
+}
+
+// removeAll implements RemoveAll. It must be called with fsys.mu held.
+func (fsys *versionfs) removeAll(name string) error {
+	if fsys.encloses(name) {
+		entries, err := fs.ReadDir(fsys.backing, name)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			child := path.Join(name, e.Name())
+			if fsys.hidden(child) {
+				continue
+			}
+			if err := fsys.removeAll(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	info, err := linkutil.Lstat(fsys.backing, name)
+	if err != nil {
+		return nil
+	}
+
+	if info.Mode().IsRegular() {
+		if err := fsys.record(name, true); err != nil {
+			return err
+		}
+		return fsys.prune(name)
+	}
+
+	if info.IsDir() {
+		if err := fsys.recordTree(name); err != nil {
+			return err
+		}
+	}
+	return fsx.RemoveAll(fsys.backing, name)
+}
+
+// -- fsx.LinkFS
+
+// Readlink returns the target of the named symlink.
+func (fsys *versionfs) Readlink(name string) (string, error) {
+	if err := fsys.check("Readlink", name); err != nil {
+		return "", err
+	}
+
+	return wrapfs.Readlink(fsys.backing, name)
+}
+
+// Link creates newname as a hard link to oldname.
+func (fsys *versionfs) Link(oldname, newname string) error {
+	if err := fsys.check("Link", oldname); err != nil {
+		return err
+	}
+	if err := fsys.check("Link", newname); err != nil {
+		return err
+	}
+
+	return wrapfs.Link(fsys.backing, oldname, newname)
+}
+
+// Symlink creates newname as a symlink to oldname.
+func (fsys *versionfs) Symlink(oldname, newname string) error {
+	if err := fsys.check("Symlink", newname); err != nil {
+		return err
+	}
+
+	return wrapfs.Symlink(fsys.backing, oldname, newname)
+}
+
+// -- fs.StatFS, fs.ReadDirFS, fs.ReadFileFS
+
+// Stat returns a fs.FileInfo describing the named file.
+func (fsys *versionfs) Stat(name string) (fs.FileInfo, error) {
+	if err := fsys.check("stat", name); err != nil {
+		return nil, err
+	}
+	return fs.Stat(fsys.backing, name)
+}
+
+// ReadDir reads the named directory omitting the history directory.
+func (fsys *versionfs) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := fsys.check("readdir", name); err != nil {
+		return nil, err
+	}
+
+	entries, err := fs.ReadDir(fsys.backing, name)
+	if err != nil {
+		return nil, err
+	}
+	return fsys.filter(name, entries), nil
+}
+
+// ReadFile reads the named file.
+func (fsys *versionfs) ReadFile(name string) ([]byte, error) {
+	if err := fsys.check("readfile", name); err != nil {
+		return nil, err
+	}
+	return fs.ReadFile(fsys.backing, name)
+}
+
+// filter removes the history directory from entries read from the
+// directory name.
+func (fsys *versionfs) filter(name string, entries []fs.DirEntry) []fs.DirEntry {
+	if !fsys.encloses(name) {
+		return entries
+	}
+
+	filtered := entries[:0]
+	for _, e := range entries {
+		if !fsys.hidden(path.Join(name, e.Name())) {
+			filtered = append(filtered, e)
+		}
+	}
+	return filtered
+}
+
+// dir wraps a directory enclosing the history directory and omits it from
+// the entries read.
+type dir struct {
+	fs.ReadDirFile
+	fsys *versionfs
+	name string
+}
+
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	for {
+		entries, err := d.ReadDirFile.ReadDir(n)
+		filtered := d.fsys.filter(d.name, entries)
+		if n <= 0 || len(filtered) > 0 || err != nil {
+			return filtered, err
+		}
+	}
+}
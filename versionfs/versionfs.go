@@ -0,0 +1,463 @@
+// Package versionfs provides a fsx.FS wrapper keeping the history of files
+// overwritten or deleted through it.
+//
+// Before a regular file's content is lost by a truncating OpenFile, a
+// WriteFile, a Remove, a RemoveAll or a Rename replacing it, the previous
+// content is moved or copied into a history directory inside the wrapped
+// filesystem. The history directory is hidden from all operations performed
+// through the wrapper. Modifications not truncating a file, such as
+// appending to it, are not recorded. Truncating a file through a symlink records
+// the version for the link's target.
+//
+// Each version of a path is identified by an ID which increases
+// monotonically and encodes the time the version has been recorded.
+// Versions can be listed, opened and restored. Retention policies limit the
+// number and age of versions kept per path; they are applied whenever a
+// version is recorded and by calling Prune.
+package versionfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/internal/linkutil"
+	"github.com/halimath/fsx/internal/wrapfs"
+)
+
+// DefaultHistoryDir is the default directory used to store versions.
+const DefaultHistoryDir = ".versions"
+
+// Option defines a function used to customize a versionfs.
+type Option func(*options)
+
+type options struct {
+	dir         string
+	maxVersions int
+	maxAge      time.Duration
+}
+
+// WithHistoryDir sets the directory used to store versions.
+func WithHistoryDir(dir string) Option {
+	return func(o *options) {
+		o.dir = dir
+	}
+}
+
+// WithMaxVersions sets the number of versions kept per path. Older versions
+// are removed. A value of 0 keeps an unlimited number of versions.
+func WithMaxVersions(n int) Option {
+	return func(o *options) {
+		o.maxVersions = n
+	}
+}
+
+// WithMaxAge sets the duration versions are kept after being recorded. A
+// value of 0 keeps versions forever.
+func WithMaxAge(d time.Duration) Option {
+	return func(o *options) {
+		o.maxAge = d
+	}
+}
+
+// Version describes a recorded version of a file.
+type Version struct {
+	// ID identifies the version among all versions of the same path.
+	ID int64
+	// Time contains the time the version has been recorded.
+	Time time.Time
+	// ModTime contains the modification time of the file's content.
+	ModTime time.Time
+	// Size contains the size of the file's content.
+	Size int64
+	// Mode contains the file's mode.
+	Mode fs.FileMode
+}
+
+// FS defines the interface of a versioning filesystem. Operations losing a
+// file's content record a version first; the versions can be inspected and
+// restored using the methods below.
+type FS interface {
+	fsx.LinkFS
+	fsx.ChmodFS
+	fsx.ChownFS
+	fsx.ChtimesFS
+	fsx.RemoveAllFS
+	fsx.WriteFileFS
+	fs.StatFS
+	fs.ReadDirFS
+	fs.ReadFileFS
+
+	// Versions returns the versions recorded for name ordered from oldest
+	// to newest. It returns an empty slice if no versions exist.
+	Versions(name string) ([]Version, error)
+
+	// OpenVersion opens the version id of name for reading.
+	OpenVersion(name string, id int64) (fs.File, error)
+
+	// Restore replaces name's content with the version id. The content
+	// replaced is recorded as a new version. Missing parent directories are
+	// created.
+	Restore(name string, id int64) error
+
+	// Prune applies the retention policies to the versions of all paths.
+	Prune() error
+}
+
+type versionfs struct {
+	backing fsx.FS
+	opts    options
+	now     func() time.Time
+
+	mu sync.Mutex
+}
+
+// New creates a versioning filesystem wrapping backing.
+func New(backing fsx.FS, opts ...Option) (FS, error) {
+	o := options{dir: DefaultHistoryDir}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if !fs.ValidPath(o.dir) || o.dir == "." {
+		return nil, fmt.Errorf("versionfs: invalid history dir: %q", o.dir)
+	}
+	if o.maxVersions < 0 {
+		return nil, fmt.Errorf("versionfs: invalid max versions: %d", o.maxVersions)
+	}
+	if o.maxAge < 0 {
+		return nil, fmt.Errorf("versionfs: invalid max age: %s", o.maxAge)
+	}
+
+	return &versionfs{
+		backing: backing,
+		opts:    o,
+		now:     time.Now,
+	}, nil
+}
+
+// hidden reports whether name is the history directory or part of it.
+func (fsys *versionfs) hidden(name string) bool {
+	return name == fsys.opts.dir || strings.HasPrefix(name, fsys.opts.dir+"/")
+}
+
+// encloses reports whether the history directory is located inside name.
+func (fsys *versionfs) encloses(name string) bool {
+	return name == "." || strings.HasPrefix(fsys.opts.dir, name+"/")
+}
+
+// check returns an error if name is not a valid path or hidden.
+func (fsys *versionfs) check(op, name string) error {
+	if !fs.ValidPath(name) {
+		return wrapfs.PathError(op, name, fs.ErrInvalid)
+	}
+	if fsys.hidden(name) {
+		return wrapfs.PathError(op, name, fs.ErrNotExist)
+	}
+	return nil
+}
+
+// checkVersioned returns an error if name is not a path versions may be
+// recorded for.
+func (fsys *versionfs) checkVersioned(op, name string) error {
+	if name == "." {
+		return wrapfs.PathError(op, name, fs.ErrInvalid)
+	}
+	return fsys.check(op, name)
+}
+
+// historyPath returns the path of version id of name.
+func (fsys *versionfs) historyPath(name string, id int64) string {
+	return path.Join(fsys.opts.dir, name) + "@" + strconv.FormatInt(id, 10)
+}
+
+// parseID returns the ID of the version stored in a file named entry if the
+// file stores a version of a path with basename base.
+func parseID(entry, base string) (int64, bool) {
+	s, ok := strings.CutPrefix(entry, base+"@")
+	if !ok {
+		return 0, false
+	}
+
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id <= 0 || strconv.FormatInt(id, 10) != s {
+		return 0, false
+	}
+	return id, true
+}
+
+// Versions returns the versions recorded for name.
+func (fsys *versionfs) Versions(name string) ([]Version, error) {
+	if err := fsys.checkVersioned("versions", name); err != nil {
+		return nil, err
+	}
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	return fsys.versions(name)
+}
+
+// versions returns the versions of name ordered by ID. It must be called
+// with fsys.mu held.
+func (fsys *versionfs) versions(name string) ([]Version, error) {
+	dir, base := path.Split(path.Join(fsys.opts.dir, name))
+
+	entries, err := fs.ReadDir(fsys.backing, path.Clean(dir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return []Version{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]Version, 0)
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+
+		id, ok := parseID(e.Name(), base)
+		if !ok {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		versions = append(versions, Version{
+			ID:      id,
+			Time:    time.Unix(0, id),
+			ModTime: info.ModTime(),
+			Size:    info.Size(),
+			Mode:    info.Mode(),
+		})
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i].ID < versions[j].ID })
+
+	return versions, nil
+}
+
+// OpenVersion opens the version id of name for reading.
+func (fsys *versionfs) OpenVersion(name string, id int64) (fs.File, error) {
+	if err := fsys.checkVersioned("openversion", name); err != nil {
+		return nil, err
+	}
+
+	f, err := fsys.backing.Open(fsys.historyPath(name, id))
+	if err != nil {
+		return nil, wrapfs.PathError("openversion", name, fs.ErrNotExist)
+	}
+	return f, nil
+}
+
+// Restore replaces name's content with the version id.
+func (fsys *versionfs) Restore(name string, id int64) error {
+	if err := fsys.checkVersioned("restore", name); err != nil {
+		return err
+	}
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	hp := fsys.historyPath(name, id)
+	info, err := fs.Stat(fsys.backing, hp)
+	if err != nil {
+		return wrapfs.PathError("restore", name, fs.ErrNotExist)
+	}
+
+	target, err := fsys.resolve("restore", name)
+	if err != nil {
+		return err
+	}
+
+	if err := fsys.record(target, false); err != nil {
+		return err
+	}
+
+	if err := fsx.MkdirAll(fsys.backing, path.Dir(name), 0755); err != nil {
+		return err
+	}
+
+	if err := fsys.copy(hp, name, info); err != nil {
+		return err
+	}
+
+	return fsys.prune(target)
+}
+
+// Prune applies the retention policies to the versions of all paths.
+func (fsys *versionfs) Prune() error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	pruned := make(map[string]bool)
+	err := fs.WalkDir(fsys.backing, fsys.opts.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		i := strings.LastIndexByte(p, '@')
+		if i < 0 {
+			return nil
+		}
+		if _, ok := parseID(p[i:], ""); !ok {
+			return nil
+		}
+
+		name := p[len(fsys.opts.dir)+1 : i]
+		if pruned[name] {
+			return nil
+		}
+		pruned[name] = true
+
+		return fsys.prune(name)
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// prune removes the versions of name exceeding the retention policies. It
+// must be called with fsys.mu held.
+func (fsys *versionfs) prune(name string) error {
+	if fsys.opts.maxVersions == 0 && fsys.opts.maxAge == 0 {
+		return nil
+	}
+
+	versions, err := fsys.versions(name)
+	if err != nil {
+		return err
+	}
+
+	keep := 0
+	if fsys.opts.maxVersions > 0 && len(versions) > fsys.opts.maxVersions {
+		keep = len(versions) - fsys.opts.maxVersions
+	}
+
+	if fsys.opts.maxAge > 0 {
+		cutoff := fsys.now().Add(-fsys.opts.maxAge)
+		for keep < len(versions) && versions[keep].Time.Before(cutoff) {
+			keep++
+		}
+	}
+
+	for _, v := range versions[:keep] {
+		if err := fsys.backing.Remove(fsys.historyPath(name, v.ID)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resolve returns the path name refers to with all symlinks resolved.
+// Writing through a symlink modifies the link's target, so the target's
+// content must be recorded before. Targets inside the history directory are
+// rejected.
+func (fsys *versionfs) resolve(op, name string) (string, error) {
+	target, err := linkutil.Resolve(fsys.backing, name)
+	if err != nil {
+		return "", wrapfs.PathError(op, name, err)
+	}
+	if fsys.hidden(target) {
+		return "", wrapfs.PathError(op, name, fs.ErrPermission)
+	}
+	return target, nil
+}
+
+// record records the current content of name as a new version if name is a
+// regular file. The file is moved into the history if move is true and
+// copied otherwise. It must be called with fsys.mu held.
+func (fsys *versionfs) record(name string, move bool) error {
+	info, err := linkutil.Lstat(fsys.backing, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	versions, err := fsys.versions(name)
+	if err != nil {
+		return err
+	}
+
+	id := fsys.now().UnixNano()
+	if n := len(versions); n > 0 && versions[n-1].ID >= id {
+		id = versions[n-1].ID + 1
+	}
+
+	hp := fsys.historyPath(name, id)
+	if err := fsx.MkdirAll(fsys.backing, path.Dir(hp), 0700); err != nil {
+		return err
+	}
+
+	if move {
+		return fsys.backing.Rename(name, hp)
+	}
+	return fsys.copy(name, hp, info)
+}
+
+// copy copies the regular file src described by info to dst.
+func (fsys *versionfs) copy(src, dst string, info fs.FileInfo) (err error) {
+	in, err := fsys.backing.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := fsys.backing.OpenFile(dst, fsx.O_WRONLY|fsx.O_CREATE|fsx.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err1 := out.Close(); err1 != nil && err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+
+	if cfs, ok := fsys.backing.(fsx.ChtimesFS); ok {
+		return cfs.Chtimes(dst, time.Now(), info.ModTime())
+	}
+	return nil
+}
+
+// recordTree records all regular files contained in name. Files are moved
+// into the history. It must be called with fsys.mu held.
+func (fsys *versionfs) recordTree(name string) error {
+	return fs.WalkDir(fsys.backing, name, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		if err := fsys.record(p, true); err != nil {
+			return err
+		}
+		return fsys.prune(p)
+	})
+}
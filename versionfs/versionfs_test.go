@@ -0,0 +1,302 @@
+package versionfs
+
+import (
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	. "github.com/halimath/fixture"
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/memfs"
+	"github.com/halimath/fsx/osfs"
+)
+
+type versionfsFixture struct {
+	backing fsx.LinkFS
+	fs      FS
+	now     time.Time
+}
+
+func (f *versionfsFixture) BeforeEach(t *testing.T) error {
+	f.backing = memfs.New()
+
+	if err := fsx.MkdirAll(f.backing, "etc/app", 0755); err != nil {
+		return err
+	}
+	if err := fsx.WriteFile(f.backing, "etc/app/config.yaml", []byte("v1"), 0644); err != nil {
+		return err
+	}
+
+	var err error
+	f.fs, err = New(f.backing)
+	if err != nil {
+		return err
+	}
+
+	f.now = time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	f.fs.(*versionfs).now = func() time.Time { return f.now }
+
+	return nil
+}
+
+// expectVersions expects name to have versions with the given contents
+// ordered from oldest to newest.
+func (f *versionfsFixture) expectVersions(t *testing.T, name string, contents ...string) {
+	t.Helper()
+
+	versions, err := f.fs.Versions(name)
+	expect.That(t, expect.FailNow(is.NoError(err)), expect.FailNow(is.EqualTo(len(versions), len(contents))))
+
+	for i, v := range versions {
+		file, err := f.fs.OpenVersion(name, v.ID)
+		expect.That(t, expect.FailNow(is.NoError(err)))
+
+		data, err := io.ReadAll(file)
+		expect.That(t,
+			is.NoError(err),
+			is.NoError(file.Close()),
+			is.EqualTo(string(data), contents[i]),
+			is.EqualTo(v.Size, int64(len(contents[i]))),
+		)
+	}
+}
+
+// expectContent expects name to contain want.
+func (f *versionfsFixture) expectContent(t *testing.T, name, want string) {
+	t.Helper()
+
+	data, err := f.fs.ReadFile(name)
+	expect.That(t, is.NoError(err), is.EqualTo(string(data), want))
+}
+
+func TestVersionFS(t *testing.T) {
+	With(t, new(versionfsFixture)).
+		Run("writeFile", func(t *testing.T, f *versionfsFixture) {
+			expect.That(t, is.NoError(fsx.WriteFile(f.fs, "etc/app/config.yaml", []byte("v2"), 0644)))
+			f.now = f.now.Add(time.Second)
+			expect.That(t, is.NoError(fsx.WriteFile(f.fs, "etc/app/config.yaml", []byte("v3"), 0644)))
+
+			f.expectContent(t, "etc/app/config.yaml", "v3")
+			f.expectVersions(t, "etc/app/config.yaml", "v1", "v2")
+
+			versions, _ := f.fs.Versions("etc/app/config.yaml")
+			expect.That(t,
+				is.EqualTo(versions[0].Time.Equal(f.now.Add(-time.Second)), true),
+				is.EqualTo(versions[1].Time.Equal(f.now), true),
+				is.EqualTo(versions[0].Mode, fs.FileMode(0644)),
+			)
+
+			// New files have no history.
+			expect.That(t, is.NoError(fsx.WriteFile(f.fs, "etc/app/new.yaml", []byte("new"), 0644)))
+			f.expectVersions(t, "etc/app/new.yaml")
+		}).
+		Run("uniqueIDs", func(t *testing.T, f *versionfsFixture) {
+			// Versions recorded at the same time get distinct IDs.
+			expect.That(t,
+				is.NoError(fsx.WriteFile(f.fs, "etc/app/config.yaml", []byte("v2"), 0644)),
+				is.NoError(fsx.WriteFile(f.fs, "etc/app/config.yaml", []byte("v3"), 0644)),
+			)
+
+			f.expectVersions(t, "etc/app/config.yaml", "v1", "v2")
+		}).
+		Run("openFile", func(t *testing.T, f *versionfsFixture) {
+			file, err := f.fs.OpenFile("etc/app/config.yaml", fsx.O_WRONLY|fsx.O_APPEND, 0)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			_, err = file.Write([]byte("-appended"))
+			expect.That(t, is.NoError(err), is.NoError(file.Close()))
+
+			f.expectVersions(t, "etc/app/config.yaml")
+
+			file, err = f.fs.OpenFile("etc/app/config.yaml", fsx.O_WRONLY|fsx.O_TRUNC, 0)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			_, err = file.Write([]byte("v2"))
+			expect.That(t, is.NoError(err), is.NoError(file.Close()))
+
+			f.expectContent(t, "etc/app/config.yaml", "v2")
+			f.expectVersions(t, "etc/app/config.yaml", "v1-appended")
+		}).
+		Run("remove", func(t *testing.T, f *versionfsFixture) {
+			expect.That(t, is.NoError(f.fs.Remove("etc/app/config.yaml")))
+
+			_, err := f.fs.Stat("etc/app/config.yaml")
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+			f.expectVersions(t, "etc/app/config.yaml", "v1")
+
+			// Directories are removed without history.
+			expect.That(t, is.NoError(f.fs.Remove("etc/app")))
+			f.expectVersions(t, "etc/app")
+		}).
+		Run("removeAll", func(t *testing.T, f *versionfsFixture) {
+			expect.That(t, is.NoError(fsx.WriteFile(f.fs, "etc/app/other.yaml", []byte("other"), 0644)))
+			expect.That(t, is.NoError(f.fs.RemoveAll("etc")))
+
+			_, err := f.fs.Stat("etc")
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+			f.expectVersions(t, "etc/app/config.yaml", "v1")
+			f.expectVersions(t, "etc/app/other.yaml", "other")
+
+			// Removing everything keeps the history.
+			expect.That(t, is.NoError(fsx.WriteFile(f.fs, "file", []byte("file"), 0644)))
+			expect.That(t, is.NoError(f.fs.RemoveAll(".")))
+
+			entries, err := f.fs.ReadDir(".")
+			expect.That(t, is.NoError(err), is.EqualTo(len(entries), 0))
+			f.expectVersions(t, "etc/app/config.yaml", "v1")
+			f.expectVersions(t, "file", "file")
+		}).
+		Run("rename", func(t *testing.T, f *versionfsFixture) {
+			expect.That(t, is.NoError(fsx.WriteFile(f.fs, "etc/app/config.yaml.new", []byte("v2"), 0644)))
+			expect.That(t, is.NoError(f.fs.Rename("etc/app/config.yaml.new", "etc/app/config.yaml")))
+
+			f.expectContent(t, "etc/app/config.yaml", "v2")
+			f.expectVersions(t, "etc/app/config.yaml", "v1")
+			f.expectVersions(t, "etc/app/config.yaml.new")
+
+			// A failing rename keeps the replaced file.
+			expect.That(t, is.Error(f.fs.Rename("etc/app/missing", "etc/app/config.yaml"), fs.ErrNotExist))
+			f.expectContent(t, "etc/app/config.yaml", "v2")
+			f.expectVersions(t, "etc/app/config.yaml", "v1")
+		}).
+		Run("restore", func(t *testing.T, f *versionfsFixture) {
+			expect.That(t, is.NoError(fsx.WriteFile(f.fs, "etc/app/config.yaml", []byte("v2"), 0644)))
+			f.now = f.now.Add(time.Second)
+
+			versions, err := f.fs.Versions("etc/app/config.yaml")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			expect.That(t, is.NoError(f.fs.Restore("etc/app/config.yaml", versions[0].ID)))
+			f.expectContent(t, "etc/app/config.yaml", "v1")
+			f.expectVersions(t, "etc/app/config.yaml", "v1", "v2")
+
+			// Deleted files are restored including their parent directories.
+			expect.That(t, is.NoError(f.fs.RemoveAll("etc")))
+			expect.That(t, is.NoError(f.fs.Restore("etc/app/config.yaml", versions[0].ID)))
+			f.expectContent(t, "etc/app/config.yaml", "v1")
+
+			expect.That(t, is.Error(f.fs.Restore("etc/app/config.yaml", 1), fs.ErrNotExist))
+		}).
+		Run("maxVersions", func(t *testing.T, f *versionfsFixture) {
+			f.fs.(*versionfs).opts.maxVersions = 2
+
+			for _, v := range []string{"v2", "v3", "v4"} {
+				expect.That(t, is.NoError(fsx.WriteFile(f.fs, "etc/app/config.yaml", []byte(v), 0644)))
+			}
+
+			f.expectVersions(t, "etc/app/config.yaml", "v2", "v3")
+		}).
+		Run("maxAge", func(t *testing.T, f *versionfsFixture) {
+			f.fs.(*versionfs).opts.maxAge = time.Hour
+
+			expect.That(t, is.NoError(fsx.WriteFile(f.fs, "etc/app/config.yaml", []byte("v2"), 0644)))
+			f.now = f.now.Add(30 * time.Minute)
+			expect.That(t, is.NoError(fsx.WriteFile(f.fs, "etc/app/config.yaml", []byte("v3"), 0644)))
+			f.now = f.now.Add(45 * time.Minute)
+			expect.That(t, is.NoError(fsx.WriteFile(f.fs, "etc/app/other.yaml", []byte("other"), 0644)))
+
+			f.expectVersions(t, "etc/app/config.yaml", "v1", "v2")
+
+			expect.That(t, is.NoError(f.fs.Prune()))
+			f.expectVersions(t, "etc/app/config.yaml", "v2")
+
+			f.now = f.now.Add(time.Hour)
+			expect.That(t, is.NoError(f.fs.Prune()))
+			f.expectVersions(t, "etc/app/config.yaml")
+		}).
+		Run("hidden", func(t *testing.T, f *versionfsFixture) {
+			expect.That(t, is.NoError(f.fs.Remove("etc/app/config.yaml")))
+
+			_, err := f.fs.Stat(DefaultHistoryDir)
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+			_, err = f.fs.Open(DefaultHistoryDir + "/etc")
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+			expect.That(t, is.Error(fsx.WriteFile(f.fs, DefaultHistoryDir+"/file", nil, 0644), fs.ErrNotExist))
+
+			entries, err := f.fs.ReadDir(".")
+			expect.That(t, is.NoError(err), is.EqualTo(len(entries), 1), is.EqualTo(entries[0].Name(), "etc"))
+
+			dir, err := f.fs.Open(".")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			entries, err = dir.(fs.ReadDirFile).ReadDir(-1)
+			expect.That(t, is.NoError(err), is.EqualTo(len(entries), 1), is.NoError(dir.Close()))
+		})
+}
+
+func TestNew(t *testing.T) {
+	for _, opts := range [][]Option{
+		{WithHistoryDir(".")},
+		{WithHistoryDir("/versions")},
+		{WithMaxVersions(-1)},
+		{WithMaxAge(-time.Second)},
+	} {
+		_, err := New(memfs.New(), opts...)
+		expect.That(t, is.EqualTo(err != nil, true))
+	}
+}
+
+func TestOSFS(t *testing.T) {
+	fsys, err := New(osfs.DirFS(t.TempDir()), WithHistoryDir("var/history"), WithMaxVersions(1))
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	expect.That(t,
+		is.NoError(fsx.MkdirAll(fsys, "var/data", 0755)),
+		is.NoError(fsx.WriteFile(fsys, "var/data/a.txt", []byte("v1"), 0600)),
+		is.NoError(fsx.WriteFile(fsys, "var/data/a.txt", []byte("v2"), 0600)),
+		is.NoError(fsx.WriteFile(fsys, "var/data/a.txt", []byte("v3"), 0600)),
+	)
+
+	expect.That(t, is.NoError(fstest.TestFS(fsys, "var/data/a.txt")))
+
+	versions, err := fsys.Versions("var/data/a.txt")
+	expect.That(t,
+		expect.FailNow(is.NoError(err)),
+		expect.FailNow(is.EqualTo(len(versions), 1)),
+		is.EqualTo(versions[0].Mode, fs.FileMode(0600)),
+	)
+
+	expect.That(t, is.NoError(fsys.RemoveAll("var")))
+
+	entries, err := fsys.ReadDir("var")
+	expect.That(t, is.NoError(err), is.EqualTo(len(entries), 0))
+
+	// Removing the file recorded v3 and dropped v2.
+	versions, err = fsys.Versions("var/data/a.txt")
+	expect.That(t, expect.FailNow(is.NoError(err)), expect.FailNow(is.EqualTo(len(versions), 1)))
+	expect.That(t, is.NoError(fsys.Restore("var/data/a.txt", versions[0].ID)))
+
+	data, err := fsys.ReadFile("var/data/a.txt")
+	expect.That(t, is.NoError(err), is.EqualTo(string(data), "v3"))
+}
+
+func TestOSFS_symlink(t *testing.T) {
+	fsys, err := New(osfs.DirFS(t.TempDir()))
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	expect.That(t,
+		is.NoError(fsx.WriteFile(fsys, "real.yaml", []byte("v1"), 0644)),
+		is.NoError(fsys.Symlink("real.yaml", "config.yaml")),
+		is.NoError(fsx.WriteFile(fsys, "config.yaml", []byte("v2"), 0644)),
+	)
+
+	file, err := fsys.OpenFile("config.yaml", fsx.O_WRONLY|fsx.O_TRUNC, 0)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	_, err = file.Write([]byte("v3"))
+	expect.That(t, is.NoError(err), is.NoError(file.Close()))
+
+	// Both overwritten contents have been recorded for the link's target.
+	versions, err := fsys.Versions("real.yaml")
+	expect.That(t, expect.FailNow(is.NoError(err)), expect.FailNow(is.EqualTo(len(versions), 2)))
+
+	for i, want := range []string{"v1", "v2"} {
+		f, err := fsys.OpenVersion("real.yaml", versions[i].ID)
+		expect.That(t, expect.FailNow(is.NoError(err)))
+		data, err := io.ReadAll(f)
+		expect.That(t, is.NoError(err), is.EqualTo(string(data), want), is.NoError(f.Close()))
+	}
+
+	target, err := fsys.Readlink("config.yaml")
+	expect.That(t, is.NoError(err), is.EqualTo(target, "real.yaml"))
+}
@@ -0,0 +1,96 @@
+package fsx
+
+import (
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/halimath/fsx/internal/linkutil"
+)
+
+// treeEntry describes a single entry found when walking a tree with walkTree.
+type treeEntry struct {
+	// path of the entry relative to the walked root.
+	path string
+	// info describes the entry. For symlinks it may describe either the link
+	// or its target, depending on the filesystem.
+	info fs.FileInfo
+	// target holds the link target if the entry is a symlink.
+	target string
+	// symlink is true if the entry is a symlink.
+	symlink bool
+}
+
+// mode returns e's mode with the type bits normalized, i.e. symlinks report
+// fs.ModeSymlink regardless of the information returned by the filesystem.
+func (e *treeEntry) mode() fs.FileMode {
+	if e.symlink {
+		return fs.ModeSymlink | e.info.Mode().Perm()
+	}
+	return e.info.Mode()
+}
+
+// walkTree walks the tree rooted at root inside fsys in lexical order and
+// calls fn for every entry matched by filter. The root itself is not
+// reported. Symlinks are detected using Readlink if fsys provides such a
+// method and are never followed.
+func walkTree(fsys fs.FS, root string, filter *Filter, fn func(e treeEntry) error) error {
+	return fs.WalkDir(fsys, root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if p == root {
+			return nil
+		}
+
+		rel := p
+		if root != "." {
+			rel = strings.TrimPrefix(p, root+"/")
+		}
+
+		if !filter.Match(rel, d.IsDir()) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		e := treeEntry{
+			path: rel,
+			info: info,
+		}
+
+		if target, ok := linkutil.Readlink(fsys, p); ok {
+			e.symlink = true
+			e.target = target
+		} else if d.Type()&fs.ModeSymlink != 0 {
+			// The filesystem reports a symlink but does not support reading
+			// its target.
+			e.symlink = true
+		}
+
+		if err := fn(e); err != nil {
+			return err
+		}
+
+		if e.symlink && d.IsDir() {
+			return fs.SkipDir
+		}
+
+		return nil
+	})
+}
+
+// joinPath joins root and name handling the "." root.
+func joinPath(root, name string) string {
+	if root == "." || root == "" {
+		return name
+	}
+	return path.Join(root, name)
+}
@@ -0,0 +1,394 @@
+package webdav
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/halimath/fsx"
+)
+
+// lock describes an exclusive write lock.
+type lock struct {
+	token    string
+	root     string
+	infinite bool
+	owner    string
+	timeout  time.Duration
+	expires  time.Time
+}
+
+// covers reports whether l applies to name.
+func (l *lock) covers(name string) bool {
+	return l.root == name || l.infinite && isDescendant(name, l.root)
+}
+
+// isDescendant reports whether name is located below dir.
+func isDescendant(name, dir string) bool {
+	return dir == "." && name != "." || strings.HasPrefix(name, dir+"/")
+}
+
+// lockManager keeps track of active locks.
+type lockManager struct {
+	mu         sync.Mutex
+	maxTimeout time.Duration
+	locks      map[string]*lock
+	now        func() time.Time
+}
+
+func newLockManager(maxTimeout time.Duration) *lockManager {
+	return &lockManager{
+		maxTimeout: maxTimeout,
+		locks:      make(map[string]*lock),
+		now:        time.Now,
+	}
+}
+
+// expire removes expired locks. m.mu must be held.
+func (m *lockManager) expire() {
+	now := m.now()
+	for t, l := range m.locks {
+		if !now.Before(l.expires) {
+			delete(m.locks, t)
+		}
+	}
+}
+
+// covering returns copies of all locks applying to name sorted by root.
+func (m *lockManager) covering(name string) []lock {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.expire()
+
+	var res []lock
+	for _, l := range m.locks {
+		if l.covers(name) {
+			res = append(res, *l)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].root < res[j].root })
+	return res
+}
+
+// conflicts reports whether a lock not identified by one of tokens applies
+// to name. If tree is set, locks on descendants of name are considered as
+// well.
+func (m *lockManager) conflicts(name string, tree bool, tokens []string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.expire()
+
+	for t, l := range m.locks {
+		if !l.covers(name) && !(tree && isDescendant(l.root, name)) {
+			continue
+		}
+
+		submitted := false
+		for _, s := range tokens {
+			if s == t {
+				submitted = true
+				break
+			}
+		}
+
+		if !submitted {
+			return true
+		}
+	}
+
+	return false
+}
+
+// create creates a new lock for name. It returns nil if a conflicting lock
+// exists.
+func (m *lockManager) create(name string, infinite bool, owner string, timeout time.Duration) *lock {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.expire()
+
+	for _, l := range m.locks {
+		if l.covers(name) || infinite && isDescendant(l.root, name) {
+			return nil
+		}
+	}
+
+	var b [16]byte
+	rand.Read(b[:])
+
+	l := &lock{
+		token:    "opaquelocktoken:" + hex.EncodeToString(b[:]),
+		root:     name,
+		infinite: infinite,
+		owner:    owner,
+	}
+	m.refreshLock(l, timeout)
+	m.locks[l.token] = l
+
+	return l
+}
+
+func (m *lockManager) refreshLock(l *lock, timeout time.Duration) {
+	if timeout <= 0 || timeout > m.maxTimeout {
+		timeout = m.maxTimeout
+	}
+	l.timeout = timeout
+	l.expires = m.now().Add(timeout)
+}
+
+// refresh extends the timeout of the first lock identified by tokens which
+// applies to name.
+func (m *lockManager) refresh(name string, tokens []string, timeout time.Duration) (lock, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.expire()
+
+	for _, t := range tokens {
+		if l, ok := m.locks[t]; ok && l.covers(name) {
+			m.refreshLock(l, timeout)
+			return *l, true
+		}
+	}
+
+	return lock{}, false
+}
+
+// unlock removes the lock identified by token if it applies to name.
+func (m *lockManager) unlock(name, token string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.expire()
+
+	l, ok := m.locks[token]
+	if !ok || !l.covers(name) {
+		return false
+	}
+
+	delete(m.locks, token)
+	return true
+}
+
+// removeTree removes all locks rooted at name or one of its descendants.
+func (m *lockManager) removeTree(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for t, l := range m.locks {
+		if l.root == name || isDescendant(l.root, name) {
+			delete(m.locks, t)
+		}
+	}
+}
+
+// ifTokens returns the state tokens contained in r's If header.
+func ifTokens(r *http.Request) []string {
+	var tokens []string
+
+	h := r.Header.Get("If")
+	depth := 0
+	for i := 0; i < len(h); i++ {
+		switch h[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case '<':
+			end := strings.IndexByte(h[i:], '>')
+			if end < 0 {
+				return tokens
+			}
+			if depth > 0 {
+				tokens = append(tokens, h[i+1:i+end])
+			}
+			i += end
+		}
+	}
+
+	return tokens
+}
+
+// checkLocks returns http.StatusLocked if one of names is locked by a lock
+// whose token has not been submitted with r. If tree is set, locks on
+// descendants of names are considered as well.
+func (h *Handler) checkLocks(r *http.Request, tree bool, names ...string) int {
+	if h.locks == nil {
+		return 0
+	}
+
+	tokens := ifTokens(r)
+	for _, n := range names {
+		if h.locks.conflicts(n, tree, tokens) {
+			return http.StatusLocked
+		}
+	}
+
+	return 0
+}
+
+// parseTimeout parses the Timeout header. It returns 0 for infinite or
+// missing timeouts.
+func parseTimeout(v string) time.Duration {
+	for _, t := range strings.Split(v, ",") {
+		t = strings.TrimSpace(t)
+		if s, ok := strings.CutPrefix(t, "Second-"); ok {
+			if n, err := strconv.ParseInt(s, 10, 64); err == nil && n > 0 {
+				return time.Duration(n) * time.Second
+			}
+		}
+	}
+	return 0
+}
+
+type lockInfo struct {
+	XMLName   xml.Name `xml:"DAV: lockinfo"`
+	LockScope struct {
+		Exclusive *struct{} `xml:"DAV: exclusive"`
+		Shared    *struct{} `xml:"DAV: shared"`
+	} `xml:"DAV: lockscope"`
+	LockType struct {
+		Write *struct{} `xml:"DAV: write"`
+	} `xml:"DAV: locktype"`
+	Owner struct {
+		InnerXML string `xml:",innerxml"`
+	} `xml:"DAV: owner"`
+}
+
+// activeLock renders l as a DAV:activelock element.
+func (h *Handler) activeLock(l lock) string {
+	depth := "0"
+	if l.infinite {
+		depth = "infinity"
+	}
+
+	var b strings.Builder
+	b.WriteString("<D:activelock>")
+	b.WriteString("<D:locktype><D:write/></D:locktype>")
+	b.WriteString("<D:lockscope><D:exclusive/></D:lockscope>")
+	b.WriteString("<D:depth>" + depth + "</D:depth>")
+	if l.owner != "" {
+		b.WriteString("<D:owner>" + l.owner + "</D:owner>")
+	}
+	b.WriteString("<D:timeout>Second-" + strconv.FormatInt(int64(l.timeout/time.Second), 10) + "</D:timeout>")
+	b.WriteString("<D:locktoken><D:href>" + escape(l.token) + "</D:href></D:locktoken>")
+	b.WriteString("<D:lockroot><D:href>" + escape(h.href(l.root, h.isDir(l.root))) + "</D:href></D:lockroot>")
+	b.WriteString("</D:activelock>")
+	return b.String()
+}
+
+func (h *Handler) writeLock(w http.ResponseWriter, l lock, status int) {
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.Header().Set("Lock-Token", "<"+l.token+">")
+	w.WriteHeader(status)
+
+	io.WriteString(w, xml.Header)
+	io.WriteString(w, `<D:prop xmlns:D="DAV:"><D:lockdiscovery>`+h.activeLock(l)+`</D:lockdiscovery></D:prop>`)
+}
+
+func (h *Handler) handleLock(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	if h.locks == nil {
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	timeout := parseTimeout(r.Header.Get("Timeout"))
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return http.StatusBadRequest, nil
+	}
+
+	if len(strings.TrimSpace(string(body))) == 0 {
+		// Refresh an existing lock.
+		l, ok := h.locks.refresh(name, ifTokens(r), timeout)
+		if !ok {
+			return http.StatusPreconditionFailed, nil
+		}
+
+		h.writeLock(w, l, http.StatusOK)
+		return 0, nil
+	}
+
+	var info lockInfo
+	if err := xml.Unmarshal(body, &info); err != nil {
+		return http.StatusBadRequest, nil
+	}
+
+	if info.LockScope.Exclusive == nil || info.LockType.Write == nil {
+		return http.StatusNotImplemented, nil
+	}
+
+	infinite := true
+	switch r.Header.Get("Depth") {
+	case "", "infinity":
+	case "0":
+		infinite = false
+	default:
+		return http.StatusBadRequest, nil
+	}
+
+	exists, err := h.exists(name)
+	if err != nil {
+		return 0, err
+	}
+
+	if !exists {
+		if !h.isDir(path.Dir(name)) {
+			return http.StatusConflict, nil
+		}
+
+		if status := h.checkLocks(r, false, path.Dir(name)); status != 0 {
+			return status, nil
+		}
+	}
+
+	l := h.locks.create(name, infinite, strings.TrimSpace(info.Owner.InnerXML), timeout)
+	if l == nil {
+		return http.StatusLocked, nil
+	}
+
+	status := http.StatusOK
+	if !exists {
+		// Locking an unmapped URL creates an empty resource.
+		f, err := h.fsys.OpenFile(name, fsx.O_WRONLY|fsx.O_CREATE, 0644)
+		if err == nil {
+			err = f.Close()
+		}
+		if err != nil {
+			h.locks.unlock(name, l.token)
+			return 0, err
+		}
+		status = http.StatusCreated
+	}
+
+	h.writeLock(w, *l, status)
+	return 0, nil
+}
+
+func (h *Handler) handleUnlock(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	if h.locks == nil {
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	token := strings.TrimSpace(r.Header.Get("Lock-Token"))
+	token = strings.TrimSuffix(strings.TrimPrefix(token, "<"), ">")
+	if token == "" {
+		return http.StatusBadRequest, nil
+	}
+
+	if !h.locks.unlock(name, token) {
+		return http.StatusConflict, nil
+	}
+
+	return http.StatusNoContent, nil
+}
@@ -0,0 +1,160 @@
+package webdav
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	. "github.com/halimath/fixture"
+)
+
+const lockBody = `<?xml version="1.0"?>
+<D:lockinfo xmlns:D="DAV:">
+<D:lockscope><D:exclusive/></D:lockscope>
+<D:locktype><D:write/></D:locktype>
+<D:owner><D:href>mailto:jane@example.com</D:href></D:owner>
+</D:lockinfo>`
+
+func TestHandler_lock(t *testing.T) {
+	With(t, new(webdavFixture)).
+		Run("lockAndUnlock", func(t *testing.T, f *webdavFixture) {
+			status, h, body := f.do(t, "LOCK", "/docs", lockBody, "Timeout", "Second-60")
+			token := strings.Trim(h.Get("Lock-Token"), "<>")
+			expect.That(t,
+				is.EqualTo(status, http.StatusOK),
+				is.EqualTo(strings.HasPrefix(token, "opaquelocktoken:"), true),
+				is.EqualTo(strings.Contains(body, "<D:timeout>Second-60</D:timeout>"), true),
+				is.EqualTo(strings.Contains(body, "<D:depth>infinity</D:depth>"), true),
+				is.EqualTo(strings.Contains(body, "mailto:jane@example.com"), true),
+			)
+
+			status, _, _ = f.do(t, http.MethodPut, "/docs/drafts/plan.md", "changed")
+			expect.That(t, is.EqualTo(status, http.StatusLocked))
+
+			status, _, _ = f.do(t, http.MethodDelete, "/docs/drafts", "")
+			expect.That(t, is.EqualTo(status, http.StatusLocked))
+
+			status, _, _ = f.do(t, "LOCK", "/docs/readme.txt", lockBody)
+			expect.That(t, is.EqualTo(status, http.StatusLocked))
+
+			status, _, _ = f.do(t, http.MethodPut, "/docs/drafts/plan.md", "changed", "If", "(<"+token+">)")
+			expect.That(t, is.EqualTo(status, http.StatusNoContent))
+
+			status, _, body = f.do(t, "PROPFIND", "/docs/readme.txt", "", "Depth", "0")
+			expect.That(t,
+				is.EqualTo(status, http.StatusMultiStatus),
+				is.EqualTo(strings.Contains(body, token), true),
+				is.EqualTo(strings.Contains(body, "<D:lockroot><D:href>/docs/</D:href></D:lockroot>"), true),
+			)
+
+			status, _, _ = f.do(t, "UNLOCK", "/docs/readme.txt", "", "Lock-Token", "<"+token+">")
+			expect.That(t, is.EqualTo(status, http.StatusNoContent))
+
+			status, _, _ = f.do(t, "UNLOCK", "/docs", "", "Lock-Token", "<"+token+">")
+			expect.That(t, is.EqualTo(status, http.StatusConflict))
+
+			status, _, _ = f.do(t, http.MethodPut, "/docs/drafts/plan.md", "changed again")
+			expect.That(t, is.EqualTo(status, http.StatusNoContent))
+		}).
+		Run("lockParentOfLocked", func(t *testing.T, f *webdavFixture) {
+			status, _, _ := f.do(t, "LOCK", "/docs/readme.txt", lockBody, "Depth", "0")
+			expect.That(t, is.EqualTo(status, http.StatusOK))
+
+			status, _, _ = f.do(t, "LOCK", "/docs", lockBody)
+			expect.That(t, is.EqualTo(status, http.StatusLocked))
+
+			status, _, _ = f.do(t, "LOCK", "/docs", lockBody, "Depth", "0")
+			expect.That(t, is.EqualTo(status, http.StatusOK))
+
+			status, _, _ = f.do(t, "LOCK", "/docs", lockBody, "Depth", "1")
+			expect.That(t, is.EqualTo(status, http.StatusBadRequest))
+		}).
+		Run("lockUnmapped", func(t *testing.T, f *webdavFixture) {
+			status, _, _ := f.do(t, "LOCK", "/docs/new.txt", lockBody)
+			expect.That(t, is.EqualTo(status, http.StatusCreated))
+
+			status, _, body := f.do(t, http.MethodGet, "/docs/new.txt", "")
+			expect.That(t, is.EqualTo(status, http.StatusOK), is.EqualTo(body, ""))
+
+			status, _, _ = f.do(t, "LOCK", "/missing/new.txt", lockBody)
+			expect.That(t, is.EqualTo(status, http.StatusConflict))
+		}).
+		Run("refresh", func(t *testing.T, f *webdavFixture) {
+			_, h, _ := f.do(t, "LOCK", "/docs", lockBody, "Timeout", "Second-60")
+			token := strings.Trim(h.Get("Lock-Token"), "<>")
+
+			status, _, body := f.do(t, "LOCK", "/docs/readme.txt", "", "If", "(<"+token+">)", "Timeout", "Infinite, Second-7200")
+			expect.That(t,
+				is.EqualTo(status, http.StatusOK),
+				is.EqualTo(strings.Contains(body, "<D:timeout>Second-3600</D:timeout>"), true),
+			)
+
+			status, _, _ = f.do(t, "LOCK", "/docs", "", "If", "(<opaquelocktoken:unknown>)")
+			expect.That(t, is.EqualTo(status, http.StatusPreconditionFailed))
+		}).
+		Run("shared", func(t *testing.T, f *webdavFixture) {
+			status, _, _ := f.do(t, "LOCK", "/docs", strings.Replace(lockBody, "exclusive", "shared", 1))
+			expect.That(t, is.EqualTo(status, http.StatusNotImplemented))
+		}).
+		Run("moveReleasesLocks", func(t *testing.T, f *webdavFixture) {
+			_, h, _ := f.do(t, "LOCK", "/docs/drafts", lockBody)
+			token := strings.Trim(h.Get("Lock-Token"), "<>")
+
+			status, _, _ := f.do(t, "MOVE", "/docs/drafts", "", "Destination", "/drafts")
+			expect.That(t, is.EqualTo(status, http.StatusLocked))
+
+			status, _, _ = f.do(t, "MOVE", "/docs/drafts", "", "Destination", "/drafts", "If", "(<"+token+">)")
+			expect.That(t, is.EqualTo(status, http.StatusCreated))
+
+			status, _, _ = f.do(t, http.MethodPut, "/drafts/plan.md", "changed")
+			expect.That(t, is.EqualTo(status, http.StatusNoContent))
+		})
+}
+
+func TestHandler_lockDisabled(t *testing.T) {
+	f := new(webdavFixture)
+	expect.That(t, expect.FailNow(is.NoError(f.BeforeEach(t))))
+	defer f.AfterEach(t)
+
+	f.srv.Config.Handler = New(f.fs)
+
+	status, h, _ := f.do(t, http.MethodOptions, "/", "")
+	expect.That(t, is.EqualTo(status, http.StatusOK), is.EqualTo(h.Get("DAV"), "1"))
+
+	status, _, _ = f.do(t, "LOCK", "/docs", lockBody)
+	expect.That(t, is.EqualTo(status, http.StatusMethodNotAllowed))
+}
+
+func TestLockManager_expire(t *testing.T) {
+	now := time.Date(2023, 11, 14, 0, 0, 0, 0, time.UTC)
+
+	m := newLockManager(time.Minute)
+	m.now = func() time.Time { return now }
+
+	l := m.create("docs", true, "", 0)
+	expect.That(t,
+		expect.FailNow(is.EqualTo(l != nil, true)),
+		is.EqualTo(l.timeout, time.Minute),
+		is.EqualTo(m.conflicts("docs/readme.txt", false, nil), true),
+		is.EqualTo(m.conflicts("docs/readme.txt", false, []string{l.token}), false),
+		is.EqualTo(m.conflicts(".", true, nil), true),
+		is.EqualTo(m.conflicts(".", false, nil), false),
+	)
+
+	now = now.Add(time.Minute)
+
+	expect.That(t,
+		is.EqualTo(m.conflicts("docs/readme.txt", false, nil), false),
+		is.SliceOfLen(m.covering("docs"), 0),
+	)
+}
+
+func TestIfTokens(t *testing.T) {
+	r, _ := http.NewRequest("PUT", "/", nil)
+	r.Header.Set("If", `</docs> (<opaquelocktoken:a> ["etag"]) (Not <opaquelocktoken:b>)`)
+
+	expect.That(t, is.DeepEqualTo(ifTokens(r), []string{"opaquelocktoken:a", "opaquelocktoken:b"}))
+}
@@ -0,0 +1,390 @@
+package webdav
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/halimath/fsx"
+)
+
+const davNS = "DAV:"
+
+// liveProps lists the names of all supported properties in namespace DAV:.
+var liveProps = []string{
+	"resourcetype",
+	"displayname",
+	"getcontentlength",
+	"getcontenttype",
+	"getlastmodified",
+	"getetag",
+}
+
+// lockProps lists the properties supported if locking is enabled.
+var lockProps = []string{
+	"supportedlock",
+	"lockdiscovery",
+}
+
+type propfindRequest struct {
+	XMLName  xml.Name  `xml:"DAV: propfind"`
+	AllProp  *struct{} `xml:"DAV: allprop"`
+	PropName *struct{} `xml:"DAV: propname"`
+	Prop     *struct {
+		Names []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	} `xml:"DAV: prop"`
+}
+
+type propertyUpdate struct {
+	XMLName xml.Name `xml:"DAV: propertyupdate"`
+	Ops     []struct {
+		XMLName xml.Name
+		Prop    struct {
+			Props []struct {
+				XMLName xml.Name
+				Value   string `xml:",chardata"`
+			} `xml:",any"`
+		} `xml:"DAV: prop"`
+	} `xml:",any"`
+}
+
+// multistatus builds the XML body of a 207 Multi-Status response.
+type multistatus struct {
+	b strings.Builder
+}
+
+func newMultistatus() *multistatus {
+	m := &multistatus{}
+	m.b.WriteString(xml.Header)
+	m.b.WriteString(`<D:multistatus xmlns:D="DAV:">`)
+	return m
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// propElement renders an element for the property n with inner XML value.
+func propElement(n xml.Name, value string) string {
+	if n.Space == davNS {
+		if value == "" {
+			return "<D:" + n.Local + "/>"
+		}
+		return "<D:" + n.Local + ">" + value + "</D:" + n.Local + ">"
+	}
+
+	attr := ""
+	if n.Space != "" {
+		attr = ` xmlns="` + escape(n.Space) + `"`
+	}
+
+	if value == "" {
+		return "<" + n.Local + attr + "/>"
+	}
+	return "<" + n.Local + attr + ">" + value + "</" + n.Local + ">"
+}
+
+// propstat describes properties sharing a status.
+type propstat struct {
+	status int
+	names  []xml.Name
+	values []string
+}
+
+func (p *propstat) add(n xml.Name, value string) {
+	p.names = append(p.names, n)
+	p.values = append(p.values, value)
+}
+
+func (m *multistatus) response(href string, stats ...*propstat) {
+	m.b.WriteString("<D:response><D:href>" + escape(href) + "</D:href>")
+	for _, ps := range stats {
+		if len(ps.names) == 0 {
+			continue
+		}
+
+		m.b.WriteString("<D:propstat><D:prop>")
+		for i, n := range ps.names {
+			m.b.WriteString(propElement(n, ps.values[i]))
+		}
+		m.b.WriteString("</D:prop>")
+		m.b.WriteString("<D:status>HTTP/1.1 " + strconv.Itoa(ps.status) + " " + http.StatusText(ps.status) + "</D:status>")
+		m.b.WriteString("</D:propstat>")
+	}
+	m.b.WriteString("</D:response>")
+}
+
+func (m *multistatus) write(w http.ResponseWriter) {
+	m.b.WriteString("</D:multistatus>")
+
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, m.b.String())
+}
+
+// props returns the names of all properties supported by h.
+func (h *Handler) props() []string {
+	if h.locks != nil {
+		return append(append([]string(nil), liveProps...), lockProps...)
+	}
+	return liveProps
+}
+
+// propValue returns the inner XML of property prop for name.
+func (h *Handler) propValue(name string, info fs.FileInfo, prop string) (string, bool) {
+	switch prop {
+	case "resourcetype":
+		if info.IsDir() {
+			return "<D:collection/>", true
+		}
+		return "", true
+
+	case "displayname":
+		if name == "." {
+			return "", true
+		}
+		return escape(path.Base(name)), true
+
+	case "getcontentlength":
+		if info.IsDir() {
+			return "", false
+		}
+		return strconv.FormatInt(info.Size(), 10), true
+
+	case "getcontenttype":
+		if info.IsDir() {
+			return "", false
+		}
+		t := mime.TypeByExtension(path.Ext(name))
+		if t == "" {
+			t = "application/octet-stream"
+		}
+		return escape(t), true
+
+	case "getlastmodified":
+		return info.ModTime().UTC().Format(http.TimeFormat), true
+
+	case "getetag":
+		if info.IsDir() {
+			return "", false
+		}
+		return escape(etag(info)), true
+
+	case "supportedlock":
+		if h.locks == nil {
+			return "", false
+		}
+		return "<D:lockentry><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>", true
+
+	case "lockdiscovery":
+		if h.locks == nil {
+			return "", false
+		}
+		var b strings.Builder
+		for _, l := range h.locks.covering(name) {
+			b.WriteString(h.activeLock(l))
+		}
+		return b.String(), true
+	}
+
+	return "", false
+}
+
+func (h *Handler) handlePropfind(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	depth := -1
+	switch r.Header.Get("Depth") {
+	case "0":
+		depth = 0
+	case "1":
+		depth = 1
+	case "", "infinity":
+	default:
+		return http.StatusBadRequest, nil
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return http.StatusBadRequest, nil
+	}
+
+	var req propfindRequest
+	if len(strings.TrimSpace(string(body))) > 0 {
+		if err := xml.Unmarshal(body, &req); err != nil {
+			return http.StatusBadRequest, nil
+		}
+	}
+
+	info, err := fs.Stat(h.fsys, name)
+	if err != nil {
+		return 0, err
+	}
+
+	m := newMultistatus()
+
+	var walk func(name string, info fs.FileInfo, depth int) error
+	walk = func(name string, info fs.FileInfo, depth int) error {
+		h.propfindResponse(m, name, info, &req)
+
+		if !info.IsDir() || depth == 0 {
+			return nil
+		}
+
+		entries, err := fs.ReadDir(h.fsys, name)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			child := path.Join(name, e.Name())
+
+			ci, err := fs.Stat(h.fsys, child)
+			if err != nil {
+				// Skip dangling symlinks.
+				continue
+			}
+
+			d := depth - 1
+			if e.Type()&fs.ModeSymlink != 0 || h.isSymlink(child) {
+				d = 0
+			}
+
+			if err := walk(child, ci, d); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if err := walk(name, info, depth); err != nil {
+		return 0, err
+	}
+
+	m.write(w)
+	return 0, nil
+}
+
+func (h *Handler) propfindResponse(m *multistatus, name string, info fs.FileInfo, req *propfindRequest) {
+	found := &propstat{status: http.StatusOK}
+	missing := &propstat{status: http.StatusNotFound}
+
+	switch {
+	case req.PropName != nil:
+		for _, p := range h.props() {
+			if _, ok := h.propValue(name, info, p); ok {
+				found.add(xml.Name{Space: davNS, Local: p}, "")
+			}
+		}
+
+	case req.Prop != nil:
+		for _, n := range req.Prop.Names {
+			if n.XMLName.Space == davNS {
+				if v, ok := h.propValue(name, info, n.XMLName.Local); ok {
+					found.add(n.XMLName, v)
+					continue
+				}
+			}
+			missing.add(n.XMLName, "")
+		}
+
+	default:
+		for _, p := range h.props() {
+			if v, ok := h.propValue(name, info, p); ok {
+				found.add(xml.Name{Space: davNS, Local: p}, v)
+			}
+		}
+	}
+
+	m.response(h.href(name, info.IsDir()), found, missing)
+}
+
+func (h *Handler) handleProppatch(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	if status := h.checkLocks(r, false, name); status != 0 {
+		return status, nil
+	}
+
+	info, err := fs.Stat(h.fsys, name)
+	if err != nil {
+		return 0, err
+	}
+
+	var req propertyUpdate
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		return http.StatusBadRequest, nil
+	}
+
+	cfs, canChtimes := h.fsys.(fsx.ChtimesFS)
+
+	type change struct {
+		name  xml.Name
+		mtime time.Time
+		err   int
+	}
+
+	var changes []change
+	failed := false
+
+	for _, op := range req.Ops {
+		if op.XMLName.Space != davNS || (op.XMLName.Local != "set" && op.XMLName.Local != "remove") {
+			continue
+		}
+
+		for _, p := range op.Prop.Props {
+			c := change{name: p.XMLName, err: http.StatusForbidden}
+
+			if op.XMLName.Local == "set" && p.XMLName.Space == davNS && p.XMLName.Local == "getlastmodified" && canChtimes {
+				if t, err := http.ParseTime(strings.TrimSpace(p.Value)); err == nil {
+					c.mtime = t
+					c.err = 0
+				} else {
+					c.err = http.StatusConflict
+				}
+			}
+
+			failed = failed || c.err != 0
+			changes = append(changes, c)
+		}
+	}
+
+	ok := &propstat{status: http.StatusOK}
+	forbidden := &propstat{status: http.StatusForbidden}
+	conflict := &propstat{status: http.StatusConflict}
+	dependency := &propstat{status: http.StatusFailedDependency}
+
+	for _, c := range changes {
+		switch {
+		case c.err == http.StatusForbidden:
+			forbidden.add(c.name, "")
+		case c.err == http.StatusConflict:
+			conflict.add(c.name, "")
+		case failed:
+			dependency.add(c.name, "")
+		default:
+			if err := cfs.Chtimes(name, time.Now(), c.mtime); err != nil {
+				if errors.Is(err, fsx.ErrNotSupported) {
+					forbidden.add(c.name, "")
+					continue
+				}
+				return 0, err
+			}
+			ok.add(c.name, "")
+		}
+	}
+
+	m := newMultistatus()
+	m.response(h.href(name, info.IsDir()), ok, forbidden, conflict, dependency)
+	m.write(w)
+
+	return 0, nil
+}
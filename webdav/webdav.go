@@ -0,0 +1,525 @@
+// Package webdav provides a http.Handler serving a fsx.FS using the WebDAV
+// protocol as defined in RFC 4918.
+//
+// The handler supports the methods OPTIONS, GET, HEAD, PUT, MKCOL, DELETE,
+// COPY, MOVE, PROPFIND and PROPPATCH. LOCK and UNLOCK are supported if
+// locking is enabled using WithLocking; locks are kept in memory and only
+// exclusive write locks are supported.
+//
+// Only live properties are supported. The last modification time
+// (DAV:getlastmodified) can be changed using PROPPATCH if the filesystem
+// satisfies fsx.ChtimesFS. The same applies to the X-OC-Mtime header sent by
+// some clients with PUT requests.
+//
+// Symlinks are handled as on a local filesystem: reading and writing follows
+// them, DELETE and MOVE operate on the link itself and COPY recreates the link
+// if the filesystem satisfies fsx.LinkFS. PROPFIND does not descend into
+// symlinked directories.
+package webdav
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/halimath/fsx"
+)
+
+// Option defines a functional option for New.
+type Option func(*Handler)
+
+// WithPrefix sets the URL path prefix to strip from request paths, e.g. when
+// mounting the handler using http.StripPrefix is not desired. The prefix is
+// also prepended to hrefs contained in responses.
+func WithPrefix(prefix string) Option {
+	return func(h *Handler) {
+		h.prefix = strings.TrimSuffix(prefix, "/")
+	}
+}
+
+// WithLocking enables the LOCK and UNLOCK methods. Locks are kept in memory
+// and expire after the timeout requested by the client but at most after
+// maxTimeout.
+func WithLocking(maxTimeout time.Duration) Option {
+	return func(h *Handler) {
+		h.locks = newLockManager(maxTimeout)
+	}
+}
+
+// Handler implements a WebDAV server for a fsx.FS.
+type Handler struct {
+	fsys   fsx.FS
+	prefix string
+	locks  *lockManager
+}
+
+// New creates a new Handler serving fsys.
+func New(fsys fsx.FS, opts ...Option) *Handler {
+	h := &Handler{fsys: fsys}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// ServeHTTP dispatches r to the method's handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, ok := h.name(r.URL.Path)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	var status int
+	var err error
+
+	switch r.Method {
+	case http.MethodOptions:
+		status, err = h.handleOptions(w, r, name)
+	case http.MethodGet, http.MethodHead:
+		status, err = h.handleGet(w, r, name)
+	case http.MethodPut:
+		status, err = h.handlePut(w, r, name)
+	case "MKCOL":
+		status, err = h.handleMkcol(w, r, name)
+	case http.MethodDelete:
+		status, err = h.handleDelete(w, r, name)
+	case "COPY", "MOVE":
+		status, err = h.handleCopyMove(w, r, name)
+	case "PROPFIND":
+		status, err = h.handlePropfind(w, r, name)
+	case "PROPPATCH":
+		status, err = h.handleProppatch(w, r, name)
+	case "LOCK":
+		status, err = h.handleLock(w, r, name)
+	case "UNLOCK":
+		status, err = h.handleUnlock(w, r, name)
+	default:
+		status = http.StatusMethodNotAllowed
+	}
+
+	if err != nil {
+		status = StatusCode(err)
+	}
+
+	if status != 0 {
+		w.WriteHeader(status)
+		if status != http.StatusNoContent && status != http.StatusNotModified && r.Method != http.MethodHead {
+			io.WriteString(w, http.StatusText(status))
+		}
+	}
+}
+
+// StatusCode returns the HTTP status code used to report err.
+func StatusCode(err error) int {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return http.StatusForbidden
+	case errors.Is(err, fs.ErrExist), errors.Is(err, fsx.ErrDirNotEmpty):
+		return http.StatusConflict
+	case errors.Is(err, fs.ErrInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, fsx.ErrNotSupported):
+		return http.StatusNotImplemented
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// name converts the request path p into a name in h.fsys.
+func (h *Handler) name(p string) (string, bool) {
+	if h.prefix != "" {
+		if p != h.prefix && !strings.HasPrefix(p, h.prefix+"/") {
+			return "", false
+		}
+		p = p[len(h.prefix):]
+	}
+
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		p = "."
+	}
+
+	return p, fs.ValidPath(p)
+}
+
+// href returns the escaped URL path for name.
+func (h *Handler) href(name string, dir bool) string {
+	u := url.URL{Path: h.prefix + "/"}
+	if name != "." {
+		u.Path += name
+		if dir {
+			u.Path += "/"
+		}
+	}
+	return u.EscapedPath()
+}
+
+// isSymlink reports whether name is a symlink.
+func (h *Handler) isSymlink(name string) bool {
+	lfs, ok := h.fsys.(fsx.LinkFS)
+	if !ok {
+		return false
+	}
+
+	_, err := lfs.Readlink(name)
+	return err == nil
+}
+
+// exists reports whether name exists. A dangling symlink exists.
+func (h *Handler) exists(name string) (bool, error) {
+	_, err := fs.Stat(h.fsys, name)
+	if err == nil {
+		return true, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	return h.isSymlink(name), nil
+}
+
+// isDir reports whether name is an existing directory.
+func (h *Handler) isDir(name string) bool {
+	info, err := fs.Stat(h.fsys, name)
+	return err == nil && info.IsDir()
+}
+
+// remove removes name. Directories are removed recursively, symlinks are
+// removed without following them.
+func (h *Handler) remove(name string) error {
+	if h.isSymlink(name) || !h.isDir(name) {
+		return h.fsys.Remove(name)
+	}
+	return fsx.RemoveAll(h.fsys, name)
+}
+
+func etag(info fs.FileInfo) string {
+	return fmt.Sprintf(`"%x%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+func (h *Handler) handleOptions(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	allow := "OPTIONS, GET, HEAD, PUT, DELETE, MKCOL, COPY, MOVE, PROPFIND, PROPPATCH"
+	dav := "1"
+	if h.locks != nil {
+		allow += ", LOCK, UNLOCK"
+		dav = "1, 2"
+	}
+
+	w.Header().Set("Allow", allow)
+	w.Header().Set("DAV", dav)
+	w.Header().Set("MS-Author-Via", "DAV")
+
+	return http.StatusOK, nil
+}
+
+func (h *Handler) handleGet(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	info, err := fs.Stat(h.fsys, name)
+	if err != nil {
+		return 0, err
+	}
+
+	if info.IsDir() {
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	f, err := h.fsys.OpenFile(name, fsx.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	w.Header().Set("ETag", etag(info))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+
+	return 0, nil
+}
+
+func (h *Handler) handlePut(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	if name == "." {
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	if status := h.checkLocks(r, false, name, path.Dir(name)); status != 0 {
+		return status, nil
+	}
+
+	info, err := fs.Stat(h.fsys, name)
+	existed := err == nil
+	if existed && info.IsDir() {
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	if !h.isDir(path.Dir(name)) {
+		return http.StatusConflict, nil
+	}
+
+	f, err := h.fsys.OpenFile(name, fsx.O_WRONLY|fsx.O_CREATE|fsx.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = io.Copy(f, r.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if mtime := r.Header.Get("X-OC-Mtime"); mtime != "" {
+		if cfs, ok := h.fsys.(fsx.ChtimesFS); ok {
+			if sec, err := strconv.ParseInt(mtime, 10, 64); err == nil {
+				if err := cfs.Chtimes(name, time.Now(), time.Unix(sec, 0)); err != nil {
+					return 0, err
+				}
+				w.Header().Set("X-OC-Mtime", "accepted")
+			}
+		}
+	}
+
+	if info, err := fs.Stat(h.fsys, name); err == nil {
+		w.Header().Set("ETag", etag(info))
+	}
+
+	if existed {
+		return http.StatusNoContent, nil
+	}
+	return http.StatusCreated, nil
+}
+
+func (h *Handler) handleMkcol(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	if r.ContentLength > 0 {
+		return http.StatusUnsupportedMediaType, nil
+	}
+
+	if status := h.checkLocks(r, false, name, path.Dir(name)); status != 0 {
+		return status, nil
+	}
+
+	exists, err := h.exists(name)
+	if err != nil {
+		return 0, err
+	}
+	if exists {
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	if !h.isDir(path.Dir(name)) {
+		return http.StatusConflict, nil
+	}
+
+	if err := h.fsys.Mkdir(name, 0755); err != nil {
+		return 0, err
+	}
+
+	return http.StatusCreated, nil
+}
+
+func (h *Handler) handleDelete(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	if name == "." {
+		return http.StatusForbidden, nil
+	}
+
+	exists, err := h.exists(name)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return http.StatusNotFound, nil
+	}
+
+	if status := h.checkLocks(r, true, name); status != 0 {
+		return status, nil
+	}
+	if status := h.checkLocks(r, false, path.Dir(name)); status != 0 {
+		return status, nil
+	}
+
+	if err := h.remove(name); err != nil {
+		return 0, err
+	}
+
+	if h.locks != nil {
+		h.locks.removeTree(name)
+	}
+
+	return http.StatusNoContent, nil
+}
+
+func (h *Handler) handleCopyMove(w http.ResponseWriter, r *http.Request, src string) (int, error) {
+	dst, status := h.destination(r)
+	if status != 0 {
+		return status, nil
+	}
+
+	move := r.Method == "MOVE"
+
+	recursive := true
+	switch r.Header.Get("Depth") {
+	case "", "infinity":
+	case "0":
+		if move {
+			return http.StatusBadRequest, nil
+		}
+		recursive = false
+	default:
+		return http.StatusBadRequest, nil
+	}
+
+	if src == dst || src == "." || dst == "." || strings.HasPrefix(dst, src+"/") {
+		return http.StatusForbidden, nil
+	}
+
+	exists, err := h.exists(src)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return http.StatusNotFound, nil
+	}
+
+	if move {
+		if status := h.checkLocks(r, true, src); status != 0 {
+			return status, nil
+		}
+		if status := h.checkLocks(r, false, path.Dir(src)); status != 0 {
+			return status, nil
+		}
+	}
+	if status := h.checkLocks(r, true, dst); status != 0 {
+		return status, nil
+	}
+	if status := h.checkLocks(r, false, path.Dir(dst)); status != 0 {
+		return status, nil
+	}
+
+	if !h.isDir(path.Dir(dst)) {
+		return http.StatusConflict, nil
+	}
+
+	dstExists, err := h.exists(dst)
+	if err != nil {
+		return 0, err
+	}
+
+	if dstExists {
+		if r.Header.Get("Overwrite") == "F" {
+			return http.StatusPreconditionFailed, nil
+		}
+
+		if err := h.remove(dst); err != nil {
+			return 0, err
+		}
+
+		if h.locks != nil {
+			h.locks.removeTree(dst)
+		}
+	}
+
+	if move {
+		if err := h.fsys.Rename(src, dst); err != nil {
+			return 0, err
+		}
+
+		if h.locks != nil {
+			h.locks.removeTree(src)
+		}
+	} else if err := h.copy(src, dst, recursive); err != nil {
+		return 0, err
+	}
+
+	if dstExists {
+		return http.StatusNoContent, nil
+	}
+	return http.StatusCreated, nil
+}
+
+// destination returns the name referred to by the Destination header.
+func (h *Handler) destination(r *http.Request) (string, int) {
+	d := r.Header.Get("Destination")
+	if d == "" {
+		return "", http.StatusBadRequest
+	}
+
+	u, err := url.Parse(d)
+	if err != nil {
+		return "", http.StatusBadRequest
+	}
+
+	if u.Host != "" && u.Host != r.Host {
+		return "", http.StatusBadGateway
+	}
+
+	name, ok := h.name(u.Path)
+	if !ok {
+		return "", http.StatusBadGateway
+	}
+
+	return name, 0
+}
+
+// copy copies src to dst. Symlinks are recreated if h.fsys satisfies
+// fsx.LinkFS. If recursive is false, only the directory src is created
+// without its content.
+func (h *Handler) copy(src, dst string, recursive bool) error {
+	if lfs, ok := h.fsys.(fsx.LinkFS); ok {
+		if target, err := lfs.Readlink(src); err == nil {
+			return lfs.Symlink(target, dst)
+		}
+	}
+
+	info, err := fs.Stat(h.fsys, src)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		if recursive {
+			_, err := fsx.Sync(h.fsys, h.fsys, &fsx.SyncOptions{
+				SrcRoot: src,
+				DstRoot: dst,
+			})
+			return err
+		}
+
+		if err := h.fsys.Mkdir(dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+	} else if err := h.copyFile(src, dst, info.Mode().Perm()); err != nil {
+		return err
+	}
+
+	if cfs, ok := h.fsys.(fsx.ChtimesFS); ok {
+		return cfs.Chtimes(dst, time.Now(), info.ModTime())
+	}
+
+	return nil
+}
+
+func (h *Handler) copyFile(src, dst string, perm fs.FileMode) error {
+	in, err := h.fsys.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := h.fsys.OpenFile(dst, fsx.O_WRONLY|fsx.O_CREATE|fsx.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
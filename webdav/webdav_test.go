@@ -0,0 +1,326 @@
+package webdav
+
+import (
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	. "github.com/halimath/fixture"
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/memfs"
+)
+
+type webdavFixture struct {
+	fs  fsx.LinkFS
+	srv *httptest.Server
+}
+
+func (f *webdavFixture) BeforeEach(t *testing.T) error {
+	f.fs = memfs.New()
+
+	if err := fsx.MkdirAll(f.fs, "docs/drafts", 0755); err != nil {
+		return err
+	}
+	if err := fsx.WriteFile(f.fs, "docs/readme.txt", []byte("hello, world"), 0644); err != nil {
+		return err
+	}
+	if err := fsx.WriteFile(f.fs, "docs/drafts/plan.md", []byte("# Plan"), 0644); err != nil {
+		return err
+	}
+	if err := f.fs.Symlink("docs", "link"); err != nil {
+		return err
+	}
+
+	f.srv = httptest.NewServer(New(f.fs, WithLocking(time.Hour)))
+	return nil
+}
+
+func (f *webdavFixture) AfterEach(t *testing.T) error {
+	f.srv.Close()
+	return nil
+}
+
+// do sends a request and returns the response's status code, headers and
+// body.
+func (f *webdavFixture) do(t *testing.T, method, p string, body string, headers ...string) (int, http.Header, string) {
+	t.Helper()
+
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, f.srv.URL+p, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res.StatusCode, res.Header, string(b)
+}
+
+func TestHandler(t *testing.T) {
+	With(t, new(webdavFixture)).
+		Run("options", func(t *testing.T, f *webdavFixture) {
+			status, h, _ := f.do(t, http.MethodOptions, "/", "")
+			expect.That(t,
+				is.EqualTo(status, http.StatusOK),
+				is.EqualTo(h.Get("DAV"), "1, 2"),
+			)
+		}).
+		Run("get", func(t *testing.T, f *webdavFixture) {
+			status, h, body := f.do(t, http.MethodGet, "/docs/readme.txt", "")
+			expect.That(t,
+				is.EqualTo(status, http.StatusOK),
+				is.EqualTo(body, "hello, world"),
+			)
+
+			status, _, body = f.do(t, http.MethodGet, "/docs/readme.txt", "", "Range", "bytes=7-")
+			expect.That(t,
+				is.EqualTo(status, http.StatusPartialContent),
+				is.EqualTo(body, "world"),
+			)
+
+			status, _, _ = f.do(t, http.MethodGet, "/docs/readme.txt", "", "If-None-Match", h.Get("ETag"))
+			expect.That(t, is.EqualTo(status, http.StatusNotModified))
+
+			expect.That(t, expect.FailNow(is.NoError(f.fs.Symlink("docs/readme.txt", "docs/drafts/readme"))))
+
+			status, _, body = f.do(t, http.MethodGet, "/docs/drafts/readme", "")
+			expect.That(t,
+				is.EqualTo(status, http.StatusOK),
+				is.EqualTo(body, "hello, world"),
+			)
+
+			status, _, _ = f.do(t, http.MethodGet, "/docs", "")
+			expect.That(t, is.EqualTo(status, http.StatusMethodNotAllowed))
+
+			status, _, _ = f.do(t, http.MethodGet, "/missing", "")
+			expect.That(t, is.EqualTo(status, http.StatusNotFound))
+		}).
+		Run("put", func(t *testing.T, f *webdavFixture) {
+			status, _, _ := f.do(t, http.MethodPut, "/docs/new.txt", "new")
+			expect.That(t, is.EqualTo(status, http.StatusCreated))
+
+			status, _, _ = f.do(t, http.MethodPut, "/docs/new.txt", "updated", "X-OC-Mtime", "1700000000")
+			expect.That(t, is.EqualTo(status, http.StatusNoContent))
+
+			content, err := fs.ReadFile(f.fs, "docs/new.txt")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "updated"))
+
+			info, err := fs.Stat(f.fs, "docs/new.txt")
+			expect.That(t, is.NoError(err), is.EqualTo(info.ModTime().Unix(), int64(1700000000)))
+
+			status, _, _ = f.do(t, http.MethodPut, "/missing/new.txt", "new")
+			expect.That(t, is.EqualTo(status, http.StatusConflict))
+
+			status, _, _ = f.do(t, http.MethodPut, "/docs", "new")
+			expect.That(t, is.EqualTo(status, http.StatusMethodNotAllowed))
+		}).
+		Run("mkcol", func(t *testing.T, f *webdavFixture) {
+			status, _, _ := f.do(t, "MKCOL", "/docs/archive", "")
+			expect.That(t, is.EqualTo(status, http.StatusCreated))
+
+			info, err := fs.Stat(f.fs, "docs/archive")
+			expect.That(t, is.NoError(err), is.EqualTo(info.IsDir(), true))
+
+			status, _, _ = f.do(t, "MKCOL", "/docs/archive", "")
+			expect.That(t, is.EqualTo(status, http.StatusMethodNotAllowed))
+
+			status, _, _ = f.do(t, "MKCOL", "/missing/archive", "")
+			expect.That(t, is.EqualTo(status, http.StatusConflict))
+
+			status, _, _ = f.do(t, "MKCOL", "/docs/body", "<x/>")
+			expect.That(t, is.EqualTo(status, http.StatusUnsupportedMediaType))
+		}).
+		Run("delete", func(t *testing.T, f *webdavFixture) {
+			status, _, _ := f.do(t, http.MethodDelete, "/link", "")
+			expect.That(t, is.EqualTo(status, http.StatusNoContent))
+
+			_, err := fs.Stat(f.fs, "docs/readme.txt")
+			expect.That(t, is.NoError(err))
+
+			status, _, _ = f.do(t, http.MethodDelete, "/docs", "")
+			expect.That(t, is.EqualTo(status, http.StatusNoContent))
+
+			_, err = fs.Stat(f.fs, "docs")
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+
+			status, _, _ = f.do(t, http.MethodDelete, "/docs", "")
+			expect.That(t, is.EqualTo(status, http.StatusNotFound))
+
+			status, _, _ = f.do(t, http.MethodDelete, "/", "")
+			expect.That(t, is.EqualTo(status, http.StatusForbidden))
+		}).
+		Run("copy", func(t *testing.T, f *webdavFixture) {
+			status, _, _ := f.do(t, "COPY", "/docs", "", "Destination", f.srv.URL+"/backup")
+			expect.That(t, is.EqualTo(status, http.StatusCreated))
+
+			content, err := fs.ReadFile(f.fs, "backup/drafts/plan.md")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "# Plan"))
+
+			status, _, _ = f.do(t, "COPY", "/docs/readme.txt", "", "Destination", "/backup/drafts/plan.md", "Overwrite", "F")
+			expect.That(t, is.EqualTo(status, http.StatusPreconditionFailed))
+
+			status, _, _ = f.do(t, "COPY", "/docs/readme.txt", "", "Destination", "/backup/drafts/plan.md")
+			expect.That(t, is.EqualTo(status, http.StatusNoContent))
+
+			content, err = fs.ReadFile(f.fs, "backup/drafts/plan.md")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "hello, world"))
+
+			status, _, _ = f.do(t, "COPY", "/docs", "", "Destination", "/shallow", "Depth", "0")
+			expect.That(t, is.EqualTo(status, http.StatusCreated))
+
+			entries, err := fs.ReadDir(f.fs, "shallow")
+			expect.That(t, is.NoError(err), is.SliceOfLen(entries, 0))
+
+			status, _, _ = f.do(t, "COPY", "/link", "", "Destination", "/link2")
+			expect.That(t, is.EqualTo(status, http.StatusCreated))
+
+			target, err := f.fs.Readlink("link2")
+			expect.That(t, is.NoError(err), is.EqualTo(target, "docs"))
+
+			status, _, _ = f.do(t, "COPY", "/docs", "", "Destination", "/docs/drafts/docs")
+			expect.That(t, is.EqualTo(status, http.StatusForbidden))
+
+			status, _, _ = f.do(t, "COPY", "/docs", "", "Destination", "/missing/docs")
+			expect.That(t, is.EqualTo(status, http.StatusConflict))
+
+			status, _, _ = f.do(t, "COPY", "/docs", "", "Destination", "http://example.com/docs")
+			expect.That(t, is.EqualTo(status, http.StatusBadGateway))
+		}).
+		Run("move", func(t *testing.T, f *webdavFixture) {
+			status, _, _ := f.do(t, "MOVE", "/docs/drafts", "", "Destination", "/drafts")
+			expect.That(t, is.EqualTo(status, http.StatusCreated))
+
+			_, err := fs.Stat(f.fs, "docs/drafts")
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+
+			content, err := fs.ReadFile(f.fs, "drafts/plan.md")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "# Plan"))
+
+			status, _, _ = f.do(t, "MOVE", "/link", "", "Destination", "/moved")
+			expect.That(t, is.EqualTo(status, http.StatusCreated))
+
+			target, err := f.fs.Readlink("moved")
+			expect.That(t, is.NoError(err), is.EqualTo(target, "docs"))
+
+			status, _, _ = f.do(t, "MOVE", "/docs", "", "Destination", "/drafts", "Depth", "0")
+			expect.That(t, is.EqualTo(status, http.StatusBadRequest))
+		}).
+		Run("propfind", func(t *testing.T, f *webdavFixture) {
+			status, _, body := f.do(t, "PROPFIND", "/docs", "", "Depth", "1")
+			expect.That(t,
+				is.EqualTo(status, http.StatusMultiStatus),
+				is.EqualTo(strings.Count(body, "<D:response>"), 3),
+				is.EqualTo(strings.Contains(body, "<D:href>/docs/drafts/</D:href>"), true),
+				is.EqualTo(strings.Contains(body, "<D:getcontentlength>12</D:getcontentlength>"), true),
+				is.EqualTo(strings.Contains(body, "<D:resourcetype><D:collection/></D:resourcetype>"), true),
+			)
+
+			status, _, body = f.do(t, "PROPFIND", "/", "")
+			expect.That(t,
+				is.EqualTo(status, http.StatusMultiStatus),
+				// root, docs, readme, drafts, plan and link without descending
+				is.EqualTo(strings.Count(body, "<D:response>"), 6),
+			)
+
+			status, _, body = f.do(t, "PROPFIND", "/docs/readme.txt", `<?xml version="1.0"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:getcontenttype/><x:color xmlns:x="urn:x"/></D:prop></D:propfind>`, "Depth", "0")
+			expect.That(t,
+				is.EqualTo(status, http.StatusMultiStatus),
+				is.EqualTo(strings.Contains(body, "<D:getcontenttype>text/plain; charset=utf-8</D:getcontenttype>"), true),
+				is.EqualTo(strings.Contains(body, `<color xmlns="urn:x"/>`), true),
+				is.EqualTo(strings.Contains(body, "404 Not Found"), true),
+			)
+
+			status, _, _ = f.do(t, "PROPFIND", "/missing", "")
+			expect.That(t, is.EqualTo(status, http.StatusNotFound))
+		}).
+		Run("proppatch", func(t *testing.T, f *webdavFixture) {
+			status, _, body := f.do(t, "PROPPATCH", "/docs/readme.txt", `<?xml version="1.0"?>
+<D:propertyupdate xmlns:D="DAV:"><D:set><D:prop>
+<D:getlastmodified>Tue, 14 Nov 2023 22:13:20 GMT</D:getlastmodified>
+</D:prop></D:set></D:propertyupdate>`)
+			expect.That(t,
+				is.EqualTo(status, http.StatusMultiStatus),
+				is.EqualTo(strings.Contains(body, "200 OK"), true),
+			)
+
+			info, err := fs.Stat(f.fs, "docs/readme.txt")
+			expect.That(t, is.NoError(err), is.EqualTo(info.ModTime().Unix(), int64(1700000000)))
+
+			status, _, body = f.do(t, "PROPPATCH", "/docs/readme.txt", `<?xml version="1.0"?>
+<D:propertyupdate xmlns:D="DAV:"><D:set><D:prop>
+<D:getlastmodified>Mon, 01 Jan 2024 00:00:00 GMT</D:getlastmodified>
+<D:displayname>other</D:displayname>
+</D:prop></D:set></D:propertyupdate>`)
+			expect.That(t,
+				is.EqualTo(status, http.StatusMultiStatus),
+				is.EqualTo(strings.Contains(body, "403 Forbidden"), true),
+				is.EqualTo(strings.Contains(body, "424 Failed Dependency"), true),
+			)
+
+			info, err = fs.Stat(f.fs, "docs/readme.txt")
+			expect.That(t, is.NoError(err), is.EqualTo(info.ModTime().Unix(), int64(1700000000)))
+		})
+}
+
+func TestHandler_prefix(t *testing.T) {
+	fsys := memfs.New()
+	srv := httptest.NewServer(New(fsys, WithPrefix("/dav/")))
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+"/dav/file.txt", strings.NewReader("content"))
+	res, err := http.DefaultClient.Do(req)
+	expect.That(t, expect.FailNow(is.NoError(err)), is.EqualTo(res.StatusCode, http.StatusCreated))
+	res.Body.Close()
+
+	req, _ = http.NewRequest("PROPFIND", srv.URL+"/dav/", nil)
+	req.Header.Set("Depth", "1")
+	res, err = http.DefaultClient.Do(req)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+
+	expect.That(t,
+		is.EqualTo(res.StatusCode, http.StatusMultiStatus),
+		is.EqualTo(strings.Contains(string(body), "<D:href>/dav/file.txt</D:href>"), true),
+	)
+
+	res, err = http.Get(srv.URL + "/other/file.txt")
+	expect.That(t, expect.FailNow(is.NoError(err)), is.EqualTo(res.StatusCode, http.StatusNotFound))
+	res.Body.Close()
+}
+
+func TestStatusCode(t *testing.T) {
+	expect.That(t,
+		is.EqualTo(StatusCode(&fs.PathError{Op: "open", Path: "f", Err: fs.ErrNotExist}), http.StatusNotFound),
+		is.EqualTo(StatusCode(fs.ErrPermission), http.StatusForbidden),
+		is.EqualTo(StatusCode(fs.ErrExist), http.StatusConflict),
+		is.EqualTo(StatusCode(fsx.ErrDirNotEmpty), http.StatusConflict),
+		is.EqualTo(StatusCode(fs.ErrInvalid), http.StatusBadRequest),
+		is.EqualTo(StatusCode(fsx.ErrNotSupported), http.StatusNotImplemented),
+		is.EqualTo(StatusCode(io.ErrUnexpectedEOF), http.StatusInternalServerError),
+	)
+}
@@ -0,0 +1,359 @@
+package webdavfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error is returned for requests rejected by the server. Errors with a status
+// code of 404 match fs.ErrNotExist, errors with a status code of 401 or 403
+// match fs.ErrPermission and errors with a status code of 412 match
+// fs.ErrExist when used with errors.Is.
+type Error struct {
+	// Method is the request's method.
+	Method string
+	// StatusCode is the response's HTTP status code.
+	StatusCode int
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("webdavfs: %s: unexpected status code %d", e.Method, e.StatusCode)
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case fs.ErrNotExist:
+		return e.StatusCode == http.StatusNotFound
+	case fs.ErrPermission:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	case fs.ErrExist:
+		return e.StatusCode == http.StatusPreconditionFailed
+	default:
+		return false
+	}
+}
+
+// statusCode returns the status code of err if it is an *Error.
+func statusCode(err error) int {
+	if e, ok := err.(*Error); ok {
+		return e.StatusCode
+	}
+	return 0
+}
+
+// resource describes a resource as returned from PROPFIND.
+type resource struct {
+	name    string
+	size    int64
+	dir     bool
+	modTime time.Time
+}
+
+type multistatus struct {
+	Responses []struct {
+		Href      string `xml:"DAV: href"`
+		Propstats []struct {
+			Prop struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+				ContentLength string `xml:"DAV: getcontentlength"`
+				LastModified  string `xml:"DAV: getlastmodified"`
+			} `xml:"DAV: prop"`
+			Status string `xml:"DAV: status"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop>` +
+	`<D:resourcetype/><D:getcontentlength/><D:getlastmodified/>` +
+	`</D:prop></D:propfind>`
+
+// parseStatus returns the status code contained in a DAV:status element.
+func parseStatus(s string) int {
+	fields := strings.Fields(s)
+	if len(fields) < 2 {
+		return 0
+	}
+	code, _ := strconv.Atoi(fields[1])
+	return code
+}
+
+// client implements the WebDAV protocol.
+type client struct {
+	base     *url.URL
+	http     *http.Client
+	ctx      context.Context
+	timeout  time.Duration
+	username string
+	password string
+}
+
+// url returns the URL for name. Collections are addressed with a trailing
+// slash if dir is set.
+func (c *client) url(name string, dir bool) string {
+	u := *c.base
+	if name != "." {
+		u.Path += name
+		if dir {
+			u.Path += "/"
+		}
+	}
+	return u.String()
+}
+
+// name converts href as found in a multistatus response into a name.
+func (c *client) name(href string) (string, bool) {
+	u, err := url.Parse(href)
+	if err != nil {
+		return "", false
+	}
+
+	p := path.Clean("/" + u.Path)
+	if p+"/" == c.base.Path {
+		return ".", true
+	}
+
+	name, ok := strings.CutPrefix(p, c.base.Path)
+	if !ok {
+		return "", false
+	}
+	if name == "" {
+		return ".", true
+	}
+	return name, true
+}
+
+// cancelBody cancels a request's context when its body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// do sends a request for name. A non-2xx response is returned as an *Error.
+// The caller must close the response's body.
+func (c *client) do(method, name string, dir bool, header http.Header, body []byte) (*http.Response, error) {
+	ctx, cancel := c.ctx, context.CancelFunc(func() {})
+	if c.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.url(name, dir), bytes.NewReader(body))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	if body == nil {
+		req.Body = http.NoBody
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	if c.username != "" || c.password != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		res.Body = &cancelBody{ReadCloser: res.Body, cancel: cancel}
+		return res, nil
+	}
+
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	res.Body.Close()
+	cancel()
+
+	return nil, &Error{Method: method, StatusCode: res.StatusCode}
+}
+
+// call sends a request and discards the response's body.
+func (c *client) call(method, name string, dir bool, header http.Header, body []byte) error {
+	res, err := c.do(method, name, dir, header, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	_, err = io.Copy(io.Discard, res.Body)
+	return err
+}
+
+// propfind returns the resources found at name with the given depth. The
+// first resource describes name itself.
+func (c *client) propfind(name string, depth int) ([]resource, error) {
+	header := http.Header{
+		"Depth":        {strconv.Itoa(depth)},
+		"Content-Type": {`application/xml; charset="utf-8"`},
+	}
+
+	res, err := c.do("PROPFIND", name, false, header, []byte(propfindBody))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusMultiStatus {
+		return nil, &Error{Method: "PROPFIND", StatusCode: res.StatusCode}
+	}
+
+	var ms multistatus
+	if err := xml.NewDecoder(res.Body).Decode(&ms); err != nil {
+		return nil, err
+	}
+
+	var self *resource
+	var resources []resource
+
+	for _, r := range ms.Responses {
+		n, ok := c.name(r.Href)
+		if !ok {
+			continue
+		}
+
+		rs := resource{name: n}
+		for _, ps := range r.Propstats {
+			if parseStatus(ps.Status) != http.StatusOK {
+				continue
+			}
+
+			if ps.Prop.ResourceType.Collection != nil {
+				rs.dir = true
+			}
+			if s, err := strconv.ParseInt(strings.TrimSpace(ps.Prop.ContentLength), 10, 64); err == nil {
+				rs.size = s
+			}
+			if t, err := http.ParseTime(strings.TrimSpace(ps.Prop.LastModified)); err == nil {
+				rs.modTime = t
+			}
+		}
+
+		if n == name {
+			self = &rs
+			continue
+		}
+
+		resources = append(resources, rs)
+	}
+
+	if self == nil {
+		return nil, fmt.Errorf("webdavfs: PROPFIND: missing response for %q", name)
+	}
+
+	return append([]resource{*self}, resources...), nil
+}
+
+// get requests the content of name starting at offset. If length is
+// negative, the content is read to the end. Servers not supporting ranges
+// are handled by skipping content.
+func (c *client) get(name string, offset, length int64) (io.ReadCloser, error) {
+	var header http.Header
+	if offset > 0 || length >= 0 {
+		r := "bytes=" + strconv.FormatInt(offset, 10) + "-"
+		if length >= 0 {
+			r += strconv.FormatInt(offset+length-1, 10)
+		}
+		header = http.Header{"Range": {r}}
+	}
+
+	res, err := c.do(http.MethodGet, name, false, header, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if header != nil && res.StatusCode != http.StatusPartialContent {
+		if _, err := io.CopyN(io.Discard, res.Body, offset); err != nil && err != io.EOF {
+			res.Body.Close()
+			return nil, err
+		}
+
+		if length >= 0 {
+			return struct {
+				io.Reader
+				io.Closer
+			}{io.LimitReader(res.Body, length), res.Body}, nil
+		}
+	}
+
+	return res.Body, nil
+}
+
+func (c *client) put(name string, data []byte) error {
+	if data == nil {
+		data = []byte{}
+	}
+	return c.call(http.MethodPut, name, false, nil, data)
+}
+
+func (c *client) mkcol(name string) error {
+	return c.call("MKCOL", name, true, nil, nil)
+}
+
+func (c *client) delete(name string, dir bool) error {
+	return c.call(http.MethodDelete, name, dir, nil, nil)
+}
+
+func (c *client) move(oldname, newname string, dir bool) error {
+	return c.call("MOVE", oldname, dir, http.Header{
+		"Destination": {c.url(newname, dir)},
+		"Overwrite":   {"T"},
+	}, nil)
+}
+
+// setModTime sets DAV:getlastmodified using PROPPATCH. It returns the status
+// reported for the property.
+func (c *client) setModTime(name string, mtime time.Time) (int, error) {
+	body := `<?xml version="1.0" encoding="utf-8"?>
+<D:propertyupdate xmlns:D="DAV:"><D:set><D:prop><D:getlastmodified>` +
+		mtime.UTC().Format(http.TimeFormat) +
+		`</D:getlastmodified></D:prop></D:set></D:propertyupdate>`
+
+	res, err := c.do("PROPPATCH", name, false, http.Header{
+		"Content-Type": {`application/xml; charset="utf-8"`},
+	}, []byte(body))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusMultiStatus {
+		return res.StatusCode, nil
+	}
+
+	var ms multistatus
+	if err := xml.NewDecoder(res.Body).Decode(&ms); err != nil {
+		return 0, err
+	}
+
+	for _, r := range ms.Responses {
+		for _, ps := range r.Propstats {
+			return parseStatus(ps.Status), nil
+		}
+	}
+
+	return 0, fmt.Errorf("webdavfs: PROPPATCH: missing status for %q", name)
+}
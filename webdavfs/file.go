@@ -0,0 +1,158 @@
+package webdavfs
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/halimath/fsx"
+)
+
+// remoteFile provides read access to a remote file. Content is requested
+// lazily starting at the current offset; seeking discards the current
+// response.
+type remoteFile struct {
+	fsys   *webdavfs
+	name   string
+	info   *fileInfo
+	body   io.ReadCloser
+	pos    int64
+	closed bool
+}
+
+func (f *remoteFile) pathError(op string, err error) error {
+	return &fs.PathError{
+		Op:   op,
+		Path: f.name,
+		Err:  err,
+	}
+}
+
+func (f *remoteFile) Stat() (fs.FileInfo, error) {
+	if f.closed {
+		return nil, f.pathError("Stat", fs.ErrClosed)
+	}
+	return f.info, nil
+}
+
+func (f *remoteFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, f.pathError("Read", fs.ErrClosed)
+	}
+
+	if f.pos >= f.info.size {
+		return 0, io.EOF
+	}
+
+	if f.body == nil {
+		body, err := f.fsys.c.get(f.name, f.pos, -1)
+		if err != nil {
+			return 0, f.pathError("Read", err)
+		}
+		f.body = body
+	}
+
+	n, err := f.body.Read(p)
+	f.pos += int64(n)
+	return n, err
+}
+
+// ReadAt reads len(p) bytes starting at off using a range request.
+func (f *remoteFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, f.pathError("ReadAt", fs.ErrClosed)
+	}
+
+	if off < 0 {
+		return 0, f.pathError("ReadAt", fs.ErrInvalid)
+	}
+
+	if off >= f.info.size {
+		return 0, io.EOF
+	}
+
+	length := int64(len(p))
+	if off+length > f.info.size {
+		length = f.info.size - off
+	}
+
+	if length == 0 {
+		return 0, nil
+	}
+
+	body, err := f.fsys.c.get(f.name, off, length)
+	if err != nil {
+		return 0, f.pathError("ReadAt", err)
+	}
+	defer body.Close()
+
+	n, err := io.ReadFull(body, p[:length])
+	if err != nil {
+		return n, f.pathError("ReadAt", err)
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *remoteFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, f.pathError("Seek", fs.ErrClosed)
+	}
+
+	var pos int64
+	switch whence {
+	case fsx.SeekWhenceRelativeOrigin:
+		pos = offset
+	case fsx.SeekWhenceRelativeCurrentOffset:
+		pos = f.pos + offset
+	case fsx.SeekWhenceRelativeEnd:
+		pos = f.info.size + offset
+	default:
+		return 0, f.pathError("Seek", fmt.Errorf("%w: %d", fsx.ErrInvalidWhence, whence))
+	}
+
+	if pos < 0 {
+		return 0, f.pathError("Seek", fs.ErrInvalid)
+	}
+
+	if pos != f.pos && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+
+	f.pos = pos
+	return pos, nil
+}
+
+func (f *remoteFile) Write(p []byte) (int, error) {
+	return 0, f.pathError("Write", fs.ErrPermission)
+}
+
+func (f *remoteFile) Chmod(mode fs.FileMode) error {
+	if f.closed {
+		return f.pathError("Chmod", fs.ErrClosed)
+	}
+
+	if err := f.info.chmod(mode); err != nil {
+		return f.pathError("Chmod", err)
+	}
+	return nil
+}
+
+// Chown is a no-op as WebDAV does not expose ownership.
+func (f *remoteFile) Chown(uid, gid int) error { return nil }
+
+func (f *remoteFile) Close() error {
+	if f.closed {
+		return f.pathError("Close", fs.ErrClosed)
+	}
+
+	f.closed = true
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
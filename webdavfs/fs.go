@@ -0,0 +1,432 @@
+package webdavfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/internal/buffile"
+)
+
+type fileInfo struct {
+	name    string
+	size    int64
+	dir     bool
+	modTime time.Time
+}
+
+func newFileInfo(r resource) *fileInfo {
+	return &fileInfo{
+		name:    r.name,
+		size:    r.size,
+		dir:     r.dir,
+		modTime: r.modTime,
+	}
+}
+
+func (i *fileInfo) Name() string       { return path.Base(i.name) }
+func (i *fileInfo) Size() int64        { return i.size }
+func (i *fileInfo) ModTime() time.Time { return i.modTime }
+func (i *fileInfo) IsDir() bool        { return i.dir }
+func (i *fileInfo) Sys() any           { return nil }
+
+func (i *fileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+// chmod accepts mode if it matches the permission reported for info as
+// WebDAV does not support permissions.
+func (i *fileInfo) chmod(mode fs.FileMode) error {
+	if mode.Perm() != i.Mode().Perm() {
+		return fmt.Errorf("%w: changing permissions to %v", fsx.ErrNotSupported, mode.Perm())
+	}
+	return nil
+}
+
+type webdavfs struct {
+	c *client
+}
+
+func pathError(op, name string, err error) error {
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		return err
+	}
+
+	return &fs.PathError{
+		Op:   op,
+		Path: name,
+		Err:  err,
+	}
+}
+
+// stat returns the info for name using a PROPFIND request with depth 0.
+func (fsys *webdavfs) stat(name string) (*fileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, fs.ErrInvalid
+	}
+
+	res, err := fsys.c.propfind(name, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return newFileInfo(res[0]), nil
+}
+
+// checkParent makes sure the parent directory of name exists.
+func (fsys *webdavfs) checkParent(name string) error {
+	parent := path.Dir(name)
+	if parent == "." {
+		return nil
+	}
+
+	info, err := fsys.stat(parent)
+	if err != nil {
+		return err
+	}
+	if !info.dir {
+		return fs.ErrInvalid
+	}
+	return nil
+}
+
+// -- fs.FS
+
+// Open opens the named file for reading.
+func (fsys *webdavfs) Open(name string) (fs.File, error) {
+	return fsys.OpenFile(name, fsx.O_RDONLY, 0)
+}
+
+// -- fsx.FS
+
+// OpenFile opens the named file. Files opened for writing are buffered in
+// memory and uploaded when closed.
+func (fsys *webdavfs) OpenFile(name string, flag int, perm fs.FileMode) (fsx.File, error) {
+	writable := flag&(fsx.O_WRONLY|fsx.O_RDWR) != 0
+
+	info, err := fsys.stat(name)
+	created := false
+
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if flag&fsx.O_CREATE == 0 {
+			return nil, pathError("OpenFile", name, err)
+		}
+		if err := fsys.checkParent(name); err != nil {
+			return nil, pathError("OpenFile", name, err)
+		}
+		created = true
+		info = &fileInfo{name: name, modTime: time.Now()}
+
+	case err != nil:
+		return nil, pathError("OpenFile", name, err)
+
+	case flag&fsx.O_CREATE != 0 && flag&fsx.O_EXCL != 0:
+		return nil, pathError("OpenFile", name, fs.ErrExist)
+
+	case info.dir:
+		if writable {
+			return nil, pathError("OpenFile", name, buffile.ErrIsDirectory)
+		}
+
+		entries, err := fsys.readDir(name)
+		if err != nil {
+			return nil, pathError("OpenFile", name, err)
+		}
+
+		return buffile.NewDir(name, func() (fs.FileInfo, error) { return info, nil }, entries), nil
+	}
+
+	if !writable {
+		return &remoteFile{fsys: fsys, name: name, info: info}, nil
+	}
+
+	var data []byte
+	if !created && flag&fsx.O_TRUNC == 0 {
+		data, err = fsys.readFile(name)
+		if err != nil {
+			return nil, pathError("OpenFile", name, err)
+		}
+	}
+
+	return buffile.New(name, data, buffile.Options{
+		Flag:  flag,
+		Dirty: created,
+		Stat: func(size int64) (fs.FileInfo, error) {
+			i := *info
+			i.size = size
+			return &i, nil
+		},
+		Commit: func(data []byte) error {
+			return fsys.c.put(name, data)
+		},
+		Chmod: info.chmod,
+	}), nil
+}
+
+func (fsys *webdavfs) readFile(name string) ([]byte, error) {
+	r, err := fsys.c.get(name, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// readDir lists the entries of directory name sorted by name using a
+// PROPFIND request with depth 1.
+func (fsys *webdavfs) readDir(name string) ([]fs.DirEntry, error) {
+	res, err := fsys.c.propfind(name, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	if !res[0].dir {
+		return nil, fs.ErrInvalid
+	}
+
+	entries := make([]fs.DirEntry, 0, len(res)-1)
+	for _, r := range res[1:] {
+		if path.Dir(r.name) != name {
+			// Some servers ignore the depth and report the whole tree.
+			continue
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(newFileInfo(r)))
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	return entries, nil
+}
+
+// Mkdir creates a directory using MKCOL. perm is ignored.
+func (fsys *webdavfs) Mkdir(name string, perm fs.FileMode) error {
+	if !fs.ValidPath(name) || name == "." {
+		return pathError("Mkdir", name, fs.ErrInvalid)
+	}
+
+	err := fsys.c.mkcol(name)
+	switch statusCode(err) {
+	case 0:
+	case http.StatusMethodNotAllowed:
+		err = fs.ErrExist
+	case http.StatusConflict:
+		err = fs.ErrNotExist
+	}
+
+	if err != nil {
+		return pathError("Mkdir", name, err)
+	}
+	return nil
+}
+
+// Remove removes the named file or empty directory.
+func (fsys *webdavfs) Remove(name string) error {
+	if name == "." {
+		return pathError("Remove", name, fs.ErrInvalid)
+	}
+
+	info, err := fsys.stat(name)
+	if err != nil {
+		return pathError("Remove", name, err)
+	}
+
+	if info.dir {
+		entries, err := fsys.readDir(name)
+		if err != nil {
+			return pathError("Remove", name, err)
+		}
+		if len(entries) > 0 {
+			return pathError("Remove", name, fsx.ErrDirNotEmpty)
+		}
+	}
+
+	if err := fsys.c.delete(name, info.dir); err != nil {
+		return pathError("Remove", name, err)
+	}
+
+	return nil
+}
+
+// RemoveAll removes name and all of its children using a single DELETE
+// request. It returns nil if name does not exist.
+func (fsys *webdavfs) RemoveAll(name string) error {
+	if !fs.ValidPath(name) || name == "." {
+		return pathError("RemoveAll", name, fs.ErrInvalid)
+	}
+
+	err := fsys.c.delete(name, false)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return pathError("RemoveAll", name, err)
+	}
+
+	return nil
+}
+
+// Rename renames oldpath to newpath using MOVE. If newpath exists and is not
+// a non-empty directory, it is replaced.
+func (fsys *webdavfs) Rename(oldpath, newpath string) error {
+	if !fs.ValidPath(newpath) || oldpath == "." || newpath == "." {
+		return pathError("Rename", oldpath, fs.ErrInvalid)
+	}
+
+	from, err := fsys.stat(oldpath)
+	if err != nil {
+		return pathError("Rename", oldpath, err)
+	}
+
+	if oldpath == newpath {
+		return nil
+	}
+
+	if strings.HasPrefix(newpath, oldpath+"/") {
+		return pathError("Rename", newpath, fs.ErrInvalid)
+	}
+
+	to, err := fsys.stat(newpath)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		// The server reports a missing parent when moving.
+
+	case err != nil:
+		return pathError("Rename", newpath, err)
+
+	case to.dir != from.dir:
+		return pathError("Rename", newpath, fs.ErrExist)
+
+	case to.dir:
+		entries, err := fsys.readDir(newpath)
+		if err != nil {
+			return pathError("Rename", newpath, err)
+		}
+		if len(entries) > 0 {
+			return pathError("Rename", newpath, fsx.ErrDirNotEmpty)
+		}
+	}
+
+	err = fsys.c.move(oldpath, newpath, from.dir)
+	if statusCode(err) == http.StatusConflict {
+		err = fs.ErrNotExist
+	}
+
+	if err != nil {
+		return pathError("Rename", oldpath, err)
+	}
+	return nil
+}
+
+// SameFile reports whether fi1 and fi2 describe the same resource. As WebDAV
+// does not expose links, this is the case if both have the same name and
+// type.
+func (fsys *webdavfs) SameFile(fi1, fi2 fs.FileInfo) bool {
+	i1, ok := fi1.(*fileInfo)
+	if !ok {
+		return false
+	}
+
+	i2, ok := fi2.(*fileInfo)
+	if !ok {
+		return false
+	}
+
+	return i1.name == i2.name && i1.dir == i2.dir
+}
+
+// -- fsx.ChmodFS
+
+// Chmod accepts mode if it matches the permission reported for name. See
+// package documentation.
+func (fsys *webdavfs) Chmod(name string, mode fs.FileMode) error {
+	info, err := fsys.stat(name)
+	if err != nil {
+		return pathError("Chmod", name, err)
+	}
+
+	if err := info.chmod(mode); err != nil {
+		return pathError("Chmod", name, err)
+	}
+	return nil
+}
+
+// -- fsx.ChtimesFS
+
+// Chtimes sets the modification time of name using PROPPATCH. atime is
+// ignored. If the server refuses to set the property, an error wrapping
+// fsx.ErrNotSupported is returned.
+func (fsys *webdavfs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if !fs.ValidPath(name) {
+		return pathError("Chtimes", name, fs.ErrInvalid)
+	}
+
+	status, err := fsys.c.setModTime(name, mtime)
+	if err != nil {
+		return pathError("Chtimes", name, err)
+	}
+
+	switch status {
+	case http.StatusOK:
+		return nil
+	case http.StatusForbidden, http.StatusConflict, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return pathError("Chtimes", name, fmt.Errorf("%w: setting DAV:getlastmodified", fsx.ErrNotSupported))
+	default:
+		return pathError("Chtimes", name, &Error{Method: "PROPPATCH", StatusCode: status})
+	}
+}
+
+// -- fs.StatFS, fs.ReadDirFS, fs.ReadFileFS
+
+// Stat returns a fs.FileInfo describing the named file.
+func (fsys *webdavfs) Stat(name string) (fs.FileInfo, error) {
+	info, err := fsys.stat(name)
+	if err != nil {
+		return nil, pathError("Stat", name, err)
+	}
+	return info, nil
+}
+
+// ReadDir returns the sorted entries of the named directory.
+func (fsys *webdavfs) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, pathError("ReadDir", name, fs.ErrInvalid)
+	}
+
+	entries, err := fsys.readDir(name)
+	if err != nil {
+		return nil, pathError("ReadDir", name, err)
+	}
+
+	return entries, nil
+}
+
+// ReadFile reads the named file using a single GET request.
+func (fsys *webdavfs) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, pathError("ReadFile", name, fs.ErrInvalid)
+	}
+
+	data, err := fsys.readFile(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		// Servers reject GET requests for collections in different ways.
+		if info, serr := fsys.stat(name); serr == nil && info.dir {
+			err = buffile.ErrIsDirectory
+		}
+	}
+	if err != nil {
+		return nil, pathError("ReadFile", name, err)
+	}
+	return data, nil
+}
+
+var _ FS = &webdavfs{}
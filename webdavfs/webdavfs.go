@@ -0,0 +1,130 @@
+// Package webdavfs provides a fsx.FS implementation that accesses files and
+// directories of a remote WebDAV share as defined in RFC 4918.
+//
+// Files opened for reading fetch their content lazily using GET requests
+// with ranges. Writable files are buffered in memory and uploaded using a
+// single PUT request when they are closed; a file becomes visible to other
+// clients when it is closed. Mkdir is implemented using MKCOL, Remove and
+// RemoveAll using DELETE and Rename using MOVE. Stat and ReadDir issue
+// PROPFIND requests with a depth of 0 and 1.
+//
+// Every request is bound to a context derived from the context configured
+// with WithContext which is canceled after the timeout configured with
+// WithTimeout. For reads, the timeout covers receiving the whole response.
+//
+// WebDAV does not expose permissions or ownership. All files report a mode
+// of 0644 and all directories a mode of 0755; Chmod only accepts these modes
+// and returns an error wrapping fsx.ErrNotSupported otherwise. Modification
+// times are reported as sent by the server and can be changed using Chtimes
+// if the server allows setting DAV:getlastmodified using PROPPATCH.
+package webdavfs
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/halimath/fsx"
+)
+
+// DefaultTimeout is the default timeout applied to each request.
+const DefaultTimeout = 30 * time.Second
+
+// Option defines a functional option for New.
+type Option func(*options)
+
+type options struct {
+	client   *http.Client
+	ctx      context.Context
+	timeout  time.Duration
+	username string
+	password string
+}
+
+// WithHTTPClient sets the HTTP client used to send requests. Defaults to
+// http.DefaultClient.
+func WithHTTPClient(c *http.Client) Option {
+	return func(o *options) {
+		o.client = c
+	}
+}
+
+// WithContext sets the context all requests are derived from. Canceling ctx
+// aborts all pending and future requests. Defaults to context.Background().
+func WithContext(ctx context.Context) Option {
+	return func(o *options) {
+		o.ctx = ctx
+	}
+}
+
+// WithTimeout sets the timeout applied to each request. A timeout of zero
+// disables the timeout. Defaults to DefaultTimeout.
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.timeout = timeout
+	}
+}
+
+// WithBasicAuth sets the credentials sent with each request using HTTP basic
+// authentication.
+func WithBasicAuth(username, password string) Option {
+	return func(o *options) {
+		o.username = username
+		o.password = password
+	}
+}
+
+// FS defines the interface of a WebDAV backed filesystem.
+type FS interface {
+	fsx.FS
+	fsx.RemoveAllFS
+	fsx.ChmodFS
+	fsx.ChtimesFS
+	fs.StatFS
+	fs.ReadDirFS
+	fs.ReadFileFS
+}
+
+// New creates a filesystem operating on the collection found at endpoint,
+// e.g. https://example.com/dav/share. New does not contact the server.
+func New(endpoint string, opts ...Option) (FS, error) {
+	o := options{
+		client:  http.DefaultClient,
+		ctx:     context.Background(),
+		timeout: DefaultTimeout,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("webdavfs: invalid endpoint: %q", endpoint)
+	}
+
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	u.RawPath = ""
+	u.RawQuery = ""
+	u.Fragment = ""
+
+	return &webdavfs{
+		c: &client{
+			base:     u,
+			http:     o.client,
+			ctx:      o.ctx,
+			timeout:  o.timeout,
+			username: o.username,
+			password: o.password,
+		},
+	}, nil
+}
@@ -0,0 +1,301 @@
+package webdavfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	. "github.com/halimath/fixture"
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/internal/buffile"
+	"github.com/halimath/fsx/memfs"
+	"github.com/halimath/fsx/webdav"
+)
+
+type webdavfsFixture struct {
+	backend fsx.LinkFS
+	srv     *httptest.Server
+	fs      FS
+
+	mu      sync.Mutex
+	methods []string
+}
+
+func (f *webdavfsFixture) BeforeEach(t *testing.T) error {
+	f.backend = memfs.New()
+	f.methods = nil
+
+	h := webdav.New(f.backend, webdav.WithPrefix("/share"))
+	f.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.methods = append(f.methods, r.Method)
+		f.mu.Unlock()
+
+		h.ServeHTTP(w, r)
+	}))
+
+	var err error
+	f.fs, err = New(f.srv.URL + "/share")
+	if err != nil {
+		return err
+	}
+
+	if err := fsx.MkdirAll(f.fs, "etc/ssl", 0755); err != nil {
+		return err
+	}
+	if err := fsx.WriteFile(f.fs, "etc/hosts", []byte("127.0.0.1 localhost\n"), 0644); err != nil {
+		return err
+	}
+	return fsx.WriteFile(f.fs, "etc/ssl/cert.pem", []byte("cert"), 0600)
+}
+
+func (f *webdavfsFixture) AfterEach(t *testing.T) error {
+	f.srv.Close()
+	return nil
+}
+
+// reset clears the recorded request methods.
+func (f *webdavfsFixture) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.methods = nil
+}
+
+// requests returns the recorded request methods.
+func (f *webdavfsFixture) requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.methods...)
+}
+
+func TestWebDAVFS(t *testing.T) {
+	With(t, new(webdavfsFixture)).
+		Run("fstest", func(t *testing.T, f *webdavfsFixture) {
+			expect.That(t, is.NoError(fstest.TestFS(f.fs, "etc/hosts", "etc/ssl/cert.pem")))
+		}).
+		Run("backend", func(t *testing.T, f *webdavfsFixture) {
+			content, err := fs.ReadFile(f.backend, "etc/ssl/cert.pem")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "cert"))
+		}).
+		Run("writeOnClose", func(t *testing.T, f *webdavfsFixture) {
+			file, err := f.fs.OpenFile("etc/hosts", fsx.O_RDWR|fsx.O_APPEND, 0)
+			expect.That(t, expect.FailNow(is.NoError(err)))
+
+			f.reset()
+
+			_, err = file.Write([]byte("::1 localhost\n"))
+			expect.That(t, is.NoError(err), is.SliceOfLen(f.requests(), 0))
+
+			info, err := file.Stat()
+			expect.That(t, is.NoError(err), is.EqualTo(info.Size(), int64(34)))
+
+			expect.That(t,
+				is.NoError(file.Close()),
+				is.DeepEqualTo(f.requests(), []string{http.MethodPut}),
+			)
+
+			content, err := fs.ReadFile(f.backend, "etc/hosts")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "127.0.0.1 localhost\n::1 localhost\n"))
+		}).
+		Run("createExclusive", func(t *testing.T, f *webdavfsFixture) {
+			_, err := f.fs.OpenFile("etc/hosts", fsx.O_WRONLY|fsx.O_CREATE|fsx.O_EXCL, 0644)
+			expect.That(t, is.Error(err, fs.ErrExist))
+
+			_, err = f.fs.OpenFile("missing/file", fsx.O_WRONLY|fsx.O_CREATE, 0644)
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+
+			_, err = f.fs.OpenFile("etc", fsx.O_WRONLY, 0)
+			expect.That(t, is.Error(err, buffile.ErrIsDirectory))
+		}).
+		Run("read", func(t *testing.T, f *webdavfsFixture) {
+			file, err := f.fs.Open("etc/hosts")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			defer file.Close()
+
+			r := file.(io.ReadSeeker)
+
+			_, err = r.Seek(10, io.SeekStart)
+			expect.That(t, is.NoError(err))
+
+			content, err := io.ReadAll(r)
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "localhost\n"))
+
+			buf := make([]byte, 5)
+			n, err := file.(io.ReaderAt).ReadAt(buf, 4)
+			expect.That(t, is.NoError(err), is.EqualTo(n, 5), is.EqualTo(string(buf), "0.0.1"))
+
+			_, err = fs.ReadFile(f.fs, "etc")
+			expect.That(t, is.Error(err, buffile.ErrIsDirectory))
+
+			_, err = fs.ReadFile(f.fs, "missing")
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+		}).
+		Run("mkdirAndRemove", func(t *testing.T, f *webdavfsFixture) {
+			f.reset()
+
+			expect.That(t,
+				is.NoError(f.fs.Mkdir("var", 0700)),
+				is.DeepEqualTo(f.requests(), []string{"MKCOL"}),
+				is.Error(f.fs.Mkdir("var", 0700), fs.ErrExist),
+				is.Error(f.fs.Mkdir("missing/child", 0700), fs.ErrNotExist),
+				is.Error(f.fs.Remove("etc"), fsx.ErrDirNotEmpty),
+				is.NoError(f.fs.Remove("var")),
+				is.Error(f.fs.Remove("var"), fs.ErrNotExist),
+				is.NoError(f.fs.Remove("etc/hosts")),
+			)
+
+			f.reset()
+
+			expect.That(t,
+				is.NoError(f.fs.RemoveAll("etc")),
+				is.DeepEqualTo(f.requests(), []string{http.MethodDelete}),
+				is.NoError(f.fs.RemoveAll("etc")),
+			)
+
+			_, err := fs.Stat(f.backend, "etc")
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+		}).
+		Run("rename", func(t *testing.T, f *webdavfsFixture) {
+			expect.That(t,
+				is.NoError(f.fs.Rename("etc/ssl", "ssl")),
+				is.NoError(f.fs.Rename("etc/hosts", "hosts")),
+				is.Error(f.fs.Rename("missing", "other"), fs.ErrNotExist),
+				is.Error(f.fs.Rename("hosts", "missing/hosts"), fs.ErrNotExist),
+				is.Error(f.fs.Rename("hosts", "etc"), fs.ErrExist),
+				is.Error(f.fs.Rename("ssl", "ssl/sub"), fs.ErrInvalid),
+			)
+
+			content, err := fs.ReadFile(f.backend, "ssl/cert.pem")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "cert"))
+
+			entries, err := f.fs.ReadDir(".")
+			expect.That(t, is.NoError(err), is.SliceOfLen(entries, 3))
+
+			entries, err = f.fs.ReadDir("etc")
+			expect.That(t, is.NoError(err), is.SliceOfLen(entries, 0))
+
+			expect.That(t,
+				is.NoError(fsx.WriteFile(f.fs, "etc/other", nil, 0644)),
+				is.Error(f.fs.Rename("ssl", "etc"), fsx.ErrDirNotEmpty),
+			)
+		}).
+		Run("stat", func(t *testing.T, f *webdavfsFixture) {
+			info, err := f.fs.Stat("etc/hosts")
+			expect.That(t,
+				is.NoError(err),
+				is.EqualTo(info.Name(), "hosts"),
+				is.EqualTo(info.Size(), int64(20)),
+				is.EqualTo(info.IsDir(), false),
+			)
+
+			info, err = f.fs.Stat(".")
+			expect.That(t, is.NoError(err), is.EqualTo(info.IsDir(), true))
+
+			_, err = f.fs.Stat("missing")
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+
+			_, err = f.fs.ReadDir("etc/hosts")
+			expect.That(t, is.Error(err, fs.ErrInvalid))
+		}).
+		Run("chmod", func(t *testing.T, f *webdavfsFixture) {
+			expect.That(t,
+				is.NoError(f.fs.Chmod("etc/hosts", 0644)),
+				is.NoError(f.fs.Chmod("etc", 0755)),
+				is.Error(f.fs.Chmod("etc/hosts", 0755), fsx.ErrNotSupported),
+				is.Error(f.fs.Chmod("missing", 0644), fs.ErrNotExist),
+			)
+		}).
+		Run("chtimes", func(t *testing.T, f *webdavfsFixture) {
+			mtime := time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC)
+
+			expect.That(t, is.NoError(f.fs.Chtimes("etc/hosts", time.Time{}, mtime)))
+
+			info, err := f.fs.Stat("etc/hosts")
+			expect.That(t, is.NoError(err), is.EqualTo(info.ModTime().Equal(mtime), true))
+
+			expect.That(t, is.Error(f.fs.Chtimes("missing", time.Time{}, mtime), fs.ErrNotExist))
+		}).
+		Run("sync", func(t *testing.T, f *webdavfsFixture) {
+			src := memfs.New()
+			expect.That(t,
+				is.NoError(fsx.MkdirAll(src, "docs", 0755)),
+				is.NoError(fsx.WriteFile(src, "docs/readme.txt", []byte("hello"), 0644)),
+			)
+
+			_, err := fsx.Sync(f.fs, src, &fsx.SyncOptions{Delete: true})
+			expect.That(t, is.NoError(err))
+
+			d, err := fsx.Diff(src, f.fs, &fsx.DiffOptions{Compare: fsx.CompareModTime, ModTimePrecision: time.Second, IgnoreMode: true})
+			expect.That(t, is.NoError(err), is.DeepEqualTo(d.Changes, []fsx.Change(nil)))
+		})
+}
+
+func TestWebDAVFS_timeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	fsys, err := New(srv.URL, WithTimeout(10*time.Millisecond))
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	_, err = fsys.Stat("file")
+	expect.That(t, is.Error(err, context.DeadlineExceeded))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	fsys, err = New(srv.URL, WithContext(ctx), WithTimeout(0))
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	_, err = fsys.Stat("file")
+	expect.That(t, is.Error(err, context.Canceled))
+}
+
+func TestWebDAVFS_basicAuth(t *testing.T) {
+	h := webdav.New(memfs.New())
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != "jane" || p != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	fsys, err := New(srv.URL)
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	err = fsx.WriteFile(fsys, "file", []byte("content"), 0644)
+	expect.That(t, is.Error(err, fs.ErrPermission))
+
+	var e *Error
+	expect.That(t,
+		is.EqualTo(errors.As(err, &e), true),
+		is.EqualTo(e.StatusCode, http.StatusUnauthorized),
+	)
+
+	fsys, err = New(srv.URL, WithBasicAuth("jane", "secret"))
+	expect.That(t, expect.FailNow(is.NoError(err)))
+
+	expect.That(t, is.NoError(fsx.WriteFile(fsys, "file", []byte("content"), 0644)))
+}
+
+func TestNew(t *testing.T) {
+	_, err := New("ftp://example.com")
+	expect.That(t, is.EqualTo(err != nil, true))
+
+	_, err = New("/share")
+	expect.That(t, is.EqualTo(err != nil, true))
+}
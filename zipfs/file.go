@@ -0,0 +1,245 @@
+package zipfs
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+
+	"github.com/halimath/fsx"
+)
+
+// stagedFile wraps a file opened from the scratch filesystem and reports the
+// archive entry's metadata.
+type stagedFile struct {
+	fsx.File
+	fsys     *zipfs
+	name     string
+	e        *entry
+	writable bool
+}
+
+func (f *stagedFile) Stat() (fs.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+
+	return &fileInfo{name: f.name, e: f.e, size: info.Size()}, nil
+}
+
+func (f *stagedFile) ReadAt(p []byte, off int64) (int, error) {
+	if ra, ok := f.File.(io.ReaderAt); ok {
+		return ra.ReadAt(p, off)
+	}
+	return 0, &fs.PathError{Op: "ReadAt", Path: f.name, Err: fsx.ErrNotSupported}
+}
+
+func (f *stagedFile) Chmod(mode fs.FileMode) error {
+	return f.fsys.Chmod(f.name, mode)
+}
+
+// Chown is a no-op as zip archives do not store ownership.
+func (f *stagedFile) Chown(uid, gid int) error { return nil }
+
+func (f *stagedFile) Close() error {
+	err := f.File.Close()
+
+	if f.writable && err == nil {
+		f.fsys.mu.Lock()
+		f.e.mtime = time.Now()
+		f.e.modified = true
+		f.fsys.mu.Unlock()
+	}
+
+	return err
+}
+
+// zipFile provides read access to an unmodified entry of the source archive.
+// Entries stored without compression are read directly from the archive's
+// io.ReaderAt and support random access. Compressed entries are decompressed
+// sequentially; seeking backwards restarts decompression.
+type zipFile struct {
+	fsys   *zipfs
+	name   string
+	e      *entry
+	size   int64
+	sr     *io.SectionReader
+	rc     io.ReadCloser
+	pos    int64
+	rcPos  int64
+	closed bool
+}
+
+func newZipFile(fsys *zipfs, name string, e *entry) *zipFile {
+	f := &zipFile{
+		fsys: fsys,
+		name: name,
+		e:    e,
+		size: int64(e.src.UncompressedSize64),
+	}
+
+	if e.src.Method == zip.Store {
+		if offset, err := e.src.DataOffset(); err == nil {
+			f.sr = io.NewSectionReader(fsys.r, offset, f.size)
+		}
+	}
+
+	return f
+}
+
+func (f *zipFile) pathError(op string, err error) error {
+	return &fs.PathError{Op: op, Path: f.name, Err: err}
+}
+
+func (f *zipFile) Stat() (fs.FileInfo, error) {
+	if f.closed {
+		return nil, f.pathError("Stat", fs.ErrClosed)
+	}
+
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+
+	return &fileInfo{name: f.name, e: f.e, size: f.size}, nil
+}
+
+func (f *zipFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, f.pathError("Read", fs.ErrClosed)
+	}
+
+	if f.sr != nil {
+		n, err := f.sr.ReadAt(p, f.pos)
+		f.pos += int64(n)
+		if err == io.EOF && n > 0 {
+			err = nil
+		}
+		return n, err
+	}
+
+	if f.pos >= f.size {
+		return 0, io.EOF
+	}
+
+	if f.rc == nil || f.pos < f.rcPos {
+		if f.rc != nil {
+			f.rc.Close()
+		}
+
+		rc, err := f.e.src.Open()
+		if err != nil {
+			return 0, err
+		}
+		f.rc = rc
+		f.rcPos = 0
+	}
+
+	if f.pos > f.rcPos {
+		n, err := io.CopyN(io.Discard, f.rc, f.pos-f.rcPos)
+		f.rcPos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.rc.Read(p)
+	f.pos += int64(n)
+	f.rcPos += int64(n)
+
+	return n, err
+}
+
+// ReadAt implements io.ReaderAt. Entries stored without compression are read
+// directly; compressed entries are decompressed up to off+len(p) on each
+// call.
+func (f *zipFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, f.pathError("ReadAt", fs.ErrClosed)
+	}
+
+	if off < 0 {
+		return 0, f.pathError("ReadAt", fs.ErrInvalid)
+	}
+
+	if f.sr != nil {
+		return f.sr.ReadAt(p, off)
+	}
+
+	rc, err := f.e.src.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	if _, err := io.CopyN(io.Discard, rc, off); err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(rc, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *zipFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, f.pathError("Seek", fs.ErrClosed)
+	}
+
+	var pos int64
+	switch whence {
+	case fsx.SeekWhenceRelativeOrigin:
+		pos = offset
+	case fsx.SeekWhenceRelativeCurrentOffset:
+		pos = f.pos + offset
+	case fsx.SeekWhenceRelativeEnd:
+		pos = f.size + offset
+	default:
+		return 0, f.pathError("Seek", fmt.Errorf("%w: %d", fsx.ErrInvalidWhence, whence))
+	}
+
+	if pos < 0 {
+		return 0, f.pathError("Seek", fs.ErrInvalid)
+	}
+
+	f.pos = pos
+	return pos, nil
+}
+
+func (f *zipFile) Write(p []byte) (int, error) {
+	return 0, f.pathError("Write", fs.ErrPermission)
+}
+
+func (f *zipFile) Chmod(mode fs.FileMode) error {
+	if f.closed {
+		return f.pathError("Chmod", fs.ErrClosed)
+	}
+	return f.fsys.Chmod(f.name, mode)
+}
+
+// Chown is a no-op as zip archives do not store ownership.
+func (f *zipFile) Chown(uid, gid int) error { return nil }
+
+func (f *zipFile) Close() error {
+	if f.closed {
+		return f.pathError("Close", fs.ErrClosed)
+	}
+	f.closed = true
+
+	if f.rc != nil {
+		return f.rc.Close()
+	}
+
+	return nil
+}
+
+var (
+	_ fsx.File    = &stagedFile{}
+	_ fsx.File    = &zipFile{}
+	_ io.ReaderAt = &zipFile{}
+)
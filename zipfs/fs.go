@@ -0,0 +1,509 @@
+package zipfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/internal/buffile"
+	"github.com/halimath/fsx/internal/pathtree"
+)
+
+type fileInfo struct {
+	name string
+	e    *entry
+	size int64
+}
+
+func (i *fileInfo) Name() string       { return path.Base(i.name) }
+func (i *fileInfo) Size() int64        { return i.size }
+func (i *fileInfo) Mode() fs.FileMode  { return i.e.mode }
+func (i *fileInfo) ModTime() time.Time { return i.e.mtime }
+func (i *fileInfo) IsDir() bool        { return i.e.isDir() }
+
+// Sys returns the *zip.FileHeader from the source archive or nil for new
+// entries.
+func (i *fileInfo) Sys() any {
+	if i.e.src == nil {
+		return nil
+	}
+	return &i.e.src.FileHeader
+}
+
+func pathError(op, name string, err error) error {
+	return &fs.PathError{
+		Op:   op,
+		Path: name,
+		Err:  err,
+	}
+}
+
+// lookup returns the entry for name. fsys.mu must be held.
+func (fsys *zipfs) lookup(op, name string) (*entry, error) {
+	if fsys.closed {
+		return nil, pathError(op, name, fs.ErrClosed)
+	}
+
+	if !fs.ValidPath(name) {
+		return nil, pathError(op, name, fs.ErrInvalid)
+	}
+
+	if e, ok := fsys.entries[name]; ok {
+		return e, nil
+	}
+
+	if err := fsys.checkParent(op, name); err != nil {
+		return nil, err
+	}
+
+	return nil, pathError(op, name, fs.ErrNotExist)
+}
+
+// checkParent verifies that name's parent exists and is a directory.
+// fsys.mu must be held.
+func (fsys *zipfs) checkParent(op, name string) error {
+	if fsys.closed {
+		return pathError(op, name, fs.ErrClosed)
+	}
+
+	if !fs.ValidPath(name) || name == "." {
+		return pathError(op, name, fs.ErrInvalid)
+	}
+
+	d, ok := fsys.entries[path.Dir(name)]
+	if !ok {
+		// Report a missing parent the same way as a missing intermediate
+		// directory is reported by the other implementations.
+		for p := path.Dir(path.Dir(name)); ; p = path.Dir(p) {
+			if pe, ok := fsys.entries[p]; ok {
+				if !pe.isDir() {
+					return pathError(op, name, fs.ErrInvalid)
+				}
+				break
+			}
+		}
+		return pathError(op, name, fs.ErrNotExist)
+	}
+
+	if !d.isDir() {
+		return pathError(op, name, fs.ErrInvalid)
+	}
+
+	return nil
+}
+
+// size returns the size of e's content. fsys.mu must be held.
+func (fsys *zipfs) size(e *entry) (int64, error) {
+	if e.isDir() {
+		return 0, nil
+	}
+
+	if e.staged != "" {
+		info, err := fs.Stat(fsys.opts.scratch, e.staged)
+		if err != nil {
+			return 0, err
+		}
+		return info.Size(), nil
+	}
+
+	if e.src != nil {
+		return int64(e.src.UncompressedSize64), nil
+	}
+
+	return 0, nil
+}
+
+func (fsys *zipfs) stat(name string, e *entry) (fs.FileInfo, error) {
+	size, err := fsys.size(e)
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{name: name, e: e, size: size}, nil
+}
+
+// stage copies e's content to a new file in the scratch filesystem unless
+// it has already been staged. If empty is true, the staged file is created
+// empty. fsys.mu must be held.
+func (fsys *zipfs) stage(e *entry, empty bool) error {
+	if e.staged != "" {
+		return nil
+	}
+
+	fsys.nextID++
+	staged := fmt.Sprintf("zipfs-%06d", fsys.nextID)
+
+	out, err := fsys.opts.scratch.OpenFile(staged, fsx.O_WRONLY|fsx.O_CREATE|fsx.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if !empty && e.src != nil {
+		in, err := e.src.Open()
+		if err != nil {
+			out.Close()
+			return err
+		}
+
+		_, err = io.Copy(out, in)
+		in.Close()
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	e.staged = staged
+	return nil
+}
+
+// unstage removes e's staged content. fsys.mu must be held.
+func (fsys *zipfs) unstage(e *entry) error {
+	if e.staged == "" {
+		return nil
+	}
+
+	err := fsys.opts.scratch.Remove(e.staged)
+	e.staged = ""
+	return err
+}
+
+// -- fs.FS
+
+// Open opens the named file for reading.
+func (fsys *zipfs) Open(name string) (fs.File, error) {
+	return fsys.OpenFile(name, fsx.O_RDONLY, 0)
+}
+
+// -- fsx.FS
+
+// OpenFile opens the file named name using flag. If the file is created, it
+// is created with permission perm. Opening a file for writing stages its
+// content in the scratch filesystem.
+func (fsys *zipfs) OpenFile(name string, flag int, perm fs.FileMode) (fsx.File, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	writable := flag&(fsx.O_WRONLY|fsx.O_RDWR) != 0
+
+	e, err := fsys.lookup("OpenFile", name)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) || flag&fsx.O_CREATE == 0 {
+			return nil, err
+		}
+
+		if err := fsys.checkParent("OpenFile", name); err != nil {
+			return nil, err
+		}
+
+		e = &entry{
+			seq:      fsys.seq(),
+			mode:     perm.Perm(),
+			mtime:    time.Now(),
+			modified: true,
+		}
+		if err := fsys.stage(e, true); err != nil {
+			return nil, err
+		}
+
+		fsys.entries[name] = e
+		pathtree.Touch(fsys.entries, name)
+	} else if flag&fsx.O_CREATE != 0 && flag&fsx.O_EXCL != 0 {
+		return nil, pathError("OpenFile", name, fs.ErrExist)
+	}
+
+	if e.isDir() {
+		if writable {
+			return nil, pathError("OpenFile", name, buffile.ErrIsDirectory)
+		}
+
+		return buffile.NewDir(name, func() (fs.FileInfo, error) {
+			fsys.mu.Lock()
+			defer fsys.mu.Unlock()
+			return fsys.stat(name, e)
+		}, fsys.readDir(name)), nil
+	}
+
+	if writable {
+		if !e.mode.IsRegular() {
+			return nil, pathError("OpenFile", name, fs.ErrInvalid)
+		}
+
+		if err := fsys.stage(e, flag&fsx.O_TRUNC != 0); err != nil {
+			return nil, err
+		}
+	}
+
+	if e.staged != "" {
+		f, err := fsys.opts.scratch.OpenFile(e.staged, flag&^(fsx.O_CREATE|fsx.O_EXCL), 0)
+		if err != nil {
+			return nil, err
+		}
+
+		return &stagedFile{
+			File:     f,
+			fsys:     fsys,
+			name:     name,
+			e:        e,
+			writable: writable,
+		}, nil
+	}
+
+	return newZipFile(fsys, name, e), nil
+}
+
+// readDir returns the sorted entries of the directory dir. fsys.mu must be
+// held.
+func (fsys *zipfs) readDir(dir string) []fs.DirEntry {
+	var names []string
+	for name := range fsys.entries {
+		if name != "." && path.Dir(name) == dir {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	entries := make([]fs.DirEntry, 0, len(names))
+	for _, name := range names {
+		e := fsys.entries[name]
+		size, _ := fsys.size(e)
+		entries = append(entries, fs.FileInfoToDirEntry(&fileInfo{name: name, e: e, size: size}))
+	}
+	return entries
+}
+
+// Mkdir creates a directory named name with permission perm.
+func (fsys *zipfs) Mkdir(name string, perm fs.FileMode) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	if err := fsys.checkParent("Mkdir", name); err != nil {
+		return err
+	}
+
+	if _, ok := fsys.entries[name]; ok {
+		return pathError("Mkdir", name, fs.ErrExist)
+	}
+
+	fsys.entries[name] = &entry{
+		seq:      fsys.seq(),
+		mode:     fs.ModeDir | perm.Perm(),
+		mtime:    time.Now(),
+		modified: true,
+	}
+	pathtree.Touch(fsys.entries, name)
+
+	return nil
+}
+
+// Remove removes the named file or empty directory.
+func (fsys *zipfs) Remove(name string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	e, err := fsys.lookup("Remove", name)
+	if err != nil {
+		return err
+	}
+
+	if name == "." {
+		return pathError("Remove", name, fs.ErrInvalid)
+	}
+
+	if e.isDir() && pathtree.HasChildren(fsys.entries, name) {
+		return pathError("Remove", name, fsx.ErrDirNotEmpty)
+	}
+
+	delete(fsys.entries, name)
+	pathtree.Touch(fsys.entries, name)
+
+	return fsys.unstage(e)
+}
+
+// RemoveAll removes name and all of its children. It returns nil if name does
+// not exist.
+func (fsys *zipfs) RemoveAll(name string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	if _, err := fsys.lookup("RemoveAll", name); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	if name == "." {
+		return pathError("RemoveAll", name, fs.ErrInvalid)
+	}
+
+	var err error
+	for p, e := range fsys.entries {
+		if p == name || strings.HasPrefix(p, name+"/") {
+			delete(fsys.entries, p)
+			if uerr := fsys.unstage(e); uerr != nil && err == nil {
+				err = uerr
+			}
+		}
+	}
+	pathtree.Touch(fsys.entries, name)
+
+	return err
+}
+
+// Rename renames oldpath to newpath. If newpath exists and is not a
+// directory, it is replaced.
+func (fsys *zipfs) Rename(oldpath, newpath string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	e, err := fsys.lookup("Rename", oldpath)
+	if err != nil {
+		return err
+	}
+
+	if oldpath == "." {
+		return pathError("Rename", oldpath, fs.ErrInvalid)
+	}
+
+	if err := fsys.checkParent("Rename", newpath); err != nil {
+		return err
+	}
+
+	if oldpath == newpath {
+		return nil
+	}
+
+	if strings.HasPrefix(newpath, oldpath+"/") {
+		return pathError("Rename", newpath, fs.ErrInvalid)
+	}
+
+	if existing, ok := fsys.entries[newpath]; ok {
+		switch {
+		case existing.isDir() != e.isDir():
+			return pathError("Rename", newpath, fs.ErrExist)
+		case existing.isDir() && pathtree.HasChildren(fsys.entries, newpath):
+			return pathError("Rename", newpath, fsx.ErrDirNotEmpty)
+		}
+
+		delete(fsys.entries, newpath)
+		if err := fsys.unstage(existing); err != nil {
+			return err
+		}
+	}
+
+	for p, c := range fsys.entries {
+		if p == oldpath {
+			delete(fsys.entries, p)
+			fsys.entries[newpath] = c
+		} else if strings.HasPrefix(p, oldpath+"/") {
+			delete(fsys.entries, p)
+			fsys.entries[newpath+p[len(oldpath):]] = c
+		}
+	}
+
+	e.implicit = false
+	pathtree.Touch(fsys.entries, oldpath)
+	pathtree.Touch(fsys.entries, newpath)
+
+	return nil
+}
+
+// SameFile reports whether fi1 and fi2 describe the same entry.
+func (fsys *zipfs) SameFile(fi1, fi2 fs.FileInfo) bool {
+	i1, ok := fi1.(*fileInfo)
+	if !ok {
+		return false
+	}
+
+	i2, ok := fi2.(*fileInfo)
+	if !ok {
+		return false
+	}
+
+	return i1.e == i2.e
+}
+
+// -- fsx.ChmodFS, fsx.ChtimesFS
+
+// Chmod changes the permission of the named file.
+func (fsys *zipfs) Chmod(name string, mode fs.FileMode) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	e, err := fsys.lookup("Chmod", name)
+	if err != nil {
+		return err
+	}
+
+	e.mode = e.mode.Type() | mode.Perm()
+	e.modified = true
+	e.implicit = false
+
+	return nil
+}
+
+// Chtimes changes the modification time of the named file. zip archives do
+// not store access times; atime is ignored. A zero mtime keeps the current
+// value.
+func (fsys *zipfs) Chtimes(name string, atime, mtime time.Time) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	e, err := fsys.lookup("Chtimes", name)
+	if err != nil {
+		return err
+	}
+
+	if !mtime.IsZero() {
+		e.mtime = mtime
+		e.modified = true
+		e.implicit = false
+	}
+
+	return nil
+}
+
+// -- fs.StatFS, fs.ReadDirFS
+
+// Stat returns a fs.FileInfo describing the named file. The info's Sys method
+// returns the *zip.FileHeader from the source archive.
+func (fsys *zipfs) Stat(name string) (fs.FileInfo, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	e, err := fsys.lookup("Stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	return fsys.stat(name, e)
+}
+
+// ReadDir returns the sorted entries of the named directory.
+func (fsys *zipfs) ReadDir(name string) ([]fs.DirEntry, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	e, err := fsys.lookup("ReadDir", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !e.isDir() {
+		return nil, pathError("ReadDir", name, fs.ErrInvalid)
+	}
+
+	return fsys.readDir(name), nil
+}
+
+var _ FS = &zipfs{}
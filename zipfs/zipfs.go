@@ -0,0 +1,390 @@
+// Package zipfs provides a writable filesystem backed by a zip archive.
+//
+// A zipfs reads the archive's central directory on creation but reads the
+// content of entries lazily from the io.ReaderAt passed to Open. Entries
+// stored without compression support random access; compressed entries are
+// decompressed as needed.
+//
+// Modifications are staged in a scratch fsx.FS (an in-memory filesystem by
+// default) and the source archive is never modified. Commit writes a new
+// archive containing all modifications. Unmodified entries are copied without
+// recompressing them. Entries keep their order from the source archive; new
+// entries are appended in creation order. This keeps archives such as JAR
+// files valid which expect certain entries (e.g. the manifest) to come first.
+//
+// Symlinks stored in an archive are reported with fs.ModeSymlink but are not
+// followed. zipfs does not enforce file permissions.
+package zipfs
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/memfs"
+)
+
+// MethodFunc selects the compression method used to write the entry name.
+// current contains the entry's method from the source archive or
+// zip.Deflate for new entries. Returning current leaves the compression of
+// unmodified entries as is; returning a different method causes the entry to
+// be recompressed.
+type MethodFunc func(name string, current uint16) uint16
+
+// Option defines a functional option for Open and New.
+type Option func(*options)
+
+type options struct {
+	scratch fsx.FS
+	method  MethodFunc
+}
+
+// WithScratch sets the filesystem used to stage modified files. zipfs
+// creates uniquely named files in scratch's root directory and removes them
+// when the filesystem is closed; scratch must not be shared between
+// filesystems. Defaults to an in-memory filesystem.
+func WithScratch(scratch fsx.FS) Option {
+	return func(o *options) {
+		o.scratch = scratch
+	}
+}
+
+// WithMethod sets the function used to select each entry's compression
+// method when calling Commit.
+func WithMethod(fn MethodFunc) Option {
+	return func(o *options) {
+		o.method = fn
+	}
+}
+
+// FS defines the interface of a zip-backed filesystem.
+type FS interface {
+	fsx.FS
+	fsx.ChmodFS
+	fsx.ChtimesFS
+	fsx.RemoveAllFS
+	fs.StatFS
+	fs.ReadDirFS
+
+	// Commit writes a new archive containing all entries and modifications
+	// to w. The filesystem can be used after calling Commit.
+	Commit(w io.Writer) error
+
+	// Close removes all staged files from the scratch filesystem. The
+	// filesystem must not be used after Close.
+	Close() error
+}
+
+// entry holds the metadata of a single archive entry.
+type entry struct {
+	// seq defines the position of the entry in the written archive.
+	seq   int
+	mode  fs.FileMode
+	mtime time.Time
+	// src is the entry in the source archive or nil for new entries.
+	src *zip.File
+	// staged contains the name of the file in the scratch filesystem holding
+	// the entry's content once it has been modified.
+	staged string
+	// modified is set when the entry's metadata has been changed.
+	modified bool
+	// implicit marks directories that have no entry of their own in the
+	// source archive.
+	implicit bool
+}
+
+func (e *entry) isDir() bool { return e.mode.IsDir() }
+
+// Touch marks the directory e as modified at t.
+func (e *entry) Touch(t time.Time) {
+	e.mtime = t
+	e.modified = true
+	e.implicit = false
+}
+
+type zipfs struct {
+	mu      sync.Mutex
+	r       io.ReaderAt
+	entries map[string]*entry
+	comment string
+	opts    options
+	nextSeq int
+	nextID  int
+	closed  bool
+}
+
+// New creates a new filesystem for an empty archive.
+func New(opts ...Option) FS {
+	fsys := &zipfs{
+		entries: map[string]*entry{
+			".": {mode: fs.ModeDir | 0755, implicit: true},
+		},
+	}
+
+	for _, opt := range opts {
+		opt(&fsys.opts)
+	}
+
+	if fsys.opts.scratch == nil {
+		fsys.opts.scratch = memfs.New()
+	}
+
+	return fsys
+}
+
+// Open opens the zip archive of the given size read from r.
+func Open(r io.ReaderAt, size int64, opts ...Option) (FS, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	fsys := New(opts...).(*zipfs)
+	fsys.r = r
+	fsys.comment = zr.Comment
+
+	for _, f := range zr.File {
+		name := cleanName(f.Name)
+		if !fs.ValidPath(name) || strings.HasPrefix(f.Name, "/") {
+			return nil, &fs.PathError{
+				Op:   "Open",
+				Path: f.Name,
+				Err:  fs.ErrInvalid,
+			}
+		}
+
+		e := &entry{
+			mode:  f.Mode(),
+			mtime: f.Modified,
+			src:   f,
+		}
+
+		if strings.HasSuffix(f.Name, "/") {
+			e.mode = fs.ModeDir | e.mode.Perm()
+		}
+
+		if name == "." {
+			continue
+		}
+
+		fsys.ensureParents(name)
+		e.seq = fsys.seq()
+		fsys.entries[name] = e
+	}
+
+	return fsys, nil
+}
+
+// cleanName converts a name found in an archive to a fs path.
+func cleanName(name string) string {
+	name = path.Clean(strings.TrimSuffix(name, "/"))
+	if name == "" || name == "/" {
+		return "."
+	}
+	return name
+}
+
+func (fsys *zipfs) seq() int {
+	fsys.nextSeq++
+	return fsys.nextSeq
+}
+
+// ensureParents creates implicit directories for all missing parents of name.
+func (fsys *zipfs) ensureParents(name string) {
+	for d := path.Dir(name); d != "."; d = path.Dir(d) {
+		if _, ok := fsys.entries[d]; ok {
+			return
+		}
+		fsys.entries[d] = &entry{
+			seq:      fsys.seq(),
+			mode:     fs.ModeDir | 0755,
+			implicit: true,
+		}
+	}
+}
+
+// method returns the compression method to use for the entry name.
+func (fsys *zipfs) method(name string, e *entry) uint16 {
+	current := zip.Deflate
+	if e.src != nil {
+		current = e.src.Method
+	}
+
+	if fsys.opts.method != nil {
+		return fsys.opts.method(name, current)
+	}
+
+	return current
+}
+
+// -- Writing
+
+// Commit writes the archive to w.
+func (fsys *zipfs) Commit(w io.Writer) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	if fsys.closed {
+		return fs.ErrClosed
+	}
+
+	names := make([]string, 0, len(fsys.entries))
+	for name, e := range fsys.entries {
+		if name != "." && !e.implicit {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return fsys.entries[names[i]].seq < fsys.entries[names[j]].seq
+	})
+
+	zw := zip.NewWriter(w)
+	if fsys.comment != "" {
+		if err := zw.SetComment(fsys.comment); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range names {
+		if err := fsys.writeEntry(zw, name, fsys.entries[name]); err != nil {
+			return fmt.Errorf("zipfs: failed to write %s: %w", name, err)
+		}
+	}
+
+	return zw.Close()
+}
+
+// header creates a zip header for e stored as name.
+func (fsys *zipfs) header(name string, e *entry) *zip.FileHeader {
+	hdr := &zip.FileHeader{
+		Name:     name,
+		Method:   fsys.method(name, e),
+		Modified: e.mtime,
+	}
+
+	if e.src != nil {
+		hdr.Comment = e.src.Comment
+	}
+
+	if e.isDir() {
+		hdr.Name += "/"
+		hdr.Method = zip.Store
+	}
+
+	hdr.SetMode(e.mode)
+
+	return hdr
+}
+
+func (fsys *zipfs) writeEntry(zw *zip.Writer, name string, e *entry) error {
+	if e.src != nil && e.staged == "" && !e.modified && e.src.Name == name+dirSuffix(e) && fsys.method(name, e) == e.src.Method {
+		return zw.Copy(e.src)
+	}
+
+	hdr := fsys.header(name, e)
+
+	if e.isDir() {
+		_, err := zw.CreateHeader(hdr)
+		return err
+	}
+
+	if e.staged == "" && e.src != nil && hdr.Method == e.src.Method {
+		// Only metadata has changed; copy the compressed data.
+		hdr.CRC32 = e.src.CRC32
+		hdr.CompressedSize64 = e.src.CompressedSize64
+		hdr.UncompressedSize64 = e.src.UncompressedSize64
+		// CreateRaw does not encode Modified; add the legacy MS-DOS time and
+		// the extended timestamp as done by CreateHeader.
+		hdr.SetModTime(e.mtime)
+		hdr.Extra = extendedTimestamp(e.mtime)
+
+		out, err := zw.CreateRaw(hdr)
+		if err != nil {
+			return err
+		}
+
+		in, err := e.src.OpenRaw()
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(out, in)
+		return err
+	}
+
+	out, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+
+	in, err := fsys.openContent(e)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// extendedTimestamp encodes t as an extended timestamp extra field holding
+// the modification time.
+func extendedTimestamp(t time.Time) []byte {
+	var buf [9]byte
+	binary.LittleEndian.PutUint16(buf[0:], 0x5455)
+	binary.LittleEndian.PutUint16(buf[2:], 5)
+	buf[4] = 1
+	binary.LittleEndian.PutUint32(buf[5:], uint32(t.Unix()))
+	return buf[:]
+}
+
+func dirSuffix(e *entry) string {
+	if e.isDir() {
+		return "/"
+	}
+	return ""
+}
+
+// openContent opens a reader for e's current content.
+func (fsys *zipfs) openContent(e *entry) (io.ReadCloser, error) {
+	if e.staged != "" {
+		return fsys.opts.scratch.Open(e.staged)
+	}
+
+	if e.src != nil {
+		return e.src.Open()
+	}
+
+	return io.NopCloser(strings.NewReader("")), nil
+}
+
+// Close removes all staged files and closes fsys.
+func (fsys *zipfs) Close() error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	if fsys.closed {
+		return fs.ErrClosed
+	}
+	fsys.closed = true
+
+	var err error
+	for _, e := range fsys.entries {
+		if e.staged != "" {
+			if rerr := fsys.opts.scratch.Remove(e.staged); rerr != nil && err == nil {
+				err = rerr
+			}
+			e.staged = ""
+		}
+	}
+
+	return err
+}
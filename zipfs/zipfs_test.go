@@ -0,0 +1,257 @@
+package zipfs
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/halimath/expect"
+	"github.com/halimath/expect/is"
+	. "github.com/halimath/fixture"
+	"github.com/halimath/fsx"
+	"github.com/halimath/fsx/memfs"
+)
+
+var mtime = time.Date(2023, 5, 17, 10, 30, 0, 0, time.UTC)
+
+type testEntry struct {
+	name   string
+	mode   fs.FileMode
+	method uint16
+	data   string
+}
+
+func createZip(t *testing.T, entries ...testEntry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	for _, e := range entries {
+		hdr := &zip.FileHeader{
+			Name:     e.name,
+			Method:   e.method,
+			Modified: mtime,
+		}
+		hdr.SetMode(e.mode)
+
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := zw.SetComment("sample"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func sampleZip(t *testing.T) []byte {
+	return createZip(t,
+		testEntry{name: "META-INF/MANIFEST.MF", mode: 0644, method: zip.Deflate, data: "Manifest-Version: 1.0\n"},
+		testEntry{name: "com/", mode: fs.ModeDir | 0755},
+		testEntry{name: "com/example/Main.class", mode: 0644, method: zip.Store, data: "0123456789"},
+		testEntry{name: "bin/run.sh", mode: 0755, method: zip.Deflate, data: "#!/bin/sh\necho hello\n"},
+	)
+}
+
+type zipfsFixture struct {
+	fs FS
+}
+
+func (f *zipfsFixture) BeforeEach(t *testing.T) error {
+	data := sampleZip(t)
+
+	var err error
+	f.fs, err = Open(bytes.NewReader(data), int64(len(data)))
+	return err
+}
+
+func (f *zipfsFixture) commit(t *testing.T) *zip.Reader {
+	var buf bytes.Buffer
+	if err := f.fs.Commit(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return zr
+}
+
+func names(zr *zip.Reader) []string {
+	n := make([]string, len(zr.File))
+	for i, f := range zr.File {
+		n[i] = f.Name
+	}
+	return n
+}
+
+func TestZipfs(t *testing.T) {
+	With(t, new(zipfsFixture)).
+		Run("read", func(t *testing.T, f *zipfsFixture) {
+			expect.That(t, is.NoError(fstest.TestFS(f.fs, "META-INF/MANIFEST.MF", "com/example/Main.class", "bin/run.sh")))
+
+			info, err := f.fs.Stat("bin/run.sh")
+			expect.That(t,
+				is.NoError(err),
+				is.EqualTo(info.Mode(), 0755),
+				is.EqualTo(info.ModTime().UTC(), mtime),
+				is.EqualTo(info.Size(), int64(21)),
+			)
+		}).
+		Run("seek", func(t *testing.T, f *zipfsFixture) {
+			for _, name := range []string{"com/example/Main.class", "META-INF/MANIFEST.MF"} {
+				file, err := f.fs.Open(name)
+				expect.That(t, expect.FailNow(is.NoError(err)))
+
+				s := file.(io.Seeker)
+				_, err = s.Seek(3, fsx.SeekWhenceRelativeOrigin)
+				expect.That(t, is.NoError(err))
+
+				buf := make([]byte, 4)
+				_, err = io.ReadFull(file, buf)
+				expect.That(t, is.NoError(err))
+
+				_, err = s.Seek(0, fsx.SeekWhenceRelativeOrigin)
+				expect.That(t, is.NoError(err))
+
+				all, err := io.ReadAll(file)
+				expect.That(t, is.NoError(err), is.EqualTo(string(buf), string(all[3:7])), is.NoError(file.Close()))
+			}
+		}).
+		Run("readAtStored", func(t *testing.T, f *zipfsFixture) {
+			file, err := f.fs.Open("com/example/Main.class")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			defer file.Close()
+
+			buf := make([]byte, 3)
+			_, err = file.(io.ReaderAt).ReadAt(buf, 5)
+			expect.That(t, is.NoError(err), is.EqualTo(string(buf), "567"))
+		}).
+		Run("unmodifiedRoundTrip", func(t *testing.T, f *zipfsFixture) {
+			zr := f.commit(t)
+
+			expect.That(t,
+				is.DeepEqualTo(names(zr), []string{"META-INF/MANIFEST.MF", "com/", "com/example/Main.class", "bin/run.sh"}),
+				is.EqualTo(zr.Comment, "sample"),
+				is.EqualTo(zr.File[2].Method, zip.Store),
+				is.EqualTo(zr.File[3].Mode(), 0755),
+			)
+		}).
+		Run("modify", func(t *testing.T, f *zipfsFixture) {
+			expect.That(t, expect.FailNow(
+				is.NoError(fsx.WriteFile(f.fs, "bin/run.sh", []byte("#!/bin/sh\necho patched\n"), 0644)),
+				is.NoError(fsx.WriteFile(f.fs, "com/example/Other.class", []byte("other"), 0600)),
+				is.NoError(f.fs.Chtimes("com/example/Main.class", time.Time{}, mtime.Add(time.Hour))),
+				is.NoError(f.fs.Chmod("com/example/Main.class", 0600)),
+			))
+
+			zr := f.commit(t)
+			expect.That(t, is.DeepEqualTo(names(zr), []string{"META-INF/MANIFEST.MF", "com/", "com/example/", "com/example/Main.class", "bin/run.sh", "com/example/Other.class"}))
+
+			content, err := fs.ReadFile(zr, "bin/run.sh")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "#!/bin/sh\necho patched\n"))
+
+			info, err := fs.Stat(zr, "bin/run.sh")
+			expect.That(t, is.NoError(err), is.EqualTo(info.Mode(), 0755))
+
+			info, err = fs.Stat(zr, "com/example/Main.class")
+			expect.That(t,
+				is.NoError(err),
+				is.EqualTo(info.Mode(), 0600),
+				is.EqualTo(info.ModTime().UTC(), mtime.Add(time.Hour)),
+			)
+
+			content, err = fs.ReadFile(zr, "com/example/Main.class")
+			expect.That(t, is.NoError(err), is.EqualTo(string(content), "0123456789"))
+		}).
+		Run("removeAndRename", func(t *testing.T, f *zipfsFixture) {
+			expect.That(t, expect.FailNow(
+				is.Error(f.fs.Remove("com"), fsx.ErrDirNotEmpty),
+				is.NoError(f.fs.Rename("com", "org")),
+				is.NoError(f.fs.Remove("META-INF/MANIFEST.MF")),
+				is.NoError(f.fs.RemoveAll("bin")),
+				is.NoError(f.fs.RemoveAll("bin")),
+			))
+
+			_, err := f.fs.Stat("com/example/Main.class")
+			expect.That(t, is.Error(err, fs.ErrNotExist))
+
+			zr := f.commit(t)
+			expect.That(t, is.DeepEqualTo(names(zr), []string{"META-INF/", "org/", "org/example/Main.class"}))
+		}).
+		Run("errors", func(t *testing.T, f *zipfsFixture) {
+			_, err := f.fs.OpenFile("bin/run.sh", fsx.O_WRONLY|fsx.O_CREATE|fsx.O_EXCL, 0644)
+			expect.That(t,
+				is.Error(err, fs.ErrExist),
+				is.Error(f.fs.Mkdir("com", 0755), fs.ErrExist),
+				is.Error(f.fs.Mkdir("missing/dir", 0755), fs.ErrNotExist),
+				is.Error(f.fs.Mkdir("bin/run.sh/dir", 0755), fs.ErrInvalid),
+				is.Error(f.fs.Rename("com", "com/sub"), fs.ErrInvalid),
+			)
+
+			file, err := f.fs.Open("bin/run.sh")
+			expect.That(t, expect.FailNow(is.NoError(err)))
+			_, err = file.(fsx.File).Write([]byte("x"))
+			expect.That(t, is.Error(err, fs.ErrPermission))
+		}).
+		Run("closeRemovesStagedFiles", func(t *testing.T, f *zipfsFixture) {
+			expect.That(t, expect.FailNow(
+				is.NoError(fsx.WriteFile(f.fs, "bin/run.sh", []byte("patched"), 0644)),
+				is.NoError(f.fs.Close()),
+			))
+
+			expect.That(t, is.Error(f.fs.Commit(io.Discard), fs.ErrClosed))
+		})
+}
+
+func TestScratchAndMethod(t *testing.T) {
+	scratch := memfs.New()
+
+	fsys := New(WithScratch(scratch), WithMethod(func(name string, current uint16) uint16 {
+		if name == "data.bin" {
+			return zip.Store
+		}
+		return current
+	}))
+
+	expect.That(t, expect.FailNow(
+		is.NoError(fsx.WriteFile(fsys, "data.bin", []byte("binary"), 0644)),
+		is.NoError(fsx.WriteFile(fsys, "text.txt", []byte("text"), 0644)),
+	))
+
+	staged, err := fs.ReadDir(scratch, ".")
+	expect.That(t, is.NoError(err), is.SliceOfLen(staged, 2))
+
+	var buf bytes.Buffer
+	expect.That(t, expect.FailNow(is.NoError(fsys.Commit(&buf))))
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	expect.That(t, expect.FailNow(is.NoError(err)))
+	expect.That(t,
+		is.DeepEqualTo(names(zr), []string{"data.bin", "text.txt"}),
+		is.EqualTo(zr.File[0].Method, zip.Store),
+		is.EqualTo(zr.File[1].Method, zip.Deflate),
+	)
+
+	expect.That(t, is.NoError(fsys.Close()))
+
+	staged, err = fs.ReadDir(scratch, ".")
+	expect.That(t, is.NoError(err), is.SliceOfLen(staged, 0))
+}